@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// With access control configured, the admin and management APIs require
+// a bearer token, whose role limits what it can do: viewers only read,
+// operators change nodes, canaries and quarantines, and only admins can
+// do what loses data or reboots nodes, like reinstalling, removing nodes
+// and their leases, upgrades and importing state. As the tokens protect
+// the APIs, they may then listen on other than loopback addresses, but
+// only over TLS, with the certificate of --tls-cert or issued by the CA
+// of --mtls, so that the tokens never cross the network in the clear.
+
+// The token subcommands read TALOS_PXE_TOKEN to authenticate with, and
+// TALOS_PXE_CA for the CA to check the certificate of APIs on other than
+// loopback addresses with, besides the system roots.
+const (
+	accessTokenEnv = "TALOS_PXE_TOKEN"
+	accessCAEnv    = "TALOS_PXE_CA"
+)
+
+type accessRole int
+
+const (
+	roleViewer accessRole = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var accessRoleNames = map[string]accessRole{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+func (r accessRole) String() string {
+	for name, role := range accessRoleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// AccessConfig lists who may use the admin and management APIs.
+type AccessConfig struct {
+	Tokens []AccessToken `json:"tokens,omitempty"`
+	// OIDC signs users in with the organization's identity provider.
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// An AccessToken is stored as its SHA-256, as printed by `talos-pxe
+// access token`.
+type AccessToken struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	SHA256 string `json:"sha256"`
+}
+
+func (c *AccessConfig) check() error {
+	seen := make(map[string]bool)
+	for i, t := range c.Tokens {
+		if t.Name == "" {
+			return fmt.Errorf("token %d needs a name", i)
+		}
+		if _, ok := accessRoleNames[t.Role]; !ok {
+			return fmt.Errorf("token %s: unknown role %q", t.Name, t.Role)
+		}
+		if sum, err := hex.DecodeString(t.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("token %s: invalid sha256", t.Name)
+		}
+		if seen[strings.ToLower(t.SHA256)] {
+			return fmt.Errorf("token %s: duplicate token", t.Name)
+		}
+		seen[strings.ToLower(t.SHA256)] = true
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.check(); err != nil {
+			return fmt.Errorf("oidc: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *AccessConfig) enabled() bool {
+	return len(c.Tokens) > 0 || c.OIDC != nil
+}
+
+// accessIdentity is who made an API request.
+type accessIdentity struct {
+	Name string
+	Role accessRole
+}
+
+type accessIdentityKey struct{}
+
+func withAccessIdentity(ctx context.Context, id *accessIdentity) context.Context {
+	return context.WithValue(ctx, accessIdentityKey{}, id)
+}
+
+func accessIdentityFrom(ctx context.Context) *accessIdentity {
+	id, _ := ctx.Value(accessIdentityKey{}).(*accessIdentity)
+	return id
+}
+
+type accessControl struct {
+	tokens map[string]*accessIdentity
+	// With OIDC, the provider and the minter of the tokens of signed in
+	// users.
+	oidc   *oidcProvider
+	minter *tokenMinter
+}
+
+// newAccessControl sets up the access config, the tokens of signed in
+// users being signed with the key.
+func newAccessControl(config *AccessConfig, key []byte) *accessControl {
+	ac := &accessControl{tokens: make(map[string]*accessIdentity)}
+	for _, t := range config.Tokens {
+		ac.tokens[strings.ToLower(t.SHA256)] = &accessIdentity{Name: t.Name, Role: accessRoleNames[t.Role]}
+	}
+	if config.OIDC != nil {
+		ac.oidc = newOIDCProvider(config.OIDC)
+		ac.minter = &tokenMinter{key: key}
+	}
+	return ac
+}
+
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the identity of the token, nil if it's unknown.
+func (ac *accessControl) authenticate(token string) *accessIdentity {
+	if token == "" {
+		return nil
+	}
+	if strings.HasPrefix(token, mintedTokenPrefix) && ac.minter != nil {
+		return ac.minter.verify(token)
+	}
+	return ac.tokens[accessTokenHash(token)]
+}
+
+func bearerToken(header string) string {
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// allowed tells whether the caller has at least the role. Without access
+// control everyone has.
+func (s *Server) allowed(ctx context.Context, role accessRole) bool {
+	if s.access == nil {
+		return true
+	}
+	id := accessIdentityFrom(ctx)
+	return id != nil && id.Role >= role
+}
+
+// authorize writes 403 and returns false if the request doesn't have the
+// role.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, role accessRole) bool {
+	if s.allowed(req.Context(), role) {
+		return true
+	}
+	accessChecks.WithLabelValues("admin", "forbidden").Inc()
+	http.Error(w, fmt.Sprintf("Requires the %s role", role), http.StatusForbidden)
+	return false
+}
+
+// requireRole returns a PermissionDenied error if the call doesn't have
+// the role.
+func (s *Server) requireRole(ctx context.Context, role accessRole) error {
+	if s.allowed(ctx, role) {
+		return nil
+	}
+	accessChecks.WithLabelValues("management", "forbidden").Inc()
+	return status.Errorf(codes.PermissionDenied, "requires the %s role", role)
+}
+
+// httpMethodRole is the role needed for the method, reads being allowed
+// to viewers. Handlers ask for more for destructive changes.
+func httpMethodRole(req *http.Request) accessRole {
+	if strings.HasPrefix(req.URL.Path, "/debug/") {
+		return roleAdmin
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return roleViewer
+	}
+	return roleOperator
+}
+
+// accessHandler authenticates the requests to the admin API.
+func (s *Server) accessHandler(next http.Handler) http.Handler {
+	if s.access == nil {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		// Signing in.
+		if strings.HasPrefix(req.URL.Path, "/auth/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		token := bearerToken(req.Header.Get("Authorization"))
+		// The session cookie of the browser of a signed in user only
+		// reads, so that other sites can't make it change anything.
+		if cookie, err := req.Cookie(sessionCookie); err == nil && token == "" && httpMethodRole(req) == roleViewer {
+			token = cookie.Value
+		}
+		id := s.access.authenticate(token)
+		if id == nil {
+			accessChecks.WithLabelValues("admin", "unauthenticated").Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="talos-pxe"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		req = req.WithContext(withAccessIdentity(req.Context(), id))
+		if !s.authorize(w, req, httpMethodRole(req)) {
+			return
+		}
+		accessChecks.WithLabelValues("admin", "allowed").Inc()
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// managementRoles are the roles needed for the management methods.
+// Methods change nodes for operators unless listed, and read for viewers
+// if they start with List, Get, Watch or Export.
+var managementRoles = map[string]accessRole{
+	"RemoveNode":       roleAdmin,
+	"RemoveEtcdMember": roleAdmin,
+	"ReconcileNode":    roleAdmin,
+	"StartUpgrade":     roleAdmin,
+	"ImportState":      roleAdmin,
+	// Shows the machine configs.
+	"GetConfigDiff": roleAdmin,
+	// Lifts the freeze.
+	"OpenProvisioning": roleAdmin,
+}
+
+func managementMethodRole(fullMethod string) accessRole {
+	if !strings.HasPrefix(fullMethod, "/"+managementService+"/") {
+		// Reflection.
+		return roleViewer
+	}
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if role, ok := managementRoles[method]; ok {
+		return role
+	}
+	for _, prefix := range []string{"List", "Get", "Watch", "Export"} {
+		if strings.HasPrefix(method, prefix) {
+			return roleViewer
+		}
+	}
+	return roleOperator
+}
+
+// authenticateCall checks the bearer token in the metadata of a
+// management call, returning the context with its identity.
+func (s *Server) authenticateCall(ctx context.Context, fullMethod string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = bearerToken(values[0])
+		}
+	}
+
+	id := s.access.authenticate(token)
+	if id == nil {
+		accessChecks.WithLabelValues("management", "unauthenticated").Inc()
+		return nil, status.Error(codes.Unauthenticated, "missing or unknown token")
+	}
+
+	ctx = withAccessIdentity(ctx, id)
+	if err := s.requireRole(ctx, managementMethodRole(fullMethod)); err != nil {
+		return nil, err
+	}
+	accessChecks.WithLabelValues("management", "allowed").Inc()
+	return ctx, nil
+}
+
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// managementAccessOptions are the options of the management server
+// authenticating the calls.
+func (s *Server) managementAccessOptions() []grpc.ServerOption {
+	if s.access == nil {
+		return nil
+	}
+
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := s.authenticateCall(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := s.authenticateCall(stream.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &identityStream{stream, ctx})
+		}),
+	}
+}
+
+// tokenCredentials sends the token of the environment with the calls of
+// the subcommands.
+type tokenCredentials struct {
+	token string
+	// secure is false for loopback addresses, served without TLS.
+	secure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// checkAPIAddr checks that the API can listen on the address: loopback
+// addresses only without access control, and TLS on others.
+func (s *Server) checkAPIAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	err := checkLoopbackAddr(addr)
+	if err == nil {
+		return nil
+	}
+	if s.access == nil {
+		return fmt.Errorf("%s, which needs access control", err)
+	}
+	if s.TLSCert == "" && !s.MTLS {
+		return fmt.Errorf("%s, which needs --tls-cert or --mtls to serve it over TLS", err)
+	}
+	return nil
+}
+
+// apiTLSConfig is the TLS config of the API listening on the address, nil
+// for loopback addresses.
+func (s *Server) apiTLSConfig(addr string) (*tls.Config, error) {
+	if checkLoopbackAddr(addr) == nil {
+		return nil, nil
+	}
+	config, err := s.httpsConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.NoClientCert
+	return config, nil
+}
+
+// apiClientTLS is the TLS config of the subcommands calling the API on
+// the address, nil for loopback addresses.
+func apiClientTLS(addr string) (*tls.Config, error) {
+	if checkLoopbackAddr(addr) == nil {
+		return nil, nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if name := os.Getenv(accessCAEnv); name != "" {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates in %s", name)
+		}
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// runAccess creates tokens for the access config.
+func runAccess(args []string) error {
+	flags := flag.NewFlagSet("access", flag.ExitOnError)
+	nameFlag := flags.String("name", "", "Name of the token, recorded in the audit events")
+	roleFlag := flags.String("role", "viewer", "Role of the token, viewer, operator or admin")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "token" || *nameFlag == "" {
+		return fmt.Errorf("Usage: %s access token --name NAME [--role ROLE]", os.Args[0])
+	}
+	if _, ok := accessRoleNames[*roleFlag]; !ok {
+		return fmt.Errorf("Unknown role %q", *roleFlag)
+	}
+
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	entry, err := json.MarshalIndent(AccessToken{Name: *nameFlag, Role: *roleFlag, SHA256: accessTokenHash(token)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token: %s\n\nAdd to the access tokens of the config:\n%s\n", token, entry)
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The server keeps a short memory of what it's doing for the admin API:
+// the boot sessions of the clients seen recently and the last errors
+// logged.
+
+const (
+	bootSessionIdle = 10 * time.Minute
+	maxRecentErrors = 100
+)
+
+type BootSession struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip,omitempty"`
+	Stage     string    `json:"stage"`
+	Started   time.Time `json:"started"`
+	LastSeen  time.Time `json:"last_seen"`
+	Requests  int       `json:"requests"`
+	LastError string    `json:"last_error,omitempty"`
+	// The time the client last reported, and how far ahead of the
+	// server's it is in seconds, see clock.go.
+	ClientTime *time.Time `json:"client_time,omitempty"`
+	ClockSkew  float64    `json:"clock_skew,omitempty"`
+	// The switch port the client is on, if known, see switchports.go.
+	SwitchPort string `json:"switch_port,omitempty"`
+}
+
+type bootSessions struct {
+	lock    sync.Mutex
+	byMAC   map[string]*BootSession
+	ipToMac map[string]string
+	history map[string]*NodeTimeline
+	// exporter is sent the steps of the timelines.
+	exporter *eventExporter
+	// onMilestone is called with the time it took a client to reach a
+	// milestone of its boot, see bootmetrics.go.
+	onMilestone func(mac string, milestone string, took time.Duration)
+}
+
+func newBootSessions() *bootSessions {
+	return &bootSessions{
+		byMAC:   make(map[string]*BootSession),
+		ipToMac: make(map[string]string),
+		history: make(map[string]*NodeTimeline),
+	}
+}
+
+// seen records a request of the client in the given stage of its boot,
+// e.g. dhcp or tftp.
+func (bs *bootSessions) seen(mac net.HardwareAddr, stage string) {
+	if mac == nil {
+		return
+	}
+
+	now := time.Now()
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	sess, ok := bs.byMAC[mac.String()]
+	if !ok || now.Sub(sess.LastSeen) > bootSessionIdle {
+		sess = &BootSession{MAC: mac.String(), Started: now}
+		bs.byMAC[mac.String()] = sess
+	}
+	sess.Stage = stage
+	sess.LastSeen = now
+	sess.Requests++
+
+	if step := bs.stepLocked(mac.String(), stage, now); step != "" {
+		bs.exporter.boot(now, mac.String(), "boot.step", step)
+	}
+	if milestone, took := bs.milestoneLocked(mac.String(), stage, now); milestone != "" && bs.onMilestone != nil {
+		bs.onMilestone(mac.String(), milestone, took)
+	}
+}
+
+// seenIP is seen for requests only carrying the client's IP.
+func (bs *bootSessions) seenIP(ip net.IP, stage string) {
+	bs.seen(bs.lookupIP(ip), stage)
+}
+
+// lookupIP returns the MAC of the client with the IP, or nil if it's
+// unknown.
+func (bs *bootSessions) lookupIP(ip net.IP) net.HardwareAddr {
+	if ip == nil {
+		return nil
+	}
+
+	bs.lock.Lock()
+	mac, ok := bs.ipToMac[ip.String()]
+	bs.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	hw, _ := net.ParseMAC(mac)
+	return hw
+}
+
+func (bs *bootSessions) learnIP(mac net.HardwareAddr, ip net.IP) {
+	if mac == nil || ip == nil || ip.IsUnspecified() {
+		return
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	bs.ipToMac[ip.String()] = mac.String()
+	if sess, ok := bs.byMAC[mac.String()]; ok {
+		sess.IP = ip.String()
+	}
+}
+
+// failed records an error in the client's session.
+func (bs *bootSessions) failed(mac net.HardwareAddr, err error) {
+	if mac == nil || err == nil {
+		return
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if sess, ok := bs.byMAC[mac.String()]; ok {
+		sess.LastError = err.Error()
+	}
+	bs.stepFailedLocked(mac.String(), err)
+	bs.exporter.boot(time.Now(), mac.String(), "boot.error", err.Error())
+}
+
+// list returns the sessions active within bootSessionIdle, most recent
+// first, and forgets the others.
+func (bs *bootSessions) list() []BootSession {
+	now := time.Now()
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	out := make([]BootSession, 0, len(bs.byMAC))
+	for mac, sess := range bs.byMAC {
+		if now.Sub(sess.LastSeen) > bootSessionIdle {
+			delete(bs.byMAC, mac)
+			continue
+		}
+		out = append(out, *sess)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
+
+type LoggedError struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// errorLog is a logrus hook keeping the last warnings and errors.
+type errorLog struct {
+	lock    sync.Mutex
+	entries []LoggedError
+}
+
+func (el *errorLog) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (el *errorLog) Fire(entry *logrus.Entry) error {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	if len(el.entries) == maxRecentErrors {
+		el.entries = el.entries[1:]
+	}
+	el.entries = append(el.entries, LoggedError{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message})
+	return nil
+}
+
+// list returns the logged errors, most recent first.
+func (el *errorLog) list() []LoggedError {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	out := make([]LoggedError, len(el.entries))
+	for i, e := range el.entries {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+type Lease struct {
+	MAC         string    `json:"mac"`
+	IP          string    `json:"ip"`
+	Expires     time.Time `json:"expires"`
+	Quarantined bool      `json:"quarantined,omitempty"`
+	Pinned      bool      `json:"pinned,omitempty"`
+}
+
+func (s *Server) leases() []Lease {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	out := make([]Lease, 0, len(s.DHCPRecords))
+	for mac, record := range s.DHCPRecords {
+		out = append(out, Lease{MAC: mac, IP: record.IP.String(), Expires: record.expires.Round(time.Second), Quarantined: record.quarantined, Pinned: record.pinned})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+type DNSEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) leasesHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.leases())
+}
+
+func (s *Server) sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.withSwitchPorts(s.sessions.list()))
+}
+
+func (s *Server) dnsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, append(s.DNSRecords.Entries(), s.serviceEntries()...))
+}
+
+func (s *Server) errorsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.errorLog.list())
+}
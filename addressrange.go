@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// Node pools lease from blocks of their own, carved out of the
+// provisioning range like the quarantine range, so that their addresses
+// never mix with the others'.
+
+// AddressRange is a block of the subnet, from Start to End inclusive.
+type AddressRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (r *AddressRange) check() error {
+	start, end := net.ParseIP(r.Start).To4(), net.ParseIP(r.End).To4()
+	if start == nil || end == nil {
+		return fmt.Errorf("start and end have to be IPv4 addresses")
+	}
+	if bytes.Compare(start, end) > 0 {
+		return fmt.Errorf("start %s is after end %s", r.Start, r.End)
+	}
+	return nil
+}
+
+type addressRange struct {
+	name      string
+	start     net.IP
+	end       net.IP
+	allocator allocators.Allocator
+}
+
+// carveRange creates the allocator of the range and takes its addresses
+// out of the provisioning range.
+func (s *Server) carveRange(name string, config *AddressRange) (*addressRange, error) {
+	r := &addressRange{
+		name:  name,
+		start: net.ParseIP(config.Start).To4(),
+		end:   net.ParseIP(config.End).To4(),
+	}
+	if !s.Net.Contains(r.start) || !s.Net.Contains(r.end) {
+		return nil, fmt.Errorf("Range %s - %s of %s is not in %s", r.start, r.end, name, s.Net)
+	}
+	first, last := binary.BigEndian.Uint32(r.start), binary.BigEndian.Uint32(r.end)
+	for _, other := range s.addressRanges {
+		if _, _, ok := other.reserved(first, last); ok {
+			return nil, fmt.Errorf("Range of %s overlaps the range of %s", name, other.name)
+		}
+	}
+	if _, _, ok := s.quarantine.reserved(first, last); ok {
+		return nil, fmt.Errorf("Range of %s overlaps the quarantine range", name)
+	}
+
+	var err error
+	if r.allocator, err = bitmap.NewIPv4Allocator(r.start, r.end); err != nil {
+		return nil, err
+	}
+	for n := first; n <= last; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		reserveAddress(s.DHCPAllocator, ip)
+	}
+
+	s.addressRanges = append(s.addressRanges, r)
+	log.Infof("Leasing %s addresses from %s - %s", name, r.start, r.end)
+	return r, nil
+}
+
+func (r *addressRange) contains(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+// reserved returns the part of the range within start and end, if any.
+func (r *addressRange) reserved(start, end uint32) (uint32, uint32, bool) {
+	first := binary.BigEndian.Uint32(r.start)
+	last := binary.BigEndian.Uint32(r.end)
+	if first < start {
+		first = start
+	}
+	if last > end {
+		last = end
+	}
+	return first, last, first <= last
+}
+
+// allocatorOf returns the allocator the address of the lease is leased
+// from.
+func (s *Server) allocatorOf(record *DHCPRecord) allocators.Allocator {
+	if record.quarantined {
+		return s.quarantine.allocator
+	}
+	for _, r := range s.addressRanges {
+		if r.contains(record.IP) {
+			return r.allocator
+		}
+	}
+	return s.DHCPAllocator
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The admin server exposes runtime diagnostics, metrics and the API. Without access control
+// it is only ever bound to a loopback address, reach it through an SSH tunnel on appliances.
+// With it, it may listen on others, over TLS only.
+
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+
+	return nil
+}
+
+// publishVars exports the sizes of the server's record maps, which are
+// the structures most likely to grow on long running appliances, and
+// the DHCP pool usage.
+func (s *Server) publishVars() {
+	expvar.Publish("dhcp_records", expvar.Func(func() interface{} {
+		s.DHCPLock.Lock()
+		defer s.DHCPLock.Unlock()
+		return len(s.DHCPRecords)
+	}))
+	expvar.Publish("dns_records", expvar.Func(func() interface{} {
+		v4, v6, ptr := s.DNSRecords.Len()
+		return map[string]int{
+			"v4":  v4,
+			"v6":  v6,
+			"ptr": ptr,
+		}
+	}))
+	expvar.Publish("restarts", expvar.Func(func() interface{} {
+		return s.supervisor.Restarts()
+	}))
+
+	poolGauge := func(name, help string, value func(*poolStats) int) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "talos_pxe",
+			Subsystem: "dhcp_pool",
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			if stats := s.poolStats(); stats != nil {
+				return float64(value(stats))
+			}
+			return 0
+		})
+	}
+	poolGauge("addresses", "Addresses in the DHCP pool.", func(p *poolStats) int { return p.Total })
+	poolGauge("used_addresses", "Addresses leased out from the DHCP pool.", func(p *poolStats) int { return p.Used })
+	poolGauge("free_addresses", "Addresses left in the DHCP pool.", func(p *poolStats) int { return p.Free })
+	poolGauge("largest_free_block", "Largest contiguous block of free addresses in the DHCP pool.", func(p *poolStats) int { return p.LargestFreeBlock })
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	mux.HandleFunc("/grafana/dashboard.json", s.grafanaHandler)
+	mux.HandleFunc("/api/v1/pool", s.poolHandler)
+	mux.HandleFunc("/api/v1/leases", s.leasesHandler)
+	mux.HandleFunc("/api/v1/leases/stats", s.leaseStatsHandler)
+	mux.HandleFunc("/api/v1/leases/compact", s.leaseCompactHandler)
+	mux.HandleFunc("/api/v1/sessions", s.sessionsHandler)
+	mux.HandleFunc("/api/v1/timeline", s.timelineHandler)
+	mux.HandleFunc("/api/v1/timeline/", s.timelineHandler)
+	mux.HandleFunc("/api/v1/dns", s.dnsHandler)
+	mux.HandleFunc("/api/v1/dns/answers", s.answerPolicyHandler)
+	mux.HandleFunc("/api/v1/errors", s.errorsHandler)
+	mux.HandleFunc("/api/v1/nodes", s.nodesHandler)
+	mux.HandleFunc("/api/v1/nodes/", s.nodeHandler)
+	mux.HandleFunc("/api/v1/health", s.nodeHealthHandler)
+	mux.HandleFunc("/api/v1/drift", s.configDriftHandler)
+	mux.HandleFunc("/api/v1/preview", s.previewHandler)
+	mux.HandleFunc("/api/v1/versions", s.configVersionsHandler)
+	mux.HandleFunc("/api/v1/versions/", s.configVersionsHandler)
+	mux.HandleFunc("/api/v1/etcd/cleanup", s.etcdCleanupHandler)
+	mux.HandleFunc("/api/v1/etcd/cleanup/", s.etcdCleanupHandler)
+	mux.HandleFunc("/api/v1/audit", s.auditHandler)
+	mux.HandleFunc("/api/v1/upgrade", s.upgradeHandler)
+	mux.HandleFunc("/api/v1/canary", s.canaryHandler)
+	mux.HandleFunc("/api/v1/canary/promote", s.canaryPromoteHandler)
+	mux.HandleFunc("/api/v1/maintenance", s.maintenanceHandler)
+	mux.HandleFunc("/api/v1/quarantine", s.quarantineHandler)
+	mux.HandleFunc("/api/v1/jobs", s.jobsHandler)
+	mux.HandleFunc("/api/v1/jobs/", s.jobsHandler)
+	mux.HandleFunc("/api/v1/dhcp", s.dhcpHandler)
+	mux.HandleFunc("/api/v1/dhcp/", s.dhcpHandler)
+	mux.HandleFunc("/api/v1/provisioning", s.provisioningHandler)
+	mux.HandleFunc("/api/v1/state", s.stateHandler)
+	mux.HandleFunc("/api/v1/backups", s.backupsHandler)
+	mux.HandleFunc("/api/v1/openapi.json", s.openapiHandler)
+	if s.access != nil && s.access.oidc != nil {
+		mux.HandleFunc("/auth/login", s.oidcLoginHandler)
+		mux.HandleFunc("/auth/callback", s.oidcCallbackHandler)
+	}
+
+	return mux
+}
+
+func (s *Server) serveAdmin(l net.Listener) error {
+	config, err := s.apiTLSConfig(s.AdminAddr)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	if err := http.Serve(l, s.accessHandler(s.adminHandler())); err != nil {
+		return fmt.Errorf("Admin server shut down: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+)
+
+// Behind NAT, in a VM with port forwarding or with a floating VIP, the
+// address the server binds to isn't the one clients reach it on. With
+// --advertise-ip and --advertise-http-port, clients are told the latter:
+// in the next server and boot file of the DHCP replies, the chain URLs of
+// the menus and boot scripts, the DNS server and records of the server,
+// and the endpoints patched into the machine configs. The other ports have
+// to be forwarded as they are.
+
+// advertisedIP is the address clients reach the server on.
+func (s *Server) advertisedIP() net.IP {
+	if s.AdvertiseIP != nil {
+		return s.AdvertiseIP
+	}
+	return s.IP
+}
+
+// advertisedHTTPPort is the HTTP port clients reach the server on.
+func (s *Server) advertisedHTTPPort() int {
+	if s.AdvertiseHTTPPort != 0 {
+		return s.AdvertiseHTTPPort
+	}
+	return s.HTTPPort
+}
+
+// serverIPs are the addresses of the server, the bound one first.
+func (s *Server) serverIPs() []net.IP {
+	if s.AdvertiseIP == nil || s.AdvertiseIP.Equal(s.IP) {
+		return []net.IP{s.IP}
+	}
+	return []net.IP{s.IP, s.AdvertiseIP}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Without a VIP the controlplane name resolves to every controlplane node,
+// and most clients only try the first address. The order of the answers
+// is set by a policy, changed at runtime: by address, the default,
+// round-robin, rotating on every query, weighted, shuffled with the nodes
+// answering the health probe faster more likely to come first, or
+// primary, a given node first while it's healthy. Nodes are probed on the
+// Kubernetes API port with the weighted and primary orders, and the ones
+// not answering go last.
+
+const (
+	answerOrderAddress    = "address"
+	answerOrderRoundRobin = "round-robin"
+	answerOrderWeighted   = "weighted"
+	answerOrderPrimary    = "primary"
+
+	answerProbeInterval = 10 * time.Second
+	answerProbeTimeout  = 2 * time.Second
+)
+
+type AnswerPolicy struct {
+	Order string `json:"order"`
+	// Primary is the address answered first with the primary order.
+	Primary string `json:"primary,omitempty"`
+}
+
+func (p *AnswerPolicy) check() error {
+	switch p.Order {
+	case answerOrderAddress, answerOrderRoundRobin, answerOrderWeighted:
+		if p.Primary != "" {
+			return fmt.Errorf("primary only goes with the %s order", answerOrderPrimary)
+		}
+	case answerOrderPrimary:
+		if net.ParseIP(p.Primary).To4() == nil {
+			return fmt.Errorf("invalid primary address %q", p.Primary)
+		}
+	default:
+		return fmt.Errorf("unknown order %q, expected %s, %s, %s or %s", p.Order, answerOrderAddress, answerOrderRoundRobin, answerOrderWeighted, answerOrderPrimary)
+	}
+	return nil
+}
+
+func (p *AnswerPolicy) probed() bool {
+	return p.Order == answerOrderWeighted || p.Order == answerOrderPrimary
+}
+
+// ControlplaneProbe is the last health probe of a controlplane address.
+type ControlplaneProbe struct {
+	IP      string  `json:"ip"`
+	Healthy bool    `json:"healthy"`
+	Latency float64 `json:"latency_seconds,omitempty"`
+}
+
+// AnswerStatus is the policy and the probes of the controlplane addresses.
+type AnswerStatus struct {
+	AnswerPolicy
+	Probes []ControlplaneProbe `json:"probes"`
+}
+
+type answerOrder struct {
+	lock   sync.Mutex
+	policy AnswerPolicy
+	probes map[string]ControlplaneProbe
+	next   uint32
+}
+
+func (o *answerOrder) get() AnswerPolicy {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.policy
+}
+
+func (o *answerOrder) set(policy AnswerPolicy) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.policy = policy
+}
+
+// order returns a copy of the addresses of the controlplane name in the
+// order of the policy.
+func (o *answerOrder) order(ips []net.IP) []net.IP {
+	ordered := append([]net.IP(nil), ips...)
+	sort.Slice(ordered, func(i, j int) bool { return bytes.Compare(ordered[i].To16(), ordered[j].To16()) < 0 })
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	switch o.policy.Order {
+	case answerOrderRoundRobin:
+		n := int(atomic.AddUint32(&o.next, 1) % uint32(len(ordered)))
+		return append(ordered[n:], ordered[:n]...)
+	case answerOrderWeighted:
+		return o.weightedLocked(ordered)
+	case answerOrderPrimary:
+		primary := net.ParseIP(o.policy.Primary)
+		for i, ip := range ordered {
+			if ip.Equal(primary) && o.healthyLocked(ip) {
+				return append(append([]net.IP{ip}, ordered[:i]...), ordered[i+1:]...)
+			}
+		}
+		return o.downLastLocked(ordered)
+	}
+	return ordered
+}
+
+// healthyLocked tells whether the address answered its last probe, or
+// wasn't probed yet.
+func (o *answerOrder) healthyLocked(ip net.IP) bool {
+	probe, ok := o.probes[ip.String()]
+	return !ok || probe.Healthy
+}
+
+// downLastLocked moves the addresses not answering the probe last.
+func (o *answerOrder) downLastLocked(ips []net.IP) []net.IP {
+	sort.SliceStable(ips, func(i, j int) bool { return o.healthyLocked(ips[i]) && !o.healthyLocked(ips[j]) })
+	return ips
+}
+
+// weightedLocked shuffles the healthy addresses weighted by the inverse
+// of their probe latency, those not probed yet weighing the mean, and
+// puts the others last.
+func (o *answerOrder) weightedLocked(ips []net.IP) []net.IP {
+	ips = o.downLastLocked(ips)
+
+	var weights []float64
+	var known, sum float64
+	for _, ip := range ips {
+		if !o.healthyLocked(ip) {
+			break
+		}
+		weight := 0.0
+		if probe, ok := o.probes[ip.String()]; ok {
+			weight = 1 / (probe.Latency + 0.001)
+			known++
+			sum += weight
+		}
+		weights = append(weights, weight)
+	}
+	mean := 1.0
+	if known > 0 {
+		mean = sum / known
+	}
+	total := 0.0
+	for i := range weights {
+		if weights[i] == 0 {
+			weights[i] = mean
+		}
+		total += weights[i]
+	}
+
+	for i := range weights {
+		r := rand.Float64() * total
+		j := i
+		for ; j < len(weights)-1 && r >= weights[j]; j++ {
+			r -= weights[j]
+		}
+		ips[i], ips[j] = ips[j], ips[i]
+		weights[i], weights[j] = weights[j], weights[i]
+		total -= weights[i]
+	}
+	return ips
+}
+
+func (o *answerOrder) status() AnswerStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	status := AnswerStatus{AnswerPolicy: o.policy, Probes: []ControlplaneProbe{}}
+	for _, probe := range o.probes {
+		status.Probes = append(status.Probes, probe)
+	}
+	sort.Slice(status.Probes, func(i, j int) bool { return status.Probes[i].IP < status.Probes[j].IP })
+	return status
+}
+
+// probeControlplanes probes the controlplane addresses periodically, with
+// the orders going by health. It never returns.
+func (s *Server) probeControlplanes() {
+	for {
+		probes := make(map[string]ControlplaneProbe)
+		if policy := s.answerOrder.get(); policy.probed() {
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			for _, ip := range s.DNSRecords.GetV4(s.Controlplane) {
+				wg.Add(1)
+				go func(ip net.IP) {
+					defer wg.Done()
+					probe := probeControlplane(ip)
+					lock.Lock()
+					probes[probe.IP] = probe
+					lock.Unlock()
+				}(ip)
+			}
+			wg.Wait()
+		}
+
+		s.answerOrder.lock.Lock()
+		for addr, probe := range probes {
+			if old, ok := s.answerOrder.probes[addr]; ok && old.Healthy != probe.Healthy {
+				if probe.Healthy {
+					log.Infof("Controlplane %s is back up", addr)
+				} else {
+					log.Warnf("Controlplane %s is down, answering it last", addr)
+				}
+			}
+		}
+		s.answerOrder.probes = probes
+		s.answerOrder.lock.Unlock()
+
+		time.Sleep(answerProbeInterval)
+	}
+}
+
+func probeControlplane(ip net.IP) ControlplaneProbe {
+	probe := ControlplaneProbe{IP: ip.String()}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), "6443"), answerProbeTimeout)
+	if err != nil {
+		return probe
+	}
+	conn.Close()
+	probe.Healthy = true
+	probe.Latency = time.Since(start).Seconds()
+	return probe
+}
+
+func (s *Server) setAnswerPolicy(actor string, policy AnswerPolicy) AnswerStatus {
+	s.answerOrder.set(policy)
+	log.Infof("Controlplane answers ordered by %s, set by %s", describeAnswerPolicy(policy), actor)
+	s.audit.record(actor, "dns.answers", s.Controlplane, describeAnswerPolicy(policy))
+	return s.answerOrder.status()
+}
+
+func describeAnswerPolicy(policy AnswerPolicy) string {
+	if policy.Order == answerOrderPrimary {
+		return fmt.Sprintf("%s %s", policy.Order, policy.Primary)
+	}
+	return policy.Order
+}
+
+// answerPolicyHandler serves the answer order of the controlplane name on
+// GET and changes it on PUT.
+func (s *Server) answerPolicyHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, s.answerOrder.status())
+	case http.MethodPut:
+		policy := AnswerPolicy{}
+		if err := json.NewDecoder(req.Body).Decode(&policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := policy.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.setAnswerPolicy(requestActor(req), policy))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runDNS shows and changes the answer order of the controlplane name of a
+// running server.
+func runDNS(args []string) error {
+	flags := flag.NewFlagSet("dns", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	orderFlag := flags.String("order", "", "Order of the controlplane answers to set: address, round-robin, weighted or primary")
+	primaryFlag := flags.String("primary", "", "Address answered first, with --order primary")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s dns answers [flags]", os.Args[0])
+	if flags.NArg() != 1 || flags.Arg(0) != "answers" {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var status AnswerStatus
+	if *orderFlag == "" {
+		status, err = client.GetAnswerPolicy()
+	} else {
+		policy := AnswerPolicy{Order: *orderFlag, Primary: *primaryFlag}
+		if err := policy.check(); err != nil {
+			return err
+		}
+		status, err = client.SetAnswerPolicy(policy)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Controlplane answers ordered by %s\n", describeAnswerPolicy(status.AnswerPolicy))
+	for _, probe := range status.Probes {
+		health := "down"
+		if probe.Healthy {
+			health = strconv.FormatFloat(probe.Latency*1000, 'f', 1, 64) + "ms"
+		}
+		fmt.Printf("  %s\t%s\n", probe.IP, health)
+	}
+	return nil
+}
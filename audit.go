@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Changes made through the admin API are recorded as audit events, logged
+// and kept for the API to list.
+
+const maxAuditEvents = 1000
+
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Node   string    `json:"node,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type auditLog struct {
+	lock     sync.Mutex
+	events   []AuditEvent
+	watchers map[chan AuditEvent]struct{}
+	exporter *eventExporter
+}
+
+// requestActor identifies who made the API request.
+func requestActor(req *http.Request) string {
+	if id := accessIdentityFrom(req.Context()); id != nil {
+		return id.Name + " " + req.RemoteAddr
+	}
+	return req.RemoteAddr
+}
+
+func (al *auditLog) record(actor, action, node, detail string) {
+	event := AuditEvent{
+		Time:   time.Now(),
+		Action: action,
+		Node:   node,
+		Actor:  actor,
+		Detail: detail,
+	}
+
+	log.WithField("audit", action).Infof("%s %s: %s", action, node, detail)
+	al.exporter.audit(event)
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if len(al.events) == maxAuditEvents {
+		al.events = al.events[1:]
+	}
+	al.events = append(al.events, event)
+
+	// Watchers which can't keep up are dropped.
+	for ch := range al.watchers {
+		select {
+		case ch <- event:
+		default:
+			delete(al.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// watch returns a channel receiving the events recorded from now on. It's
+// closed if the watcher falls behind.
+func (al *auditLog) watch() chan AuditEvent {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if al.watchers == nil {
+		al.watchers = make(map[chan AuditEvent]struct{})
+	}
+	ch := make(chan AuditEvent, 64)
+	al.watchers[ch] = struct{}{}
+	return ch
+}
+
+func (al *auditLog) unwatch(ch chan AuditEvent) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if _, ok := al.watchers[ch]; ok {
+		delete(al.watchers, ch)
+		close(ch)
+	}
+}
+
+// list returns the events, oldest first.
+func (al *auditLog) list() []AuditEvent {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	return append([]AuditEvent{}, al.events...)
+}
+
+func (s *Server) auditHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.audit.list())
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The leases and the node inventory only live in memory, and the secrets
+// store and the CA on the disk of the server. The backup config uploads
+// them on a schedule to a target kept elsewhere, with the small files of
+// the server root, e.g. the profiles, groups and templates, and a
+// manifest of the big ones, e.g. the images, which can be downloaded
+// again. Backups are a gzipped tarball encrypted with the backup key,
+// which has to be kept off the server: the secrets in a backup are
+// useless without it. `talos-pxe backup restore` unpacks one on the
+// replacement, the snapshot of the state to import with --import-state.
+
+const (
+	backupInterval = 24 * time.Hour
+	backupKeep     = 7
+	backupTimeFmt  = "20060102T150405Z"
+
+	// Files of the server root bigger than this are only listed in the
+	// manifest.
+	backupMaxRootFile = 1 << 20
+	// Scheduled backups leave the server the time to settle after the
+	// start.
+	backupStartDelay = time.Minute
+
+	backupStateFile    = "state.json"
+	backupManifestFile = "manifest.json"
+)
+
+var errNoBackups = errors.New("Backups aren't configured")
+
+// BackupConfig backs the server up to the target every Interval, 24h by
+// default, keeping the last Keep backups, 7 by default, encrypted with
+// the key in KeyFile, generated if missing. KeyFile is required, and
+// can't be in the dirs backed up: a backup holding its own key wouldn't
+// protect the secrets.
+type BackupConfig struct {
+	BackupTarget
+	Interval string `json:"interval,omitempty"`
+	Keep     int    `json:"keep,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	interval time.Duration
+}
+
+func (c *BackupConfig) check() error {
+	if err := c.BackupTarget.check(); err != nil {
+		return err
+	}
+	c.interval = backupInterval
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid interval %q", c.Interval)
+		}
+		c.interval = interval
+	}
+	if c.Keep < 0 {
+		return fmt.Errorf("keep can't be negative")
+	}
+	if c.Keep == 0 {
+		c.Keep = backupKeep
+	}
+	if c.KeyFile == "" {
+		return fmt.Errorf("keyFile is required")
+	}
+	return nil
+}
+
+// BackupRun is the outcome of a backup.
+type BackupRun struct {
+	Name    string    `json:"name,omitempty"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// BackupList is the backups on the target, oldest first, and the last
+// backup run.
+type BackupList struct {
+	Target  string     `json:"target"`
+	Backups []string   `json:"backups"`
+	Last    *BackupRun `json:"last,omitempty"`
+}
+
+// BackupFile is a file of the server root in the manifest.
+type BackupFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Included tells whether the file is in the backup.
+	Included bool `json:"included"`
+}
+
+type backups struct {
+	config *BackupConfig
+	store  backupStore
+	aead   cipher.AEAD
+
+	// running serializes the backups.
+	running sync.Mutex
+	lock    sync.Mutex
+	last    *BackupRun
+}
+
+// setupBackups opens the target and the key of the backup config.
+func (s *Server) setupBackups(config *BackupConfig) error {
+	store, err := backupStores[config.Type](&config.BackupTarget)
+	if err != nil {
+		return fmt.Errorf("Could not back up to %s: %s", config.name(), err)
+	}
+
+	for _, dir := range []string{s.secretsDir(), s.caPath(), s.ServerRoot} {
+		if inDir(dir, config.KeyFile) {
+			return fmt.Errorf("The backup key %s can't be in %s, which is backed up with it", config.KeyFile, dir)
+		}
+	}
+	key, err := loadBackupKey(config.KeyFile, true)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	s.backups.config = config
+	s.backups.store = store
+	s.backups.aead = aead
+	log.Infof("Backing up to %s every %s, keeping %d backups", config.name(), config.interval, config.Keep)
+	return nil
+}
+
+// loadBackupKey reads the hex encoded key, generating it if missing and
+// create.
+func loadBackupKey(name string, create bool) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(name, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Warnf("Generated backup key %s, keep a copy off the server: backups can't be restored without it", name)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Invalid backup key %s, expected 32 hex encoded bytes", name)
+	}
+	return key, nil
+}
+
+// inDir tells whether name is dir or in it.
+func inDir(dir, name string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// scheduleBackups backs up every interval, counted from the last backup
+// on the target. It never returns.
+func (s *Server) scheduleBackups() {
+	wait := backupStartDelay
+	if names, err := s.backups.store.list(); err != nil {
+		log.Errorf("Could not list the backups on %s: %s", s.backups.config.name(), err)
+	} else if len(names) > 0 {
+		if last, ok := backupTime(names[len(names)-1]); ok && time.Until(last.Add(s.backups.config.interval)) > wait {
+			wait = time.Until(last.Add(s.backups.config.interval))
+		}
+	}
+
+	for {
+		time.Sleep(wait)
+		s.backUp("schedule")
+		wait = s.backups.config.interval
+	}
+}
+
+func backupTime(name string) (time.Time, bool) {
+	t, err := time.Parse(backupTimeFmt, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+	return t, err == nil
+}
+
+// backUp uploads a backup and drops the ones beyond those kept.
+func (s *Server) backUp(actor string) (BackupRun, error) {
+	if s.backups.store == nil {
+		return BackupRun{}, errNoBackups
+	}
+	s.backups.running.Lock()
+	defer s.backups.running.Unlock()
+
+	run := BackupRun{Started: time.Now().UTC().Round(time.Second)}
+	run.Name = backupPrefix + run.Started.Format(backupTimeFmt) + backupSuffix
+	err := s.uploadBackup(&run)
+	if err != nil {
+		run.Error = err.Error()
+		backupsTotal.WithLabelValues("failed").Inc()
+		log.Errorf("Could not back up to %s: %s", s.backups.config.name(), err)
+		s.audit.record(actor, "backup.run", run.Name, fmt.Sprintf("failed: %s", err))
+	} else {
+		backupsTotal.WithLabelValues("ok").Inc()
+		backupLastSuccess.Set(float64(run.Started.Unix()))
+		log.Infof("Backed up %s to %s, %d bytes", run.Name, s.backups.config.name(), run.Size)
+		s.audit.record(actor, "backup.run", run.Name, fmt.Sprintf("%d bytes", run.Size))
+	}
+
+	s.backups.lock.Lock()
+	s.backups.last = &run
+	s.backups.lock.Unlock()
+	return run, err
+}
+
+func (s *Server) uploadBackup(run *BackupRun) error {
+	archive, err := s.backupArchive()
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(s.backups.aead, archive, []byte(run.Name))
+	if err != nil {
+		return err
+	}
+	if err := s.backups.store.put(run.Name, sealed); err != nil {
+		return err
+	}
+	run.Size = int64(len(sealed))
+
+	names, err := s.backups.store.list()
+	if err != nil {
+		return fmt.Errorf("Could not list the backups to drop: %s", err)
+	}
+	for len(names) > s.backups.config.Keep {
+		if err := s.backups.store.remove(names[0]); err != nil {
+			return fmt.Errorf("Could not drop %s: %s", names[0], err)
+		}
+		log.Infof("Dropped backup %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// backupArchive packs the state snapshot, the secrets store, the CA and
+// the small files of the server root with the manifest of the root.
+func (s *Server) backupArchive() ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	state, err := json.MarshalIndent(s.exportState(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := addBackupFile(tw, backupStateFile, state, 0600, time.Now()); err != nil {
+		return nil, err
+	}
+
+	skip := map[string]bool{filepath.Clean(s.secretsDir()): true, filepath.Clean(s.caPath()): true}
+	if err := addBackupDir(tw, "secrets", s.secretsDir(), nil, nil); err != nil {
+		return nil, err
+	}
+	if err := addBackupDir(tw, "ca", s.caPath(), nil, nil); err != nil {
+		return nil, err
+	}
+	manifest := []BackupFile{}
+	if err := addBackupDir(tw, "root", s.ServerRoot, skip, &manifest); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := addBackupFile(tw, backupManifestFile, data, 0644, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func addBackupFile(tw *tar.Writer, name string, data []byte, mode os.FileMode, modified time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(mode.Perm()), Size: int64(len(data)), ModTime: modified}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// addBackupDir adds the files of the directory under the prefix. With a
+// manifest, files bigger than backupMaxRootFile are only listed in it.
+func addBackupDir(tw *tar.Writer, prefix, dir string, skip map[string]bool, manifest *[]BackupFile) error {
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && skip[filepath.Clean(name)] {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+
+		included := manifest == nil || info.Size() <= backupMaxRootFile
+		if manifest != nil {
+			*manifest = append(*manifest, BackupFile{Path: filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime().UTC(), Included: included})
+		}
+		if !included {
+			return nil
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return addBackupFile(tw, prefix+"/"+filepath.ToSlash(rel), data, info.Mode(), info.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) backupList() (BackupList, error) {
+	if s.backups.store == nil {
+		return BackupList{}, errNoBackups
+	}
+	list := BackupList{Target: s.backups.config.name()}
+	s.backups.lock.Lock()
+	list.Last = s.backups.last
+	s.backups.lock.Unlock()
+
+	names, err := s.backups.store.list()
+	if err != nil {
+		return list, err
+	}
+	list.Backups = append([]string{}, names...)
+	return list, nil
+}
+
+// backupsHandler lists the backups on GET and backs up on POST.
+func (s *Server) backupsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		list, err := s.backupList()
+		switch {
+		case err == errNoBackups:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			writeJSON(w, list)
+		}
+	case http.MethodPost:
+		run, err := s.backUp(requestActor(req))
+		switch {
+		case err == errNoBackups:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			writeJSON(w, run)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runBackup lists and takes the backups of a running server, and restores
+// one on its replacement.
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	configFlag := flags.String("config", "", "Config of the server with the backup target, with restore")
+	keyFileFlag := flags.String("key-file", "", "Backup key, instead of the keyFile of the backup config, with restore")
+	rootFlag := flags.String("root", "/var/lib/matchbox", "Server root to restore to")
+	secretsDirFlag := flags.String("secrets-dir", "", "Secrets dir to restore to (default <root>/secrets)")
+	caDirFlag := flags.String("ca-dir", "", "CA dir to restore to (default <root>/ca)")
+	forceFlag := flags.Bool("force", false, "Overwrite the existing files, with restore")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s backup list|now|restore [flags] [NAME]", os.Args[0])
+	if flags.NArg() < 1 {
+		return usage
+	}
+
+	switch flags.Arg(0) {
+	case "list", "now":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		client, err := dialManagement(*managementAddrFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		if flags.Arg(0) == "now" {
+			run, err := client.RunBackup()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Backed up %s, %d bytes\n", run.Name, run.Size)
+			return nil
+		}
+
+		list, err := client.ListBackups()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backups on %s:\n", list.Target)
+		for _, name := range list.Backups {
+			fmt.Printf("  %s\n", name)
+		}
+		if last := list.Last; last != nil && last.Error != "" {
+			fmt.Printf("Last backup %s failed: %s\n", ago(last.Started), last.Error)
+		}
+		return nil
+	case "restore":
+		if flags.NArg() > 2 {
+			return usage
+		}
+		s := &Server{ServerRoot: *rootFlag, SecretsDir: *secretsDirFlag, CADir: *caDirFlag}
+		return s.restoreBackup(*configFlag, *keyFileFlag, flags.Arg(1), *forceFlag)
+	default:
+		return usage
+	}
+}
+
+// restoreBackup unpacks the named backup, or the last one, from the
+// target of the backup config.
+func (s *Server) restoreBackup(configFile, keyFile, name string, force bool) error {
+	if configFile == "" {
+		return fmt.Errorf("Restoring needs the --config with the backup target")
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if config.Backup == nil {
+		return fmt.Errorf("No backup config in %s", configFile)
+	}
+	if keyFile == "" {
+		keyFile = config.Backup.KeyFile
+	}
+	if keyFile == "" {
+		return fmt.Errorf("Restoring needs the --key-file the backups were encrypted with")
+	}
+	key, err := loadBackupKey(keyFile, false)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	store, err := backupStores[config.Backup.Type](&config.Backup.BackupTarget)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		names, err := store.list()
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("No backups on %s", config.Backup.name())
+		}
+		name = names[len(names)-1]
+	}
+	sealed, err := store.get(name)
+	if err != nil {
+		return fmt.Errorf("Could not get %s: %s", name, err)
+	}
+	archive, err := openSealed(aead, sealed, []byte(name))
+	if err != nil {
+		return fmt.Errorf("Could not decrypt %s, wrong key? %s", name, err)
+	}
+
+	files, err := readBackupArchive(archive)
+	if err != nil {
+		return fmt.Errorf("Corrupt backup %s: %s", name, err)
+	}
+
+	// Where the files go, checking them all before writing any.
+	paths := make(map[string]string)
+	var manifest []BackupFile
+	for file := range files {
+		var dest string
+		switch dir, rel := splitBackupPath(file); dir {
+		case "":
+			switch file {
+			case backupStateFile:
+				dest = filepath.Join(s.ServerRoot, backupStateFile)
+			case backupManifestFile:
+				if err := json.Unmarshal(files[file].data, &manifest); err != nil {
+					return fmt.Errorf("Corrupt manifest in %s: %s", name, err)
+				}
+			}
+		case "secrets":
+			dest = filepath.Join(s.secretsDir(), rel)
+		case "ca":
+			dest = filepath.Join(s.caPath(), rel)
+		case "root":
+			dest = filepath.Join(s.ServerRoot, rel)
+		}
+		if dest == "" {
+			continue
+		}
+		if _, err := os.Stat(dest); err == nil && !force {
+			return fmt.Errorf("%s exists, pass --force to overwrite it", dest)
+		}
+		paths[file] = dest
+	}
+
+	names := make([]string, 0, len(paths))
+	for file := range paths {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	for _, file := range names {
+		dest := paths[file]
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dest, files[file].data, files[file].mode); err != nil {
+			return err
+		}
+		os.Chtimes(dest, files[file].modified, files[file].modified)
+	}
+	fmt.Printf("Restored %d files of %s\n", len(paths), name)
+
+	missing := 0
+	for _, file := range manifest {
+		if _, err := os.Stat(filepath.Join(s.ServerRoot, filepath.FromSlash(file.Path))); err != nil {
+			if missing < 10 {
+				fmt.Printf("  missing %s, %d bytes\n", file.Path, file.Size)
+			}
+			missing++
+		}
+	}
+	if missing > 0 {
+		fmt.Printf("%d files too big to back up are missing from %s, download them again\n", missing, s.ServerRoot)
+	}
+	fmt.Printf("Start the server with --import-state %s to restore the leases, nodes and DNS records\n", filepath.Join(s.ServerRoot, backupStateFile))
+	return nil
+}
+
+type backupArchiveFile struct {
+	data     []byte
+	mode     os.FileMode
+	modified time.Time
+}
+
+func readBackupArchive(archive []byte) (map[string]backupArchiveFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	files := make(map[string]backupArchiveFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !isRootRelative(header.Name) {
+			return nil, fmt.Errorf("unexpected entry %s", header.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = backupArchiveFile{data: data, mode: os.FileMode(header.Mode).Perm(), modified: header.ModTime}
+	}
+}
+
+// splitBackupPath splits the directory of the archive off the path, empty
+// for the files at the top.
+func splitBackupPath(name string) (string, string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return "", name
+	}
+	return parts[0], filepath.FromSlash(parts[1])
+}
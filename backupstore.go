@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are stored in an S3 bucket, signing the requests with AWS
+// signature version 4 so that MinIO and the other S3-compatible stores
+// work too, on an SFTP server through the sftp client of the system,
+// authenticated with an identity file, or in a directory, e.g. a mounted
+// NFS share.
+
+const (
+	backupPrefix = "talos-pxe-"
+	backupSuffix = ".tar.gz.enc"
+)
+
+// A BackupTarget is where the backups are stored.
+type BackupTarget struct {
+	// Type is s3, sftp or dir.
+	Type string `json:"type"`
+
+	// URL of the bucket and prefix, path-style, e.g.
+	// https://s3.eu-west-1.amazonaws.com/backups/talos-pxe, or of the SFTP
+	// server and directory, e.g. sftp://backup@host:22/talos-pxe.
+	URL string `json:"url,omitempty"`
+
+	// Region of the bucket, us-east-1 by default. The keys default to
+	// $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY.
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+
+	// IdentityFile is the SSH private key for SFTP, the default keys of
+	// ssh if empty.
+	IdentityFile string `json:"identityFile,omitempty"`
+
+	// Path of the directory.
+	Path string `json:"path,omitempty"`
+}
+
+func (t *BackupTarget) check() error {
+	switch t.Type {
+	case "s3":
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("s3 needs an http or https url")
+		}
+		if strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("s3 url needs a bucket")
+		}
+	case "sftp":
+		u, err := url.Parse(t.URL)
+		if err != nil || u.Scheme != "sftp" || u.Hostname() == "" {
+			return fmt.Errorf("sftp needs an sftp://[user@]host[:port]/path url")
+		}
+	case "dir":
+		if t.Path == "" {
+			return fmt.Errorf("dir needs a path")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", t.Type)
+	}
+	return nil
+}
+
+func (t *BackupTarget) name() string {
+	if t.Type == "dir" {
+		return t.Path
+	}
+	return t.URL
+}
+
+type backupStore interface {
+	put(name string, data []byte) error
+	get(name string) ([]byte, error)
+	// list returns the names of the backups, oldest first.
+	list() ([]string, error)
+	remove(name string) error
+}
+
+// backupStores create the stores of the types.
+var backupStores = map[string]func(*BackupTarget) (backupStore, error){
+	"s3":   newS3Store,
+	"sftp": newSFTPStore,
+	"dir":  newDirStore,
+}
+
+// backupNames keeps the names of backups, sorted oldest first by the time
+// in them.
+func backupNames(names []string) []string {
+	var out []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store(target *BackupTarget) (backupStore, error) {
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	st := &s3Store{
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:    parts[0],
+		region:    target.Region,
+		accessKey: target.AccessKeyID,
+		secretKey: target.SecretAccessKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		st.prefix = parts[1] + "/"
+	}
+	if st.region == "" {
+		st.region = "us-east-1"
+	}
+	if st.accessKey == "" {
+		st.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if st.secretKey == "" {
+		st.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if st.accessKey == "" || st.secretKey == "" {
+		return nil, fmt.Errorf("Missing S3 keys")
+	}
+	return st, nil
+}
+
+func (st *s3Store) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	u := *st.endpoint
+	u.Path = "/" + st.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	st.sign(req, body, time.Now())
+
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Error struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(data, &s3Error) == nil && s3Error.Code != "" {
+			return nil, fmt.Errorf("S3 returned %s: %s", s3Error.Code, s3Error.Message)
+		}
+		return nil, fmt.Errorf("S3 returned %s", resp.Status)
+	}
+	return data, nil
+}
+
+// sign adds the AWS signature version 4 of the request.
+func (st *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + st.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + st.secretKey)
+	for _, part := range []string{amzDate[:8], st.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", st.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (st *s3Store) put(name string, data []byte) error {
+	_, err := st.do(http.MethodPut, st.prefix+name, nil, data)
+	return err
+}
+
+func (st *s3Store) get(name string) ([]byte, error) {
+	return st.do(http.MethodGet, st.prefix+name, nil, nil)
+}
+
+func (st *s3Store) remove(name string) error {
+	_, err := st.do(http.MethodDelete, st.prefix+name, nil, nil)
+	return err
+}
+
+func (st *s3Store) list() ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {st.prefix}}
+	for {
+		data, err := st.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("Invalid S3 listing: %s", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, st.prefix))
+		}
+		if !result.IsTruncated {
+			return backupNames(names), nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+type sftpStore struct {
+	host     string
+	port     string
+	dir      string
+	identity string
+}
+
+func newSFTPStore(target *BackupTarget) (backupStore, error) {
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, err
+	}
+	st := &sftpStore{
+		host:     u.Hostname(),
+		port:     u.Port(),
+		dir:      strings.TrimPrefix(u.Path, "/"),
+		identity: target.IdentityFile,
+	}
+	if u.User != nil {
+		st.host = u.User.Username() + "@" + st.host
+	}
+	if st.dir == "" {
+		st.dir = "."
+	}
+	return st, nil
+}
+
+// run runs the batch of commands with sftp, returning its output.
+func (st *sftpStore) run(commands ...string) ([]byte, error) {
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if st.port != "" {
+		args = append(args, "-P", st.port)
+	}
+	if st.identity != "" {
+		args = append(args, "-i", st.identity)
+	}
+	cmd := exec.Command("sftp", append(args, st.host)...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("sftp %s: %s: %s", st.host, err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (st *sftpStore) put(name string, data []byte) error {
+	tmp, err := ioutil.TempFile("", "talos-pxe-backup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Uploaded under a temporary name, so that no partial backup is ever
+	// listed.
+	remote := path.Join(st.dir, name)
+	_, err = st.run("-mkdir "+st.dir, "put "+tmp.Name()+" "+remote+".part", "rename "+remote+".part "+remote)
+	return err
+}
+
+func (st *sftpStore) get(name string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "talos-pxe-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, name)
+	if _, err := st.run("get " + path.Join(st.dir, name) + " " + local); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(local)
+}
+
+func (st *sftpStore) remove(name string) error {
+	_, err := st.run("rm " + path.Join(st.dir, name))
+	return err
+}
+
+func (st *sftpStore) list() ([]string, error) {
+	out, err := st.run("ls -1 " + st.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "sftp>") {
+			names = append(names, path.Base(line))
+		}
+	}
+	return backupNames(names), nil
+}
+
+type dirStore struct {
+	path string
+}
+
+func newDirStore(target *BackupTarget) (backupStore, error) {
+	if err := os.MkdirAll(target.Path, 0700); err != nil {
+		return nil, err
+	}
+	return &dirStore{path: target.Path}, nil
+}
+
+func (st *dirStore) put(name string, data []byte) error {
+	tmp := filepath.Join(st.path, name+".part")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(st.path, name))
+}
+
+func (st *dirStore) get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(st.path, name))
+}
+
+func (st *dirStore) remove(name string) error {
+	return os.Remove(filepath.Join(st.path, name))
+}
+
+func (st *dirStore) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(st.path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return backupNames(names), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/borancar/talos-pxe/pxesim"
+	flag "github.com/spf13/pflag"
+)
+
+// runBench boots many simulated clients at once against a running server
+// and reports how long every step of their boots took, to check that it
+// can take the rollout of a whole rack before it happens.
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	ifNameFlag := flags.String("if", "veth1", "Interface on the served network to simulate the clients on")
+	clientsFlag := flags.IntP("clients", "n", 10, "Number of clients to boot")
+	concurrencyFlag := flags.IntP("concurrency", "c", 0, "Clients booting at the same time (default all)")
+	rampFlag := flags.Duration("ramp", 0, "Spread the start of the clients over this long")
+	roleFlag := flags.String("role", "worker", "Menu entry to select")
+	macPrefixFlag := flags.String("mac-prefix", "02:00", "Prefix of the random client MACs, locally administered by default")
+	timeoutFlag := flags.Duration("timeout", 30*time.Second, "Timeout for every step")
+	serverPortFlag := flags.Int("server-port", 67, "DHCP port of the server, for a server on high ports")
+	clientPortFlag := flags.Int("client-port", 68, "DHCP port of the client of the clients")
+	tftpPortFlag := flags.Int("tftp-port", 69, "TFTP port of the server, unless the boot file URL has one")
+	unprivilegedFlag := flags.Bool("unprivileged", false, "Use a UDP socket instead of a raw one, asking for broadcast replies, with a --client-port above 1023")
+	flags.Parse(args)
+
+	if *clientsFlag < 1 {
+		return fmt.Errorf("Need at least one client")
+	}
+	concurrency := *concurrencyFlag
+	if concurrency <= 0 || concurrency > *clientsFlag {
+		concurrency = *clientsFlag
+	}
+	prefix, err := parseMACPrefix(*macPrefixFlag)
+	if err != nil {
+		return err
+	}
+
+	cfg := pxesim.Config{
+		Interface:    *ifNameFlag,
+		Role:         *roleFlag,
+		Timeout:      *timeoutFlag,
+		ServerPort:   *serverPortFlag,
+		ClientPort:   *clientPortFlag,
+		TFTPPort:     *tftpPortFlag,
+		Unprivileged: *unprivilegedFlag,
+	}
+
+	// TFTP and HTTP need an address on the served network. Without one,
+	// the first client assigns its lease to the interface before the
+	// others start.
+	hasAddr, err := interfaceHasIPv4(*ifNameFlag)
+	if err != nil {
+		return err
+	}
+
+	results := make([]benchResult, *clientsFlag)
+	boot := func(i int) {
+		c := cfg
+		c.MAC = randomMAC(prefix)
+		c.ConfigureAddress = i == 0 && !hasAddr
+		start := time.Now()
+		res, err := pxesim.Run(context.Background(), c)
+		results[i] = benchResult{took: time.Since(start), err: err}
+		if res != nil {
+			results[i].timings = res.Timings
+		}
+		if err != nil {
+			log.Warnf("Client %s failed: %s", c.MAC, err)
+		}
+	}
+
+	log.Infof("Booting %d clients on %s, %d at a time", *clientsFlag, *ifNameFlag, concurrency)
+	start := time.Now()
+	first := 0
+	if !hasAddr {
+		boot(0)
+		if results[0].err != nil {
+			return fmt.Errorf("First client failed, not booting the others: %s", results[0].err)
+		}
+		first = 1
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := first; i < *clientsFlag; i++ {
+		if *rampFlag > 0 && *clientsFlag > 1 {
+			time.Sleep(*rampFlag / time.Duration(*clientsFlag-1))
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			boot(i)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := printBenchReport(results, time.Since(start))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clients failed to boot", failed, len(results))
+	}
+	return nil
+}
+
+type benchResult struct {
+	took    time.Duration
+	timings map[string]time.Duration
+	err     error
+}
+
+func interfaceHasIPv4(name string) (bool, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseMACPrefix parses the first one to five bytes of a MAC.
+func parseMACPrefix(s string) ([]byte, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 5 {
+		return nil, fmt.Errorf("Invalid MAC prefix %s", s)
+	}
+	prefix := make([]byte, len(parts))
+	for i, part := range parts {
+		b, err := hex.DecodeString(part)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("Invalid MAC prefix %s", s)
+		}
+		prefix[i] = b[0]
+	}
+	return prefix, nil
+}
+
+// randomMAC returns a MAC starting with the prefix, the rest random.
+func randomMAC(prefix []byte) net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, prefix)
+	rand.Read(mac[len(prefix):])
+	return mac
+}
+
+// percentile returns the duration below which the fraction p of the
+// sorted durations are.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// printBenchReport prints the latency percentiles of every step and of
+// the whole boot, and the errors, returning how many clients failed.
+func printBenchReport(results []benchResult, took time.Duration) int {
+	steps := make(map[string][]time.Duration)
+	var total []time.Duration
+	errors := make(map[string]int)
+	failed := 0
+	for _, r := range results {
+		for step, d := range r.timings {
+			steps[step] = append(steps[step], d)
+		}
+		if r.err != nil {
+			failed++
+			errors[r.err.Error()]++
+			continue
+		}
+		total = append(total, r.took)
+	}
+
+	fmt.Printf("%d clients in %s, %d booted, %d failed\n\n", len(results), took.Round(time.Millisecond), len(results)-failed, failed)
+	fmt.Printf("%-10s %6s %10s %10s %10s %10s\n", "step", "count", "p50", "p90", "p99", "max")
+	row := func(name string, durations []time.Duration) {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		fmt.Printf("%-10s %6d %10s %10s %10s %10s\n", name, len(durations),
+			percentile(durations, 0.5).Round(time.Millisecond),
+			percentile(durations, 0.9).Round(time.Millisecond),
+			percentile(durations, 0.99).Round(time.Millisecond),
+			durations[len(durations)-1].Round(time.Millisecond))
+	}
+	for _, step := range pxesim.Steps {
+		if len(steps[step]) > 0 {
+			row(step, steps[step])
+		}
+	}
+	if len(total) > 0 {
+		row("total", total)
+	}
+
+	if failed > 0 {
+		var messages []string
+		for msg := range errors {
+			messages = append(messages, msg)
+		}
+		sort.Slice(messages, func(i, j int) bool { return errors[messages[i]] > errors[messages[j]] })
+
+		fmt.Printf("\nErrors:\n")
+		for _, msg := range messages {
+			fmt.Printf("%6d  %s\n", errors[msg], msg)
+		}
+	}
+	return failed
+}
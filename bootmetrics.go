@@ -0,0 +1,101 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Every boot attempt is timed to three milestones: getting the menu,
+// fetching the machine config and finishing the install, as reported to
+// the progress URL. The times are observed in the boot milestone
+// histogram by the Talos version the node is pinned to, default if none,
+// so that a version booting slower than the one before shows up on the
+// dashboard in grafana/talos-pxe.json.
+
+//go:embed grafana/talos-pxe.json
+var grafanaDashboard []byte
+
+const (
+	milestoneMenu    = "menu"
+	milestoneConfig  = "config"
+	milestoneInstall = "install"
+)
+
+// bootMilestone returns the milestone reached with the stage, if any.
+func bootMilestone(stage string) string {
+	if strings.HasPrefix(stage, "install ") {
+		if installedStages[strings.TrimPrefix(stage, "install ")] {
+			return milestoneInstall
+		}
+		return ""
+	}
+	switch name, _ := timelineStage(stage); name {
+	case "menu":
+		return milestoneMenu
+	case "config":
+		return milestoneConfig
+	}
+	return ""
+}
+
+// milestoneLocked returns the milestone the client reached with the stage
+// and how long into the current attempt, the first time it's reached in
+// the attempt. Must be called with the lock held, after stepLocked.
+func (bs *bootSessions) milestoneLocked(mac string, stage string, now time.Time) (string, time.Duration) {
+	milestone := bootMilestone(stage)
+	tl, ok := bs.history[mac]
+	if milestone == "" || !ok || len(tl.Attempts) == 0 {
+		return "", 0
+	}
+
+	attempt := &tl.Attempts[len(tl.Attempts)-1]
+	if attempt.milestones[milestone] {
+		return "", 0
+	}
+	if attempt.milestones == nil {
+		attempt.milestones = make(map[string]bool)
+	}
+	attempt.milestones[milestone] = true
+	return milestone, now.Sub(attempt.Started)
+}
+
+// observeBootMilestone records the time to the milestone, with the MAC
+// and the trace ID of the boot session as exemplar.
+func (s *Server) observeBootMilestone(mac string, milestone string, took time.Duration) {
+	version := "default"
+	if node, ok := s.nodes.get(mac); ok && node.Version != "" {
+		version = node.Version
+	}
+
+	exemplar := prometheus.Labels{"mac": mac}
+	if traceId := s.tracer.traceId(mac); traceId != "" {
+		exemplar["trace_id"] = traceId
+	}
+	bootMilestones.WithLabelValues(milestone, version).(prometheus.ExemplarObserver).ObserveWithExemplar(took.Seconds(), exemplar)
+}
+
+// traceId returns the trace ID of the boot session of the MAC, empty if
+// there's none.
+func (t *tracer) traceId(mac string) string {
+	if t == nil {
+		return ""
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if sess, ok := t.sessions[mac]; ok {
+		return hex.EncodeToString(sess.traceId)
+	}
+	return ""
+}
+
+func (s *Server) grafanaHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(grafanaDashboard)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Sites with their own bootloader infrastructure, e.g. a TFTP server with
+// pxelinux or an HTTP server with signed shims, can still use talos-pxe
+// for DHCP and ProxyDHCP. Boot overrides point the matching clients at
+// another next server and boot file instead of the iPXE served here. The
+// first matching override wins.
+
+// A BootOverride sets the next server and boot file of the matching
+// clients. Filename may be a URL, for UEFI HTTP boot and iPXE.
+type BootOverride struct {
+	Comment string `json:"comment,omitempty"`
+	ClientMatch
+	// NextServer is the address of the TFTP server, the server itself if
+	// empty.
+	NextServer string `json:"nextServer,omitempty"`
+	// ServerName is the TFTP server name (option 66), NextServer if
+	// empty.
+	ServerName string `json:"serverName,omitempty"`
+	Filename   string `json:"filename"`
+
+	nextServer net.IP
+}
+
+func (o *BootOverride) check() error {
+	if err := o.ClientMatch.check(); err != nil {
+		return err
+	}
+	if o.Filename == "" {
+		return fmt.Errorf("missing filename")
+	}
+	if o.NextServer != "" {
+		if o.nextServer = net.ParseIP(o.NextServer).To4(); o.nextServer == nil {
+			return fmt.Errorf("invalid next server %s", o.NextServer)
+		}
+	}
+	return nil
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "tftp://")
+}
+
+// bootOverride returns the override matching the client, if any.
+func (s *Server) bootOverride(m *dhcpv4.DHCPv4) *BootOverride {
+	if s.Config == nil {
+		return nil
+	}
+	classInfo := fmt.Sprintf("%s", m.UserClass())
+	for i := range s.Config.BootOverrides {
+		if o := &s.Config.BootOverrides[i]; o.matches(m.ClientHWAddr, m.ClassIdentifier(), classInfo) {
+			return o
+		}
+	}
+	return nil
+}
+
+// applyBootOverride points the reply at the next server and boot file
+// of the override, in the header fields too for BOOTP clients.
+func (s *Server) applyBootOverride(o *BootOverride, m, resp *dhcpv4.DHCPv4, bootp bool) {
+	nextServer := s.advertisedIP()
+	if o.nextServer != nil {
+		nextServer = o.nextServer
+	}
+	serverName := o.ServerName
+	if serverName == "" {
+		serverName = nextServer.String()
+	}
+
+	log.Infof("Pointing %s at %s on %s", m.ClientHWAddr, o.Filename, serverName)
+	resp.ServerIPAddr = nextServer
+	if bootp {
+		resp.BootFileName = o.Filename
+		resp.ServerHostName = serverName
+		return
+	}
+
+	resp.UpdateOption(dhcpv4.OptTFTPServerName(serverName))
+	resp.UpdateOption(dhcpv4.OptBootFileName(o.Filename))
+	// UEFI HTTP boot clients only take URLs from replies saying so.
+	if strings.HasPrefix(m.ClassIdentifier(), "HTTPClient") && isURL(o.Filename) {
+		resp.UpdateOption(dhcpv4.OptClassIdentifier("HTTPClient"))
+	}
+}
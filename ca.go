@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// With --mtls, iPXE has to authenticate with a client certificate to get
+// boot scripts and matchbox configs over HTTPS. A lightweight CA, created
+// in <root>/ca on first use, issues the certificate of every node, bound
+// to its MAC, to embed into a custom iPXE build along with the CA to
+// trust the server with. Talos can't present a certificate fetching its
+// machine config, so those are protected by config tokens instead.
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+)
+
+type certAuthority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+}
+
+// openCA loads the CA from the directory, creating it if there's none.
+func openCA(dir string) (*certAuthority, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, caCertFile))
+	if os.IsNotExist(err) {
+		return createCA(dir)
+	} else if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CA in %s: %s", dir, err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Invalid CA in %s: not an ECDSA key", dir)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, certPEM: certPEM, key: key}, nil
+}
+
+func createCA(dir string) (*certAuthority, error) {
+	log.Infof("Creating CA in %s", dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate("talos-pxe CA", caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &certAuthority{cert: cert, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key: key}
+	if err := ioutil.WriteFile(filepath.Join(dir, caKeyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, caCertFile), ca.certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+func certTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// issue signs a new certificate, for a client if ips is empty and else
+// for a server with the addresses. Returns the certificate and key PEM.
+func (ca *certAuthority) issue(commonName string, ips []net.IP, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certTemplate(commonName, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if len(ips) > 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = ips
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+func (s *Server) caPath() string {
+	if s.CADir != "" {
+		return s.CADir
+	}
+	return filepath.Join(s.ServerRoot, "ca")
+}
+
+// httpsConfig is the TLS config of the HTTPS listener: with --mtls asking
+// for client certificates from the CA, and serving a certificate from it
+// unless there's another one.
+func (s *Server) httpsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSCert != "" {
+		pair, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if s.ca == nil {
+		return config, nil
+	}
+
+	if s.TLSCert == "" {
+		certPEM, keyPEM, err := s.ca.issue(s.advertisedIP().String(), s.serverIPs(), serverValidity)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	config.ClientCAs.AddCert(s.ca.cert)
+	// Certificates are only required for the config endpoints, the boot
+	// images are fetched without.
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// isMatchboxEndpoint tells whether matchbox renders the path for the
+// node.
+func isMatchboxEndpoint(name string) bool {
+	switch name {
+	case "/ipxe", "/grub", "/ignition", "/cloud", "/generic", "/metadata":
+		return true
+	}
+	return false
+}
+
+// clientCertHandler refuses the boot scripts and matchbox configs to
+// clients without a certificate from the CA, and to nodes asking for
+// those of another MAC. The scripts served over HTTPS chain over HTTPS.
+func (s *Server) clientCertHandler(next http.Handler) http.Handler {
+	if s.ca == nil {
+		return next
+	}
+
+	httpURL := []byte(fmt.Sprintf("http://%s:%d/", s.advertisedIP(), s.advertisedHTTPPort()))
+	httpsURL := []byte(fmt.Sprintf("https://%s:%d/", s.advertisedIP(), s.HTTPSPort))
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		// Edges check the certificates of their clients themselves,
+		// everyone else needs a verified one. Only edges which
+		// authenticated with the edge secret are let through.
+		if !isMatchboxEndpoint(path.Clean(req.URL.Path)) || isEdgeRequest(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			log.Warnf("Refusing %s to %s without a client certificate", req.URL.Path, req.RemoteAddr)
+			clientCertChecks.WithLabelValues("denied").Inc()
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		name := req.TLS.PeerCertificates[0].Subject.CommonName
+		if value := req.URL.Query().Get("mac"); value != "" {
+			mac, err := net.ParseMAC(value)
+			if err != nil || mac.String() != name {
+				log.Warnf("Refusing %s for %s to %s with the certificate of %s", req.URL.Path, value, req.RemoteAddr, name)
+				clientCertChecks.WithLabelValues("denied").Inc()
+				http.Error(w, "Certificate was issued for another node", http.StatusForbidden)
+				return
+			}
+		}
+		clientCertChecks.WithLabelValues("accepted").Inc()
+
+		rr := httptest.NewRecorder()
+		next.ServeHTTP(rr, req)
+		copyHeader(w.Header(), rr.Header())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rr.Code)
+		w.Write(bytes.ReplaceAll(rr.Body.Bytes(), httpURL, httpsURL))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// runCA issues the certificate of a node from the CA of the server, and
+// writes what's needed to build iPXE with it.
+func runCA(args []string) error {
+	flags := flag.NewFlagSet("ca", flag.ExitOnError)
+	rootFlag := flags.String("root", ".", "Server root")
+	caDirFlag := flags.String("ca-dir", "", "CA location (default <root>/ca)")
+	macFlag := flags.String("mac", "", "MAC of the node to issue the certificate for")
+	addrFlag := flags.String("addr", "192.168.123.1", "Address of the server for the node to chain to")
+	httpsPortFlag := flags.Int("https-port", portHTTPS, "HTTPS port of the server")
+	validityFlag := flags.Duration("validity", serverValidity, "How long the certificate is valid")
+	outputFlag := flags.StringP("output", "o", ".", "Directory to write the certificate, key and iPXE script to")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "issue" {
+		return fmt.Errorf("Usage: %s ca issue --mac MAC [flags]", os.Args[0])
+	}
+	mac, err := net.ParseMAC(*macFlag)
+	if err != nil {
+		return fmt.Errorf("Invalid MAC %q: %s", *macFlag, err)
+	}
+	ip := net.ParseIP(*addrFlag)
+	if ip == nil {
+		return fmt.Errorf("Invalid address %q", *addrFlag)
+	}
+
+	s := &Server{ServerRoot: *rootFlag, CADir: *caDirFlag}
+	ca, err := openCA(s.caPath())
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := ca.issue(mac.String(), nil, *validityFlag)
+	if err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(*outputFlag)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	script := ipxeEmbedScript("https://" + net.JoinHostPort(ip.String(), strconv.Itoa(*httpsPortFlag)))
+	files := map[string][]byte{
+		"node.crt":   certPEM,
+		"node.key":   keyPEM,
+		"ca.crt":     ca.certPEM,
+		"embed.ipxe": []byte(script),
+	}
+	for name, data := range files {
+		mode := os.FileMode(0644)
+		if name == "node.key" {
+			mode = 0600
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, mode); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Issued the certificate of %s, build iPXE with it:\n", mac)
+	fmt.Printf("  %[1]s ipxe-build --script %[2]s/embed.ipxe --cert %[2]s/node.crt --key %[2]s/node.key --trust %[2]s/ca.crt\n", os.Args[0], dir)
+	return nil
+}
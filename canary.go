@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/poseidon/matchbox/matchbox/storage"
+	flag "github.com/spf13/pflag"
+)
+
+// A canary rollout boots a share of the workers, or the workers matching
+// a selector, with another profile: their matchbox requests get the
+// channel=canary selector, so groups selecting it pick the canary profile,
+// e.g. one booting the assets of a new Talos version, while the others
+// keep matching the stable groups. Workers are picked by hashing their
+// MAC, so the same ones stay canaries across reboots, and raising the
+// percentage only adds workers. Promoting the canary points every stable
+// group at the profile of its canary group and ends the rollout.
+
+const (
+	canaryLabel = "channel"
+	canaryValue = "canary"
+)
+
+type CanaryConfig struct {
+	// Percent of the workers matching Selector, 100 if unset.
+	Percent  int               `json:"percent,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+func (c *CanaryConfig) check() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent has to be between 0 and 100")
+	}
+	if c.Percent == 0 && len(c.Selector) == 0 {
+		return fmt.Errorf("needs a percent or a selector")
+	}
+	if _, ok := c.Selector[canaryLabel]; ok {
+		return fmt.Errorf("can't select on %s", canaryLabel)
+	}
+	return nil
+}
+
+// matches tells whether the worker with the mac and selectors is a canary.
+func (c *CanaryConfig) matches(mac net.HardwareAddr, selectors map[string]string) bool {
+	for key, value := range c.Selector {
+		if selectors[key] != value {
+			return false
+		}
+	}
+	if c.Percent == 0 || c.Percent == 100 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write(mac)
+	return int(h.Sum32()%100) < c.Percent
+}
+
+type canaryState struct {
+	lock   sync.Mutex
+	config *CanaryConfig
+}
+
+func (c *canaryState) get() *CanaryConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.config
+}
+
+func (c *canaryState) set(config *CanaryConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config = config
+}
+
+// Canary is the rollout with the nodes booted as canaries.
+type Canary struct {
+	CanaryConfig
+	Nodes []string `json:"nodes"`
+}
+
+func (s *Server) canaryStatus() Canary {
+	out := Canary{Nodes: []string{}}
+	if config := s.canary.get(); config != nil {
+		out.CanaryConfig = *config
+	}
+	for _, node := range s.nodes.list() {
+		if node.Labels[canaryLabel] == canaryValue {
+			out.Nodes = append(out.Nodes, node.MAC)
+		}
+	}
+	return out
+}
+
+// canaryRequest returns the matchbox request with the canary selector if
+// it's for a canary worker.
+func (s *Server) canaryRequest(req *http.Request) *http.Request {
+	config := s.canary.get()
+	query := req.URL.Query()
+	if config == nil || query.Get("type") != "worker" || query.Get(canaryLabel) != "" {
+		return req
+	}
+
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil || !config.matches(mac, requestSelectors(query)) {
+		return req
+	}
+
+	query.Set(canaryLabel, canaryValue)
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
+
+func (s *Server) setCanary(actor string, config *CanaryConfig) {
+	s.canary.set(config)
+	if config == nil {
+		s.audit.record(actor, "canary.clear", "", "")
+		return
+	}
+	s.audit.record(actor, "canary.set", "", describeCanary(config))
+}
+
+func describeCanary(config *CanaryConfig) string {
+	percent := config.Percent
+	if percent == 0 {
+		percent = 100
+	}
+	desc := strconv.Itoa(percent) + "% of workers"
+	if len(config.Selector) > 0 {
+		desc += " matching " + strings.TrimPrefix(encodeSelectors(config.Selector), "&")
+	}
+	return desc
+}
+
+// promoteCanary points the stable groups at the profiles of their canary
+// groups, those with the same selectors plus the canary one, and ends the
+// rollout. Returns the IDs of the groups changed.
+func (s *Server) promoteCanary(actor string) ([]string, error) {
+	store := storage.NewFileStore(&storage.Config{Root: s.ServerRoot})
+	groups, err := store.GroupList()
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, canary := range groups {
+		if canary.Selector[canaryLabel] != canaryValue {
+			continue
+		}
+
+		for _, stable := range groups {
+			if !isStableGroupOf(stable.Selector, canary.Selector) || stable.Profile == canary.Profile {
+				continue
+			}
+			stable.Profile = canary.Profile
+			if err := store.GroupPut(stable); err != nil {
+				return changed, fmt.Errorf("Could not update group %s: %s", stable.Id, err)
+			}
+			log.Infof("Group %s now boots canary profile %s", stable.Id, canary.Profile)
+			changed = append(changed, stable.Id)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, fmt.Errorf("No stable group to promote a canary profile to")
+	}
+
+	sort.Strings(changed)
+	s.canary.set(nil)
+	s.audit.record(actor, "canary.promote", "", strings.Join(changed, ", "))
+	return changed, nil
+}
+
+func isStableGroupOf(stable, canary map[string]string) bool {
+	if len(stable) != len(canary)-1 {
+		return false
+	}
+	for key, value := range stable {
+		if key == canaryLabel || canary[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// canaryHandler serves the canary rollout on GET, starts or changes it on
+// PUT and ends it on DELETE.
+func (s *Server) canaryHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, s.canaryStatus())
+	case http.MethodPut:
+		config := &CanaryConfig{}
+		if err := json.NewDecoder(req.Body).Decode(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := config.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.setCanary(requestActor(req), config)
+		writeJSON(w, s.canaryStatus())
+	case http.MethodDelete:
+		s.setCanary(requestActor(req), nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// canaryPromoteHandler promotes the canary on POST.
+func (s *Server) canaryPromoteHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := s.promoteCanary(requestActor(req))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, groups)
+}
+
+// runCanary shows, changes and promotes the canary rollout of a running
+// server.
+func runCanary(args []string) error {
+	flags := flag.NewFlagSet("canary", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	percentFlag := flags.Int("percent", 0, "Percentage of the workers to boot as canaries, with set")
+	selectorFlag := flags.StringToString("selector", nil, "Only boot workers with these selectors as canaries, with set")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s canary status|set|clear|promote [flags]", os.Args[0])
+	if flags.NArg() != 1 {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var canary Canary
+	switch flags.Arg(0) {
+	case "status":
+		canary, err = client.GetCanary()
+	case "set":
+		config := CanaryConfig{Percent: *percentFlag, Selector: *selectorFlag}
+		if err := config.check(); err != nil {
+			return err
+		}
+		canary, err = client.SetCanary(config)
+	case "clear":
+		return client.ClearCanary()
+	case "promote":
+		groups, err := client.PromoteCanary()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Promoted the canary profiles to groups %s\n", strings.Join(groups, ", "))
+		return nil
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+
+	if canary.Percent == 0 && len(canary.Selector) == 0 {
+		fmt.Println("No canary rollout")
+	} else {
+		fmt.Printf("Canary: %s\n", describeCanary(&canary.CanaryConfig))
+	}
+	if len(canary.Nodes) > 0 {
+		fmt.Println("Booted as canaries:")
+	}
+	for _, mac := range canary.Nodes {
+		fmt.Printf("  %s\n", mac)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Firmware retry behaviour only shows when something goes wrong, which on
+// a healthy network is rarely. For testing, the chaos section of the
+// config injects failures: DHCP offers and acks which are never sent,
+// TFTP blocks sent slowly, and machine config fetches failing with 500.
+// It's only honoured with --chaos, so that a config copied from a test
+// lab doesn't break production.
+
+// ChaosConfig has the failures to inject, in percent of the requests.
+type ChaosConfig struct {
+	DropOffers   int `json:"dropOffers,omitempty"`
+	DropAcks     int `json:"dropAcks,omitempty"`
+	ConfigErrors int `json:"configErrors,omitempty"`
+	// TFTPBlockDelay delays every TFTP block, e.g. 50ms.
+	TFTPBlockDelay string `json:"tftpBlockDelay,omitempty"`
+	// MACs limits the failures to these clients.
+	MACs []string `json:"macs,omitempty"`
+
+	tftpBlockDelay time.Duration
+	macs           map[string]bool
+}
+
+func (c *ChaosConfig) check() error {
+	for _, p := range []int{c.DropOffers, c.DropAcks, c.ConfigErrors} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("percentages have to be between 0 and 100")
+		}
+	}
+	if c.TFTPBlockDelay != "" {
+		delay, err := time.ParseDuration(c.TFTPBlockDelay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid TFTP block delay %q", c.TFTPBlockDelay)
+		}
+		c.tftpBlockDelay = delay
+	}
+	c.macs = make(map[string]bool)
+	for _, value := range c.MACs {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAC %s", value)
+		}
+		c.macs[mac.String()] = true
+	}
+	return nil
+}
+
+// chaos returns the failures to inject into the requests of the client,
+// nil if there are none.
+func (s *Server) chaos(mac net.HardwareAddr) *ChaosConfig {
+	if !s.Chaos || s.Config == nil || s.Config.Chaos == nil {
+		return nil
+	}
+	c := s.Config.Chaos
+	if len(c.macs) > 0 && (mac == nil || !c.macs[mac.String()]) {
+		return nil
+	}
+	return c
+}
+
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func chaosHit(percent int) bool {
+	if percent == 0 {
+		return false
+	}
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.Intn(100) < percent
+}
+
+// chaosDropReply tells if the DHCP reply to the client is to be dropped.
+func (s *Server) chaosDropReply(mac net.HardwareAddr, resp *dhcpv4.DHCPv4) bool {
+	c := s.chaos(mac)
+	if c == nil {
+		return false
+	}
+
+	var drop bool
+	switch resp.MessageType() {
+	case dhcpv4.MessageTypeOffer:
+		drop = chaosHit(c.DropOffers)
+	case dhcpv4.MessageTypeAck:
+		drop = chaosHit(c.DropAcks)
+	}
+	if drop {
+		log.Warnf("Chaos: dropping the %s to %s", resp.MessageType(), mac)
+		chaosFailures.WithLabelValues("dhcp").Inc()
+	}
+	return drop
+}
+
+// chaosReader delays every read, that is every TFTP block.
+type chaosReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *chaosReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.Reader.Read(p)
+}
+
+// chaosTFTPReader returns the reader sending the file to the client.
+func (s *Server) chaosTFTPReader(mac net.HardwareAddr, r io.Reader) io.Reader {
+	c := s.chaos(mac)
+	if c == nil || c.tftpBlockDelay == 0 {
+		return r
+	}
+	log.Warnf("Chaos: delaying the TFTP blocks to %s by %s", mac, c.tftpBlockDelay)
+	chaosFailures.WithLabelValues("tftp").Inc()
+	return &chaosReader{Reader: r, delay: c.tftpBlockDelay}
+}
+
+// chaosHandler fails machine config fetches with 500.
+func (s *Server) chaosHandler(next http.Handler) http.Handler {
+	if !s.Chaos {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if !isMachineConfigPath(path.Clean(req.URL.Path)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		mac := s.clientMAC(req)
+		if c := s.chaos(mac); c != nil && chaosHit(c.ConfigErrors) {
+			log.Warnf("Chaos: failing %s for %s", req.URL.Path, req.RemoteAddr)
+			chaosFailures.WithLabelValues("config").Inc()
+			http.Error(w, "Chaos", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Nodes often boot with their clock at the epoch or wherever the firmware
+// left it, so nothing is ever validated against the time a client
+// reports. Leases, tokens and sessions expire by the monotonic clock of
+// the server, which wall clock steps, e.g. NTP fixing up the server's own
+// clock after boot, don't move either. The time clients report is only
+// recorded in their boot sessions, to tell why a node fails TLS or
+// refuses its certificates.
+
+const (
+	// clientTimeParam carries ${unixtime} of iPXE on /ipxe, and the time
+	// of the node on progress reports.
+	clientTimeParam = "time"
+	// Skews below this are the usual network and firmware delays.
+	clockSkewWarn = 5 * time.Minute
+)
+
+// sinceNow returns the time as far in the future as the wall clock time
+// t, carrying the monotonic clock reading, for times read from disk or
+// across the wire.
+func sinceNow(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Now().Add(time.Until(t))
+}
+
+// parseClientTime parses a client reported time in Unix seconds, which is
+// all iPXE knows, or RFC 3339.
+func parseClientTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// takeClientTime removes the client time from the query of the request,
+// so that it doesn't end up in the selectors or the render cache keys,
+// and returns it.
+func takeClientTime(req *http.Request) (time.Time, bool) {
+	query := req.URL.Query()
+	if _, ok := query[clientTimeParam]; !ok {
+		return time.Time{}, false
+	}
+
+	t, ok := parseClientTime(query.Get(clientTimeParam))
+	query.Del(clientTimeParam)
+	req.URL.RawQuery = query.Encode()
+	return t, ok
+}
+
+// clientClock records the time the client reported in its session.
+func (bs *bootSessions) clientClock(mac net.HardwareAddr, reported time.Time) {
+	if mac == nil {
+		return
+	}
+
+	skew := reported.Sub(time.Now()).Round(time.Second)
+
+	bs.lock.Lock()
+	sess, ok := bs.byMAC[mac.String()]
+	if ok {
+		reported := reported.UTC()
+		sess.ClientTime = &reported
+		sess.ClockSkew = skew.Seconds()
+	}
+	bs.lock.Unlock()
+
+	if skew < 0 {
+		clientClockSkew.Observe(-skew.Seconds())
+	} else {
+		clientClockSkew.Observe(skew.Seconds())
+	}
+	if skew > clockSkewWarn || skew < -clockSkewWarn {
+		log.Warnf("Clock of %s is off by %s, it reports %s", mac, skew, reported.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Subcommands are run as `talos-pxe <command> [flags]`. Without a command
+// talos-pxe runs the server.
+var commands = map[string]func(args []string) error{
+	"access":          runAccess,
+	"bench":           runBench,
+	"backup":          runBackup,
+	"ca":              runCA,
+	"canary":          runCanary,
+	"demo":            runDemo,
+	"dhcp":            runDHCP,
+	"dns":             runDNS,
+	"etcd":            runEtcd,
+	"events":          runEvents,
+	"ipxe-build":      runIpxeBuild,
+	"leases":          runLeases,
+	"media":           runMedia,
+	"nodes":           runNodes,
+	"openapi":         runOpenAPI,
+	"provisioning":    runProvisioning,
+	"proxydhcp-check": runProxyDHCPCheck,
+	"report":          runReport,
+	"selfhost":        runSelfhost,
+	"simulate":        runSimulate,
+	"state":           runState,
+	"top":             runTop,
+	"upgrade":         runUpgrade,
+	"versions":        runVersions,
+	"vm":              runVM,
+}
+
+// runCommand runs the subcommand named by the first argument, if any.
+// Returns false if there was no subcommand to run.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	if args[0] == "help" {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+		fmt.Fprintf(os.Stderr, "\nWithout a command the server is started, see --help for its flags.\n")
+		return true
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := command(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	return true
+}
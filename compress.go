@@ -0,0 +1,198 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Only the configs, scripts and metadata are compressed. The kernel and
+// initramfs images are already compressed, and have binary types.
+var compressibleTypes = map[string]bool{
+	"application/json":   true,
+	"application/yaml":   true,
+	"application/x-yaml": true,
+	"application/xml":    true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// The encodings in order of preference, for clients accepting several
+// with the same quality. zstd is both faster and smaller than gzip.
+var contentEncodings = []string{"zstd", "gzip"}
+
+// acceptedEncoding negotiates the content encoding of the response from
+// the Accept-Encoding header, empty if the client accepts none of ours.
+func acceptedEncoding(req *http.Request) string {
+	quality := map[string]float64{}
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		quality[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range contentEncodings {
+		if q := quality[name]; q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// The encoders are pooled, as the zstd ones are costly to create.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	zstdWriters = sync.Pool{New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}}
+)
+
+// compressWriter is the encoder of a response, returned to its pool once
+// closed.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressWriter(encoding string, w io.Writer) compressWriter {
+	switch encoding {
+	case "zstd":
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &pooledWriter{enc, &zstdWriters}
+	default:
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return &pooledWriter{gz, &gzipWriters}
+	}
+}
+
+type pooledWriter struct {
+	compressWriter
+	pool *sync.Pool
+}
+
+func (w *pooledWriter) Close() error {
+	err := w.compressWriter.Close()
+	w.pool.Put(w.compressWriter)
+	return err
+}
+
+// compressResponseWriter decides whether to compress once the status and
+// content type of the response are known. It passes http.Flusher and
+// io.ReaderFrom through, the latter so that uncompressed files are still
+// sent with sendfile.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      compressWriter
+	decided  bool
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decided = true
+
+		h := w.Header()
+		if status == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			w.enc = newCompressWriter(w.encoding, w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writerOnly hides the io.ReaderFrom of the response writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+func (w *compressResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	// Without a content type, it's sniffed from the first write.
+	if !w.decided && w.Header().Get("Content-Type") != "" {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided && w.enc == nil {
+		if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+			return rf.ReadFrom(r)
+		}
+	}
+	return io.Copy(writerOnly{w}, r)
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+// compressHandler compresses the responses for clients which accept zstd
+// or gzip. iPXE accepts neither, so this only matters to the tooling and
+// to Talos fetching its config.
+func compressHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(req)
+		if encoding == "" || req.Header.Get("Range") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
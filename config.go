@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings too structured for flags, loaded from the
+// JSON file given with --config.
+type Config struct {
+	// NICQuirks maps NICs known to hang with the default iPXE build to
+	// an alternative one. The first matching entry wins.
+	NICQuirks []NICQuirk `json:"nicQuirks,omitempty"`
+
+	// BootOverrides point matching clients at another next server and
+	// boot file. The first matching override wins.
+	BootOverrides []BootOverride `json:"bootOverrides,omitempty"`
+
+	// BootPolicies select how matching clients boot, see BootPolicy.
+	// The first matching policy wins.
+	BootPolicies []BootPolicy `json:"bootPolicies,omitempty"`
+
+	// Interfaces are created before serving, in order.
+	Interfaces []InterfaceConfig `json:"interfaces,omitempty"`
+
+	// WireGuard sets up a tunnel to a central site.
+	WireGuard *WireGuardConfig `json:"wireguard,omitempty"`
+
+	// Quarantine keeps unknown clients off the provisioning range.
+	Quarantine *QuarantineConfig `json:"quarantine,omitempty"`
+
+	// Canary boots some of the workers with the canary profiles.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+
+	// Maintenance limits reinstalling known nodes to windows.
+	Maintenance *MaintenanceConfig `json:"maintenance,omitempty"`
+
+	// Variables are looked up when rendering templates, by name.
+	Variables map[string]*TemplateVar `json:"variables,omitempty"`
+
+	// Access requires tokens for the admin and management APIs.
+	Access *AccessConfig `json:"access,omitempty"`
+
+	// Export sends the audit events and boot steps to remote sinks.
+	Export []ExportSink `json:"export,omitempty"`
+
+	// Routes mount extra backends on the HTTP port.
+	Routes []HTTPRoute `json:"routes,omitempty"`
+
+	// SerialConsoles set the console arguments by hardware model. The
+	// first matching entry wins.
+	SerialConsoles []SerialConsole `json:"serialConsoles,omitempty"`
+
+	// MachineClasses sort the machines by hardware. The first matching
+	// class wins.
+	MachineClasses []MachineClass `json:"machineClasses,omitempty"`
+
+	// InstallDisk picks the install disk of the nodes from the disks
+	// they reported.
+	InstallDisk *InstallDiskPolicy `json:"installDisk,omitempty"`
+
+	// Network configures the leased addresses of the nodes statically.
+	Network *NetworkConfig `json:"network,omitempty"`
+
+	// NodePools group nodes with defaults of their own. The first
+	// matching pool wins.
+	NodePools []NodePool `json:"nodePools,omitempty"`
+
+	// RoleRanges lease controlplane nodes and workers addresses from
+	// blocks of their own.
+	RoleRanges map[string]*AddressRange `json:"roleRanges,omitempty"`
+
+	// Jobs flag nodes for reinstall on a schedule.
+	Jobs []ScheduledJob `json:"jobs,omitempty"`
+
+	// Switches are asked for the ports of the booting nodes.
+	Switches []SwitchConfig `json:"switches,omitempty"`
+
+	// Chaos injects failures, with --chaos.
+	Chaos *ChaosConfig `json:"chaos,omitempty"`
+
+	// Backup uploads the state and secrets of the server on a schedule.
+	Backup *BackupConfig `json:"backup,omitempty"`
+
+	// Hooks run at points of the lifecycle of the nodes, in order.
+	Hooks []Hook `json:"hooks,omitempty"`
+}
+
+// ClientMatch matches clients by any combination of architecture (option
+// 93), vendor class (option 60), user class (option 77) and MAC prefix.
+// The classes are globs.
+type ClientMatch struct {
+	Arch      *int   `json:"arch,omitempty"`
+	Class     string `json:"class,omitempty"`
+	UserClass string `json:"userClass,omitempty"`
+	MACPrefix string `json:"macPrefix,omitempty"`
+}
+
+// A NICQuirk serves Binary from the server root instead of ipxe.efi to
+// the matching clients.
+type NICQuirk struct {
+	Comment string `json:"comment,omitempty"`
+	ClientMatch
+	Binary string `json:"binary"`
+}
+
+func loadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Could not parse config %s: %s", name, err)
+	}
+
+	for i, q := range config.NICQuirks {
+		if q.Binary == "" || !isRootRelative(q.Binary) {
+			return nil, fmt.Errorf("NIC quirk %d needs the name of a binary in the server root", i)
+		}
+		if err := q.check(); err != nil {
+			return nil, fmt.Errorf("NIC quirk %d: %s", i, err)
+		}
+	}
+
+	for i := range config.BootOverrides {
+		if err := config.BootOverrides[i].check(); err != nil {
+			return nil, fmt.Errorf("Boot override %d: %s", i, err)
+		}
+	}
+
+	for i, p := range config.BootPolicies {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("Boot policy %d: %s", i, err)
+		}
+	}
+
+	for i, ic := range config.Interfaces {
+		if err := ic.check(); err != nil {
+			return nil, fmt.Errorf("Interface %d: %s", i, err)
+		}
+	}
+
+	if config.WireGuard != nil {
+		if err := config.WireGuard.check(); err != nil {
+			return nil, fmt.Errorf("WireGuard: %s", err)
+		}
+	}
+
+	if config.Quarantine != nil {
+		if err := config.Quarantine.check(); err != nil {
+			return nil, fmt.Errorf("Quarantine: %s", err)
+		}
+	}
+
+	if config.Canary != nil {
+		if err := config.Canary.check(); err != nil {
+			return nil, fmt.Errorf("Canary: %s", err)
+		}
+	}
+
+	if config.Maintenance != nil {
+		if err := config.Maintenance.check(); err != nil {
+			return nil, fmt.Errorf("Maintenance: %s", err)
+		}
+	}
+
+	for name, v := range config.Variables {
+		if err := v.check(); err != nil {
+			return nil, fmt.Errorf("Variable %s: %s", name, err)
+		}
+	}
+
+	if config.Access != nil {
+		if err := config.Access.check(); err != nil {
+			return nil, fmt.Errorf("Access: %s", err)
+		}
+	}
+
+	for i, sink := range config.Export {
+		if err := sink.check(); err != nil {
+			return nil, fmt.Errorf("Export %d: %s", i, err)
+		}
+	}
+
+	for i, route := range config.Routes {
+		if err := route.check(); err != nil {
+			return nil, fmt.Errorf("Route %d: %s", i, err)
+		}
+	}
+
+	for i, console := range config.SerialConsoles {
+		if err := console.check(); err != nil {
+			return nil, fmt.Errorf("Serial console %d: %s", i, err)
+		}
+	}
+
+	if config.InstallDisk != nil {
+		if err := config.InstallDisk.check(); err != nil {
+			return nil, fmt.Errorf("Install disk: %s", err)
+		}
+	}
+
+	if config.Network != nil {
+		if err := config.Network.check(); err != nil {
+			return nil, fmt.Errorf("Network: %s", err)
+		}
+	}
+
+	if config.Chaos != nil {
+		if err := config.Chaos.check(); err != nil {
+			return nil, fmt.Errorf("Chaos: %s", err)
+		}
+	}
+
+	if config.Backup != nil {
+		if err := config.Backup.check(); err != nil {
+			return nil, fmt.Errorf("Backup: %s", err)
+		}
+	}
+
+	for i := range config.Hooks {
+		if err := config.Hooks[i].check(); err != nil {
+			return nil, fmt.Errorf("Hook %d: %s", i, err)
+		}
+	}
+
+	jobs := make(map[string]bool)
+	for i := range config.Jobs {
+		job := &config.Jobs[i]
+		if err := job.check(); err != nil {
+			return nil, fmt.Errorf("Job %d: %s", i, err)
+		}
+		if jobs[job.Name] {
+			return nil, fmt.Errorf("Job %d: duplicate name %s", i, job.Name)
+		}
+		jobs[job.Name] = true
+	}
+
+	classes := make(map[string]bool)
+	for i, class := range config.MachineClasses {
+		if err := class.check(); err != nil {
+			return nil, fmt.Errorf("Machine class %d: %s", i, err)
+		}
+		if classes[class.Name] {
+			return nil, fmt.Errorf("Machine class %d: duplicate name %s", i, class.Name)
+		}
+		classes[class.Name] = true
+	}
+
+	pools := make(map[string]bool)
+	for i := range config.NodePools {
+		pool := &config.NodePools[i]
+		if err := pool.check(); err != nil {
+			return nil, fmt.Errorf("Node pool %d: %s", i, err)
+		}
+		if pools[pool.Name] {
+			return nil, fmt.Errorf("Node pool %d: duplicate name %s", i, pool.Name)
+		}
+		pools[pool.Name] = true
+		for _, class := range pool.Match.MachineClasses {
+			if !classes[class] {
+				return nil, fmt.Errorf("Node pool %d: unknown machine class %s", i, class)
+			}
+		}
+	}
+
+	if err := checkRoleRanges(config.RoleRanges); err != nil {
+		return nil, fmt.Errorf("Role ranges: %s", err)
+	}
+
+	for i := range config.Switches {
+		if err := config.Switches[i].check(); err != nil {
+			return nil, fmt.Errorf("Switch %d: %s", i, err)
+		}
+	}
+
+	return config, nil
+}
+
+func isRootRelative(name string) bool {
+	return !path.IsAbs(name) && !strings.Contains(name, "..")
+}
+
+func (m *ClientMatch) check() error {
+	for _, pattern := range []string{m.Class, m.UserClass} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid class pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// classArch extracts the architecture from a PXE vendor class like
+// PXEClient:Arch:00007:UNDI:003016.
+func classArch(classId string) (int, bool) {
+	parts := strings.Split(classId, ":")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "Arch" {
+			arch, err := strconv.Atoi(parts[i+1])
+			return arch, err == nil
+		}
+	}
+	return 0, false
+}
+
+// userClasses splits the user classes the way they're formatted into
+// the boot file name, e.g. [iPXE].
+func userClasses(classInfo string) []string {
+	return strings.Fields(strings.Trim(classInfo, "[]"))
+}
+
+func (m *ClientMatch) matches(mac net.HardwareAddr, classId, classInfo string) bool {
+	if m.Arch != nil {
+		if arch, ok := classArch(classId); !ok || arch != *m.Arch {
+			return false
+		}
+	}
+	if m.Class != "" {
+		if ok, _ := path.Match(m.Class, classId); !ok {
+			return false
+		}
+	}
+	if m.UserClass != "" {
+		found := false
+		for _, class := range userClasses(classInfo) {
+			if ok, _ := path.Match(m.UserClass, class); ok {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.MACPrefix != "" && !strings.HasPrefix(mac.String(), strings.ToLower(m.MACPrefix)) {
+		return false
+	}
+	return true
+}
+
+// nicQuirk returns the quirk matching the client, if any.
+func (s *Server) nicQuirk(mac net.HardwareAddr, classId, classInfo string) *NICQuirk {
+	if s.Config == nil {
+		return nil
+	}
+
+	for i := range s.Config.NICQuirks {
+		if q := &s.Config.NICQuirks[i]; q.matches(mac, classId, classInfo) {
+			return q
+		}
+	}
+	return nil
+}
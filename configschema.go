@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/ajeddeloh/yaml"
+)
+
+// A typo in a machine config, e.g. `dsik` for `disk` under
+// `machine.install`, makes Talos refuse it only once the node booted,
+// leaving it stuck or, worse, installing with the defaults. The machine
+// configs served are checked against the v1alpha1 schema in strict mode,
+// unknown fields and values of the wrong type failing them, and invalid
+// ones aren't served: machines asking for their boot script get a script
+// retrying with a backoff like those without a profile, and the config
+// fetch fails. Only the fields typos are likely in are typed, the others
+// taking anything. Documents of other kinds only need an apiVersion and a
+// kind.
+
+type schemaKind int
+
+const (
+	schemaAny schemaKind = iota
+	schemaString
+	schemaBool
+	schemaInt
+	schemaObject
+	schemaMap
+	schemaList
+)
+
+// How many problems a validation error lists at most.
+const schemaMaxProblems = 5
+
+type configSchema struct {
+	kind   schemaKind
+	fields map[string]*configSchema
+	// elem is the schema of the values of maps and the items of lists.
+	elem *configSchema
+	enum []string
+}
+
+var (
+	anySchema    = &configSchema{kind: schemaAny}
+	stringSchema = &configSchema{kind: schemaString}
+	boolSchema   = &configSchema{kind: schemaBool}
+	intSchema    = &configSchema{kind: schemaInt}
+)
+
+func objectSchema(fields map[string]*configSchema) *configSchema {
+	return &configSchema{kind: schemaObject, fields: fields}
+}
+
+func mapSchema(elem *configSchema) *configSchema {
+	return &configSchema{kind: schemaMap, elem: elem}
+}
+
+func listSchema(elem *configSchema) *configSchema {
+	return &configSchema{kind: schemaList, elem: elem}
+}
+
+func enumSchema(values ...string) *configSchema {
+	return &configSchema{kind: schemaString, enum: values}
+}
+
+var (
+	certSchema = objectSchema(map[string]*configSchema{
+		"crt": stringSchema,
+		"key": stringSchema,
+	})
+
+	stringsSchema = listSchema(stringSchema)
+
+	stringMapSchema = mapSchema(stringSchema)
+
+	v1alpha1Schema = objectSchema(map[string]*configSchema{
+		"version": enumSchema("v1alpha1"),
+		"debug":   boolSchema,
+		"persist": boolSchema,
+		"machine": objectSchema(map[string]*configSchema{
+			"type":        enumSchema("init", "controlplane", "worker"),
+			"token":       stringSchema,
+			"ca":          certSchema,
+			"acceptedCAs": listSchema(certSchema),
+			"certSANs":    stringsSchema,
+			"controlPlane": objectSchema(map[string]*configSchema{
+				"controllerManager": anySchema,
+				"scheduler":         anySchema,
+			}),
+			"kubelet": objectSchema(map[string]*configSchema{
+				"image":                               stringSchema,
+				"clusterDNS":                          stringsSchema,
+				"extraArgs":                           stringMapSchema,
+				"extraMounts":                         listSchema(anySchema),
+				"extraConfig":                         anySchema,
+				"credentialProviderConfig":            anySchema,
+				"defaultRuntimeSeccompProfileEnabled": boolSchema,
+				"registerWithFQDN":                    boolSchema,
+				"nodeIP":                              anySchema,
+				"skipNodeRegistration":                boolSchema,
+				"disableManifestsDirectory":           boolSchema,
+			}),
+			"pods": listSchema(anySchema),
+			"network": objectSchema(map[string]*configSchema{
+				"hostname":            stringSchema,
+				"interfaces":          listSchema(anySchema),
+				"nameservers":         stringsSchema,
+				"extraHostEntries":    listSchema(anySchema),
+				"kubespan":            anySchema,
+				"disableSearchDomain": boolSchema,
+			}),
+			"disks": listSchema(anySchema),
+			"install": objectSchema(map[string]*configSchema{
+				"disk":              stringSchema,
+				"diskSelector":      anySchema,
+				"extraKernelArgs":   stringsSchema,
+				"image":             stringSchema,
+				"extensions":        listSchema(anySchema),
+				"bootloader":        boolSchema,
+				"wipe":              boolSchema,
+				"legacyBIOSSupport": boolSchema,
+			}),
+			"files": listSchema(objectSchema(map[string]*configSchema{
+				"content":     stringSchema,
+				"permissions": intSchema,
+				"path":        stringSchema,
+				"op":          enumSchema("create", "append", "overwrite"),
+			})),
+			"env": stringMapSchema,
+			"time": objectSchema(map[string]*configSchema{
+				"disabled":    boolSchema,
+				"servers":     stringsSchema,
+				"bootTimeout": stringSchema,
+			}),
+			"sysctls":                  stringMapSchema,
+			"sysfs":                    stringMapSchema,
+			"registries":               anySchema,
+			"systemDiskEncryption":     anySchema,
+			"features":                 anySchema,
+			"udev":                     anySchema,
+			"logging":                  anySchema,
+			"kernel":                   anySchema,
+			"seccompProfiles":          listSchema(anySchema),
+			"nodeLabels":               stringMapSchema,
+			"nodeAnnotations":          stringMapSchema,
+			"nodeTaints":               stringMapSchema,
+			"baseRuntimeSpecOverrides": anySchema,
+		}),
+		"cluster": objectSchema(map[string]*configSchema{
+			"id":     stringSchema,
+			"secret": stringSchema,
+			"controlPlane": objectSchema(map[string]*configSchema{
+				"endpoint":           stringSchema,
+				"localAPIServerPort": intSchema,
+			}),
+			"clusterName": stringSchema,
+			"network": objectSchema(map[string]*configSchema{
+				"cni":            anySchema,
+				"dnsDomain":      stringSchema,
+				"podSubnets":     stringsSchema,
+				"serviceSubnets": stringsSchema,
+			}),
+			"token":                     stringSchema,
+			"aescbcEncryptionSecret":    stringSchema,
+			"secretboxEncryptionSecret": stringSchema,
+			"ca":                        certSchema,
+			"acceptedCAs":               listSchema(certSchema),
+			"aggregatorCA":              certSchema,
+			"serviceAccount": objectSchema(map[string]*configSchema{
+				"key": stringSchema,
+			}),
+			"apiServer":         anySchema,
+			"controllerManager": anySchema,
+			"proxy":             anySchema,
+			"scheduler":         anySchema,
+			"discovery": objectSchema(map[string]*configSchema{
+				"enabled": boolSchema,
+				"registries": objectSchema(map[string]*configSchema{
+					"kubernetes": objectSchema(map[string]*configSchema{
+						"disabled": boolSchema,
+					}),
+					"service": objectSchema(map[string]*configSchema{
+						"disabled": boolSchema,
+						"endpoint": stringSchema,
+					}),
+				}),
+			}),
+			"etcd":                           anySchema,
+			"coreDNS":                        anySchema,
+			"externalCloudProvider":          anySchema,
+			"extraManifests":                 stringsSchema,
+			"extraManifestHeaders":           stringMapSchema,
+			"inlineManifests":                listSchema(anySchema),
+			"adminKubeconfig":                anySchema,
+			"allowSchedulingOnControlPlanes": boolSchema,
+			"allowSchedulingOnMasters":       boolSchema,
+		}),
+	})
+)
+
+var invalidConfigRetryTemplate = template.Must(template.New("iPXE invalid config").Parse(`#!ipxe
+echo
+echo The {{ .Type }} machine config of this machine ({{ .MAC }}) is invalid:
+echo {{ .Reason }}
+echo Retrying in {{ .Delay }} seconds, attempt {{ .Attempt }} of {{ .Attempts }}.
+sleep {{ .Delay }}
+chain {{ .URL }}
+`))
+
+func (c *configSchema) validate(key string, v interface{}, problems *[]string) {
+	if v == nil || c.kind == schemaAny {
+		return
+	}
+	wrongType := func(want string) {
+		*problems = append(*problems, fmt.Sprintf("%s: has to be %s", key, want))
+	}
+
+	switch c.kind {
+	case schemaString:
+		s, ok := v.(string)
+		if !ok {
+			wrongType("a string")
+			return
+		}
+		if len(c.enum) == 0 {
+			return
+		}
+		for _, value := range c.enum {
+			if s == value {
+				return
+			}
+		}
+		*problems = append(*problems, fmt.Sprintf("%s: %q isn't one of %s", key, s, strings.Join(c.enum, ", ")))
+	case schemaBool:
+		if _, ok := v.(bool); !ok {
+			wrongType("true or false")
+		}
+	case schemaInt:
+		switch v.(type) {
+		case int, int64, uint64:
+		default:
+			wrongType("an integer")
+		}
+	case schemaList:
+		items, ok := v.([]interface{})
+		if !ok {
+			wrongType("a list")
+			return
+		}
+		for i, item := range items {
+			c.elem.validate(fmt.Sprintf("%s[%d]", key, i), item, problems)
+		}
+	case schemaMap, schemaObject:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			wrongType("a map")
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if key != "" {
+				child = key + "." + k
+			}
+			value := m[k]
+			if c.kind == schemaMap {
+				c.elem.validate(child, value, problems)
+				continue
+			}
+			field, ok := c.fields[k]
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("%s: unknown field", child))
+				continue
+			}
+			field.validate(child, value, problems)
+		}
+	}
+}
+
+// splitConfigDocuments splits the YAML documents of a machine config.
+func splitConfigDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	var doc []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.Equal(bytes.TrimRight(line, " \r\n"), []byte("---")) {
+			docs = append(docs, doc)
+			doc = nil
+			continue
+		}
+		doc = append(doc, line...)
+	}
+	return append(docs, doc)
+}
+
+// validateMachineConfig checks the machine config against the schema.
+func validateMachineConfig(data []byte) error {
+	var problems []string
+	for i, doc := range splitConfigDocuments(data) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		var cfg map[interface{}]interface{}
+		if err := yaml.Unmarshal(doc, &cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("document %d isn't valid YAML: %s", i+1, err))
+			continue
+		}
+		if cfg == nil {
+			continue
+		}
+		if _, ok := cfg["version"]; ok {
+			v1alpha1Schema.validate("", cfg, &problems)
+			continue
+		}
+		if cfg["apiVersion"] == nil || cfg["kind"] == nil {
+			problems = append(problems, fmt.Sprintf("document %d has no version, or apiVersion and kind", i+1))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > schemaMaxProblems {
+		problems = append(problems[:schemaMaxProblems], fmt.Sprintf("and %d more", len(problems)-schemaMaxProblems))
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// configSchemaHandler refuses the machine configs not matching the
+// schema. Everything else is passed to the next handler.
+func (s *Server) configSchemaHandler(next http.Handler) http.Handler {
+	if !s.ValidateConfigs {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		if req.Method != http.MethodGet || !isMachineConfigPath(name) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rr := httptest.NewRecorder()
+		next.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			if err := validateMachineConfig(rr.Body.Bytes()); err != nil {
+				if !isConfigRender(req) {
+					mac := s.clientMAC(req)
+					log.Errorf("Refusing invalid machine config %s to %s: %s", name, mac, err)
+					s.sessions.failed(mac, err)
+					invalidMachineConfigs.Inc()
+				}
+				http.Error(w, fmt.Sprintf("Invalid machine config %s: %s", name, err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		copyHeader(w.Header(), rr.Header())
+		w.WriteHeader(rr.Code)
+		w.Write(rr.Body.Bytes())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// invalidConfigScript tells whether the machine config the boot script
+// rendered by matchbox passes is invalid, returning the script retrying
+// the boot script request, nil if the attempts ran out.
+func (s *Server) invalidConfigScript(req *http.Request, script []byte, mac net.HardwareAddr, retry int) ([]byte, bool) {
+	if !s.ValidateConfigs || mac == nil {
+		return nil, false
+	}
+	uri, ok := bootScriptConfig(s.withTalosVersion(script, mac))
+	if !ok {
+		return nil, false
+	}
+	ip := req.URL.Query().Get("ip")
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	_, err := s.renderConfig(configRenderRequest(uri, ip, mac))
+	if err == nil {
+		return nil, false
+	}
+	// Other failures are left to the config fetch.
+	i := strings.Index(err.Error(), "Invalid machine config")
+	if i < 0 {
+		return nil, false
+	}
+
+	query := req.URL.Query()
+	log.Errorf("Not booting %s as %s: %s", mac, query.Get("type"), err)
+	s.sessions.failed(mac, err)
+	invalidMachineConfigs.Inc()
+
+	data, ok := s.retryData(req, retry)
+	if !ok {
+		if s.ConfigRetryAttempts > 0 {
+			log.Warnf("Machine config of %s still invalid after %d attempts, serving the menu", mac, retry)
+		}
+		return nil, true
+	}
+	reason := err.Error()[i:]
+
+	var buf bytes.Buffer
+	err = invalidConfigRetryTemplate.Execute(&buf, struct {
+		configRetryData
+		Reason string
+	}{data, strings.NewReplacer("\n", " ", "$", "", "{", "(", "}", ")").Replace(reason)})
+	if err != nil {
+		log.Errorf("Could not render retry script: %s", err)
+		return nil, true
+	}
+	return buf.Bytes(), true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// How much the iPXE scripts print on the console depends on who's looking
+// at it. Quiet skips the boot menu entirely, booting the default item
+// straight away, for fleets nobody watches boot. Verbose prints what the
+// client is and where it boots from, and what the boot scripts are
+// loading, for crash carts and serial consoles debugging a node.
+
+const (
+	ConsoleQuiet   = "quiet"
+	ConsoleNormal  = "normal"
+	ConsoleVerbose = "verbose"
+)
+
+var consoleVerbosities = map[string]bool{
+	ConsoleQuiet:   true,
+	ConsoleNormal:  true,
+	ConsoleVerbose: true,
+}
+
+func checkConsoleVerbosity(verbosity string) error {
+	if !consoleVerbosities[verbosity] {
+		return fmt.Errorf("Unknown console verbosity %s, expected quiet, normal or verbose", verbosity)
+	}
+	return nil
+}
+
+// withConsoleMessages adds messages telling what's being loaded to the
+// boot script, if the console is verbose.
+func (s *Server) withConsoleMessages(script []byte) []byte {
+	if s.ConsoleVerbosity != ConsoleVerbose {
+		return script
+	}
+
+	var out []string
+	for _, line := range strings.Split(string(script), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			out = append(out, line)
+			continue
+		}
+
+		switch fields[0] {
+		case "kernel", "initrd":
+			what := map[string]string{"kernel": "kernel", "initrd": "initramfs"}[fields[0]]
+			out = append(out, fmt.Sprintf("echo Loading %s %s", what, scriptImageName(fields[1:])))
+		case "boot":
+			out = append(out, "imgstat", "echo Booting Talos")
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// scriptImageName returns the name of the image the arguments of a
+// kernel or initrd command load, skipping their options.
+func scriptImageName(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return path.Base(strings.SplitN(arg, "?", 2)[0])
+		}
+	}
+	return ""
+}
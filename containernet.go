@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// For CI, the nodes can be containers, e.g. QEMU in a container, on a
+// user-defined Docker or Podman network. --container-network inspects the
+// network, serving on the interface with an address in its subnet, the
+// bridge when on the host or the container's when talos-pxe runs on the
+// network itself, and advertising that address. Docker and Podman assign
+// the containers' addresses themselves, so those aren't leased: the
+// --ip-range of the network if it has one, else the lower half of the
+// subnet, which they assign from, and the addresses of the containers
+// attached.
+
+type containerNetwork struct {
+	Name    string
+	Subnet  *net.IPNet
+	Gateway net.IP
+	// Range is what the containers are assigned addresses from.
+	Range      *AddressRange
+	Containers []net.IP
+}
+
+// Both the Docker and the Podman formats of `network inspect`.
+type containerNetworkInspect struct {
+	Name string `json:"name"`
+	IPAM struct {
+		Config []struct {
+			Subnet  string `json:"Subnet"`
+			IPRange string `json:"IPRange"`
+			Gateway string `json:"Gateway"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+	Subnets []struct {
+		Subnet     string `json:"subnet"`
+		Gateway    string `json:"gateway"`
+		LeaseRange *struct {
+			StartIP string `json:"start_ip"`
+			EndIP   string `json:"end_ip"`
+		} `json:"lease_range"`
+	} `json:"subnets"`
+	Containers map[string]struct {
+		IPv4Address string `json:"IPv4Address"`
+	} `json:"Containers"`
+}
+
+// containerRuntime returns the runtime to use, docker if it's installed
+// and else podman.
+func containerRuntime(runtime string) string {
+	if runtime != "" {
+		return runtime
+	}
+	if _, err := exec.LookPath("docker"); err == nil {
+		return "docker"
+	}
+	return "podman"
+}
+
+func inspectContainerNetwork(runtime, name string) (*containerNetwork, error) {
+	runtime = containerRuntime(runtime)
+	var stderr bytes.Buffer
+	cmd := exec.Command(runtime, "network", "inspect", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Could not inspect %s network %s: %s: %s", runtime, name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var inspect []containerNetworkInspect
+	if err := json.Unmarshal(out, &inspect); err != nil || len(inspect) != 1 {
+		return nil, fmt.Errorf("Unexpected output of %s network inspect %s", runtime, name)
+	}
+	return parseContainerNetwork(&inspect[0], name)
+}
+
+// parseContainerNetwork takes the first IPv4 subnet of the network.
+func parseContainerNetwork(inspect *containerNetworkInspect, name string) (*containerNetwork, error) {
+	n := &containerNetwork{Name: name}
+	for _, config := range inspect.IPAM.Config {
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil || subnet.IP.To4() == nil {
+			continue
+		}
+		n.Subnet, n.Gateway = subnet, net.ParseIP(config.Gateway).To4()
+		if config.IPRange != "" {
+			_, r, err := net.ParseCIDR(config.IPRange)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid IP range %s of network %s", config.IPRange, name)
+			}
+			n.Range = cidrRange(r)
+		}
+		break
+	}
+	for _, config := range inspect.Subnets {
+		if n.Subnet != nil {
+			break
+		}
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil || subnet.IP.To4() == nil {
+			continue
+		}
+		n.Subnet, n.Gateway = subnet, net.ParseIP(config.Gateway).To4()
+		if config.LeaseRange != nil {
+			n.Range = &AddressRange{Start: config.LeaseRange.StartIP, End: config.LeaseRange.EndIP}
+		}
+	}
+	if n.Subnet == nil {
+		return nil, fmt.Errorf("Network %s has no IPv4 subnet", name)
+	}
+
+	if n.Range == nil {
+		lower := *n.Subnet
+		ones, bits := lower.Mask.Size()
+		if ones < bits-1 {
+			lower.Mask = net.CIDRMask(ones+1, bits)
+		}
+		n.Range = cidrRange(&lower)
+	}
+	if err := n.Range.check(); err != nil {
+		return nil, fmt.Errorf("Invalid IP range of network %s: %s", name, err)
+	}
+
+	for _, c := range inspect.Containers {
+		if ip, _, err := net.ParseCIDR(c.IPv4Address); err == nil && ip.To4() != nil {
+			n.Containers = append(n.Containers, ip.To4())
+		}
+	}
+	return n, nil
+}
+
+func cidrRange(n *net.IPNet) *AddressRange {
+	start := n.IP.To4()
+	end := make(net.IP, 4)
+	binary.BigEndian.PutUint32(end, binary.BigEndian.Uint32(start)|^binary.BigEndian.Uint32(net.IP(n.Mask).To4()))
+	return &AddressRange{Start: start.String(), End: end.String()}
+}
+
+// localAddress returns the interface with an address in the subnet of the
+// network and the address.
+func (n *containerNetwork) localAddress() (string, *net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && n.Subnet.Contains(ipNet.IP) {
+				return iface.Name, &net.IPNet{IP: ipNet.IP.To4(), Mask: n.Subnet.Mask}, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("No interface on network %s (%s), run talos-pxe on the host or attached to it with the host network", n.Name, n.Subnet)
+}
+
+// reserveContainerAddresses takes the addresses the runtime assigns to
+// the containers out of the provisioning range.
+func (s *Server) reserveContainerAddresses() {
+	n := s.ContainerNetwork
+	start := binary.BigEndian.Uint32(net.ParseIP(n.Range.Start).To4())
+	end := binary.BigEndian.Uint32(net.ParseIP(n.Range.End).To4())
+	for i := start; i <= end; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, i)
+		if s.Net.Contains(ip) {
+			reserveAddress(s.allocatorOf(&DHCPRecord{IP: ip}), ip)
+		}
+	}
+	for _, ip := range n.Containers {
+		if s.Net.Contains(ip) {
+			reserveAddress(s.allocatorOf(&DHCPRecord{IP: ip}), ip)
+		}
+	}
+	log.Infof("Not leasing %s - %s, and %d addresses of containers, assigned by the runtime on network %s", n.Range.Start, n.Range.End, len(n.Containers), n.Name)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/template"
+
+	flag "github.com/spf13/pflag"
+)
+
+// `talos-pxe demo` is the happy path for a first look: it writes a server
+// root with the kernel and initramfs of a Talos release, a single profile
+// every machine boots whatever it picks in the menu, and the machine
+// config of a single-node cluster with throwaway secrets, then runs the
+// server on it. Builds with the demo tag embed the assets (see
+// demo_assets.go), others need them in --assets.
+
+const (
+	demoTalosVersion = "v1.6.0"
+	demoClusterName  = "demo"
+	demoConfigFile   = "demo.yaml"
+)
+
+// demoAssets has vmlinuz-amd64 and initramfs-amd64.xz of demoTalosVersion
+// in builds with the demo tag, nil otherwise.
+var demoAssets fs.FS
+
+var demoAssetFiles = []string{"vmlinuz-amd64", "initramfs-amd64.xz"}
+
+var demoProfile = []byte(`{
+  "id": "demo",
+  "name": "demo",
+  "boot": {
+    "kernel": "/assets/vmlinuz-amd64",
+    "initrd": ["/assets/initramfs-amd64.xz"],
+    "args": [
+      "initrd=initramfs-amd64.xz",
+      "init_on_alloc=1",
+      "slab_nomerge",
+      "pti=on",
+      "console=tty0",
+      "console=ttyS0",
+      "printk.devkmsg=on",
+      "talos.platform=metal",
+      "talos.config=http://${next-server}:8080/assets/demo.yaml"
+    ]
+  }
+}
+`)
+
+// The group has no selector, so that it matches every role.
+var demoGroup = []byte(`{
+	"name": "demo",
+	"profile": "demo"
+}
+`)
+
+type demoSecrets struct {
+	ClusterName   string
+	Endpoint      string
+	InstallDisk   string
+	InstallImage  string
+	MachineToken  string
+	ClusterID     string
+	ClusterSecret string
+	ClusterToken  string
+	Secretbox     string
+	OSCA          demoPair
+	KubernetesCA  demoPair
+	AggregatorCA  demoPair
+	EtcdCA        demoPair
+	ServiceKey    string
+	AdminCert     demoPair
+}
+
+// demoPair is a certificate and its key, both PEM in base64 as Talos
+// takes them.
+type demoPair struct {
+	Crt string
+	Key string
+}
+
+var demoConfigTemplate = template.Must(template.New("demo").Parse(`version: v1alpha1
+debug: false
+persist: true
+machine:
+  type: controlplane
+  token: {{ .MachineToken }}
+  ca:
+    crt: {{ .OSCA.Crt }}
+    key: {{ .OSCA.Key }}
+  install:
+    disk: {{ .InstallDisk }}
+    image: {{ .InstallImage }}
+    wipe: false
+cluster:
+  id: {{ .ClusterID }}
+  secret: {{ .ClusterSecret }}
+  controlPlane:
+    endpoint: https://{{ .Endpoint }}:6443
+  clusterName: {{ .ClusterName }}
+  network:
+    dnsDomain: cluster.local
+    podSubnets:
+      - 10.244.0.0/16
+    serviceSubnets:
+      - 10.96.0.0/12
+  token: {{ .ClusterToken }}
+  secretboxEncryptionSecret: {{ .Secretbox }}
+  ca:
+    crt: {{ .KubernetesCA.Crt }}
+    key: {{ .KubernetesCA.Key }}
+  aggregatorCA:
+    crt: {{ .AggregatorCA.Crt }}
+    key: {{ .AggregatorCA.Key }}
+  serviceAccount:
+    key: {{ .ServiceKey }}
+  etcd:
+    ca:
+      crt: {{ .EtcdCA.Crt }}
+      key: {{ .EtcdCA.Key }}
+  allowSchedulingOnControlPlanes: true
+`))
+
+var demoTalosconfigTemplate = template.Must(template.New("talosconfig").Parse(`context: {{ .ClusterName }}
+contexts:
+  {{ .ClusterName }}:
+    endpoints: []
+    ca: {{ .OSCA.Crt }}
+    crt: {{ .AdminCert.Crt }}
+    key: {{ .AdminCert.Key }}
+`))
+
+// runDemo writes the demo server root, unless it's there from an earlier
+// run, and runs the server on it with the server flags after --.
+func runDemo(args []string) error {
+	flags := flag.NewFlagSet("demo", flag.ExitOnError)
+	dirFlag := flags.String("dir", filepath.Join(os.TempDir(), "talos-pxe-demo"), "Server root of the demo, kept to boot the node again")
+	assetsFlag := flags.String("assets", "", "Directory with vmlinuz-amd64 and initramfs-amd64.xz, for builds without the demo tag")
+	installDiskFlag := flags.String("install-disk", "/dev/sda", "Disk Talos is installed to")
+	installerImageFlag := flags.String("installer-image", "ghcr.io/siderolabs/installer", "Repository of the Talos installer image")
+	flags.Parse(args)
+
+	assets := demoAssets
+	if *assetsFlag != "" {
+		assets = os.DirFS(*assetsFlag)
+	}
+	if assets == nil {
+		return fmt.Errorf("No Talos assets in this build, pass --assets or build with -tags demo, see the README")
+	}
+
+	dir := *dirFlag
+	for _, sub := range []string{"assets", "profiles", "groups"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	for _, name := range demoAssetFiles {
+		if err := writeDemoAsset(assets, name, filepath.Join(dir, "assets", name)); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "profiles", "demo.json"), demoProfile, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "groups", "demo.json"), demoGroup, 0644); err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(dir, "assets", demoConfigFile)
+	talosconfigPath := filepath.Join(dir, "talosconfig")
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		secrets, err := generateDemoSecrets()
+		if err != nil {
+			return err
+		}
+		secrets.ClusterName = demoClusterName
+		secrets.Endpoint = "controlplane." + clusterDomain
+		secrets.InstallDisk = *installDiskFlag
+		secrets.InstallImage = *installerImageFlag + ":" + demoTalosVersion
+		if err := writeDemoTemplate(demoTalosconfigTemplate, secrets, talosconfigPath); err != nil {
+			return err
+		}
+		if err := writeDemoTemplate(demoConfigTemplate, secrets, configPath); err != nil {
+			return err
+		}
+		log.Infof("Generated the machine config of demo cluster %s in %s", demoClusterName, configPath)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf(`Serving a single-node Talos %s cluster from %s.
+
+PXE boot a machine on the network, it installs to %s whatever is picked
+in the menu. Once it's up, bootstrap the cluster with its address, from
+talos-pxe nodes:
+
+  talosctl --talosconfig %s -e NODE_IP -n NODE_IP bootstrap
+  talosctl --talosconfig %s -e NODE_IP -n NODE_IP kubeconfig
+
+Remove %s for a new cluster.
+
+`, demoTalosVersion, dir, *installDiskFlag, talosconfigPath, talosconfigPath, dir)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, append([]string{os.Args[0], "--root", dir}, flags.Args()...), os.Environ())
+}
+
+// writeDemoAsset copies the asset, unless it's there already.
+func writeDemoAsset(assets fs.FS, name, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	in, err := assets.Open(name)
+	if err != nil {
+		return fmt.Errorf("Missing Talos asset %s: %s", name, err)
+	}
+	defer in.Close()
+
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func writeDemoTemplate(tmpl *template.Template, secrets *demoSecrets, dest string) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(f, secrets); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// generateDemoSecrets generates the secrets of a cluster like `talosctl
+// gen config` does: the Talos API CA with an os:admin client certificate
+// for the talosconfig, the Kubernetes, aggregator and etcd CAs, the
+// service account key and the tokens.
+func generateDemoSecrets() (*demoSecrets, error) {
+	var secrets demoSecrets
+	var err error
+
+	for _, token := range []*string{&secrets.MachineToken, &secrets.ClusterToken} {
+		if *token, err = demoToken(); err != nil {
+			return nil, err
+		}
+	}
+	for _, secret := range []*string{&secrets.ClusterID, &secrets.ClusterSecret, &secrets.Secretbox} {
+		if *secret, err = demoRandom(32); err != nil {
+			return nil, err
+		}
+	}
+
+	osKey, osCA, err := demoOSCA()
+	if err != nil {
+		return nil, err
+	}
+	secrets.OSCA = osCA
+	if secrets.AdminCert, err = demoAdminCert(osKey, osCA); err != nil {
+		return nil, err
+	}
+	for _, ca := range []struct {
+		pair *demoPair
+		name string
+	}{
+		{&secrets.KubernetesCA, "kubernetes"},
+		{&secrets.AggregatorCA, "aggregator"},
+		{&secrets.EtcdCA, "etcd"},
+	} {
+		if *ca.pair, err = demoECDSACA(ca.name); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	secrets.ServiceKey = base64.StdEncoding.EncodeToString(keyPEM)
+	return &secrets, nil
+}
+
+// demoToken returns a token of the form Talos and kubeadm use, 6 and 16
+// lowercase letters and digits.
+func demoToken() (string, error) {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 22)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b[:6]) + "." + string(b[6:]), nil
+}
+
+func demoRandom(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func demoPEM(blockType string, der []byte) string {
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+func demoCATemplate(commonName string) (*x509.Certificate, error) {
+	template, err := certTemplate(commonName, caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	return template, nil
+}
+
+// demoOSCA creates the Talos API CA, with an Ed25519 key like Talos.
+func demoOSCA() (ed25519.PrivateKey, demoPair, error) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, demoPair{}, err
+	}
+	template, err := demoCATemplate("talos")
+	if err != nil {
+		return nil, demoPair{}, err
+	}
+	template.Subject.Organization = []string{"talos"}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, key)
+	if err != nil {
+		return nil, demoPair{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, demoPair{}, err
+	}
+	return key, demoPair{Crt: demoPEM("CERTIFICATE", der), Key: demoPEM("ED25519 PRIVATE KEY", keyDER)}, nil
+}
+
+// demoAdminCert issues the client certificate of the talosconfig, with
+// the os:admin role.
+func demoAdminCert(caKey ed25519.PrivateKey, ca demoPair) (demoPair, error) {
+	caPEM, err := base64.StdEncoding.DecodeString(ca.Crt)
+	if err != nil {
+		return demoPair{}, err
+	}
+	block, _ := pem.Decode(caPEM)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return demoPair{}, err
+	}
+
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return demoPair{}, err
+	}
+	template, err := certTemplate("admin", caValidity)
+	if err != nil {
+		return demoPair{}, err
+	}
+	template.Subject.Organization = []string{"os:admin"}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, public, caKey)
+	if err != nil {
+		return demoPair{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return demoPair{}, err
+	}
+	return demoPair{Crt: demoPEM("CERTIFICATE", der), Key: demoPEM("ED25519 PRIVATE KEY", keyDER)}, nil
+}
+
+// demoECDSACA creates one of the cluster CAs, with an ECDSA P-256 key.
+func demoECDSACA(commonName string) (demoPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return demoPair{}, err
+	}
+	template, err := demoCATemplate(commonName)
+	if err != nil {
+		return demoPair{}, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return demoPair{}, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return demoPair{}, err
+	}
+	return demoPair{Crt: demoPEM("CERTIFICATE", der), Key: base64.StdEncoding.EncodeToString(keyPEM)}, nil
+}
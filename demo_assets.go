@@ -0,0 +1,23 @@
+//go:build demo
+// +build demo
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Builds with the demo tag embed the Talos assets of the demo, downloaded
+// to demo/ first:
+//
+//	curl -Lo demo/vmlinuz-amd64 https://github.com/siderolabs/talos/releases/download/v1.6.0/vmlinuz-amd64
+//	curl -Lo demo/initramfs-amd64.xz https://github.com/siderolabs/talos/releases/download/v1.6.0/initramfs-amd64.xz
+//	go build -tags demo
+
+//go:embed demo/vmlinuz-amd64 demo/initramfs-amd64.xz
+var demoAssetsFS embed.FS
+
+func init() {
+	demoAssets, _ = fs.Sub(demoAssetsFS, "demo")
+}
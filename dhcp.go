@@ -15,21 +15,46 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
+	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/iana"
 )
 
-func (s *Server) handlerDHCP4() server4.Handler {
-	leaseTime := 5*time.Minute
+const (
+	// Where the vendor area starts in a BOOTP message, RFC 951.
+	bootpVendorOffset = 236
+	// Legacy BOOTP clients are served what BIOS PXE clients get.
+	bootpClassId = "PXEClient:Arch:00000:UNDI:002001"
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// How long the leases run.
+const leaseTime = 5 * time.Minute
 
+func (s *Server) handlerDHCP4(replier *dhcpReplier) server4.Handler {
 	return func(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+		defer recoverHandler("DHCP")
 		log.Debugf("DHCPv4: got %s", m.Summary())
 
+		if s.dhcpPausedDrop("dhcp") {
+			log.Debugf("Not answering %s, DHCP is paused", m.ClientHWAddr)
+			return
+		}
+
+		sp := s.tracer.start(m.ClientHWAddr, "dhcp")
+		s.sessions.seen(m.ClientHWAddr, "dhcp")
+		s.locateSwitchPort(m.ClientHWAddr)
+		sp.SetAttr("dhcp.message_type", m.MessageType().String())
+		defer sp.End(nil)
+
 		if m.OpCode != dhcpv4.OpcodeBootRequest {
 			log.Infof("Not a boot request")
 			return
@@ -68,14 +93,89 @@ func (s *Server) handlerDHCP4() server4.Handler {
 			}
 		}
 
-		if !s.ProxyDHCP {
+		// BOOTP requests carry no message type. They come from option
+		// ROMs old enough to not speak DHCP, and are only answered when
+		// we hand out the addresses.
+		mt := m.MessageType()
+		bootp := mt == dhcpv4.MessageTypeNone
+		if bootp && s.ProxyDHCP {
+			log.Debugf("Ignoring BOOTP request from %s in proxyDHCP mode", m.ClientHWAddr)
+			return
+		}
+
+		if mt == dhcpv4.MessageTypeRelease {
+			if !s.ProxyDHCP {
+				s.releaseLease(m.ClientHWAddr)
+			}
+			return
+		}
+
+		if mt == dhcpv4.MessageTypeDiscover {
+			if err := s.offerHooks(m); err != nil {
+				log.Infof("Not offering %s: %s", m.ClientHWAddr, err)
+				return
+			}
+		}
+
+		if mt == dhcpv4.MessageTypeInform {
+			if s.ProxyDHCP {
+				return
+			}
+
+			// The client already has an address and only wants the
+			// options, so there's no lease to hand out.
+			resp, err = dhcpv4.NewReplyFromRequest(m,
+				dhcpv4.WithNetmask(s.Net.Mask),
+				dhcpv4.WithGatewayIP(s.GWIP),
+				dhcpv4.WithOption(dhcpv4.OptRouter(s.GWIP)),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.IP)),
+			)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		} else if !s.ProxyDHCP {
 			s.DHCPLock.Lock()
 			defer s.DHCPLock.Unlock()
 
-			record, ok := s.DHCPRecords[m.ClientHWAddr.String()]
-			if !ok {
-				newIp, err := s.DHCPAllocator.Allocate(net.IPNet{})
+			// The NICs of a node share its lease, see nics.go.
+			identity := s.nodes.identity(m.ClientHWAddr)
+			s.nodePoolSeen(identity, m)
+			quarantined := s.quarantine.holds(identity)
+
+			record, ok := s.DHCPRecords[identity.String()]
+			if !ok && s.frozen(identity) {
+				log.Infof("Not leasing an address to unknown client %s, provisioning is frozen", m.ClientHWAddr)
+				return
+			}
+			if !ok && quarantined {
+				newIp, err := s.quarantine.allocator.Allocate(net.IPNet{})
 				if err != nil {
+					log.Errorf("Could not quarantine %s: %s", m.ClientHWAddr, err)
+					return
+				}
+
+				log.Warnf("Quarantining unknown client %s with %s", m.ClientHWAddr, newIp.IP)
+				record = &DHCPRecord{
+					IP: newIp.IP,
+					expires: time.Now().Add(leaseTime),
+					granted: time.Now(),
+					quarantined: true,
+				}
+				s.DHCPRecords[identity.String()] = record
+				s.leaseChurn.granted++
+			} else if !ok {
+				allocator := s.DHCPAllocator
+				if r := s.leaseRange(identity); r != nil {
+					allocator = r.allocator
+				}
+				newIp, err := allocator.Allocate(net.IPNet{})
+				if err == allocators.ErrNoAddrAvail && allocator == s.DHCPAllocator {
+					// Logged and alerted once, see pool.go.
+					log.Debugf("No address left for %s", m.ClientHWAddr)
+					s.checkPoolAlert(true)
+					return
+				} else if err != nil {
 					log.Error(err)
 					return
 				}
@@ -83,27 +183,44 @@ func (s *Server) handlerDHCP4() server4.Handler {
 				record = &DHCPRecord{
 					IP: newIp.IP,
 					expires: time.Now().Add(leaseTime),
+					granted: time.Now(),
 				}
-				s.DHCPRecords[m.ClientHWAddr.String()] = record
+				s.DHCPRecords[identity.String()] = record
+				s.leaseChurn.granted++
+				s.checkPoolAlert(false)
 
 			} else {
+				if mt == dhcpv4.MessageTypeDiscover {
+					record = s.moveLeaseLocked(identity, record)
+				} else if mt == dhcpv4.MessageTypeRequest && !m.ClientIPAddr.IsUnspecified() {
+					// Renewing or rebinding.
+					s.leaseChurn.renewed++
+				}
 				if record.expires.Before(time.Now().Add(leaseTime)) {
-					record.expires = time.Now().Add(leaseTime).Round(time.Second)
+					record.expires = time.Now().Add(leaseTime)
 				}
 			}
 
+			if bootp {
+				// BOOTP clients don't renew, they keep the address for good.
+				s.pinLeaseLocked(identity, record, "BOOTP client")
+			}
+
 			resp, err = dhcpv4.NewReplyFromRequest(m,
 				dhcpv4.WithNetmask(s.Net.Mask),
 				dhcpv4.WithYourIP(record.IP),
 				dhcpv4.WithGatewayIP(s.GWIP),
 				dhcpv4.WithOption(dhcpv4.OptRouter(s.GWIP)),
-				dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(leaseTime)),
 				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.IP)),
 			)
 			if err != nil {
 				log.Error(err)
 				return
 			}
+
+			if !bootp {
+				resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(leaseTime))
+			}
 		} else {
 			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClassIdentifier, []byte("PXEClient")))
 
@@ -113,7 +230,9 @@ func (s *Server) handlerDHCP4() server4.Handler {
 
 			// Some EFI firmwares refuse to boot if PXE Boot Server Discovery Control is set, so
 			// only set it if not on EFI
-			if !efi {
+			if !efi && s.PXEMenu {
+				resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, s.pxeMenuOption()))
+			} else if !efi {
 				pxe := []byte{
 					// PXE Boot Server Discovery Control - bypass, just boot from filename.
 					6, 1, 8, byte(dhcpv4.OptionEnd),
@@ -123,31 +242,63 @@ func (s *Server) handlerDHCP4() server4.Handler {
 			}
 		}
 
-		resp.Options.Update(dhcpv4.OptDNS(s.IP))
-		resp.ServerIPAddr = s.IP
+		if !s.ProxyDHCP && !efi && !ipxe && s.PXEMenu && isPXEClient(m) {
+			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClassIdentifier, []byte("PXEClient")))
+			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, s.pxeMenuOption()))
+		}
+
+		resp.Options.Update(dhcpv4.OptDNS(s.advertisedIP()))
+		if !s.ProxyDHCP {
+			for _, opt := range s.domainOptions() {
+				resp.Options.Update(opt)
+			}
+		}
+		resp.ServerIPAddr = s.advertisedIP()
+
+		if bootp {
+			// BOOTP clients only look at the header fields, and are
+			// treated like BIOS PXE clients.
+			log.Infof("received BOOTP request from %s", m.ClientHWAddr)
 
-		if m.IsOptionRequested(dhcpv4.OptionBootfileName) {
+			resp.BootFileName = fmt.Sprintf("%s/%s/", m.ClientHWAddr, bootpClassId)
+			resp.ServerHostName = s.advertisedIP().String()
+		} else if m.IsOptionRequested(dhcpv4.OptionBootfileName) {
 			log.Infof("received PXE boot request from %s", m.ClientHWAddr)
 
 			log.Infof("sending PXE response to %s", m.ClientHWAddr)
 
-			resp.UpdateOption(dhcpv4.OptTFTPServerName(s.IP.String()))
+			resp.UpdateOption(dhcpv4.OptTFTPServerName(s.advertisedIP().String()))
 
 			if ipxe {
 				// In proxyDHCP, iPXE ignores TFTPServerName option if DHCP sent it, so we have to use tftp://
-				resp.UpdateOption(dhcpv4.OptBootFileName(fmt.Sprintf("tftp://%s/%s/%s/%s", s.IP, m.ClientHWAddr, m.ClassIdentifier(), m.UserClass())))
+				resp.UpdateOption(dhcpv4.OptBootFileName(fmt.Sprintf("tftp://%s/%s/%s/%s", s.tftpHost(), m.ClientHWAddr, m.ClassIdentifier(), m.UserClass())))
 			} else {
 				// other clients don't understand tftp://, but they will accept TFTPServerName, even in proxyDHCP
 				resp.UpdateOption(dhcpv4.OptBootFileName(fmt.Sprintf("%s/%s/%s", m.ClientHWAddr, m.ClassIdentifier(), m.UserClass())))
 			}
 		}
 
+		if o := s.bootOverride(m); o != nil && (bootp || m.IsOptionRequested(dhcpv4.OptionBootfileName)) {
+			s.applyBootOverride(o, m, resp, bootp)
+		}
+
+		if s.quarantine.restricts(m.ClientHWAddr) {
+			// Quarantined clients only get an address.
+			for _, code := range quarantineStrippedOptions {
+				delete(resp.Options, code.Code())
+			}
+			resp.BootFileName = ""
+			resp.ServerHostName = ""
+		}
+
 		//resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, dhcpv4.Uint16(match.MTU).ToBytes()))
 
-		switch mt := m.MessageType(); mt { //nolint:exhaustive
+		switch mt { //nolint:exhaustive
+		case dhcpv4.MessageTypeNone:
+			// BOOTREPLY
 		case dhcpv4.MessageTypeDiscover:
 			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
-		case dhcpv4.MessageTypeRequest:
+		case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
 			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
 		default:
 			log.Errorf("unhandled message type: %v", mt)
@@ -155,10 +306,19 @@ func (s *Server) handlerDHCP4() server4.Handler {
 			return
 		}
 
+		s.tracer.learnIP(m.ClientHWAddr, resp.YourIPAddr)
+		s.sessions.learnIP(m.ClientHWAddr, resp.YourIPAddr)
+		sp.SetAttr("dhcp.your_ip", resp.YourIPAddr.String())
+
 		log.Debug(resp.Summary())
-		_, err = conn.WriteTo(resp.ToBytes(), peer)
+		if s.chaosDropReply(m.ClientHWAddr, resp) {
+			return
+		}
+		err = replier.reply(conn, m, resp)
 		if err != nil {
 			log.Printf("failure sending response: %s", err)
+		} else if s.GratuitousARPLeases && !s.ProxyDHCP && resp.MessageType() == dhcpv4.MessageTypeAck {
+			replier.announceLease(m.ClientHWAddr, resp.YourIPAddr)
 		}
 	}
 }
@@ -174,21 +334,65 @@ func (l DHCPLogger) Printf(format string, v ...interface{}) {
 	log.Infof(format, v...)
 }
 
-func (s *Server) startDhcp() error {
+// bootpConn makes BOOTP requests without RFC 1048 vendor extensions
+// parseable as DHCP, by adding the magic cookie and an empty option list
+// to their zeroed vendor area.
+type bootpConn struct {
+	net.PacketConn
+}
+
+func (c bootpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	// The cookie and the end option.
+	if err != nil || n < bootpVendorOffset+5 {
+		return n, addr, err
+	}
+
+	vendor := b[bootpVendorOffset:n]
+	if bytes.Equal(vendor[:4], []byte{0, 0, 0, 0}) {
+		copy(vendor, dhcpMagicCookie)
+		vendor[4] = byte(dhcpv4.OptionEnd)
+	}
+
+	return n, addr, nil
+}
+
+func (s *Server) openDhcp() (io.Closer, func() error, error) {
 	logger := DHCPLogger{}
 
+	replier, err := s.newDHCPReplier()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	udpConn, err := server4.NewIPv4UDPConn(s.Intf, &net.UDPAddr{Port: s.DHCPPort})
+	if err != nil {
+		replier.Close()
+		return nil, nil, err
+	}
+
+	var conn net.PacketConn = udpConn
+	if s.DHCPRateLimit > 0 {
+		conn = rateLimitedConn{conn, newRateLimiter("DHCP", s.DHCPRateLimit), dhcpClientKey}
+	}
+
 	server, err := server4.NewServer(
 		s.Intf,
 		nil,
-		s.handlerDHCP4(),
+		s.handlerDHCP4(replier),
+		server4.WithConn(bootpConn{conn}),
 		server4.WithLogger(logger),
 	)
 
 	if err != nil {
-		return err
+		conn.Close()
+		replier.Close()
+		return nil, nil, err
 	}
 
-	server.Serve()
-
-	return nil
+	closer := closerFunc(func() {
+		server.Close()
+		replier.Close()
+	})
+	return closer, server.Serve, nil
 }
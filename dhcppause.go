@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// During an incident, e.g. machines reinstalling in a loop, provisioning
+// can be frozen by pausing DHCP: DHCP and ProxyDHCP requests go
+// unanswered until it's resumed, so no new client boots, while DNS, TFTP
+// and HTTP keep serving the nodes and the leases, nodes and sessions are
+// kept, which restarting the server without DHCP would lose.
+
+// DHCPStatus is whether DHCP answering is paused, since when, by whom and
+// why.
+type DHCPStatus struct {
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since,omitempty"`
+	By     string    `json:"by,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type dhcpPause struct {
+	lock   sync.Mutex
+	status DHCPStatus
+}
+
+func (p *dhcpPause) get() DHCPStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+func (p *dhcpPause) paused() bool {
+	return p.get().Paused
+}
+
+// set changes the status, telling whether it was changed.
+func (p *dhcpPause) set(status DHCPStatus) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status.Paused == status.Paused {
+		return false
+	}
+	p.status = status
+	return true
+}
+
+func (s *Server) pauseDHCP(actor, reason string) DHCPStatus {
+	if s.dhcpPause.set(DHCPStatus{Paused: true, Since: time.Now().UTC(), By: actor, Reason: reason}) {
+		log.Warnf("DHCP paused by %s, not answering DHCP and ProxyDHCP requests", actor)
+		dhcpPaused.Set(1)
+		s.audit.record(actor, "dhcp.pause", "", reason)
+	}
+	return s.dhcpPause.get()
+}
+
+func (s *Server) resumeDHCP(actor string) DHCPStatus {
+	if s.dhcpPause.set(DHCPStatus{}) {
+		log.Infof("DHCP resumed by %s", actor)
+		dhcpPaused.Set(0)
+		s.audit.record(actor, "dhcp.resume", "", "")
+	}
+	return s.dhcpPause.get()
+}
+
+// dhcpPausedDrop tells whether requests are to be left unanswered as
+// DHCP is paused, counting them.
+func (s *Server) dhcpPausedDrop(protocol string) bool {
+	if !s.dhcpPause.paused() {
+		return false
+	}
+	dhcpPausedRequests.WithLabelValues(protocol).Inc()
+	return true
+}
+
+// dhcpHandler returns whether DHCP is paused on GET, and pauses or
+// resumes it on POST to /api/v1/dhcp/pause and /api/v1/dhcp/resume.
+func (s *Server) dhcpHandler(w http.ResponseWriter, req *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v1/dhcp"), "/")
+	if action == "" {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.dhcpPause.get())
+		return
+	}
+
+	if action != "pause" && action != "resume" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action == "pause" {
+		writeJSON(w, s.pauseDHCP(requestActor(req), req.FormValue("reason")))
+		return
+	}
+	writeJSON(w, s.resumeDHCP(requestActor(req)))
+}
+
+// runDHCP shows, pauses and resumes DHCP answering of a running server.
+func runDHCP(args []string) error {
+	flags := flag.NewFlagSet("dhcp", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	reasonFlag := flags.String("reason", "", "Why DHCP is paused, recorded in the audit event, with pause")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s dhcp status|pause|resume [flags]", os.Args[0])
+	if flags.NArg() != 1 {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var status DHCPStatus
+	switch flags.Arg(0) {
+	case "status":
+		status, err = client.GetDHCP()
+	case "pause":
+		status, err = client.PauseDHCP(*reasonFlag)
+	case "resume":
+		status, err = client.ResumeDHCP()
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+
+	if !status.Paused {
+		fmt.Println("DHCP is answering")
+		return nil
+	}
+	fmt.Printf("DHCP is paused since %s by %s\n", status.Since.Local().Format(time.RFC1123), status.By)
+	if status.Reason != "" {
+		fmt.Printf("Reason: %s\n", status.Reason)
+	}
+	return nil
+}
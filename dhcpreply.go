@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// DHCP replies are sent where RFC 2131 section 4.1 says, as some firmware
+// ignores replies sent any other way: to the relay agent if the request
+// was relayed, to the client address when renewing, broadcast if the
+// client asks for it, and otherwise to the offered address and the MAC of
+// the client. The client can't answer ARP for an address it doesn't have
+// yet, so the latter are sent as raw frames.
+
+type dhcpReplier struct {
+	ifindex int
+	ip      net.IP
+	// The ports of the server, which relay agents listen on as well, and
+	// of the clients.
+	serverPort int
+	clientPort int
+	// The packet socket the raw frames are sent on, -1 if it couldn't be
+	// opened, in which case the replies are broadcast instead.
+	raw int
+}
+
+func (s *Server) newDHCPReplier() (*dhcpReplier, error) {
+	intf, err := net.InterfaceByName(s.Intf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Protocol 0 only sends, nothing is received on the socket.
+	raw, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		log.Warnf("Could not open a packet socket, broadcasting DHCP replies to clients without an address: %s", err)
+		raw = -1
+	}
+	return &dhcpReplier{ifindex: intf.Index, ip: s.IP, serverPort: s.DHCPPort, clientPort: s.DHCPClientPort, raw: raw}, nil
+}
+
+func (r *dhcpReplier) Close() {
+	if r.raw >= 0 {
+		syscall.Close(r.raw)
+	}
+}
+
+// reply sends the reply to the request.
+func (r *dhcpReplier) reply(conn net.PacketConn, req, resp *dhcpv4.DHCPv4) error {
+	var err error
+	switch {
+	case !req.GatewayIPAddr.IsUnspecified():
+		_, err = conn.WriteTo(resp.ToBytes(), &net.UDPAddr{IP: req.GatewayIPAddr, Port: r.serverPort})
+	case !req.ClientIPAddr.IsUnspecified():
+		_, err = conn.WriteTo(resp.ToBytes(), &net.UDPAddr{IP: req.ClientIPAddr, Port: r.clientPort})
+	case req.IsBroadcast() || resp.MessageType() == dhcpv4.MessageTypeNak || resp.YourIPAddr.IsUnspecified() ||
+		r.raw < 0 || req.HWType != iana.HWTypeEthernet || len(req.ClientHWAddr) != 6:
+		_, err = conn.WriteTo(resp.ToBytes(), &net.UDPAddr{IP: net.IPv4bcast, Port: r.clientPort})
+	default:
+		err = r.sendRaw(req.ClientHWAddr, resp)
+	}
+	return err
+}
+
+// sendRaw sends the reply straight to the MAC and the offered address of
+// the client.
+func (r *dhcpReplier) sendRaw(mac net.HardwareAddr, resp *dhcpv4.DHCPv4) error {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    r.ip.To4(),
+		DstIP:    resp.YourIPAddr.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(r.serverPort),
+		DstPort: layers.UDPPort(r.clientPort),
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(resp.ToBytes())); err != nil {
+		return fmt.Errorf("Could not build the packet to %s: %s", mac, err)
+	}
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_IP),
+		Ifindex:  r.ifindex,
+		Halen:    uint8(len(mac)),
+	}
+	copy(addr.Addr[:], mac)
+	return syscall.Sendto(r.raw, buf.Bytes(), 0, addr)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The discovery service implements the Cluster gRPC service Talos nodes
+// use to find each other (KubeSpan and cluster membership). Affiliate
+// data is encrypted by the nodes, so we only store opaque blobs and relay
+// them to the other members of the same cluster.
+
+const (
+	discoveryMaxTTL     = 30 * time.Minute
+	discoveryGCInterval = 30 * time.Second
+	discoveryWatchQueue = 32
+)
+
+type discoveryAffiliate struct {
+	ID        string
+	Data      []byte
+	Endpoints [][]byte
+	Expires   time.Time
+}
+
+type discoveryEvent struct {
+	Affiliate discoveryAffiliate
+	Deleted   bool
+}
+
+type discoveryCluster struct {
+	affiliates map[string]*discoveryAffiliate
+	watchers   map[chan discoveryEvent]struct{}
+}
+
+type discoveryService struct {
+	lock     sync.Mutex
+	clusters map[string]*discoveryCluster
+}
+
+func newDiscoveryService() *discoveryService {
+	return &discoveryService{
+		clusters: make(map[string]*discoveryCluster),
+	}
+}
+
+// cluster returns the cluster with the given ID, creating it if needed.
+// Must be called with the lock held.
+func (d *discoveryService) cluster(id string) *discoveryCluster {
+	c, ok := d.clusters[id]
+	if !ok {
+		c = &discoveryCluster{
+			affiliates: make(map[string]*discoveryAffiliate),
+			watchers:   make(map[chan discoveryEvent]struct{}),
+		}
+		d.clusters[id] = c
+	}
+	return c
+}
+
+// notify sends the event to all watchers of the cluster, dropping the
+// watchers which can't keep up. Must be called with the lock held.
+func (c *discoveryCluster) notify(ev discoveryEvent) {
+	for ch := range c.watchers {
+		select {
+		case ch <- ev:
+		default:
+			delete(c.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (d *discoveryService) update(clusterId, affiliateId string, data []byte, endpoints [][]byte, ttl time.Duration) {
+	if ttl <= 0 || ttl > discoveryMaxTTL {
+		ttl = discoveryMaxTTL
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c := d.cluster(clusterId)
+	a, ok := c.affiliates[affiliateId]
+	if !ok {
+		a = &discoveryAffiliate{ID: affiliateId}
+		c.affiliates[affiliateId] = a
+	}
+
+	if data != nil {
+		a.Data = data
+	}
+
+	for _, endpoint := range endpoints {
+		known := false
+		for _, e := range a.Endpoints {
+			if string(e) == string(endpoint) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			a.Endpoints = append(a.Endpoints, endpoint)
+		}
+	}
+
+	a.Expires = time.Now().Add(ttl)
+
+	c.notify(discoveryEvent{Affiliate: *a})
+}
+
+func (d *discoveryService) delete(clusterId, affiliateId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c := d.cluster(clusterId)
+	if a, ok := c.affiliates[affiliateId]; ok {
+		delete(c.affiliates, affiliateId)
+		c.notify(discoveryEvent{Affiliate: *a, Deleted: true})
+	}
+}
+
+func (d *discoveryService) list(clusterId string) []discoveryAffiliate {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.snapshot(d.cluster(clusterId))
+}
+
+// snapshot copies the live affiliates of the cluster. Must be called with
+// the lock held.
+func (d *discoveryService) snapshot(c *discoveryCluster) []discoveryAffiliate {
+	now := time.Now()
+	affiliates := make([]discoveryAffiliate, 0, len(c.affiliates))
+	for _, a := range c.affiliates {
+		if a.Expires.After(now) {
+			affiliates = append(affiliates, *a)
+		}
+	}
+	return affiliates
+}
+
+// watch returns the current affiliates of the cluster together with a
+// channel delivering all subsequent changes.
+func (d *discoveryService) watch(clusterId string) ([]discoveryAffiliate, chan discoveryEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c := d.cluster(clusterId)
+	ch := make(chan discoveryEvent, discoveryWatchQueue)
+	c.watchers[ch] = struct{}{}
+
+	return d.snapshot(c), ch
+}
+
+func (d *discoveryService) unwatch(clusterId string, ch chan discoveryEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c := d.cluster(clusterId)
+	if _, ok := c.watchers[ch]; ok {
+		delete(c.watchers, ch)
+		close(ch)
+	}
+}
+
+// gc removes expired affiliates and clusters nobody is interested in.
+func (d *discoveryService) gc() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	for id, c := range d.clusters {
+		for affiliateId, a := range c.affiliates {
+			if a.Expires.Before(now) {
+				delete(c.affiliates, affiliateId)
+				c.notify(discoveryEvent{Affiliate: *a, Deleted: true})
+			}
+		}
+
+		if len(c.affiliates) == 0 && len(c.watchers) == 0 {
+			delete(d.clusters, id)
+		}
+	}
+}
+
+func (d *discoveryService) Hello(ctx context.Context, req *discoveryHelloRequest) (*discoveryHelloResponse, error) {
+	resp := &discoveryHelloResponse{}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, ok := p.Addr.(*net.TCPAddr); ok {
+			resp.ClientIP = addr.IP
+			if ip := addr.IP.To4(); ip != nil {
+				resp.ClientIP = ip
+			}
+		}
+	}
+
+	log.Debugf("Discovery hello from %s (cluster %s, version %s)", net.IP(resp.ClientIP), req.ClusterID, req.ClientVersion)
+
+	return resp, nil
+}
+
+func (d *discoveryService) AffiliateUpdate(ctx context.Context, req *discoveryAffiliateUpdateRequest) (*wireEmpty, error) {
+	if req.ClusterID == "" || req.AffiliateID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cluster and affiliate IDs are required")
+	}
+
+	d.update(req.ClusterID, req.AffiliateID, req.Data, req.Endpoints, req.TTL)
+
+	return &wireEmpty{}, nil
+}
+
+func (d *discoveryService) AffiliateDelete(ctx context.Context, req *discoveryAffiliateDeleteRequest) (*wireEmpty, error) {
+	if req.ClusterID == "" || req.AffiliateID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cluster and affiliate IDs are required")
+	}
+
+	d.delete(req.ClusterID, req.AffiliateID)
+
+	return &wireEmpty{}, nil
+}
+
+func (d *discoveryService) List(ctx context.Context, req *discoveryClusterRequest) (*discoveryListResponse, error) {
+	if req.ClusterID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cluster ID is required")
+	}
+
+	return &discoveryListResponse{Affiliates: d.list(req.ClusterID)}, nil
+}
+
+func (d *discoveryService) Watch(req *discoveryClusterRequest, stream grpc.ServerStream) error {
+	if req.ClusterID == "" {
+		return status.Error(codes.InvalidArgument, "cluster ID is required")
+	}
+
+	affiliates, ch := d.watch(req.ClusterID)
+	defer d.unwatch(req.ClusterID, ch)
+
+	if err := stream.SendMsg(&discoveryWatchResponse{Affiliates: affiliates}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watch queue overflow")
+			}
+
+			resp := &discoveryWatchResponse{
+				Affiliates: []discoveryAffiliate{ev.Affiliate},
+				Deleted:    ev.Deleted,
+			}
+			if err := stream.SendMsg(resp); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+var discoveryServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sidero.discovery.server.Cluster",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Hello",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &discoveryHelloRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(*discoveryService).Hello(ctx, req)
+			},
+		},
+		{
+			MethodName: "AffiliateUpdate",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &discoveryAffiliateUpdateRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(*discoveryService).AffiliateUpdate(ctx, req)
+			},
+		},
+		{
+			MethodName: "AffiliateDelete",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &discoveryAffiliateDeleteRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(*discoveryService).AffiliateDelete(ctx, req)
+			},
+		},
+		{
+			MethodName: "List",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &discoveryClusterRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(*discoveryService).List(ctx, req)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Watch",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &discoveryClusterRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(*discoveryService).Watch(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "v1alpha1/server/cluster.proto",
+}
+
+func (s *Server) serveDiscovery(l net.Listener) error {
+	discovery := newDiscoveryService()
+
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	server.RegisterService(&discoveryServiceDesc, discovery)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(discoveryGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				discovery.gc()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := server.Serve(l); err != nil {
+		return fmt.Errorf("Discovery server shut down: %s", err)
+	}
+
+	return nil
+}
+
+type discoveryHelloRequest struct {
+	ClusterID     string
+	ClientVersion string
+}
+
+func (m *discoveryHelloRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.ClusterID)
+	b = wireAppendString(b, 2, m.ClientVersion)
+	return b
+}
+
+func (m *discoveryHelloRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.ClusterID = string(v)
+		case 2:
+			m.ClientVersion = string(v)
+		}
+		return nil
+	})
+}
+
+type discoveryHelloResponse struct {
+	ClientIP []byte
+}
+
+func (m *discoveryHelloResponse) MarshalWire() []byte {
+	var b []byte
+	if len(m.ClientIP) > 0 {
+		b = wireAppendBytes(b, 2, m.ClientIP)
+	}
+	return b
+}
+
+func (m *discoveryHelloResponse) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 2 {
+			m.ClientIP = append([]byte(nil), v...)
+		}
+		return nil
+	})
+}
+
+type discoveryAffiliateUpdateRequest struct {
+	ClusterID   string
+	AffiliateID string
+	Data        []byte
+	Endpoints   [][]byte
+	TTL         time.Duration
+}
+
+func (m *discoveryAffiliateUpdateRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.ClusterID)
+	b = wireAppendString(b, 2, m.AffiliateID)
+	if m.Data != nil {
+		b = wireAppendBytes(b, 3, m.Data)
+	}
+	for _, e := range m.Endpoints {
+		b = wireAppendBytes(b, 4, e)
+	}
+	if m.TTL > 0 {
+		var ttl []byte
+		ttl = wireAppendVarint(ttl, 1, uint64(m.TTL/time.Second))
+		ttl = wireAppendVarint(ttl, 2, uint64(m.TTL%time.Second))
+		b = wireAppendBytes(b, 5, ttl)
+	}
+	return b
+}
+
+func (m *discoveryAffiliateUpdateRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.ClusterID = string(v)
+		case 2:
+			m.AffiliateID = string(v)
+		case 3:
+			m.Data = append([]byte{}, v...)
+		case 4:
+			m.Endpoints = append(m.Endpoints, append([]byte(nil), v...))
+		case 5:
+			// google.protobuf.Duration
+			return wireFields(v, func(num protowire.Number, _ []byte, n uint64) error {
+				switch num {
+				case 1:
+					m.TTL += time.Duration(int64(n)) * time.Second
+				case 2:
+					m.TTL += time.Duration(int32(n))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+type discoveryAffiliateDeleteRequest struct {
+	ClusterID   string
+	AffiliateID string
+}
+
+func (m *discoveryAffiliateDeleteRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.ClusterID)
+	b = wireAppendString(b, 2, m.AffiliateID)
+	return b
+}
+
+func (m *discoveryAffiliateDeleteRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.ClusterID = string(v)
+		case 2:
+			m.AffiliateID = string(v)
+		}
+		return nil
+	})
+}
+
+// discoveryClusterRequest is used for both the List and Watch requests,
+// which only carry the cluster ID.
+type discoveryClusterRequest struct {
+	ClusterID string
+}
+
+func (m *discoveryClusterRequest) MarshalWire() []byte {
+	return wireAppendString(nil, 1, m.ClusterID)
+}
+
+func (m *discoveryClusterRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.ClusterID = string(v)
+		}
+		return nil
+	})
+}
+
+func appendDiscoveryAffiliate(b []byte, num protowire.Number, a discoveryAffiliate) []byte {
+	var m []byte
+	m = wireAppendString(m, 1, a.ID)
+	m = wireAppendBytes(m, 2, a.Data)
+	for _, e := range a.Endpoints {
+		m = wireAppendBytes(m, 3, e)
+	}
+	return wireAppendBytes(b, num, m)
+}
+
+func parseDiscoveryAffiliate(b []byte) (discoveryAffiliate, error) {
+	a := discoveryAffiliate{}
+	err := wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			a.ID = string(v)
+		case 2:
+			a.Data = append([]byte(nil), v...)
+		case 3:
+			a.Endpoints = append(a.Endpoints, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return a, err
+}
+
+type discoveryListResponse struct {
+	Affiliates []discoveryAffiliate
+}
+
+func (m *discoveryListResponse) MarshalWire() []byte {
+	var b []byte
+	for _, a := range m.Affiliates {
+		b = appendDiscoveryAffiliate(b, 1, a)
+	}
+	return b
+}
+
+func (m *discoveryListResponse) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			a, err := parseDiscoveryAffiliate(v)
+			if err != nil {
+				return err
+			}
+			m.Affiliates = append(m.Affiliates, a)
+		}
+		return nil
+	})
+}
+
+type discoveryWatchResponse struct {
+	Affiliates []discoveryAffiliate
+	Deleted    bool
+}
+
+func (m *discoveryWatchResponse) MarshalWire() []byte {
+	var b []byte
+	for _, a := range m.Affiliates {
+		b = appendDiscoveryAffiliate(b, 1, a)
+	}
+	if m.Deleted {
+		b = wireAppendVarint(b, 2, protowire.EncodeBool(true))
+	}
+	return b
+}
+
+func (m *discoveryWatchResponse) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			a, err := parseDiscoveryAffiliate(v)
+			if err != nil {
+				return err
+			}
+			m.Affiliates = append(m.Affiliates, a)
+		case 2:
+			m.Deleted = protowire.DecodeBool(n)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Across heterogeneous hardware, no single install disk fits every node.
+// An install disk policy picks the disk of every node from the disks it
+// reported to the inventory, e.g. the smallest SSD, the disk with a WWN
+// or the first NVMe, and the served machine config installs to it.
+
+const (
+	DiskFirst    = "first"
+	DiskSmallest = "smallest"
+	DiskLargest  = "largest"
+)
+
+// An InstallDiskPolicy picks the install disk among the disks matching
+// its filters, all of them optional. Model and WWN are globs.
+type InstallDiskPolicy struct {
+	// Type is ssd, hdd or nvme.
+	Type       string `json:"type,omitempty"`
+	Model      string `json:"model,omitempty"`
+	WWN        string `json:"wwn,omitempty"`
+	MinSizeGiB int    `json:"minSizeGiB,omitempty"`
+	// Prefer is which of the matching disks to pick, first in the order
+	// reported, smallest or largest.
+	Prefer string `json:"prefer,omitempty"`
+}
+
+var diskTypes = map[string]bool{"": true, "ssd": true, "hdd": true, "nvme": true}
+
+func (p *InstallDiskPolicy) check() error {
+	if !diskTypes[p.Type] {
+		return fmt.Errorf("unknown disk type %s", p.Type)
+	}
+	for _, pattern := range []string{p.Model, p.WWN} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+	}
+	switch p.Prefer {
+	case "", DiskFirst, DiskSmallest, DiskLargest:
+	default:
+		return fmt.Errorf("unknown preference %s", p.Prefer)
+	}
+	return nil
+}
+
+func (p *InstallDiskPolicy) String() string {
+	var parts []string
+	if p.Prefer != "" {
+		parts = append(parts, p.Prefer)
+	}
+	if p.Type != "" {
+		parts = append(parts, p.Type)
+	}
+	for _, f := range [][2]string{{"model", p.Model}, {"wwn", p.WWN}} {
+		if f[1] != "" {
+			parts = append(parts, f[0]+" "+f[1])
+		}
+	}
+	if p.MinSizeGiB > 0 {
+		parts = append(parts, fmt.Sprintf("of at least %d GiB", p.MinSizeGiB))
+	}
+	if len(parts) == 0 {
+		return "any disk"
+	}
+	return strings.Join(parts, " ")
+}
+
+// diskType returns the type of the disk, going by its name for NVMe
+// disks which didn't report one.
+func diskType(disk Disk) string {
+	if disk.Type == "" && strings.HasPrefix(path.Base(disk.Name), "nvme") {
+		return "nvme"
+	}
+	return strings.ToLower(disk.Type)
+}
+
+func (p *InstallDiskPolicy) matches(disk Disk) bool {
+	if p.Type != "" && diskType(disk) != p.Type {
+		return false
+	}
+	if p.Model != "" {
+		if ok, _ := path.Match(p.Model, disk.Model); !ok {
+			return false
+		}
+	}
+	if p.WWN != "" {
+		if ok, _ := path.Match(strings.ToLower(p.WWN), strings.ToLower(disk.WWN)); !ok {
+			return false
+		}
+	}
+	return disk.SizeBytes >= uint64(p.MinSizeGiB)<<30
+}
+
+// pick returns the install disk among the disks, or an error if none
+// matches.
+func (p *InstallDiskPolicy) pick(disks []Disk) (Disk, error) {
+	var matching []Disk
+	for _, disk := range disks {
+		if p.matches(disk) {
+			matching = append(matching, disk)
+		}
+	}
+	if len(matching) == 0 {
+		return Disk{}, fmt.Errorf("No disk matches the install disk policy, %s", p)
+	}
+
+	switch p.Prefer {
+	case DiskSmallest:
+		sort.SliceStable(matching, func(i, j int) bool { return matching[i].SizeBytes < matching[j].SizeBytes })
+	case DiskLargest:
+		sort.SliceStable(matching, func(i, j int) bool { return matching[i].SizeBytes > matching[j].SizeBytes })
+	}
+	return matching[0], nil
+}
+
+// installDiskPolicy returns the install disk policy of the node, that of
+// its machine class if it has one.
+func (s *Server) installDiskPolicy(mac net.HardwareAddr) *InstallDiskPolicy {
+	if s.Config == nil {
+		return nil
+	}
+	if class := s.machineClass(url.Values{"mac": {mac.String()}}); class != nil && class.InstallDisk != nil {
+		return class.InstallDisk
+	}
+	return s.Config.InstallDisk
+}
+
+// installDiskPatch returns the patch installing to the disk the policy
+// picks for the node, or nil if no policy applies or the node didn't
+// report its disks.
+func (s *Server) installDiskPatch(mac net.HardwareAddr) (machineConfigPatch, error) {
+	if mac == nil {
+		return nil, nil
+	}
+	policy := s.installDiskPolicy(mac)
+	if policy == nil {
+		return nil, nil
+	}
+	node, ok := s.nodes.get(mac.String())
+	if !ok || node.Hardware == nil || len(node.Hardware.Disks) == 0 {
+		return nil, nil
+	}
+
+	disk, err := policy.pick(node.Hardware.Disks)
+	if err != nil {
+		return nil, err
+	}
+	device := "/dev/" + path.Base(disk.Name)
+	log.Infof("Installing %s to %s, the %s", mac, device, policy)
+
+	return func(cfg map[interface{}]interface{}) error {
+		if install, ok := getConfigValue(cfg, "machine.install"); ok {
+			if m, ok := install.(map[interface{}]interface{}); ok {
+				delete(m, "diskSelector")
+			}
+		}
+		return setConfigValue(cfg, "machine.install.disk", device)
+	}, nil
+}
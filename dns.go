@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
@@ -41,6 +42,9 @@ func (s ServiceLookupPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter,
 
 	switch state.QType() {
 	case dns.TypePTR:
+		if answers = s.Server.lookupService(qname, dns.TypePTR); len(answers) > 0 {
+			break
+		}
 		names := s.GetREntry(dnsutil.ExtractAddressFromReverse(qname))
 		if len(names) == 0 {
 			return plugin.NextOrFailure(s.Name(), s.Next, ctx, w, r)
@@ -48,10 +52,15 @@ func (s ServiceLookupPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter,
 		answers = ptr(qname, DNSTTL, names)
 	case dns.TypeA:
 		ips := s.GetHostV4(qname)
+		if qname == s.Server.Controlplane {
+			ips = s.Server.answerOrder.order(ips)
+		}
 		answers = a(qname, DNSTTL, ips)
 	case dns.TypeAAAA:
 		ips := s.GetHostV6(qname)
 		answers = aaaa(qname, DNSTTL, ips)
+	case dns.TypeSRV, dns.TypeTXT:
+		answers = s.Server.lookupService(qname, state.QType())
 	}
 
 	// Only on NXDOMAIN we will fallthrough.
@@ -60,6 +69,7 @@ func (s ServiceLookupPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter,
 			return plugin.NextOrFailure(s.Name(), s.Next, ctx, w, r)
 		}
 
+		dnsQueries.WithLabelValues(dns.TypeToString[state.QType()], dns.RcodeToString[dns.RcodeServerFailure]).Inc()
 		return dns.RcodeServerFailure, nil
 	}
 
@@ -70,6 +80,7 @@ func (s ServiceLookupPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter,
 
 	w.WriteMsg(m)
 
+	dnsQueries.WithLabelValues(dns.TypeToString[state.QType()], dns.RcodeToString[dns.RcodeSuccess]).Inc()
 	return dns.RcodeSuccess, nil
 }
 
@@ -80,25 +91,22 @@ func (s ServiceLookupPlugin) otherRecordsExist(qname string) bool {
 	if len(s.GetHostV6(qname)) > 0 {
 		return true
 	}
+	if len(s.Server.serviceRecords[qname]) > 0 {
+		return true
+	}
 	return false
 }
 
 func (s ServiceLookupPlugin) GetREntry(ip string) []string {
-	s.Server.DNSRWLock.RLock()
-	defer s.Server.DNSRWLock.RUnlock()
-	return s.Server.DNSRRecords[ip]
+	return s.Server.DNSRecords.GetPTR(ip)
 }
 
 func (s ServiceLookupPlugin) GetHostV4(name string) []net.IP {
-	s.Server.DNSRWLock.RLock()
-	defer s.Server.DNSRWLock.RUnlock()
-	return s.Server.DNSRecordsv4[name]
+	return s.Server.DNSRecords.GetV4(name)
 }
 
 func (s ServiceLookupPlugin) GetHostV6(name string) []net.IP {
-	s.Server.DNSRWLock.RLock()
-	defer s.Server.DNSRWLock.RUnlock()
-	return s.Server.DNSRecordsv6[name]
+	return s.Server.DNSRecords.GetV6(name)
 }
 
 func (s ServiceLookupPlugin) Name() string {
@@ -142,38 +150,43 @@ func ptr(zone string, ttl uint32, names []string) []dns.RR {
 }
 
 func (s *Server) registerDNSEntry(entry string, ip net.IP) {
-	s.DNSRWLock.Lock()
-	defer s.DNSRWLock.Unlock()
-	records := s.DNSRecordsv4[entry]
-	for _, r := range records {
-		if r.Equal(ip) {
-			return
-		}
-	}
-	records = append(records, ip)
-	s.DNSRecordsv4[entry] = records
+	s.DNSRecords.AddV4(entry, ip)
 }
 
 func (s *Server) serveDNS(l net.PacketConn) error {
-	zone := "talos."
+	if s.DNSRateLimit > 0 {
+		l = rateLimitedConn{l, newRateLimiter("DNS", s.DNSRateLimit), sourceIPKey}
+	}
 
-	zoneConfig := &dnsserver.Config{
-		Zone: zone,
-		Transport: "dns",
-		ListenHosts: []string{""},
-		Port: fmt.Sprintf("%d", s.DNSPort),
-		Debug: true,
+	zones := []string{dns.Fqdn(clusterDomain)}
+	if s.Domain != "" {
+		zones[0] = dns.Fqdn(strings.ToLower(s.Domain))
+	}
+	if domain := dns.Fqdn(strings.ToLower(s.ServiceDomain)); s.ServiceDomain != "" && !dns.IsSubDomain(zones[0], domain) {
+		zones = append(zones, domain)
 	}
 
-	zoneConfig.AddPlugin(func(next plugin.Handler) plugin.Handler {
-		serviceLookup := ServiceLookupPlugin{
-			Server: s,
-			Zones: []string{zone},
+	var configs []*dnsserver.Config
+	for _, zone := range zones {
+		zoneConfig := &dnsserver.Config{
+			Zone: zone,
+			Transport: "dns",
+			ListenHosts: []string{""},
+			Port: fmt.Sprintf("%d", s.DNSPort),
+			Debug: true,
 		}
-		serviceLookup.Next = next
 
-		return serviceLookup
-	})
+		zoneConfig.AddPlugin(func(next plugin.Handler) plugin.Handler {
+			serviceLookup := ServiceLookupPlugin{
+				Server: s,
+				Zones: zones,
+			}
+			serviceLookup.Next = next
+
+			return serviceLookup
+		})
+		configs = append(configs, zoneConfig)
+	}
 
 	proxyConfig := &dnsserver.Config{
 		Zone: ".",
@@ -183,6 +196,13 @@ func (s *Server) serveDNS(l net.PacketConn) error {
 		Debug: true,
 	}
 
+	if s.DNSSEC {
+		validator := newDNSSECValidator(s.ForwardDns)
+		proxyConfig.AddPlugin(func(next plugin.Handler) plugin.Handler {
+			return DNSSECPlugin{Next: next, Validator: validator}
+		})
+	}
+
 	proxyConfig.AddPlugin(func(next plugin.Handler) plugin.Handler {
 		forwardProxy := forward.New()
 		for _, forwardDns := range s.ForwardDns {
@@ -193,7 +213,7 @@ func (s *Server) serveDNS(l net.PacketConn) error {
 		return forwardProxy
 	})
 
-	dnsServer, err := dnsserver.NewServer(s.IP.String(), []*dnsserver.Config{zoneConfig, proxyConfig})
+	dnsServer, err := dnsserver.NewServer(s.IP.String(), append(configs, proxyConfig))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/miekg/dns"
+)
+
+// Forwarded answers can be DNSSEC validated, so that nodes fetching from
+// signed domains can't be fed spoofed answers on a hostile network. The
+// chain of trust is followed from the root trust anchor with queries to
+// the upstream servers. Answers from unsigned zones are passed on without
+// the AD bit once the delegation to them is proven insecure; bogus
+// answers are replaced with SERVFAIL.
+//
+// Denial of existence is only checked to be signed by the zone, the
+// NSEC/NSEC3 records aren't checked to actually cover the name.
+
+const (
+	dnssecCacheTime = 10 * time.Minute
+	dnssecTimeout   = 5 * time.Second
+)
+
+// The root zone KSK-2017, see https://data.iana.org/root-anchors/.
+var dnssecRootAnchor = &dns.DS{
+	Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+	KeyTag:     20326,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+}
+
+type dnssecKeys struct {
+	keys    []*dns.DNSKEY
+	err     error
+	expires time.Time
+}
+
+// A dnssecDelegation tells whether the name is a zone cut, and the DS
+// records of the child zone if it's signed.
+type dnssecDelegation struct {
+	cut     bool
+	ds      []*dns.DS
+	err     error
+	expires time.Time
+}
+
+type dnssecValidator struct {
+	upstreams []string
+	client    *dns.Client
+
+	lock        sync.Mutex
+	keys        map[string]*dnssecKeys
+	delegations map[string]*dnssecDelegation
+}
+
+func newDNSSECValidator(upstreams []string) *dnssecValidator {
+	return &dnssecValidator{
+		upstreams:   upstreams,
+		client:      &dns.Client{Timeout: dnssecTimeout},
+		keys:        make(map[string]*dnssecKeys),
+		delegations: make(map[string]*dnssecDelegation),
+	}
+}
+
+// exchange asks the upstream servers, without them validating, so that
+// bogus answers are returned for us to notice.
+func (v *dnssecValidator) exchange(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, true)
+	m.CheckingDisabled = true
+
+	var err error
+	for _, upstream := range v.upstreams {
+		var resp *dns.Msg
+		resp, _, err = v.client.Exchange(m, upstream)
+		if err == nil && resp.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: dnssecTimeout}
+			resp, _, err = tcp.Exchange(m, upstream)
+		}
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// rrsets groups the records of a section by owner and type, and the
+// signatures covering each group.
+func rrsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := name + "/" + dns.TypeToString[sig.TypeCovered]
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := name + "/" + dns.TypeToString[rr.Header().Rrtype]
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+// verify checks that one of the signatures over the RRset is valid and
+// made with a trusted key of its zone.
+func (v *dnssecValidator) verify(rrset []dns.RR, sigs []*dns.RRSIG) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s/%s is not signed", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+	}
+
+	err := fmt.Errorf("no valid signature")
+	now := time.Now()
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, rrset[0].Header().Name) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = fmt.Errorf("signature by %s expired or not yet valid", sig.SignerName)
+			continue
+		}
+
+		keys, kerr := v.zoneKeys(sig.SignerName)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s/%s: %s", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+}
+
+// zoneKeys returns the DNSKEYs of a signed zone, after checking them
+// against the DS records of its parent, or the root trust anchor.
+func (v *dnssecValidator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	v.lock.Lock()
+	cached, ok := v.keys[zone]
+	v.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.keys, cached.err
+	}
+
+	keys, err := v.fetchZoneKeys(zone)
+
+	v.lock.Lock()
+	v.keys[zone] = &dnssecKeys{keys: keys, err: err, expires: time.Now().Add(dnssecCacheTime)}
+	v.lock.Unlock()
+
+	return keys, err
+}
+
+func (v *dnssecValidator) fetchZoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	var ds []*dns.DS
+	if zone == "." {
+		ds = []*dns.DS{dnssecRootAnchor}
+	} else {
+		d, err := v.delegation(zone)
+		if err != nil {
+			return nil, err
+		}
+		if len(d.ds) == 0 {
+			return nil, fmt.Errorf("%s is not a signed zone", zone)
+		}
+		ds = d.ds
+	}
+
+	resp, err := v.exchange(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*dns.DNSKEY
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	// The key set has to be signed by a key the parent vouches for.
+	now := time.Now()
+	for _, key := range keys {
+		if !dsMatches(ds, key) {
+			continue
+		}
+		for _, sig := range sigs {
+			if sig.KeyTag == key.KeyTag() && sig.ValidityPeriod(now) && sig.Verify(key, rrset) == nil {
+				return keys, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no trusted key for %s", zone)
+}
+
+func dsMatches(ds []*dns.DS, key *dns.DNSKEY) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if kds := key.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation looks up the DS records of name in its parent zone.
+func (v *dnssecValidator) delegation(name string) (*dnssecDelegation, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	v.lock.Lock()
+	cached, ok := v.delegations[name]
+	v.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, cached.err
+	}
+
+	d := v.fetchDelegation(name)
+	d.expires = time.Now().Add(dnssecCacheTime)
+
+	v.lock.Lock()
+	v.delegations[name] = d
+	v.lock.Unlock()
+
+	return d, d.err
+}
+
+func (v *dnssecValidator) fetchDelegation(name string) *dnssecDelegation {
+	resp, err := v.exchange(name, dns.TypeDS)
+	if err != nil {
+		return &dnssecDelegation{err: err}
+	}
+
+	sets, sigs := rrsets(resp.Answer)
+	if set, ok := sets[name+"/DS"]; ok {
+		if err := v.verify(set, sigs[name+"/DS"]); err != nil {
+			return &dnssecDelegation{err: err}
+		}
+		d := &dnssecDelegation{cut: true}
+		for _, rr := range set {
+			d.ds = append(d.ds, rr.(*dns.DS))
+		}
+		return d
+	}
+
+	// No DS, the denial tells whether there's an unsigned delegation or
+	// no zone cut at all.
+	sets, sigs = rrsets(resp.Ns)
+	for key, set := range sets {
+		switch set[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+		if err := v.verify(set, sigs[key]); err != nil {
+			return &dnssecDelegation{err: err}
+		}
+
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(rr.Hdr.Name, name) {
+					return &dnssecDelegation{cut: hasType(rr.TypeBitMap, dns.TypeNS)}
+				}
+			case *dns.NSEC3:
+				if rr.Match(name) {
+					return &dnssecDelegation{cut: hasType(rr.TypeBitMap, dns.TypeNS)}
+				}
+				// Opt-out spans may hold unsigned delegations.
+				if rr.Cover(name) && rr.Flags&1 == 1 {
+					return &dnssecDelegation{cut: true}
+				}
+			}
+		}
+	}
+
+	return &dnssecDelegation{err: fmt.Errorf("no proof for the missing DS of %s", name)}
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// insecure returns whether the name is below an unsigned delegation.
+func (v *dnssecValidator) insecure(name string) (bool, error) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		d, err := v.delegation(strings.Join(labels[i:], ".") + ".")
+		if err != nil {
+			return false, err
+		}
+		if d.cut && len(d.ds) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validate returns whether the response is secure, or an error if it's
+// bogus.
+func (v *dnssecValidator) validate(qname string, resp *dns.Msg) (bool, error) {
+	section := resp.Answer
+	if len(section) == 0 {
+		// Negative answers are signed in the authority section.
+		section = resp.Ns
+	}
+
+	sets, sigs := rrsets(section)
+	secure := true
+	for key, set := range sets {
+		if len(sigs[key]) > 0 {
+			if err := v.verify(set, sigs[key]); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		insecure, err := v.insecure(set[0].Header().Name)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, fmt.Errorf("%s is missing signatures", key)
+		}
+		secure = false
+	}
+
+	if len(sets) == 0 {
+		insecure, err := v.insecure(qname)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, fmt.Errorf("unsigned empty answer")
+		}
+		secure = false
+	}
+
+	return secure, nil
+}
+
+// DNSSECPlugin validates the answers of the plugin after it.
+type DNSSECPlugin struct {
+	Next      plugin.Handler
+	Validator *dnssecValidator
+}
+
+func (p DNSSECPlugin) Name() string {
+	return "dnssec-validate"
+}
+
+func (p DNSSECPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	// Clients setting CD validate themselves.
+	if r.CheckingDisabled || len(r.Question) != 1 {
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	req := r.Copy()
+	req.CheckingDisabled = true
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		req.SetEdns0(4096, true)
+	}
+
+	nw := nonwriter.New(w)
+	rcode, err := plugin.NextOrFailure(p.Name(), p.Next, ctx, nw, req)
+	if err != nil || nw.Msg == nil {
+		return rcode, err
+	}
+	resp := nw.Msg
+	qname := r.Question[0].Name
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		resp.Id = r.Id
+		w.WriteMsg(resp)
+		return resp.Rcode, nil
+	}
+
+	secure, err := p.Validator.validate(qname, resp)
+	if err != nil {
+		log.Warnf("DNSSEC validation of %s %s failed: %s", dns.TypeToString[r.Question[0].Qtype], qname, err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return dns.RcodeServerFailure, nil
+	}
+
+	resp.Id = r.Id
+	resp.CheckingDisabled = false
+	resp.AuthenticatedData = secure && (do || r.AuthenticatedData)
+	if !do {
+		// Clients which didn't ask for DNSSEC records don't get them.
+		resp.Answer = stripDNSSEC(resp.Answer)
+		resp.Ns = stripDNSSEC(resp.Ns)
+	}
+	w.WriteMsg(resp)
+
+	return resp.Rcode, nil
+}
+
+func stripDNSSEC(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
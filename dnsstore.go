@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsRecords is an immutable snapshot of the records served by DNS.
+type dnsRecords struct {
+	v4  map[string][]net.IP
+	v6  map[string][]net.IP
+	ptr map[string][]string
+}
+
+// dnsStore serves lookups from an atomically swapped snapshot, so that
+// queries never wait on each other or on registrations. Writers copy the
+// snapshot, which is cheap for the few hundred names of a cluster and
+// only happens when a lease is handed out.
+type dnsStore struct {
+	writeLock sync.Mutex
+	records   atomic.Value // *dnsRecords
+}
+
+func newDNSStore() *dnsStore {
+	st := &dnsStore{}
+	st.records.Store(&dnsRecords{
+		v4:  make(map[string][]net.IP),
+		v6:  make(map[string][]net.IP),
+		ptr: make(map[string][]string),
+	})
+	return st
+}
+
+func (st *dnsStore) load() *dnsRecords {
+	return st.records.Load().(*dnsRecords)
+}
+
+func (st *dnsStore) GetV4(name string) []net.IP {
+	return st.load().v4[name]
+}
+
+func (st *dnsStore) GetV6(name string) []net.IP {
+	return st.load().v6[name]
+}
+
+func (st *dnsStore) GetPTR(ip string) []string {
+	return st.load().ptr[ip]
+}
+
+// Len returns the number of names of each record type.
+func (st *dnsStore) Len() (v4, v6, ptr int) {
+	r := st.load()
+	return len(r.v4), len(r.v6), len(r.ptr)
+}
+
+// update applies fn to a copy of the current records and publishes the
+// copy. fn must not retain or modify the slices it finds in the maps.
+func (st *dnsStore) update(fn func(r *dnsRecords)) {
+	start := time.Now()
+	st.writeLock.Lock()
+	defer st.writeLock.Unlock()
+	dnsStoreWriteWait.Observe(time.Since(start).Seconds())
+
+	old := st.load()
+	r := &dnsRecords{
+		v4:  make(map[string][]net.IP, len(old.v4)),
+		v6:  make(map[string][]net.IP, len(old.v6)),
+		ptr: make(map[string][]string, len(old.ptr)),
+	}
+	for k, v := range old.v4 {
+		r.v4[k] = v
+	}
+	for k, v := range old.v6 {
+		r.v6[k] = v
+	}
+	for k, v := range old.ptr {
+		r.ptr[k] = v
+	}
+
+	fn(r)
+
+	st.records.Store(r)
+	dnsStoreWrites.Inc()
+}
+
+// AddV4 adds the IP to the A records of the name, unless it's already
+// there.
+func (st *dnsStore) AddV4(name string, ip net.IP) {
+	for _, r := range st.GetV4(name) {
+		if r.Equal(ip) {
+			return
+		}
+	}
+
+	st.update(func(r *dnsRecords) {
+		records := r.v4[name]
+		for _, rec := range records {
+			if rec.Equal(ip) {
+				return
+			}
+		}
+		r.v4[name] = append(records[:len(records):len(records)], ip)
+	})
+}
+
+// Entries lists all records, sorted by name.
+func (st *dnsStore) Entries() []DNSEntry {
+	r := st.load()
+
+	out := []DNSEntry{}
+	for name, ips := range r.v4 {
+		for _, ip := range ips {
+			out = append(out, DNSEntry{Name: name, Type: "A", Data: ip.String()})
+		}
+	}
+	for name, ips := range r.v6 {
+		for _, ip := range ips {
+			out = append(out, DNSEntry{Name: name, Type: "AAAA", Data: ip.String()})
+		}
+	}
+	for ip, names := range r.ptr {
+		for _, name := range names {
+			out = append(out, DNSEntry{Name: ip, Type: "PTR", Data: name})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// RemoveIP removes the A and AAAA records pointing to the IP, the names
+// left without records, and the PTR records of the IP. Returns the names
+// it was removed from.
+func (st *dnsStore) RemoveIP(ip net.IP) []string {
+	var names []string
+	st.update(func(r *dnsRecords) {
+		for _, records := range []map[string][]net.IP{r.v4, r.v6} {
+			for name, ips := range records {
+				var kept []net.IP
+				for _, rec := range ips {
+					if !rec.Equal(ip) {
+						kept = append(kept, rec)
+					}
+				}
+				if len(kept) == len(ips) {
+					continue
+				}
+				names = append(names, name)
+				if len(kept) == 0 {
+					delete(records, name)
+				} else {
+					records[name] = kept
+				}
+			}
+		}
+		delete(r.ptr, ip.String())
+	})
+	sort.Strings(names)
+	return names
+}
+
+// RemoveName removes the IP from the A or AAAA records of the name.
+func (st *dnsStore) RemoveName(name string, ip net.IP) {
+	st.update(func(r *dnsRecords) {
+		records := r.v4
+		if ip.To4() == nil {
+			records = r.v6
+		}
+
+		var kept []net.IP
+		for _, rec := range records[name] {
+			if !rec.Equal(ip) {
+				kept = append(kept, rec)
+			}
+		}
+		if len(kept) == 0 {
+			delete(records, name)
+		} else {
+			records[name] = kept
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// The DNS server answers for the cluster domain, talos by default, but
+// without a domain the nodes and the installer only resolve the fully
+// qualified names, e.g. controlplane.talos. The leases carry the domain
+// as the domain name (option 15) and the search list (option 119), so
+// that short names like controlplane resolve without editing resolv.conf.
+
+const clusterDomain = "talos"
+
+// domainOptions returns the domain name and domain search options of
+// the leases, none if there's no domain.
+func (s *Server) domainOptions() []dhcpv4.Option {
+	domain := strings.TrimSuffix(s.Domain, ".")
+	if domain == "" {
+		return nil
+	}
+
+	search := make([]string, 0, len(s.DomainSearch))
+	for _, d := range s.DomainSearch {
+		if d = strings.TrimSuffix(d, "."); d != "" {
+			search = append(search, d)
+		}
+	}
+	if len(search) == 0 {
+		search = []string{domain}
+	}
+
+	return []dhcpv4.Option{
+		dhcpv4.OptDomainName(domain),
+		dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: search}),
+	}
+}
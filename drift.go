@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Nodes keep the machine config they were installed with, while the
+// profiles, the patches and the settings of the server change under them.
+// The request of the machine config served to every node is kept with
+// the hash of the config, and rendered again to compare: the nodes whose
+// config changed since have drifted. Reconciling a node flags it for
+// reinstall, power cycling it with the power cycle command to reinstall
+// right away, or, for changes not needing a reinstall, pushes the config
+// rendered again to the running node with apply-config on its Talos API.
+
+const (
+	ReconcileMethodReinstall = "reinstall"
+	ReconcileMethodApply     = "apply"
+
+	configDriftInterval = 5 * time.Minute
+	// Within the timeout of the management client.
+	applyConfigTimeout = 8 * time.Second
+)
+
+// applyConfigModes are the apply-config modes of the Talos API.
+var applyConfigModes = map[string]uint64{
+	"reboot":    0,
+	"auto":      1,
+	"no-reboot": 2,
+	"staged":    3,
+}
+
+// ConfigDrift compares the machine config served to a node with the one
+// it would get now.
+type ConfigDrift struct {
+	MAC           string    `json:"mac"`
+	IP            string    `json:"ip"`
+	Hostname      string    `json:"hostname,omitempty"`
+	Config        string    `json:"config"`
+	Served        time.Time `json:"served"`
+	ServedSHA256  string    `json:"served_sha256"`
+	CurrentSHA256 string    `json:"current_sha256,omitempty"`
+	Drifted       bool      `json:"drifted"`
+	// Error tells why the config couldn't be rendered again.
+	Error string `json:"error,omitempty"`
+}
+
+type reconcile struct {
+	// reinstall, the default, or apply.
+	Method     string `json:"method,omitempty"`
+	PowerCycle bool   `json:"power_cycle"`
+	// The apply-config mode, auto by default.
+	Mode string `json:"mode,omitempty"`
+}
+
+func (r *reconcile) check() error {
+	switch r.Method {
+	case "", ReconcileMethodReinstall:
+		if r.Mode != "" {
+			return fmt.Errorf("The apply-config mode only makes sense with the %s method", ReconcileMethodApply)
+		}
+	case ReconcileMethodApply:
+		if r.PowerCycle {
+			return fmt.Errorf("Power cycling a node only makes sense with the %s method", ReconcileMethodReinstall)
+		}
+		if _, ok := applyConfigModes[r.Mode]; r.Mode != "" && !ok {
+			return fmt.Errorf("Invalid apply-config mode %q, has to be auto, no-reboot, reboot or staged", r.Mode)
+		}
+	default:
+		return fmt.Errorf("Reconcile method has to be %s or %s", ReconcileMethodReinstall, ReconcileMethodApply)
+	}
+	return nil
+}
+
+type configDrifts struct {
+	lock    sync.Mutex
+	drifted map[string]bool
+}
+
+// update logs the nodes which drifted, or came back in line, since the
+// last check.
+func (d *configDrifts) update(drifts []ConfigDrift) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	drifted := make(map[string]bool)
+	for _, drift := range drifts {
+		if !drift.Drifted {
+			if d.drifted[drift.MAC] {
+				log.Infof("Machine config of %s (%s) is up to date again", drift.MAC, drift.IP)
+			}
+			continue
+		}
+		drifted[drift.MAC] = true
+		if !d.drifted[drift.MAC] {
+			log.Warnf("Machine config %s of %s (%s) changed since it was served %s, reconcile with talos-pxe nodes reconcile %s",
+				drift.Config, drift.MAC, drift.IP, drift.Served.Format(time.RFC3339), drift.MAC)
+		}
+	}
+	d.drifted = drifted
+	nodesConfigDrifted.Set(float64(len(drifted)))
+}
+
+// configRenderKey marks the requests rendering configs again, which
+// aren't served to anyone, with the MAC of the node they're rendered for.
+type configRenderKey struct{}
+
+func isConfigRender(req *http.Request) bool {
+	_, ok := req.Context().Value(configRenderKey{}).(net.HardwareAddr)
+	return ok
+}
+
+// renderMAC is the MAC of the node the request renders a config for.
+func renderMAC(req *http.Request) net.HardwareAddr {
+	mac, _ := req.Context().Value(configRenderKey{}).(net.HardwareAddr)
+	return mac
+}
+
+// configRenderRequest requests uri as the node at ip would.
+func configRenderRequest(uri, ip string, mac net.HardwareAddr) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, uri, nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "0")
+	return req.WithContext(context.WithValue(req.Context(), configRenderKey{}, mac))
+}
+
+// renderServedConfig renders the machine config served to the node as it
+// would be served now.
+func (s *Server) renderServedConfig(node Node) ([]byte, error) {
+	if node.ConfigURL == "" {
+		return nil, fmt.Errorf("No machine config request recorded")
+	}
+	mac, _ := net.ParseMAC(node.MAC)
+	return s.renderConfig(configRenderRequest(node.ConfigURL, node.IP, mac))
+}
+
+func (s *Server) renderConfig(req *http.Request) ([]byte, error) {
+	rr := httptest.NewRecorder()
+	s.configRenderer().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		return nil, fmt.Errorf("Rendering %s failed with %d: %s", req.URL.Path, rr.Code, strings.TrimSpace(rr.Body.String()))
+	}
+	return rr.Body.Bytes(), nil
+}
+
+func (s *Server) checkConfigDrift(node Node) ConfigDrift {
+	drift := ConfigDrift{
+		MAC:          node.MAC,
+		IP:           node.IP,
+		Hostname:     node.Hostname,
+		Config:       node.Config,
+		Served:       node.ConfigServed,
+		ServedSHA256: node.ConfigSHA256,
+	}
+	data, err := s.renderServedConfig(node)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+	sum := sha256.Sum256(data)
+	drift.CurrentSHA256 = hex.EncodeToString(sum[:])
+	drift.Drifted = drift.CurrentSHA256 != drift.ServedSHA256
+	return drift
+}
+
+// configDrift checks the nodes which were served a machine config, only
+// returning those which drifted unless all.
+func (s *Server) configDrift(all bool) []ConfigDrift {
+	drifts := []ConfigDrift{}
+	for _, node := range s.nodes.list() {
+		if node.ConfigSHA256 == "" {
+			continue
+		}
+		if drift := s.checkConfigDrift(node); all || drift.Drifted {
+			drifts = append(drifts, drift)
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].IP < drifts[j].IP })
+	return drifts
+}
+
+// watchConfigDrift checks the nodes for drift periodically. It never
+// returns.
+func (s *Server) watchConfigDrift() {
+	for {
+		time.Sleep(configDriftInterval)
+		s.configDrifts.update(s.configDrift(true))
+	}
+}
+
+// reconcileNode flags the drifted node for reinstall, and power cycles
+// it, or applies the config to it. The node is returned with the error if
+// the power cycle or the Talos API failed.
+func (s *Server) reconcileNode(actor string, mac net.HardwareAddr, r reconcile) (Node, error) {
+	mac = s.nodes.identity(mac)
+	if r.Method == ReconcileMethodApply {
+		return s.applyNodeConfig(actor, mac, r.Mode)
+	}
+
+	node, ok := s.nodes.get(mac.String())
+	if !ok {
+		return Node{}, errNodeNotFound
+	}
+	if node.ConfigSHA256 == "" {
+		return Node{}, fmt.Errorf("Node %s wasn't served a machine config", mac)
+	}
+	drift := s.checkConfigDrift(node)
+	if drift.Error != "" {
+		return Node{}, fmt.Errorf("Could not render the machine config of %s: %s", mac, drift.Error)
+	}
+	if !drift.Drifted {
+		return Node{}, fmt.Errorf("Machine config of %s is up to date", mac)
+	}
+	if r.PowerCycle && s.PowerCycleCommand == "" {
+		return Node{}, fmt.Errorf("No power cycle command configured")
+	}
+
+	state := NodeStateReinstall
+	if node, ok = s.updateNode(actor, mac, nodeUpdate{State: &state}); !ok {
+		return Node{}, errNodeNotFound
+	}
+	s.audit.record(actor, "node.reconcile", mac.String(), fmt.Sprintf("%s from %s to %s", drift.Config, shortSHA256(drift.ServedSHA256), shortSHA256(drift.CurrentSHA256)))
+
+	if r.PowerCycle {
+		if err := s.powerCycle(node); err != nil {
+			s.audit.record(actor, "node.power-cycle", mac.String(), fmt.Sprintf("failed: %s", err))
+			return node, fmt.Errorf("Could not power cycle %s: %s", mac, err)
+		}
+		s.audit.record(actor, "node.power-cycle", mac.String(), "")
+	}
+	return node, nil
+}
+
+// applyNodeConfig pushes the machine config of the drifted node, rendered
+// again, to it through the Talos API.
+func (s *Server) applyNodeConfig(actor string, mac net.HardwareAddr, mode string) (Node, error) {
+	if s.Freeze {
+		return Node{}, errFrozen
+	}
+	if s.talosTLS == nil {
+		return Node{}, fmt.Errorf("Applying configs needs --talosconfig")
+	}
+	if mode == "" {
+		mode = "auto"
+	}
+	node, ok := s.nodes.get(mac.String())
+	if !ok {
+		return Node{}, errNodeNotFound
+	}
+	if node.ConfigSHA256 == "" {
+		return Node{}, fmt.Errorf("Node %s wasn't served a machine config", mac)
+	}
+	data, err := s.renderServedConfig(node)
+	if err != nil {
+		return Node{}, fmt.Errorf("Could not render the machine config of %s: %s", mac, err)
+	}
+	served := node.ConfigSHA256
+	sum := sha256.Sum256(data)
+	if current := hex.EncodeToString(sum[:]); current == served {
+		return Node{}, fmt.Errorf("Machine config of %s is up to date", mac)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), applyConfigTimeout)
+	defer cancel()
+	client, err := dialTalos(ctx, s.talosTLS, node.IP)
+	if err != nil {
+		return node, fmt.Errorf("Could not reach %s: %s", node.IP, err)
+	}
+	defer client.Close()
+	details, warnings, err := client.ApplyConfiguration(ctx, data, applyConfigModes[mode])
+	if err != nil {
+		s.audit.record(actor, "node.apply-config", mac.String(), fmt.Sprintf("failed: %s", err))
+		return node, fmt.Errorf("Could not apply the machine config to %s: %s", mac, err)
+	}
+	for _, warning := range warnings {
+		log.Warnf("Applying the machine config to %s: %s", mac, warning)
+	}
+
+	// The node runs the config now, as if it was served.
+	s.nodes.configServed(mac, node.Config, node.ConfigURL, data)
+	node, _ = s.nodes.get(mac.String())
+	log.Infof("Applied machine config %s to %s (%s): %s", node.Config, mac, node.IP, details)
+	s.audit.record(actor, "node.apply-config", mac.String(), fmt.Sprintf("%s from %s to %s, %s", node.Config, shortSHA256(served), shortSHA256(node.ConfigSHA256), mode))
+	return node, nil
+}
+
+func shortSHA256(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
+
+// configDriftHandler lists the drifted nodes, all the nodes served a
+// machine config with all=true.
+func (s *Server) configDriftHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.configDrift(req.FormValue("all") == "true"))
+}
+
+func (s *Server) nodeReconcileHandler(w http.ResponseWriter, req *http.Request, mac net.HardwareAddr) {
+	r := reconcile{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := r.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, req, roleAdmin) {
+		return
+	}
+
+	node, err := s.reconcileNode(requestActor(req), mac, r)
+	switch {
+	case err == errNodeNotFound:
+		http.NotFound(w, req)
+	case err != nil && node.MAC != "":
+		// Flagged, but the power cycle failed, or the Talos API did.
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, node)
+	}
+}
+
+// runNodesDrift lists the nodes whose machine config changed since it
+// was served.
+func runNodesDrift(args []string) error {
+	flags := flag.NewFlagSet("nodes drift", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	allFlag := flags.Bool("all", false, "List all the nodes served a machine config, not only the drifted ones")
+	flags.Parse(args)
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	drifts, err := client.ListConfigDrift(*allFlag)
+	if err != nil {
+		return err
+	}
+	if len(drifts) == 0 {
+		fmt.Println("No machine config changed since it was served")
+		return nil
+	}
+	for _, drift := range drifts {
+		status := "up to date"
+		switch {
+		case drift.Error != "":
+			status = drift.Error
+		case drift.Drifted:
+			status = fmt.Sprintf("drifted, served %s, now %s", shortSHA256(drift.ServedSHA256), shortSHA256(drift.CurrentSHA256))
+		}
+		fmt.Printf("%s\t%s\t%s\tserved %s ago\t%s\n", drift.MAC, drift.IP, drift.Config, ago(drift.Served), status)
+	}
+	return nil
+}
+
+// runNodesReconcile flags the drifted nodes for reinstall, or applies
+// their configs.
+func runNodesReconcile(args []string) error {
+	flags := flag.NewFlagSet("nodes reconcile", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	methodFlag := flags.String("method", ReconcileMethodReinstall, "How to reconcile, reinstall on the next boot or apply the config through the Talos API")
+	powerCycleFlag := flags.Bool("power-cycle", false, "Power cycle the nodes with the server's power cycle command to reinstall them now")
+	modeFlag := flags.String("mode", "", "Apply-config mode with --method apply, auto, no-reboot, reboot or staged (default auto)")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Usage: %s nodes reconcile [flags] MAC...", os.Args[0])
+	}
+	r := reconcile{Method: *methodFlag, PowerCycle: *powerCycleFlag, Mode: *modeFlag}
+	if err := r.check(); err != nil {
+		return err
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var nodes []Node
+	for _, mac := range flags.Args() {
+		node, err := client.ReconcileNode(mac, r)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+	return exportJSON(os.Stdout, nodes)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// An edge instance only runs DHCP, TFTP and DNS on its own segment and
+// proxies the HTTP requests to a central core instance, the single source
+// of truth for groups, profiles and machine configs. The iPXE menu is
+// still rendered by the edge, so that clients chain back to the edge.
+
+// The core only trusts edges knowing the secret shared with them: the
+// edge header of requests without it, e.g. sent by a client to skip the
+// config tokens, is stripped before any handler sees it.
+
+const (
+	// edgeHeader marks requests proxied by an edge, carrying its address.
+	edgeHeader = "X-Talos-Pxe-Edge"
+	// edgeSecretHeader carries the secret shared by the edges and the
+	// core.
+	edgeSecretHeader = "X-Talos-Pxe-Edge-Secret"
+)
+
+// loadEdgeSecret reads the secret shared by the edges and the core.
+func (s *Server) loadEdgeSecret() error {
+	if s.EdgeSecretFile == "" {
+		if s.CoreURL != "" {
+			return fmt.Errorf("Running as an edge needs --edge-secret-file, the core doesn't trust edges without it")
+		}
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.EdgeSecretFile)
+	if err != nil {
+		return err
+	}
+	s.edgeSecret = bytes.TrimSpace(data)
+	if len(s.edgeSecret) == 0 {
+		return fmt.Errorf("Edge secret %s is empty", s.EdgeSecretFile)
+	}
+	return nil
+}
+
+// isEdgeRequest returns whether the request was proxied by an edge. Only
+// the requests of authenticated edges keep the edge header past
+// edgeAuthHandler.
+func isEdgeRequest(req *http.Request) bool {
+	return req.Header.Get(edgeHeader) != ""
+}
+
+// edgeAuthHandler is the outermost handler, stripping the edge header of
+// the requests not carrying the edge secret.
+func (s *Server) edgeAuthHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if isEdgeRequest(req) {
+			secret := []byte(req.Header.Get(edgeSecretHeader))
+			if s.edgeSecret == nil || s.CoreURL != "" || subtle.ConstantTimeCompare(secret, s.edgeSecret) != 1 {
+				log.Warnf("Ignoring the %s header of %s, it didn't authenticate as an edge", edgeHeader, req.RemoteAddr)
+				req.Header.Del(edgeHeader)
+			}
+		}
+		req.Header.Del(edgeSecretHeader)
+
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func (s *Server) newCoreProxy() (http.Handler, error) {
+	target, err := url.Parse(s.CoreURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid core URL: %s", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.CoreCA != "" {
+		pem, err := ioutil.ReadFile(s.CoreCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", s.CoreCA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+		req.Header.Set(edgeHeader, s.IP.String())
+		req.Header.Set(edgeSecretHeader, string(s.edgeSecret))
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Errorf("Could not proxy %s to core %s: %s", req.URL.Path, s.CoreURL, err)
+		http.Error(w, "core unreachable", http.StatusBadGateway)
+	}
+
+	// Boot images present locally are served from here, saving the
+	// uplink the bulk of the traffic.
+	assetsDir := filepath.Join(s.ServerRoot, "assets")
+	assets := http.StripPrefix("/assets/", http.FileServer(http.Dir(assetsDir)))
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		if isBootImagePath(name) {
+			if fi, err := os.Stat(filepath.Join(assetsDir, filepath.FromSlash(name[len("/assets/"):]))); err == nil && !fi.IsDir() {
+				assets.ServeHTTP(w, req)
+				return
+			}
+		}
+
+		proxy.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn), nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// A controlplane node which is gone for good, e.g. with its hardware
+// dead, stays an etcd member: etcd keeps counting it for quorum, so that
+// losing one more controlplane node can lose quorum. A controlplane node
+// is taken to be gone when its Talos API hasn't answered the health checks
+// for --etcd-cleanup-after, when the --power-status-command reports it
+// off, or when its lease expired. A warning then suggests removing it
+// from etcd, with the talosctl commands doing it through another
+// controlplane node, and `talos-pxe etcd cleanup --execute` removes it
+// through the Talos API, after asking for confirmation.
+
+const (
+	etcdCleanupInterval = time.Minute
+	// Within the timeout of the management client.
+	etcdRemoveTimeout = 5 * time.Second
+)
+
+var errNoEtcdCleanup = errors.New("No etcd cleanup suggested for the node")
+
+// EtcdCleanup is the suggestion to remove a controlplane node gone from
+// etcd.
+type EtcdCleanup struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+	// Through is the controlplane node the member is removed through.
+	Through  string   `json:"through"`
+	Commands []string `json:"commands"`
+}
+
+type etcdCleanups struct {
+	lock        sync.Mutex
+	suggestions map[string]EtcdCleanup
+}
+
+func (c *etcdCleanups) list() []EtcdCleanup {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	out := []EtcdCleanup{}
+	for _, cleanup := range c.suggestions {
+		out = append(out, cleanup)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+func (c *etcdCleanups) get(mac string) (EtcdCleanup, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cleanup, ok := c.suggestions[mac]
+	return cleanup, ok
+}
+
+func (c *etcdCleanups) remove(mac string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.suggestions, mac)
+	etcdCleanupsPending.Set(float64(len(c.suggestions)))
+}
+
+// update replaces the suggestions, warning about the new ones.
+func (c *etcdCleanups) update(suggestions map[string]EtcdCleanup) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for mac, cleanup := range suggestions {
+		if old, ok := c.suggestions[mac]; ok {
+			cleanup.Since = old.Since
+			suggestions[mac] = cleanup
+			continue
+		}
+		log.Warnf("Controlplane node %s (%s) looks gone, %s: remove it from etcd before another controlplane node fails, with %s",
+			mac, cleanup.IP, cleanup.Reason, strings.Join(cleanup.Commands, " && "))
+	}
+	for mac, cleanup := range c.suggestions {
+		if _, ok := suggestions[mac]; !ok {
+			log.Infof("Controlplane node %s (%s) is back, no etcd cleanup needed", mac, cleanup.IP)
+		}
+	}
+	c.suggestions = suggestions
+	etcdCleanupsPending.Set(float64(len(suggestions)))
+}
+
+// watchEtcdMembers looks for controlplane nodes gone periodically. It
+// never returns.
+func (s *Server) watchEtcdMembers() {
+	for {
+		s.etcdCleanups.update(s.suggestEtcdCleanups())
+		time.Sleep(etcdCleanupInterval)
+	}
+}
+
+func (s *Server) suggestEtcdCleanups() map[string]EtcdCleanup {
+	var controlplanes []Node
+	for _, node := range s.nodes.list() {
+		if isControlplaneRole(node.Role) && node.IP != "" {
+			controlplanes = append(controlplanes, node)
+		}
+	}
+
+	gone := make(map[string]string)
+	for _, node := range controlplanes {
+		if reason := s.controlplaneGone(node); reason != "" {
+			gone[node.MAC] = reason
+		}
+	}
+
+	suggestions := make(map[string]EtcdCleanup)
+	for _, node := range controlplanes {
+		reason, ok := gone[node.MAC]
+		if !ok {
+			continue
+		}
+		// Through a controlplane node still there, preferring those
+		// known to answer.
+		var through string
+		for _, other := range controlplanes {
+			if _, ok := gone[other.MAC]; ok {
+				continue
+			}
+			if check, ok := s.nodeHealth.get(other.MAC); ok && check.Reachable {
+				through = other.IP
+				break
+			}
+			if through == "" {
+				through = other.IP
+			}
+		}
+		if through == "" {
+			// No quorum to keep without any controlplane node left.
+			continue
+		}
+
+		member := node.Hostname
+		if member == "" {
+			member = "<member>"
+		}
+		suggestions[node.MAC] = EtcdCleanup{
+			MAC:      node.MAC,
+			IP:       node.IP,
+			Hostname: node.Hostname,
+			Reason:   reason,
+			Since:    time.Now().UTC().Round(time.Second),
+			Through:  through,
+			Commands: []string{
+				fmt.Sprintf("talosctl -n %s etcd members", through),
+				fmt.Sprintf("talosctl -n %s etcd remove-member %s", through, member),
+				fmt.Sprintf("talos-pxe nodes remove %s", node.MAC),
+			},
+		}
+	}
+	return suggestions
+}
+
+// controlplaneGone tells why the controlplane node looks gone, if it
+// does.
+func (s *Server) controlplaneGone(node Node) string {
+	if check, ok := s.nodeHealth.get(node.MAC); ok && !check.Reachable && time.Since(check.Since) >= s.EtcdCleanupAfter {
+		return fmt.Sprintf("its Talos API is unreachable since %s", check.Since.Format(time.RFC3339))
+	}
+
+	if s.PowerStatusCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), powerCycleTimeout)
+		out, err := nodeCommand(ctx, s.PowerStatusCommand, node).Output()
+		cancel()
+		if err != nil {
+			log.Errorf("Could not get the power status of %s: %s", node.MAC, err)
+		} else if strings.EqualFold(strings.TrimSpace(string(out)), "off") {
+			return "it's powered off"
+		}
+	}
+
+	if !s.ProxyDHCP && !s.Observe {
+		s.DHCPLock.Lock()
+		_, ok := s.DHCPRecords[node.MAC]
+		s.DHCPLock.Unlock()
+		if !ok {
+			return "its lease expired"
+		}
+	}
+	return ""
+}
+
+// removeEtcdMember removes the controlplane node suggested for cleanup
+// from etcd through the Talos API of another controlplane node. The
+// cleanup is returned with the error if the Talos API failed.
+func (s *Server) removeEtcdMember(actor string, mac net.HardwareAddr) (EtcdCleanup, error) {
+	if s.Freeze {
+		return EtcdCleanup{}, errFrozen
+	}
+	cleanup, ok := s.etcdCleanups.get(mac.String())
+	if !ok {
+		return cleanup, errNoEtcdCleanup
+	}
+	if s.talosTLS == nil {
+		return EtcdCleanup{}, fmt.Errorf("Removing etcd members needs --talosconfig")
+	}
+	if cleanup.Hostname == "" {
+		return EtcdCleanup{}, fmt.Errorf("The hostname of %s, its etcd member name, isn't known, remove it with talosctl", mac)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRemoveTimeout)
+	defer cancel()
+	client, err := dialTalos(ctx, s.talosTLS, cleanup.Through)
+	if err != nil {
+		return cleanup, fmt.Errorf("Could not reach %s: %s", cleanup.Through, err)
+	}
+	defer client.Close()
+	if err := client.EtcdRemoveMember(ctx, cleanup.Hostname); err != nil {
+		return cleanup, fmt.Errorf("Could not remove %s from etcd through %s: %s", cleanup.Hostname, cleanup.Through, err)
+	}
+
+	s.etcdCleanups.remove(mac.String())
+	log.Infof("Removed %s (%s) from etcd through %s", cleanup.Hostname, mac, cleanup.Through)
+	s.audit.record(actor, "etcd.remove-member", mac.String(), fmt.Sprintf("%s through %s, %s", cleanup.Hostname, cleanup.Through, cleanup.Reason))
+	return cleanup, nil
+}
+
+// etcdCleanupHandler lists the suggested cleanups on GET of
+// /api/v1/etcd/cleanup and removes the member on POST to
+// /api/v1/etcd/cleanup/<mac>.
+func (s *Server) etcdCleanupHandler(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v1/etcd/cleanup"), "/")
+	if name == "" {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.etcdCleanups.list())
+		return
+	}
+
+	mac, err := net.ParseMAC(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, req, roleAdmin) {
+		return
+	}
+
+	cleanup, err := s.removeEtcdMember(requestActor(req), mac)
+	switch {
+	case err == errNoEtcdCleanup:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil && cleanup.MAC != "":
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, cleanup)
+	}
+}
+
+// runEtcd lists the suggested etcd cleanups of a running server and
+// carries them out.
+func runEtcd(args []string) error {
+	flags := flag.NewFlagSet("etcd", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	executeFlag := flags.Bool("execute", false, "Remove the members through the Talos API, asking for confirmation")
+	yesFlag := flags.BoolP("yes", "y", false, "Don't ask for confirmation, with --execute")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "cleanup" {
+		return fmt.Errorf("Usage: %s etcd cleanup [flags]", os.Args[0])
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	cleanups, err := client.ListEtcdCleanups()
+	if err != nil {
+		return err
+	}
+	if len(cleanups) == 0 {
+		fmt.Println("No controlplane node looks gone")
+		return nil
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	for _, cleanup := range cleanups {
+		fmt.Printf("%s (%s) looks gone since %s, %s:\n", cleanup.MAC, cleanup.IP, cleanup.Since.Local().Format(time.RFC1123), cleanup.Reason)
+		for _, command := range cleanup.Commands {
+			fmt.Printf("  %s\n", command)
+		}
+		if !*executeFlag {
+			continue
+		}
+
+		if !*yesFlag {
+			fmt.Printf("Remove %s from etcd through %s? [y/N] ", cleanup.Hostname, cleanup.Through)
+			answer, _ := stdin.ReadString('\n')
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				continue
+			}
+		}
+		if err := client.RemoveEtcdMember(cleanup.MAC); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from etcd, forget the node with talos-pxe nodes remove %s\n", cleanup.Hostname, cleanup.MAC)
+	}
+	return nil
+}
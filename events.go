@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// runEvents prints the audit events of a running server, and with
+// --follow keeps printing them as they're recorded.
+func runEvents(args []string) error {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	followFlag := flags.BoolP("follow", "f", false, "Keep printing events as they're recorded")
+	flags.Parse(args)
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	events, err := client.ListEvents()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		printEvent(os.Stdout, event)
+	}
+
+	if !*followFlag {
+		return nil
+	}
+	return client.WatchEvents(context.Background(), func(event AuditEvent) {
+		printEvent(os.Stdout, event)
+	})
+}
+
+func printEvent(w io.Writer, event AuditEvent) {
+	fields := []string{event.Time.Local().Format("2006-01-02 15:04:05"), event.Action}
+	for _, field := range []string{event.Node, event.Detail} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if event.Actor != "" {
+		fields = append(fields, "by "+event.Actor)
+	}
+	fmt.Fprintln(w, strings.Join(fields, "  "))
+}
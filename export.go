@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The audit events and the steps of the boot timelines are exported to
+// the sinks of the export config, so that their history outlives the
+// memory of the server: syslog, a Loki push API and files rotated by
+// size. Every sink has its own queue, a sink which is down keeps the
+// events until it's back, up to maxExportBacklog.
+
+const (
+	exportQueueSize     = 1024
+	exportBatchSize     = 100
+	exportFlushInterval = 2 * time.Second
+	maxExportBacklog    = 10000
+
+	exportFileSize  = 10 << 20
+	exportFileCount = 5
+)
+
+// An ExportSink is one destination of the events.
+type ExportSink struct {
+	// Type is syslog, loki or file.
+	Type string `json:"type"`
+	// Events limits the sink to audit or boot events, both by default.
+	Events []string `json:"events,omitempty"`
+
+	// Address of the syslog server as udp://host:port, tcp://host:port
+	// or unix:///dev/log, the local syslog if empty. Facility defaults
+	// to local0 and Tag to talos-pxe.
+	Address  string `json:"address,omitempty"`
+	Facility string `json:"facility,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+
+	// URL of the Loki push API, e.g.
+	// http://loki:3100/loki/api/v1/push. Labels are added to the job and
+	// type labels of the streams, Tenant is sent as X-Scope-OrgID.
+	URL    string            `json:"url,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Tenant string            `json:"tenant,omitempty"`
+
+	// Path of the file events are appended to, one JSON object per line.
+	// Once it reaches MaxSize bytes it's rotated to Path.1, keeping
+	// MaxFiles rotated files.
+	Path     string `json:"path,omitempty"`
+	MaxSize  int64  `json:"maxSize,omitempty"`
+	MaxFiles int    `json:"maxFiles,omitempty"`
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// eventSinks create the sinks of the types.
+var eventSinks = map[string]func(*ExportSink) (eventSink, error){
+	"syslog": newSyslogSink,
+	"loki":   newLokiSink,
+	"file":   newFileSink,
+}
+
+func (c *ExportSink) check() error {
+	for _, events := range c.Events {
+		if events != "audit" && events != "boot" {
+			return fmt.Errorf("unknown events %q", events)
+		}
+	}
+
+	switch c.Type {
+	case "syslog":
+		if c.Facility != "" {
+			if _, ok := syslogFacilities[c.Facility]; !ok {
+				return fmt.Errorf("unknown facility %q", c.Facility)
+			}
+		}
+		if c.Address != "" {
+			u, err := url.Parse(c.Address)
+			if err != nil {
+				return fmt.Errorf("invalid address: %s", err)
+			}
+			switch u.Scheme {
+			case "udp", "tcp":
+				if u.Host == "" {
+					return fmt.Errorf("address needs a host")
+				}
+			case "unix", "unixgram":
+				if u.Path == "" {
+					return fmt.Errorf("address needs a path")
+				}
+			default:
+				return fmt.Errorf("unsupported address %s", c.Address)
+			}
+		}
+	case "loki":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("loki needs an http or https url")
+		}
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("file needs a path")
+		}
+		if c.MaxSize < 0 || c.MaxFiles < 0 {
+			return fmt.Errorf("maxSize and maxFiles can't be negative")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	return nil
+}
+
+// name identifies the sink in logs and metrics.
+func (c *ExportSink) name() string {
+	switch c.Type {
+	case "syslog":
+		if c.Address == "" {
+			return "syslog"
+		}
+		return "syslog " + c.Address
+	case "loki":
+		return "loki " + c.URL
+	}
+	return c.Type + " " + c.Path
+}
+
+func (c *ExportSink) exports(eventType string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, events := range c.Events {
+		if events == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// An ExportedEvent is an audit event or a boot step, the step as
+// boot.step with the step in Detail, and its errors as boot.error.
+type ExportedEvent struct {
+	Type string `json:"type"`
+	AuditEvent
+}
+
+type eventSink interface {
+	send(batch []ExportedEvent) error
+}
+
+type exportQueue struct {
+	config *ExportSink
+	sink   eventSink
+	events chan ExportedEvent
+}
+
+// eventExporter sends the events to the sinks. The zero value and nil
+// export nothing.
+type eventExporter struct {
+	queues []*exportQueue
+}
+
+func newEventExporter(sinks []ExportSink) (*eventExporter, error) {
+	e := &eventExporter{}
+	for i := range sinks {
+		config := &sinks[i]
+		sink, err := eventSinks[config.Type](config)
+		if err != nil {
+			return nil, fmt.Errorf("Could not export to %s: %s", config.name(), err)
+		}
+		e.queues = append(e.queues, &exportQueue{
+			config: config,
+			sink:   sink,
+			events: make(chan ExportedEvent, exportQueueSize),
+		})
+	}
+	return e, nil
+}
+
+func (e *eventExporter) run() {
+	for _, q := range e.queues {
+		go q.run()
+	}
+}
+
+// export queues the event for the sinks. It never blocks, sinks which
+// can't keep up lose events.
+func (e *eventExporter) export(event ExportedEvent) {
+	if e == nil {
+		return
+	}
+	for _, q := range e.queues {
+		if !q.config.exports(event.Type) {
+			continue
+		}
+		select {
+		case q.events <- event:
+		default:
+			exportedEvents.WithLabelValues(q.config.Type, "dropped").Inc()
+		}
+	}
+}
+
+func (e *eventExporter) audit(event AuditEvent) {
+	e.export(ExportedEvent{Type: "audit", AuditEvent: event})
+}
+
+func (e *eventExporter) boot(now time.Time, mac, action, detail string) {
+	e.export(ExportedEvent{Type: "boot", AuditEvent: AuditEvent{Time: now, Action: action, Node: mac, Detail: detail}})
+}
+
+// run batches the events and sends them. A failed batch is retried with
+// the next one. It never returns.
+func (q *exportQueue) run() {
+	ticker := time.NewTicker(exportFlushInterval)
+	defer ticker.Stop()
+
+	var batch []ExportedEvent
+	failing := false
+	for {
+		select {
+		case event := <-q.events:
+			batch = append(batch, event)
+			if len(batch) < exportBatchSize || failing {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		if err := q.sink.send(batch); err != nil {
+			if !failing {
+				log.Errorf("Failed to export events to %s: %s", q.config.name(), err)
+			}
+			failing = true
+			exportedEvents.WithLabelValues(q.config.Type, "failed").Inc()
+			if len(batch) > maxExportBacklog {
+				exportedEvents.WithLabelValues(q.config.Type, "dropped").Add(float64(len(batch) - maxExportBacklog))
+				batch = append(batch[:0], batch[len(batch)-maxExportBacklog:]...)
+			}
+			continue
+		}
+
+		if failing {
+			log.Infof("Exporting events to %s again", q.config.name())
+			failing = false
+		}
+		exportedEvents.WithLabelValues(q.config.Type, "sent").Add(float64(len(batch)))
+		batch = nil
+	}
+}
+
+type syslogSink struct {
+	network, raddr string
+	priority       syslog.Priority
+	tag            string
+	writer         *syslog.Writer
+}
+
+func newSyslogSink(config *ExportSink) (eventSink, error) {
+	s := &syslogSink{priority: syslog.LOG_LOCAL0 | syslog.LOG_INFO, tag: "talos-pxe"}
+	if config.Facility != "" {
+		s.priority = syslogFacilities[config.Facility] | syslog.LOG_INFO
+	}
+	if config.Tag != "" {
+		s.tag = config.Tag
+	}
+	if config.Address != "" {
+		u, err := url.Parse(config.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.network, s.raddr = u.Scheme, u.Host
+		if u.Scheme == "unix" || u.Scheme == "unixgram" {
+			s.raddr = u.Path
+		}
+	}
+	return s, nil
+}
+
+// send writes every event as a JSON message. The server is only dialed
+// once there's something to send, so that it may be down on startup.
+func (s *syslogSink) send(batch []ExportedEvent) error {
+	if s.writer == nil {
+		w, err := syslog.Dial(s.network, s.raddr, s.priority, s.tag)
+		if err != nil {
+			return err
+		}
+		s.writer = w
+	}
+
+	for _, event := range batch {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := s.writer.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type lokiSink struct {
+	url    string
+	labels map[string]string
+	tenant string
+	client *http.Client
+}
+
+func newLokiSink(config *ExportSink) (eventSink, error) {
+	return &lokiSink{
+		url:    config.URL,
+		labels: config.Labels,
+		tenant: config.Tenant,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// send pushes the events as a stream per type, labelled with the job
+// and the configured labels.
+func (l *lokiSink) send(batch []ExportedEvent) error {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, event := range batch {
+		stream, ok := streams[event.Type]
+		if !ok {
+			labels := map[string]string{"job": "talos-pxe"}
+			for k, v := range l.labels {
+				labels[k] = v
+			}
+			labels["type"] = event.Type
+			stream = &lokiStream{Stream: labels}
+			streams[event.Type] = stream
+			order = append(order, event.Type)
+		}
+
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(event.Time.UnixNano(), 10), string(line)})
+	}
+
+	var push struct {
+		Streams []*lokiStream `json:"streams"`
+	}
+	for _, t := range order {
+		push.Streams = append(push.Streams, streams[t])
+	}
+	data, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("loki returned %s", resp.Status)
+	}
+	return nil
+}
+
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newFileSink(config *ExportSink) (eventSink, error) {
+	f := &fileSink{path: config.Path, maxSize: config.MaxSize, maxFiles: config.MaxFiles}
+	if f.maxSize == 0 {
+		f.maxSize = exportFileSize
+	}
+	if f.maxFiles == 0 {
+		f.maxFiles = exportFileCount
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+// rotate moves the file to path.1, path.1 to path.2 and so on, removing
+// the oldest, and starts a new file.
+func (f *fileSink) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *fileSink) send(batch []ExportedEvent) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, event := range batch {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	if f.size > 0 && f.size+int64(buf.Len()) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(buf.Bytes())
+	f.size += int64(n)
+	return err
+}
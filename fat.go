@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// fatImage builds a FAT16 file system image, just big enough to hold a
+// few boot files. Names that aren't 8.3 get long names, so that e.g.
+// autoexec.ipxe can be found.
+
+const (
+	fatSectorSize     = 512
+	fatClusterSectors = 4
+	fatClusterSize    = fatSectorSize * fatClusterSectors
+	fatReserved       = 4
+	fatRootEntries    = 512
+	fatMinSize        = 16 << 20
+
+	fatAttrVolume  = 0x08
+	fatAttrDir     = 0x10
+	fatAttrArchive = 0x20
+	fatAttrLFN     = 0x0f
+)
+
+type fatNode struct {
+	name     string
+	data     []byte
+	children map[string]*fatNode
+	cluster  int
+}
+
+func (n *fatNode) isDir() bool {
+	return n.children != nil
+}
+
+// sorted returns the children of the directory in a stable order.
+func (n *fatNode) sorted() []*fatNode {
+	var names []string
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []*fatNode
+	for _, name := range names {
+		out = append(out, n.children[name])
+	}
+	return out
+}
+
+type fatImage struct {
+	label string
+	root  *fatNode
+	// hidden is the number of sectors before the file system on the
+	// disk, its partition offset.
+	hidden uint32
+}
+
+func newFATImage(label string) *fatImage {
+	return &fatImage{label: label, root: &fatNode{children: make(map[string]*fatNode)}}
+}
+
+// add adds the file at the slash separated path, creating its
+// directories.
+func (img *fatImage) add(name string, data []byte) {
+	dir := img.root
+	parts := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		key := strings.ToUpper(part)
+		child, ok := dir.children[key]
+		if !ok {
+			child = &fatNode{name: part, children: make(map[string]*fatNode)}
+			dir.children[key] = child
+		}
+		dir = child
+	}
+	last := parts[len(parts)-1]
+	dir.children[strings.ToUpper(last)] = &fatNode{name: last, data: data}
+}
+
+func fatClusters(size int) int {
+	if size == 0 {
+		return 0
+	}
+	return (size + fatClusterSize - 1) / fatClusterSize
+}
+
+// bytes lays out the image.
+func (img *fatImage) bytes() ([]byte, error) {
+	// Every subdirectory fits into a cluster, which holds 64 entries.
+	var clusters []*fatNode
+	var walk func(dir *fatNode) error
+	walk = func(dir *fatNode) error {
+		for _, child := range dir.sorted() {
+			if child.isDir() {
+				if len(child.children) > 20 {
+					return fmt.Errorf("Too many files in %s", child.name)
+				}
+				clusters = append(clusters, child)
+				if err := walk(child); err != nil {
+					return err
+				}
+			} else if len(child.data) > 0 {
+				clusters = append(clusters, child)
+			}
+		}
+		return nil
+	}
+	if err := walk(img.root); err != nil {
+		return nil, err
+	}
+
+	used := 0
+	for _, n := range clusters {
+		n.cluster = 2 + used
+		if n.isDir() {
+			used++
+		} else {
+			used += fatClusters(len(n.data))
+		}
+	}
+
+	rootSectors := fatRootEntries * 32 / fatSectorSize
+	size := fatMinSize
+	if need := (used+64)*fatClusterSize + 1<<20; need > size {
+		size = need
+	}
+	totalSectors := size / fatSectorSize
+	count := (totalSectors - fatReserved - rootSectors) / fatClusterSectors
+	if count > 65524 {
+		return nil, fmt.Errorf("Files too large for the boot image")
+	}
+	fatSectors := ((count+2)*2 + fatSectorSize - 1) / fatSectorSize
+	rootStart := (fatReserved + 2*fatSectors) * fatSectorSize
+	dataStart := rootStart + rootSectors*fatSectorSize
+
+	out := make([]byte, totalSectors*fatSectorSize)
+	le := binary.LittleEndian
+
+	// Boot sector with the BIOS parameter block.
+	copy(out, []byte{0xeb, 0x3c, 0x90})
+	copy(out[3:11], "TALOSPXE")
+	le.PutUint16(out[11:], fatSectorSize)
+	out[13] = fatClusterSectors
+	le.PutUint16(out[14:], fatReserved)
+	out[16] = 2
+	le.PutUint16(out[17:], fatRootEntries)
+	if totalSectors < 1<<16 {
+		le.PutUint16(out[19:], uint16(totalSectors))
+	} else {
+		le.PutUint32(out[32:], uint32(totalSectors))
+	}
+	out[21] = 0xf8
+	le.PutUint16(out[22:], uint16(fatSectors))
+	le.PutUint16(out[24:], 32)
+	le.PutUint16(out[26:], 64)
+	le.PutUint32(out[28:], img.hidden)
+	out[36] = 0x80
+	out[38] = 0x29
+	le.PutUint32(out[39:], uint32(time.Now().Unix()))
+	copy(out[43:54], fatPad(strings.ToUpper(img.label), 11))
+	copy(out[54:62], "FAT16   ")
+	out[510], out[511] = 0x55, 0xaa
+
+	// The FAT, and its copy.
+	fat := make([]byte, fatSectors*fatSectorSize)
+	le.PutUint16(fat[0:], 0xfff8)
+	le.PutUint16(fat[2:], 0xffff)
+	for _, n := range clusters {
+		length := 1
+		if !n.isDir() {
+			length = fatClusters(len(n.data))
+		}
+		for i := 0; i < length; i++ {
+			next := uint16(n.cluster + i + 1)
+			if i == length-1 {
+				next = 0xffff
+			}
+			le.PutUint16(fat[(n.cluster+i)*2:], next)
+		}
+	}
+	copy(out[fatReserved*fatSectorSize:], fat)
+	copy(out[(fatReserved+fatSectors)*fatSectorSize:], fat)
+
+	clusterOffset := func(cluster int) int {
+		return dataStart + (cluster-2)*fatClusterSize
+	}
+
+	now := time.Now()
+	var writeDir func(dir *fatNode, offset, parent int, isRoot bool)
+	writeDir = func(dir *fatNode, offset, parent int, isRoot bool) {
+		var entries [][]byte
+		if isRoot {
+			entries = append(entries, fatEntry(fatPad(strings.ToUpper(img.label), 11), fatAttrVolume, 0, 0, now))
+		} else {
+			entries = append(entries, fatEntry(fatPad(".", 11), fatAttrDir, dir.cluster, 0, now))
+			entries = append(entries, fatEntry(fatPad("..", 11), fatAttrDir, parent, 0, now))
+		}
+		for i, child := range dir.sorted() {
+			attr, cluster, size := byte(fatAttrArchive), 0, 0
+			if child.isDir() {
+				attr, cluster = fatAttrDir, child.cluster
+			} else if len(child.data) > 0 {
+				cluster, size = child.cluster, len(child.data)
+				copy(out[clusterOffset(child.cluster):], child.data)
+			}
+			short, ok := fatShortName(child.name)
+			if !ok {
+				short = fatAliasName(child.name, i+1)
+				entries = append(entries, fatLongEntries(child.name, short)...)
+			}
+			entries = append(entries, fatEntry(short, attr, cluster, size, now))
+		}
+		for i, entry := range entries {
+			copy(out[offset+i*32:], entry)
+		}
+
+		for _, child := range dir.sorted() {
+			if child.isDir() {
+				self := dir.cluster
+				if isRoot {
+					self = 0
+				}
+				writeDir(child, clusterOffset(child.cluster), self, false)
+			}
+		}
+	}
+	writeDir(img.root, rootStart, 0, true)
+
+	return out, nil
+}
+
+func fatPad(s string, n int) []byte {
+	b := []byte(s)
+	for len(b) < n {
+		b = append(b, ' ')
+	}
+	return b[:n]
+}
+
+// fatShortName returns the 8.3 name, if the name is one.
+func fatShortName(name string) ([]byte, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.ToUpper(name) != name {
+		return nil, false
+	}
+	for _, c := range base + ext {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-~!#$%&()@^'{}", c)) {
+			return nil, false
+		}
+	}
+	return append(fatPad(base, 8), fatPad(ext, 3)...), true
+}
+
+// fatAliasName makes up the short name of a long name, e.g. AUTOEX~1IPX.
+func fatAliasName(name string, n int) []byte {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+				b.WriteRune(c)
+			}
+		}
+		return b.String()
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	tail := fmt.Sprintf("~%d", n)
+	base = clean(base)
+	if len(base) > 8-len(tail) {
+		base = base[:8-len(tail)]
+	}
+	return append(fatPad(base+tail, 8), fatPad(clean(ext), 3)...)
+}
+
+func fatEntry(name []byte, attr byte, cluster, size int, t time.Time) []byte {
+	e := make([]byte, 32)
+	copy(e, name)
+	e[11] = attr
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	le := binary.LittleEndian
+	le.PutUint16(e[14:], clock)
+	le.PutUint16(e[16:], date)
+	le.PutUint16(e[18:], date)
+	le.PutUint16(e[22:], clock)
+	le.PutUint16(e[24:], date)
+	le.PutUint16(e[26:], uint16(cluster))
+	le.PutUint32(e[28:], uint32(size))
+	return e
+}
+
+// fatLongEntries returns the long name entries preceding the short entry,
+// the last part of the name first.
+func fatLongEntries(name string, short []byte) [][]byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+
+	chars := utf16.Encode([]rune(name))
+	chars = append(chars, 0)
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xffff)
+	}
+
+	count := len(chars) / 13
+	var entries [][]byte
+	for i := count - 1; i >= 0; i-- {
+		e := make([]byte, 32)
+		e[0] = byte(i + 1)
+		if i == count-1 {
+			e[0] |= 0x40
+		}
+		e[11] = fatAttrLFN
+		e[13] = sum
+		part := chars[i*13 : i*13+13]
+		for j, c := range part {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + j*2
+			case j < 11:
+				off = 14 + (j-5)*2
+			default:
+				off = 28 + (j-11)*2
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+)
+
+// --freeze is the emergency brake for change freezes: the server keeps
+// booting the nodes it knows from their disks, but provisions nothing.
+// Unknown clients get no lease, every iPXE boot gets a script booting
+// from disk instead of the menu or a role, machine configs aren't served,
+// and upgrades, scheduled jobs and power cycles are refused. Provisioning
+// windows let some clients through, see provisioning.go.
+
+var errFrozen = fmt.Errorf("Provisioning is frozen")
+
+var freezeScript = []byte(`#!ipxe
+echo Provisioning is frozen, booting this machine (${mac}) from disk.
+exit
+`)
+
+// frozenScript returns what the machine gets instead of the menu or its
+// role while frozen, nil otherwise.
+func (s *Server) frozenScript(mac net.HardwareAddr) []byte {
+	if !s.frozen(mac) {
+		return nil
+	}
+	log.Infof("Booting %s from disk, provisioning is frozen", mac)
+	return freezeScript
+}
+
+// freezeHandler refuses machine config fetches while frozen.
+func (s *Server) freezeHandler(next http.Handler) http.Handler {
+	if !s.Freeze {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if isMachineConfigPath(path.Clean(req.URL.Path)) && s.frozen(s.clientMAC(req)) {
+			log.Warnf("Refusing %s to %s, provisioning is frozen", req.URL.Path, req.RemoteAddr)
+			http.Error(w, errFrozen.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Some fabrics blackhole a freshly claimed address for up to a minute,
+// until the switches and routers relearn where it is. Once the server
+// claims its address it announces it with gratuitous ARP, and with
+// --gratuitous-arp-leases it announces the addresses it leases after
+// their ACKs too, on behalf of the clients: the ARP sender is the client,
+// while the frame comes from the server, so switches don't move the MAC
+// of the client to the port of the server.
+
+// The interval between the announcements of the server address, as in
+// RFC 5227.
+const gratuitousARPInterval = 2 * time.Second
+
+// sendGratuitousARP broadcasts an ARP announcement of the IP at the MAC
+// on the packet socket.
+func sendGratuitousARP(raw, ifindex int, mac net.HardwareAddr, ip net.IP) error {
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := arp.SerializeTo(buf, gopacket.SerializeOptions{}); err != nil {
+		return fmt.Errorf("Could not build the announcement of %s: %s", ip, err)
+	}
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ifindex,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], layers.EthernetBroadcast)
+	return syscall.Sendto(raw, buf.Bytes(), 0, addr)
+}
+
+// announceAddress announces the address of the server GratuitousARP
+// times.
+func (s *Server) announceAddress() {
+	intf, err := net.InterfaceByName(s.Intf)
+	if err != nil {
+		log.Errorf("Could not announce %s: %s", s.IP, err)
+		return
+	}
+	if len(intf.HardwareAddr) != 6 || s.IP.To4() == nil {
+		return
+	}
+
+	raw, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		log.Warnf("Could not open a packet socket, not announcing %s: %s", s.IP, err)
+		return
+	}
+	defer syscall.Close(raw)
+
+	for i := 0; i < s.GratuitousARP; i++ {
+		if i > 0 {
+			time.Sleep(gratuitousARPInterval)
+		}
+		if err := sendGratuitousARP(raw, intf.Index, intf.HardwareAddr, s.IP); err != nil {
+			log.Errorf("Could not announce %s: %s", s.IP, err)
+			return
+		}
+	}
+	log.Infof("Announced %s at %s with gratuitous ARP", s.IP, intf.HardwareAddr)
+}
+
+// announceLease announces the leased address of the client.
+func (r *dhcpReplier) announceLease(mac net.HardwareAddr, ip net.IP) {
+	if r.raw < 0 || len(mac) != 6 || ip.To4() == nil || ip.IsUnspecified() {
+		return
+	}
+	if err := sendGratuitousARP(r.raw, r.ifindex, mac, ip); err != nil {
+		log.Errorf("Could not announce %s for %s: %s", ip, mac, err)
+	}
+}
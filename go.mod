@@ -3,16 +3,25 @@ module github.com/borancar/talos-pxe
 go 1.16
 
 require (
+	github.com/ajeddeloh/yaml v0.0.0-20170912190910-6b94386aeefd
 	github.com/coredhcp/coredhcp v0.0.0-20210830115404-2176f33418f4
 	github.com/coredns/coredns v1.8.4
 	github.com/digineo/go-dhclient v1.0.2
+	github.com/docker/libcontainer v2.2.1+incompatible
 	github.com/google/gopacket v1.1.19
 	github.com/insomniacslk/dhcp v0.0.0-20210813103503-c143d771146e
+	github.com/klauspost/compress v1.15.9
 	github.com/miekg/dns v1.1.42
 	github.com/milosgajdos/tenus v0.0.3
 	github.com/pin/tftp v0.0.0-20210809155059-0161c5dd2e96
 	github.com/poseidon/matchbox v0.9.0
+	github.com/prometheus/client_golang v1.10.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/pflag v1.0.6-0.20201009195203-85dd5c8bc61c
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
+	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
 )
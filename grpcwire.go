@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The Talos gRPC services we implement only use a handful of small
+// messages, so rather than vendoring the generated code for each of them
+// we encode and decode the protobuf wire format by hand.
+
+// A wireMessage can convert itself to and from the protobuf wire format.
+type wireMessage interface {
+	MarshalWire() []byte
+	UnmarshalWire(b []byte) error
+}
+
+// wireCodec is a gRPC codec for wireMessages. It registers under the
+// "proto" name so that it is picked for standard protobuf clients.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal %T to protobuf", v)
+	}
+	return m.MarshalWire(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("Cannot unmarshal protobuf into %T", v)
+	}
+	return m.UnmarshalWire(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+// wireEmpty is a message without any fields.
+type wireEmpty struct{}
+
+func (*wireEmpty) MarshalWire() []byte {
+	return nil
+}
+
+func (*wireEmpty) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(protowire.Number, []byte, uint64) error { return nil })
+}
+
+// wireFields calls fn for every field in b. Length-delimited fields are
+// passed in v, varint fields in n. Fields of any other type are skipped.
+func wireFields(b []byte, fn func(num protowire.Number, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			if err := fn(num, v, 0); err != nil {
+				return err
+			}
+			b = b[l:]
+		case protowire.VarintType:
+			n, l := protowire.ConsumeVarint(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			if err := fn(num, nil, n); err != nil {
+				return err
+			}
+			b = b[l:]
+		default:
+			l := protowire.ConsumeFieldValue(num, typ, b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			b = b[l:]
+		}
+	}
+	return nil
+}
+
+func wireAppendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func wireAppendString(b []byte, num protowire.Number, v string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func wireAppendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Hooks integrate the server with the rest of a site, e.g. updating a
+// CMDB or asking for an approval, without forking it. The hooks of the
+// config run a shell command, the context on its stdin and the node in
+// its environment, or POST the context to a URL, at four points of the
+// lifecycle of the nodes: before a client is offered an address, after a
+// machine chose its role, after its machine config was served and after
+// its install was verified, the Talos API of the node answering. Hooks of
+// the first two can approve: their failure, or timing out, refuses the
+// offer or the boot. The others run in the background, every hook with
+// its own queue.
+
+const (
+	hookPreOffer            = "pre-offer"
+	hookPostRoleSelection   = "post-role-selection"
+	hookPostConfigServe     = "post-config-serve"
+	hookPostInstallVerified = "post-install-verified"
+
+	hookTimeout   = 5 * time.Second
+	hookQueueSize = 256
+	// Clients repeat their discovers, so the pre-offer hooks of a client
+	// run at most this often, the decision being kept in the meantime.
+	hookOfferTTL = time.Minute
+	// How many discovers the pre-offer hooks run for at once. Beyond
+	// that, as every new MAC runs them, the offers are refused until
+	// they finish, the clients discovering again.
+	hookMaxOfferRuns = 16
+	// How much of the output of a failed hook is kept.
+	hookMaxOutput = 512
+)
+
+var hookEvents = map[string]bool{
+	hookPreOffer:            true,
+	hookPostRoleSelection:   true,
+	hookPostConfigServe:     true,
+	hookPostInstallVerified: true,
+}
+
+var errHooksBusy = fmt.Errorf("Too many pre-offer hooks running")
+
+var refusedBootTemplate = template.Must(template.New("iPXE refused").Parse(`#!ipxe
+echo
+echo Booting this machine ({{ .MAC }}) as {{ .Type }} wasn't approved:
+echo {{ .Reason }}
+echo Retrying in {{ .Delay }} seconds, attempt {{ .Attempt }} of {{ .Attempts }}.
+sleep {{ .Delay }}
+chain {{ .URL }}
+`))
+
+// A Hook runs Command, or POSTs to URL, on the Event. Timeout defaults to
+// 5s.
+type Hook struct {
+	Comment string `json:"comment,omitempty"`
+	// Event is pre-offer, post-role-selection, post-config-serve or
+	// post-install-verified.
+	Event string `json:"event"`
+	// Command is run with sh -c, getting the context as JSON on its stdin
+	// and the node in NODE_ variables like the power cycle command.
+	Command string `json:"command,omitempty"`
+	// URL is POSTed the context as JSON, with the Headers.
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Timeout string            `json:"timeout,omitempty"`
+	// Approve refuses the offer or the boot if the command fails or the
+	// URL doesn't answer with 2xx, for pre-offer and post-role-selection.
+	Approve bool `json:"approve,omitempty"`
+
+	timeout time.Duration
+}
+
+func (h *Hook) check() error {
+	if !hookEvents[h.Event] {
+		return fmt.Errorf("unknown event %q", h.Event)
+	}
+	if (h.Command == "") == (h.URL == "") {
+		return fmt.Errorf("needs either a command or a url")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("needs an http or https url")
+		}
+	}
+	if h.Approve && h.Event != hookPreOffer && h.Event != hookPostRoleSelection {
+		return fmt.Errorf("only %s and %s hooks can approve", hookPreOffer, hookPostRoleSelection)
+	}
+	h.timeout = hookTimeout
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", h.Timeout)
+		}
+		h.timeout = timeout
+	}
+	return nil
+}
+
+// name identifies the hook in logs.
+func (h *Hook) name() string {
+	if h.Comment != "" {
+		return h.Comment
+	}
+	if h.URL != "" {
+		return h.URL
+	}
+	return h.Command
+}
+
+// HookContext is what the hooks get, as JSON.
+type HookContext struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	MAC   string    `json:"mac"`
+	IP    string    `json:"ip,omitempty"`
+	Role  string    `json:"role,omitempty"`
+	// The DHCP fields of the client, for pre-offer.
+	Arch      string `json:"arch,omitempty"`
+	Class     string `json:"class,omitempty"`
+	UserClass string `json:"user_class,omitempty"`
+	// Selectors of the boot, for post-role-selection.
+	Selectors map[string]string `json:"selectors,omitempty"`
+	// The machine config served, for post-config-serve.
+	Config       string `json:"config,omitempty"`
+	ConfigSHA256 string `json:"config_sha256,omitempty"`
+	// Node is the inventory entry of the node, if it's known.
+	Node *Node `json:"node,omitempty"`
+}
+
+// call runs the hook, returning why it failed.
+func (h *Hook) call(c HookContext) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	if h.Command != "" {
+		node := Node{MAC: c.MAC, IP: c.IP, Role: c.Role}
+		if c.Node != nil {
+			node = *c.Node
+		}
+		cmd := nodeCommand(ctx, h.Command, node)
+		cmd.Env = append(cmd.Env, "HOOK_EVENT="+c.Event)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, hookOutput(out))
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range h.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, hookMaxOutput))
+		return fmt.Errorf("%s: %s", resp.Status, hookOutput(body))
+	}
+	return nil
+}
+
+func hookOutput(out []byte) string {
+	if len(out) > hookMaxOutput {
+		out = out[:hookMaxOutput]
+	}
+	return strings.Join(strings.Fields(string(out)), " ")
+}
+
+type hookQueue struct {
+	hook     *Hook
+	contexts chan HookContext
+}
+
+type hookDecision struct {
+	err     error
+	expires time.Time
+}
+
+// hookRunner runs the hooks. Nil runs nothing.
+type hookRunner struct {
+	approvers []*Hook
+	queues    []*hookQueue
+
+	lock sync.Mutex
+	// offers are the pre-offer decisions by MAC.
+	offers map[string]hookDecision
+	// offerRuns holds a slot for every discover running the pre-offer
+	// hooks.
+	offerRuns chan struct{}
+}
+
+func newHookRunner(hooks []Hook) *hookRunner {
+	r := &hookRunner{offers: make(map[string]hookDecision), offerRuns: make(chan struct{}, hookMaxOfferRuns)}
+	for i := range hooks {
+		hook := &hooks[i]
+		if hook.Approve {
+			r.approvers = append(r.approvers, hook)
+			continue
+		}
+		r.queues = append(r.queues, &hookQueue{hook: hook, contexts: make(chan HookContext, hookQueueSize)})
+	}
+	return r
+}
+
+func (r *hookRunner) run() {
+	for _, q := range r.queues {
+		go q.run()
+	}
+}
+
+// fire runs the approving hooks of the event in order, returning the
+// refusal of the first failing one, or errHooksBusy if too many pre-offer
+// hooks are running, and then queues the context for the others.
+func (r *hookRunner) fire(c HookContext) error {
+	if r == nil {
+		return nil
+	}
+	c.Time = time.Now().UTC()
+
+	if c.Event == hookPreOffer {
+		r.lock.Lock()
+		decision, ok := r.offers[c.MAC]
+		r.lock.Unlock()
+		if ok && decision.expires.After(c.Time) {
+			return decision.err
+		}
+
+		select {
+		case r.offerRuns <- struct{}{}:
+			defer func() { <-r.offerRuns }()
+		default:
+			log.Warnf("Pre-offer hooks can't keep up, refusing the offer to %s", c.MAC)
+			hookRuns.WithLabelValues(c.Event, "busy").Inc()
+			return errHooksBusy
+		}
+	}
+
+	err := r.approve(c)
+	if c.Event == hookPreOffer {
+		r.lock.Lock()
+		for mac, decision := range r.offers {
+			if !decision.expires.After(c.Time) {
+				delete(r.offers, mac)
+			}
+		}
+		r.offers[c.MAC] = hookDecision{err: err, expires: c.Time.Add(hookOfferTTL)}
+		r.lock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, q := range r.queues {
+		if q.hook.Event != c.Event {
+			continue
+		}
+		select {
+		case q.contexts <- c:
+		default:
+			log.Warnf("Hook %s can't keep up, dropping %s of %s", q.hook.name(), c.Event, c.MAC)
+			hookRuns.WithLabelValues(c.Event, "dropped").Inc()
+		}
+	}
+	return nil
+}
+
+func (r *hookRunner) approve(c HookContext) error {
+	for _, hook := range r.approvers {
+		if hook.Event != c.Event {
+			continue
+		}
+		if err := hook.call(c); err != nil {
+			hookRuns.WithLabelValues(c.Event, "refused").Inc()
+			return fmt.Errorf("Hook %s refused: %s", hook.name(), err)
+		}
+		hookRuns.WithLabelValues(c.Event, "approved").Inc()
+	}
+	return nil
+}
+
+// run calls the hook for the queued contexts. It never returns.
+func (q *hookQueue) run() {
+	for c := range q.contexts {
+		if err := q.hook.call(c); err != nil {
+			log.Warnf("Hook %s failed on %s of %s: %s", q.hook.name(), c.Event, c.MAC, err)
+			hookRuns.WithLabelValues(c.Event, "failed").Inc()
+			continue
+		}
+		hookRuns.WithLabelValues(c.Event, "ok").Inc()
+	}
+}
+
+// nodeHookContext is the context of the event for the node.
+func (s *Server) nodeHookContext(event string, mac net.HardwareAddr) HookContext {
+	c := HookContext{Event: event, MAC: mac.String()}
+	if node, ok := s.nodes.get(s.nodes.identity(mac).String()); ok {
+		c.IP, c.Role, c.Node = node.IP, node.Role, &node
+	}
+	return c
+}
+
+// offerHooks runs the pre-offer hooks for the discover.
+func (s *Server) offerHooks(m *dhcpv4.DHCPv4) error {
+	if s.hooks == nil {
+		return nil
+	}
+	c := s.nodeHookContext(hookPreOffer, m.ClientHWAddr)
+	if archs := m.ClientArch(); len(archs) > 0 {
+		c.Arch = strings.ToLower(archs[0].String())
+	}
+	c.Class = m.ClassIdentifier()
+	c.UserClass = strings.Join(m.UserClass(), ",")
+	return s.hooks.fire(c)
+}
+
+// roleSelectionHooks runs the post-role-selection hooks for the boot
+// script request, telling whether the boot was refused and returning the
+// script retrying the request, nil if the attempts ran out.
+func (s *Server) roleSelectionHooks(req *http.Request, mac net.HardwareAddr, retry int) ([]byte, bool) {
+	query := req.URL.Query()
+	if s.hooks == nil || mac == nil || query.Get("type") == "" {
+		return nil, false
+	}
+
+	c := s.nodeHookContext(hookPostRoleSelection, mac)
+	c.IP = query.Get("ip")
+	c.Role = query.Get("type")
+	c.Selectors = requestSelectors(query)
+	err := s.hooks.fire(c)
+	if err == nil {
+		return nil, false
+	}
+
+	log.Warnf("Not booting %s as %s: %s", mac, c.Role, err)
+	s.audit.record("hooks", "node.refuse", mac.String(), err.Error())
+	s.sessions.failed(mac, err)
+
+	data, ok := s.retryData(req, retry)
+	if !ok {
+		return nil, true
+	}
+	var buf bytes.Buffer
+	err = refusedBootTemplate.Execute(&buf, struct {
+		configRetryData
+		Reason string
+	}{data, strings.NewReplacer("$", "", "{", "(", "}", ")").Replace(err.Error())})
+	if err != nil {
+		log.Errorf("Could not render retry script: %s", err)
+		return nil, true
+	}
+	return buf.Bytes(), true
+}
+
+// configServeHooks runs the post-config-serve hooks.
+func (s *Server) configServeHooks(mac net.HardwareAddr) {
+	if s.hooks == nil {
+		return
+	}
+	c := s.nodeHookContext(hookPostConfigServe, mac)
+	if c.Node != nil {
+		c.Config, c.ConfigSHA256 = c.Node.Config, c.Node.ConfigSHA256
+	}
+	s.hooks.fire(c)
+}
+
+// installVerified marks the install of the node verified once, running
+// the post-install-verified hooks. Nodes are only verified after their
+// machine config was served, and until they boot again.
+func (s *Server) installVerified(mac string) {
+	var verified *Node
+	s.nodes.update(mac, func(node *Node) {
+		if node.ConfigServed.IsZero() || !node.Verified.IsZero() {
+			return
+		}
+		if node.State != NodeStateProvisioning && node.State != NodeStateInstalled {
+			return
+		}
+		node.Verified = time.Now()
+		copied := *node
+		verified = &copied
+	})
+	if verified == nil {
+		return
+	}
+
+	log.Infof("Install of node %s (%s) verified", verified.MAC, verified.IP)
+	s.hooks.fire(HookContext{Event: hookPostInstallVerified, MAC: verified.MAC, IP: verified.IP, Role: verified.Role, Node: verified})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP proxy lets nodes without a route to the internet pull the
+// installer and the other images they need through the server. Machine
+// configs are pointed at it, and it only connects to the registries on
+// the allowlist.
+
+const portHTTPProxy = 3128
+
+var defaultHTTPProxyAllow = []string{
+	"ghcr.io",
+	"pkg-containers.githubusercontent.com",
+	"registry.k8s.io",
+	"*.pkg.dev",
+	"docker.io",
+	"*.docker.io",
+	"production.cloudflare.docker.com",
+	"quay.io",
+	"*.quay.io",
+	"factory.talos.dev",
+}
+
+// httpProxyAllows tells whether the host is on the allowlist. Entries
+// starting with *. match the subdomains of the rest.
+func (s *Server) httpProxyAllows(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, allowed := range s.HTTPProxyAllow {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) httpProxyURL() string {
+	return fmt.Sprintf("http://%s:%d", s.advertisedIP(), s.HTTPProxyPort)
+}
+
+// httpProxyPatch has the nodes use the proxy for everything but the
+// provisioning network.
+func (s *Server) httpProxyPatch(cfg map[interface{}]interface{}) error {
+	noProxy := []string{s.advertisedIP().String(), "localhost", "127.0.0.1", strings.TrimSuffix(s.Controlplane, ".")}
+	if s.Net != nil {
+		noProxy = append(noProxy, s.Net.String())
+	}
+
+	for key, value := range map[string]string{
+		"http_proxy":  s.httpProxyURL(),
+		"https_proxy": s.httpProxyURL(),
+		"no_proxy":    strings.Join(noProxy, ","),
+	} {
+		if err := setConfigValue(cfg, "machine.env."+key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type httpProxy struct {
+	s         *Server
+	transport *http.Transport
+	dialer    *net.Dialer
+}
+
+func (s *Server) serveHTTPProxy(l net.Listener) error {
+	p := &httpProxy{
+		s:      s,
+		dialer: &net.Dialer{Timeout: 30 * time.Second},
+		transport: &http.Transport{
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	p.transport.DialContext = p.dialer.DialContext
+
+	log.Infof("Proxying HTTP to %s", strings.Join(s.HTTPProxyAllow, ", "))
+	if err := http.Serve(l, p); err != nil {
+		return fmt.Errorf("HTTP proxy shut down: %s", err)
+	}
+	return nil
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.URL.Hostname()
+	if req.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(req.Host)
+	}
+
+	if host == "" || !p.s.httpProxyAllows(host) {
+		log.Warnf("HTTP proxy: denied %s %s from %s", req.Method, req.Host, req.RemoteAddr)
+		httpProxyRequests.WithLabelValues("denied").Inc()
+		http.Error(w, fmt.Sprintf("%s is not on the allowlist", host), http.StatusForbidden)
+		return
+	}
+	httpProxyRequests.WithLabelValues("allowed").Inc()
+
+	if req.Method == http.MethodConnect {
+		p.tunnel(w, req)
+		return
+	}
+	p.forward(w, req)
+}
+
+// tunnel connects the client to the host for CONNECT requests, which is
+// how HTTPS goes through the proxy.
+func (p *httpProxy) tunnel(w http.ResponseWriter, req *http.Request) {
+	upstream, err := p.dialer.DialContext(req.Context(), "tcp", req.Host)
+	if err != nil {
+		log.Warnf("HTTP proxy: could not connect to %s: %s", req.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Error(err)
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	log.Debugf("HTTP proxy: tunneling %s to %s", req.RemoteAddr, req.Host)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Whatever the client sent along with the request.
+		if n := buf.Reader.Buffered(); n > 0 {
+			data, _ := buf.Reader.Peek(n)
+			upstream.Write(data)
+		}
+		io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	client.Close()
+	upstream.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
+}
+
+// forward passes plain HTTP requests on.
+func (p *httpProxy) forward(w http.ResponseWriter, req *http.Request) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		log.Warnf("HTTP proxy: %s %s failed: %s", req.Method, req.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/poseidon/matchbox/matchbox/storage"
+)
+
+// Talos only finds out that the install disk of its config doesn't exist
+// halfway through the install, leaving the node in maintenance mode.
+// With ValidateInstallDisk, the disks the node reported to the inventory
+// are checked against the install disk of the machine config before it's
+// served, and the boot session fails with the reason instead. Nodes which
+// didn't report their disks first boot PreflightProfile, if set, which is
+// expected to report them and reboot.
+
+// installDisk is the install disk of a machine config, either a device
+// or a selector.
+type installDisk struct {
+	Disk     string
+	Selector map[string]string
+}
+
+func (d installDisk) String() string {
+	if d.Disk != "" {
+		return d.Disk
+	}
+	var parts []string
+	for _, key := range []string{"name", "model", "serial", "size"} {
+		if value := d.Selector[key]; value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	return "disk with " + strings.Join(parts, ", ")
+}
+
+// machineInstallDisk returns the install disk of the machine config.
+func machineInstallDisk(data []byte) (installDisk, error) {
+	_, cfg, err := v1alpha1Document(splitConfigDocuments(data))
+	if err != nil {
+		return installDisk{}, err
+	}
+
+	var d installDisk
+	if value, ok := getConfigValue(cfg, "machine.install.disk"); ok {
+		d.Disk, _ = value.(string)
+	}
+	if value, ok := getConfigValue(cfg, "machine.install.diskSelector"); ok {
+		if m, ok := value.(map[interface{}]interface{}); ok {
+			d.Selector = make(map[string]string)
+			for key, v := range m {
+				d.Selector[fmt.Sprint(key)] = fmt.Sprint(v)
+			}
+		}
+	}
+	return d, nil
+}
+
+var diskSizeRegexp = regexp.MustCompile(`^\s*(==|>=|<=|>|<)?\s*([0-9.]+)\s*([KMGTP]i?B|B)?\s*$`)
+
+var diskSizeUnits = map[string]float64{
+	"": 1, "B": 1,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12, "PB": 1e15,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40, "PiB": 1 << 50,
+}
+
+// matchDiskSize matches the size like the size of a Talos disk selector,
+// e.g. 4GB, >= 1TB or < 2TiB.
+func matchDiskSize(matcher string, size uint64) (bool, error) {
+	m := diskSizeRegexp.FindStringSubmatch(matcher)
+	if m == nil {
+		return false, fmt.Errorf("Invalid disk size %s", matcher)
+	}
+	value, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return false, fmt.Errorf("Invalid disk size %s", matcher)
+	}
+	want := uint64(value * diskSizeUnits[m[3]])
+
+	switch m[1] {
+	case ">=":
+		return size >= want, nil
+	case "<=":
+		return size <= want, nil
+	case ">":
+		return size > want, nil
+	case "<":
+		return size < want, nil
+	}
+	return size == want, nil
+}
+
+// matches tells if the disk is the install disk. Selector keys the
+// inventory doesn't know are ignored.
+func (d installDisk) matches(disk Disk) (bool, error) {
+	if d.Disk != "" {
+		return path.Base(d.Disk) == path.Base(disk.Name), nil
+	}
+	for key, value := range d.Selector {
+		switch key {
+		case "name":
+			if ok, _ := path.Match(path.Base(value), path.Base(disk.Name)); !ok {
+				return false, nil
+			}
+		case "model":
+			if ok, _ := path.Match(value, disk.Model); !ok {
+				return false, nil
+			}
+		case "serial":
+			if value != disk.Serial {
+				return false, nil
+			}
+		case "size":
+			ok, err := matchDiskSize(value, disk.SizeBytes)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// checkInstallDisk returns an error if none of the disks is the install
+// disk of the machine config.
+func checkInstallDisk(data []byte, disks []Disk) error {
+	d, err := machineInstallDisk(data)
+	if err != nil {
+		return fmt.Errorf("Could not parse machine config: %s", err)
+	}
+	if d.Disk == "" && len(d.Selector) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, disk := range disks {
+		ok, err := d.matches(disk)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		names = append(names, path.Base(disk.Name))
+	}
+	return fmt.Errorf("Install disk %s not found, the node has %s", d, strings.Join(names, ", "))
+}
+
+// installDiskHandler refuses the machine configs whose install disk the
+// node requesting them doesn't have. Machines which didn't report their
+// disks get the config unchecked.
+func (s *Server) installDiskHandler(next http.Handler) http.Handler {
+	if !s.ValidateInstallDisk {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || !isMachineConfigPath(path.Clean(req.URL.Path)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rr := httptest.NewRecorder()
+		next.ServeHTTP(rr, req)
+
+		mac := s.clientMAC(req)
+		node, ok := Node{}, false
+		if mac != nil {
+			node, ok = s.nodes.get(mac.String())
+		}
+		if rr.Code == http.StatusOK && ok && node.Hardware != nil && len(node.Hardware.Disks) > 0 {
+			if err := checkInstallDisk(rr.Body.Bytes(), node.Hardware.Disks); err != nil {
+				log.Warnf("Refusing %s to %s: %s", req.URL.Path, mac, err)
+				installDiskChecks.WithLabelValues("failed").Inc()
+				s.sessions.failed(mac, err)
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			installDiskChecks.WithLabelValues("passed").Inc()
+		} else if rr.Code == http.StatusOK {
+			log.Warnf("Not checking the install disk of %s for %s, it didn't report its disks", req.URL.Path, req.RemoteAddr)
+			installDiskChecks.WithLabelValues("unknown").Inc()
+		}
+
+		copyHeader(w.Header(), rr.Header())
+		w.WriteHeader(rr.Code)
+		w.Write(rr.Body.Bytes())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// The boot script of a profile, as matchbox renders it.
+var profileScriptTemplate = template.Must(template.New("iPXE profile").Parse(`#!ipxe
+kernel {{.Kernel}}{{range $arg := .Args}} {{$arg}}{{end}}
+{{- range $element := .Initrd }}
+initrd {{$element}}
+{{- end}}
+boot
+`))
+
+// needsPreflight tells if the machine should boot the preflight profile
+// before its role, because it didn't report its disks yet.
+func (s *Server) needsPreflight(node Node, ok bool) bool {
+	if s.PreflightProfile == "" {
+		return false
+	}
+	return !ok || node.Hardware == nil || len(node.Hardware.Disks) == 0
+}
+
+// preflightScript renders the boot script of the preflight profile.
+func (s *Server) preflightScript(store storage.Store) ([]byte, error) {
+	profile, err := store.ProfileGet(s.PreflightProfile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load preflight profile %s: %s", s.PreflightProfile, err)
+	}
+	if profile.Boot == nil {
+		return nil, fmt.Errorf("Preflight profile %s has no boot", s.PreflightProfile)
+	}
+
+	var buf bytes.Buffer
+	if err := profileScriptTemplate.Execute(&buf, profile.Boot); err != nil {
+		return nil, err
+	}
+	return s.withInventoryURL(s.withProgressURL(buf.Bytes())), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iPXE only knows the SMBIOS model of the machine, not what's plugged
+// into it. The boot scripts pass the nodes the URL to report their
+// hardware to in the talos.pxe.inventory kernel argument, and whatever
+// runs on the node, e.g. an extension of the installer, POSTs its PCI
+// devices, disks, CPUs and memory there as JSON. The hardware is kept in the
+// node inventory, and the labels derived from it are added to the
+// selectors of the later boots of the node, so that matchbox groups can
+// e.g. boot the nodes with GPUs into a separate worker pool.
+
+const (
+	inventoryPath      = "/inventory"
+	inventoryKernelArg = "talos.pxe.inventory"
+	maxInventorySize   = 1 << 20
+)
+
+// Hardware is what a node reported of its hardware.
+type Hardware struct {
+	Manufacturer string      `json:"manufacturer,omitempty"`
+	Product      string      `json:"product,omitempty"`
+	CPUs         int         `json:"cpus,omitempty"`
+	MemoryBytes  uint64      `json:"memory_bytes,omitempty"`
+	PCI          []PCIDevice `json:"pci,omitempty"`
+	Disks        []Disk      `json:"disks,omitempty"`
+	NICs         []NIC       `json:"nics,omitempty"`
+	Reported     time.Time   `json:"reported"`
+}
+
+// A PCIDevice has the IDs and class code as lspci -n prints them, in
+// hex.
+type PCIDevice struct {
+	Slot   string `json:"slot,omitempty"`
+	Vendor string `json:"vendor"`
+	Device string `json:"device"`
+	Class  string `json:"class"`
+}
+
+// A Disk is a block device of the node.
+type Disk struct {
+	Name   string `json:"name"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	WWN    string `json:"wwn,omitempty"`
+	// Type is ssd, hdd or nvme.
+	Type      string `json:"type,omitempty"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
+}
+
+// The vendors of the display controllers which are GPUs, rather than the
+// VGA of the BMC.
+var gpuVendors = map[string]string{
+	"10de": "nvidia",
+	"1002": "amd",
+}
+
+func normalizeHex(id string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+}
+
+func (hw *Hardware) check() error {
+	for i := range hw.PCI {
+		dev := &hw.PCI[i]
+		dev.Vendor, dev.Device, dev.Class = normalizeHex(dev.Vendor), normalizeHex(dev.Device), normalizeHex(dev.Class)
+		for _, id := range []string{dev.Vendor, dev.Device, dev.Class} {
+			if _, err := strconv.ParseUint(id, 16, 32); err != nil {
+				return fmt.Errorf("Invalid PCI device %s:%s class %s", dev.Vendor, dev.Device, dev.Class)
+			}
+		}
+	}
+	return checkNICs(hw.NICs)
+}
+
+// labels returns the selectors derived from the hardware.
+func (hw *Hardware) labels() map[string]string {
+	labels := make(map[string]string)
+
+	gpus := make(map[string]int)
+	for _, dev := range hw.PCI {
+		if vendor, ok := gpuVendors[dev.Vendor]; ok && strings.HasPrefix(dev.Class, "03") {
+			gpus[vendor]++
+		}
+	}
+	if len(gpus) > 0 {
+		vendors := make([]string, 0, len(gpus))
+		count := 0
+		for vendor, n := range gpus {
+			vendors = append(vendors, vendor)
+			count += n
+		}
+		sort.Strings(vendors)
+		labels["gpu"] = strings.Join(vendors, "-")
+		labels["gpu-count"] = strconv.Itoa(count)
+	}
+	return labels
+}
+
+// withInventoryURL adds the inventory URL to the kernel command line of
+// the boot script.
+func (s *Server) withInventoryURL(script []byte) []byte {
+	arg := fmt.Sprintf(" %s=http://${next-server}:%d%s", inventoryKernelArg, s.advertisedHTTPPort(), inventoryPath)
+
+	lines := bytes.Split(script, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("kernel ")) && !bytes.Contains(line, []byte(inventoryKernelArg+"=")) {
+			lines[i] = append(bytes.TrimRight(line, " \r"), arg...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// hardwareRequest adds the labels derived from the hardware of the node
+// to the selectors of the request, unless the request sets them itself.
+func (s *Server) hardwareRequest(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil {
+		return req
+	}
+	node, ok := s.nodes.get(mac.String())
+	if !ok || node.Hardware == nil {
+		return req
+	}
+
+	added := false
+	for key, value := range node.Hardware.labels() {
+		if _, ok := query[key]; !ok {
+			query.Set(key, value)
+			added = true
+		}
+	}
+	if !added {
+		return req
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
+
+// inventoryHandler records the hardware reported on inventoryPath in the
+// node inventory. Everything else is passed to the next handler.
+func (s *Server) inventoryHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != inventoryPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mac := s.reportingNode(w, req, req.URL.Query().Get("mac"))
+		if mac == nil {
+			return
+		}
+
+		var hw Hardware
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxInventorySize)).Decode(&hw); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid inventory: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := hw.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hw.Reported = time.Now()
+
+		mac = s.nodes.identity(mac)
+		if _, ok := s.nodes.update(mac.String(), func(node *Node) { node.Hardware = &hw }); !ok {
+			http.Error(w, "Unknown node", http.StatusNotFound)
+			return
+		}
+		if len(hw.NICs) > 1 {
+			s.linkNICs(mac, hw.NICs)
+		}
+		log.Infof("%s reported %d PCI devices, labels %s", mac, len(hw.PCI), strings.TrimPrefix(encodeSelectors(hw.labels()), "&"))
+		inventoryReports.Inc()
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	return http.HandlerFunc(fn)
+}
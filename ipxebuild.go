@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Machines whose firmware can't PXE boot at all can still boot iPXE from
+// a USB stick or CD, and have it chain to the server. `talos-pxe
+// ipxe-build` builds iPXE from its sources with a script doing so
+// embedded, and the CAs to trust the server with over HTTPS.
+
+const (
+	ipxeGitURL = "https://github.com/ipxe/ipxe.git"
+	// The iPXE named config, under config/local, of the build options.
+	ipxeConfigName = "talos-pxe"
+)
+
+// The USB and ISO images for BIOS and UEFI machines.
+var defaultIpxeTargets = []string{
+	"bin/ipxe.usb",
+	"bin/ipxe.iso",
+	"bin-x86_64-efi/ipxe.usb",
+	"bin-x86_64-efi/ipxe.efi",
+}
+
+// ipxeEmbedScript gets an address and chains to the server at the base
+// URL, retrying until it succeeds.
+func ipxeEmbedScript(base string) string {
+	return fmt.Sprintf(`#!ipxe
+:retry
+dhcp || goto retry
+chain %s/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime} || goto retry
+`, strings.TrimSuffix(base, "/"))
+}
+
+func runIpxeBuild(args []string) error {
+	flags := flag.NewFlagSet("ipxe-build", flag.ExitOnError)
+	urlFlag := flags.String("url", fmt.Sprintf("http://192.168.123.1:%d", portHTTP), "URL of the server for iPXE to chain to")
+	srcFlag := flags.String("src", "", "iPXE source tree, cloned from "+ipxeGitURL+" if empty")
+	refFlag := flags.String("ref", "master", "iPXE git branch or tag to clone")
+	trustFlag := flags.StringArray("trust", nil, "CA certificate to trust HTTPS servers with instead of the public CAs, can be repeated")
+	certFlag := flags.String("cert", "", "Client certificate to embed, e.g. from `talos-pxe ca issue`")
+	keyFlag := flags.String("key", "", "Key of the client certificate")
+	scriptFlag := flags.String("script", "", "iPXE script to embed instead of chaining to --url")
+	targetFlag := flags.StringArray("target", defaultIpxeTargets, "iPXE build targets, can be repeated")
+	outputFlag := flags.StringP("output", "o", ".", "Directory to write the images to")
+	jobsFlag := flags.Int("jobs", runtime.NumCPU(), "Parallel make jobs")
+	multicastTFTPFlag := flags.Bool("multicast-tftp", false, "Build with multicast TFTP, to download the boot images from talos-pxe --multicast-tftp")
+	flags.Parse(args)
+
+	if u, err := url.Parse(*urlFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid server URL %q", *urlFlag)
+	}
+	if (*certFlag == "") != (*keyFlag == "") {
+		return fmt.Errorf("--cert and --key go together")
+	}
+
+	work, err := ioutil.TempDir("", "talos-pxe-ipxe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	src := *srcFlag
+	if src == "" {
+		log.Infof("Cloning iPXE %s", *refFlag)
+		cmd := exec.Command("git", "clone", "--depth", "1", "--branch", *refFlag, ipxeGitURL, filepath.Join(work, "ipxe"))
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Could not clone iPXE: %s", err)
+		}
+		src = filepath.Join(work, "ipxe")
+	}
+	// Either the checkout or its src directory.
+	if _, err := os.Stat(filepath.Join(src, "src", "Makefile")); err == nil {
+		src = filepath.Join(src, "src")
+	}
+
+	script := filepath.Join(work, "embed.ipxe")
+	if *scriptFlag != "" {
+		if script, err = filepath.Abs(*scriptFlag); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(script, []byte(ipxeEmbedScript(*urlFlag)), 0644); err != nil {
+		return err
+	}
+
+	vars := []string{"EMBED=" + script}
+	if len(*trustFlag) > 0 {
+		var trust []string
+		for _, name := range *trustFlag {
+			abs, err := filepath.Abs(name)
+			if err != nil {
+				return err
+			}
+			trust = append(trust, abs)
+		}
+		vars = append(vars, "TRUST="+strings.Join(trust, ","))
+	}
+	if *certFlag != "" {
+		cert, err := filepath.Abs(*certFlag)
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Abs(*keyFlag)
+		if err != nil {
+			return err
+		}
+		vars = append(vars, "CERT="+cert, "PRIVKEY="+key)
+	}
+
+	if *multicastTFTPFlag {
+		// A named config, so that the build doesn't touch the
+		// general.h of the source tree.
+		dir := filepath.Join(src, "config", "local", ipxeConfigName)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "general.h"), []byte("#define DOWNLOAD_PROTO_TFTM\n"), 0644); err != nil {
+			return err
+		}
+		vars = append(vars, "CONFIG="+ipxeConfigName)
+	}
+
+	log.Infof("Building %s", strings.Join(*targetFlag, ", "))
+	makeArgs := append([]string{"-C", src, "-j", strconv.Itoa(*jobsFlag)}, *targetFlag...)
+	cmd := exec.Command("make", append(makeArgs, vars...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not build iPXE: %s", err)
+	}
+
+	if err := os.MkdirAll(*outputFlag, 0755); err != nil {
+		return err
+	}
+	for _, target := range *targetFlag {
+		data, err := ioutil.ReadFile(filepath.Join(src, filepath.FromSlash(target)))
+		if err != nil {
+			return err
+		}
+		// bin/ipxe.usb becomes ipxe-bios.usb, bin-x86_64-efi/ipxe.usb
+		// ipxe-x86_64-efi.usb.
+		dir, name := filepath.Split(filepath.FromSlash(target))
+		platform := strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(dir), "bin"), "-")
+		if platform == "" {
+			platform = "bios"
+		}
+		ext := filepath.Ext(name)
+		out := filepath.Join(*outputFlag, fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), platform, ext))
+		if err := ioutil.WriteFile(out, data, 0644); err != nil {
+			return err
+		}
+		fmt.Println(out)
+	}
+	return nil
+}
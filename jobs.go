@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Test labs rebuild their nodes from scratch on a schedule, so that
+// nothing drifts from the golden configs. Jobs in the config flag the
+// nodes they select for reinstall, or for booting Talos in maintenance
+// mode, without a machine config, at the times of their cron schedule,
+// and power cycle them with the power cycle command to boot right away.
+// With maintenance windows, the runs falling outside of them are
+// skipped, as the nodes wouldn't be reinstalled anyway.
+
+const (
+	JobReinstall   = "reinstall"
+	JobMaintenance = "maintenance"
+
+	// How far ahead the next run is looked for.
+	jobLookahead = 366 * 24 * time.Hour
+)
+
+// A ScheduledJob flags the nodes matching Nodes on Schedule, a cron
+// expression, e.g. 0 2 * * sat, in Timezone, local time if empty.
+type ScheduledJob struct {
+	Name       string   `json:"name"`
+	Schedule   string   `json:"schedule"`
+	Timezone   string   `json:"timezone,omitempty"`
+	Action     string   `json:"action"`
+	Nodes      JobNodes `json:"nodes"`
+	PowerCycle bool     `json:"powerCycle,omitempty"`
+
+	schedule *cronSchedule
+	location *time.Location
+}
+
+// JobNodes selects the nodes by any combination of their role, labels
+// and MACs.
+type JobNodes struct {
+	Role   string            `json:"role,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	MACs   []string          `json:"macs,omitempty"`
+}
+
+func (j *ScheduledJob) check() error {
+	if j.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if j.Action != JobReinstall && j.Action != JobMaintenance {
+		return fmt.Errorf("action has to be %s or %s", JobReinstall, JobMaintenance)
+	}
+	schedule, err := parseCronSchedule(j.Schedule)
+	if err != nil {
+		return err
+	}
+	j.schedule = schedule
+	j.location = time.Local
+	if j.Timezone != "" {
+		if j.location, err = time.LoadLocation(j.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %s", j.Timezone, err)
+		}
+	}
+	if j.Nodes.Role == "" && len(j.Nodes.Labels) == 0 && len(j.Nodes.MACs) == 0 {
+		return fmt.Errorf("needs a role, labels or MACs to select nodes by")
+	}
+	for i, value := range j.Nodes.MACs {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAC %s", value)
+		}
+		j.Nodes.MACs[i] = mac.String()
+	}
+	return nil
+}
+
+func (n *JobNodes) matches(node Node) bool {
+	if node.Role == observedRole {
+		return false
+	}
+	if n.Role != "" && node.Role != n.Role {
+		return false
+	}
+	for key, value := range n.Labels {
+		if node.Labels[key] != value {
+			return false
+		}
+	}
+	if len(n.MACs) == 0 {
+		return true
+	}
+	for _, mac := range n.MACs {
+		if mac == node.MAC {
+			return true
+		}
+		for _, other := range node.MACs {
+			if mac == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A cronSchedule has the minutes, hours, days of the month, months and
+// days of the week it matches as bit sets.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// A day matches either field if both are restricted, like cron does.
+	anyDay, anyWeekday bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+var cronWeekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	if expanded, ok := cronShorthands[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, e.g. 0 2 * * sat", spec)
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12, nil); err != nil {
+		return nil, err
+	}
+	if s.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, err
+	}
+	// 7 is Sunday too.
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	s.anyDay, s.anyWeekday = fields[2] == "*", fields[4] == "*"
+	return &s, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges,
+// each with an optional /step, into a bit set.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q in %q, %d to %d", s, field, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q in %q", part, field)
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 || s.hours&(1<<uint(t.Hour())) == 0 || s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// next returns the next time after t the schedule matches, or the zero
+// time if it doesn't within jobLookahead.
+func (j *ScheduledJob) next(t time.Time) time.Time {
+	t = t.In(j.location).Truncate(time.Minute).Add(time.Minute)
+	for end := t.Add(jobLookahead); t.Before(end); t = t.Add(time.Minute) {
+		if j.schedule.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// JobStatus is a job with when it runs next and how its last run went.
+type JobStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Action   string    `json:"action"`
+	Next     time.Time `json:"next,omitempty"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+	Nodes    []string  `json:"nodes,omitempty"`
+	Skipped  string    `json:"skipped,omitempty"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+type jobRuns struct {
+	lock sync.Mutex
+	last map[string]JobStatus
+}
+
+func (s *Server) scheduledJobs() []ScheduledJob {
+	if s.Config == nil {
+		return nil
+	}
+	return s.Config.Jobs
+}
+
+func (s *Server) scheduledJob(name string) *ScheduledJob {
+	jobs := s.scheduledJobs()
+	for i := range jobs {
+		if jobs[i].Name == name {
+			return &jobs[i]
+		}
+	}
+	return nil
+}
+
+// runJobs runs the jobs on their schedules, checking every minute.
+func (s *Server) runJobs() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		now = time.Now()
+		for i := range s.Config.Jobs {
+			job := &s.Config.Jobs[i]
+			if !job.schedule.matches(now.In(job.location)) {
+				continue
+			}
+			if s.Freeze {
+				log.Warnf("Skipping job %s, provisioning is frozen", job.Name)
+				s.jobs.done(JobStatus{Name: job.Name, LastRun: now, Skipped: "provisioning frozen"})
+				jobRunsTotal.WithLabelValues(job.Name, "skipped").Inc()
+				continue
+			}
+			if m := s.maintenance(); m != nil && !m.open(now) {
+				log.Warnf("Skipping job %s, no maintenance window is open", job.Name)
+				s.jobs.done(JobStatus{Name: job.Name, LastRun: now, Skipped: "no maintenance window open"})
+				jobRunsTotal.WithLabelValues(job.Name, "skipped").Inc()
+				continue
+			}
+			s.runJob("job "+job.Name, job)
+		}
+	}
+}
+
+// runJob flags the nodes the job selects, power cycling them if the job
+// does.
+func (s *Server) runJob(actor string, job *ScheduledJob) JobStatus {
+	status := JobStatus{Name: job.Name, Schedule: job.Schedule, Action: job.Action, LastRun: time.Now()}
+	state := NodeStateReinstall
+	if job.Action == JobMaintenance {
+		state = NodeStateMaintenance
+	}
+
+	for _, node := range s.nodes.list() {
+		if !job.Nodes.matches(node) {
+			continue
+		}
+		mac, _ := net.ParseMAC(node.MAC)
+		node, ok := s.updateNode(actor, mac, nodeUpdate{State: &state})
+		if !ok {
+			continue
+		}
+		status.Nodes = append(status.Nodes, node.MAC)
+
+		if job.PowerCycle {
+			if err := s.powerCycle(node); err != nil {
+				s.audit.record(actor, "node.power-cycle", node.MAC, fmt.Sprintf("failed: %s", err))
+				status.Errors = append(status.Errors, fmt.Sprintf("Could not power cycle %s: %s", node.MAC, err))
+				continue
+			}
+			s.audit.record(actor, "node.power-cycle", node.MAC, "")
+		}
+	}
+	sort.Strings(status.Nodes)
+
+	log.Infof("Job %s flagged %d nodes for %s", job.Name, len(status.Nodes), job.Action)
+	s.audit.record(actor, "job.run", "", fmt.Sprintf("%s flagged %d nodes for %s", job.Name, len(status.Nodes), job.Action))
+	result := "done"
+	if len(status.Errors) > 0 {
+		result = "failed"
+	}
+	jobRunsTotal.WithLabelValues(job.Name, result).Inc()
+
+	s.jobs.done(status)
+	return status
+}
+
+func (r *jobRuns) done(status JobStatus) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.last == nil {
+		r.last = make(map[string]JobStatus)
+	}
+	r.last[status.Name] = status
+}
+
+func (s *Server) jobStatus(job *ScheduledJob) JobStatus {
+	s.jobs.lock.Lock()
+	status := s.jobs.last[job.Name]
+	s.jobs.lock.Unlock()
+
+	status.Name, status.Schedule, status.Action = job.Name, job.Schedule, job.Action
+	status.Next = job.next(time.Now())
+	return status
+}
+
+// jobsHandler lists the jobs on /api/v1/jobs, and runs one now on a POST
+// to /api/v1/jobs/NAME/run.
+func (s *Server) jobsHandler(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v1/jobs"), "/")
+	if name == "" {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jobs := s.scheduledJobs()
+		out := make([]JobStatus, 0, len(jobs))
+		for i := range jobs {
+			out = append(out, s.jobStatus(&jobs[i]))
+		}
+		writeJSON(w, out)
+		return
+	}
+
+	name = strings.TrimSuffix(name, "/run")
+	job := s.scheduledJob(name)
+	if job == nil || !strings.HasSuffix(req.URL.Path, "/run") {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(w, req, roleAdmin) {
+		return
+	}
+	if s.Freeze {
+		http.Error(w, errFrozen.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, s.runJob(requestActor(req), job))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The KMS service implements the KMSService Talos uses for network-bound
+// disk encryption. Nodes send us their disk encryption key to seal when
+// the disk is formatted, and get it back unsealed on every boot. Nodes
+// point at it with a "grpc://" endpoint in their systemDiskEncryption
+// kms key config.
+
+const kmsSecret = "kms-key"
+
+type kmsService struct {
+	key []byte
+}
+
+// aead returns the cipher for the given node. Keys are derived per node so
+// that one node can't unseal the data of another.
+func (k *kmsService) aead(nodeUUID string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write([]byte(nodeUUID))
+
+	return newAEAD(mac.Sum(nil))
+}
+
+func (k *kmsService) Seal(ctx context.Context, req *kmsRequest) (*kmsResponse, error) {
+	if req.NodeUUID == "" {
+		return nil, status.Error(codes.InvalidArgument, "node UUID is required")
+	}
+
+	aead, err := k.aead(req.NodeUUID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	sealed, err := seal(aead, req.Data, []byte(req.NodeUUID))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.Infof("Sealed disk encryption key for node %s", req.NodeUUID)
+
+	return &kmsResponse{Data: sealed}, nil
+}
+
+func (k *kmsService) Unseal(ctx context.Context, req *kmsRequest) (*kmsResponse, error) {
+	if req.NodeUUID == "" {
+		return nil, status.Error(codes.InvalidArgument, "node UUID is required")
+	}
+
+	aead, err := k.aead(req.NodeUUID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	plain, err := openSealed(aead, req.Data, []byte(req.NodeUUID))
+	if err != nil {
+		log.Errorf("Failed to unseal disk encryption key for node %s: %s", req.NodeUUID, err)
+		return nil, status.Error(codes.PermissionDenied, "failed to unseal data")
+	}
+
+	log.Infof("Unsealed disk encryption key for node %s", req.NodeUUID)
+
+	return &kmsResponse{Data: plain}, nil
+}
+
+func kmsHandler(unseal bool) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := &kmsRequest{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if unseal {
+			return srv.(*kmsService).Unseal(ctx, req)
+		}
+		return srv.(*kmsService).Seal(ctx, req)
+	}
+}
+
+var kmsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kms.KMSService",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Seal", Handler: kmsHandler(false)},
+		{MethodName: "Unseal", Handler: kmsHandler(true)},
+	},
+	Metadata: "kms.proto",
+}
+
+func (s *Server) serveKMS(l net.Listener) error {
+	secrets, err := s.secretsStore()
+	if err != nil {
+		return fmt.Errorf("KMS server can't open secrets: %s", err)
+	}
+
+	key, err := secrets.GetOrCreate(kmsSecret, 32)
+	if err != nil {
+		return fmt.Errorf("KMS server can't create key: %s", err)
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	server.RegisterService(&kmsServiceDesc, &kmsService{key: key})
+
+	if err := server.Serve(l); err != nil {
+		return fmt.Errorf("KMS server shut down: %s", err)
+	}
+
+	return nil
+}
+
+type kmsRequest struct {
+	NodeUUID string
+	Data     []byte
+}
+
+func (m *kmsRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.NodeUUID)
+	b = wireAppendBytes(b, 2, m.Data)
+	return b
+}
+
+func (m *kmsRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.NodeUUID = string(v)
+		case 2:
+			m.Data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+}
+
+type kmsResponse struct {
+	Data []byte
+}
+
+func (m *kmsResponse) MarshalWire() []byte {
+	return wireAppendBytes(nil, 1, m.Data)
+}
+
+func (m *kmsResponse) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.Data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+}
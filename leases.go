@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Leases which expired or were released are collected after a grace
+// period, freeing the address and removing the DNS records created from
+// it, e.g. the controlplane registration. The grace period lets a node
+// which was down briefly come back with the same address and names.
+// Pinned leases, e.g. of controlplane nodes, are never collected.
+
+const (
+	leaseGracePeriod = 10 * time.Minute
+	leaseGCInterval  = 30 * time.Second
+)
+
+// releaseLease marks the client's lease as expired, when it gives up its
+// address with a DHCPRELEASE.
+func (s *Server) releaseLease(mac net.HardwareAddr) {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	if record, ok := s.DHCPRecords[s.nodes.identity(mac).String()]; ok {
+		log.Infof("%s released %s", mac, record.IP)
+		record.expires = time.Now()
+		s.leaseChurn.released++
+	}
+}
+
+// dropLeaseLocked frees the address of the lease and forgets it. Must be
+// called with DHCPLock held.
+func (s *Server) dropLeaseLocked(mac string, record *DHCPRecord) {
+	if err := s.allocatorOf(record).Free(net.IPNet{IP: record.IP}); err != nil {
+		log.Errorf("Could not free %s: %s", record.IP, err)
+	}
+	delete(s.DHCPRecords, mac)
+
+	if record.pinned {
+		log.Infof("Unpinned %s from %s", record.IP, mac)
+		s.savePinsLocked()
+	}
+}
+
+// expireLeases removes the leases expired for longer than the grace
+// period.
+func (s *Server) expireLeases(now time.Time) {
+	s.collectExpiredLeases(now, s.LeaseGracePeriod)
+}
+
+// collectExpiredLeases removes the leases expired for longer than grace,
+// returning how many.
+func (s *Server) collectExpiredLeases(now time.Time, grace time.Duration) int {
+	var expired []net.IP
+
+	s.DHCPLock.Lock()
+	for mac, record := range s.DHCPRecords {
+		if record.pinned || now.Sub(record.expires) < grace {
+			continue
+		}
+
+		s.dropLeaseLocked(mac, record)
+		leasesExpired.Inc()
+		s.leaseChurn.expired++
+
+		log.Infof("Lease of %s for %s expired", record.IP, mac)
+		expired = append(expired, record.IP)
+	}
+	if len(expired) > 0 {
+		s.checkPoolAlert(false)
+	}
+	s.DHCPLock.Unlock()
+
+	for _, ip := range expired {
+		if names := s.DNSRecords.RemoveIP(ip); len(names) > 0 {
+			log.Infof("Removed %s from DNS names %v", ip, names)
+		}
+	}
+	return len(expired)
+}
+
+// collectLeases expires leases periodically. It never returns.
+func (s *Server) collectLeases() {
+	for now := range time.Tick(leaseGCInterval) {
+		s.expireLeases(now)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Appliances serving for months accumulate churn: `talos-pxe leases stats`
+// reports the leases granted, renewed, released and collected since the
+// start, how fragmented the free addresses of the pool are and the
+// longest-lived leases. `talos-pxe leases compact` collects the expired
+// leases on demand instead of waiting for the collector, all of them with
+// --now regardless of the grace period, giving their addresses back to the
+// pool, and rewrites the pinned leases file without the stale entries.
+
+// How many of the longest-lived leases are reported.
+const leaseStatsOldest = 5
+
+// leaseChurn counts the lease changes since the start. Guarded by
+// DHCPLock.
+type leaseChurn struct {
+	since    time.Time
+	granted  int
+	renewed  int
+	released int
+	expired  int
+}
+
+// LeaseAge is a lease and when it was granted.
+type LeaseAge struct {
+	MAC     string    `json:"mac"`
+	IP      string    `json:"ip"`
+	Granted time.Time `json:"granted"`
+}
+
+type LeaseStats struct {
+	Since    time.Time `json:"since"`
+	Granted  int       `json:"granted"`
+	Renewed  int       `json:"renewed"`
+	Released int       `json:"released"`
+	// Expired counts the expired and released leases collected.
+	Expired int `json:"expired"`
+
+	Leases      int `json:"leases"`
+	Active      int `json:"active"`
+	Pinned      int `json:"pinned"`
+	Quarantined int `json:"quarantined"`
+
+	Pool   *poolStats `json:"pool,omitempty"`
+	Oldest []LeaseAge `json:"oldest"`
+}
+
+// LeaseCompaction counts what compacting the leases dropped.
+type LeaseCompaction struct {
+	Collected int `json:"collected"`
+	Pins      int `json:"pins"`
+	StalePins int `json:"stale_pins"`
+}
+
+func (s *Server) leaseStats() LeaseStats {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	now := time.Now()
+	stats := LeaseStats{
+		Since:    s.leaseChurn.since.UTC().Round(time.Second),
+		Granted:  s.leaseChurn.granted,
+		Renewed:  s.leaseChurn.renewed,
+		Released: s.leaseChurn.released,
+		Expired:  s.leaseChurn.expired,
+		Leases:   len(s.DHCPRecords),
+		Pool:     s.poolStatsLocked(),
+		Oldest:   []LeaseAge{},
+	}
+	for mac, record := range s.DHCPRecords {
+		if record.pinned || record.expires.After(now) {
+			stats.Active++
+		}
+		if record.pinned {
+			stats.Pinned++
+		}
+		if record.quarantined {
+			stats.Quarantined++
+		}
+		stats.Oldest = append(stats.Oldest, LeaseAge{MAC: mac, IP: record.IP.String(), Granted: record.granted.UTC().Round(time.Second)})
+	}
+	sort.Slice(stats.Oldest, func(i, j int) bool { return stats.Oldest[i].Granted.Before(stats.Oldest[j].Granted) })
+	if len(stats.Oldest) > leaseStatsOldest {
+		stats.Oldest = stats.Oldest[:leaseStatsOldest]
+	}
+	return stats
+}
+
+// compactLeases collects the leases expired for longer than the grace
+// period, or all the expired ones if now, and rewrites the pinned leases.
+func (s *Server) compactLeases(actor string, now bool) (LeaseCompaction, error) {
+	if s.ProxyDHCP || s.Observe {
+		return LeaseCompaction{}, fmt.Errorf("Not leasing addresses")
+	}
+
+	grace := s.LeaseGracePeriod
+	if now {
+		grace = 0
+	}
+	compaction := LeaseCompaction{Collected: s.collectExpiredLeases(time.Now(), grace)}
+
+	saved := make(map[string]string)
+	if data, err := ioutil.ReadFile(s.pinsPath()); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Warnf("Replacing corrupt pinned leases %s: %s", s.pinsPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return compaction, err
+	}
+
+	s.DHCPLock.Lock()
+	for mac, ip := range saved {
+		if record, ok := s.DHCPRecords[mac]; !ok || !record.pinned || record.IP.String() != ip {
+			compaction.StalePins++
+		}
+	}
+	for _, record := range s.DHCPRecords {
+		if record.pinned {
+			compaction.Pins++
+		}
+	}
+	s.savePinsLocked()
+	s.DHCPLock.Unlock()
+
+	log.Infof("Leases compacted by %s, collected %d expired leases and dropped %d stale pinned leases", actor, compaction.Collected, compaction.StalePins)
+	s.audit.record(actor, "leases.compact", "", fmt.Sprintf("collected %d, stale pins %d", compaction.Collected, compaction.StalePins))
+	return compaction, nil
+}
+
+func (s *Server) leaseStatsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.leaseStats())
+}
+
+// leaseCompactHandler compacts the leases on POST, all the expired ones
+// with now=true.
+func (s *Server) leaseCompactHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := false
+	if value := req.FormValue("now"); value != "" {
+		var err error
+		if now, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid now %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	compaction, err := s.compactLeases(requestActor(req), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, compaction)
+}
+
+// runLeases reports the lease stats of a running server and compacts its
+// leases.
+func runLeases(args []string) error {
+	flags := flag.NewFlagSet("leases", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	nowFlag := flags.Bool("now", false, "Collect all expired leases, not only those past the grace period, with compact")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s leases stats|compact [flags]", os.Args[0])
+	if flags.NArg() != 1 {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch flags.Arg(0) {
+	case "stats":
+		stats, err := client.GetLeaseStats()
+		if err != nil {
+			return err
+		}
+		printLeaseStats(stats)
+	case "compact":
+		compaction, err := client.CompactLeases(*nowFlag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Collected %d expired leases\n", compaction.Collected)
+		fmt.Printf("Kept %d pinned leases, dropped %d stale ones\n", compaction.Pins, compaction.StalePins)
+	default:
+		return usage
+	}
+	return nil
+}
+
+func printLeaseStats(stats LeaseStats) {
+	fmt.Printf("Since %s: %d granted, %d renewed, %d released, %d expired\n", stats.Since.Local().Format(time.RFC1123), stats.Granted, stats.Renewed, stats.Released, stats.Expired)
+	fmt.Printf("Leases: %d, %d active, %d pinned, %d quarantined\n", stats.Leases, stats.Active, stats.Pinned, stats.Quarantined)
+	if p := stats.Pool; p != nil {
+		fmt.Printf("Pool %s - %s: %d of %d used (%.0f%%)\n", p.Start, p.End, p.Used, p.Total, p.Utilization*100)
+		fmt.Printf("Free: %d in %d blocks, largest %d, %.0f%% fragmented\n", p.Free, p.FreeBlocks, p.LargestFreeBlock, p.Fragmentation*100)
+	}
+	if len(stats.Oldest) > 0 {
+		fmt.Println("Longest-lived leases:")
+		for _, lease := range stats.Oldest {
+			fmt.Printf("  %s\t%s\t%s\n", lease.MAC, lease.IP, time.Since(lease.Granted).Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// With --lldp the server listens for the LLDP frames on the interface and
+// records the switch and port every MAC announced it's cabled to, which
+// answers which cable a node is on, see switchports.go. Switches don't
+// forward LLDP, so this only sees the nodes whose frames reach the server,
+// e.g. through Linux bridges, virtual switches or port mirrors, or which
+// run an LLDP agent relaying them.
+
+// The nearest bridge group address LLDP is sent to.
+var lldpMulticast = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// lldpFilter accepts LLDP frames.
+var lldpFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 12, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(layers.EthernetTypeLinkLayerDiscovery), SkipTrue: 1},
+	bpf.RetConstant{Val: pcapSnapLen},
+	bpf.RetConstant{Val: 0},
+}
+
+// lldpID formats the chassis or port ID by its subtype.
+func lldpID(id []byte, mac, network bool) string {
+	switch {
+	case mac && len(id) == 6:
+		return net.HardwareAddr(id).String()
+	case network && len(id) == 5 && id[0] == 1:
+		// IANA address family 1 is IPv4.
+		return net.IP(id[1:]).String()
+	}
+	return string(id)
+}
+
+// packetMreq is struct packet_mreq of linux/if_packet.h.
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+// joinLLDPMulticast makes the interface receive the LLDP multicast for as
+// long as the returned socket is open.
+func joinLLDPMulticast(intf *net.Interface) (io.Closer, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	mreq := packetMreq{ifindex: int32(intf.Index), typ: syscall.PACKET_MR_MULTICAST, alen: uint16(len(lldpMulticast))}
+	copy(mreq.address[:], lldpMulticast)
+	b := (*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))[:]
+	if err := syscall.SetsockoptString(fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(b)); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return closerFunc(func() { syscall.Close(fd) }), nil
+}
+
+// openLLDP starts listening for LLDP frames on the serving interface.
+func (s *Server) openLLDP() (io.Closer, func() error, error) {
+	intf, err := net.InterfaceByName(s.Intf)
+	if err != nil {
+		return nil, nil, err
+	}
+	membership, err := joinLLDPMulticast(intf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not receive LLDP on %s: %s", s.Intf, err)
+	}
+
+	handle, err := pcapgo.NewEthernetHandle(s.Intf)
+	if err != nil {
+		membership.Close()
+		return nil, nil, fmt.Errorf("Could not capture on %s: %s", s.Intf, err)
+	}
+	filter, err := bpf.Assemble(lldpFilter)
+	if err == nil {
+		err = handle.SetBPF(filter)
+	}
+	if err != nil {
+		handle.Close()
+		membership.Close()
+		return nil, nil, err
+	}
+
+	closer := closerFunc(func() {
+		handle.Close()
+		membership.Close()
+	})
+	return closer, func() error { return s.listenLLDP(handle) }, nil
+}
+
+// listenLLDP records the ports from the frames until the handle is
+// closed.
+func (s *Server) listenLLDP(handle *pcapgo.EthernetHandle) error {
+	for {
+		data, _, err := handle.ReadPacketData()
+		if err != nil {
+			return fmt.Errorf("LLDP listener stopped: %s", err)
+		}
+
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+		eth, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		lldp, _ := packet.Layer(layers.LayerTypeLinkLayerDiscovery).(*layers.LinkLayerDiscovery)
+		if eth == nil || lldp == nil {
+			continue
+		}
+
+		port := SwitchPort{
+			ChassisID: lldpID(lldp.ChassisID.ID, lldp.ChassisID.Subtype == layers.LLDPChassisIDSubTypeMACAddr, lldp.ChassisID.Subtype == layers.LLDPChassisIDSubTypeNetworkAddr),
+			PortID:    lldpID(lldp.PortID.ID, lldp.PortID.Subtype == layers.LLDPPortIDSubtypeMACAddr, lldp.PortID.Subtype == layers.LLDPPortIDSubtypeNetworkAddr),
+			Seen:      time.Now(),
+		}
+		if info, ok := packet.Layer(layers.LayerTypeLinkLayerDiscoveryInfo).(*layers.LinkLayerDiscoveryInfo); ok {
+			port.PortDescription = info.PortDescription
+			port.SystemName = info.SysName
+		}
+		s.switchPortSeen("lldp", eth.SrcMAC, port)
+	}
+}
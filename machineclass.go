@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/poseidon/matchbox/matchbox/storage"
+	"github.com/poseidon/matchbox/matchbox/storage/storagepb"
+)
+
+// Machine classes sort the machines by their hardware, the model iPXE
+// passes and what the nodes reported to the inventory, like the server
+// classes of Sidero. The first class matching a machine decides the role
+// it boots into, the profile it boots, and the labels and kernel
+// arguments it gets. Its requests carry the class=<name> selector, so
+// that groups can pick profiles for the class themselves as well.
+
+const machineClassLabel = "class"
+
+// MachineMatch matches machines by any combination of their attributes.
+// Manufacturer and Product are globs matched ignoring case. The rest
+// only match machines which reported their hardware.
+type MachineMatch struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	MinCPUs      int    `json:"minCPUs,omitempty"`
+	MinMemoryGiB int    `json:"minMemoryGiB,omitempty"`
+	MinDisks     int    `json:"minDisks,omitempty"`
+	MaxDisks     int    `json:"maxDisks,omitempty"`
+	GPU          *bool  `json:"gpu,omitempty"`
+}
+
+// A MachineClass applies to the machines matching Match. Role replaces
+// the role chosen in the menu, and Profile is booted instead of the
+// profile of the role.
+type MachineClass struct {
+	Name       string            `json:"name"`
+	Match      MachineMatch      `json:"match"`
+	Role       string            `json:"role,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	KernelArgs []string          `json:"kernelArgs,omitempty"`
+	// InstallDisk picks the install disk instead of the global policy.
+	InstallDisk *InstallDiskPolicy `json:"installDisk,omitempty"`
+}
+
+var machineRoles = map[string]bool{"init": true, "controlplane": true, "worker": true}
+
+func (c *MachineClass) check() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if c.Role != "" && !machineRoles[c.Role] {
+		return fmt.Errorf("unknown role %s", c.Role)
+	}
+	for _, pattern := range []string{c.Match.Manufacturer, c.Match.Product} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+	}
+	if c.Match.MaxDisks > 0 && c.Match.MaxDisks < c.Match.MinDisks {
+		return fmt.Errorf("maxDisks is below minDisks")
+	}
+	if c.InstallDisk != nil {
+		if err := c.InstallDisk.check(); err != nil {
+			return fmt.Errorf("install disk: %s", err)
+		}
+	}
+	for key := range c.Labels {
+		if ipxeMenuSelectors[key] || key == machineClassLabel || key == nodePoolLabel {
+			return fmt.Errorf("label %s is set by the menu", key)
+		}
+	}
+	return nil
+}
+
+// needsHardware tells if the match goes by the reported hardware.
+func (m *MachineMatch) needsHardware() bool {
+	return m.MinCPUs > 0 || m.MinMemoryGiB > 0 || m.MinDisks > 0 || m.MaxDisks > 0 || m.GPU != nil
+}
+
+func (m *MachineMatch) matches(manufacturer, product string, hw *Hardware) bool {
+	for _, p := range [][2]string{{m.Manufacturer, manufacturer}, {m.Product, product}} {
+		if p[0] == "" {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(p[0]), strings.ToLower(strings.TrimSpace(p[1]))); !ok {
+			return false
+		}
+	}
+	if !m.needsHardware() {
+		return true
+	}
+	if hw == nil {
+		return false
+	}
+
+	if hw.CPUs < m.MinCPUs || hw.MemoryBytes < uint64(m.MinMemoryGiB)<<30 || len(hw.Disks) < m.MinDisks {
+		return false
+	}
+	if m.MaxDisks > 0 && len(hw.Disks) > m.MaxDisks {
+		return false
+	}
+	if m.GPU != nil && *m.GPU != (hw.labels()["gpu"] != "") {
+		return false
+	}
+	return true
+}
+
+// machineClass returns the class of the machine requesting the query, or
+// nil if none matches.
+func (s *Server) machineClass(query url.Values) *MachineClass {
+	if s.Config == nil || len(s.Config.MachineClasses) == 0 {
+		return nil
+	}
+
+	manufacturer, product := query.Get("manufacturer"), query.Get("product")
+	var hw *Hardware
+	if mac, err := net.ParseMAC(query.Get("mac")); err == nil {
+		if node, ok := s.nodes.get(mac.String()); ok {
+			hw = node.Hardware
+			if manufacturer == "" && product == "" {
+				manufacturer, product = node.Manufacturer, node.Product
+			}
+		}
+	}
+	if hw != nil && manufacturer == "" && product == "" {
+		manufacturer, product = hw.Manufacturer, hw.Product
+	}
+
+	for i := range s.Config.MachineClasses {
+		if c := &s.Config.MachineClasses[i]; c.Match.matches(manufacturer, product, hw) {
+			return c
+		}
+	}
+	return nil
+}
+
+// machineClassRequest adds the class of the machine and its labels to
+// the selectors of the request, and chains into the role of the class,
+// if the request chains into a role.
+func (s *Server) machineClassRequest(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	if query.Get("type") == "" || query.Get(machineClassLabel) != "" {
+		return req
+	}
+	class := s.machineClass(query)
+	if class == nil {
+		return req
+	}
+
+	query.Set(machineClassLabel, class.Name)
+	for key, value := range class.Labels {
+		if _, ok := query[key]; !ok {
+			query.Set(key, value)
+		}
+	}
+	if class.Role != "" && class.Role != query.Get("type") {
+		log.Infof("Booting %s as %s instead of %s, it's of machine class %s", query.Get("mac"), class.Role, query.Get("type"), class.Name)
+		query.Set("type", class.Role)
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
+
+// withClassKernelArgs appends the kernel arguments of the machine class
+// to the kernel command line of the boot script.
+func (s *Server) withClassKernelArgs(script []byte, query url.Values) []byte {
+	if s.Config == nil || query.Get(machineClassLabel) == "" {
+		return script
+	}
+	var class *MachineClass
+	for i := range s.Config.MachineClasses {
+		if s.Config.MachineClasses[i].Name == query.Get(machineClassLabel) {
+			class = &s.Config.MachineClasses[i]
+		}
+	}
+	if class == nil || len(class.KernelArgs) == 0 {
+		return script
+	}
+
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "kernel ") {
+			lines[i] = strings.TrimRight(line, " \r") + " " + strings.Join(class.KernelArgs, " ")
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// classStore adds a group for every role of the machine classes with a
+// profile, selecting the class and the role, so that it's picked over
+// the groups of the role alone.
+type classStore struct {
+	storage.Store
+	classes []MachineClass
+}
+
+func (s *Server) withMachineClasses(store storage.Store) storage.Store {
+	if s.Config == nil || len(s.Config.MachineClasses) == 0 {
+		return store
+	}
+	return &classStore{Store: store, classes: s.Config.MachineClasses}
+}
+
+func (st *classStore) groups() []*storagepb.Group {
+	var groups []*storagepb.Group
+	for _, class := range st.classes {
+		if class.Profile == "" {
+			continue
+		}
+		for role := range machineRoles {
+			if class.Role != "" && role != class.Role {
+				continue
+			}
+			groups = append(groups, &storagepb.Group{
+				Id:       "class-" + class.Name + "-" + role,
+				Name:     "Machine class " + class.Name + " " + role,
+				Profile:  class.Profile,
+				Selector: map[string]string{machineClassLabel: class.Name, "type": role},
+			})
+		}
+	}
+	return groups
+}
+
+func (st *classStore) GroupGet(id string) (*storagepb.Group, error) {
+	for _, group := range st.groups() {
+		if group.Id == id {
+			return group, nil
+		}
+	}
+	return st.Store.GroupGet(id)
+}
+
+func (st *classStore) GroupList() ([]*storagepb.Group, error) {
+	groups, err := st.Store.GroupList()
+	if err != nil {
+		return nil, err
+	}
+	return append(groups, st.groups()...), nil
+}
+
+// checkMachineClassProfiles checks that the profiles of the machine
+// classes exist.
+func (s *Server) checkMachineClassProfiles(store storage.Store) error {
+	if s.Config == nil {
+		return nil
+	}
+	for _, class := range s.Config.MachineClasses {
+		if class.Profile == "" {
+			continue
+		}
+		if _, err := store.ProfileGet(class.Profile); err != nil {
+			return fmt.Errorf("Machine class %s: no profile %s: %s", class.Name, class.Profile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ajeddeloh/yaml"
+)
+
+// A machineConfigPatch modifies a decoded Talos machine config.
+type machineConfigPatch func(cfg map[interface{}]interface{}) error
+
+// machineConfigPatches returns the patches which have to be applied to
+// every served machine config for it to use the services we provide.
+func (s *Server) machineConfigPatches() []machineConfigPatch {
+	var patches []machineConfigPatch
+
+	if s.Discovery {
+		endpoint := fmt.Sprintf("http://%s:%d/", s.advertisedIP(), s.DiscoveryPort)
+		patches = append(patches, func(cfg map[interface{}]interface{}) error {
+			if err := setConfigValue(cfg, "cluster.discovery.enabled", true); err != nil {
+				return err
+			}
+			return setConfigValue(cfg, "cluster.discovery.registries.service.endpoint", endpoint)
+		})
+	}
+
+	if s.ControlplaneVIP != nil {
+		patches = append(patches, s.controlplaneVIPPatch)
+	}
+
+	if s.HTTPProxy {
+		patches = append(patches, s.httpProxyPatch)
+	}
+
+	return patches
+}
+
+// controlplaneVIPPatch points the nodes at the controlplane VIP, and has
+// the controlplane nodes share it.
+func (s *Server) controlplaneVIPPatch(cfg map[interface{}]interface{}) error {
+	endpoint := fmt.Sprintf("https://%s:6443", s.ControlplaneVIP)
+	if err := setConfigValue(cfg, "cluster.controlPlane.endpoint", endpoint); err != nil {
+		return err
+	}
+
+	machine, _ := cfg["machine"].(map[interface{}]interface{})
+	if machine == nil || (machine["type"] != "controlplane" && machine["type"] != "init") {
+		return nil
+	}
+
+	network, _ := machine["network"].(map[interface{}]interface{})
+	var interfaces []interface{}
+	if network != nil {
+		interfaces, _ = network["interfaces"].([]interface{})
+	}
+
+	vip := map[interface{}]interface{}{"ip": s.ControlplaneVIP.String()}
+	for _, ifc := range interfaces {
+		if m, ok := ifc.(map[interface{}]interface{}); ok && m["interface"] == s.ControlplaneVIPInterface {
+			m["vip"] = vip
+			return nil
+		}
+	}
+
+	interfaces = append(interfaces, map[interface{}]interface{}{
+		"interface": s.ControlplaneVIPInterface,
+		"dhcp":      true,
+		"vip":       vip,
+	})
+	return setConfigValue(cfg, "machine.network.interfaces", interfaces)
+}
+
+// nodePatched tells whether the machine configs served to the client are
+// patched for it alone, with its install disk or static network config.
+func (s *Server) nodePatched(mac net.HardwareAddr) bool {
+	if mac == nil {
+		return false
+	}
+	return s.installDiskPolicy(mac) != nil || s.networkConfigPatch(mac) != nil
+}
+
+func isMachineConfigPath(name string) bool {
+	return strings.HasPrefix(name, "/assets/") && (strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml"))
+}
+
+// machineConfigHandler serves the Talos machine configs from the assets
+// directory, applying machineConfigPatches on the way out, and setting the
+// installer image of the version nodes pinned to one pass, and the
+// install disk and static network config of the requesting node.
+// Everything else is passed to the next handler.
+func (s *Server) machineConfigHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		patches := s.machineConfigPatches()
+		static := false
+		if version := req.URL.Query().Get(talosVersionParam); talosVersionRegexp.MatchString(version) {
+			patches = append(patches, s.installerImagePatch(version))
+		}
+		if isMachineConfigPath(name) {
+			mac := s.clientMAC(req)
+			patch, err := s.installDiskPatch(mac)
+			if err != nil {
+				if !isConfigRender(req) {
+					log.Warnf("Refusing %s to %s: %s", name, mac, err)
+					s.sessions.failed(mac, err)
+				}
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			if patch != nil {
+				patches = append(patches, patch)
+			}
+			if patch := s.networkConfigPatch(mac); patch != nil {
+				patches = append(patches, patch)
+				static = true
+			}
+		}
+		if !isMachineConfigPath(name) || len(patches) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.ServerRoot, filepath.FromSlash(name)))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+
+		data, err = patchMachineConfig(data, patches)
+		if err != nil {
+			log.Errorf("Failed to patch machine config %s: %s", name, err)
+			http.Error(w, "failed to patch machine config", http.StatusInternalServerError)
+			return
+		}
+
+		if !isConfigRender(req) {
+			log.Infof("Serving patched machine config %s to %s", name, req.RemoteAddr)
+			// The node keeps the address after it stops asking for
+			// it, so it can't be leased out again.
+			if static {
+				s.pinLease(s.clientMAC(req), "node with a static network config")
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// v1alpha1Document decodes the v1alpha1 document of the machine config,
+// the first one with a version, or the only one, returning its index.
+func v1alpha1Document(docs [][]byte) (int, map[interface{}]interface{}, error) {
+	for i, doc := range docs {
+		cfg := make(map[interface{}]interface{})
+		if err := yaml.Unmarshal(doc, &cfg); err != nil {
+			return 0, nil, fmt.Errorf("Document %d: %s", i+1, err)
+		}
+		if _, ok := cfg["version"]; ok || len(docs) == 1 {
+			return i, cfg, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("No v1alpha1 document in the machine config")
+}
+
+// patchMachineConfig applies the patches to the v1alpha1 document of the
+// machine config, keeping the other documents as they are.
+func patchMachineConfig(data []byte, patches []machineConfigPatch) ([]byte, error) {
+	docs := splitConfigDocuments(data)
+	i, cfg, err := v1alpha1Document(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, patch := range patches {
+		if err := patch(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if docs[i], err = yaml.Marshal(cfg); err != nil {
+		return nil, err
+	}
+
+	for i, doc := range docs {
+		if len(doc) > 0 && doc[len(doc)-1] != '\n' {
+			docs[i] = append(doc, '\n')
+		}
+	}
+	return bytes.Join(docs, []byte("---\n")), nil
+}
+
+// machineConfigSecrets are the keys of the v1alpha1 document holding the
+// secrets of the machine and the cluster.
+var machineConfigSecrets = []string{
+	"machine.token",
+	"machine.ca.key",
+	"cluster.token",
+	"cluster.secret",
+	"cluster.aescbcEncryptionSecret",
+	"cluster.secretboxEncryptionSecret",
+	"cluster.ca.key",
+	"cluster.aggregatorCA.key",
+	"cluster.serviceAccount.key",
+	"cluster.etcd.ca.key",
+}
+
+// redactedValue replaces the secrets of redacted machine configs.
+const redactedValue = "<redacted>"
+
+// redactMachineConfig replaces the secrets of the machine config, for
+// showing it to who isn't allowed to see them.
+func redactMachineConfig(data []byte) ([]byte, error) {
+	return patchMachineConfig(data, []machineConfigPatch{func(cfg map[interface{}]interface{}) error {
+		for _, key := range machineConfigSecrets {
+			if value, ok := getConfigValue(cfg, key); ok && value != nil && value != "" {
+				if err := setConfigValue(cfg, key, redactedValue); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}})
+}
+
+// setConfigValue sets the value at the dotted key path, creating any
+// missing intermediate maps.
+func setConfigValue(cfg map[interface{}]interface{}, key string, value interface{}) error {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := cfg[part]
+		if !ok || next == nil {
+			next = make(map[interface{}]interface{})
+			cfg[part] = next
+		}
+
+		m, ok := next.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("Config key %s in %s is not a map", part, key)
+		}
+		cfg = m
+	}
+
+	cfg[parts[len(parts)-1]] = value
+	return nil
+}
+
+// getConfigValue returns the value at the dotted key path.
+func getConfigValue(cfg map[interface{}]interface{}, key string) (interface{}, bool) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		m, ok := cfg[part].(map[interface{}]interface{})
+		if !ok {
+			return nil, false
+		}
+		cfg = m
+	}
+
+	value, ok := cfg[parts[len(parts)-1]]
+	return value, ok
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -32,17 +32,27 @@ import (
 var log = logrus.New()
 
 const (
-	portDNS    = 53
-	portDHCP   = 67
-	portTFTP   = 69
-	portHTTP   = 8080
-	portPXE    = 4011
-	forwardDns = "1.1.1.1:53"
+	portDNS        = 53
+	portDHCP       = 67
+	portDHCPClient = 68
+	portTFTP       = 69
+	portHTTP       = 8080
+	portHTTPS      = 8443
+	portPXE        = 4011
+	portDiscovery  = 3000
+	portKMS        = 4050
+	forwardDns     = "1.1.1.1:53"
 )
 
 type DHCPRecord struct {
 	IP net.IP
 	expires time.Time
+	// When the address was leased, for the lease stats.
+	granted time.Time
+	// Leased from the quarantine range.
+	quarantined bool
+	// Pinned to a controlplane node, never expires.
+	pinned bool
 }
 
 // A Server boots machines using a Booter.
@@ -51,48 +61,339 @@ type Server struct {
 
 	IP net.IP
 	GWIP net.IP
+	// AdvertiseIP and AdvertiseHTTPPort are where clients reach the
+	// server, if not on IP and HTTPPort, see advertise.go.
+	AdvertiseIP net.IP
+	AdvertiseHTTPPort int
 
 	Net *net.IPNet
 
 	ForwardDns []string
+	// DNSSEC validates the forwarded answers.
+	DNSSEC bool
+	// ServiceDomain is the domain the services of the server are
+	// published under, see servicediscovery.go.
+	ServiceDomain  string
+	serviceRecords serviceRecords
+	// Domain is the cluster domain the DNS server answers for, which the
+	// leases carry with DomainSearch, see domain.go.
+	Domain       string
+	DomainSearch []string
 
 	Intf string
 
 	Controlplane string
+	// ControlplaneVIP is shared by the controlplane nodes on the
+	// ControlplaneVIPInterface, and what the controlplane name resolves to.
+	ControlplaneVIP net.IP
+	ControlplaneVIPInterface string
+	// ControlplaneAnswers orders the addresses the controlplane name
+	// resolves to, changed at runtime, see answerorder.go.
+	ControlplaneAnswers AnswerPolicy
+	answerOrder answerOrder
 
 	ProxyDHCP bool
 
+	// Protocol servers which shouldn't be run, e.g. because the host
+	// already runs another server for them.
+	DisableDHCP bool
+	DisableDNS  bool
+	DisableTFTP bool
+	DisablePXE  bool
+	DisableHTTP bool
+
+	// Discovery enables the embedded Talos discovery service.
+	Discovery bool
+
+	// KMS enables the Talos KMS endpoint for disk encryption keys.
+	KMS bool
+
+	// HTTPProxy enables the HTTP proxy for the nodes, only connecting to
+	// the hosts in HTTPProxyAllow.
+	HTTPProxy      bool
+	HTTPProxyAllow []string
+
+	// SecretsDir holds the encrypted secrets store, defaults to
+	// ServerRoot/secrets.
+	SecretsDir  string
+	secretsLock sync.Mutex
+	secrets     *secretsStore
+
+	templateVars *templateVars
+
+	// ConfigTokens has the config URLs in the boot scripts carry a token
+	// good for one fetch by the node within ConfigTokenTTL.
+	ConfigTokens   bool
+	ConfigTokenTTL time.Duration
+	configTokens   *configTokens
+
+	// Observe only watches the boot traffic on Intf, serving nothing.
+	Observe bool
+
+	// Chaos injects the failures of the chaos section of the config, see
+	// chaos.go.
+	Chaos bool
+
+	// Freeze provisions nothing, booting the nodes from their disks, see
+	// freeze.go.
+	Freeze bool
+	// The provisioning window open while frozen, see provisioning.go.
+	provisioning provisioningState
+
+	// PinsFile keeps the leases pinned to controlplane nodes, defaults
+	// to ServerRoot/pins.json.
+	PinsFile string
+
+	// ImportState is a state snapshot imported on startup.
+	ImportState string
+
+	// OTLPEndpoint is the OTLP/HTTP collector boot sessions are traced
+	// to, tracing is disabled if empty.
+	OTLPEndpoint string
+	tracer       *tracer
+
+	// What the admin API reports on, see activity.go.
+	sessions *bootSessions
+	errorLog *errorLog
+
+	nodes *nodeInventory
+	audit auditLog
+
+	quarantine *quarantine
+	// The ranges carved out of the provisioning range, see
+	// addressrange.go.
+	addressRanges []*addressRange
+	roleRanges    map[string]*addressRange
+	pools nodePools
+
+	// AdminAddr is the address serving pprof, expvar and the admin API,
+	// disabled if empty. Only loopback addresses without access control,
+	// and others over TLS with it.
+	AdminAddr string
+
+	// ManagementAddr is the address serving the gRPC management API,
+	// disabled if empty, like AdminAddr.
+	ManagementAddr string
+
+	// PowerCycleCommand is run through sh to power cycle a node, with the
+	// node in NODE_ environment variables.
+	PowerCycleCommand string
+	// PowerStatusCommand is run through sh to tell whether a node is
+	// powered off, printing "off", with the node in NODE_ environment
+	// variables.
+	PowerStatusCommand string
+
+	// LocateCommand is run through sh to find the switch port of the
+	// MAC in NODE_MAC, instead of asking the switches of the config.
+	LocateCommand string
+
+	// Talosconfig authenticates upgrades through the Talos API of the
+	// nodes. InstallerImage is the repository of the installer images
+	// upgrades install, tagged with the version.
+	Talosconfig string
+	talosTLS *tls.Config
+	// NodeHealthInterval is how often the Talos API of the nodes is
+	// checked, see nodehealth.go.
+	NodeHealthInterval time.Duration
+	nodeHealth nodeHealth
+	// EtcdCleanupAfter is how long a controlplane node stays unreachable
+	// before its removal from etcd is suggested, see etcdcleanup.go.
+	EtcdCleanupAfter time.Duration
+	etcdCleanups etcdCleanups
+	backups backups
+	InstallerImage string
+	UpgradeNodeTimeout time.Duration
+	upgrades upgradeState
+
+	// Runs of the scheduled jobs, see jobs.go.
+	jobs jobRuns
+
+	// Hooks of the config, see hooks.go.
+	hooks *hookRunner
+
+	canary canaryState
+
+	// Paused DHCP and ProxyDHCP answering, see dhcppause.go.
+	dhcpPause dhcpPause
+
+	// Config is loaded from the file given with --config.
+	Config *Config
+
+	// PXEMenu makes PXE firmware show a boot menu, offering to boot
+	// from the local disk instead, for PXEMenuTimeout.
+	PXEMenu bool
+	PXEMenuTimeout time.Duration
+
+	// How often machines are told to retry choosing a role matchbox has
+	// no profile for, and how long they first wait, doubled every attempt.
+	ConfigRetryAttempts int
+	ConfigRetryDelay time.Duration
+
+	// Whether machine configs are checked against the schema, invalid
+	// ones not being served.
+	ValidateConfigs bool
+
+	// Concurrent TFTP transfers, and how long a transfer waits for the
+	// client before retransmitting.
+	TFTPMaxTransfers int
+	TFTPTimeout time.Duration
+	tftpSlots chan struct{}
+
+	// Renders of templates and configs at a time, and for every client,
+	// 0 for no limit per client.
+	RenderWorkers int
+	RenderClientLimit int
+	renderLimiter *renderLimiter
+
+	// Gratuitous ARP announcements of the server address once it's
+	// claimed, and whether the leased addresses are announced after
+	// their ACKs, see garp.go.
+	GratuitousARP int
+	GratuitousARPLeases bool
+
+	// Packets per second accepted from every client by DHCP and DNS, 0
+	// for no limit.
+	DHCPRateLimit float64
+	DNSRateLimit float64
+	bootFiles bootFileCache
+	renderCache *renderCache
+	rendererOnce sync.Once
+	renderer http.Handler
+	configDrifts configDrifts
+	configVersions configVersions
+
+	// CoreURL makes this an edge instance, proxying HTTP to the core
+	// instance at the URL. CoreCA verifies its certificate.
+	CoreURL string
+	CoreCA string
+	// EdgeSecretFile holds the secret shared by the edges and the core,
+	// see edge.go.
+	EdgeSecretFile string
+	edgeSecret []byte
+	coreProxy http.Handler
+
+	// routes mount the backends of the routes config in front of
+	// matchbox.
+	routes []httpRoute
+
+	// AssetMirrors serve the same assets, boot image downloads are
+	// spread over them.
+	AssetMirrors []string
+	mirrors []*assetMirror
+
+	// ValidateInstallDisk refuses machine configs with an install disk
+	// the node doesn't have, and nodes which didn't report their disks
+	// boot PreflightProfile first, if set, see installdisk.go.
+	ValidateInstallDisk bool
+	PreflightProfile    string
+
+	// ConsoleVerbosity is how much the iPXE scripts print, see
+	// console.go.
+	ConsoleVerbosity string
+
+	// FallbackMirrors are tried in turn by the boot scripts when
+	// downloading the kernel or initramfs from the server fails.
+	FallbackMirrors []string
+
+	// MulticastTFTP serves the boot images over multicast TFTP on
+	// MulticastTFTPPort as well, to groups from MulticastTFTPGroup,
+	// see mtftp.go.
+	MulticastTFTP      bool
+	MulticastTFTPPort  int
+	MulticastTFTPGroup net.IP
+	mtftp *mtftpServer
+
+	// TLSCert and TLSKey enable serving HTTP over TLS as well.
+	TLSCert string
+	TLSKey string
+
+	// MTLS requires client certificates issued by the CA in CADir, which
+	// defaults to ServerRoot/ca, for the boot scripts and matchbox
+	// configs.
+	MTLS  bool
+	CADir string
+	ca    *certAuthority
+
+	// access requires tokens for the admin and management APIs, set up
+	// from the access config.
+	access *accessControl
+
+	// PcapDir receives rotating dumps of the boot protocol traffic,
+	// disabled if empty.
+	PcapDir string
+
+	// LLDP records the switch ports the nodes announce, see lldp.go.
+	LLDP bool
+	ports switchPorts
+
+	// ContainerNetwork is the Docker or Podman network served, whose
+	// container addresses aren't leased, see containernet.go.
+	ContainerNetwork *containerNetwork
+
 	DHCPLock sync.Mutex
 	DHCPRecords map[string]*DHCPRecord
 	DHCPAllocator allocators.Allocator
-
-	DNSRWLock sync.RWMutex
-	DNSRecordsv4 map[string][]net.IP
-	DNSRecordsv6 map[string][]net.IP
-	DNSRRecords map[string][]string
+	// How long expired and released leases are kept.
+	LeaseGracePeriod time.Duration
+	// Lease churn since the start, see leasestats.go.
+	leaseChurn leaseChurn
+	DHCPRangeStart net.IP
+	DHCPRangeEnd net.IP
+
+	// Alert when this fraction of the DHCP pool is in use, by logging
+	// and posting to PoolAlertWebhook if set.
+	PoolAlertThreshold float64
+	PoolAlertWebhook string
+	poolAlerted bool
+	poolExhausted bool
+
+	DNSRecords *dnsStore
 
 	// These ports can technically be set for testing, but the
 	// protocols burned in firmware on the client side hardcode these,
-	// so if you change them in production, nothing will work.
-	DHCPPort int
-	TFTPPort int
-	PXEPort  int
-	HTTPPort int
-	DNSPort  int
-
-	errs chan error
+	// so if you change them in production, nothing will work. See
+	// ports.go.
+	DHCPPort       int
+	DHCPClientPort int
+	TFTPPort       int
+	PXEPort        int
+	HTTPPort       int
+	HTTPSPort      int
+	DNSPort        int
+	DiscoveryPort  int
+	KMSPort        int
+	HTTPProxyPort  int
+
+	errs       chan error
+	supervisor *supervisor
 }
 
-func (s *Server) Ipxe(classId, classInfo string) ([]byte, error) {
-	var resultBuffer bytes.Buffer
+func (s *Server) Ipxe(mac net.HardwareAddr, classId, classInfo string) ([]byte, error) {
+	if s.quarantine.restricts(mac) {
+		return nil, fmt.Errorf("%s is quarantined", mac)
+	}
+
+	policy := s.bootPolicy(mac, classId, classInfo)
 
 	if strings.Contains(classInfo, "iPXE") {
-		ipxeMenuTemplate.Execute(&resultBuffer, s)
-		return resultBuffer.Bytes(), nil
+		if s.quarantine.holds(mac) {
+			return []byte(quarantineScript), nil
+		}
+		return s.nodeMenu(mac, policy, nil)
+	}
+
+	if quirk := s.nicQuirk(mac, classId, classInfo); quirk != nil {
+		log.Infof("Serving %s to %s (%s)", quirk.Binary, mac, classId)
+		return s.bootFiles.read(filepath.Join(s.ServerRoot, filepath.FromSlash(quirk.Binary)))
+	}
+
+	if policy != nil && policy.Bootfile != "" {
+		log.Infof("Serving %s to %s (%s) by boot policy %s", policy.Bootfile, mac, classId, policy.Name)
+		return s.bootFiles.read(filepath.Join(s.ServerRoot, filepath.FromSlash(policy.Bootfile)))
 	}
 
 	if classId == "PXEClient:Arch:00000:UNDI:002001" || classId == "PXEClient:Arch:00007:UNDI:003001" {
-	    data, err := ioutil.ReadFile(filepath.Join(s.ServerRoot, "ipxe.efi"))
+	    data, err := s.bootFiles.read(filepath.Join(s.ServerRoot, "ipxe.efi"))
 	    if err != nil {
 		return nil, err
 	    }
@@ -108,6 +409,9 @@ func (s *Server) Serve() error {
 	if s.DHCPPort == 0 {
 		s.DHCPPort = portDHCP
 	}
+	if s.DHCPClientPort == 0 {
+		s.DHCPClientPort = portDHCPClient
+	}
 	if s.TFTPPort == 0 {
 		s.TFTPPort = portTFTP
 	}
@@ -117,79 +421,448 @@ func (s *Server) Serve() error {
 	if s.HTTPPort == 0 {
 		s.HTTPPort = portHTTP
 	}
+	if s.HTTPSPort == 0 {
+		s.HTTPSPort = portHTTPS
+	}
 	if s.DNSPort == 0 {
 		s.DNSPort = portDNS
 	}
+	if s.TFTPMaxTransfers == 0 {
+		s.TFTPMaxTransfers = tftpMaxTransfers
+	}
+	if s.TFTPTimeout == 0 {
+		s.TFTPTimeout = tftpTimeout
+	}
+	s.tftpSlots = make(chan struct{}, s.TFTPMaxTransfers)
+	if s.RenderWorkers <= 0 {
+		s.RenderWorkers = renderWorkers
+	}
+	s.renderLimiter = newRenderLimiter(s.RenderWorkers, s.RenderClientLimit)
+	if s.DiscoveryPort == 0 {
+		s.DiscoveryPort = portDiscovery
+	}
+	if s.KMSPort == 0 {
+		s.KMSPort = portKMS
+	}
+	if s.HTTPProxyPort == 0 {
+		s.HTTPProxyPort = portHTTPProxy
+	}
 
 	if len(s.ForwardDns) == 0 {
 		s.ForwardDns = []string{forwardDns}
 	}
 
-	tftp, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.IP, s.TFTPPort))
-	if err != nil {
-		return err
+	if s.Config != nil && s.Config.Access != nil && s.Config.Access.enabled() {
+		var key []byte
+		if s.Config.Access.OIDC != nil {
+			// The tokens of signed in users stay valid across restarts.
+			store, err := s.secretsStore()
+			if err != nil {
+				return err
+			}
+			if key, err = store.GetOrCreate(mintedTokenKeyName, 32); err != nil {
+				return err
+			}
+			log.Infof("Signing users in with %s", s.Config.Access.OIDC.Issuer)
+		}
+		s.access = newAccessControl(s.Config.Access, key)
+		log.Infof("Requiring tokens for the admin and management APIs")
 	}
-	pxe, err := net.ListenPacket("udp4", fmt.Sprintf("%s:%d", s.IP, s.PXEPort))
-	if err != nil {
-		tftp.Close()
+
+	// Without access control the APIs are only protected by being bound
+	// to loopback addresses, and with it, the tokens only cross the
+	// network over TLS.
+	if err := s.checkAPIAddr(s.AdminAddr); err != nil {
+		return fmt.Errorf("Invalid admin address: %s", err)
+	}
+
+	if err := s.checkAPIAddr(s.ManagementAddr); err != nil {
+		return fmt.Errorf("Invalid management address: %s", err)
+	}
+
+	s.sessions.onMilestone = s.observeBootMilestone
+
+	if s.Config != nil && len(s.Config.Export) > 0 {
+		exporter, err := newEventExporter(s.Config.Export)
+		if err != nil {
+			return err
+		}
+		s.audit.exporter = exporter
+		s.sessions.exporter = exporter
+		go exporter.run()
+		log.Infof("Exporting events to %d sinks", len(s.Config.Export))
+	}
+
+	if s.Config != nil && len(s.Config.Hooks) > 0 {
+		s.hooks = newHookRunner(s.Config.Hooks)
+		go s.hooks.run()
+		log.Infof("Running %d hooks", len(s.Config.Hooks))
+	}
+
+	if s.OTLPEndpoint != "" {
+		log.Infof("Tracing boot sessions to %s", s.OTLPEndpoint)
+		s.tracer = newTracer(s.OTLPEndpoint)
+		go s.tracer.run()
+	}
+
+	if s.Config != nil && s.Config.Quarantine != nil {
+		if err := s.setupQuarantine(); err != nil {
+			return err
+		}
+	}
+
+	if s.Config != nil && len(s.Config.NodePools) > 0 {
+		if err := s.setupNodePools(); err != nil {
+			return err
+		}
+	}
+
+	if s.Config != nil && len(s.Config.RoleRanges) > 0 {
+		if err := s.setupRoleRanges(); err != nil {
+			return err
+		}
+	}
+
+	if s.ContainerNetwork != nil && !s.ProxyDHCP {
+		s.reserveContainerAddresses()
+	}
+
+	if s.ControlplaneVIP != nil {
+		// Reserved, so that no node is leased the VIP.
+		if !s.ProxyDHCP && s.Net.Contains(s.ControlplaneVIP) && !reserveAddress(s.allocatorOf(&DHCPRecord{IP: s.ControlplaneVIP}), s.ControlplaneVIP) {
+			log.Warnf("Could not reserve controlplane VIP %s, it may be leased out", s.ControlplaneVIP)
+		}
+		s.registerDNSEntry(s.Controlplane, s.ControlplaneVIP)
+		log.Infof("Controlplane VIP is %s", s.ControlplaneVIP)
+	}
+
+	if !s.ProxyDHCP && !s.Observe {
+		s.leaseChurn.since = time.Now()
+		if err := s.loadPins(); err != nil {
+			return err
+		}
+		go s.collectLeases()
+	}
+
+	if s.ImportState != "" && !s.Observe {
+		if err := s.importStateFile(s.ImportState); err != nil {
+			return err
+		}
+	}
+
+	if s.Config != nil && s.Config.Backup != nil && !s.Observe {
+		if err := s.setupBackups(s.Config.Backup); err != nil {
+			return err
+		}
+		go s.scheduleBackups()
+	}
+
+	if s.Config != nil && s.Config.WireGuard != nil {
+		if err := s.setupWireGuard(); err != nil {
+			return err
+		}
+		go s.monitorWireGuard()
+	}
+
+	if err := s.loadEdgeSecret(); err != nil {
 		return err
 	}
-	http, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.IP, s.HTTPPort))
-	if err != nil {
-		tftp.Close()
-		pxe.Close()
+
+	if s.CoreURL != "" {
+		proxy, err := s.newCoreProxy()
+		if err != nil {
+			return err
+		}
+		s.coreProxy = proxy
+		log.Infof("Running as edge of %s", s.CoreURL)
+	}
+
+	if s.Config != nil && len(s.Config.Routes) > 0 {
+		routes, err := newHTTPRoutes(s.Config.Routes)
+		if err != nil {
+			return err
+		}
+		s.routes = routes
+		for _, r := range routes {
+			log.Infof("Routing %s to %s%s", r.Prefix, r.URL, r.Dir)
+		}
+	}
+
+	if s.ControlplaneAnswers.Order == "" {
+		s.ControlplaneAnswers.Order = answerOrderAddress
+	}
+	if err := s.ControlplaneAnswers.check(); err != nil {
+		return fmt.Errorf("Invalid controlplane answer order: %s", err)
+	}
+	s.answerOrder.set(s.ControlplaneAnswers)
+	if !s.DisableDNS && !s.Observe {
+		go s.probeControlplanes()
+	}
+
+	if len(s.AssetMirrors) > 0 {
+		mirrors, err := newAssetMirrors(s.AssetMirrors)
+		if err != nil {
+			return fmt.Errorf("Invalid asset mirror: %s", err)
+		}
+		s.mirrors = mirrors
+		go s.checkMirrors()
+	}
+
+	if s.ConsoleVerbosity == "" {
+		s.ConsoleVerbosity = ConsoleNormal
+	}
+	if err := checkConsoleVerbosity(s.ConsoleVerbosity); err != nil {
 		return err
 	}
-	dns, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.IP, s.DNSPort))
-	if err != nil {
-		http.Close()
-		tftp.Close()
-		pxe.Close()
+
+	if len(s.FallbackMirrors) > 0 {
+		mirrors, err := checkFallbackMirrors(s.FallbackMirrors)
+		if err != nil {
+			return fmt.Errorf("Invalid fallback mirror: %s", err)
+		}
+		s.FallbackMirrors = mirrors
+	}
+
+	if s.MulticastTFTP {
+		if s.MulticastTFTPPort == 0 {
+			s.MulticastTFTPPort = portMulticastTFTP
+		}
+		if s.MulticastTFTPGroup == nil {
+			s.MulticastTFTPGroup = defaultMulticastTFTPGroup
+		}
+		if group := s.MulticastTFTPGroup.To4(); group == nil || !group.IsMulticast() || group[3] != 0 {
+			return fmt.Errorf("Invalid multicast TFTP group %s, must be the first address of an IPv4 multicast /24", s.MulticastTFTPGroup)
+		}
+		s.mtftp = &mtftpServer{s: s, sessions: make(map[string]*mtftpSession)}
+	}
+
+	if s.Config != nil && s.Config.Canary != nil {
+		s.canary.set(s.Config.Canary)
+		log.Infof("Booting %s as canaries", describeCanary(s.Config.Canary))
+	}
+
+	if err := s.loadTalosCredentials(); err != nil {
 		return err
 	}
+	if s.talosTLS != nil && s.NodeHealthInterval > 0 && !s.Observe {
+		go s.checkNodesHealth()
+	}
+	if !s.Observe {
+		go s.watchEtcdMembers()
+		go s.watchConfigDrift()
+	}
+
+	if s.Config != nil && len(s.Config.Variables) > 0 {
+		s.templateVars = newTemplateVars(s.Config.Variables)
+	}
+
+	if s.MTLS {
+		ca, err := openCA(s.caPath())
+		if err != nil {
+			return err
+		}
+		s.ca = ca
+		// Talos can't authenticate fetching its config.
+		s.ConfigTokens = true
+	}
+
+	if s.ConfigTokens {
+		if s.ConfigTokenTTL == 0 {
+			s.ConfigTokenTTL = configTokenTTL
+		}
+		store, err := s.secretsStore()
+		if err != nil {
+			return err
+		}
+		key, err := store.GetOrCreate(reportTokenKeyName, 32)
+		if err != nil {
+			return err
+		}
+		s.configTokens = newConfigTokens(s.ConfigTokenTTL, key)
+	}
+
+	s.renderCache = newRenderCache(s.ServerRoot)
+
+	// Edges render what the core serves.
+	if !s.Observe && s.coreProxy == nil {
+		if err := s.loadConfigVersions(); err != nil {
+			return err
+		}
+		go s.watchConfigVersions()
+	}
+
+	if s.PreflightProfile != "" && s.coreProxy != nil {
+		return fmt.Errorf("Edges can't boot a preflight profile")
+	}
+	if s.PreflightProfile != "" {
+		if _, err := storage.NewFileStore(&storage.Config{Root: s.ServerRoot}).ProfileGet(s.PreflightProfile); err != nil {
+			return fmt.Errorf("No preflight profile %s: %s", s.PreflightProfile, err)
+		}
+	}
+
+	if s.Chaos {
+		if s.Config == nil || s.Config.Chaos == nil {
+			return fmt.Errorf("Chaos needs a chaos section in the config")
+		}
+		log.Warnf("Chaos: injecting failures, don't use in production")
+	}
+
+	if s.Freeze {
+		log.Warnf("Provisioning is frozen, only booting nodes from their disks")
+	}
+
+	if s.GratuitousARP > 0 && !s.Observe {
+		go s.announceAddress()
+	}
+
+	if len(s.scheduledJobs()) > 0 {
+		for _, job := range s.Config.Jobs {
+			if job.PowerCycle && s.PowerCycleCommand == "" {
+				return fmt.Errorf("Job %s power cycles nodes, but there's no power cycle command", job.Name)
+			}
+		}
+		go s.runJobs()
+	}
 
-	// 6 buffer slots, one for each goroutine, plus one for
-	// Shutdown(). We only ever pull the first error out, but shutdown
-	// will likely generate some spurious errors from the other
-	// goroutines, and we want them to be able to dump them without
-	// blocking.
-	s.errs = make(chan error, 6)
+	if s.ProxyDHCP && s.Config != nil && s.Config.Network != nil {
+		return fmt.Errorf("Static network configs need the leases of the DHCP server, not proxy DHCP")
+	}
+
+	if s.coreProxy == nil {
+		if err := s.checkMachineClassProfiles(storage.NewFileStore(&storage.Config{Root: s.ServerRoot})); err != nil {
+			return err
+		}
+		if err := s.checkNodePoolProfiles(storage.NewFileStore(&storage.Config{Root: s.ServerRoot})); err != nil {
+			return err
+		}
+	}
+
+	if !s.DisableDNS && !s.Observe && s.ServiceDomain != "" {
+		s.publishServices()
+	}
+
+	var servers []subServer
+	if s.Observe {
+		servers = append(servers, subServer{name: "observer", open: s.openObserver})
+	}
+	if !s.DisablePXE && !s.Observe {
+		servers = append(servers, packetServer("PXE", "udp4", fmt.Sprintf("%s:%d", s.IP, s.PXEPort), s.servePXE).withHint("--disable-pxe"))
+	}
+	if !s.DisableTFTP && !s.Observe {
+		servers = append(servers, packetServer("TFTP", "udp", fmt.Sprintf("%s:%d", s.IP, s.TFTPPort), s.serveTFTP).withHint("--disable-tftp"))
+	}
+	if s.MulticastTFTP && !s.Observe {
+		servers = append(servers, packetServer("multicast TFTP", "udp4", fmt.Sprintf("%s:%d", s.IP, s.MulticastTFTPPort), s.serveMulticastTFTP).withHint("--multicast-tftp=false"))
+	}
+	if !s.DisableHTTP && !s.Observe {
+		servers = append(servers, streamServer("HTTP", "tcp", fmt.Sprintf("%s:%d", s.IP, s.HTTPPort), s.startMatchbox).withHint("--disable-http"))
+	}
+	if (s.TLSCert != "" || s.MTLS) && !s.Observe {
+		servers = append(servers, streamServer("HTTPS", "tcp", fmt.Sprintf("%s:%d", s.IP, s.HTTPSPort), s.serveHTTPS))
+	}
+	if !s.DisableDHCP && !s.Observe {
+		servers = append(servers, subServer{name: "DHCP", open: s.openDhcp, proto: "udp", port: s.DHCPPort, hint: "--disable-dhcp"})
+	}
+	if !s.DisableDNS && !s.Observe {
+		servers = append(servers, packetServer("DNS", "udp", fmt.Sprintf("%s:%d", s.IP, s.DNSPort), s.serveDNS).withHint("--disable-dns"))
+	}
+	if s.Discovery && !s.Observe {
+		servers = append(servers, streamServer("discovery", "tcp", fmt.Sprintf("%s:%d", s.IP, s.DiscoveryPort), s.serveDiscovery).withHint("--discovery=false"))
+	}
+	if s.KMS && !s.Observe {
+		servers = append(servers, streamServer("KMS", "tcp", fmt.Sprintf("%s:%d", s.IP, s.KMSPort), s.serveKMS).withHint("--kms=false"))
+	}
+	if s.HTTPProxy && !s.Observe {
+		servers = append(servers, streamServer("HTTP proxy", "tcp", fmt.Sprintf("%s:%d", s.IP, s.HTTPProxyPort), s.serveHTTPProxy).withHint("--http-proxy=false"))
+	}
+	if s.AdminAddr != "" {
+		s.publishVars()
+		servers = append(servers, streamServer("admin", "tcp", s.AdminAddr, s.serveAdmin).withHint("a different --admin-addr"))
+	}
+	if s.ManagementAddr != "" {
+		servers = append(servers, streamServer("management", "tcp", s.ManagementAddr, s.serveManagement).withHint("a different --management-addr"))
+	}
+	if s.PcapDir != "" {
+		servers = append(servers, subServer{name: "packet capture", open: s.openCapture})
+	}
+	if s.LLDP {
+		servers = append(servers, subServer{name: "LLDP", open: s.openLLDP})
+	}
+
+	// One buffer slot for Shutdown(), so that it never blocks.
+	s.errs = make(chan error, 1)
+	s.supervisor = newSupervisor()
 
 	log.Info("Starting servers")
 
-	go func() { s.errs <- s.servePXE(pxe) }()
-	go func() { s.errs <- s.serveTFTP(tftp) }()
-	go func() { s.errs <- s.startMatchbox(http) }()
-	go func() { s.errs <- s.startDhcp() }()
-	go func() { s.errs <- s.serveDNS(dns) }()
-
-	// Wait for either a fatal error, or Shutdown().
-	err = <-s.errs
-	dns.Close()
-	http.Close()
-	tftp.Close()
-	pxe.Close()
+	if err := s.supervisor.start(servers); err != nil {
+		return err
+	}
+
+	// Wait for Shutdown(). Sub-servers which fail in the meantime are
+	// restarted by the supervisor.
+	err := <-s.errs
+	s.supervisor.stop()
 	return err
 }
 
-func (s *Server) startMatchbox(l net.Listener) error {
-	store := storage.NewFileStore(&storage.Config{
-		Root: s.ServerRoot,
-	})
+// httpHandler serves matchbox along with the menu and the patched
+// machine configs.
+func (s *Server) httpHandler() http.Handler {
+	return s.edgeAuthHandler(s.progressHandler(s.inventoryHandler(s.tracingHandler(s.chaosHandler(s.routeHandler(s.mirrorHandler(compressHandler(s.clientCertHandler(s.ipxeWrapperMenuHandler(s.freezeHandler(s.configTokenHandler(s.installDiskHandler(s.configServedHandler(s.configRenderer()))))))))))))))
+}
 
-	server := server.NewServer(&server.Config{
-		Store: store,
+// configRenderer renders the matchbox responses and the patched machine
+// configs, built once for the listeners and the config drift checks.
+func (s *Server) configRenderer() http.Handler {
+	s.rendererOnce.Do(func() {
+		if s.coreProxy != nil {
+			s.renderer = s.configSchemaHandler(s.coreProxy)
+			return
+		}
+
+		store := s.withNodePools(s.withMachineClasses(storage.NewFileStore(&storage.Config{
+			Root: s.ServerRoot,
+		})))
+
+		newMatchbox := func(store storage.Store) http.Handler {
+			return web.NewServer(&web.Config{
+				Core: server.NewServer(&server.Config{
+					Store: store,
+				}),
+				Logger: log,
+				AssetsPath: filepath.Join(s.ServerRoot, "assets"),
+			}).HTTPHandler()
+		}
+
+		matchbox := newMatchbox(s.withTemplateVars(store))
+		if s.templateVars != nil {
+			matchbox = metadataWithoutVars(matchbox, newMatchbox(store))
+		}
+		s.renderer = s.configSchemaHandler(s.renderCacheHandler(s.renderLimitHandler(s.machineConfigHandler(matchbox))))
 	})
+	return s.renderer
+}
 
-	config := &web.Config{
-		Core: server,
-		Logger: log,
-		AssetsPath: filepath.Join(s.ServerRoot, "assets"),
+func (s *Server) startMatchbox(l net.Listener) error {
+	if err := http.Serve(l, s.httpHandler()); err != nil {
+		return fmt.Errorf("Matchbox server shut down: %s", err)
 	}
 
-	httpServer := web.NewServer(config)
-	if err := http.Serve(l, s.ipxeWrapperMenuHandler(httpServer.HTTPHandler())); err != nil {
-		return fmt.Errorf("Matchbox server shut down: %s", err)
+	return nil
+}
+
+// serveHTTPS serves the same as startMatchbox over TLS, which also
+// enables HTTP/2 for the clients supporting it.
+func (s *Server) serveHTTPS(l net.Listener) error {
+	config, err := s.httpsConfig()
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: s.httpHandler(), TLSConfig: config}
+	if err := srv.ServeTLS(l, "", ""); err != nil {
+		return fmt.Errorf("HTTPS server shut down: %s", err)
 	}
 
 	return nil
@@ -209,27 +882,42 @@ set next-server ${proxydhcp/next-server}
 set filename ${proxydhcp/filename}
 
 :start
+{{- if eq .ConsoleVerbosity "verbose" }}
+echo Talos PXE boot from {{ .IP }}
+echo ${mac} (${uuid}) at ${ip}, ${platform} ${buildarch} firmware
+{{- end }}
+{{- if eq .ConsoleVerbosity "quiet" }}
+set selected {{ .Default }}
+{{- else }}
 menu iPXE boot menu for Talos
 item --gap                      Talos Nodes
 item --key i init               Bootstrap Node
 item --key c controlplane       Master Node
 item --key w worker             Worker Node
 item --gap                      Other
+item --key l local              Local Disk
 item --key s shell              iPXE Shell
 item --key r reboot             Reboot
 item --key e exit               Exit
-choose --timeout 0 --default worker selected || goto cancel
+choose --timeout {{ .Timeout }} --default {{ .Default }} selected || goto cancel
 set menu-timeout 0
+{{- end }}
+{{- if eq .ConsoleVerbosity "verbose" }}
+echo Booting ${selected}
+{{- end }}
 goto ${selected}
 
 :init
-chain http://{{ .IP }}:8080/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&type=init
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime}&type=init{{ .Selectors }}
 
 :controlplane
-chain http://{{ .IP }}:8080/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&type=controlplane
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime}&type=controlplane{{ .Selectors }}
 
 :worker
-chain http://{{ .IP }}:8080/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&type=worker
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime}&type=worker{{ .Selectors }}
+
+:local
+exit
 
 :reboot
 reboot
@@ -340,25 +1028,107 @@ func runDhclient(ctx context.Context, iface *net.Interface) (*dhclient.Lease, er
 	}
 }
 
+// ipxeWrapperMenuHandler serves the menu and rewrites the boot scripts on
+// /ipxe, which are small enough to buffer. Everything else, the assets
+// included, is streamed straight from the primary handler.
 func (s *Server) ipxeWrapperMenuHandler(primaryHandler http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, req *http.Request) {
-		if req.URL.Path != "ipxe" && req.URL.Path != "/ipxe" {
+		// Edges render the menu themselves, with their own address.
+		if path.Clean("/"+req.URL.Path) != "/ipxe" || isEdgeRequest(req) {
 			primaryHandler.ServeHTTP(w, req)
 			return
 		}
 
+		req = s.identityRequest(req)
+		if reported, ok := takeClientTime(req); ok {
+			mac, _ := net.ParseMAC(req.URL.Query().Get("mac"))
+			s.sessions.clientClock(mac, reported)
+		}
+
+		if mac, err := net.ParseMAC(req.URL.Query().Get("mac")); err == nil && s.quarantine.holds(mac) {
+			log.Infof("Telling quarantined client %s it's not authorized", mac)
+			w.Write([]byte(quarantineScript))
+			return
+		}
+
+		mac, _ := net.ParseMAC(req.URL.Query().Get("mac"))
+		if script := s.frozenScript(mac); script != nil {
+			w.Write(script)
+			return
+		}
+
+		// Known nodes aren't reinstalled outside maintenance windows, even
+		// when chaining straight to their role.
+		if script, err := s.maintenanceScript(mac, requestSelectors(req.URL.Query())); err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if script != nil {
+			w.Write(script)
+			return
+		}
+
+		if node, ok := s.nodes.get(mac.String()); mac != nil && req.URL.Query().Get("type") != "" && s.needsPreflight(node, ok) {
+			script, err := s.preflightScript(storage.NewFileStore(&storage.Config{Root: s.ServerRoot}))
+			if err != nil {
+				log.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Booting %s into preflight to report its disks", mac)
+			s.nodes.record(req.URL.Query())
+			w.Write(s.withConsoleMessages(script))
+			return
+		}
+
+		// Read before the boot is recorded, which resets the state.
+		node, _ := s.nodes.get(mac.String())
+		maintenanceMode := node.State == NodeStateMaintenance
+
+		retry := takeRetry(req)
+		canaryReq := s.canaryRequest(s.nodePoolRequest(s.machineClassRequest(s.hardwareRequest(s.switchPortRequest(req)))))
+
 		rr := httptest.NewRecorder()
-		primaryHandler.ServeHTTP(rr, req)
+		primaryHandler.ServeHTTP(rr, canaryReq)
+
+		// Machines aren't booted into machine configs failing the schema.
+		status := rr.Code
+		if status == http.StatusOK && !maintenanceMode {
+			if script, invalid := s.invalidConfigScript(canaryReq, rr.Body.Bytes(), mac, retry); invalid {
+				if script != nil {
+					w.Write(script)
+					return
+				}
+				status = http.StatusInternalServerError
+			}
+		}
 
-		if status := rr.Code; status == http.StatusOK {
+		// Hooks approve the role before the boot is recorded.
+		if status == http.StatusOK {
+			if script, refused := s.roleSelectionHooks(canaryReq, mac, retry); refused {
+				if script != nil {
+					w.Write(script)
+					return
+				}
+				status = http.StatusForbidden
+			}
+		}
+
+		if status == http.StatusOK {
+			req = canaryReq
 			req.ParseForm()
 			machineType := req.Form.Get("type")
 			remoteIp := net.ParseIP(req.Form.Get("ip"))
 			log.Infof("Selecting %s for %s", machineType, remoteIp)
 
-			if machineType == "init" || machineType == "controlplane" {
+			if (machineType == "init" || machineType == "controlplane") && s.ControlplaneVIP == nil {
 				s.registerDNSEntry(s.Controlplane, remoteIp)
 			}
+			s.nodes.record(req.Form)
+			s.switchPortAttach(mac)
+			if isControlplaneRole(machineType) {
+				s.pinLease(mac, "controlplane node")
+			}
 
 			for key, values := range rr.HeaderMap {
 				for _, value := range values {
@@ -366,16 +1136,29 @@ func (s *Server) ipxeWrapperMenuHandler(primaryHandler http.Handler) http.Handle
 				}
 			}
 
+			body := s.finishBootScript(rr.Body.Bytes(), mac, req.Form, true)
+			if maintenanceMode {
+				log.Infof("Booting %s into maintenance mode, without its machine config", mac)
+				body = withoutMachineConfig(body)
+			}
+			w.Header().Del("Content-Length")
 			w.WriteHeader(rr.Code)
 
-			w.Write(rr.Body.Bytes())
+			w.Write(body)
+		} else if script := busyRetryScript(req, status, rr.Header()); script != nil {
+			w.Write(script)
+		} else if script := s.configRetryScript(req, status, retry); script != nil {
+			w.Write(script)
 		} else {
 			log.Info("Serving menu")
 
-			if err := ipxeMenuTemplate.Execute(w, s); err != nil {
+			menu, err := s.nodeMenu(mac, nil, requestSelectors(req.URL.Query()))
+			if err != nil {
 				log.Error(err)
 				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
+			w.Write(menu)
 		}
 	}
 
@@ -399,14 +1182,134 @@ func getAvailableRange(netIp net.IPNet, netServer net.IP) (net.IP, net.IP) {
 }
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	errorLog := &errorLog{}
+	log.AddHook(errorLog)
+
 	serverRootFlag := flag.String("root", ".", "Server root, where to serve the files from")
 	ifNameFlag := flag.String("if", "eth0", "Interface to use")
 	ipAddrFlag := flag.String("addr", "192.168.123.1/24", "Address to listen on")
 	gwAddrFlag := flag.String("gw", "", "Override gateway address")
+	advertiseIpFlag := flag.String("advertise-ip", "", "Address clients reach the server on, if not the one it listens on, e.g. behind NAT")
+	advertiseHttpPortFlag := flag.Int("advertise-http-port", 0, "HTTP port clients reach the server on, if not 8080, e.g. with port forwarding")
 	dnsAddrFlag := flag.String("dns", "", "Override DNS address")
-	controlplaneFlag := flag.String("controlplane", "controlplane.talos.", "Controlplane address")
+	controlplaneFlag := flag.String("controlplane", "controlplane."+clusterDomain+".", "Controlplane address (default controlplane.<domain>.)")
+	domainFlag := flag.String("domain", clusterDomain, "Cluster domain the DNS server answers for, handed out as the domain name of the leases, empty to not hand it out")
+	domainSearchFlag := flag.StringSlice("domain-search", nil, "Domain search list of the leases (default the cluster domain)")
+	controlplaneVipFlag := flag.String("controlplane-vip", "", "Virtual IP shared by the controlplane nodes, which the controlplane address resolves to")
+	controlplaneVipIfFlag := flag.String("controlplane-vip-interface", "eth0", "Interface of the controlplane nodes to share the virtual IP on")
+	controlplaneAnswerOrderFlag := flag.String("controlplane-answer-order", answerOrderAddress, "Order of the addresses the controlplane address resolves to: address, round-robin, weighted by health probe latency, or primary")
+	controlplanePrimaryFlag := flag.String("controlplane-primary", "", "Controlplane node answered first while healthy, with --controlplane-answer-order primary")
+	disableDhcpFlag := flag.Bool("disable-dhcp", false, "Don't run the DHCP server")
+	disableDnsFlag := flag.Bool("disable-dns", false, "Don't run the DNS server")
+	disableTftpFlag := flag.Bool("disable-tftp", false, "Don't run the TFTP server")
+	disablePxeFlag := flag.Bool("disable-pxe", false, "Don't run the PXE boot server")
+	disableHttpFlag := flag.Bool("disable-http", false, "Don't run the HTTP server")
+	proxyOnlyFlag := flag.Bool("proxy-only", false, "Never lease addresses, only answer PXE clients as a ProxyDHCP server, even if no DHCP server is found")
+	observeFlag := flag.Bool("observe", false, "Only watch the DHCP, TFTP and DNS traffic on the interface, building the node inventory without answering")
+	discoveryFlag := flag.Bool("discovery", false, "Run an embedded Talos discovery service and point machine configs at it")
+	kmsFlag := flag.Bool("kms", false, "Run a Talos KMS endpoint for network-bound disk encryption")
+	httpProxyFlag := flag.Bool("http-proxy", false, "Run an HTTP proxy for the nodes to pull images through, and point machine configs at it")
+	httpProxyAllowFlag := flag.StringSlice("http-proxy-allow", defaultHTTPProxyAllow, "Hosts the HTTP proxy connects to, *.example.com for the subdomains of example.com")
+	secretsDirFlag := flag.String("secrets-dir", "", "Encrypted secrets store location (default <root>/secrets)")
+	configTokensFlag := flag.Bool("config-tokens", false, "Only serve machine configs with a single-use token from the boot script of the node")
+	configTokenTTLFlag := flag.Duration("config-token-ttl", configTokenTTL, "How long the config tokens are valid")
+	importStateFlag := flag.String("import-state", "", "State snapshot to import on startup, as exported by the state command")
+	pinsFileFlag := flag.String("pins-file", "", "Where the leases pinned to controlplane nodes are kept (default <root>/pins.json)")
+	adminAddrFlag := flag.String("admin-addr", "127.0.0.1:8081", "Address for pprof and expvar diagnostics and the admin API, loopback unless access control is configured, empty to disable")
+	locateCommandFlag := flag.String("locate-command", "", "Shell command printing the switch and the port of the MAC in $NODE_MAC, e.g. through gNMI, instead of asking the switches of the config over SNMP")
+	powerCycleCommandFlag := flag.String("power-cycle-command", "", "Shell command power cycling the node in $NODE_MAC, $NODE_IP, $NODE_HOSTNAME and $NODE_LABEL_*, e.g. through its BMC")
+	talosconfigFlag := flag.String("talosconfig", "", "talosconfig of the cluster, to upgrade and check nodes through the Talos API, kept in the secrets store for later starts")
+	installerImageFlag := flag.String("installer-image", "ghcr.io/siderolabs/installer", "Repository of the Talos installer images nodes are upgraded to")
+	powerStatusCommandFlag := flag.String("power-status-command", "", "Shell command printing off if the node in $NODE_MAC, $NODE_IP, $NODE_HOSTNAME and $NODE_LABEL_* is powered off, e.g. through its BMC")
+	etcdCleanupAfterFlag := flag.Duration("etcd-cleanup-after", 15*time.Minute, "How long a controlplane node is unreachable before its removal from etcd is suggested")
+	nodeHealthIntervalFlag := flag.Duration("node-health-interval", time.Minute, "How often the Talos API of the nodes is checked with the talosconfig, 0 to not check")
+	upgradeNodeTimeoutFlag := flag.Duration("upgrade-node-timeout", 30*time.Minute, "How long upgrading a node may take before the upgrade is stopped")
+	managementAddrFlag := flag.String("management-addr", "127.0.0.1:8082", "Address for the gRPC management API, loopback unless access control is configured, empty to disable")
+	pcapDumpFlag := flag.String("pcap-dump", "", "Directory to dump DHCP, PXE and TFTP packets to for debugging")
+	lldpFlag := flag.Bool("lldp", false, "Listen for LLDP frames, recording the switch ports of the nodes")
+	dhcpPortFlag := flag.Int("dhcp-port", portDHCP, "DHCP server port, for tests only")
+	dhcpClientPortFlag := flag.Int("dhcp-client-port", portDHCPClient, "DHCP client port replies are sent to, for tests only")
+	tftpPortFlag := flag.Int("tftp-port", portTFTP, "TFTP port, for tests only")
+	pxePortFlag := flag.Int("pxe-port", portPXE, "PXE boot server port, for tests only")
+	dnsPortFlag := flag.Int("dns-port", portDNS, "DNS port, for tests only")
+	httpPortFlag := flag.Int("http-port", portHTTP, "HTTP port")
+	httpsPortFlag := flag.Int("https-port", portHTTPS, "HTTPS port, with --tls-cert")
+	containerNetworkFlag := flag.String("container-network", "", "Docker or Podman network of containerized nodes to serve, detecting the interface and address on it")
+	containerRuntimeFlag := flag.String("container-runtime", "", "docker or podman, to inspect --container-network with (default docker if installed)")
+	configFlag := flag.String("config", "", "JSON file with further settings, e.g. NIC quirks")
+	pxeMenuFlag := flag.Bool("pxe-menu", false, "Show a boot menu in PXE firmware supporting it, before loading iPXE")
+	pxeMenuTimeoutFlag := flag.Duration("pxe-menu-timeout", 10*time.Second, "How long the PXE firmware boot menu prompt is shown")
+	coreUrlFlag := flag.String("core-url", "", "Run as an edge, proxying HTTP requests to the core instance at this URL")
+	coreCaFlag := flag.String("core-ca", "", "CA certificate to verify the core instance with")
+	edgeSecretFileFlag := flag.String("edge-secret-file", "", "File with the secret shared by the edges and the core, which only trusts edges sending it")
+	freezeFlag := flag.Bool("freeze", false, "Provision nothing: no leases for unknown clients, no installs, only booting from disk")
+	chaosFlag := flag.Bool("chaos", false, "Inject the failures of the chaos section of the config, for testing only")
+	validateInstallDiskFlag := flag.Bool("validate-install-disk", false, "Refuse machine configs whose install disk isn't among the disks the node reported")
+	preflightProfileFlag := flag.String("preflight-profile", "", "Matchbox profile reporting the disks, booted by nodes which didn't report them before their role")
+	consoleVerbosityFlag := flag.String("console-verbosity", ConsoleNormal, "How much the iPXE scripts print on the console: quiet boots without showing the menu, verbose prints what the client loads")
+	fallbackMirrorFlag := flag.StringArray("fallback-mirror", nil, "URL of a server the boot scripts download the kernel and initramfs from if the download from this one fails, can be repeated")
+	multicastTFTPFlag := flag.Bool("multicast-tftp", false, "Serve the boot images over multicast TFTP too, for iPXE built with DOWNLOAD_PROTO_TFTM")
+	multicastTFTPPortFlag := flag.Int("multicast-tftp-port", portMulticastTFTP, "Multicast TFTP port, the multicast data is sent to the next one")
+	multicastTFTPGroupFlag := flag.IP("multicast-tftp-group", defaultMulticastTFTPGroup, "First address of the /24 of multicast groups the multicast TFTP sessions send to")
+	assetMirrorFlag := flag.StringArray("asset-mirror", nil, "URL of a mirror serving the same assets to spread boot image downloads over, can be repeated")
+	tlsCertFlag := flag.String("tls-cert", "", "Certificate to serve HTTPS with, on port 8443")
+	tlsKeyFlag := flag.String("tls-key", "", "Key of the HTTPS certificate")
+	mtlsFlag := flag.Bool("mtls", false, "Only serve boot scripts and matchbox configs over HTTPS to iPXE builds with a client certificate from the CA, implies --config-tokens")
+	caDirFlag := flag.String("ca-dir", "", "CA issuing the client certificates location (default <root>/ca)")
+	tftpMaxTransfersFlag := flag.Int("tftp-max-transfers", tftpMaxTransfers, "Maximum number of concurrent TFTP transfers")
+	renderWorkersFlag := flag.Int("render-workers", renderWorkers, "Maximum number of matchbox templates and machine configs rendered at a time")
+	renderClientLimitFlag := flag.Int("render-client-limit", renderClientLimit, "Maximum number of renders at a time for every client, 0 for no limit")
+	tftpTimeoutFlag := flag.Duration("tftp-timeout", tftpTimeout, "How long a TFTP transfer waits for the client before retransmitting")
+	configRetryAttemptsFlag := flag.Int("config-retry-attempts", 5, "How often machines without a matching profile retry before getting the menu again, 0 to disable")
+	configRetryDelayFlag := flag.Duration("config-retry-delay", 5*time.Second, "How long machines without a matching profile wait before the first retry")
+	validateConfigsFlag := flag.Bool("validate-configs", true, "Refuse to serve machine configs not matching the Talos config schema")
+	leaseGracePeriodFlag := flag.Duration("lease-grace-period", leaseGracePeriod, "How long expired and released leases, and their DNS records, are kept")
+	gratuitousARPFlag := flag.Int("gratuitous-arp", 3, "Gratuitous ARP announcements of the server address once it's claimed, 0 to disable")
+	gratuitousARPLeasesFlag := flag.Bool("gratuitous-arp-leases", false, "Announce the leased addresses with gratuitous ARP after their ACKs")
+	dhcpRateLimitFlag := flag.Float64("dhcp-rate-limit", dhcpRateLimit, "DHCP packets per second accepted from every client, 0 for no limit")
+	dnssecFlag := flag.Bool("dnssec-validate", false, "Validate DNSSEC on forwarded answers, answering SERVFAIL for bogus ones")
+	serviceDomainFlag := flag.String("service-domain", serviceDomain, "Domain the SRV and TXT records of the services of the server are published under, empty to not publish them")
+	dnsRateLimitFlag := flag.Float64("dns-rate-limit", dnsRateLimit, "DNS queries per second accepted from every client, 0 for no limit")
+	poolAlertThresholdFlag := flag.Float64("pool-alert-threshold", 0.9, "Alert when this fraction of the DHCP pool is leased out, 0 to disable")
+	poolAlertWebhookFlag := flag.String("pool-alert-webhook", "", "URL to post DHCP pool alerts to as JSON")
+	otlpEndpointFlag := flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export boot session traces to, e.g. http://tempo:4318")
 	flag.Parse()
 
+	var containerNet *containerNetwork
+	if *containerNetworkFlag != "" {
+		n, err := inspectContainerNetwork(*containerRuntimeFlag, *containerNetworkFlag)
+		if err != nil {
+			log.Panic(err)
+		}
+		ifName, addr, err := n.localAddress()
+		if err != nil {
+			log.Panic(err)
+		}
+		if !flag.CommandLine.Changed("if") {
+			*ifNameFlag = ifName
+		}
+		if !flag.CommandLine.Changed("addr") {
+			*ipAddrFlag = addr.String()
+		}
+		if !flag.CommandLine.Changed("gw") && n.Gateway != nil {
+			*gwAddrFlag = n.Gateway.String()
+		}
+		log.Infof("Serving container network %s (%s) on %s", n.Name, n.Subnet, ifName)
+		containerNet = n
+	}
+
+	var config *Config
+	if *configFlag != "" {
+		var err error
+		if config, err = loadConfig(*configFlag); err != nil {
+			log.Panic(err)
+		}
+	}
+
 	validInterfaces, err := getValidInterfaces()
 	if err != nil {
 		log.Panic(err)
@@ -417,6 +1320,14 @@ func main() {
 		log.Infof(" - %s\n", iface.Name)
 	}
 
+	if config != nil {
+		for _, ic := range config.Interfaces {
+			if err := setupInterface(ic); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
 	log.Infof("Select interface %s", *ifNameFlag)
 
 	eth, err := tenus.NewLinkFrom(*ifNameFlag)
@@ -430,18 +1341,113 @@ func main() {
 
 	log.Infof("Brought %s up\n", eth.NetInterface().Name)
 
-	lease, err := runDhclient(context.Background(), eth.NetInterface())
+	// The controlplane address and the services follow the domain.
+	if domain := strings.TrimSuffix(*domainFlag, "."); domain != "" {
+		if !flag.CommandLine.Changed("controlplane") {
+			*controlplaneFlag = "controlplane." + domain + "."
+		}
+		if !flag.CommandLine.Changed("service-domain") {
+			*serviceDomainFlag = domain + "."
+		}
+	}
 
 	server := &Server{
 		ServerRoot: *serverRootFlag,
 		Intf: eth.NetInterface().Name,
 		Controlplane: *controlplaneFlag,
+		Domain: *domainFlag,
+		DomainSearch: *domainSearchFlag,
+		ControlplaneVIPInterface: *controlplaneVipIfFlag,
+		ControlplaneAnswers: AnswerPolicy{Order: *controlplaneAnswerOrderFlag, Primary: *controlplanePrimaryFlag},
+		Config: config,
+		DisableDHCP: *disableDhcpFlag,
+		DisableDNS: *disableDnsFlag,
+		DisableTFTP: *disableTftpFlag,
+		DisablePXE: *disablePxeFlag,
+		DisableHTTP: *disableHttpFlag,
+		Discovery: *discoveryFlag,
+		KMS: *kmsFlag,
+		HTTPProxy: *httpProxyFlag,
+		HTTPProxyAllow: *httpProxyAllowFlag,
+		SecretsDir: *secretsDirFlag,
+		PinsFile: *pinsFileFlag,
+		ImportState: *importStateFlag,
+		ConfigTokens: *configTokensFlag,
+		ConfigTokenTTL: *configTokenTTLFlag,
+		OTLPEndpoint: *otlpEndpointFlag,
+		AdminAddr: *adminAddrFlag,
+		ManagementAddr: *managementAddrFlag,
+		PowerCycleCommand: *powerCycleCommandFlag,
+		PowerStatusCommand: *powerStatusCommandFlag,
+		LocateCommand: *locateCommandFlag,
+		Talosconfig: *talosconfigFlag,
+		InstallerImage: *installerImageFlag,
+		UpgradeNodeTimeout: *upgradeNodeTimeoutFlag,
+		NodeHealthInterval: *nodeHealthIntervalFlag,
+		EtcdCleanupAfter: *etcdCleanupAfterFlag,
+		PcapDir: *pcapDumpFlag,
+		LLDP: *lldpFlag,
+		ContainerNetwork: containerNet,
+		DHCPPort: *dhcpPortFlag,
+		DHCPClientPort: *dhcpClientPortFlag,
+		TFTPPort: *tftpPortFlag,
+		PXEPort: *pxePortFlag,
+		DNSPort: *dnsPortFlag,
+		HTTPPort: *httpPortFlag,
+		HTTPSPort: *httpsPortFlag,
+		PXEMenu: *pxeMenuFlag,
+		PXEMenuTimeout: *pxeMenuTimeoutFlag,
+		ConfigRetryAttempts: *configRetryAttemptsFlag,
+		ConfigRetryDelay: *configRetryDelayFlag,
+		ValidateConfigs: *validateConfigsFlag,
+		CoreURL: *coreUrlFlag,
+		CoreCA: *coreCaFlag,
+		EdgeSecretFile: *edgeSecretFileFlag,
+		AssetMirrors: *assetMirrorFlag,
+		FallbackMirrors: *fallbackMirrorFlag,
+		MulticastTFTP: *multicastTFTPFlag,
+		MulticastTFTPPort: *multicastTFTPPortFlag,
+		MulticastTFTPGroup: *multicastTFTPGroupFlag,
+		ConsoleVerbosity: *consoleVerbosityFlag,
+		ValidateInstallDisk: *validateInstallDiskFlag || *preflightProfileFlag != "",
+		Chaos: *chaosFlag,
+		Freeze: *freezeFlag,
+		PreflightProfile: *preflightProfileFlag,
+		TLSCert: *tlsCertFlag,
+		TLSKey: *tlsKeyFlag,
+		MTLS: *mtlsFlag,
+		CADir: *caDirFlag,
+		TFTPMaxTransfers: *tftpMaxTransfersFlag,
+		TFTPTimeout: *tftpTimeoutFlag,
+		RenderWorkers: *renderWorkersFlag,
+		RenderClientLimit: *renderClientLimitFlag,
+		GratuitousARP: *gratuitousARPFlag,
+		GratuitousARPLeases: *gratuitousARPLeasesFlag,
+		DHCPRateLimit: *dhcpRateLimitFlag,
+		LeaseGracePeriod: *leaseGracePeriodFlag,
+		DNSRateLimit: *dnsRateLimitFlag,
+		DNSSEC: *dnssecFlag,
+		ServiceDomain: *serviceDomainFlag,
+		PoolAlertThreshold: *poolAlertThresholdFlag,
+		PoolAlertWebhook: *poolAlertWebhookFlag,
 		DHCPRecords: make(map[string]*DHCPRecord),
-		DNSRecordsv4: make(map[string][]net.IP),
-		DNSRecordsv6: make(map[string][]net.IP),
-		DNSRRecords: make(map[string][]string),
+		DNSRecords: newDNSStore(),
+		sessions: newBootSessions(),
+		errorLog: errorLog,
+		nodes: newNodeInventory(),
+	}
+
+	if *observeFlag {
+		// Observing sends nothing, not even to get an address.
+		server.Observe = true
+		if err := server.Serve(); err != nil {
+			log.Panic(err)
+		}
+		return
 	}
 
+	lease, err := runDhclient(context.Background(), eth.NetInterface())
+
 	if lease != nil {
 		log.Infof("Obtained address %s\n", lease.FixedAddress)
 
@@ -468,6 +1474,21 @@ func main() {
 
 		server.IP = lease.FixedAddress
 		server.ProxyDHCP = true
+	} else if *proxyOnlyFlag {
+		// Addresses are someone else's to hand out, so none are leased
+		// even without a DHCP server to lease them.
+		netIp, netNet, err := net.ParseCIDR(*ipAddrFlag)
+		if err != nil {
+			log.Panic(err)
+		}
+		log.Warnf("No DHCP server found, setting manual address %s, clients won't get addresses until one answers\n", netIp)
+
+		server.IP = netIp
+		server.ProxyDHCP = true
+
+		if err := eth.SetLinkIp(netIp, netNet); err != nil && err != syscall.EEXIST {
+			log.Panic(err)
+		}
 	} else {
 		netIp, netNet, err := net.ParseCIDR(*ipAddrFlag)
 		firstIp, lastIp := getAvailableRange(*netNet, netIp)
@@ -477,6 +1498,7 @@ func main() {
 		server.Net = netNet
 		server.ProxyDHCP = false
 
+		server.DHCPRangeStart, server.DHCPRangeEnd = firstIp, lastIp
 		server.DHCPAllocator, err = bitmap.NewIPv4Allocator(firstIp, lastIp)
 		if err != nil {
 			log.Panic(err)
@@ -491,6 +1513,22 @@ func main() {
 		}
 	}
 
+	if *controlplaneVipFlag != "" {
+		server.ControlplaneVIP = net.ParseIP(*controlplaneVipFlag).To4()
+		if server.ControlplaneVIP == nil {
+			log.Panicf("Invalid controlplane VIP %s", *controlplaneVipFlag)
+		}
+	}
+
+	if *advertiseIpFlag != "" {
+		server.AdvertiseIP = net.ParseIP(*advertiseIpFlag).To4()
+		if server.AdvertiseIP == nil {
+			log.Panicf("Invalid advertised address %s", *advertiseIpFlag)
+		}
+		log.Infof("Advertising %s to clients", server.AdvertiseIP)
+	}
+	server.AdvertiseHTTPPort = *advertiseHttpPortFlag
+
 	if *gwAddrFlag != "" {
 	    log.Infof("Overriding gateway address with %s", *gwAddrFlag)
 	    server.GWIP = net.ParseIP(*gwAddrFlag)
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Maintenance windows keep nodes which were provisioned before from being
+// reinstalled at any time, e.g. because someone power cycled a production
+// node at 2pm with PXE first in its boot order. Outside the windows, nodes
+// in the inventory get a script booting them from disk, or one waiting
+// for the next window, instead of the menu or their role. New machines
+// are provisioned as usual.
+
+const (
+	MaintenanceOutsideLocal = "local"
+	MaintenanceOutsideWait  = "wait"
+
+	// How far ahead the next window is looked for.
+	maintenanceLookahead = 8 * 24 * time.Hour
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow opens at Start on Days, every day if empty, and
+// closes at End, on the next day if End is before Start. Times are 15:04.
+type MaintenanceWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+
+	start, end int
+	days       map[time.Weekday]bool
+}
+
+type MaintenanceConfig struct {
+	Windows []MaintenanceWindow `json:"windows"`
+	// Timezone of the windows, e.g. Europe/Berlin, local time if empty.
+	Timezone string `json:"timezone,omitempty"`
+	// Outside is what nodes get outside the windows, local or wait.
+	Outside string `json:"outside,omitempty"`
+
+	location *time.Location
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, e.g. 22:00", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (m *MaintenanceConfig) check() error {
+	if len(m.Windows) == 0 {
+		return fmt.Errorf("needs at least one window")
+	}
+
+	switch m.Outside {
+	case "":
+		m.Outside = MaintenanceOutsideLocal
+	case MaintenanceOutsideLocal, MaintenanceOutsideWait:
+	default:
+		return fmt.Errorf("outside has to be %s or %s", MaintenanceOutsideLocal, MaintenanceOutsideWait)
+	}
+
+	location, err := time.LoadLocation(m.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %s", m.Timezone, err)
+	}
+	m.location = location
+
+	for i := range m.Windows {
+		w := &m.Windows[i]
+		if w.start, err = parseClock(w.Start); err != nil {
+			return fmt.Errorf("window %d: %s", i, err)
+		}
+		if w.end, err = parseClock(w.End); err != nil {
+			return fmt.Errorf("window %d: %s", i, err)
+		}
+		if w.start == w.end {
+			return fmt.Errorf("window %d: starts when it ends", i)
+		}
+
+		w.days = make(map[time.Weekday]bool)
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("window %d: invalid day %q, e.g. sat", i, day)
+			}
+			w.days[weekday] = true
+		}
+	}
+	return nil
+}
+
+func (w *MaintenanceWindow) startsOn(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
+
+// open tells whether the window is open at t, in its timezone.
+func (w *MaintenanceWindow) open(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.startsOn(t.Weekday()) && minute >= w.start && minute < w.end
+	}
+	// Past midnight, the window opened the day before.
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.startsOn(t.Weekday()) && minute >= w.start) || (w.startsOn(yesterday) && minute < w.end)
+}
+
+func (m *MaintenanceConfig) open(t time.Time) bool {
+	t = t.In(m.location)
+	for i := range m.Windows {
+		if m.Windows[i].open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns when the next window opens after t, or the zero time if
+// none does within maintenanceLookahead.
+func (m *MaintenanceConfig) next(t time.Time) time.Time {
+	t = t.In(m.location).Truncate(time.Minute)
+	for end := t.Add(maintenanceLookahead); t.Before(end); t = t.Add(time.Minute) {
+		if m.open(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// MaintenanceStatus is whether reinstalls are allowed now.
+type MaintenanceStatus struct {
+	Open bool      `json:"open"`
+	Next time.Time `json:"next,omitempty"`
+}
+
+func (s *Server) maintenanceStatus() MaintenanceStatus {
+	m := s.maintenance()
+	now := time.Now()
+	if m == nil || m.open(now) {
+		return MaintenanceStatus{Open: true}
+	}
+	return MaintenanceStatus{Next: m.next(now)}
+}
+
+func (s *Server) maintenance() *MaintenanceConfig {
+	if s.Config == nil {
+		return nil
+	}
+	return s.Config.Maintenance
+}
+
+var maintenanceLocalScript = []byte(`#!ipxe
+echo This machine (${mac}) is only reinstalled in maintenance windows, booting from disk.
+exit
+`)
+
+var maintenanceWaitScriptTemplate = template.Must(template.New("iPXE maintenance").Parse(`#!ipxe
+echo This machine (${mac}) is only reinstalled in maintenance windows.
+echo {{ if .Next.IsZero }}No window is coming up{{ else }}The next one opens {{ .Next.Format "Mon Jan 2 15:04 MST" }}{{ end }}, checking again in 5 minutes.
+sleep 300
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?mac=${mac:hexhyp}&time=${unixtime}{{ .Selectors }}
+`))
+
+type maintenanceScriptData struct {
+	ipxeMenuData
+	Next time.Time
+}
+
+// maintenanceScript returns what the machine gets instead of the menu or
+// its role if it's a node of the inventory and no window is open, nil
+// otherwise.
+func (s *Server) maintenanceScript(mac net.HardwareAddr, selectors map[string]string) ([]byte, error) {
+	m := s.maintenance()
+	if m == nil || mac == nil {
+		return nil, nil
+	}
+	if _, ok := s.nodes.get(mac.String()); !ok {
+		return nil, nil
+	}
+
+	status := s.maintenanceStatus()
+	if status.Open {
+		return nil, nil
+	}
+
+	if m.Outside == MaintenanceOutsideLocal {
+		log.Infof("Booting node %s from disk outside the maintenance windows", mac)
+		return maintenanceLocalScript, nil
+	}
+
+	log.Infof("Telling node %s to wait for the next maintenance window", mac)
+	var buf bytes.Buffer
+	data := maintenanceScriptData{ipxeMenuData: s.menuData(selectors), Next: status.Next}
+	if err := maintenanceWaitScriptTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Server) maintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	if s.maintenance() == nil {
+		http.Error(w, "No maintenance windows configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.maintenanceStatus())
+}
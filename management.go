@@ -0,0 +1,2323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/poseidon/matchbox/matchbox/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The management API serves what the admin REST API does for nodes,
+// leases and their stats, DNS, profiles, audit events, upgrades, canaries,
+// state snapshots, pausing DHCP and provisioning windows over gRPC, as
+// described by api/management.proto. Like the other gRPC services the
+// messages are encoded by hand. As it can change the state of the server,
+// it's bound to a loopback address only without access control, and
+// served over TLS on others with it.
+
+const managementService = "talospxe.management.v1.Management"
+
+type management struct {
+	s *Server
+}
+
+// managementActor identifies who made the call in the audit events.
+func managementActor(ctx context.Context) string {
+	actor := "grpc"
+	if id := accessIdentityFrom(ctx); id != nil {
+		actor += " " + id.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		actor += " " + p.Addr.String()
+	}
+	return actor
+}
+
+func parseNodeMAC(mac string) (net.HardwareAddr, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return hw, nil
+}
+
+func (m *management) ListNodes(ctx context.Context, req *wireEmpty) (*mgmtNodeList, error) {
+	return &mgmtNodeList{Nodes: m.s.nodes.list()}, nil
+}
+
+func (m *management) ListNodeHealth(ctx context.Context, req *wireEmpty) (*mgmtNodeHealthList, error) {
+	return &mgmtNodeHealthList{Checks: m.s.nodeHealth.list()}, nil
+}
+
+func (m *management) GetNode(ctx context.Context, req *mgmtNodeRequest) (*mgmtNode, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	node, ok := m.s.nodes.get(m.s.nodes.identity(mac).String())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %s not found", mac)
+	}
+	return &mgmtNode{node}, nil
+}
+
+func (m *management) UpdateNode(ctx context.Context, req *mgmtUpdateNodeRequest) (*mgmtNode, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Update.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := m.s.requireRole(ctx, req.Update.role()); err != nil {
+		return nil, err
+	}
+
+	node, ok := m.s.updateNode(managementActor(ctx), mac, req.Update)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %s not found", mac)
+	}
+	return &mgmtNode{node}, nil
+}
+
+func (m *management) RemoveNode(ctx context.Context, req *mgmtNodeRequest) (*wireEmpty, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.s.deregisterNode(managementActor(ctx), mac) {
+		return nil, status.Errorf(codes.NotFound, "node %s not found", mac)
+	}
+	return &wireEmpty{}, nil
+}
+
+func (m *management) ChangeNodeRole(ctx context.Context, req *mgmtChangeNodeRoleRequest) (*mgmtNode, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Change.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := m.s.requireRole(ctx, req.Change.role()); err != nil {
+		return nil, err
+	}
+
+	node, err := m.s.changeNodeRole(managementActor(ctx), mac, req.Change)
+	switch {
+	case err == errNodeNotFound:
+		return nil, status.Errorf(codes.NotFound, "node %s not found", mac)
+	case err != nil && node.MAC != "":
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtNode{node}, nil
+}
+
+func (m *management) ListEtcdCleanups(ctx context.Context, req *wireEmpty) (*mgmtEtcdCleanupList, error) {
+	return &mgmtEtcdCleanupList{Cleanups: m.s.etcdCleanups.list()}, nil
+}
+
+func (m *management) RemoveEtcdMember(ctx context.Context, req *mgmtNodeRequest) (*wireEmpty, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanup, err := m.s.removeEtcdMember(managementActor(ctx), mac)
+	switch {
+	case err == errNoEtcdCleanup:
+		return nil, status.Errorf(codes.NotFound, "no etcd cleanup suggested for %s", mac)
+	case err != nil && cleanup.MAC != "":
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &wireEmpty{}, nil
+}
+
+func (m *management) ListConfigDrift(ctx context.Context, req *mgmtListConfigDriftRequest) (*mgmtConfigDriftList, error) {
+	return &mgmtConfigDriftList{Drifts: m.s.configDrift(req.All)}, nil
+}
+
+func (m *management) GetPreview(ctx context.Context, req *mgmtPreviewRequest) (*mgmtPreview, error) {
+	preview, err := m.s.preview(req.previewRequest)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !m.s.allowed(ctx, roleAdmin) {
+		preview.redactSecrets()
+	}
+	return &mgmtPreview{preview}, nil
+}
+
+func (m *management) ListConfigVersions(ctx context.Context, req *wireEmpty) (*mgmtConfigVersionList, error) {
+	return &mgmtConfigVersionList{Versions: m.s.configVersions.list()}, nil
+}
+
+func (m *management) GetConfigDiff(ctx context.Context, req *mgmtConfigDiffRequest) (*mgmtVersionDiff, error) {
+	diff, err := m.s.diffConfigVersions(req.From, req.To, req.MAC)
+	switch {
+	case err == errNoConfigVersion:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &mgmtVersionDiff{diff}, nil
+}
+
+func (m *management) ReconcileNode(ctx context.Context, req *mgmtReconcileNodeRequest) (*mgmtNode, error) {
+	mac, err := parseNodeMAC(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Reconcile.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	node, err := m.s.reconcileNode(managementActor(ctx), mac, req.Reconcile)
+	switch {
+	case err == errNodeNotFound:
+		return nil, status.Errorf(codes.NotFound, "node %s not found", mac)
+	case err != nil && node.MAC != "":
+		return nil, status.Error(codes.Unavailable, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtNode{node}, nil
+}
+
+func (m *management) ListLeases(ctx context.Context, req *wireEmpty) (*mgmtLeaseList, error) {
+	return &mgmtLeaseList{Leases: m.s.leases()}, nil
+}
+
+func (m *management) GetLeaseStats(ctx context.Context, req *wireEmpty) (*mgmtLeaseStats, error) {
+	return &mgmtLeaseStats{m.s.leaseStats()}, nil
+}
+
+func (m *management) CompactLeases(ctx context.Context, req *mgmtCompactLeasesRequest) (*mgmtLeaseCompaction, error) {
+	compaction, err := m.s.compactLeases(managementActor(ctx), req.Now)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtLeaseCompaction{compaction}, nil
+}
+
+func (m *management) ListDNSRecords(ctx context.Context, req *wireEmpty) (*mgmtDNSRecordList, error) {
+	return &mgmtDNSRecordList{Records: m.s.DNSRecords.Entries()}, nil
+}
+
+func (m *management) GetAnswerPolicy(ctx context.Context, req *wireEmpty) (*mgmtAnswerStatus, error) {
+	return &mgmtAnswerStatus{m.s.answerOrder.status()}, nil
+}
+
+func (m *management) SetAnswerPolicy(ctx context.Context, req *mgmtAnswerPolicy) (*mgmtAnswerStatus, error) {
+	if err := req.AnswerPolicy.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &mgmtAnswerStatus{m.s.setAnswerPolicy(managementActor(ctx), req.AnswerPolicy)}, nil
+}
+
+func (m *management) ListProfiles(ctx context.Context, req *wireEmpty) (*mgmtProfileList, error) {
+	store := storage.NewFileStore(&storage.Config{Root: m.s.ServerRoot})
+	profiles, err := store.ProfileList()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &mgmtProfileList{}
+	for _, p := range profiles {
+		profile := mgmtProfile{ID: p.Id, Name: p.Name}
+		if p.Boot != nil {
+			profile.Kernel, profile.Initrd, profile.Args = p.Boot.Kernel, p.Boot.Initrd, p.Boot.Args
+		}
+		resp.Profiles = append(resp.Profiles, profile)
+	}
+	return resp, nil
+}
+
+func (m *management) ListEvents(ctx context.Context, req *wireEmpty) (*mgmtEventList, error) {
+	return &mgmtEventList{Events: m.s.audit.list()}, nil
+}
+
+func (m *management) WatchEvents(req *wireEmpty, stream grpc.ServerStream) error {
+	ch := m.s.audit.watch()
+	defer m.s.audit.unwatch(ch)
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watch queue overflow")
+			}
+			if err := stream.SendMsg(&mgmtEvent{event}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (m *management) StartUpgrade(ctx context.Context, req *mgmtStartUpgradeRequest) (*mgmtUpgrade, error) {
+	if err := req.Request.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	upgrade, err := m.s.startUpgrade(managementActor(ctx), req.Request)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtUpgrade{upgrade}, nil
+}
+
+func (m *management) GetUpgrade(ctx context.Context, req *wireEmpty) (*mgmtUpgrade, error) {
+	upgrade, ok := m.s.upgrades.get()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no upgrade was started")
+	}
+	return &mgmtUpgrade{upgrade}, nil
+}
+
+func (m *management) CancelUpgrade(ctx context.Context, req *wireEmpty) (*mgmtUpgrade, error) {
+	upgrade, err := m.s.cancelUpgrade(managementActor(ctx))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtUpgrade{upgrade}, nil
+}
+
+func (m *management) ExportState(ctx context.Context, req *wireEmpty) (*mgmtState, error) {
+	return &mgmtState{m.s.exportState()}, nil
+}
+
+func (m *management) ImportState(ctx context.Context, req *mgmtState) (*mgmtStateImport, error) {
+	imported, err := m.s.importState(managementActor(ctx), req.State)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &mgmtStateImport{imported}, nil
+}
+
+func (m *management) ListBackups(ctx context.Context, req *wireEmpty) (*mgmtBackupList, error) {
+	list, err := m.s.backupList()
+	switch {
+	case err == errNoBackups:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &mgmtBackupList{list}, nil
+}
+
+func (m *management) RunBackup(ctx context.Context, req *wireEmpty) (*mgmtBackupRun, error) {
+	run, err := m.s.backUp(managementActor(ctx))
+	switch {
+	case err == errNoBackups:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &mgmtBackupRun{run}, nil
+}
+
+func (m *management) GetCanary(ctx context.Context, req *wireEmpty) (*mgmtCanary, error) {
+	return &mgmtCanary{m.s.canaryStatus()}, nil
+}
+
+func (m *management) SetCanary(ctx context.Context, req *mgmtCanaryConfig) (*mgmtCanary, error) {
+	if err := req.CanaryConfig.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	config := req.CanaryConfig
+	m.s.setCanary(managementActor(ctx), &config)
+	return &mgmtCanary{m.s.canaryStatus()}, nil
+}
+
+func (m *management) ClearCanary(ctx context.Context, req *wireEmpty) (*wireEmpty, error) {
+	m.s.setCanary(managementActor(ctx), nil)
+	return &wireEmpty{}, nil
+}
+
+func (m *management) PromoteCanary(ctx context.Context, req *wireEmpty) (*mgmtStringList, error) {
+	groups, err := m.s.promoteCanary(managementActor(ctx))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtStringList{groups}, nil
+}
+
+func (m *management) GetDHCP(ctx context.Context, req *wireEmpty) (*mgmtDHCPStatus, error) {
+	return &mgmtDHCPStatus{m.s.dhcpPause.get()}, nil
+}
+
+func (m *management) PauseDHCP(ctx context.Context, req *mgmtPauseDHCPRequest) (*mgmtDHCPStatus, error) {
+	return &mgmtDHCPStatus{m.s.pauseDHCP(managementActor(ctx), req.Reason)}, nil
+}
+
+func (m *management) ResumeDHCP(ctx context.Context, req *wireEmpty) (*mgmtDHCPStatus, error) {
+	return &mgmtDHCPStatus{m.s.resumeDHCP(managementActor(ctx))}, nil
+}
+
+func (m *management) GetProvisioning(ctx context.Context, req *wireEmpty) (*mgmtProvisioningStatus, error) {
+	return &mgmtProvisioningStatus{m.s.provisioningStatus()}, nil
+}
+
+func (m *management) OpenProvisioning(ctx context.Context, req *mgmtProvisioningWindow) (*mgmtProvisioningStatus, error) {
+	if err := req.ProvisioningWindow.check(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	window := req.ProvisioningWindow
+	provisioning, err := m.s.openProvisioning(managementActor(ctx), &window)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &mgmtProvisioningStatus{provisioning}, nil
+}
+
+func (m *management) CloseProvisioning(ctx context.Context, req *wireEmpty) (*wireEmpty, error) {
+	m.s.closeProvisioning(managementActor(ctx))
+	return &wireEmpty{}, nil
+}
+
+// managementMethod adapts a method of the service to a grpc.MethodDesc.
+func managementMethod(name string, newReq func() wireMessage, call func(*management, context.Context, wireMessage) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(*management), ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + managementService + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(*management), ctx, req.(wireMessage))
+			})
+		},
+	}
+}
+
+func newWireEmpty() wireMessage   { return &wireEmpty{} }
+func newNodeRequest() wireMessage { return &mgmtNodeRequest{} }
+
+var managementServiceDesc = grpc.ServiceDesc{
+	ServiceName: managementService,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		managementMethod("ListNodes", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListNodes(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("ListNodeHealth", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListNodeHealth(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetNode", newNodeRequest, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetNode(ctx, req.(*mgmtNodeRequest))
+		}),
+		managementMethod("UpdateNode", func() wireMessage { return &mgmtUpdateNodeRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.UpdateNode(ctx, req.(*mgmtUpdateNodeRequest))
+		}),
+		managementMethod("RemoveNode", newNodeRequest, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.RemoveNode(ctx, req.(*mgmtNodeRequest))
+		}),
+		managementMethod("ChangeNodeRole", func() wireMessage { return &mgmtChangeNodeRoleRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ChangeNodeRole(ctx, req.(*mgmtChangeNodeRoleRequest))
+		}),
+		managementMethod("ListEtcdCleanups", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListEtcdCleanups(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("RemoveEtcdMember", newNodeRequest, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.RemoveEtcdMember(ctx, req.(*mgmtNodeRequest))
+		}),
+		managementMethod("ListConfigDrift", func() wireMessage { return &mgmtListConfigDriftRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListConfigDrift(ctx, req.(*mgmtListConfigDriftRequest))
+		}),
+		managementMethod("GetPreview", func() wireMessage { return &mgmtPreviewRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetPreview(ctx, req.(*mgmtPreviewRequest))
+		}),
+		managementMethod("ListConfigVersions", func() wireMessage { return &wireEmpty{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListConfigVersions(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetConfigDiff", func() wireMessage { return &mgmtConfigDiffRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetConfigDiff(ctx, req.(*mgmtConfigDiffRequest))
+		}),
+		managementMethod("ReconcileNode", func() wireMessage { return &mgmtReconcileNodeRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ReconcileNode(ctx, req.(*mgmtReconcileNodeRequest))
+		}),
+		managementMethod("ListLeases", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListLeases(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetLeaseStats", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetLeaseStats(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("CompactLeases", func() wireMessage { return &mgmtCompactLeasesRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.CompactLeases(ctx, req.(*mgmtCompactLeasesRequest))
+		}),
+		managementMethod("ListDNSRecords", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListDNSRecords(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetAnswerPolicy", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetAnswerPolicy(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("SetAnswerPolicy", func() wireMessage { return &mgmtAnswerPolicy{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.SetAnswerPolicy(ctx, req.(*mgmtAnswerPolicy))
+		}),
+		managementMethod("ListProfiles", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListProfiles(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("ListEvents", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListEvents(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("StartUpgrade", func() wireMessage { return &mgmtStartUpgradeRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.StartUpgrade(ctx, req.(*mgmtStartUpgradeRequest))
+		}),
+		managementMethod("GetUpgrade", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetUpgrade(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("CancelUpgrade", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.CancelUpgrade(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("ExportState", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ExportState(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("ImportState", func() wireMessage { return &mgmtState{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ImportState(ctx, req.(*mgmtState))
+		}),
+		managementMethod("ListBackups", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ListBackups(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("RunBackup", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.RunBackup(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetCanary", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetCanary(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("SetCanary", func() wireMessage { return &mgmtCanaryConfig{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.SetCanary(ctx, req.(*mgmtCanaryConfig))
+		}),
+		managementMethod("ClearCanary", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ClearCanary(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("PromoteCanary", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.PromoteCanary(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetDHCP", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetDHCP(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("PauseDHCP", func() wireMessage { return &mgmtPauseDHCPRequest{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.PauseDHCP(ctx, req.(*mgmtPauseDHCPRequest))
+		}),
+		managementMethod("ResumeDHCP", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.ResumeDHCP(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("GetProvisioning", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.GetProvisioning(ctx, req.(*wireEmpty))
+		}),
+		managementMethod("OpenProvisioning", func() wireMessage { return &mgmtProvisioningWindow{} }, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.OpenProvisioning(ctx, req.(*mgmtProvisioningWindow))
+		}),
+		managementMethod("CloseProvisioning", newWireEmpty, func(m *management, ctx context.Context, req wireMessage) (interface{}, error) {
+			return m.CloseProvisioning(ctx, req.(*wireEmpty))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "WatchEvents",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &wireEmpty{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(*management).WatchEvents(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/management.proto",
+}
+
+func (s *Server) serveManagement(l net.Listener) error {
+	opts := append([]grpc.ServerOption{grpc.ForceServerCodec(wireCodec{})}, s.managementAccessOptions()...)
+	config, err := s.apiTLSConfig(s.ManagementAddr)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&managementServiceDesc, &management{s: s})
+	if _, err := loadManagementFiles(); err != nil {
+		log.Warnf("Not serving gRPC reflection: %s", err)
+	} else {
+		for _, name := range []string{reflectionServiceV1Alpha, reflectionServiceV1} {
+			server.RegisterService(reflectionServiceDesc(name), nil)
+		}
+	}
+
+	if err := server.Serve(l); err != nil {
+		return fmt.Errorf("Management server shut down: %s", err)
+	}
+
+	return nil
+}
+
+// managementClient calls the management API of a running server, for the
+// subcommands.
+type managementClient struct {
+	conn *grpc.ClientConn
+}
+
+func dialManagement(addr string) (*managementClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config, err := apiClientTLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.DialOption{grpc.WithBlock(), grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{}))}
+	if config != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if token := os.Getenv(accessTokenEnv); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: token, secure: config != nil}))
+	}
+	conn, err := grpc.DialContext(ctx, addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the management API on %s: %s", addr, err)
+	}
+	return &managementClient{conn: conn}, nil
+}
+
+func (c *managementClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *managementClient) invoke(method string, req, resp wireMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return c.conn.Invoke(ctx, "/"+managementService+"/"+method, req, resp)
+}
+
+func (c *managementClient) ListNodes() ([]Node, error) {
+	resp := &mgmtNodeList{}
+	err := c.invoke("ListNodes", &wireEmpty{}, resp)
+	return resp.Nodes, err
+}
+
+func (c *managementClient) ListNodeHealth() ([]NodeHealth, error) {
+	resp := &mgmtNodeHealthList{}
+	err := c.invoke("ListNodeHealth", &wireEmpty{}, resp)
+	return resp.Checks, err
+}
+
+func (c *managementClient) UpdateNode(mac string, update nodeUpdate) (Node, error) {
+	resp := &mgmtNode{}
+	err := c.invoke("UpdateNode", &mgmtUpdateNodeRequest{MAC: mac, Update: update}, resp)
+	return resp.Node, err
+}
+
+func (c *managementClient) RemoveNode(mac string) error {
+	return c.invoke("RemoveNode", &mgmtNodeRequest{MAC: mac}, &wireEmpty{})
+}
+
+func (c *managementClient) ChangeNodeRole(mac string, change roleChange) (Node, error) {
+	resp := &mgmtNode{}
+	err := c.invoke("ChangeNodeRole", &mgmtChangeNodeRoleRequest{MAC: mac, Change: change}, resp)
+	return resp.Node, err
+}
+
+func (c *managementClient) ListEtcdCleanups() ([]EtcdCleanup, error) {
+	resp := &mgmtEtcdCleanupList{}
+	err := c.invoke("ListEtcdCleanups", &wireEmpty{}, resp)
+	return resp.Cleanups, err
+}
+
+func (c *managementClient) RemoveEtcdMember(mac string) error {
+	return c.invoke("RemoveEtcdMember", &mgmtNodeRequest{MAC: mac}, &wireEmpty{})
+}
+
+func (c *managementClient) ListConfigDrift(all bool) ([]ConfigDrift, error) {
+	resp := &mgmtConfigDriftList{}
+	err := c.invoke("ListConfigDrift", &mgmtListConfigDriftRequest{All: all}, resp)
+	return resp.Drifts, err
+}
+
+func (c *managementClient) GetPreview(r previewRequest) (Preview, error) {
+	resp := &mgmtPreview{}
+	err := c.invoke("GetPreview", &mgmtPreviewRequest{r}, resp)
+	return resp.Preview, err
+}
+
+func (c *managementClient) ListConfigVersions() ([]ConfigVersion, error) {
+	resp := &mgmtConfigVersionList{}
+	err := c.invoke("ListConfigVersions", &wireEmpty{}, resp)
+	return resp.Versions, err
+}
+
+func (c *managementClient) GetConfigDiff(from, to int, mac string) (VersionDiff, error) {
+	resp := &mgmtVersionDiff{}
+	err := c.invoke("GetConfigDiff", &mgmtConfigDiffRequest{From: from, To: to, MAC: mac}, resp)
+	return resp.VersionDiff, err
+}
+
+func (c *managementClient) ReconcileNode(mac string, r reconcile) (Node, error) {
+	resp := &mgmtNode{}
+	err := c.invoke("ReconcileNode", &mgmtReconcileNodeRequest{MAC: mac, Reconcile: r}, resp)
+	return resp.Node, err
+}
+
+func (c *managementClient) ListEvents() ([]AuditEvent, error) {
+	resp := &mgmtEventList{}
+	err := c.invoke("ListEvents", &wireEmpty{}, resp)
+	return resp.Events, err
+}
+
+func (c *managementClient) StartUpgrade(req upgradeRequest) (Upgrade, error) {
+	resp := &mgmtUpgrade{}
+	err := c.invoke("StartUpgrade", &mgmtStartUpgradeRequest{req}, resp)
+	return resp.Upgrade, err
+}
+
+func (c *managementClient) GetUpgrade() (Upgrade, error) {
+	resp := &mgmtUpgrade{}
+	err := c.invoke("GetUpgrade", &wireEmpty{}, resp)
+	return resp.Upgrade, err
+}
+
+func (c *managementClient) CancelUpgrade() (Upgrade, error) {
+	resp := &mgmtUpgrade{}
+	err := c.invoke("CancelUpgrade", &wireEmpty{}, resp)
+	return resp.Upgrade, err
+}
+
+func (c *managementClient) ExportState() (State, error) {
+	resp := &mgmtState{}
+	err := c.invoke("ExportState", &wireEmpty{}, resp)
+	return resp.State, err
+}
+
+func (c *managementClient) ImportState(st State) (StateImport, error) {
+	resp := &mgmtStateImport{}
+	err := c.invoke("ImportState", &mgmtState{st}, resp)
+	return resp.StateImport, err
+}
+
+func (c *managementClient) ListBackups() (BackupList, error) {
+	resp := &mgmtBackupList{}
+	err := c.invoke("ListBackups", &wireEmpty{}, resp)
+	return resp.BackupList, err
+}
+
+func (c *managementClient) RunBackup() (BackupRun, error) {
+	resp := &mgmtBackupRun{}
+	err := c.invoke("RunBackup", &wireEmpty{}, resp)
+	return resp.BackupRun, err
+}
+
+func (c *managementClient) GetCanary() (Canary, error) {
+	resp := &mgmtCanary{}
+	err := c.invoke("GetCanary", &wireEmpty{}, resp)
+	return resp.Canary, err
+}
+
+func (c *managementClient) SetCanary(config CanaryConfig) (Canary, error) {
+	resp := &mgmtCanary{}
+	err := c.invoke("SetCanary", &mgmtCanaryConfig{config}, resp)
+	return resp.Canary, err
+}
+
+func (c *managementClient) ClearCanary() error {
+	return c.invoke("ClearCanary", &wireEmpty{}, &wireEmpty{})
+}
+
+func (c *managementClient) PromoteCanary() ([]string, error) {
+	resp := &mgmtStringList{}
+	err := c.invoke("PromoteCanary", &wireEmpty{}, resp)
+	return resp.Values, err
+}
+
+func (c *managementClient) GetDHCP() (DHCPStatus, error) {
+	resp := &mgmtDHCPStatus{}
+	err := c.invoke("GetDHCP", &wireEmpty{}, resp)
+	return resp.DHCPStatus, err
+}
+
+func (c *managementClient) PauseDHCP(reason string) (DHCPStatus, error) {
+	resp := &mgmtDHCPStatus{}
+	err := c.invoke("PauseDHCP", &mgmtPauseDHCPRequest{Reason: reason}, resp)
+	return resp.DHCPStatus, err
+}
+
+func (c *managementClient) ResumeDHCP() (DHCPStatus, error) {
+	resp := &mgmtDHCPStatus{}
+	err := c.invoke("ResumeDHCP", &wireEmpty{}, resp)
+	return resp.DHCPStatus, err
+}
+
+func (c *managementClient) GetProvisioning() (ProvisioningStatus, error) {
+	resp := &mgmtProvisioningStatus{}
+	err := c.invoke("GetProvisioning", &wireEmpty{}, resp)
+	return resp.ProvisioningStatus, err
+}
+
+func (c *managementClient) OpenProvisioning(window ProvisioningWindow) (ProvisioningStatus, error) {
+	resp := &mgmtProvisioningStatus{}
+	err := c.invoke("OpenProvisioning", &mgmtProvisioningWindow{window}, resp)
+	return resp.ProvisioningStatus, err
+}
+
+func (c *managementClient) CloseProvisioning() error {
+	return c.invoke("CloseProvisioning", &wireEmpty{}, &wireEmpty{})
+}
+
+func (c *managementClient) GetLeaseStats() (LeaseStats, error) {
+	resp := &mgmtLeaseStats{}
+	err := c.invoke("GetLeaseStats", &wireEmpty{}, resp)
+	return resp.LeaseStats, err
+}
+
+func (c *managementClient) CompactLeases(now bool) (LeaseCompaction, error) {
+	resp := &mgmtLeaseCompaction{}
+	err := c.invoke("CompactLeases", &mgmtCompactLeasesRequest{Now: now}, resp)
+	return resp.LeaseCompaction, err
+}
+
+func (c *managementClient) GetAnswerPolicy() (AnswerStatus, error) {
+	resp := &mgmtAnswerStatus{}
+	err := c.invoke("GetAnswerPolicy", &wireEmpty{}, resp)
+	return resp.AnswerStatus, err
+}
+
+func (c *managementClient) SetAnswerPolicy(policy AnswerPolicy) (AnswerStatus, error) {
+	resp := &mgmtAnswerStatus{}
+	err := c.invoke("SetAnswerPolicy", &mgmtAnswerPolicy{policy}, resp)
+	return resp.AnswerStatus, err
+}
+
+// WatchEvents calls fn with every event recorded until ctx is done.
+func (c *managementClient) WatchEvents(ctx context.Context, fn func(AuditEvent)) error {
+	desc := &managementServiceDesc.Streams[0]
+	stream, err := c.conn.NewStream(ctx, desc, "/"+managementService+"/WatchEvents")
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&wireEmpty{}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		event := &mgmtEvent{}
+		if err := stream.RecvMsg(event); err != nil {
+			return err
+		}
+		fn(event.AuditEvent)
+	}
+}
+
+func wireAppendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	m = wireAppendVarint(m, 1, uint64(t.Unix()))
+	if nanos := t.Nanosecond(); nanos != 0 {
+		m = wireAppendVarint(m, 2, uint64(nanos))
+	}
+	return wireAppendBytes(b, num, m)
+}
+
+func wireParseTimestamp(b []byte) (time.Time, error) {
+	var secs, nanos int64
+	err := wireFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		switch num {
+		case 1:
+			secs = int64(n)
+		case 2:
+			nanos = int64(int32(n))
+		}
+		return nil
+	})
+	return time.Unix(secs, nanos).UTC(), err
+}
+
+func wireAppendNonEmpty(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return wireAppendString(b, num, v)
+}
+
+func wireAppendStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for _, key := range sortedKeys(m) {
+		var entry []byte
+		entry = wireAppendString(entry, 1, key)
+		entry = wireAppendString(entry, 2, m[key])
+		b = wireAppendBytes(b, num, entry)
+	}
+	return b
+}
+
+// wireParseMapEntry adds the map entry to m.
+func wireParseMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			key = string(v)
+		case 2:
+			value = string(v)
+		}
+		return nil
+	})
+	m[key] = value
+	return err
+}
+
+type mgmtNodeRequest struct {
+	MAC string
+}
+
+func (m *mgmtNodeRequest) MarshalWire() []byte {
+	return wireAppendString(nil, 1, m.MAC)
+}
+
+func (m *mgmtNodeRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.MAC = string(v)
+		}
+		return nil
+	})
+}
+
+// mgmtUpdateNodeRequest carries the optional fields of the update, which
+// are only on the wire when set.
+type mgmtUpdateNodeRequest struct {
+	MAC    string
+	Update nodeUpdate
+}
+
+func (m *mgmtUpdateNodeRequest) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.MAC)
+	for num, v := range []*string{m.Update.Hostname, m.Update.Role, m.Update.State} {
+		if v != nil {
+			b = wireAppendString(b, protowire.Number(num+2), *v)
+		}
+	}
+	return b
+}
+
+func (m *mgmtUpdateNodeRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		value := string(v)
+		switch num {
+		case 1:
+			m.MAC = value
+		case 2:
+			m.Update.Hostname = &value
+		case 3:
+			m.Update.Role = &value
+		case 4:
+			m.Update.State = &value
+		}
+		return nil
+	})
+}
+
+type mgmtChangeNodeRoleRequest struct {
+	MAC    string
+	Change roleChange
+}
+
+func (m *mgmtChangeNodeRoleRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.MAC)
+	b = wireAppendString(b, 2, m.Change.Role)
+	if m.Change.Reinstall {
+		b = wireAppendVarint(b, 3, protowire.EncodeBool(true))
+	}
+	if m.Change.PowerCycle {
+		b = wireAppendVarint(b, 4, protowire.EncodeBool(true))
+	}
+	return b
+}
+
+func (m *mgmtChangeNodeRoleRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.MAC = string(v)
+		case 2:
+			m.Change.Role = string(v)
+		case 3:
+			m.Change.Reinstall = protowire.DecodeBool(n)
+		case 4:
+			m.Change.PowerCycle = protowire.DecodeBool(n)
+		}
+		return nil
+	})
+}
+
+type mgmtNode struct {
+	Node
+}
+
+func (m *mgmtNode) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendNonEmpty(b, 1, m.Hostname)
+	b = wireAppendNonEmpty(b, 2, m.IP)
+	b = wireAppendNonEmpty(b, 3, m.MAC)
+	b = wireAppendNonEmpty(b, 4, m.Role)
+	b = wireAppendStringMap(b, 5, m.Labels)
+	b = wireAppendTimestamp(b, 6, m.Booted)
+	b = wireAppendNonEmpty(b, 7, m.State)
+	b = wireAppendNonEmpty(b, 8, m.Version)
+	b = wireAppendNonEmpty(b, 9, m.Serial)
+	b = wireAppendNonEmpty(b, 10, m.Config)
+	b = wireAppendNonEmpty(b, 11, m.ConfigSHA256)
+	b = wireAppendTimestamp(b, 12, m.ConfigServed)
+	b = wireAppendNonEmpty(b, 13, m.ConfigURL)
+	return b
+}
+
+func (m *mgmtNode) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.Hostname = string(v)
+		case 2:
+			m.IP = string(v)
+		case 3:
+			m.MAC = string(v)
+		case 4:
+			m.Role = string(v)
+		case 5:
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			return wireParseMapEntry(v, m.Labels)
+		case 6:
+			t, err := wireParseTimestamp(v)
+			m.Booted = t
+			return err
+		case 7:
+			m.State = string(v)
+		case 8:
+			m.Version = string(v)
+		case 9:
+			m.Serial = string(v)
+		case 10:
+			m.Config = string(v)
+		case 11:
+			m.ConfigSHA256 = string(v)
+		case 12:
+			t, err := wireParseTimestamp(v)
+			m.ConfigServed = t
+			return err
+		case 13:
+			m.ConfigURL = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtNodeHealthList struct {
+	Checks []NodeHealth
+}
+
+// The latency goes in microseconds, as a varint.
+func (m *mgmtNodeHealthList) MarshalWire() []byte {
+	var b []byte
+	for _, check := range m.Checks {
+		var c []byte
+		c = wireAppendString(c, 1, check.MAC)
+		c = wireAppendString(c, 2, check.IP)
+		if check.Reachable {
+			c = wireAppendVarint(c, 3, protowire.EncodeBool(true))
+		}
+		c = wireAppendNonEmpty(c, 4, check.Version)
+		c = wireAppendVarint(c, 5, uint64(check.Latency*1e6))
+		c = wireAppendNonEmpty(c, 6, check.Error)
+		c = wireAppendTimestamp(c, 7, check.Checked)
+		c = wireAppendTimestamp(c, 8, check.Since)
+		b = wireAppendBytes(b, 1, c)
+	}
+	return b
+}
+
+func (m *mgmtNodeHealthList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var check NodeHealth
+		err := wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+			var err error
+			switch num {
+			case 1:
+				check.MAC = string(v)
+			case 2:
+				check.IP = string(v)
+			case 3:
+				check.Reachable = protowire.DecodeBool(n)
+			case 4:
+				check.Version = string(v)
+			case 5:
+				check.Latency = float64(n) / 1e6
+			case 6:
+				check.Error = string(v)
+			case 7:
+				check.Checked, err = wireParseTimestamp(v)
+			case 8:
+				check.Since, err = wireParseTimestamp(v)
+			}
+			return err
+		})
+		m.Checks = append(m.Checks, check)
+		return err
+	})
+}
+
+type mgmtEtcdCleanupList struct {
+	Cleanups []EtcdCleanup
+}
+
+func (m *mgmtEtcdCleanupList) MarshalWire() []byte {
+	var b []byte
+	for _, cleanup := range m.Cleanups {
+		var c []byte
+		c = wireAppendString(c, 1, cleanup.MAC)
+		c = wireAppendString(c, 2, cleanup.IP)
+		c = wireAppendNonEmpty(c, 3, cleanup.Hostname)
+		c = wireAppendString(c, 4, cleanup.Reason)
+		c = wireAppendTimestamp(c, 5, cleanup.Since)
+		c = wireAppendString(c, 6, cleanup.Through)
+		for _, command := range cleanup.Commands {
+			c = wireAppendString(c, 7, command)
+		}
+		b = wireAppendBytes(b, 1, c)
+	}
+	return b
+}
+
+func (m *mgmtEtcdCleanupList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var cleanup EtcdCleanup
+		err := wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			var err error
+			switch num {
+			case 1:
+				cleanup.MAC = string(v)
+			case 2:
+				cleanup.IP = string(v)
+			case 3:
+				cleanup.Hostname = string(v)
+			case 4:
+				cleanup.Reason = string(v)
+			case 5:
+				cleanup.Since, err = wireParseTimestamp(v)
+			case 6:
+				cleanup.Through = string(v)
+			case 7:
+				cleanup.Commands = append(cleanup.Commands, string(v))
+			}
+			return err
+		})
+		m.Cleanups = append(m.Cleanups, cleanup)
+		return err
+	})
+}
+
+type mgmtListConfigDriftRequest struct {
+	All bool
+}
+
+func (m *mgmtListConfigDriftRequest) MarshalWire() []byte {
+	if !m.All {
+		return nil
+	}
+	return wireAppendVarint(nil, 1, protowire.EncodeBool(true))
+}
+
+func (m *mgmtListConfigDriftRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		if num == 1 {
+			m.All = protowire.DecodeBool(n)
+		}
+		return nil
+	})
+}
+
+type mgmtConfigDriftList struct {
+	Drifts []ConfigDrift
+}
+
+func (m *mgmtConfigDriftList) MarshalWire() []byte {
+	var b []byte
+	for _, drift := range m.Drifts {
+		var d []byte
+		d = wireAppendString(d, 1, drift.MAC)
+		d = wireAppendString(d, 2, drift.IP)
+		d = wireAppendNonEmpty(d, 3, drift.Hostname)
+		d = wireAppendString(d, 4, drift.Config)
+		d = wireAppendTimestamp(d, 5, drift.Served)
+		d = wireAppendString(d, 6, drift.ServedSHA256)
+		d = wireAppendNonEmpty(d, 7, drift.CurrentSHA256)
+		if drift.Drifted {
+			d = wireAppendVarint(d, 8, protowire.EncodeBool(true))
+		}
+		d = wireAppendNonEmpty(d, 9, drift.Error)
+		b = wireAppendBytes(b, 1, d)
+	}
+	return b
+}
+
+func (m *mgmtConfigDriftList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var drift ConfigDrift
+		err := wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+			var err error
+			switch num {
+			case 1:
+				drift.MAC = string(v)
+			case 2:
+				drift.IP = string(v)
+			case 3:
+				drift.Hostname = string(v)
+			case 4:
+				drift.Config = string(v)
+			case 5:
+				drift.Served, err = wireParseTimestamp(v)
+			case 6:
+				drift.ServedSHA256 = string(v)
+			case 7:
+				drift.CurrentSHA256 = string(v)
+			case 8:
+				drift.Drifted = protowire.DecodeBool(n)
+			case 9:
+				drift.Error = string(v)
+			}
+			return err
+		})
+		m.Drifts = append(m.Drifts, drift)
+		return err
+	})
+}
+
+type mgmtPreviewRequest struct {
+	previewRequest
+}
+
+func (m *mgmtPreviewRequest) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.MAC)
+	b = wireAppendNonEmpty(b, 2, m.Role)
+	b = wireAppendNonEmpty(b, 3, m.IP)
+	return wireAppendStringMap(b, 4, m.Selectors)
+}
+
+func (m *mgmtPreviewRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.MAC = string(v)
+		case 2:
+			m.Role = string(v)
+		case 3:
+			m.IP = string(v)
+		case 4:
+			if m.Selectors == nil {
+				m.Selectors = make(map[string]string)
+			}
+			return wireParseMapEntry(v, m.Selectors)
+		}
+		return nil
+	})
+}
+
+type mgmtPreview struct {
+	Preview
+}
+
+func (m *mgmtPreview) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.MAC)
+	b = wireAppendNonEmpty(b, 2, m.IP)
+	b = wireAppendString(b, 3, m.Role)
+	b = wireAppendString(b, 4, m.Script)
+	b = wireAppendNonEmpty(b, 5, m.Config)
+	b = wireAppendNonEmpty(b, 6, m.MachineConfig)
+	for _, problem := range m.Problems {
+		b = wireAppendString(b, 7, problem)
+	}
+	return b
+}
+
+func (m *mgmtPreview) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.MAC = string(v)
+		case 2:
+			m.IP = string(v)
+		case 3:
+			m.Role = string(v)
+		case 4:
+			m.Script = string(v)
+		case 5:
+			m.Config = string(v)
+		case 6:
+			m.MachineConfig = string(v)
+		case 7:
+			m.Problems = append(m.Problems, string(v))
+		}
+		return nil
+	})
+}
+
+type mgmtConfigVersionList struct {
+	Versions []ConfigVersion
+}
+
+func (m *mgmtConfigVersionList) MarshalWire() []byte {
+	var b []byte
+	for _, version := range m.Versions {
+		v := wireAppendVarint(nil, 1, uint64(version.ID))
+		v = wireAppendTimestamp(v, 2, version.Created)
+		for _, file := range version.Files {
+			v = wireAppendString(v, 3, file)
+		}
+		for _, mac := range version.Nodes {
+			v = wireAppendString(v, 4, mac)
+		}
+		b = wireAppendBytes(b, 1, v)
+	}
+	return b
+}
+
+func (m *mgmtConfigVersionList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var version ConfigVersion
+		err := wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+			var err error
+			switch num {
+			case 1:
+				version.ID = int(n)
+			case 2:
+				version.Created, err = wireParseTimestamp(v)
+			case 3:
+				version.Files = append(version.Files, string(v))
+			case 4:
+				version.Nodes = append(version.Nodes, string(v))
+			}
+			return err
+		})
+		m.Versions = append(m.Versions, version)
+		return err
+	})
+}
+
+type mgmtConfigDiffRequest struct {
+	From int
+	To   int
+	MAC  string
+}
+
+func (m *mgmtConfigDiffRequest) MarshalWire() []byte {
+	var b []byte
+	if m.From != 0 {
+		b = wireAppendVarint(b, 1, uint64(m.From))
+	}
+	if m.To != 0 {
+		b = wireAppendVarint(b, 2, uint64(m.To))
+	}
+	return wireAppendNonEmpty(b, 3, m.MAC)
+}
+
+func (m *mgmtConfigDiffRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.From = int(n)
+		case 2:
+			m.To = int(n)
+		case 3:
+			m.MAC = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtVersionDiff struct {
+	VersionDiff
+}
+
+func (m *mgmtVersionDiff) MarshalWire() []byte {
+	b := wireAppendVarint(nil, 1, uint64(m.From))
+	b = wireAppendVarint(b, 2, uint64(m.To))
+	for _, file := range m.Files {
+		b = wireAppendString(b, 3, file)
+	}
+	for _, node := range m.Nodes {
+		d := wireAppendString(nil, 1, node.MAC)
+		d = wireAppendString(d, 2, node.Role)
+		d = wireAppendNonEmpty(d, 3, node.Script)
+		d = wireAppendNonEmpty(d, 4, node.MachineConfig)
+		b = wireAppendBytes(b, 4, d)
+	}
+	return b
+}
+
+func (m *mgmtVersionDiff) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.From = int(n)
+		case 2:
+			m.To = int(n)
+		case 3:
+			m.Files = append(m.Files, string(v))
+		case 4:
+			var node NodeDiff
+			err := wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					node.MAC = string(v)
+				case 2:
+					node.Role = string(v)
+				case 3:
+					node.Script = string(v)
+				case 4:
+					node.MachineConfig = string(v)
+				}
+				return nil
+			})
+			m.Nodes = append(m.Nodes, node)
+			return err
+		}
+		return nil
+	})
+}
+
+type mgmtReconcileNodeRequest struct {
+	MAC       string
+	Reconcile reconcile
+}
+
+func (m *mgmtReconcileNodeRequest) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.MAC)
+	if m.Reconcile.PowerCycle {
+		b = wireAppendVarint(b, 2, protowire.EncodeBool(true))
+	}
+	b = wireAppendNonEmpty(b, 3, m.Reconcile.Method)
+	return wireAppendNonEmpty(b, 4, m.Reconcile.Mode)
+}
+
+func (m *mgmtReconcileNodeRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.MAC = string(v)
+		case 2:
+			m.Reconcile.PowerCycle = protowire.DecodeBool(n)
+		case 3:
+			m.Reconcile.Method = string(v)
+		case 4:
+			m.Reconcile.Mode = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtNodeList struct {
+	Nodes []Node
+}
+
+func (m *mgmtNodeList) MarshalWire() []byte {
+	var b []byte
+	for _, node := range m.Nodes {
+		b = wireAppendBytes(b, 1, (&mgmtNode{node}).MarshalWire())
+	}
+	return b
+}
+
+func (m *mgmtNodeList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			node := &mgmtNode{}
+			if err := node.UnmarshalWire(v); err != nil {
+				return err
+			}
+			m.Nodes = append(m.Nodes, node.Node)
+		}
+		return nil
+	})
+}
+
+type mgmtLeaseList struct {
+	Leases []Lease
+}
+
+func (m *mgmtLeaseList) MarshalWire() []byte {
+	var b []byte
+	for _, lease := range m.Leases {
+		var l []byte
+		l = wireAppendString(l, 1, lease.MAC)
+		l = wireAppendString(l, 2, lease.IP)
+		l = wireAppendTimestamp(l, 3, lease.Expires)
+		if lease.Quarantined {
+			l = wireAppendVarint(l, 4, protowire.EncodeBool(true))
+		}
+		if lease.Pinned {
+			l = wireAppendVarint(l, 5, protowire.EncodeBool(true))
+		}
+		b = wireAppendBytes(b, 1, l)
+	}
+	return b
+}
+
+func (m *mgmtLeaseList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var lease Lease
+		err := wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+			var err error
+			switch num {
+			case 1:
+				lease.MAC = string(v)
+			case 2:
+				lease.IP = string(v)
+			case 3:
+				lease.Expires, err = wireParseTimestamp(v)
+			case 4:
+				lease.Quarantined = protowire.DecodeBool(n)
+			case 5:
+				lease.Pinned = protowire.DecodeBool(n)
+			}
+			return err
+		})
+		m.Leases = append(m.Leases, lease)
+		return err
+	})
+}
+
+type mgmtLeaseStats struct {
+	LeaseStats
+}
+
+func (m *mgmtLeaseStats) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendTimestamp(b, 1, m.Since)
+	b = wireAppendVarint(b, 2, uint64(m.Granted))
+	b = wireAppendVarint(b, 3, uint64(m.Renewed))
+	b = wireAppendVarint(b, 4, uint64(m.Released))
+	b = wireAppendVarint(b, 5, uint64(m.Expired))
+	b = wireAppendVarint(b, 6, uint64(m.Leases))
+	b = wireAppendVarint(b, 7, uint64(m.Active))
+	b = wireAppendVarint(b, 8, uint64(m.Pinned))
+	b = wireAppendVarint(b, 9, uint64(m.Quarantined))
+	if p := m.Pool; p != nil {
+		var pool []byte
+		pool = wireAppendString(pool, 1, p.Start)
+		pool = wireAppendString(pool, 2, p.End)
+		pool = wireAppendVarint(pool, 3, uint64(p.Total))
+		pool = wireAppendVarint(pool, 4, uint64(p.Used))
+		pool = wireAppendVarint(pool, 5, uint64(p.Free))
+		pool = wireAppendVarint(pool, 6, uint64(p.FreeBlocks))
+		pool = wireAppendVarint(pool, 7, uint64(p.LargestFreeBlock))
+		b = wireAppendBytes(b, 10, pool)
+	}
+	for _, lease := range m.Oldest {
+		var l []byte
+		l = wireAppendString(l, 1, lease.MAC)
+		l = wireAppendString(l, 2, lease.IP)
+		l = wireAppendTimestamp(l, 3, lease.Granted)
+		b = wireAppendBytes(b, 11, l)
+	}
+	return b
+}
+
+func (m *mgmtLeaseStats) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Since, err = wireParseTimestamp(v)
+		case 2:
+			m.Granted = int(n)
+		case 3:
+			m.Renewed = int(n)
+		case 4:
+			m.Released = int(n)
+		case 5:
+			m.Expired = int(n)
+		case 6:
+			m.Leases = int(n)
+		case 7:
+			m.Active = int(n)
+		case 8:
+			m.Pinned = int(n)
+		case 9:
+			m.Quarantined = int(n)
+		case 10:
+			pool := &poolStats{}
+			err = wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					pool.Start = string(v)
+				case 2:
+					pool.End = string(v)
+				case 3:
+					pool.Total = int(n)
+				case 4:
+					pool.Used = int(n)
+				case 5:
+					pool.Free = int(n)
+				case 6:
+					pool.FreeBlocks = int(n)
+				case 7:
+					pool.LargestFreeBlock = int(n)
+				}
+				return nil
+			})
+			pool.setRatios()
+			m.Pool = pool
+		case 11:
+			var lease LeaseAge
+			err = wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				var err error
+				switch num {
+				case 1:
+					lease.MAC = string(v)
+				case 2:
+					lease.IP = string(v)
+				case 3:
+					lease.Granted, err = wireParseTimestamp(v)
+				}
+				return err
+			})
+			m.Oldest = append(m.Oldest, lease)
+		}
+		return err
+	})
+}
+
+type mgmtCompactLeasesRequest struct {
+	Now bool
+}
+
+func (m *mgmtCompactLeasesRequest) MarshalWire() []byte {
+	if !m.Now {
+		return nil
+	}
+	return wireAppendVarint(nil, 1, protowire.EncodeBool(true))
+}
+
+func (m *mgmtCompactLeasesRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		if num == 1 {
+			m.Now = protowire.DecodeBool(n)
+		}
+		return nil
+	})
+}
+
+type mgmtLeaseCompaction struct {
+	LeaseCompaction
+}
+
+func (m *mgmtLeaseCompaction) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendVarint(b, 1, uint64(m.Collected))
+	b = wireAppendVarint(b, 2, uint64(m.Pins))
+	b = wireAppendVarint(b, 3, uint64(m.StalePins))
+	return b
+}
+
+func (m *mgmtLeaseCompaction) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.Collected = int(n)
+		case 2:
+			m.Pins = int(n)
+		case 3:
+			m.StalePins = int(n)
+		}
+		return nil
+	})
+}
+
+type mgmtDNSRecordList struct {
+	Records []DNSEntry
+}
+
+func (m *mgmtDNSRecordList) MarshalWire() []byte {
+	var b []byte
+	for _, entry := range m.Records {
+		var r []byte
+		r = wireAppendString(r, 1, entry.Name)
+		r = wireAppendString(r, 2, entry.Type)
+		r = wireAppendString(r, 3, entry.Data)
+		b = wireAppendBytes(b, 1, r)
+	}
+	return b
+}
+
+func (m *mgmtDNSRecordList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var entry DNSEntry
+		err := wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			switch num {
+			case 1:
+				entry.Name = string(v)
+			case 2:
+				entry.Type = string(v)
+			case 3:
+				entry.Data = string(v)
+			}
+			return nil
+		})
+		m.Records = append(m.Records, entry)
+		return err
+	})
+}
+
+type mgmtProfile struct {
+	ID     string
+	Name   string
+	Kernel string
+	Initrd []string
+	Args   []string
+}
+
+type mgmtProfileList struct {
+	Profiles []mgmtProfile
+}
+
+func (m *mgmtProfileList) MarshalWire() []byte {
+	var b []byte
+	for _, profile := range m.Profiles {
+		var p []byte
+		p = wireAppendString(p, 1, profile.ID)
+		p = wireAppendNonEmpty(p, 2, profile.Name)
+		p = wireAppendNonEmpty(p, 3, profile.Kernel)
+		for _, initrd := range profile.Initrd {
+			p = wireAppendString(p, 4, initrd)
+		}
+		for _, arg := range profile.Args {
+			p = wireAppendString(p, 5, arg)
+		}
+		b = wireAppendBytes(b, 1, p)
+	}
+	return b
+}
+
+func (m *mgmtProfileList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var profile mgmtProfile
+		err := wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			switch num {
+			case 1:
+				profile.ID = string(v)
+			case 2:
+				profile.Name = string(v)
+			case 3:
+				profile.Kernel = string(v)
+			case 4:
+				profile.Initrd = append(profile.Initrd, string(v))
+			case 5:
+				profile.Args = append(profile.Args, string(v))
+			}
+			return nil
+		})
+		m.Profiles = append(m.Profiles, profile)
+		return err
+	})
+}
+
+type mgmtEvent struct {
+	AuditEvent
+}
+
+func (m *mgmtEvent) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendTimestamp(b, 1, m.Time)
+	b = wireAppendNonEmpty(b, 2, m.Action)
+	b = wireAppendNonEmpty(b, 3, m.Node)
+	b = wireAppendNonEmpty(b, 4, m.Actor)
+	b = wireAppendNonEmpty(b, 5, m.Detail)
+	return b
+}
+
+func (m *mgmtEvent) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Time, err = wireParseTimestamp(v)
+		case 2:
+			m.Action = string(v)
+		case 3:
+			m.Node = string(v)
+		case 4:
+			m.Actor = string(v)
+		case 5:
+			m.Detail = string(v)
+		}
+		return err
+	})
+}
+
+type mgmtEventList struct {
+	Events []AuditEvent
+}
+
+func (m *mgmtEventList) MarshalWire() []byte {
+	var b []byte
+	for _, event := range m.Events {
+		b = wireAppendBytes(b, 1, (&mgmtEvent{event}).MarshalWire())
+	}
+	return b
+}
+
+func (m *mgmtEventList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			event := &mgmtEvent{}
+			if err := event.UnmarshalWire(v); err != nil {
+				return err
+			}
+			m.Events = append(m.Events, event.AuditEvent)
+		}
+		return nil
+	})
+}
+
+type mgmtStartUpgradeRequest struct {
+	Request upgradeRequest
+}
+
+func (m *mgmtStartUpgradeRequest) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendString(b, 1, m.Request.Version)
+	b = wireAppendString(b, 2, m.Request.Method)
+	return b
+}
+
+func (m *mgmtStartUpgradeRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.Request.Version = string(v)
+		case 2:
+			m.Request.Method = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtUpgrade struct {
+	Upgrade
+}
+
+func (m *mgmtUpgrade) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendNonEmpty(b, 1, m.Version)
+	b = wireAppendNonEmpty(b, 2, m.Method)
+	b = wireAppendNonEmpty(b, 3, m.Status)
+	b = wireAppendTimestamp(b, 4, m.Started)
+	b = wireAppendTimestamp(b, 5, m.Finished)
+	for _, node := range m.Nodes {
+		var n []byte
+		n = wireAppendNonEmpty(n, 1, node.MAC)
+		n = wireAppendNonEmpty(n, 2, node.Name)
+		n = wireAppendNonEmpty(n, 3, node.Role)
+		n = wireAppendNonEmpty(n, 4, node.Status)
+		n = wireAppendTimestamp(n, 5, node.Started)
+		n = wireAppendTimestamp(n, 6, node.Finished)
+		n = wireAppendNonEmpty(n, 7, node.Error)
+		b = wireAppendBytes(b, 6, n)
+	}
+	return b
+}
+
+func (m *mgmtUpgrade) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Version = string(v)
+		case 2:
+			m.Method = string(v)
+		case 3:
+			m.Status = string(v)
+		case 4:
+			m.Started, err = wireParseTimestamp(v)
+		case 5:
+			m.Finished, err = wireParseTimestamp(v)
+		case 6:
+			var node UpgradeNode
+			err = wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				var err error
+				switch num {
+				case 1:
+					node.MAC = string(v)
+				case 2:
+					node.Name = string(v)
+				case 3:
+					node.Role = string(v)
+				case 4:
+					node.Status = string(v)
+				case 5:
+					node.Started, err = wireParseTimestamp(v)
+				case 6:
+					node.Finished, err = wireParseTimestamp(v)
+				case 7:
+					node.Error = string(v)
+				}
+				return err
+			})
+			m.Nodes = append(m.Nodes, node)
+		}
+		return err
+	})
+}
+
+type mgmtCanaryConfig struct {
+	CanaryConfig
+}
+
+func (m *mgmtCanaryConfig) MarshalWire() []byte {
+	var b []byte
+	if m.Percent != 0 {
+		b = wireAppendVarint(b, 1, uint64(m.Percent))
+	}
+	return wireAppendStringMap(b, 2, m.Selector)
+}
+
+func (m *mgmtCanaryConfig) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.Percent = int(int32(n))
+		case 2:
+			if m.Selector == nil {
+				m.Selector = make(map[string]string)
+			}
+			return wireParseMapEntry(v, m.Selector)
+		}
+		return nil
+	})
+}
+
+type mgmtCanary struct {
+	Canary
+}
+
+func (m *mgmtCanary) MarshalWire() []byte {
+	var b []byte
+	if config := (&mgmtCanaryConfig{m.CanaryConfig}).MarshalWire(); len(config) > 0 {
+		b = wireAppendBytes(b, 1, config)
+	}
+	for _, node := range m.Nodes {
+		b = wireAppendString(b, 2, node)
+	}
+	return b
+}
+
+func (m *mgmtCanary) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			config := &mgmtCanaryConfig{}
+			if err := config.UnmarshalWire(v); err != nil {
+				return err
+			}
+			m.CanaryConfig = config.CanaryConfig
+		case 2:
+			m.Nodes = append(m.Nodes, string(v))
+		}
+		return nil
+	})
+}
+
+// mgmtStringList is any message with only a repeated string field 1.
+type mgmtStringList struct {
+	Values []string
+}
+
+func (m *mgmtStringList) MarshalWire() []byte {
+	var b []byte
+	for _, v := range m.Values {
+		b = wireAppendString(b, 1, v)
+	}
+	return b
+}
+
+func (m *mgmtStringList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.Values = append(m.Values, string(v))
+		}
+		return nil
+	})
+}
+
+type mgmtState struct {
+	State
+}
+
+func (m *mgmtState) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendVarint(b, 1, uint64(m.Version))
+	b = wireAppendTimestamp(b, 2, m.Exported)
+	b = wireAppendBytes(b, 3, (&mgmtLeaseList{m.Leases}).MarshalWire())
+	b = wireAppendBytes(b, 4, (&mgmtNodeList{m.Nodes}).MarshalWire())
+	b = wireAppendBytes(b, 5, (&mgmtDNSRecordList{m.DNS}).MarshalWire())
+	return b
+}
+
+func (m *mgmtState) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Version = int(n)
+		case 2:
+			m.Exported, err = wireParseTimestamp(v)
+		case 3:
+			leases := &mgmtLeaseList{}
+			err = leases.UnmarshalWire(v)
+			m.Leases = append(m.Leases, leases.Leases...)
+		case 4:
+			nodes := &mgmtNodeList{}
+			err = nodes.UnmarshalWire(v)
+			m.Nodes = append(m.Nodes, nodes.Nodes...)
+		case 5:
+			records := &mgmtDNSRecordList{}
+			err = records.UnmarshalWire(v)
+			m.DNS = append(m.DNS, records.Records...)
+		}
+		return err
+	})
+}
+
+type mgmtStateImport struct {
+	StateImport
+}
+
+func (m *mgmtStateImport) MarshalWire() []byte {
+	var b []byte
+	b = wireAppendVarint(b, 1, uint64(m.Leases))
+	b = wireAppendVarint(b, 2, uint64(m.Nodes))
+	b = wireAppendVarint(b, 3, uint64(m.DNS))
+	return b
+}
+
+func (m *mgmtStateImport) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.Leases = int(n)
+		case 2:
+			m.Nodes = int(n)
+		case 3:
+			m.DNS = int(n)
+		}
+		return nil
+	})
+}
+
+type mgmtBackupRun struct {
+	BackupRun
+}
+
+func (m *mgmtBackupRun) MarshalWire() []byte {
+	b := wireAppendNonEmpty(nil, 1, m.Name)
+	b = wireAppendTimestamp(b, 2, m.Started)
+	b = wireAppendVarint(b, 3, uint64(m.Size))
+	return wireAppendNonEmpty(b, 4, m.Error)
+}
+
+func (m *mgmtBackupRun) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Name = string(v)
+		case 2:
+			m.Started, err = wireParseTimestamp(v)
+		case 3:
+			m.Size = int64(n)
+		case 4:
+			m.Error = string(v)
+		}
+		return err
+	})
+}
+
+type mgmtBackupList struct {
+	BackupList
+}
+
+func (m *mgmtBackupList) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.Target)
+	for _, name := range m.Backups {
+		b = wireAppendString(b, 2, name)
+	}
+	if m.Last != nil {
+		b = wireAppendBytes(b, 3, (&mgmtBackupRun{*m.Last}).MarshalWire())
+	}
+	return b
+}
+
+func (m *mgmtBackupList) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.Target = string(v)
+		case 2:
+			m.Backups = append(m.Backups, string(v))
+		case 3:
+			last := &mgmtBackupRun{}
+			if err := last.UnmarshalWire(v); err != nil {
+				return err
+			}
+			m.Last = &last.BackupRun
+		}
+		return nil
+	})
+}
+
+type mgmtAnswerPolicy struct {
+	AnswerPolicy
+}
+
+func (m *mgmtAnswerPolicy) MarshalWire() []byte {
+	b := wireAppendNonEmpty(nil, 1, m.Order)
+	return wireAppendNonEmpty(b, 2, m.Primary)
+}
+
+func (m *mgmtAnswerPolicy) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.Order = string(v)
+		case 2:
+			m.Primary = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtAnswerStatus struct {
+	AnswerStatus
+}
+
+// The latency goes in microseconds, as a varint.
+func (m *mgmtAnswerStatus) MarshalWire() []byte {
+	b := wireAppendBytes(nil, 1, (&mgmtAnswerPolicy{m.AnswerPolicy}).MarshalWire())
+	for _, probe := range m.Probes {
+		var p []byte
+		p = wireAppendString(p, 1, probe.IP)
+		if probe.Healthy {
+			p = wireAppendVarint(p, 2, protowire.EncodeBool(true))
+		}
+		p = wireAppendVarint(p, 3, uint64(probe.Latency*1e6))
+		b = wireAppendBytes(b, 2, p)
+	}
+	return b
+}
+
+func (m *mgmtAnswerStatus) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			policy := &mgmtAnswerPolicy{}
+			if err := policy.UnmarshalWire(v); err != nil {
+				return err
+			}
+			m.AnswerPolicy = policy.AnswerPolicy
+		case 2:
+			var probe ControlplaneProbe
+			if err := wireFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					probe.IP = string(v)
+				case 2:
+					probe.Healthy = protowire.DecodeBool(n)
+				case 3:
+					probe.Latency = float64(n) / 1e6
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			m.Probes = append(m.Probes, probe)
+		}
+		return nil
+	})
+}
+
+type mgmtPauseDHCPRequest struct {
+	Reason string
+}
+
+func (m *mgmtPauseDHCPRequest) MarshalWire() []byte {
+	return wireAppendNonEmpty(nil, 1, m.Reason)
+}
+
+func (m *mgmtPauseDHCPRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.Reason = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtDHCPStatus struct {
+	DHCPStatus
+}
+
+func (m *mgmtDHCPStatus) MarshalWire() []byte {
+	var b []byte
+	if m.Paused {
+		b = wireAppendVarint(b, 1, protowire.EncodeBool(true))
+	}
+	b = wireAppendTimestamp(b, 2, m.Since)
+	b = wireAppendNonEmpty(b, 3, m.By)
+	b = wireAppendNonEmpty(b, 4, m.Reason)
+	return b
+}
+
+func (m *mgmtDHCPStatus) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Paused = protowire.DecodeBool(n)
+		case 2:
+			m.Since, err = wireParseTimestamp(v)
+		case 3:
+			m.By = string(v)
+		case 4:
+			m.Reason = string(v)
+		}
+		return err
+	})
+}
+
+type mgmtProvisioningWindow struct {
+	ProvisioningWindow
+}
+
+func (m *mgmtProvisioningWindow) MarshalWire() []byte {
+	var b []byte
+	for _, mac := range m.MACs {
+		b = wireAppendString(b, 1, mac)
+	}
+	if m.Count != 0 {
+		b = wireAppendVarint(b, 2, uint64(m.Count))
+	}
+	return wireAppendNonEmpty(b, 3, m.Duration)
+}
+
+func (m *mgmtProvisioningWindow) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.MACs = append(m.MACs, string(v))
+		case 2:
+			m.Count = int(int32(n))
+		case 3:
+			m.Duration = string(v)
+		}
+		return nil
+	})
+}
+
+type mgmtProvisioningStatus struct {
+	ProvisioningStatus
+}
+
+func (m *mgmtProvisioningStatus) MarshalWire() []byte {
+	var b []byte
+	if m.Frozen {
+		b = wireAppendVarint(b, 1, protowire.EncodeBool(true))
+	}
+	if m.Open {
+		b = wireAppendVarint(b, 2, protowire.EncodeBool(true))
+		b = wireAppendBytes(b, 3, (&mgmtProvisioningWindow{m.ProvisioningWindow}).MarshalWire())
+	}
+	b = wireAppendTimestamp(b, 4, m.Closes)
+	b = wireAppendNonEmpty(b, 5, m.By)
+	for _, mac := range m.Admitted {
+		b = wireAppendString(b, 6, mac)
+	}
+	return b
+}
+
+func (m *mgmtProvisioningStatus) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Frozen = protowire.DecodeBool(n)
+		case 2:
+			m.Open = protowire.DecodeBool(n)
+		case 3:
+			window := &mgmtProvisioningWindow{}
+			err = window.UnmarshalWire(v)
+			m.ProvisioningWindow = window.ProvisioningWindow
+		case 4:
+			m.Closes, err = wireParseTimestamp(v)
+		case 5:
+			m.By = string(v)
+		case 6:
+			m.Admitted = append(m.Admitted, string(v))
+		}
+		return err
+	})
+}
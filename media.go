@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// `talos-pxe media create` writes a small UEFI bootable USB or ISO image
+// with the iPXE binary of the server root, and an autoexec.ipxe script
+// next to it which iPXE runs, chaining to the server's menu. It boots
+// machines without network boot firmware, or the first node of a new
+// site, without building iPXE. BIOS machines need the images of
+// `talos-pxe ipxe-build`.
+
+const (
+	mediaLabel = "TALOS-PXE"
+
+	// The partition of the USB image starts at 1MiB.
+	mediaPartitionStart = 2048
+
+	isoSectorSize = 2048
+)
+
+var mediaEFINames = map[string]string{
+	"amd64": "BOOTX64.EFI",
+	"arm64": "BOOTAA64.EFI",
+}
+
+func runMedia(args []string) error {
+	flags := flag.NewFlagSet("media", flag.ExitOnError)
+	urlFlag := flags.String("url", fmt.Sprintf("http://192.168.123.1:%d", portHTTP), "URL of the server for iPXE to chain to")
+	rootFlag := flags.String("root", ".", "Server root with the iPXE binary")
+	ipxeFlag := flags.String("ipxe", "", "iPXE EFI binary (default <root>/ipxe.efi)")
+	archFlag := flags.String("arch", "amd64", "Architecture of the iPXE binary, amd64 or arm64")
+	formatFlag := flags.String("format", "usb", "Image format, usb or iso")
+	outputFlag := flags.StringP("output", "o", "", "Image to write (default talos-pxe.img or talos-pxe.iso)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "create" {
+		return fmt.Errorf("Usage: %s media create [flags]", os.Args[0])
+	}
+	if u, err := url.Parse(*urlFlag); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid server URL %q", *urlFlag)
+	}
+	efiName, ok := mediaEFINames[*archFlag]
+	if !ok {
+		return fmt.Errorf("Unsupported architecture %q", *archFlag)
+	}
+
+	ipxe := *ipxeFlag
+	if ipxe == "" {
+		ipxe = filepath.Join(*rootFlag, "ipxe.efi")
+	}
+	efi, err := ioutil.ReadFile(ipxe)
+	if err != nil {
+		return err
+	}
+
+	img := newFATImage(mediaLabel)
+	img.add("EFI/BOOT/"+efiName, efi)
+	// iPXE looks for the script in the directory it was loaded from, or
+	// in the root, depending on the version.
+	script := []byte(ipxeEmbedScript(*urlFlag))
+	img.add("EFI/BOOT/autoexec.ipxe", script)
+	img.add("autoexec.ipxe", script)
+
+	var out []byte
+	switch *formatFlag {
+	case "usb":
+		img.hidden = mediaPartitionStart
+		fs, err := img.bytes()
+		if err != nil {
+			return err
+		}
+		out = mbrImage(fs)
+	case "iso":
+		fs, err := img.bytes()
+		if err != nil {
+			return err
+		}
+		out = isoImage(fs)
+	default:
+		return fmt.Errorf("Unsupported format %q", *formatFlag)
+	}
+
+	name := *outputFlag
+	if name == "" {
+		name = "talos-pxe.img"
+		if *formatFlag == "iso" {
+			name = "talos-pxe.iso"
+		}
+	}
+	if err := ioutil.WriteFile(name, out, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, booting into the menu of %s\n", name, *urlFlag)
+	return nil
+}
+
+// mbrImage puts the file system into the EFI system partition of a disk
+// image.
+func mbrImage(fs []byte) []byte {
+	out := make([]byte, mediaPartitionStart*fatSectorSize+len(fs))
+	le := binary.LittleEndian
+
+	le.PutUint32(out[440:], uint32(time.Now().Unix()))
+	entry := out[446:462]
+	entry[0] = 0x80
+	// CHS addresses are unused, as for partitions past what they can
+	// address.
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = 0xef
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	le.PutUint32(entry[8:], mediaPartitionStart)
+	le.PutUint32(entry[12:], uint32(len(fs)/fatSectorSize))
+	out[510], out[511] = 0x55, 0xaa
+
+	copy(out[mediaPartitionStart*fatSectorSize:], fs)
+	return out
+}
+
+// isoImage writes an ISO 9660 image with the file system as its El Torito
+// EFI boot image.
+func isoImage(fs []byte) []byte {
+	const (
+		pvdSector     = 16
+		bootSector    = 17
+		termSector    = 18
+		catalogSector = 19
+		lPathSector   = 20
+		mPathSector   = 21
+		rootSector    = 22
+		imageSector   = 23
+	)
+	imageSectors := (len(fs) + isoSectorSize - 1) / isoSectorSize
+	total := imageSector + imageSectors
+	out := make([]byte, total*isoSectorSize)
+	sector := func(n int) []byte {
+		return out[n*isoSectorSize : (n+1)*isoSectorSize]
+	}
+	le, be := binary.LittleEndian, binary.BigEndian
+	both32 := func(b []byte, v uint32) {
+		le.PutUint32(b, v)
+		be.PutUint32(b[4:], v)
+	}
+	both16 := func(b []byte, v uint16) {
+		le.PutUint16(b, v)
+		be.PutUint16(b[2:], v)
+	}
+
+	now := time.Now().UTC()
+	dirRecord := func(b []byte, id byte) {
+		b[0] = 34
+		both32(b[2:], rootSector)
+		both32(b[10:], isoSectorSize)
+		b[18] = byte(now.Year() - 1900)
+		b[19] = byte(now.Month())
+		b[20] = byte(now.Day())
+		b[21] = byte(now.Hour())
+		b[22] = byte(now.Minute())
+		b[23] = byte(now.Second())
+		b[25] = 0x02
+		both16(b[28:], 1)
+		b[32] = 1
+		b[33] = id
+	}
+	isoString := func(b []byte, s string) {
+		copy(b, fatPad(s, len(b)))
+	}
+	stamp := []byte(now.Format("20060102150405") + "00\x00")
+
+	pvd := sector(pvdSector)
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	pvd[6] = 1
+	isoString(pvd[8:40], "")
+	isoString(pvd[40:72], strings.Replace(mediaLabel, "-", "_", -1))
+	both32(pvd[80:], uint32(total))
+	both16(pvd[120:], 1)
+	both16(pvd[124:], 1)
+	both16(pvd[128:], isoSectorSize)
+	both32(pvd[132:], 10)
+	le.PutUint32(pvd[140:], lPathSector)
+	be.PutUint32(pvd[148:], mPathSector)
+	dirRecord(pvd[156:190], 0)
+	isoString(pvd[190:318], "")
+	isoString(pvd[318:446], "")
+	isoString(pvd[446:574], "")
+	isoString(pvd[574:702], "TALOS-PXE")
+	isoString(pvd[702:813], "")
+	copy(pvd[813:], stamp)
+	copy(pvd[830:], stamp)
+	copy(pvd[847:], "0000000000000000\x00")
+	copy(pvd[864:], stamp)
+	pvd[881] = 1
+
+	boot := sector(bootSector)
+	copy(boot[1:6], "CD001")
+	boot[6] = 1
+	copy(boot[7:], "EL TORITO SPECIFICATION")
+	le.PutUint32(boot[71:], catalogSector)
+
+	term := sector(termSector)
+	term[0] = 255
+	copy(term[1:6], "CD001")
+	term[6] = 1
+
+	// The validation entry, its words summing up to 0, and the default
+	// entry booting the image without emulation.
+	catalog := sector(catalogSector)
+	catalog[0] = 1
+	catalog[1] = 0xef
+	copy(catalog[4:28], "TALOS-PXE")
+	catalog[30], catalog[31] = 0x55, 0xaa
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += le.Uint16(catalog[i:])
+	}
+	le.PutUint16(catalog[28:], -sum)
+	catalog[32] = 0x88
+	sectors := len(fs) / 512
+	if sectors > 0xffff {
+		// The whole image is used by EFI firmware anyway.
+		sectors = 0xffff
+	}
+	le.PutUint16(catalog[38:], uint16(sectors))
+	le.PutUint32(catalog[40:], imageSector)
+
+	for _, table := range []struct {
+		sector int
+		order  binary.ByteOrder
+	}{{lPathSector, le}, {mPathSector, be}} {
+		p := sector(table.sector)
+		p[0] = 1
+		table.order.PutUint32(p[2:], rootSector)
+		table.order.PutUint16(p[6:], 1)
+	}
+
+	root := sector(rootSector)
+	dirRecord(root[0:34], 0)
+	dirRecord(root[34:68], 1)
+
+	copy(out[imageSector*isoSectorSize:], fs)
+	return out
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are served in the Prometheus format on the admin listener
+// under /metrics, and in the OpenMetrics format with exemplars to
+// scrapers asking for it.
+
+var (
+	dnsQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dns",
+		Name:      "queries_total",
+		Help:      "DNS queries answered from the local records, by query type and response code.",
+	}, []string{"type", "rcode"})
+
+	dnsStoreWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dns",
+		Name:      "store_writes_total",
+		Help:      "Updates of the DNS record store.",
+	})
+
+	dnsStoreWriteWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dns",
+		Name:      "store_write_wait_seconds",
+		Help:      "Time spent waiting for the DNS record store write lock. Lookups never take a lock.",
+		Buckets:   prometheus.ExponentialBuckets(1e-6, 10, 7),
+	})
+
+	tftpTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "tftp",
+		Name:      "transfers",
+		Help:      "TFTP transfers in progress.",
+	})
+
+	multicastTFTPSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "tftp",
+		Name:      "multicast_sessions",
+		Help:      "Multicast TFTP sessions in progress.",
+	})
+
+	multicastTFTPClients = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "tftp",
+		Name:      "multicast_clients_total",
+		Help:      "Clients of multicast TFTP sessions, by joined, completed, aborted or dropped after not acknowledging as master.",
+	}, []string{"result"})
+
+	multicastTFTPBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "tftp",
+		Name:      "multicast_blocks_sent_total",
+		Help:      "Blocks sent to the multicast TFTP groups.",
+	})
+
+	tftpRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "tftp",
+		Name:      "rejected_transfers_total",
+		Help:      "TFTP transfers refused because the transfer limit was reached.",
+	})
+
+	renderCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "render_cache",
+		Name:      "hits_total",
+		Help:      "Rendered configs and scripts served from the cache.",
+	})
+
+	renderCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "render_cache",
+		Name:      "misses_total",
+		Help:      "Rendered configs and scripts which had to be rendered.",
+	})
+
+	mirrorRedirects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "mirror_redirects_total",
+		Help:      "Boot image downloads redirected to a mirror, by mirror.",
+	}, []string{"mirror"})
+
+	leasesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dhcp",
+		Name:      "expired_leases_total",
+		Help:      "Expired or released leases collected after the grace period.",
+	})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Name:      "rate_limited_packets_total",
+		Help:      "Packets dropped because their client exceeded the rate limit, by service.",
+	}, []string{"service"})
+
+	installReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "install_reports_total",
+		Help:      "Install stages reported by the nodes, by stage: downloading-installer, writing-disk, rebooting, installed or other.",
+	}, []string{"stage"})
+
+	httpProxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http_proxy",
+		Name:      "requests_total",
+		Help:      "Requests to the HTTP proxy, by whether the host was allowed.",
+	}, []string{"result"})
+
+	configTokenChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "config_tokens",
+		Name:      "checks_total",
+		Help:      "Config requests checked for a token, by whether they were accepted.",
+	}, []string{"result"})
+
+	reportChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "reports",
+		Name:      "checks_total",
+		Help:      "Install progress and inventory reports checked for the node they're for, by whether they were accepted.",
+	}, []string{"result"})
+
+	clientCertChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "client_certs",
+		Name:      "checks_total",
+		Help:      "Boot script and matchbox config requests checked for a client certificate, by whether they were accepted.",
+	}, []string{"result"})
+
+	accessChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "access",
+		Name:      "checks_total",
+		Help:      "Admin and management API requests checked for a token, by API and whether they were allowed.",
+	}, []string{"api", "result"})
+
+	exportedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "export",
+		Name:      "events_total",
+		Help:      "Audit and boot events exported, by sink type and whether they were sent, failed to send or were dropped.",
+	}, []string{"sink", "result"})
+
+	renders = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "renders",
+		Help:      "Matchbox templates and machine configs being rendered.",
+	})
+
+	renderLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "render_limited_requests_total",
+		Help:      "Requests to render refused, by whether the client had too many in flight or all workers were busy.",
+	}, []string{"reason"})
+
+	bootMilestones = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "boot",
+		Name:      "milestone_seconds",
+		Help:      "Time from the start of a boot attempt to the menu, the config fetch and the end of the install, by milestone and pinned Talos version. Exemplars carry the MAC and trace ID.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 120, 180, 300, 450, 600, 900, 1200, 1800},
+	}, []string{"milestone", "version"})
+
+	inventoryReports = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "inventory_reports_total",
+		Help:      "Hardware inventories reported by the nodes.",
+	})
+
+	installDiskChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "install_disk_checks_total",
+		Help:      "Install disks of served machine configs checked against the reported disks, by whether they were found, or unknown.",
+	}, []string{"result"})
+
+	jobRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Name:      "job_runs_total",
+		Help:      "Runs of the scheduled jobs, by job and whether they were done, failed to power cycle nodes or were skipped outside the maintenance windows or while frozen.",
+	}, []string{"job", "result"})
+
+	chaosFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Name:      "chaos_failures_total",
+		Help:      "Failures injected with --chaos, by protocol.",
+	}, []string{"protocol"})
+
+	dhcpPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dhcp",
+		Name:      "paused",
+		Help:      "Whether DHCP and ProxyDHCP answering is paused.",
+	})
+
+	dhcpPausedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "dhcp",
+		Name:      "paused_requests_total",
+		Help:      "Requests left unanswered while DHCP was paused, by protocol.",
+	}, []string{"protocol"})
+
+	nodesReachable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "nodes",
+		Name:      "talos_api_reachable",
+		Help:      "Nodes whose Talos API answered the last health check, or didn't.",
+	}, []string{"reachable"})
+
+	backupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Name:      "backups_total",
+		Help:      "Backups uploaded to the backup target, by result.",
+	}, []string{"result"})
+
+	backupLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Name:      "backup_last_success_timestamp_seconds",
+		Help:      "When the last backup was uploaded.",
+	})
+
+	nodesConfigDrifted = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "nodes",
+		Name:      "config_drifted",
+		Help:      "Nodes whose machine config changed since it was served.",
+	})
+
+	etcdCleanupsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "etcd",
+		Name:      "cleanups_pending",
+		Help:      "Controlplane nodes which look gone, still to be removed from etcd.",
+	})
+
+	hookRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "hooks",
+		Name:      "runs_total",
+		Help:      "Hook runs by event and whether they approved, refused, succeeded, failed, were dropped or, for pre-offer, weren't run as too many were running.",
+	}, []string{"event", "result"})
+
+	invalidMachineConfigs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "http",
+		Name:      "invalid_machine_configs_total",
+		Help:      "Machine configs refused for not matching the schema, when fetched or checked for a boot script.",
+	})
+
+	configVersionsRecorded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "config",
+		Name:      "versions_total",
+		Help:      "Config versions recorded, whenever the store changed what it renders to.",
+	})
+
+	clientClockSkew = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "talos_pxe",
+		Subsystem: "boot",
+		Name:      "client_clock_skew_seconds",
+		Help:      "How far off the clocks the clients report are from the server's, either way.",
+		Buckets:   []float64{1, 10, 60, 300, 3600, 86400, 30 * 86400, 365 * 86400},
+	})
+)
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mirrorCheckInterval = 30 * time.Second
+)
+
+// Large fleets pulling the kernel and initramfs from a single NIC during
+// a rollout saturate it. Boot images can be spread over mirrors, e.g.
+// other talos-pxe instances or HTTP caches serving the same assets: every
+// client is redirected to one of the healthy mirrors or served locally,
+// picked by hashing its address so that retries land on the same one.
+
+type assetMirror struct {
+	url     *url.URL
+	healthy int32
+}
+
+func newAssetMirrors(urls []string) ([]*assetMirror, error) {
+	var mirrors []*assetMirror
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+		mirrors = append(mirrors, &assetMirror{url: parsed, healthy: 1})
+	}
+	return mirrors, nil
+}
+
+func (m *assetMirror) isHealthy() bool {
+	return atomic.LoadInt32(&m.healthy) == 1
+}
+
+// check marks the mirror healthy if it serves the assets directory, a
+// 404 means it doesn't have the assets at all.
+func (m *assetMirror) check(client *http.Client) {
+	healthy := int32(0)
+
+	resp, err := client.Head(m.url.String() + "/assets/")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusBadRequest {
+			healthy = 1
+		}
+	}
+
+	if old := atomic.SwapInt32(&m.healthy, healthy); old != healthy {
+		if healthy == 1 {
+			log.Infof("Asset mirror %s is back up", m.url)
+		} else {
+			log.Warnf("Asset mirror %s is down, not redirecting to it", m.url)
+		}
+	}
+}
+
+// checkMirrors periodically checks the health of the mirrors. It never
+// returns.
+func (s *Server) checkMirrors() {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for {
+		for _, m := range s.mirrors {
+			m.check(client)
+		}
+		time.Sleep(mirrorCheckInterval)
+	}
+}
+
+func isBootImagePath(name string) bool {
+	if !strings.HasPrefix(name, "/assets/") {
+		return false
+	}
+
+	base := path.Base(name)
+	return strings.HasPrefix(base, "vmlinuz") || strings.HasPrefix(base, "initramfs") ||
+		strings.HasSuffix(base, ".img") || strings.HasSuffix(base, ".iso")
+}
+
+// mirrorHandler redirects boot image downloads to the mirrors.
+func (s *Server) mirrorHandler(next http.Handler) http.Handler {
+	if len(s.mirrors) == 0 {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		if (req.Method != http.MethodGet && req.Method != http.MethodHead) || !isBootImagePath(name) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		var healthy []*assetMirror
+		for _, m := range s.mirrors {
+			if m.isHealthy() {
+				healthy = append(healthy, m)
+			}
+		}
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		h := fnv.New32a()
+		h.Write([]byte(host))
+
+		// The server itself is the first choice.
+		i := int(h.Sum32() % uint32(len(healthy)+1))
+		if i == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		mirror := healthy[i-1]
+		target := *mirror.url
+		target.Path += name
+		target.RawQuery = req.URL.RawQuery
+
+		mirrorRedirects.WithLabelValues(mirror.url.Host).Inc()
+		log.Debugf("Redirecting %s to %s", host, target.String())
+		http.Redirect(w, req, target.String(), http.StatusFound)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Boot scripts can also fall back to other servers when downloading the
+// kernel or initramfs fails, e.g. because the server is restarted during
+// a rollout: the kernel and initrd commands are chained with || to the
+// same command on every fallback mirror in turn.
+
+func checkFallbackMirrors(urls []string) ([]string, error) {
+	var out []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("%s isn't an HTTP URL", u)
+		}
+		out = append(out, strings.TrimSuffix(u, "/"))
+	}
+	return out, nil
+}
+
+// bootImageURLPath returns the path of the boot image the iPXE URL, which
+// may be relative or contain settings, points at.
+func bootImageURLPath(u string) (string, bool) {
+	if i := strings.Index(u, "://"); i >= 0 {
+		j := strings.Index(u[i+3:], "/")
+		if j < 0 {
+			return "", false
+		}
+		u = u[i+3+j:]
+	}
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+
+	name := path.Clean("/" + u)
+	return name, isBootImagePath(name)
+}
+
+// bootImageCommand splits a kernel or initrd command of a boot script,
+// returning the index of its boot image URL and the path of the image.
+func bootImageCommand(line string) ([]string, int, string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || (fields[0] != "kernel" && fields[0] != "initrd") {
+		return nil, 0, "", false
+	}
+
+	// Skip the options of the command to the image.
+	image := 1
+	for image < len(fields) && strings.HasPrefix(fields[image], "-") {
+		image++
+	}
+	if image == len(fields) {
+		return nil, 0, "", false
+	}
+	name, ok := bootImageURLPath(fields[image])
+	return fields, image, name, ok
+}
+
+// withFallbackMirrors makes the kernel and initrd commands of the boot
+// script fall back to the fallback mirrors.
+func (s *Server) withFallbackMirrors(script []byte) []byte {
+	if len(s.FallbackMirrors) == 0 {
+		return script
+	}
+
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "||") {
+			continue
+		}
+		fields, image, name, ok := bootImageCommand(line)
+		if !ok {
+			continue
+		}
+
+		commands := []string{strings.TrimSpace(line)}
+		for _, mirror := range s.FallbackMirrors {
+			fallback := append([]string{}, fields...)
+			fallback[image] = mirror + name
+			commands = append(commands, strings.Join(fallback, " "))
+		}
+		lines[i] = strings.Join(commands, " || ")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
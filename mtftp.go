@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// A rack booting at once downloads the same kernel and initramfs once per
+// machine. With --multicast-tftp, boot images are also served over
+// multicast TFTP (RFC 2090), which iPXE speaks through tftm:// URLs when
+// built with DOWNLOAD_PROTO_TFTM (`talos-pxe ipxe-build
+// --multicast-tftp`): every client asking for the same image joins the
+// same session, whose blocks are sent once to a multicast group. One
+// client at a time, the master, acknowledges the blocks and paces the
+// session; the others fill the gaps they have when they become master in
+// turn. The boot scripts try tftm:// first and fall back to HTTP, so iPXE
+// builds without multicast TFTP boot as before.
+//
+// Block numbers are 16 bits and iPXE guesses where they wrap around from
+// the blocks it already has, which goes wrong for clients joining late,
+// so only images of at most 65535 blocks are served.
+
+const (
+	portMulticastTFTP = 1758
+
+	mtftpMaxBlockSize = 1432
+	mtftpMaxBlocks    = 65535
+	// Blocks sent ahead of the master's acknowledgements.
+	mtftpWindow     = 16
+	mtftpAckTimeout = 250 * time.Millisecond
+	mtftpRetries    = 4
+	mtftpMaxGroups  = 256
+
+	tftpOpRRQ   = 1
+	tftpOpData  = 3
+	tftpOpAck   = 4
+	tftpOpError = 5
+	tftpOpOACK  = 6
+)
+
+var defaultMulticastTFTPGroup = net.IPv4(239, 255, 84, 0)
+
+type mtftpServer struct {
+	s *Server
+
+	lock     sync.Mutex
+	sessions map[string]*mtftpSession
+	groups   [mtftpMaxGroups]bool
+}
+
+type mtftpClient struct {
+	addr    *net.UDPAddr
+	tsize   bool
+	blksize bool
+	retries int
+}
+
+type mtftpPacket struct {
+	addr  *net.UDPAddr
+	op    uint16
+	block uint16
+}
+
+// mtftpSession sends one image to one multicast group, from its own
+// socket which the clients take as the session's TID.
+type mtftpSession struct {
+	m       *mtftpServer
+	key     string
+	name    string
+	data    []byte
+	blksize int
+	blocks  int
+	index   int
+	group   *net.UDPAddr
+	conn    *net.UDPConn
+	pc      *ipv4.PacketConn
+	joins   chan *mtftpClient
+	packets chan mtftpPacket
+
+	clients []*mtftpClient
+	master  *mtftpClient
+	// Whether the master has to acknowledge its OACK yet.
+	opening bool
+	acked   int
+	sent    int
+	dups    int
+	// When the master was last heard from or sent to.
+	active time.Time
+}
+
+// multicastTFTPFits returns whether the image at the path fits in a
+// multicast TFTP session.
+func (s *Server) multicastTFTPFits(name string) bool {
+	fi, err := os.Stat(filepath.Join(s.ServerRoot, filepath.FromSlash(name)))
+	return err == nil && fi.Mode().IsRegular() && fi.Size()/mtftpMaxBlockSize+1 <= mtftpMaxBlocks
+}
+
+// withMulticastTFTP makes the kernel and initrd commands of the boot
+// script try multicast TFTP first, falling back to the commands as they
+// are.
+func (s *Server) withMulticastTFTP(script []byte) []byte {
+	if !s.MulticastTFTP {
+		return script
+	}
+
+	host := net.JoinHostPort(s.advertisedIP().String(), strconv.Itoa(s.MulticastTFTPPort))
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "tftm://") {
+			continue
+		}
+		fields, image, name, ok := bootImageCommand(line)
+		if !ok || !s.multicastTFTPFits(name) {
+			continue
+		}
+
+		fields[image] = "tftm://" + host + name
+		lines[i] = strings.Join(fields, " ") + " || " + strings.TrimSpace(line)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func parseTFTPRequest(buf []byte) (string, map[string]string, error) {
+	if len(buf) < 2 || binary.BigEndian.Uint16(buf) != tftpOpRRQ {
+		return "", nil, fmt.Errorf("not a read request")
+	}
+	fields := bytes.Split(bytes.TrimSuffix(buf[2:], []byte{0}), []byte{0})
+	if len(fields) < 2 || len(fields)%2 != 0 {
+		return "", nil, fmt.Errorf("malformed read request")
+	}
+	if !strings.EqualFold(string(fields[1]), "octet") {
+		return "", nil, fmt.Errorf("unsupported mode %q", fields[1])
+	}
+
+	opts := make(map[string]string)
+	for i := 2; i < len(fields); i += 2 {
+		opts[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return string(fields[0]), opts, nil
+}
+
+func tftpError(code uint16, msg string) []byte {
+	buf := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(buf, tftpOpError)
+	binary.BigEndian.PutUint16(buf[2:], code)
+	return append(append(buf, msg...), 0)
+}
+
+// serveMulticastTFTP answers the read requests of the clients, which
+// the sessions take over.
+func (s *Server) serveMulticastTFTP(conn net.PacketConn) error {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("Multicast TFTP server shut down: %s", err)
+		}
+
+		if err := s.mtftp.request(buf[:n], addr.(*net.UDPAddr)); err != nil {
+			log.Infof("Refusing multicast TFTP request of %s: %s", addr, err)
+			conn.WriteTo(tftpError(0, err.Error()), addr)
+		}
+	}
+}
+
+func (m *mtftpServer) request(buf []byte, addr *net.UDPAddr) error {
+	filename, opts, err := parseTFTPRequest(buf)
+	if err != nil {
+		return err
+	}
+	if _, ok := opts["multicast"]; !ok {
+		return fmt.Errorf("only multicast transfers are served here")
+	}
+
+	name := path.Clean("/" + filename)
+	if !isBootImagePath(name) {
+		return fmt.Errorf("%s isn't a boot image", name)
+	}
+
+	client := &mtftpClient{addr: addr}
+	blksize := 512
+	if v, ok := opts["blksize"]; ok {
+		if blksize, err = strconv.Atoi(v); err != nil || blksize < 8 {
+			return fmt.Errorf("invalid block size %q", v)
+		}
+		if blksize > mtftpMaxBlockSize {
+			blksize = mtftpMaxBlockSize
+		}
+		client.blksize = true
+	}
+	_, client.tsize = opts["tsize"]
+
+	data, err := m.s.bootFiles.read(filepath.Join(m.s.ServerRoot, filepath.FromSlash(name)))
+	if err != nil {
+		return fmt.Errorf("%s not found", name)
+	}
+	if len(data)/blksize+1 > mtftpMaxBlocks {
+		return fmt.Errorf("%s is too large for multicast TFTP", name)
+	}
+
+	return m.join(name, blksize, data, client)
+}
+
+// join adds the client to the session sending the image, starting one if
+// there's none.
+func (m *mtftpServer) join(name string, blksize int, data []byte, client *mtftpClient) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := fmt.Sprintf("%s/%d", name, blksize)
+	sess, ok := m.sessions[key]
+	if ok && !sameData(sess.data, data) {
+		// The image changed, let the session finish for its clients.
+		delete(m.sessions, key)
+		ok = false
+	}
+	if !ok {
+		var err error
+		if sess, err = m.newSession(key, name, blksize, data); err != nil {
+			return err
+		}
+		m.sessions[key] = sess
+		go sess.run()
+	}
+
+	select {
+	case sess.joins <- client:
+	default:
+		// The client retries its request.
+	}
+	return nil
+}
+
+// sameData returns whether both are the same cached copy of an image.
+func sameData(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+func (m *mtftpServer) newSession(key, name string, blksize int, data []byte) (*mtftpSession, error) {
+	index := -1
+	for i, used := range m.groups {
+		if !used {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("too many multicast TFTP sessions")
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: m.s.IP})
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(conn)
+	pc.SetMulticastTTL(1)
+	if m.s.Intf != "" {
+		if intf, err := net.InterfaceByName(m.s.Intf); err == nil {
+			pc.SetMulticastInterface(intf)
+		}
+	}
+
+	group := make(net.IP, net.IPv4len)
+	copy(group, m.s.MulticastTFTPGroup.To4())
+	group[3] += byte(index)
+	m.groups[index] = true
+
+	log.Infof("Starting multicast TFTP session for %s on %s", name, group)
+	multicastTFTPSessions.Inc()
+
+	return &mtftpSession{
+		m:       m,
+		key:     key,
+		name:    name,
+		data:    data,
+		blksize: blksize,
+		blocks:  len(data)/blksize + 1,
+		index:   index,
+		group:   &net.UDPAddr{IP: group, Port: m.s.MulticastTFTPPort + 1},
+		conn:    conn,
+		pc:      pc,
+		joins:   make(chan *mtftpClient, 64),
+		packets: make(chan mtftpPacket, 64),
+	}, nil
+}
+
+// end stops the session unless a client joined meanwhile.
+func (sess *mtftpSession) end() bool {
+	m := sess.m
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(sess.joins) > 0 {
+		return false
+	}
+	if m.sessions[sess.key] == sess {
+		delete(m.sessions, sess.key)
+	}
+	m.groups[sess.index] = false
+	sess.conn.Close()
+
+	log.Infof("Multicast TFTP session for %s on %s done", sess.name, sess.group.IP)
+	multicastTFTPSessions.Dec()
+	return true
+}
+
+func (sess *mtftpSession) receive() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := sess.conn.ReadFromUDP(buf)
+		if err != nil {
+			close(sess.packets)
+			return
+		}
+		if n < 4 {
+			continue
+		}
+		sess.packets <- mtftpPacket{
+			addr:  addr,
+			op:    binary.BigEndian.Uint16(buf),
+			block: binary.BigEndian.Uint16(buf[2:]),
+		}
+	}
+}
+
+func (sess *mtftpSession) run() {
+	go sess.receive()
+
+	ticker := time.NewTicker(mtftpAckTimeout / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case client := <-sess.joins:
+			sess.joined(client)
+		case p := <-sess.packets:
+			sess.received(p)
+		case <-ticker.C:
+			if time.Since(sess.active) >= mtftpAckTimeout {
+				sess.timeout()
+			}
+		}
+
+		if len(sess.clients) == 0 && sess.end() {
+			// Let the receiver finish.
+			for range sess.packets {
+			}
+			return
+		}
+	}
+}
+
+func (sess *mtftpSession) find(addr *net.UDPAddr) *mtftpClient {
+	for _, c := range sess.clients {
+		if c.addr.IP.Equal(addr.IP) && c.addr.Port == addr.Port {
+			return c
+		}
+	}
+	return nil
+}
+
+func (sess *mtftpSession) remove(client *mtftpClient) {
+	for i, c := range sess.clients {
+		if c == client {
+			sess.clients = append(sess.clients[:i], sess.clients[i+1:]...)
+			break
+		}
+	}
+	if client == sess.master {
+		sess.elect()
+	}
+}
+
+func (sess *mtftpSession) joined(client *mtftpClient) {
+	if c := sess.find(client.addr); c != nil {
+		// A retransmitted request, the OACK got lost.
+		sess.sendOACK(c)
+		return
+	}
+
+	log.Debugf("%s joined the multicast TFTP session for %s", client.addr, sess.name)
+	multicastTFTPClients.WithLabelValues("joined").Inc()
+	sess.clients = append(sess.clients, client)
+	if sess.master == nil {
+		sess.elect()
+	} else {
+		sess.sendOACK(client)
+	}
+}
+
+// elect makes the client which joined last the master, it's the one
+// missing the most blocks.
+func (sess *mtftpSession) elect() {
+	sess.master = nil
+	if len(sess.clients) == 0 {
+		return
+	}
+	sess.master = sess.clients[len(sess.clients)-1]
+	sess.master.retries = 0
+	sess.opening = true
+	sess.active = time.Now()
+	sess.sendOACK(sess.master)
+}
+
+func (sess *mtftpSession) received(p mtftpPacket) {
+	client := sess.find(p.addr)
+	if client == nil {
+		return
+	}
+
+	switch p.op {
+	case tftpOpError:
+		log.Debugf("%s left the multicast TFTP session for %s", client.addr, sess.name)
+		multicastTFTPClients.WithLabelValues("aborted").Inc()
+		sess.remove(client)
+	case tftpOpAck:
+		if client != sess.master {
+			return
+		}
+		client.retries = 0
+		sess.active = time.Now()
+		block := int(p.block)
+		if block >= sess.blocks {
+			multicastTFTPClients.WithLabelValues("completed").Inc()
+			sess.remove(client)
+			return
+		}
+
+		switch {
+		case sess.opening:
+			// Start from the first block the new master is missing.
+			sess.opening = false
+			sess.sent = block
+			sess.dups = 0
+		case block == sess.acked:
+			// The next block got lost, the master acknowledges
+			// every block after it with the same gap.
+			sess.dups++
+			if sess.dups == 3 {
+				sess.sent = block
+			}
+		case block > sess.acked:
+			sess.dups = 0
+		default:
+			// Reordered behind a later one.
+			return
+		}
+		sess.acked = block
+		sess.sendWindow()
+	}
+}
+
+func (sess *mtftpSession) timeout() {
+	master := sess.master
+	if master == nil {
+		return
+	}
+
+	sess.active = time.Now()
+	master.retries++
+	if master.retries > mtftpRetries {
+		log.Debugf("%s dropped from the multicast TFTP session for %s", master.addr, sess.name)
+		multicastTFTPClients.WithLabelValues("dropped").Inc()
+		sess.remove(master)
+		return
+	}
+
+	if sess.opening {
+		sess.sendOACK(master)
+	} else {
+		sess.sent = sess.acked
+		sess.sendWindow()
+	}
+}
+
+func (sess *mtftpSession) sendOACK(client *mtftpClient) {
+	mc := 0
+	if client == sess.master {
+		mc = 1
+	}
+
+	buf := []byte{0, tftpOpOACK}
+	opt := func(name, value string) {
+		buf = append(append(append(append(buf, name...), 0), value...), 0)
+	}
+	opt("multicast", fmt.Sprintf("%s,%d,%d", sess.group.IP, sess.group.Port, mc))
+	if client.blksize {
+		opt("blksize", strconv.Itoa(sess.blksize))
+	}
+	if client.tsize {
+		opt("tsize", strconv.Itoa(len(sess.data)))
+	}
+
+	if _, err := sess.conn.WriteToUDP(buf, client.addr); err != nil {
+		log.Debugf("Sending multicast TFTP OACK to %s: %s", client.addr, err)
+	}
+}
+
+// sendWindow sends the blocks after the master's acknowledgement, up to
+// the window, to the group.
+func (sess *mtftpSession) sendWindow() {
+	buf := make([]byte, 4+sess.blksize)
+	for sess.sent < sess.acked+mtftpWindow && sess.sent < sess.blocks {
+		sess.sent++
+		start := (sess.sent - 1) * sess.blksize
+		end := start + sess.blksize
+		if end > len(sess.data) {
+			end = len(sess.data)
+		}
+
+		binary.BigEndian.PutUint16(buf, tftpOpData)
+		binary.BigEndian.PutUint16(buf[2:], uint16(sess.sent))
+		n := 4 + copy(buf[4:], sess.data[start:end])
+		if _, err := sess.pc.WriteTo(buf[:n], nil, sess.group); err != nil {
+			log.Debugf("Sending multicast TFTP block to %s: %s", sess.group, err)
+			return
+		}
+		multicastTFTPBlocks.Inc()
+	}
+}
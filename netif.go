@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/libcontainer/netlink"
+	"github.com/milosgajdos/tenus"
+)
+
+const (
+	interfaceTypeBridge = "bridge"
+	interfaceTypeBond   = "bond"
+
+	defaultBondMode = "802.3ad"
+)
+
+// InterfaceConfig describes a bridge or bond to create before serving, so
+// that --if can name it instead of a single physical interface.
+type InterfaceConfig struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+	// Bond mode as accepted by the bonding driver, 802.3ad (LACP) by
+	// default.
+	Mode string `json:"mode,omitempty"`
+}
+
+func (ic *InterfaceConfig) check() error {
+	if ok, err := tenus.NetInterfaceNameValid(ic.Name); !ok {
+		return err
+	}
+	if ic.Type != interfaceTypeBridge && ic.Type != interfaceTypeBond {
+		return fmt.Errorf("unknown type %q, should be %s or %s", ic.Type, interfaceTypeBridge, interfaceTypeBond)
+	}
+	if len(ic.Members) == 0 {
+		return fmt.Errorf("no members")
+	}
+	if ic.Mode != "" && ic.Type != interfaceTypeBond {
+		return fmt.Errorf("only bonds have a mode")
+	}
+	return nil
+}
+
+// interfaceMaster returns the name of the bridge or bond the interface
+// belongs to, if any.
+func interfaceMaster(name string) string {
+	master, err := os.Readlink(filepath.Join("/sys/class/net", name, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(master)
+}
+
+// setupInterface creates the bridge or bond unless it exists already, and
+// adds the members missing from it.
+func setupInterface(ic InterfaceConfig) error {
+	_, err := net.InterfaceByName(ic.Name)
+	exists := err == nil
+
+	if !exists {
+		log.Infof("Creating %s %s", ic.Type, ic.Name)
+		if err := netlink.NetworkLinkAdd(ic.Name, ic.Type); err != nil {
+			return fmt.Errorf("Could not create %s %s: %s", ic.Type, ic.Name, err)
+		}
+	}
+
+	master, err := net.InterfaceByName(ic.Name)
+	if err != nil {
+		return err
+	}
+
+	if ic.Type == interfaceTypeBond && !exists {
+		mode := ic.Mode
+		if mode == "" {
+			mode = defaultBondMode
+		}
+		if err := writeBondingAttr(ic.Name, "mode", mode); err != nil {
+			return err
+		}
+		if err := writeBondingAttr(ic.Name, "miimon", "100"); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range ic.Members {
+		if current := interfaceMaster(name); current == ic.Name {
+			continue
+		} else if current != "" {
+			return fmt.Errorf("Interface %s is already part of %s", name, current)
+		}
+
+		member, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("Could not find member %s of %s: %s", name, ic.Name, err)
+		}
+
+		// Bonds only take members which are down.
+		if ic.Type == interfaceTypeBond {
+			if err := netlink.NetworkLinkDown(member); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("Adding %s to %s", name, ic.Name)
+		if err := netlink.NetworkSetMaster(member, master); err != nil {
+			return fmt.Errorf("Could not add %s to %s: %s", name, ic.Name, err)
+		}
+
+		if err := netlink.NetworkLinkUp(member); err != nil {
+			return err
+		}
+	}
+
+	return netlink.NetworkLinkUp(master)
+}
+
+func writeBondingAttr(bond, attr, value string) error {
+	name := filepath.Join("/sys/class/net", bond, "bonding", attr)
+	if err := ioutil.WriteFile(name, []byte(value), 0644); err != nil {
+		return fmt.Errorf("Could not set %s of bond %s to %s: %s", attr, bond, strings.TrimSpace(value), err)
+	}
+	return nil
+}
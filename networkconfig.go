@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Nodes keep asking for DHCP after the install, so an outage of the
+// server takes their addresses with it. With a network section in the
+// config, the machine configs served to a node configure the address it
+// was leased statically, with the gateway and nameservers it got from
+// DHCP and its hostname. The section is the template of the interface,
+// adding the bond and the VLANs the address goes on.
+
+// NetworkConfig is the template of the static network config.
+type NetworkConfig struct {
+	// Interface is the name of the interface, or of the bond. By default
+	// the interface with the MAC of the node is selected.
+	Interface string `json:"interface,omitempty"`
+	// Bond bonds the interfaces, with the address on the bond.
+	Bond *NetworkBond `json:"bond,omitempty"`
+	// VLAN puts the address on the VLAN of the interface.
+	VLAN int `json:"vlan,omitempty"`
+	MTU  int `json:"mtu,omitempty"`
+	// Nameservers replace the server, which DHCP hands out.
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// A NetworkBond bonds interfaces, in balance-rr mode by default.
+type NetworkBond struct {
+	Interfaces []string `json:"interfaces"`
+	Mode       string   `json:"mode,omitempty"`
+}
+
+func (c *NetworkConfig) check() error {
+	if c.Bond != nil {
+		if c.Interface == "" {
+			return fmt.Errorf("bond needs an interface name")
+		}
+		if len(c.Bond.Interfaces) == 0 {
+			return fmt.Errorf("bond needs interfaces")
+		}
+	}
+	if c.VLAN < 0 || c.VLAN > 4094 {
+		return fmt.Errorf("invalid VLAN %d", c.VLAN)
+	}
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %s", ns)
+		}
+	}
+	return nil
+}
+
+// leasedIP returns the address leased to the MAC, or nil if it has none.
+func (s *Server) leasedIP(mac net.HardwareAddr) net.IP {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+	if record, ok := s.DHCPRecords[mac.String()]; ok {
+		return record.IP
+	}
+	return nil
+}
+
+// networkConfigPatch returns the patch configuring the address leased to
+// the node statically, or nil if there's no network section or the node
+// has no lease.
+func (s *Server) networkConfigPatch(mac net.HardwareAddr) machineConfigPatch {
+	if s.Config == nil || s.Config.Network == nil || s.ProxyDHCP || mac == nil {
+		return nil
+	}
+	ip := s.leasedIP(mac)
+	if ip == nil {
+		return nil
+	}
+	c := s.Config.Network
+
+	ones, _ := s.Net.Mask.Size()
+	addresses := []interface{}{fmt.Sprintf("%s/%d", ip, ones)}
+	var routes []interface{}
+	if s.GWIP != nil && !s.GWIP.IsUnspecified() {
+		routes = append(routes, map[interface{}]interface{}{"network": "0.0.0.0/0", "gateway": s.GWIP.String()})
+	}
+	nameservers := []interface{}{s.advertisedIP().String()}
+	if len(c.Nameservers) > 0 {
+		nameservers = nameservers[:0]
+		for _, ns := range c.Nameservers {
+			nameservers = append(nameservers, ns)
+		}
+	}
+	var hostname string
+	if node, ok := s.nodes.get(mac.String()); ok {
+		hostname = node.Hostname
+	}
+
+	return func(cfg map[interface{}]interface{}) error {
+		var interfaces []interface{}
+		if value, ok := getConfigValue(cfg, "machine.network.interfaces"); ok {
+			interfaces, _ = value.([]interface{})
+		}
+
+		// Merge into the interface of the config with the same name,
+		// e.g. the one sharing the controlplane VIP.
+		var ifc map[interface{}]interface{}
+		for _, i := range interfaces {
+			if m, ok := i.(map[interface{}]interface{}); ok && c.Interface != "" && m["interface"] == c.Interface {
+				ifc = m
+			}
+		}
+		if ifc == nil {
+			ifc = make(map[interface{}]interface{})
+			interfaces = append(interfaces, ifc)
+		}
+
+		if c.Interface != "" {
+			ifc["interface"] = c.Interface
+		} else {
+			ifc["deviceSelector"] = map[interface{}]interface{}{"hardwareAddr": mac.String()}
+		}
+		if c.Bond != nil {
+			bond := map[interface{}]interface{}{"mode": "balance-rr"}
+			if c.Bond.Mode != "" {
+				bond["mode"] = c.Bond.Mode
+			}
+			var members []interface{}
+			for _, member := range c.Bond.Interfaces {
+				members = append(members, member)
+			}
+			bond["interfaces"] = members
+			ifc["bond"] = bond
+		}
+		if c.MTU > 0 {
+			ifc["mtu"] = c.MTU
+		}
+		delete(ifc, "dhcp")
+
+		if c.VLAN > 0 {
+			vlan := map[interface{}]interface{}{"vlanId": c.VLAN, "addresses": addresses}
+			if routes != nil {
+				vlan["routes"] = routes
+			}
+			ifc["vlans"] = []interface{}{vlan}
+		} else {
+			ifc["addresses"] = addresses
+			if routes != nil {
+				ifc["routes"] = routes
+			}
+		}
+
+		if err := setConfigValue(cfg, "machine.network.interfaces", interfaces); err != nil {
+			return err
+		}
+		if err := setConfigValue(cfg, "machine.network.nameservers", nameservers); err != nil {
+			return err
+		}
+		if hostname != "" {
+			return setConfigValue(cfg, "machine.network.hostname", hostname)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Machines with several NICs PXE boot from whichever the firmware tries
+// first, and bonded hosts change the MAC they ask for DHCP with. Once a
+// node reports its NICs to the inventory, their MACs are linked to the
+// node: the node is known by the MAC it was first recorded with, DHCP
+// leases it the same address whichever NIC asks, and its boots chain
+// into its role with that MAC. As anyone can report, MACs of other nodes,
+// recorded in the inventory or linked to them, are never taken over: the
+// conflict is logged, and the MAC only linked once an operator removed
+// the other node.
+
+// A NIC is a network interface of the node.
+type NIC struct {
+	Name string `json:"name,omitempty"`
+	MAC  string `json:"mac"`
+}
+
+// checkNICs normalizes the MACs of the NICs.
+func checkNICs(nics []NIC) error {
+	for i := range nics {
+		mac, err := net.ParseMAC(nics[i].MAC)
+		if err != nil {
+			return fmt.Errorf("Invalid MAC %s of NIC %s", nics[i].MAC, nics[i].Name)
+		}
+		nics[i].MAC = mac.String()
+	}
+	return nil
+}
+
+// resolveLocked returns the MAC the node with the MAC is known by. Must
+// be called with the lock held.
+func (ni *nodeInventory) resolveLocked(mac string) string {
+	if primary, ok := ni.aliases[mac]; ok {
+		return primary
+	}
+	return mac
+}
+
+// identity returns the MAC the node with the MAC is known by.
+func (ni *nodeInventory) identity(mac net.HardwareAddr) net.HardwareAddr {
+	if mac == nil {
+		return nil
+	}
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	if primary, ok := ni.aliases[mac.String()]; ok {
+		hw, _ := net.ParseMAC(primary)
+		return hw
+	}
+	return mac
+}
+
+// linkLocked makes the MACs of the node aliases of its MAC. Must be
+// called with the lock held.
+func (ni *nodeInventory) linkLocked(node *Node) {
+	for _, mac := range node.MACs {
+		if mac != node.MAC {
+			ni.aliases[mac] = node.MAC
+		}
+	}
+}
+
+// unlinkLocked forgets the aliases of the node. Must be called with the
+// lock held.
+func (ni *nodeInventory) unlinkLocked(node *Node) {
+	for _, mac := range node.MACs {
+		if ni.aliases[mac] == node.MAC {
+			delete(ni.aliases, mac)
+		}
+	}
+}
+
+// linkNICs links the MACs of the NICs the node reported to it, but for
+// those of other nodes.
+func (s *Server) linkNICs(mac net.HardwareAddr, nics []NIC) {
+	var others []string
+	conflicts := make(map[string]bool)
+	for _, nic := range nics {
+		hw, _ := net.ParseMAC(nic.MAC)
+		owner := s.nodes.identity(hw).String()
+		if nic.MAC == mac.String() || owner == mac.String() {
+			continue
+		}
+		if _, ok := s.nodes.get(owner); ok || owner != nic.MAC {
+			log.Warnf("Not linking NIC %s reported by %s, it belongs to node %s", nic.MAC, mac, owner)
+			conflicts[nic.MAC] = true
+			continue
+		}
+		others = append(others, nic.MAC)
+	}
+
+	linked := false
+	s.nodes.update(mac.String(), func(node *Node) {
+		macs := []string{node.MAC}
+		for _, nic := range nics {
+			if nic.MAC != node.MAC && !conflicts[nic.MAC] {
+				macs = append(macs, nic.MAC)
+			}
+		}
+		if strings.Join(macs, ",") == strings.Join(node.MACs, ",") {
+			return
+		}
+
+		s.nodes.unlinkLocked(node)
+		node.MACs = macs
+		if len(macs) == 1 {
+			node.MACs = nil
+		}
+		s.nodes.linkLocked(node)
+		linked = true
+	})
+	if linked {
+		s.audit.record("inventory", "node.link", mac.String(), strings.Join(others, ", "))
+	}
+}
+
+// identityRequest replaces the MAC of the request with the MAC the node
+// is known by.
+func (s *Server) identityRequest(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil {
+		return req
+	}
+	primary := s.nodes.identity(mac)
+	if primary.String() == mac.String() {
+		return req
+	}
+	log.Debugf("%s is a NIC of %s", mac, primary)
+
+	query.Set("mac", primary.String())
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Once provisioned, the nodes are checked through the Talos API
+// periodically, calling Version on apid with the client certificate of
+// the talosconfig, so that the inventory shows which nodes are still up
+// and what they run. The talosconfig given with --talosconfig is kept in
+// the secrets store, so that later starts without it keep checking.
+
+const (
+	talosconfigSecret = "talosconfig"
+
+	nodeHealthTimeout = 10 * time.Second
+	// How many nodes are checked at once.
+	nodeHealthWorkers = 16
+)
+
+// NodeHealth is the last check of the Talos API of a node.
+type NodeHealth struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Reachable bool      `json:"reachable"`
+	Version   string    `json:"version,omitempty"`
+	Latency   float64   `json:"latency_seconds,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
+	// Since when the node is reachable, or not.
+	Since time.Time `json:"since"`
+}
+
+type nodeHealth struct {
+	lock   sync.Mutex
+	checks map[string]NodeHealth
+}
+
+func (h *nodeHealth) list() []NodeHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	out := []NodeHealth{}
+	for _, check := range h.checks {
+		out = append(out, check)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+func (h *nodeHealth) get(mac string) (NodeHealth, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	check, ok := h.checks[mac]
+	return check, ok
+}
+
+// update replaces the checks, forgetting the nodes not checked.
+func (h *nodeHealth) update(checks []NodeHealth) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	reachable := 0
+	updated := make(map[string]NodeHealth, len(checks))
+	for _, check := range checks {
+		check.Since = check.Checked
+		if old, ok := h.checks[check.MAC]; ok {
+			if old.Reachable == check.Reachable {
+				check.Since = old.Since
+			} else if check.Reachable {
+				log.Infof("Talos API of node %s (%s) is reachable again", check.MAC, check.IP)
+			} else {
+				log.Warnf("Talos API of node %s (%s) is unreachable: %s", check.MAC, check.IP, check.Error)
+			}
+		}
+		if check.Reachable {
+			reachable++
+		}
+		updated[check.MAC] = check
+	}
+	h.checks = updated
+
+	nodesReachable.WithLabelValues("true").Set(float64(reachable))
+	nodesReachable.WithLabelValues("false").Set(float64(len(checks) - reachable))
+}
+
+// loadTalosCredentials sets up the client certificate for the Talos API
+// from the talosconfig given, keeping it in the secrets store, or else
+// from the one kept there.
+func (s *Server) loadTalosCredentials() error {
+	if s.Talosconfig != "" {
+		data, err := ioutil.ReadFile(s.Talosconfig)
+		if err != nil {
+			return err
+		}
+		if s.talosTLS, err = parseTalosTLS(data, s.Talosconfig); err != nil {
+			return err
+		}
+		store, err := s.secretsStore()
+		if err != nil {
+			return err
+		}
+		return store.Put(talosconfigSecret, data)
+	}
+
+	// Not creating a store only to find it empty.
+	if _, err := os.Stat(filepath.Join(s.secretsDir(), secretsStoreFile)); err != nil {
+		return nil
+	}
+	store, err := s.secretsStore()
+	if err != nil {
+		return err
+	}
+	data, ok := store.Get(talosconfigSecret)
+	if !ok {
+		return nil
+	}
+	if s.talosTLS, err = parseTalosTLS(data, talosconfigSecret+" secret"); err != nil {
+		return err
+	}
+	log.Infof("Using the talosconfig kept in the secrets store")
+	return nil
+}
+
+// checkNodesHealth checks the nodes periodically. It never returns.
+func (s *Server) checkNodesHealth() {
+	for {
+		nodes := s.nodes.list()
+		results := make(chan NodeHealth)
+		workers := make(chan struct{}, nodeHealthWorkers)
+		checked := 0
+		for _, node := range nodes {
+			if node.IP == "" {
+				continue
+			}
+			checked++
+			go func(node Node) {
+				workers <- struct{}{}
+				defer func() { <-workers }()
+				results <- s.checkNodeAPI(node)
+			}(node)
+		}
+
+		var checks []NodeHealth
+		for i := 0; i < checked; i++ {
+			checks = append(checks, <-results)
+		}
+		s.nodeHealth.update(checks)
+		for _, check := range checks {
+			if check.Reachable {
+				s.installVerified(check.MAC)
+			}
+		}
+
+		time.Sleep(s.NodeHealthInterval)
+	}
+}
+
+// checkNodeAPI asks the node for its version.
+func (s *Server) checkNodeAPI(node Node) NodeHealth {
+	check := NodeHealth{MAC: node.MAC, IP: node.IP, Checked: time.Now().UTC().Round(time.Second)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nodeHealthTimeout)
+	defer cancel()
+
+	start := time.Now()
+	client, err := dialTalos(ctx, s.talosTLS, node.IP)
+	if err == nil {
+		defer client.Close()
+		check.Version, err = client.Version(ctx)
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Reachable = true
+	check.Latency = time.Since(start).Seconds()
+	return check
+}
+
+func (s *Server) nodeHealthHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.nodeHealth.list())
+}
+
+// runNodesHealth prints the last checks of the Talos API of the nodes.
+func runNodesHealth(args []string) error {
+	flags := flag.NewFlagSet("nodes health", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	flags.Parse(args)
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	checks, err := client.ListNodeHealth()
+	if err != nil {
+		return err
+	}
+	if len(checks) == 0 {
+		fmt.Println("No nodes checked, the server needs a talosconfig")
+		return nil
+	}
+	for _, check := range checks {
+		status := "reachable"
+		if !check.Reachable {
+			status = "unreachable"
+		}
+		fmt.Printf("%s\t%s\t%s for %s\t%s%s\n", check.MAC, check.IP, status, ago(check.Since), check.Version, check.Error)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// What a machine gets instead of the boot menu depends on the state of
+// its node. Nodes booting into a role are provisioning until they report
+// being installed, after which the menu defaults to the local disk. An
+// operator can hold a node back as pending, which shows a waiting screen
+// polling for the state to change, or flag it for reinstall, which skips
+// the menu and boots its role again. Flagged for maintenance, it boots
+// its role without the machine config instead, so that Talos waits in
+// maintenance mode for one to be applied.
+
+const (
+	NodeStateProvisioning = ""
+	NodeStatePending      = "pending"
+	NodeStateInstalled    = "installed"
+	NodeStateReinstall    = "reinstall"
+	NodeStateMaintenance  = "maintenance"
+
+	// How long installed nodes show the menu before booting from disk.
+	installedMenuTimeout = 10000
+)
+
+var nodeStates = map[string]bool{
+	NodeStateProvisioning: true,
+	NodeStatePending:      true,
+	NodeStateInstalled:    true,
+	NodeStateReinstall:    true,
+	NodeStateMaintenance:  true,
+}
+
+var pendingScriptTemplate = template.Must(template.New("iPXE pending").Parse(`#!ipxe
+echo This machine (${mac}) is waiting to be approved for provisioning.
+echo Checking again in 30 seconds.
+sleep 30
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?mac=${mac:hexhyp}&time=${unixtime}{{ .Selectors }}
+`))
+
+var reinstallScriptTemplate = template.Must(template.New("iPXE reinstall").Parse(`#!ipxe
+echo Reinstalling this machine (${mac}) as {{ .Role }}.
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime}&type={{ .Role }}{{ .Selectors }}
+`))
+
+var maintenanceModeScriptTemplate = template.Must(template.New("iPXE maintenance mode").Parse(`#!ipxe
+echo Booting this machine (${mac}) into maintenance mode.
+chain http://{{ .IP }}:{{ .HTTPPort }}/ipxe?uuid=${uuid}&ip=${ip}&mac=${mac:hexhyp}&domain=${domain}&hostname=${hostname}&serial=${serial}&manufacturer=${manufacturer:uristring}&product=${product:uristring}&time=${unixtime}&type={{ .Role }}{{ .Selectors }}
+`))
+
+// withoutMachineConfig removes the machine config from the kernel command
+// line of the boot script, for Talos to boot into maintenance mode.
+func withoutMachineConfig(script []byte) []byte {
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "kernel" {
+			continue
+		}
+		kept := fields[:0]
+		for _, field := range fields {
+			if !strings.HasPrefix(field, "talos.config=") {
+				kept = append(kept, field)
+			}
+		}
+		lines[i] = strings.Join(kept, " ")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+type nodeScriptData struct {
+	ipxeMenuData
+	Role string
+}
+
+// nodeMenu renders what the machine gets instead of the boot menu in the
+// state of its node.
+func (s *Server) nodeMenu(mac net.HardwareAddr, policy *BootPolicy, selectors map[string]string) ([]byte, error) {
+	var node Node
+	var pool *NodePool
+	if mac != nil {
+		node, _ = s.nodes.get(mac.String())
+		pool = s.nodePool(url.Values{"mac": {mac.String()}})
+	}
+	if policy != nil {
+		selectors = policy.Selectors
+	}
+	if script := s.frozenScript(mac); script != nil {
+		return script, nil
+	}
+	if script, err := s.maintenanceScript(mac, selectors); script != nil || err != nil {
+		return script, err
+	}
+
+	var tmpl *template.Template
+	switch node.State {
+	case NodeStatePending:
+		log.Infof("Telling pending node %s to wait", mac)
+		tmpl = pendingScriptTemplate
+	case NodeStateReinstall:
+		log.Infof("Reinstalling node %s as %s", mac, node.Role)
+		tmpl = reinstallScriptTemplate
+	case NodeStateMaintenance:
+		log.Infof("Booting node %s into maintenance mode", mac)
+		tmpl = maintenanceModeScriptTemplate
+	case NodeStateInstalled:
+		data := s.menuData(selectors)
+		data.Default, data.Timeout = "local", installedMenuTimeout
+		return s.renderMenu(policy, pool, data)
+	default:
+		return s.ipxeMenu(policy, pool, selectors)
+	}
+
+	var buf bytes.Buffer
+	data := nodeScriptData{ipxeMenuData: s.menuData(selectors), Role: node.Role}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// installed marks the node installed, when it reported finishing its
+// installation.
+func (ni *nodeInventory) installed(mac string) {
+	ni.update(mac, func(node *Node) {
+		if node.State == NodeStateProvisioning {
+			node.State = NodeStateInstalled
+		}
+	})
+}
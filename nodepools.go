@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/poseidon/matchbox/matchbox/storage"
+	"github.com/poseidon/matchbox/matchbox/storage/storagepb"
+)
+
+// Node pools group the nodes of a kind, e.g. gpu-workers or edge, with
+// defaults of their own between the global ones and those of a node: the
+// role the menu defaults to, the menu, the profile booted, labels and an
+// address range. Nodes join the first pool matching their MAC, OUI,
+// relay agent circuit ID (option 82) or machine class. Their requests
+// carry the nodepool=<name> selector, so that groups can pick profiles for
+// the pool themselves as well.
+
+const nodePoolLabel = "nodepool"
+
+// PoolMatch matches nodes by any of their attributes. OUIs are MAC
+// prefixes, e.g. 52:54:00, and circuit IDs are globs.
+type PoolMatch struct {
+	MACs           []string `json:"macs,omitempty"`
+	OUIs           []string `json:"ouis,omitempty"`
+	CircuitIDs     []string `json:"circuitIds,omitempty"`
+	MachineClasses []string `json:"machineClasses,omitempty"`
+}
+
+// A NodePool applies to the nodes matching Match. Role is what the menu
+// defaults to, Menu an iPXE menu template in the server root used
+// instead of the built-in one, and Profile is booted instead of the
+// profile of the role, unless the machine class of the node has one.
+type NodePool struct {
+	Name    string            `json:"name"`
+	Match   PoolMatch         `json:"match"`
+	Role    string            `json:"role,omitempty"`
+	Profile string            `json:"profile,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Menu    string            `json:"menu,omitempty"`
+	// Range is where the nodes of the pool are leased addresses from.
+	Range *AddressRange `json:"range,omitempty"`
+}
+
+func (p *NodePool) check() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if p.Role != "" && !machineRoles[p.Role] {
+		return fmt.Errorf("unknown role %s", p.Role)
+	}
+	if p.Menu != "" && !isRootRelative(p.Menu) {
+		return fmt.Errorf("menu has to be in the server root")
+	}
+	if p.Range != nil {
+		if err := p.Range.check(); err != nil {
+			return fmt.Errorf("range: %s", err)
+		}
+	}
+	for i, value := range p.Match.MACs {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAC %s", value)
+		}
+		p.Match.MACs[i] = mac.String()
+	}
+	for i, oui := range p.Match.OUIs {
+		if !isMACPrefix(oui) {
+			return fmt.Errorf("invalid OUI %q", oui)
+		}
+		p.Match.OUIs[i] = strings.ToLower(oui)
+	}
+	for _, pattern := range p.Match.CircuitIDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid circuit ID pattern %q: %s", pattern, err)
+		}
+	}
+	for key := range p.Labels {
+		if ipxeMenuSelectors[key] || key == machineClassLabel || key == nodePoolLabel {
+			return fmt.Errorf("label %s is set by the menu", key)
+		}
+	}
+	return nil
+}
+
+func (m *PoolMatch) matches(mac net.HardwareAddr, circuitID, class string) bool {
+	for _, value := range m.MACs {
+		if value == mac.String() {
+			return true
+		}
+	}
+	for _, oui := range m.OUIs {
+		if strings.HasPrefix(mac.String(), oui) {
+			return true
+		}
+	}
+	for _, pattern := range m.CircuitIDs {
+		if ok, _ := path.Match(pattern, circuitID); ok && circuitID != "" {
+			return true
+		}
+	}
+	for _, name := range m.MachineClasses {
+		if name == class {
+			return true
+		}
+	}
+	return false
+}
+
+// nodePools keeps the pool ranges and the circuit IDs the relay agents
+// added to the DHCP requests of the clients, which their boots are
+// matched by later.
+type nodePools struct {
+	lock     sync.Mutex
+	circuits map[string]string
+	ranges   map[string]*addressRange
+}
+
+// nodePoolSeen records the circuit ID of the relayed DHCP request of
+// the client.
+func (s *Server) nodePoolSeen(mac net.HardwareAddr, m *dhcpv4.DHCPv4) {
+	info := m.RelayAgentInfo()
+	if s.Config == nil || len(s.Config.NodePools) == 0 || info == nil {
+		return
+	}
+	circuitID := string(info.Get(dhcpv4.AgentCircuitIDSubOption))
+	if circuitID == "" {
+		return
+	}
+
+	s.pools.lock.Lock()
+	defer s.pools.lock.Unlock()
+	if s.pools.circuits == nil {
+		s.pools.circuits = make(map[string]string)
+	}
+	s.pools.circuits[mac.String()] = circuitID
+}
+
+// nodePool returns the pool of the node requesting the query, or nil if
+// none matches.
+func (s *Server) nodePool(query url.Values) *NodePool {
+	if s.Config == nil || len(s.Config.NodePools) == 0 {
+		return nil
+	}
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil {
+		return nil
+	}
+
+	s.pools.lock.Lock()
+	circuitID := s.pools.circuits[mac.String()]
+	s.pools.lock.Unlock()
+
+	class := query.Get(machineClassLabel)
+	if class == "" {
+		if c := s.machineClass(query); c != nil {
+			class = c.Name
+		}
+	}
+
+	for i := range s.Config.NodePools {
+		if p := &s.Config.NodePools[i]; p.Match.matches(mac, circuitID, class) {
+			return p
+		}
+	}
+	return nil
+}
+
+// setupNodePools carves the ranges of the pools out of the provisioning
+// range.
+func (s *Server) setupNodePools() error {
+	s.pools.ranges = make(map[string]*addressRange)
+	for i := range s.Config.NodePools {
+		p := &s.Config.NodePools[i]
+		if p.Range == nil {
+			continue
+		}
+		if s.ProxyDHCP {
+			log.Warnf("Not leasing pool %s its own range in proxyDHCP mode", p.Name)
+			continue
+		}
+		r, err := s.carveRange("pool "+p.Name, p.Range)
+		if err != nil {
+			return err
+		}
+		s.pools.ranges[p.Name] = r
+	}
+	return nil
+}
+
+// leaseRange returns the range the client is leased an address from, the
+// one of its pool or else of its role, nil for the provisioning range.
+func (s *Server) leaseRange(mac net.HardwareAddr) *addressRange {
+	if p := s.nodePool(url.Values{"mac": {mac.String()}}); p != nil && s.pools.ranges[p.Name] != nil {
+		return s.pools.ranges[p.Name]
+	}
+	return s.roleRange(mac)
+}
+
+// nodePoolRequest adds the pool of the node and its labels to the
+// selectors of the request, if the request chains into a role.
+func (s *Server) nodePoolRequest(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	if query.Get("type") == "" || query.Get(nodePoolLabel) != "" {
+		return req
+	}
+	pool := s.nodePool(query)
+	if pool == nil {
+		return req
+	}
+
+	query.Set(nodePoolLabel, pool.Name)
+	for key, value := range pool.Labels {
+		if _, ok := query[key]; !ok {
+			query.Set(key, value)
+		}
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
+
+// poolStore adds a group for every role of the pools with a profile,
+// selecting the pool and the role. The groups of the machine classes
+// with a profile are added for each pool as well, so that they're picked
+// over the pool's.
+type poolStore struct {
+	storage.Store
+	pools   []NodePool
+	classes []MachineClass
+}
+
+func (s *Server) withNodePools(store storage.Store) storage.Store {
+	if s.Config == nil || len(s.Config.NodePools) == 0 {
+		return store
+	}
+	return &poolStore{Store: store, pools: s.Config.NodePools, classes: s.Config.MachineClasses}
+}
+
+func (st *poolStore) groups() []*storagepb.Group {
+	var groups []*storagepb.Group
+	for _, pool := range st.pools {
+		if pool.Profile == "" {
+			continue
+		}
+		for role := range machineRoles {
+			groups = append(groups, &storagepb.Group{
+				Id:       "pool-" + pool.Name + "-" + role,
+				Name:     "Node pool " + pool.Name + " " + role,
+				Profile:  pool.Profile,
+				Selector: map[string]string{nodePoolLabel: pool.Name, "type": role},
+			})
+			for _, class := range st.classes {
+				if class.Profile == "" || (class.Role != "" && class.Role != role) {
+					continue
+				}
+				groups = append(groups, &storagepb.Group{
+					Id:       "pool-" + pool.Name + "-class-" + class.Name + "-" + role,
+					Name:     "Node pool " + pool.Name + " machine class " + class.Name + " " + role,
+					Profile:  class.Profile,
+					Selector: map[string]string{nodePoolLabel: pool.Name, machineClassLabel: class.Name, "type": role},
+				})
+			}
+		}
+	}
+	return groups
+}
+
+func (st *poolStore) GroupGet(id string) (*storagepb.Group, error) {
+	for _, group := range st.groups() {
+		if group.Id == id {
+			return group, nil
+		}
+	}
+	return st.Store.GroupGet(id)
+}
+
+func (st *poolStore) GroupList() ([]*storagepb.Group, error) {
+	groups, err := st.Store.GroupList()
+	if err != nil {
+		return nil, err
+	}
+	return append(groups, st.groups()...), nil
+}
+
+// checkNodePoolProfiles checks that the profiles of the pools exist.
+func (s *Server) checkNodePoolProfiles(store storage.Store) error {
+	if s.Config == nil {
+		return nil
+	}
+	for _, pool := range s.Config.NodePools {
+		if pool.Profile == "" {
+			continue
+		}
+		if _, err := store.ProfileGet(pool.Profile); err != nil {
+			return fmt.Errorf("Node pool %s: no profile %s: %s", pool.Name, pool.Profile, err)
+		}
+	}
+	return nil
+}
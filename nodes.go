@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The node inventory holds the clients which booted into a role, for
+// downstream automation to pick up with `talos-pxe nodes export`.
+
+type Node struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip"`
+	MAC      string `json:"mac"`
+	// MACs are the MACs of all the NICs of the node, see nics.go.
+	MACs   []string          `json:"macs,omitempty"`
+	Role   string            `json:"role"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Booted time.Time         `json:"booted"`
+	State  string            `json:"state,omitempty"`
+	// Version pins the Talos version the node boots, set by upgrades.
+	Version string `json:"version,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	// The SMBIOS manufacturer and product of the machine.
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// Hardware is what the node reported, see inventory.go.
+	Hardware *Hardware `json:"hardware,omitempty"`
+	// Switch is the switch port the node is on, see switchports.go.
+	Switch *SwitchPort `json:"switch,omitempty"`
+	// The machine config last served to the node, and its SHA-256.
+	Config       string    `json:"config,omitempty"`
+	ConfigSHA256 string    `json:"config_sha256,omitempty"`
+	ConfigServed time.Time `json:"config_served,omitempty"`
+	// ConfigURL is the request of the machine config, see drift.go.
+	ConfigURL string `json:"config_url,omitempty"`
+	// Verified is when the install was verified, see hooks.go.
+	Verified time.Time `json:"verified,omitempty"`
+}
+
+// name is how the node is referred to in inventories, the hostname if
+// it's known.
+func (n *Node) name() string {
+	if n.Hostname != "" {
+		return n.Hostname
+	}
+	return "talos-" + strings.NewReplacer(".", "-", ":", "-").Replace(n.IP)
+}
+
+type nodeInventory struct {
+	lock  sync.Mutex
+	nodes map[string]*Node
+	// aliases map the MACs of the other NICs of nodes to their MAC.
+	aliases map[string]string
+}
+
+func newNodeInventory() *nodeInventory {
+	return &nodeInventory{nodes: make(map[string]*Node), aliases: make(map[string]string)}
+}
+
+// record adds the node booting from a matchbox request, replacing what
+// was known about its MAC except for its pinned version.
+func (ni *nodeInventory) record(query url.Values) {
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil || query.Get("type") == "" {
+		return
+	}
+
+	node := &Node{
+		Hostname:     query.Get("hostname"),
+		IP:           query.Get("ip"),
+		MAC:          mac.String(),
+		Role:         query.Get("type"),
+		Serial:       query.Get("serial"),
+		Manufacturer: query.Get("manufacturer"),
+		Product:      query.Get("product"),
+		Labels:       requestSelectors(query),
+		Booted:       time.Now(),
+	}
+	if len(node.Labels) == 0 {
+		node.Labels = nil
+	}
+
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	node.MAC = ni.resolveLocked(node.MAC)
+	if old, ok := ni.nodes[node.MAC]; ok {
+		node.Version = old.Version
+		node.MACs = old.MACs
+		node.Hardware = old.Hardware
+		node.Switch = old.Switch
+		node.Config, node.ConfigSHA256, node.ConfigServed, node.ConfigURL = old.Config, old.ConfigSHA256, old.ConfigServed, old.ConfigURL
+	}
+	ni.nodes[node.MAC] = node
+}
+
+// configServed records the machine config served to the node for the
+// request.
+func (ni *nodeInventory) configServed(mac net.HardwareAddr, name, uri string, data []byte) {
+	sum := sha256.Sum256(data)
+	ni.update(mac.String(), func(node *Node) {
+		node.Config = name
+		node.ConfigURL = uri
+		node.ConfigSHA256 = hex.EncodeToString(sum[:])
+		node.ConfigServed = time.Now()
+	})
+}
+
+// put adds the node as it is, e.g. restored from a snapshot.
+func (ni *nodeInventory) put(node Node) {
+	if mac, err := net.ParseMAC(node.MAC); err == nil {
+		node.MAC = mac.String()
+	}
+
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	if old, ok := ni.nodes[node.MAC]; ok {
+		ni.unlinkLocked(old)
+	}
+	ni.nodes[node.MAC] = &node
+	ni.linkLocked(&node)
+}
+
+// list returns the nodes ordered by role and IP.
+func (ni *nodeInventory) list() []Node {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	out := make([]Node, 0, len(ni.nodes))
+	for _, node := range ni.nodes {
+		out = append(out, *node)
+	}
+	sortNodes(out)
+	return out
+}
+
+func sortNodes(nodes []Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Role != nodes[j].Role {
+			return nodes[i].Role < nodes[j].Role
+		}
+		return bytes.Compare(net.ParseIP(nodes[i].IP).To16(), net.ParseIP(nodes[j].IP).To16()) < 0
+	})
+}
+
+func (ni *nodeInventory) get(mac string) (Node, bool) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	node, ok := ni.nodes[ni.resolveLocked(mac)]
+	if !ok {
+		return Node{}, false
+	}
+	return *node, true
+}
+
+func (ni *nodeInventory) remove(mac string) (Node, bool) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	mac = ni.resolveLocked(mac)
+	node, ok := ni.nodes[mac]
+	if !ok {
+		return Node{}, false
+	}
+	ni.unlinkLocked(node)
+	delete(ni.nodes, mac)
+	return *node, true
+}
+
+// update applies fn to the node, returning the node as it was before.
+func (ni *nodeInventory) update(mac string, fn func(node *Node)) (Node, bool) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	node, ok := ni.nodes[ni.resolveLocked(mac)]
+	if !ok {
+		return Node{}, false
+	}
+	old := *node
+	fn(node)
+	return old, true
+}
+
+func isControlplaneRole(role string) bool {
+	return role == "init" || role == "controlplane"
+}
+
+// deregisterNode forgets everything about the node: its lease, the DNS
+// records pointing to it and its inventory entry. Returns false if
+// nothing was known about it.
+func (s *Server) deregisterNode(actor string, mac net.HardwareAddr) bool {
+	var ips []net.IP
+	mac = s.nodes.identity(mac)
+
+	s.DHCPLock.Lock()
+	if record, ok := s.DHCPRecords[mac.String()]; ok {
+		s.dropLeaseLocked(mac.String(), record)
+		ips = append(ips, record.IP)
+		s.checkPoolAlert(false)
+	}
+	s.DHCPLock.Unlock()
+
+	if node, ok := s.nodes.remove(mac.String()); ok {
+		if ip := net.ParseIP(node.IP); ip != nil && (len(ips) == 0 || !ips[0].Equal(ip)) {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return false
+	}
+
+	var names []string
+	for _, ip := range ips {
+		names = append(names, s.DNSRecords.RemoveIP(ip)...)
+	}
+
+	s.audit.record(actor, "node.deregister", mac.String(), fmt.Sprintf("freed %v, removed from DNS names %v", ips, names))
+	return true
+}
+
+// nodeIPs returns the addresses of the node, from the inventory and its
+// lease.
+func (s *Server) nodeIPs(mac net.HardwareAddr, node Node) []net.IP {
+	var ips []net.IP
+	if ip := net.ParseIP(node.IP); ip != nil {
+		ips = append(ips, ip)
+	}
+	s.DHCPLock.Lock()
+	if record, ok := s.DHCPRecords[mac.String()]; ok && (len(ips) == 0 || !ips[0].Equal(record.IP)) {
+		ips = append(ips, record.IP)
+	}
+	s.DHCPLock.Unlock()
+	return ips
+}
+
+type nodeUpdate struct {
+	Hostname *string `json:"hostname"`
+	Role     *string `json:"role"`
+	State    *string `json:"state"`
+}
+
+// role is the access role needed for the update, reinstalling takes an
+// admin.
+func (u *nodeUpdate) role() accessRole {
+	if u.State != nil && *u.State == NodeStateReinstall {
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+func (u *nodeUpdate) check() error {
+	if u.Role != nil && *u.Role == "" {
+		return fmt.Errorf("Role can't be empty")
+	}
+	if u.State != nil && !nodeStates[*u.State] {
+		return fmt.Errorf("Unknown state %s", *u.State)
+	}
+	return nil
+}
+
+// updateNode renames or re-roles the node, moving it in or out of the
+// controlplane DNS answer.
+func (s *Server) updateNode(actor string, mac net.HardwareAddr, update nodeUpdate) (Node, bool) {
+	mac = s.nodes.identity(mac)
+	old, ok := s.nodes.update(mac.String(), func(node *Node) {
+		if update.Hostname != nil {
+			node.Hostname = *update.Hostname
+		}
+		if update.Role != nil {
+			node.Role = *update.Role
+		}
+		if update.State != nil {
+			node.State = *update.State
+		}
+	})
+	if !ok {
+		return Node{}, false
+	}
+	node, _ := s.nodes.get(mac.String())
+
+	if !isControlplaneRole(old.Role) && isControlplaneRole(node.Role) {
+		s.pinLease(mac, "controlplane node")
+		if ip := net.ParseIP(node.IP); ip != nil && s.ControlplaneVIP == nil {
+			s.registerDNSEntry(s.Controlplane, ip)
+		}
+	} else if isControlplaneRole(old.Role) && !isControlplaneRole(node.Role) {
+		s.unpinLease(mac, "controlplane node")
+		if s.ControlplaneVIP == nil {
+			for _, ip := range s.nodeIPs(mac, node) {
+				s.DNSRecords.RemoveName(s.Controlplane, ip)
+			}
+		}
+	}
+
+	if old.Hostname != node.Hostname {
+		s.audit.record(actor, "node.rename", mac.String(), fmt.Sprintf("%q to %q", old.Hostname, node.Hostname))
+	}
+	if old.Role != node.Role {
+		s.audit.record(actor, "node.role", mac.String(), fmt.Sprintf("%s to %s", old.Role, node.Role))
+	}
+	if old.State != node.State {
+		s.audit.record(actor, "node.state", mac.String(), fmt.Sprintf("%q to %q", old.State, node.State))
+	}
+	return node, true
+}
+
+func (s *Server) nodesHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.nodes.list())
+}
+
+// nodeHandler serves /api/v1/nodes/<mac>: GET returns the node, PATCH
+// renames or re-roles it and DELETE deregisters it. POST to
+// /api/v1/nodes/<mac>/role promotes or demotes it.
+func (s *Server) nodeHandler(w http.ResponseWriter, req *http.Request) {
+	name, action := strings.TrimPrefix(req.URL.Path, "/api/v1/nodes/"), ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+
+	mac, err := net.ParseMAC(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if action != "" {
+		if action != "role" && action != "reconcile" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if action == "reconcile" {
+			s.nodeReconcileHandler(w, req, mac)
+		} else {
+			s.nodeRoleHandler(w, req, mac)
+		}
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		node, ok := s.nodes.get(s.nodes.identity(mac).String())
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, node)
+	case http.MethodPatch:
+		var update nodeUpdate
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := update.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.authorize(w, req, update.role()) {
+			return
+		}
+		node, ok := s.updateNode(requestActor(req), mac, update)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, node)
+	case http.MethodDelete:
+		if !s.authorize(w, req, roleAdmin) {
+			return
+		}
+		if !s.deregisterNode(requestActor(req), mac) {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var nodeExporters = map[string]func(w io.Writer, nodes []Node) error{
+	"ansible":   exportAnsible,
+	"terraform": exportTerraform,
+	"csv":       exportCSV,
+	"json":      exportJSON,
+}
+
+var nodesCommands = map[string]func(args []string) error{
+	"demote":    runNodesChangeRole("demote", "worker"),
+	"drift":     runNodesDrift,
+	"export":    runNodesExport,
+	"health":    runNodesHealth,
+	"preview":   runNodesPreview,
+	"promote":   runNodesChangeRole("promote", "controlplane"),
+	"reconcile": runNodesReconcile,
+	"remove":    runNodesRemove,
+	"update":    runNodesUpdate,
+}
+
+func runNodes(args []string) error {
+	if len(args) > 0 {
+		if command, ok := nodesCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	return fmt.Errorf("Usage: %s nodes export|health|drift|reconcile|preview|remove|update|promote|demote [flags]", os.Args[0])
+}
+
+func runNodesExport(args []string) error {
+	flags := flag.NewFlagSet("nodes export", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	formatFlag := flags.String("format", "json", "Inventory format, one of ansible, terraform, csv or json")
+	outputFlag := flags.StringP("output", "o", "", "File to write the inventory to instead of stdout")
+	flags.Parse(args)
+
+	export, ok := nodeExporters[*formatFlag]
+	if !ok {
+		return fmt.Errorf("Unknown inventory format %s", *formatFlag)
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	nodes, err := client.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := export(&buf, nodes); err != nil {
+		return err
+	}
+
+	if *outputFlag == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*outputFlag, buf.Bytes(), 0644)
+}
+
+// runNodesRemove deregisters nodes, e.g. after swapping their hardware.
+func runNodesRemove(args []string) error {
+	flags := flag.NewFlagSet("nodes remove", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("Usage: %s nodes remove [flags] MAC...", os.Args[0])
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, mac := range flags.Args() {
+		if err := client.RemoveNode(mac); err != nil {
+			return err
+		}
+		log.Infof("Removed %s", mac)
+	}
+	return nil
+}
+
+func runNodesUpdate(args []string) error {
+	flags := flag.NewFlagSet("nodes update", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	hostnameFlag := flags.String("hostname", "", "New hostname of the node")
+	roleFlag := flags.String("role", "", "New role of the node")
+	stateFlag := flags.String("state", "", "New state of the node, one of pending, installed, reinstall, maintenance or empty for provisioning")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: %s nodes update [flags] MAC", os.Args[0])
+	}
+
+	var update nodeUpdate
+	if flags.Changed("hostname") {
+		update.Hostname = hostnameFlag
+	}
+	if flags.Changed("role") {
+		update.Role = roleFlag
+	}
+	if flags.Changed("state") {
+		update.State = stateFlag
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	node, err := client.UpdateNode(flags.Arg(0), update)
+	if err != nil {
+		return err
+	}
+	return exportJSON(os.Stdout, []Node{node})
+}
+
+// Node names, roles and labels are partly reported by the nodes, so the
+// inventories only take the names safe in INI and HCL, and values
+// Ansible won't template.
+var exportNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// exportable returns whether the node can be exported, logging why not
+// if it can't.
+func exportable(node *Node) bool {
+	if !exportNameRegexp.MatchString(node.name()) || !exportNameRegexp.MatchString(node.Role) {
+		log.Warnf("Not exporting node %s with name %q and role %q", node.MAC, node.name(), node.Role)
+		return false
+	}
+	if _, err := net.ParseMAC(node.MAC); err != nil || net.ParseIP(node.IP) == nil {
+		log.Warnf("Not exporting node %s with address %q", node.name(), node.IP)
+		return false
+	}
+	return true
+}
+
+// exportLabels returns the keys of the labels which can be exported.
+func exportLabels(node *Node) []string {
+	var keys []string
+	for _, key := range sortedKeys(node.Labels) {
+		value := node.Labels[key]
+		if !exportNameRegexp.MatchString(key) || strings.ContainsAny(value, "{}%") || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			log.Warnf("Not exporting label %q of node %s", key, node.name())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// exportAnsible writes an INI inventory with a group per role, all of
+// them children of the talos group.
+func exportAnsible(w io.Writer, nodes []Node) error {
+	var roles []string
+	byRole := make(map[string][]Node)
+	for _, node := range nodes {
+		if !exportable(&node) {
+			continue
+		}
+		if _, ok := byRole[node.Role]; !ok {
+			roles = append(roles, node.Role)
+		}
+		byRole[node.Role] = append(byRole[node.Role], node)
+	}
+
+	for _, role := range roles {
+		fmt.Fprintf(w, "[%s]\n", role)
+		for _, node := range byRole[role] {
+			fmt.Fprintf(w, "%s ansible_host=%s mac=%s", node.name(), node.IP, node.MAC)
+			for _, key := range exportLabels(&node) {
+				fmt.Fprintf(w, " %s=%q", key, node.Labels[key])
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "[talos:children]")
+	for _, role := range roles {
+		fmt.Fprintln(w, role)
+	}
+	return nil
+}
+
+// exportTerraform writes a variable definitions file setting a nodes
+// map, keyed by node name.
+func exportTerraform(w io.Writer, nodes []Node) error {
+	fmt.Fprintln(w, "nodes = {")
+	for _, node := range nodes {
+		if !exportable(&node) {
+			continue
+		}
+		fmt.Fprintf(w, "  %q = {\n", node.name())
+		fmt.Fprintf(w, "    hostname = %q\n", node.Hostname)
+		fmt.Fprintf(w, "    ip       = %q\n", node.IP)
+		fmt.Fprintf(w, "    mac      = %q\n", node.MAC)
+		fmt.Fprintf(w, "    role     = %q\n", node.Role)
+		fmt.Fprintf(w, "    labels   = {")
+		for i, key := range exportLabels(&node) {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, " %q = %q", key, node.Labels[key])
+		}
+		fmt.Fprintln(w, " }")
+		fmt.Fprintln(w, "  }")
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// exportCSV writes one node per row, the labels joined as key=value
+// pairs separated by semicolons.
+func exportCSV(w io.Writer, nodes []Node) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"hostname", "ip", "mac", "role", "labels"})
+	for _, node := range nodes {
+		var labels []string
+		for _, key := range sortedKeys(node.Labels) {
+			labels = append(labels, key+"="+node.Labels[key])
+		}
+		cw.Write([]string{node.Hostname, node.IP, node.MAC, node.Role, strings.Join(labels, ";")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportJSON(w io.Writer, nodes []Node) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(nodes)
+}
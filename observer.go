@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/miekg/dns"
+	"golang.org/x/net/bpf"
+)
+
+// In observer mode talos-pxe serves nothing and sends nothing, not even
+// to get an address, but watches the DHCP, ProxyDHCP, TFTP and DNS
+// traffic on the interface. The clients seen booting show up in the boot
+// sessions and timelines, and in the node inventory as observed nodes,
+// labeled with what they were told to boot. New clients and DHCP servers
+// are recorded as audit events. This audits an existing provisioning
+// network before cutting over to talos-pxe.
+
+const observedRole = "observed"
+
+// observerFilter accepts IPv4 UDP packets from the DHCP and PXE ports,
+// and to the DNS, TFTP and PXE ports.
+func (s *Server) observerFilter() []bpf.Instruction {
+	return []bpf.Instruction{
+		// IPv4
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x0800, SkipTrue: 13},
+		// UDP
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 17, SkipTrue: 11},
+		// Not a fragment
+		bpf.LoadAbsolute{Off: 20, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 9},
+		bpf.LoadMemShift{Off: 14},
+		// Source port
+		bpf.LoadIndirect{Off: 14, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPPort), SkipTrue: 7},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPClientPort), SkipTrue: 6},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.PXEPort), SkipTrue: 5},
+		// Destination port
+		bpf.LoadIndirect{Off: 16, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DNSPort), SkipTrue: 3},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.TFTPPort), SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.PXEPort), SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: pcapSnapLen},
+	}
+}
+
+// openObserver starts watching the boot protocol traffic on the serving
+// interface.
+func (s *Server) openObserver() (io.Closer, func() error, error) {
+	handle, err := pcapgo.NewEthernetHandle(s.Intf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not capture on %s: %s", s.Intf, err)
+	}
+
+	filter, err := bpf.Assemble(s.observerFilter())
+	if err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+	if err := handle.SetBPF(filter); err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+
+	log.Infof("Observing the boot traffic on %s without answering", s.Intf)
+	return closerFunc(handle.Close), func() error { return s.observe(handle) }, nil
+}
+
+// observe follows the packets from the handle until it is closed.
+func (s *Server) observe(handle *pcapgo.EthernetHandle) error {
+	dhcpServers := make(map[string]bool)
+
+	for {
+		data, _, err := handle.ReadPacketData()
+		if err != nil {
+			return fmt.Errorf("Observing stopped: %s", err)
+		}
+
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if ip == nil || udp == nil {
+			continue
+		}
+
+		switch {
+		case int(udp.DstPort) == s.TFTPPort:
+			s.observeTFTP(ip.SrcIP, udp.Payload)
+		case int(udp.DstPort) == s.DNSPort:
+			s.observeDNS(ip.SrcIP, udp.Payload)
+		default:
+			m, err := dhcpv4.FromBytes(udp.Payload)
+			if err != nil {
+				continue
+			}
+			if m.OpCode == dhcpv4.OpcodeBootRequest {
+				s.observeDHCPRequest(m, int(udp.DstPort) == s.PXEPort)
+			} else {
+				s.observeDHCPReply(m, ip.SrcIP, dhcpServers)
+			}
+		}
+	}
+}
+
+func (s *Server) observeDHCPRequest(m *dhcpv4.DHCPv4, pxe bool) {
+	stage := "dhcp"
+	if pxe {
+		stage = "pxe"
+	}
+	s.sessions.seen(m.ClientHWAddr, stage)
+
+	s.observeNode(m.ClientHWAddr, func(node *Node) {
+		if hostname := m.HostName(); hostname != "" {
+			node.Hostname = hostname
+		}
+		if archs := m.ClientArch(); len(archs) > 0 {
+			node.Labels["arch"] = strings.ToLower(archs[0].String())
+		}
+		if class := m.ClassIdentifier(); class != "" {
+			node.Labels["class"] = class
+		}
+	})
+}
+
+func (s *Server) observeDHCPReply(m *dhcpv4.DHCPv4, from net.IP, dhcpServers map[string]bool) {
+	server := m.ServerIdentifier()
+	if server == nil {
+		server = from
+	}
+
+	mt := m.MessageType()
+	if mt == dhcpv4.MessageTypeOffer && !dhcpServers[server.String()] {
+		dhcpServers[server.String()] = true
+		kind := "DHCP"
+		if m.YourIPAddr.IsUnspecified() {
+			kind = "ProxyDHCP"
+		}
+		s.audit.record("observer", "observe.dhcp-server", "", fmt.Sprintf("%s server %s", kind, server))
+	}
+	if mt != dhcpv4.MessageTypeAck && mt != dhcpv4.MessageTypeOffer {
+		return
+	}
+
+	bootFile := m.BootFileNameOption()
+	if bootFile == "" {
+		bootFile = m.BootFileName
+	}
+	s.observeNode(m.ClientHWAddr, func(node *Node) {
+		if mt == dhcpv4.MessageTypeAck && !m.YourIPAddr.IsUnspecified() {
+			node.IP = m.YourIPAddr.String()
+			node.Labels["dhcp-server"] = server.String()
+		}
+		if hostname := m.HostName(); hostname != "" {
+			node.Hostname = hostname
+		}
+		if bootFile != "" {
+			node.Labels["boot-file"] = bootFile
+		}
+		if !m.ServerIPAddr.IsUnspecified() {
+			node.Labels["next-server"] = m.ServerIPAddr.String()
+		}
+	})
+
+	if mt == dhcpv4.MessageTypeAck {
+		s.sessions.learnIP(m.ClientHWAddr, m.YourIPAddr)
+	}
+}
+
+// observeTFTP follows read requests, opcode 1 followed by the file name.
+func (s *Server) observeTFTP(from net.IP, payload []byte) {
+	if len(payload) < 4 || payload[0] != 0 || payload[1] != 1 {
+		return
+	}
+	name := payload[2:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	s.sessions.seenIP(from, "tftp")
+	if mac := s.sessions.lookupIP(from); mac != nil {
+		s.observeNode(mac, func(node *Node) {
+			node.Labels["tftp-file"] = string(name)
+		})
+	}
+}
+
+func (s *Server) observeDNS(from net.IP, payload []byte) {
+	var m dns.Msg
+	if err := m.Unpack(payload); err != nil || m.Response || len(m.Question) == 0 {
+		return
+	}
+	if mac := s.sessions.lookupIP(from); mac != nil {
+		log.Debugf("Observed %s looking up %s", mac, m.Question[0].Name)
+		s.sessions.seen(mac, "dns")
+	}
+}
+
+// observeNode applies fn to the observed node with the MAC, adding it to
+// the inventory when it's first seen.
+func (s *Server) observeNode(mac net.HardwareAddr, fn func(node *Node)) {
+	if len(mac) == 0 {
+		return
+	}
+
+	ni := s.nodes
+	ni.lock.Lock()
+	node, ok := ni.nodes[mac.String()]
+	if !ok {
+		node = &Node{MAC: mac.String(), Role: observedRole, Labels: make(map[string]string), Booted: time.Now()}
+		ni.nodes[node.MAC] = node
+	}
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	fn(node)
+	ni.lock.Unlock()
+
+	if !ok {
+		s.audit.record("observer", "observe.node", mac.String(), "")
+	}
+}
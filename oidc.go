@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With OIDC configured, users sign in on /auth/login of the admin API
+// with the organization's identity provider. Their groups map to a role,
+// and they're given an API token for that role, signed by the server and
+// expiring after the token TTL, which the browser keeps in a cookie for
+// reading the API and the subcommands take in TALOS_PXE_TOKEN.
+
+const (
+	oidcLoginTTL       = 10 * time.Minute
+	oidcTokenTTL       = 12 * time.Hour
+	oidcStateCookie    = "talos_pxe_oidc_state"
+	sessionCookie      = "talos_pxe_session"
+	mintedTokenPrefix  = "tpx1."
+	mintedTokenKeyName = "access-token-key"
+)
+
+// OIDCConfig signs users in with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// RedirectURL is the /auth/callback URL of the admin API, as the
+	// browser reaches it.
+	RedirectURL string `json:"redirectUrl"`
+	// Scopes requested besides openid, profile and email, e.g. groups.
+	Scopes []string `json:"scopes,omitempty"`
+	// RoleClaim is the claim with the groups of the user, groups if
+	// empty.
+	RoleClaim string `json:"roleClaim,omitempty"`
+	// Roles maps groups to roles, the highest one of the user wins.
+	Roles map[string]string `json:"roles"`
+	// DefaultRole is the role of users in none of the groups, who can't
+	// sign in if empty.
+	DefaultRole string `json:"defaultRole,omitempty"`
+	// TokenTTL is how long the API tokens are valid, e.g. 8h.
+	TokenTTL string `json:"tokenTTL,omitempty"`
+
+	ttl time.Duration
+}
+
+func (c *OIDCConfig) check() error {
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("needs a client ID")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || !strings.HasSuffix(u.Path, "/auth/callback") {
+		return fmt.Errorf("the redirect URL has to be the /auth/callback URL of the admin API")
+	}
+	if c.RoleClaim == "" {
+		c.RoleClaim = "groups"
+	}
+	for group, role := range c.Roles {
+		if _, ok := accessRoleNames[role]; !ok {
+			return fmt.Errorf("group %s: unknown role %q", group, role)
+		}
+	}
+	if _, ok := accessRoleNames[c.DefaultRole]; c.DefaultRole != "" && !ok {
+		return fmt.Errorf("unknown default role %q", c.DefaultRole)
+	}
+	if len(c.Roles) == 0 && c.DefaultRole == "" {
+		return fmt.Errorf("needs roles or a default role")
+	}
+
+	c.ttl = oidcTokenTTL
+	if c.TokenTTL != "" {
+		ttl, err := time.ParseDuration(c.TokenTTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid token TTL %q", c.TokenTTL)
+		}
+		c.ttl = ttl
+	}
+	return nil
+}
+
+// role returns the highest role of the groups, the default role if none
+// matches.
+func (c *OIDCConfig) role(claims map[string]interface{}) (accessRole, bool) {
+	var groups []string
+	switch v := claims[c.RoleClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	best := accessRoleNames[c.DefaultRole]
+	for _, group := range groups {
+		if role, ok := accessRoleNames[c.Roles[group]]; ok && role > best {
+			best = role
+		}
+	}
+	return best, best != 0
+}
+
+// tokenMinter signs the API tokens given to signed in users.
+type tokenMinter struct {
+	key []byte
+}
+
+type mintedToken struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+func (m *tokenMinter) mac(payload string) string {
+	h := hmac.New(sha256.New, m.key)
+	io.WriteString(h, payload)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (m *tokenMinter) mint(name string, role accessRole, expires time.Time) (string, error) {
+	data, err := json.Marshal(mintedToken{Name: name, Role: role.String(), Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return mintedTokenPrefix + payload + "." + m.mac(payload), nil
+}
+
+// verify returns the identity of a token minted by the server, nil if it
+// wasn't or expired.
+func (m *tokenMinter) verify(token string) *accessIdentity {
+	parts := strings.Split(strings.TrimPrefix(token, mintedTokenPrefix), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(m.mac(parts[0])), []byte(parts[1])) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	var t mintedToken
+	if err := json.Unmarshal(data, &t); err != nil || time.Now().Unix() >= t.Expires {
+		return nil
+	}
+	role, ok := accessRoleNames[t.Role]
+	if !ok {
+		return nil
+	}
+	return &accessIdentity{Name: t.Name, Role: role}
+}
+
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// oidcProvider is the identity provider, with its endpoints and keys
+// fetched on first use.
+type oidcProvider struct {
+	config *OIDCConfig
+	client *http.Client
+
+	lock          sync.Mutex
+	authURL       string
+	tokenURL      string
+	jwksURL       string
+	keys          map[string]crypto.PublicKey
+	keysFetched   time.Time
+	pendingLogins map[string]*oidcLogin
+}
+
+func newOIDCProvider(config *OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		config:        config,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		pendingLogins: make(map[string]*oidcLogin),
+	}
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the endpoints of the provider, once it succeeds.
+func (p *oidcProvider) discover() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.authURL != "" {
+		return nil
+	}
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return fmt.Errorf("Could not discover the OIDC provider: %s", err)
+	}
+	if doc.Issuer != p.config.Issuer {
+		return fmt.Errorf("OIDC provider issuer %s doesn't match %s", doc.Issuer, p.config.Issuer)
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthURL, doc.TokenURL, doc.JWKSURL
+	return nil
+}
+
+// key returns the signing key with the ID, refetching the keys if it's
+// unknown, at most once a minute, for the provider rotating them.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	p.keysFetched = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce
+// of the ID token, returning its claims.
+func (p *oidcProvider) verifyIDToken(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	if claims["iss"] != p.config.Issuer {
+		return nil, fmt.Errorf("ID token issued by %v", claims["iss"])
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.config.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == p.config.ClientID
+		}
+	}
+	if !audience {
+		return nil, fmt.Errorf("ID token issued for another client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().Unix() >= int64(exp) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// exchange trades the authorization code for the ID token.
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned %s %s", resp.Status, tokens.Error)
+	}
+	return tokens.IDToken, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcLoginHandler redirects to the provider, with PKCE.
+func (s *Server) oidcLoginHandler(w http.ResponseWriter, req *http.Request) {
+	p := s.access.oidc
+	if err := p.discover(); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := randomToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	p.lock.Lock()
+	now := time.Now()
+	for key, login := range p.pendingLogins {
+		if now.After(login.expires) {
+			delete(p.pendingLogins, key)
+		}
+	}
+	p.pendingLogins[state] = &oidcLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTTL)}
+	p.lock.Unlock()
+
+	// The state is bound to the browser starting the login.
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: state, Path: "/auth/", MaxAge: int(oidcLoginTTL.Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid", "profile", "email"}, p.config.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, req, p.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+var oidcTokenTemplate = template.Must(template.New("token").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>talos-pxe</title></head>
+<body style="font-family: sans-serif">
+<p>Signed in as {{ .Name }} with the {{ .Role }} role, until {{ .Expires.Format "2006-01-02 15:04 MST" }}.</p>
+<p>The browser can now read <a href="/api/v1/nodes">/api/v1/</a>. For the subcommands:</p>
+<pre>export TALOS_PXE_TOKEN={{ .Token }}</pre>
+</body>
+</html>
+`))
+
+// oidcCallbackHandler completes the login, minting the API token of the
+// user.
+func (s *Server) oidcCallbackHandler(w http.ResponseWriter, req *http.Request) {
+	p := s.access.oidc
+	fail := func(code int, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Warnf("OIDC login from %s failed: %s", req.RemoteAddr, msg)
+		accessChecks.WithLabelValues("oidc", "failed").Inc()
+		http.Error(w, msg, code)
+	}
+
+	if e := req.FormValue("error"); e != "" {
+		fail(http.StatusForbidden, "Identity provider returned %s: %s", e, req.FormValue("error_description"))
+		return
+	}
+	state := req.FormValue("state")
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		fail(http.StatusBadRequest, "Login state mismatch, start again at /auth/login")
+		return
+	}
+	p.lock.Lock()
+	login, ok := p.pendingLogins[state]
+	delete(p.pendingLogins, state)
+	p.lock.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		fail(http.StatusBadRequest, "Login expired, start again at /auth/login")
+		return
+	}
+
+	idToken, err := p.exchange(req.FormValue("code"), login.verifier)
+	if err != nil {
+		fail(http.StatusBadGateway, "Could not get the ID token: %s", err)
+		return
+	}
+	claims, err := p.verifyIDToken(idToken, login.nonce)
+	if err != nil {
+		fail(http.StatusForbidden, "%s", err)
+		return
+	}
+
+	name := ""
+	for _, claim := range []string{"email", "preferred_username", "sub"} {
+		if v, ok := claims[claim].(string); ok && v != "" {
+			name = v
+			break
+		}
+	}
+	role, ok := p.config.role(claims)
+	if !ok {
+		fail(http.StatusForbidden, "%s is in none of the groups with a role", name)
+		return
+	}
+
+	expires := time.Now().Add(p.config.ttl)
+	token, err := s.access.minter.mint(name, role, expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessChecks.WithLabelValues("oidc", "signed_in").Inc()
+	s.audit.record(name+" "+req.RemoteAddr, "access.login", "", fmt.Sprintf("signed in with the %s role until %s", role, expires.Format(time.RFC3339)))
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", Expires: expires, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	oidcTokenTemplate.Execute(w, struct {
+		Name    string
+		Role    accessRole
+		Expires time.Time
+		Token   string
+	}{name, role, expires, token})
+}
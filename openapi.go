@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The admin API is described by an OpenAPI 3 document served on
+// /api/v1/openapi.json, for users to generate clients from. The schemas
+// are derived from the types the handlers encode and decode, so that they
+// can't drift from what's served.
+
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Request is a value of the type of the JSON body, nil if none.
+	Request interface{}
+	// Response is a value of the type of the JSON response, nil if the
+	// response has no content.
+	Response interface{}
+	// Form parameters of the request.
+	Form []string
+	// Error statuses, with the error message as the body.
+	Errors []int
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "get", Path: "/api/v1/pool", Summary: "Usage of the DHCP address pool", Response: poolStats{}, Errors: []int{http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/leases", Summary: "DHCP leases", Response: []Lease{}},
+	{Method: "get", Path: "/api/v1/leases/stats", Summary: "Lease churn, pool fragmentation and longest-lived leases", Response: LeaseStats{}},
+	{Method: "post", Path: "/api/v1/leases/compact", Summary: "Collect the expired leases and rewrite the pinned leases", Form: []string{"now"}, Response: LeaseCompaction{}, Errors: []int{http.StatusBadRequest, http.StatusConflict}},
+	{Method: "get", Path: "/api/v1/sessions", Summary: "Boot sessions of the clients", Response: []BootSession{}},
+	{Method: "get", Path: "/api/v1/timeline", Summary: "Boot timelines of all clients, most recently seen first", Response: []NodeTimeline{}},
+	{Method: "get", Path: "/api/v1/timeline/{mac}", Summary: "Boot timeline of a client", Response: NodeTimeline{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/dns", Summary: "DNS records", Response: []DNSEntry{}},
+	{Method: "get", Path: "/api/v1/dns/answers", Summary: "Order of the controlplane answers and the health probes of the controlplanes", Response: AnswerStatus{}},
+	{Method: "put", Path: "/api/v1/dns/answers", Summary: "Change the order of the controlplane answers", Request: AnswerPolicy{}, Response: AnswerStatus{}, Errors: []int{http.StatusBadRequest}},
+	{Method: "get", Path: "/api/v1/errors", Summary: "Recent warnings and errors, most recent first", Response: []LoggedError{}},
+	{Method: "get", Path: "/api/v1/nodes", Summary: "Node inventory", Response: []Node{}},
+	{Method: "get", Path: "/api/v1/nodes/{mac}", Summary: "Node", Response: Node{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "patch", Path: "/api/v1/nodes/{mac}", Summary: "Rename, re-role or change the state of a node", Request: nodeUpdate{}, Response: Node{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "delete", Path: "/api/v1/nodes/{mac}", Summary: "Free the lease of a node, remove its DNS records and forget it", Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "post", Path: "/api/v1/nodes/{mac}/reconcile", Summary: "Flag a node whose machine config changed since it was served for reinstall, or apply the config through the Talos API", Request: reconcile{}, Response: Node{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+	{Method: "post", Path: "/api/v1/nodes/{mac}/role", Summary: "Promote a worker to controlplane or demote a controlplane to worker", Request: roleChange{}, Response: Node{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+	{Method: "get", Path: "/api/v1/health", Summary: "Last checks of the Talos API of the nodes", Response: []NodeHealth{}},
+	{Method: "get", Path: "/api/v1/drift", Summary: "Nodes whose machine config changed since it was served, all the nodes served one with all=true", Response: []ConfigDrift{}},
+	{Method: "get", Path: "/api/v1/preview", Summary: "Boot script and machine config the node given with mac, role and ip would get if it booted now, the other parameters being its selectors", Response: Preview{}, Errors: []int{http.StatusBadRequest}},
+	{Method: "get", Path: "/api/v1/versions", Summary: "Config versions recorded whenever the store changed, the last first", Response: []ConfigVersion{}},
+	{Method: "get", Path: "/api/v1/versions/diff", Summary: "What changed in the rendered output of each node between the versions from and to, the last two by default, for the node given with mac only", Response: VersionDiff{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/etcd/cleanup", Summary: "Controlplane nodes which look gone, with the commands removing them from etcd", Response: []EtcdCleanup{}},
+	{Method: "post", Path: "/api/v1/etcd/cleanup/{mac}", Summary: "Remove a controlplane node which looks gone from etcd", Response: EtcdCleanup{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusBadGateway}},
+	{Method: "get", Path: "/api/v1/audit", Summary: "Audit events, oldest first", Response: []AuditEvent{}},
+	{Method: "get", Path: "/api/v1/upgrade", Summary: "Running or last upgrade", Response: Upgrade{}, Errors: []int{http.StatusNotFound}},
+	{Method: "post", Path: "/api/v1/upgrade", Summary: "Roll a Talos version across the nodes", Request: upgradeRequest{}, Response: Upgrade{}, Errors: []int{http.StatusBadRequest, http.StatusConflict}},
+	{Method: "delete", Path: "/api/v1/upgrade", Summary: "Cancel the running upgrade", Response: Upgrade{}, Errors: []int{http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/canary", Summary: "Canary rollout and the nodes booted as canaries", Response: Canary{}},
+	{Method: "put", Path: "/api/v1/canary", Summary: "Start or change the canary rollout", Request: CanaryConfig{}, Response: Canary{}, Errors: []int{http.StatusBadRequest}},
+	{Method: "delete", Path: "/api/v1/canary", Summary: "End the canary rollout"},
+	{Method: "post", Path: "/api/v1/canary/promote", Summary: "Point the stable groups at the canary profiles, returning their IDs", Response: []string{}, Errors: []int{http.StatusConflict}},
+	{Method: "get", Path: "/api/v1/maintenance", Summary: "Whether reinstalls are allowed now", Response: MaintenanceStatus{}, Errors: []int{http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/jobs", Summary: "Scheduled jobs with their next and last runs", Response: []JobStatus{}},
+	{Method: "post", Path: "/api/v1/jobs/{name}/run", Summary: "Run a scheduled job now", Response: JobStatus{}, Errors: []int{http.StatusNotFound, http.StatusConflict}},
+	{Method: "get", Path: "/api/v1/quarantine", Summary: "Quarantined clients", Response: []Lease{}, Errors: []int{http.StatusNotFound}},
+	{Method: "post", Path: "/api/v1/quarantine", Summary: "Approve a quarantined client", Form: []string{"mac"}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "get", Path: "/api/v1/dhcp", Summary: "Whether DHCP answering is paused", Response: DHCPStatus{}},
+	{Method: "post", Path: "/api/v1/dhcp/pause", Summary: "Stop answering DHCP and ProxyDHCP requests", Form: []string{"reason"}, Response: DHCPStatus{}},
+	{Method: "post", Path: "/api/v1/dhcp/resume", Summary: "Answer DHCP and ProxyDHCP requests again", Response: DHCPStatus{}},
+	{Method: "get", Path: "/api/v1/provisioning", Summary: "Whether provisioning is frozen and the provisioning window open", Response: ProvisioningStatus{}},
+	{Method: "put", Path: "/api/v1/provisioning", Summary: "Open a provisioning window while frozen", Request: ProvisioningWindow{}, Response: ProvisioningStatus{}, Errors: []int{http.StatusBadRequest, http.StatusConflict}},
+	{Method: "delete", Path: "/api/v1/provisioning", Summary: "Close the provisioning window"},
+	{Method: "get", Path: "/api/v1/state", Summary: "Snapshot of the leases, nodes and DNS records", Response: State{}},
+	{Method: "put", Path: "/api/v1/state", Summary: "Restore a snapshot", Request: State{}, Response: StateImport{}, Errors: []int{http.StatusBadRequest}},
+	{Method: "get", Path: "/api/v1/backups", Summary: "Backups on the backup target and the last backup run", Response: BackupList{}, Errors: []int{http.StatusNotFound, http.StatusBadGateway}},
+	{Method: "post", Path: "/api/v1/backups", Summary: "Back up right away", Response: BackupRun{}, Errors: []int{http.StatusNotFound, http.StatusBadGateway}},
+}
+
+type openapiSchemas map[string]interface{}
+
+// schemaName is the name of the component of a named type, e.g.
+// NodeUpdate for nodeUpdate.
+func schemaName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// schema returns the schema of the type, adding the structs it refers to
+// to the components.
+func (c openapiSchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := schemaName(t)
+		if _, ok := c[name]; !ok {
+			// Placeholder for recursive types.
+			c[name] = nil
+			c[name] = c.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": c.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schema(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	}
+	return map[string]interface{}{}
+}
+
+// object returns the schema of a struct as encoding/json encodes it.
+func (c openapiSchemas) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if f.Anonymous && tag == "" {
+				fields(f.Type)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+
+			name, opts := tag, ""
+			if i := strings.Index(tag, ","); i >= 0 {
+				name, opts = tag[:i], tag[i+1:]
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = c.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	fields(t)
+
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		object["required"] = required
+	}
+	return object
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// openapiDocument builds the OpenAPI document of the admin API.
+func openapiDocument() map[string]interface{} {
+	schemas := make(openapiSchemas)
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range apiRoutes {
+		op := map[string]interface{}{"summary": route.Summary}
+
+		var params []interface{}
+		if strings.Contains(route.Path, "{mac}") {
+			params = append(params, map[string]interface{}{
+				"name":     "mac",
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemas.schema(reflect.TypeOf(route.Request))),
+			}
+		} else if len(route.Form) > 0 {
+			properties := make(map[string]interface{})
+			for _, name := range route.Form {
+				properties[name] = map[string]interface{}{"type": "string"}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/x-www-form-urlencoded": map[string]interface{}{
+						"schema": map[string]interface{}{"type": "object", "properties": properties, "required": route.Form},
+					},
+				},
+			}
+		}
+
+		responses := make(map[string]interface{})
+		if route.Response != nil {
+			responses["200"] = map[string]interface{}{
+				"description": "OK",
+				"content":     jsonContent(schemas.schema(reflect.TypeOf(route.Response))),
+			}
+		} else {
+			responses["204"] = map[string]interface{}{"description": "No Content"}
+		}
+		for _, code := range route.Errors {
+			responses[fmt.Sprint(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content": map[string]interface{}{
+					"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+		}
+		op["responses"] = responses
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = make(map[string]interface{})
+		}
+		paths[route.Path][route.Method] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "talos-pxe admin API",
+			"description": "Served on --admin-addr. The gRPC management API is described by api/management.proto.",
+			"version":     "v1",
+		},
+		"paths": paths,
+		// Tokens are only required with access control configured.
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (s *Server) openapiHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, openapiDocument())
+}
+
+// runOpenAPI writes the OpenAPI document without a running server.
+func runOpenAPI(args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	outputFlag := flags.StringP("output", "o", "", "File to write the document to instead of stdout")
+	flags.Parse(args)
+
+	data, err := json.MarshalIndent(openapiDocument(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *outputFlag == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*outputFlag, data, 0644)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	pcapSnapLen  = 65535
+	pcapFileSize = 16 << 20
+	pcapFiles    = 10
+)
+
+// pcapFilter accepts IPv4 UDP packets on the DHCP, TFTP and PXE ports, as
+// well as packets between two unprivileged ports, which is where TFTP
+// moves the actual transfers to.
+func (s *Server) pcapFilter() []bpf.Instruction {
+	return []bpf.Instruction{
+		// IPv4
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x0800, SkipTrue: 19},
+		// UDP
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 17, SkipTrue: 17},
+		// Not a fragment
+		bpf.LoadAbsolute{Off: 20, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 15},
+		bpf.LoadMemShift{Off: 14},
+		// Source port
+		bpf.LoadIndirect{Off: 14, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPPort), SkipTrue: 11},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPClientPort), SkipTrue: 10},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.TFTPPort), SkipTrue: 9},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.PXEPort), SkipTrue: 8},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 1024, SkipTrue: 2},
+		// Both ports unprivileged
+		bpf.LoadIndirect{Off: 16, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 1024, SkipTrue: 5},
+		// Destination port
+		bpf.LoadIndirect{Off: 16, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPPort), SkipTrue: 3},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.DHCPClientPort), SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(s.TFTPPort), SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(s.PXEPort), SkipTrue: 1},
+		bpf.RetConstant{Val: pcapSnapLen},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// pcapRotator writes packets to a directory of pcap files, starting a
+// new file once the current one reaches pcapFileSize and keeping only
+// the newest pcapFiles.
+type pcapRotator struct {
+	dir     string
+	file    *os.File
+	writer  *pcapgo.Writer
+	written int
+}
+
+func (r *pcapRotator) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+	}
+
+	name := filepath.Join(r.dir, fmt.Sprintf("talos-pxe-%s.pcap", time.Now().Format("20060102-150405.000")))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.writer = pcapgo.NewWriter(f)
+	r.written = 0
+
+	if err := r.writer.WriteFileHeader(pcapSnapLen, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+
+	log.Infof("Dumping packets to %s", name)
+
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	var dumps []string
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), "talos-pxe-") && strings.HasSuffix(fi.Name(), ".pcap") {
+			dumps = append(dumps, fi.Name())
+		}
+	}
+
+	sort.Strings(dumps)
+	for len(dumps) > pcapFiles {
+		os.Remove(filepath.Join(r.dir, dumps[0]))
+		dumps = dumps[1:]
+	}
+
+	return nil
+}
+
+// openCapture starts capturing the boot protocol traffic on the serving
+// interface.
+func (s *Server) openCapture() (io.Closer, func() error, error) {
+	if err := os.MkdirAll(s.PcapDir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	handle, err := pcapgo.NewEthernetHandle(s.Intf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not capture on %s: %s", s.Intf, err)
+	}
+
+	filter, err := bpf.Assemble(s.pcapFilter())
+	if err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+	if err := handle.SetBPF(filter); err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+
+	return closerFunc(handle.Close), func() error { return s.capturePackets(handle) }, nil
+}
+
+// capturePackets dumps the packets from the handle until it is closed.
+func (s *Server) capturePackets(handle *pcapgo.EthernetHandle) error {
+	r := &pcapRotator{dir: s.PcapDir}
+	if err := r.rotate(); err != nil {
+		return err
+	}
+	defer r.file.Close()
+
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			return fmt.Errorf("Packet capture stopped: %s", err)
+		}
+
+		if r.written+len(data) > pcapFileSize {
+			if err := r.rotate(); err != nil {
+				return err
+			}
+		}
+
+		if err := r.writer.WritePacket(ci, data); err != nil {
+			return err
+		}
+		r.written += len(data) + 16
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Once a node boots as controlplane its lease is pinned: it never expires
+// and is kept in a file across restarts, as etcd peer URLs and the
+// certificates of the cluster embed the address. Deregistering the node
+// frees it, and demoting it unpins it, the lease then moving to the range
+// of its new role on its next discover. So are the leases of BOOTP clients, which have no notion
+// of a lease time, and of nodes served a static network config, which
+// both keep their address for good.
+
+const pinsFile = "pins.json"
+
+func (s *Server) pinsPath() string {
+	if s.PinsFile != "" {
+		return s.PinsFile
+	}
+	return filepath.Join(s.ServerRoot, pinsFile)
+}
+
+// loadPins restores the pinned leases and takes their addresses out of
+// the pool.
+func (s *Server) loadPins() error {
+	data, err := ioutil.ReadFile(s.pinsPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pins := make(map[string]string)
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return fmt.Errorf("Corrupt pinned leases %s: %s", s.pinsPath(), err)
+	}
+
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	for name, addr := range pins {
+		mac, err := net.ParseMAC(name)
+		if err != nil {
+			return fmt.Errorf("Corrupt pinned leases %s: %s", s.pinsPath(), err)
+		}
+		ip := net.ParseIP(addr).To4()
+		if ip == nil || !s.Net.Contains(ip) {
+			log.Warnf("Not restoring pinned lease of %s for %s outside %s", addr, mac, s.Net)
+			continue
+		}
+		record := &DHCPRecord{IP: ip, expires: time.Now(), granted: time.Now(), pinned: true}
+		// Addresses outside the provisioning range aren't in the pool.
+		if !reserveAddress(s.allocatorOf(record), ip) && s.inRange(ip) {
+			log.Warnf("Could not reserve pinned address %s of %s, it may be leased out", ip, mac)
+		}
+		s.DHCPRecords[mac.String()] = record
+	}
+	log.Infof("Restored %d pinned leases", len(pins))
+	return nil
+}
+
+func (s *Server) inRange(ip net.IP) bool {
+	if s.DHCPRangeStart == nil || s.DHCPRangeEnd == nil {
+		return false
+	}
+	n := binary.BigEndian.Uint32(ip.To4())
+	return n >= binary.BigEndian.Uint32(s.DHCPRangeStart.To4()) && n <= binary.BigEndian.Uint32(s.DHCPRangeEnd.To4())
+}
+
+// pinLease pins the lease of the node, if it has one, the reason being
+// what the node is, e.g. "controlplane node".
+func (s *Server) pinLease(mac net.HardwareAddr, why string) {
+	if s.ProxyDHCP || mac == nil {
+		return
+	}
+
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	if record, ok := s.DHCPRecords[mac.String()]; ok {
+		s.pinLeaseLocked(mac, record, why)
+	}
+}
+
+// pinLeaseLocked pins the lease. Must be called with DHCPLock held.
+func (s *Server) pinLeaseLocked(mac net.HardwareAddr, record *DHCPRecord, why string) {
+	if record.pinned || record.quarantined {
+		return
+	}
+	if r := s.leaseRange(mac); r != nil && !r.contains(record.IP) {
+		log.Infof("Not pinning %s to %s %s, it's moved to the range of %s first", record.IP, why, mac, r.name)
+		return
+	}
+	record.pinned = true
+	log.Infof("Pinned %s to %s %s", record.IP, why, mac)
+	s.savePinsLocked()
+}
+
+// unpinLease unpins the lease of the node, if pinned, the reason being
+// what the node is no longer. The lease runs for a lease time from now.
+func (s *Server) unpinLease(mac net.HardwareAddr, why string) {
+	if s.ProxyDHCP || mac == nil {
+		return
+	}
+
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	record, ok := s.DHCPRecords[mac.String()]
+	if !ok || !record.pinned {
+		return
+	}
+	record.pinned = false
+	if record.expires.Before(time.Now().Add(leaseTime)) {
+		record.expires = time.Now().Add(leaseTime)
+	}
+	log.Infof("Unpinned %s from %s, no longer a %s", record.IP, mac, why)
+	s.savePinsLocked()
+}
+
+// savePinsLocked writes out the pinned leases. Must be called with
+// DHCPLock held.
+func (s *Server) savePinsLocked() {
+	pins := make(map[string]string)
+	for mac, record := range s.DHCPRecords {
+		if record.pinned {
+			pins[mac] = record.IP.String()
+		}
+	}
+
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	tmp := s.pinsPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("Could not save pinned leases: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, s.pinsPath()); err != nil {
+		log.Errorf("Could not save pinned leases: %s", err)
+	}
+}
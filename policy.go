@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"text/template"
+)
+
+// A BootPolicy decides how the matching clients boot, e.g. sending arm64
+// clients (arch 11) to a different asset set entirely:
+//
+//	{"name": "arm64", "arch": 11, "bootfile": "ipxe-arm64.efi",
+//	 "selectors": {"arch": "arm64"}}
+//
+// Bootfile is served over TFTP instead of ipxe.efi, Menu is an iPXE menu
+// template in the server root used instead of the built-in one, and the
+// Selectors are added to the matchbox request, so that groups can pick
+// different profiles for the clients.
+type BootPolicy struct {
+	Name string `json:"name"`
+	ClientMatch
+	Bootfile  string            `json:"bootfile,omitempty"`
+	Menu      string            `json:"menu,omitempty"`
+	Selectors map[string]string `json:"selectors,omitempty"`
+}
+
+// The selectors the built-in menu sends to matchbox, which policies can't
+// override.
+var ipxeMenuSelectors = map[string]bool{
+	"uuid": true, "ip": true, "mac": true, "domain": true,
+	"hostname": true, "serial": true, "type": true,
+	"manufacturer": true, "product": true, clientTimeParam: true,
+}
+
+func (p *BootPolicy) check() error {
+	if p.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if p.Bootfile != "" && !isRootRelative(p.Bootfile) {
+		return fmt.Errorf("bootfile has to be in the server root")
+	}
+	if p.Menu != "" && !isRootRelative(p.Menu) {
+		return fmt.Errorf("menu has to be in the server root")
+	}
+	for key := range p.Selectors {
+		if ipxeMenuSelectors[key] {
+			return fmt.Errorf("selector %s is set by the menu", key)
+		}
+	}
+	return p.ClientMatch.check()
+}
+
+// bootPolicy returns the policy matching the client, if any.
+func (s *Server) bootPolicy(mac net.HardwareAddr, classId, classInfo string) *BootPolicy {
+	if s.Config == nil {
+		return nil
+	}
+
+	for i := range s.Config.BootPolicies {
+		if p := &s.Config.BootPolicies[i]; p.matches(mac, classId, classInfo) {
+			return p
+		}
+	}
+	return nil
+}
+
+// ipxeMenuData is what the iPXE menu templates are rendered with. IP
+// and HTTPPort are where the server is advertised. The Selectors are
+// appended to the chain URLs, Default is the item chosen after Timeout
+// milliseconds, 0 waiting forever.
+type ipxeMenuData struct {
+	*Server
+	IP        net.IP
+	HTTPPort  int
+	Selectors string
+	Default   string
+	Timeout   int
+}
+
+func (s *Server) menuData(selectors map[string]string) ipxeMenuData {
+	return ipxeMenuData{Server: s, IP: s.advertisedIP(), HTTPPort: s.advertisedHTTPPort(), Selectors: encodeSelectors(selectors)}
+}
+
+func encodeSelectors(selectors map[string]string) string {
+	keys := make([]string, 0, len(selectors))
+	for key := range selectors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out string
+	for _, key := range keys {
+		out += "&" + url.QueryEscape(key) + "=" + url.QueryEscape(selectors[key])
+	}
+	return out
+}
+
+// ipxeMenu renders the iPXE menu for the clients of the policy and the
+// nodes of the pool, either of which may be nil.
+func (s *Server) ipxeMenu(policy *BootPolicy, pool *NodePool, selectors map[string]string) ([]byte, error) {
+	if policy != nil {
+		selectors = policy.Selectors
+	}
+	role := "worker"
+	if pool != nil && pool.Role != "" {
+		role = pool.Role
+	}
+	data := s.menuData(selectors)
+	data.Default = role
+	return s.renderMenu(policy, pool, data)
+}
+
+// renderMenu renders the menu of the policy, or else of the pool, or the
+// built-in one.
+func (s *Server) renderMenu(policy *BootPolicy, pool *NodePool, data ipxeMenuData) ([]byte, error) {
+	tmpl := ipxeMenuTemplate
+	var err error
+	switch {
+	case policy != nil && policy.Menu != "":
+		tmpl, err = template.ParseFiles(filepath.Join(s.ServerRoot, filepath.FromSlash(policy.Menu)))
+		if err != nil {
+			return nil, fmt.Errorf("Could not load menu of boot policy %s: %s", policy.Name, err)
+		}
+	case pool != nil && pool.Menu != "":
+		tmpl, err = template.ParseFiles(filepath.Join(s.ServerRoot, filepath.FromSlash(pool.Menu)))
+		if err != nil {
+			return nil, fmt.Errorf("Could not load menu of node pool %s: %s", pool.Name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// requestSelectors returns the selectors of a matchbox request which
+// weren't set by the menu itself, i.e. came from a boot policy.
+func requestSelectors(query url.Values) map[string]string {
+	selectors := make(map[string]string)
+	for key := range query {
+		if !ipxeMenuSelectors[key] {
+			selectors[key] = query.Get(key)
+		}
+	}
+	return selectors
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// poolStats describes the usage of the DHCP address pool.
+type poolStats struct {
+	Start            string  `json:"start"`
+	End              string  `json:"end"`
+	Total            int     `json:"total"`
+	Used             int     `json:"used"`
+	Free             int     `json:"free"`
+	FreeBlocks       int     `json:"free_blocks"`
+	LargestFreeBlock int     `json:"largest_free_block"`
+	Utilization      float64 `json:"utilization"`
+	// Fragmentation is the fraction of the free addresses outside the
+	// largest free block.
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+type poolAlert struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Pool  poolStats `json:"pool"`
+}
+
+// poolStatsLocked computes the pool usage from the DHCP records. Returns
+// nil when not leasing addresses. Must be called with DHCPLock held.
+func (s *Server) poolStatsLocked() *poolStats {
+	if s.DHCPRangeStart == nil || s.DHCPRangeEnd == nil {
+		return nil
+	}
+
+	start := binary.BigEndian.Uint32(s.DHCPRangeStart.To4())
+	end := binary.BigEndian.Uint32(s.DHCPRangeEnd.To4())
+
+	var used, taken []uint32
+	for _, record := range s.DHCPRecords {
+		ip := record.IP.To4()
+		if ip == nil || record.quarantined || s.allocatorOf(record) != s.DHCPAllocator {
+			continue
+		}
+		if n := binary.BigEndian.Uint32(ip); n >= start && n <= end {
+			used = append(used, n)
+		}
+	}
+	// The quarantine range and the ranges of the pools are taken out of
+	// the pool, but their addresses still split the free blocks.
+	taken = append(taken, used...)
+	reserved := 0
+	if first, last, ok := s.quarantine.reserved(start, end); ok {
+		for n := first; n <= last; n++ {
+			taken = append(taken, n)
+		}
+		reserved = int(last-first) + 1
+	}
+	for _, r := range s.addressRanges {
+		if first, last, ok := r.reserved(start, end); ok {
+			for n := first; n <= last; n++ {
+				taken = append(taken, n)
+			}
+			reserved += int(last-first) + 1
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool { return taken[i] < taken[j] })
+
+	largest, blocks := 0, 0
+	next := start
+	for _, n := range append(taken, end+1) {
+		if n >= next {
+			block := int(n - next)
+			if block > 0 {
+				blocks++
+			}
+			if block > largest {
+				largest = block
+			}
+			next = n + 1
+		}
+	}
+
+	stats := &poolStats{
+		Start:            s.DHCPRangeStart.String(),
+		End:              s.DHCPRangeEnd.String(),
+		Total:            int(end-start) + 1 - reserved,
+		Used:             len(used),
+		FreeBlocks:       blocks,
+		LargestFreeBlock: largest,
+	}
+	stats.Free = stats.Total - stats.Used
+	stats.setRatios()
+
+	return stats
+}
+
+// setRatios computes the utilization and fragmentation from the counts.
+func (p *poolStats) setRatios() {
+	p.Utilization = float64(p.Used) / float64(p.Total)
+	p.Fragmentation = 0
+	if p.Free > 0 {
+		p.Fragmentation = 1 - float64(p.LargestFreeBlock)/float64(p.Free)
+	}
+}
+
+// reserveAddress takes the IP out of the allocator's pool. Allocators
+// hand out another address when the hint is taken or outside the pool,
+// which is given back.
+func reserveAddress(a allocators.Allocator, ip net.IP) bool {
+	n, err := a.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return false
+	}
+	if !n.IP.Equal(ip) {
+		a.Free(n)
+		return false
+	}
+	return true
+}
+
+func (s *Server) poolStats() *poolStats {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+	return s.poolStatsLocked()
+}
+
+// checkPoolAlert alerts once when the pool utilization crosses the
+// threshold, and again only after it dropped below it. The pool running
+// out alerts once too, until an address is leased again. Must be called
+// with DHCPLock held.
+func (s *Server) checkPoolAlert(exhausted bool) {
+	if exhausted && s.poolExhausted {
+		return
+	}
+	stats := s.poolStatsLocked()
+	if stats == nil || s.PoolAlertThreshold <= 0 {
+		return
+	}
+
+	if exhausted {
+		s.poolExhausted = true
+		log.Errorf("DHCP pool %s - %s is exhausted, new clients won't get an address", stats.Start, stats.End)
+		s.sendPoolAlert("exhausted", stats)
+		return
+	}
+	s.poolExhausted = false
+
+	if stats.Utilization < s.PoolAlertThreshold {
+		s.poolAlerted = false
+		return
+	}
+	if s.poolAlerted {
+		return
+	}
+	s.poolAlerted = true
+
+	log.Warnf("DHCP pool %s - %s is %.0f%% used, %d addresses left", stats.Start, stats.End, stats.Utilization*100, stats.Free)
+	s.sendPoolAlert("threshold", stats)
+}
+
+func (s *Server) sendPoolAlert(event string, stats *poolStats) {
+	if s.PoolAlertWebhook == "" {
+		return
+	}
+
+	data, err := json.Marshal(poolAlert{Event: event, Time: time.Now(), Pool: *stats})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(s.PoolAlertWebhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("Failed to send pool alert: %s", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			log.Errorf("Failed to send pool alert: webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+func (s *Server) poolHandler(w http.ResponseWriter, req *http.Request) {
+	stats := s.poolStats()
+	if stats == nil {
+		http.Error(w, "Not leasing addresses in proxyDHCP mode", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
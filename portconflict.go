@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	procTCPListen = "0A"
+)
+
+func isErrno(err error, errno syscall.Errno) bool {
+	// Some libraries format the errno into their errors instead of
+	// wrapping it, so fall back to matching the message.
+	return errors.Is(err, errno) || strings.Contains(err.Error(), errno.Error())
+}
+
+// socketInodes returns the inodes of the sockets bound to the local port.
+func socketInodes(proto string, port int) map[string]bool {
+	inodes := make(map[string]bool)
+
+	for _, table := range []string{proto, proto + "6"} {
+		f, err := os.Open(filepath.Join("/proc/net", table))
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+
+			local := strings.Split(fields[1], ":")
+			if len(local) != 2 {
+				continue
+			}
+			localPort, err := strconv.ParseUint(local[1], 16, 16)
+			if err != nil || int(localPort) != port {
+				continue
+			}
+			if proto == "tcp" && fields[3] != procTCPListen {
+				continue
+			}
+
+			inodes[fields[9]] = true
+		}
+		f.Close()
+	}
+
+	return inodes
+}
+
+// portOwner finds the process bound to the local port by going through
+// the socket tables and file descriptors in /proc. Returns an empty
+// string if it can't be determined, e.g. without permission to look at
+// other processes.
+func portOwner(proto string, port int) string {
+	inodes := socketInodes(proto, port)
+	if len(inodes) == 0 {
+		return ""
+	}
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return ""
+	}
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		fds, err := ioutil.ReadDir(filepath.Join("/proc", proc.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join("/proc", proc.Name(), "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+
+			if inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+				comm, _ := ioutil.ReadFile(filepath.Join("/proc", proc.Name(), "comm"))
+				return fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), pid)
+			}
+		}
+	}
+
+	return ""
+}
+
+// bindError turns a failure to open a sub-server into an actionable
+// error, naming whoever holds the port and how to run without it.
+func bindError(srv subServer, err error) error {
+	switch {
+	case srv.port != 0 && isErrno(err, syscall.EADDRINUSE):
+		msg := fmt.Sprintf("%s port %d/%s is already in use", srv.name, srv.port, srv.proto)
+		if owner := portOwner(srv.proto, srv.port); owner != "" {
+			msg += " by " + owner
+		}
+		if srv.hint != "" {
+			msg += fmt.Sprintf("; stop it or pass %s", srv.hint)
+		}
+		return errors.New(msg)
+	case srv.port != 0 && isErrno(err, syscall.EACCES):
+		return fmt.Errorf("%s server needs root or CAP_NET_BIND_SERVICE to bind port %d/%s", srv.name, srv.port, srv.proto)
+	case isErrno(err, syscall.EADDRNOTAVAIL):
+		return fmt.Errorf("%s server can't bind, the address isn't configured on any interface: %s", srv.name, err)
+	}
+
+	return fmt.Errorf("Starting %s server: %s", srv.name, err)
+}
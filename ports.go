@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// Firmware only talks to the well-known ports, but tests and the
+// simulator can run the server on high ones without the privileges to
+// bind the others: every port served, and the DHCP client port replies
+// are sent to, is set by a --*-port flag. The TFTP port is passed on to
+// iPXE in the tftp:// URL of the boot file. Without a packet socket, e.g.
+// unprivileged, replies to clients without an address are broadcast, and
+// `talos-pxe simulate --unprivileged` asks for broadcast replies anyway.
+
+// tftpHost is the host of the tftp:// URLs, with the port unless it's the
+// standard one.
+func (s *Server) tftpHost() string {
+	if s.TFTPPort == portTFTP {
+		return s.advertisedIP().String()
+	}
+	return net.JoinHostPort(s.advertisedIP().String(), strconv.Itoa(s.TFTPPort))
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ajeddeloh/yaml"
+	flag "github.com/spf13/pflag"
+)
+
+// A preview renders the boot script and the machine config a node would
+// get if it booted right now, through the same matchbox groups and
+// profiles, selectors, patches and script rewrites as a boot, without
+// the node booting or anything being recorded. Both are linted for the
+// usual mistakes of template and patch changes: template variables
+// rendered empty, boot images missing and machine configs not parsing or
+// of another role. Only admins see the secrets of the machine config,
+// which is redacted for the others.
+
+// noValue is what text/template renders missing map keys as.
+const noValue = "<no value>"
+
+// derivedLabels are the labels the server adds to the requests itself,
+// derived again rather than taken from the last boot.
+var derivedLabels = map[string]bool{
+	canaryLabel:       true,
+	nodePoolLabel:     true,
+	machineClassLabel: true,
+	switchLabel:       true,
+	switchPortLabel:   true,
+	"gpu":             true,
+	"gpu-count":       true,
+}
+
+// Preview is what a node would get if it booted now.
+type Preview struct {
+	MAC    string `json:"mac"`
+	IP     string `json:"ip,omitempty"`
+	Role   string `json:"role"`
+	Script string `json:"script"`
+	// Config is the machine config the boot script points at.
+	Config        string `json:"config,omitempty"`
+	MachineConfig string `json:"machine_config,omitempty"`
+	// Problems are what the linting found.
+	Problems []string `json:"problems,omitempty"`
+}
+
+type previewRequest struct {
+	MAC  string
+	Role string
+	IP   string
+	// Selectors replace the labels of the node's last boot.
+	Selectors map[string]string
+}
+
+// finishBootScript adds what the server adds to the boot script rendered
+// by matchbox for the node, issuing its config tokens unless previewing.
+func (s *Server) finishBootScript(script []byte, mac net.HardwareAddr, form url.Values, tokens bool) []byte {
+	script = s.withInventoryURL(s.withProgressURL(s.withTalosVersion(script, mac)))
+	if tokens {
+		script = s.withConfigTokens(script, mac, form.Get("uuid"))
+	}
+	return s.withConsoleMessages(s.withMulticastTFTP(s.withFallbackMirrors(s.withSerialConsole(s.withClassKernelArgs(script, form), form.Get("manufacturer"), form.Get("product")))))
+}
+
+// preview renders the boot script and the machine config of the node.
+func (s *Server) preview(r previewRequest) (Preview, error) {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return Preview{}, err
+	}
+	mac = s.nodes.identity(mac)
+	node, known := s.nodes.get(mac.String())
+
+	p := Preview{MAC: mac.String(), IP: r.IP, Role: r.Role}
+	if p.IP == "" {
+		p.IP = node.IP
+	}
+	if p.Role == "" {
+		p.Role = node.Role
+	}
+	if p.Role == "" {
+		return Preview{}, fmt.Errorf("The role of %s isn't known, pass one", mac)
+	}
+
+	if s.quarantine.holds(mac) {
+		p.Script = quarantineScript
+		p.Problems = append(p.Problems, "The node is quarantined")
+		return p, nil
+	}
+	if s.Freeze {
+		p.Problems = append(p.Problems, "Provisioning is frozen, the node boots from disk unless admitted")
+	}
+
+	query := url.Values{}
+	selectors := r.Selectors
+	if selectors == nil {
+		selectors = node.Labels
+	}
+	for key, value := range selectors {
+		if r.Selectors != nil || !derivedLabels[key] {
+			query.Set(key, value)
+		}
+	}
+	query.Set("mac", mac.String())
+	query.Set("ip", p.IP)
+	query.Set("hostname", node.Hostname)
+	query.Set("serial", node.Serial)
+	query.Set("manufacturer", node.Manufacturer)
+	query.Set("product", node.Product)
+	query.Set("type", p.Role)
+
+	req := configRenderRequest("/ipxe?"+query.Encode(), p.IP, mac)
+	req = s.canaryRequest(s.nodePoolRequest(s.machineClassRequest(s.hardwareRequest(s.switchPortRequest(req)))))
+	script, err := s.renderConfig(req)
+	if err != nil {
+		return Preview{}, err
+	}
+	req.ParseForm()
+	script = s.finishBootScript(script, mac, req.Form, false)
+	if known && node.State == NodeStateMaintenance {
+		script = withoutMachineConfig(script)
+	}
+	p.Script = string(script)
+	p.Problems = append(p.Problems, s.lintBootScript(script)...)
+
+	uri, ok := bootScriptConfig(script)
+	if !ok {
+		if node.State != NodeStateMaintenance {
+			p.Problems = append(p.Problems, "The boot script passes no talos.config")
+		}
+		return p, nil
+	}
+	p.Config = strings.SplitN(uri, "?", 2)[0]
+	config, err := s.renderConfig(configRenderRequest(uri, p.IP, mac))
+	if err != nil {
+		p.Problems = append(p.Problems, err.Error())
+		return p, nil
+	}
+	p.MachineConfig = string(config)
+	p.Problems = append(p.Problems, lintMachineConfig(config, p.Role)...)
+	return p, nil
+}
+
+// redactSecrets replaces the secrets of the machine config, dropping it
+// if they can't be found.
+func (p *Preview) redactSecrets() {
+	if p.MachineConfig == "" {
+		return
+	}
+	data, err := redactMachineConfig([]byte(p.MachineConfig))
+	if err != nil {
+		p.MachineConfig = ""
+		return
+	}
+	p.MachineConfig = string(data)
+}
+
+// bootScriptConfig returns the request of the machine config the boot
+// script passes.
+func bootScriptConfig(script []byte) (string, bool) {
+	for _, line := range strings.Split(string(script), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "kernel" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "talos.config=") {
+				continue
+			}
+			u := strings.TrimPrefix(field, "talos.config=")
+			i := strings.Index(u, "://")
+			if i < 0 {
+				return "", false
+			}
+			j := strings.Index(u[i+3:], "/")
+			if j < 0 {
+				return "", false
+			}
+			return strings.SplitN(u[i+3+j:], "#", 2)[0], true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) lintBootScript(script []byte) []string {
+	var problems []string
+	if strings.Contains(string(script), noValue) {
+		problems = append(problems, "The boot script has "+noValue+", a template variable missing")
+	}
+
+	kernel := false
+	for _, line := range strings.Split(string(script), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "kernel" && fields[0] != "initrd") {
+			continue
+		}
+		kernel = kernel || fields[0] == "kernel"
+		if len(s.mirrors) > 0 {
+			continue
+		}
+		if name, ok := bootImageURLPath(fields[1]); ok {
+			if _, err := os.Stat(filepath.Join(s.ServerRoot, filepath.FromSlash(name))); err != nil {
+				problems = append(problems, fmt.Sprintf("Boot image %s isn't in the server root", name))
+			}
+		}
+	}
+	if !kernel {
+		problems = append(problems, "The boot script has no kernel")
+	}
+	return problems
+}
+
+func lintMachineConfig(data []byte, role string) []string {
+	if strings.Contains(string(data), noValue) {
+		return []string{"The machine config has " + noValue + ", a template variable missing"}
+	}
+	var cfg struct {
+		Machine struct {
+			Type string `yaml:"type"`
+		} `yaml:"machine"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return []string{fmt.Sprintf("The machine config isn't valid YAML: %s", err)}
+	}
+	if cfg.Machine.Type != "" && isControlplaneRole(cfg.Machine.Type) != isControlplaneRole(role) {
+		return []string{fmt.Sprintf("The machine config is of type %s, for a %s", cfg.Machine.Type, role)}
+	}
+	return nil
+}
+
+// previewHandler previews the node given with mac, role and ip, the
+// other parameters being its selectors, with the secrets redacted unless
+// asked by an admin.
+func (s *Server) previewHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	r := previewRequest{MAC: query.Get("mac"), Role: query.Get("role"), IP: query.Get("ip")}
+	for key := range query {
+		if key == "mac" || key == "role" || key == "ip" {
+			continue
+		}
+		if r.Selectors == nil {
+			r.Selectors = make(map[string]string)
+		}
+		r.Selectors[key] = query.Get(key)
+	}
+
+	preview, err := s.preview(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(req.Context(), roleAdmin) {
+		preview.redactSecrets()
+	}
+	writeJSON(w, preview)
+}
+
+// runNodesPreview prints what the node would get if it booted now,
+// failing if the linting found problems.
+func runNodesPreview(args []string) error {
+	flags := flag.NewFlagSet("nodes preview", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	roleFlag := flags.String("role", "", "Role to boot the node as (default its role)")
+	ipFlag := flags.String("ip", "", "Address of the node (default its address)")
+	selectorsFlag := flags.StringToString("selector", nil, "Selectors of the request, instead of the labels of the node's last boot")
+	jsonFlag := flags.Bool("json", false, "Print the preview as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: %s nodes preview [flags] MAC", os.Args[0])
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	preview, err := client.GetPreview(previewRequest{MAC: flags.Arg(0), Role: *roleFlag, IP: *ipFlag, Selectors: *selectorsFlag})
+	if err != nil {
+		return err
+	}
+	if *jsonFlag {
+		data, err := json.MarshalIndent(preview, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("# Boot script of %s as %s\n%s\n", preview.MAC, preview.Role, strings.TrimRight(preview.Script, "\n"))
+		if preview.MachineConfig != "" {
+			fmt.Printf("\n# Machine config %s\n%s\n", preview.Config, strings.TrimRight(preview.MachineConfig, "\n"))
+		}
+	}
+
+	for _, problem := range preview.Problems {
+		fmt.Fprintf(os.Stderr, "Problem: %s\n", problem)
+	}
+	if len(preview.Problems) > 0 {
+		return fmt.Errorf("Found %d problems", len(preview.Problems))
+	}
+	return nil
+}
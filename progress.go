@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The server only sees a node until it fetches its config. To follow the
+// installation after that, the boot scripts pass the node the URL to
+// report its progress to in the talos.pxe.progress kernel argument. Talos
+// itself doesn't read it: a custom installer image or a system extension
+// POSTs the stage it's in, e.g. downloading-installer, writing-disk or
+// rebooting, and the error if it failed, identifying itself by its mac or
+// else its address, and authenticating like the inventory reports. Without one, the node health checks tell when nodes
+// are installed.
+
+const (
+	progressPath      = "/progress"
+	progressKernelArg = "talos.pxe.progress"
+)
+
+// The stages after which the node is installed.
+var installedStages = map[string]bool{"rebooting": true, "installed": true}
+
+// The stages counted by name in the metrics, the others are counted as
+// other so that the nodes can't grow the label set.
+var metricStages = map[string]bool{
+	"downloading-installer": true,
+	"writing-disk":          true,
+	"rebooting":             true,
+	"installed":             true,
+}
+
+func installStageLabel(stage string) string {
+	if metricStages[stage] {
+		return stage
+	}
+	return "other"
+}
+
+var installStageRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// withProgressURL adds the progress URL to the kernel command line of the
+// boot script.
+func (s *Server) withProgressURL(script []byte) []byte {
+	arg := fmt.Sprintf(" %s=http://${next-server}:%d%s", progressKernelArg, s.advertisedHTTPPort(), progressPath)
+
+	lines := bytes.Split(script, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("kernel ")) && !bytes.Contains(line, []byte(progressKernelArg+"=")) {
+			lines[i] = append(bytes.TrimRight(line, " \r"), arg...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// progressHandler records the install stages reported on progressPath in
+// the boot sessions. Everything else is passed to the next handler.
+func (s *Server) progressHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != progressPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stage := strings.ToLower(req.FormValue("stage"))
+		if !installStageRegexp.MatchString(stage) {
+			http.Error(w, "Invalid stage", http.StatusBadRequest)
+			return
+		}
+
+		mac := s.reportingNode(w, req, req.FormValue("mac"))
+		if mac == nil {
+			return
+		}
+
+		log.Infof("%s reports install stage %s", mac, stage)
+		installReports.WithLabelValues(installStageLabel(stage)).Inc()
+		s.sessions.seen(mac, "install "+stage)
+		if reported, ok := parseClientTime(req.FormValue(clientTimeParam)); ok {
+			s.sessions.clientClock(mac, reported)
+		}
+		if msg := req.FormValue("error"); msg != "" {
+			log.Warnf("%s failed to install in stage %s: %s", mac, stage, msg)
+			s.sessions.failed(mac, errors.New(msg))
+		} else if installedStages[stage] {
+			s.nodes.installed(mac.String())
+			// Without health checks, the report verifies the install.
+			if s.talosTLS == nil || s.NodeHealthInterval <= 0 {
+				s.installVerified(mac.String())
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Talos can't change the role of an installed node, so promoting a worker
+// to controlplane, or demoting one, changes its role and flags it for
+// reinstall: on its next boot it gets the profile and machine config of
+// the new role. The controlplane DNS answer follows the role right away.
+// With a power cycle command, e.g. calling ipmitool or a Redfish client,
+// the node is rebooted into the reinstall too.
+
+const powerCycleTimeout = time.Minute
+
+var errNodeNotFound = fmt.Errorf("Node not found")
+
+type roleChange struct {
+	Role       string `json:"role"`
+	Reinstall  bool   `json:"reinstall"`
+	PowerCycle bool   `json:"power_cycle"`
+}
+
+// role is the access role needed for the change, reinstalling or power
+// cycling takes an admin.
+func (c *roleChange) role() accessRole {
+	if c.Reinstall || c.PowerCycle {
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+func (c *roleChange) check() error {
+	if c.Role != "controlplane" && c.Role != "worker" {
+		return fmt.Errorf("Nodes can only be promoted to controlplane or demoted to worker")
+	}
+	if c.PowerCycle && !c.Reinstall {
+		return fmt.Errorf("Power cycling a node only makes sense with a reinstall")
+	}
+	return nil
+}
+
+// changeNodeRole promotes or demotes the node.
+func (s *Server) changeNodeRole(actor string, mac net.HardwareAddr, change roleChange) (Node, error) {
+	mac = s.nodes.identity(mac)
+	node, ok := s.nodes.get(mac.String())
+	if !ok {
+		return Node{}, errNodeNotFound
+	}
+	if isControlplaneRole(node.Role) == (change.Role == "controlplane") {
+		return Node{}, fmt.Errorf("Node %s already is %s", mac, node.Role)
+	}
+	if change.PowerCycle && s.PowerCycleCommand == "" {
+		return Node{}, fmt.Errorf("No power cycle command configured")
+	}
+
+	update := nodeUpdate{Role: &change.Role}
+	if change.Reinstall {
+		state := NodeStateReinstall
+		update.State = &state
+	}
+	if node, ok = s.updateNode(actor, mac, update); !ok {
+		return Node{}, errNodeNotFound
+	}
+
+	if change.PowerCycle {
+		if err := s.powerCycle(node); err != nil {
+			s.audit.record(actor, "node.power-cycle", mac.String(), fmt.Sprintf("failed: %s", err))
+			return node, fmt.Errorf("Could not power cycle %s: %s", mac, err)
+		}
+		s.audit.record(actor, "node.power-cycle", mac.String(), "")
+	}
+	return node, nil
+}
+
+// powerCycle runs the power cycle command for the node, which gets the
+// node in its environment.
+func (s *Server) powerCycle(node Node) error {
+	if s.Freeze {
+		return errFrozen
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), powerCycleTimeout)
+	defer cancel()
+
+	out, err := nodeCommand(ctx, s.PowerCycleCommand, node).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Infof("Power cycled %s", node.MAC)
+	return nil
+}
+
+// nodeCommand runs the shell command with the node in its environment.
+func nodeCommand(ctx context.Context, command string, node Node) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"NODE_MAC="+node.MAC,
+		"NODE_IP="+node.IP,
+		"NODE_HOSTNAME="+node.Hostname,
+		"NODE_ROLE="+node.Role,
+	)
+	for key, value := range node.Labels {
+		cmd.Env = append(cmd.Env, "NODE_LABEL_"+strings.ToUpper(strings.ReplaceAll(key, "-", "_"))+"="+value)
+	}
+	return cmd
+}
+
+func (s *Server) nodeRoleHandler(w http.ResponseWriter, req *http.Request, mac net.HardwareAddr) {
+	change := roleChange{Reinstall: true}
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := change.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, req, change.role()) {
+		return
+	}
+
+	node, err := s.changeNodeRole(requestActor(req), mac, change)
+	switch {
+	case err == errNodeNotFound:
+		http.NotFound(w, req)
+	case err != nil && node.MAC != "":
+		// The role changed, but the power cycle failed.
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, node)
+	}
+}
+
+func runNodesChangeRole(name, role string) func(args []string) error {
+	return func(args []string) error {
+		flags := flag.NewFlagSet("nodes "+name, flag.ExitOnError)
+		managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+		reinstallFlag := flags.Bool("reinstall", true, "Reinstall the node with its new role on its next boot")
+		powerCycleFlag := flags.Bool("power-cycle", false, "Power cycle the node with the server's power cycle command to reinstall it now")
+		flags.Parse(args)
+
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage: %s nodes %s [flags] MAC", os.Args[0], name)
+		}
+
+		client, err := dialManagement(*managementAddrFlag)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		node, err := client.ChangeNodeRole(flags.Arg(0), roleChange{Role: role, Reinstall: *reinstallFlag, PowerCycle: *powerCycleFlag})
+		if err != nil {
+			return err
+		}
+		return exportJSON(os.Stdout, []Node{node})
+	}
+}
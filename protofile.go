@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// parseProtoFile parses the subset of proto3 api/management.proto is
+// written in into its descriptor: messages with scalar, message, map,
+// repeated and optional fields, and services. It saves generating and
+// vendoring the descriptor, which would have to be kept in sync by hand.
+func parseProtoFile(name, src string) (*descriptorpb.FileDescriptorProto, error) {
+	p := &protoParser{tokens: protoTokens(src)}
+	fd := &descriptorpb.FileDescriptorProto{Name: proto.String(name)}
+	if err := p.file(fd); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	p.resolve(fd)
+	return fd, nil
+}
+
+// protoTokens splits the source into identifiers, numbers, strings and
+// punctuation, dropping the comments.
+func protoTokens(src string) []string {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		case c == '_' || c == '.' || c == '-' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] == '-' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"double":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"float":    descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"int64":    descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint64":   descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"int32":    descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"fixed64":  descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+	"fixed32":  descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+	"bool":     descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"string":   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":    descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"uint32":   descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"sfixed32": descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+	"sfixed64": descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+	"sint32":   descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+	"sint64":   descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+}
+
+type protoParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *protoParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *protoParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *protoParser) expect(want string) error {
+	if t := p.next(); t != want {
+		return fmt.Errorf("expected %q, found %q", want, t)
+	}
+	return nil
+}
+
+func (p *protoParser) str() (string, error) {
+	t := p.next()
+	if len(t) < 2 || (t[0] != '"' && t[0] != '\'') {
+		return "", fmt.Errorf("expected a string, found %q", t)
+	}
+	return strconv.Unquote(`"` + t[1:len(t)-1] + `"`)
+}
+
+func (p *protoParser) file(fd *descriptorpb.FileDescriptorProto) error {
+	for p.peek() != "" {
+		switch t := p.next(); t {
+		case ";":
+		case "syntax":
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			syntax, err := p.str()
+			if err != nil {
+				return err
+			}
+			if syntax != "proto3" {
+				return fmt.Errorf("unsupported syntax %s", syntax)
+			}
+			fd.Syntax = proto.String(syntax)
+		case "package":
+			fd.Package = proto.String(p.next())
+		case "import":
+			dep, err := p.str()
+			if err != nil {
+				return err
+			}
+			fd.Dependency = append(fd.Dependency, dep)
+		case "option":
+			name := p.next()
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			if name == "go_package" {
+				value, err := p.str()
+				if err != nil {
+					return err
+				}
+				fd.Options = &descriptorpb.FileOptions{GoPackage: proto.String(value)}
+			} else {
+				p.next()
+			}
+		case "message":
+			msg, err := p.message()
+			if err != nil {
+				return err
+			}
+			fd.MessageType = append(fd.MessageType, msg)
+		case "service":
+			svc, err := p.service()
+			if err != nil {
+				return err
+			}
+			fd.Service = append(fd.Service, svc)
+		default:
+			return fmt.Errorf("unexpected %q", t)
+		}
+	}
+	return nil
+}
+
+func (p *protoParser) message() (*descriptorpb.DescriptorProto, error) {
+	msg := &descriptorpb.DescriptorProto{Name: proto.String(p.next())}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var optional []*descriptorpb.FieldDescriptorProto
+	for {
+		t := p.next()
+		switch t {
+		case "}":
+			// The oneofs of the optional fields come after the others.
+			for _, field := range optional {
+				field.OneofIndex = proto.Int32(int32(len(msg.OneofDecl)))
+				msg.OneofDecl = append(msg.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + field.GetName())})
+			}
+			return msg, nil
+		case "":
+			return nil, fmt.Errorf("message %s not closed", msg.GetName())
+		case ";":
+			continue
+		case "message":
+			nested, err := p.message()
+			if err != nil {
+				return nil, err
+			}
+			msg.NestedType = append(msg.NestedType, nested)
+			continue
+		}
+
+		field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+		typ := t
+		var entry *descriptorpb.DescriptorProto
+		switch t {
+		case "repeated":
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			typ = p.next()
+		case "optional":
+			field.Proto3Optional = proto.Bool(true)
+			optional = append(optional, field)
+			typ = p.next()
+		case "map":
+			var err error
+			if entry, err = p.mapEntry(); err != nil {
+				return nil, err
+			}
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		}
+
+		name := p.next()
+		if entry != nil {
+			entry.Name = proto.String(protoCamel(name, true) + "Entry")
+			msg.NestedType = append(msg.NestedType, entry)
+			typ = entry.GetName()
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		number, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("invalid number of field %s.%s", msg.GetName(), name)
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+
+		field.Name = proto.String(name)
+		field.JsonName = proto.String(protoCamel(name, false))
+		field.Number = proto.Int32(int32(number))
+		setProtoFieldType(field, typ)
+		msg.Field = append(msg.Field, field)
+	}
+}
+
+// mapEntry parses <key, value> into the entry message of a map field,
+// named after the field.
+func (p *protoParser) mapEntry() (*descriptorpb.DescriptorProto, error) {
+	if err := p.expect("<"); err != nil {
+		return nil, err
+	}
+	key := p.next()
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	value := p.next()
+	if err := p.expect(">"); err != nil {
+		return nil, err
+	}
+
+	entry := &descriptorpb.DescriptorProto{
+		Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+	}
+	for i, kv := range []struct{ name, typ string }{{"key", key}, {"value", value}} {
+		field := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(kv.name),
+			JsonName: proto.String(kv.name),
+			Number:   proto.Int32(int32(i + 1)),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		setProtoFieldType(field, kv.typ)
+		entry.Field = append(entry.Field, field)
+	}
+	return entry, nil
+}
+
+// setProtoFieldType sets a scalar type, or the message type to resolve.
+func setProtoFieldType(field *descriptorpb.FieldDescriptorProto, typ string) {
+	if scalar, ok := protoScalarTypes[typ]; ok {
+		field.Type = scalar.Enum()
+		return
+	}
+	field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	field.TypeName = proto.String(typ)
+}
+
+func (p *protoParser) service() (*descriptorpb.ServiceDescriptorProto, error) {
+	svc := &descriptorpb.ServiceDescriptorProto{Name: proto.String(p.next())}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for {
+		switch t := p.next(); t {
+		case "}":
+			return svc, nil
+		case ";":
+		case "rpc":
+			method := &descriptorpb.MethodDescriptorProto{Name: proto.String(p.next())}
+			input, clientStreaming, err := p.rpcType()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("returns"); err != nil {
+				return nil, err
+			}
+			output, serverStreaming, err := p.rpcType()
+			if err != nil {
+				return nil, err
+			}
+			method.InputType, method.OutputType = proto.String(input), proto.String(output)
+			if clientStreaming {
+				method.ClientStreaming = proto.Bool(true)
+			}
+			if serverStreaming {
+				method.ServerStreaming = proto.Bool(true)
+			}
+			// Skip the options of the method, if any.
+			if p.peek() == "{" {
+				for p.next() != "}" {
+				}
+			} else if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			svc.Method = append(svc.Method, method)
+		default:
+			return nil, fmt.Errorf("unexpected %q in service %s", t, svc.GetName())
+		}
+	}
+}
+
+// rpcType parses the (stream Type) of an rpc.
+func (p *protoParser) rpcType() (string, bool, error) {
+	if err := p.expect("("); err != nil {
+		return "", false, err
+	}
+	name, stream := p.next(), false
+	if name == "stream" {
+		name, stream = p.next(), true
+	}
+	return name, stream, p.expect(")")
+}
+
+// resolve makes the type names fully qualified: the messages of the file
+// are prefixed with its package, the others are already qualified.
+func (p *protoParser) resolve(fd *descriptorpb.FileDescriptorProto) {
+	prefix := "." + fd.GetPackage() + "."
+	local := make(map[string]bool)
+	var walk func(scope string, msgs []*descriptorpb.DescriptorProto)
+	walk = func(scope string, msgs []*descriptorpb.DescriptorProto) {
+		for _, msg := range msgs {
+			local[scope+msg.GetName()] = true
+			walk(scope+msg.GetName()+".", msg.NestedType)
+		}
+	}
+	walk("", fd.MessageType)
+
+	qualify := func(scope, name string) string {
+		// The innermost scope declaring the name wins.
+		for s := scope; ; {
+			if local[s+name] {
+				return prefix + s + name
+			}
+			if s == "" {
+				break
+			}
+			s = s[:strings.LastIndex(strings.TrimSuffix(s, "."), ".")+1]
+		}
+		return "." + name
+	}
+
+	var fields func(scope string, msgs []*descriptorpb.DescriptorProto)
+	fields = func(scope string, msgs []*descriptorpb.DescriptorProto) {
+		for _, msg := range msgs {
+			inner := scope + msg.GetName() + "."
+			for _, field := range msg.Field {
+				if field.TypeName != nil {
+					field.TypeName = proto.String(qualify(inner, field.GetTypeName()))
+				}
+			}
+			fields(inner, msg.NestedType)
+		}
+	}
+	fields("", fd.MessageType)
+
+	for _, svc := range fd.Service {
+		for _, method := range svc.Method {
+			method.InputType = proto.String(qualify("", method.GetInputType()))
+			method.OutputType = proto.String(qualify("", method.GetOutputType()))
+		}
+	}
+}
+
+// protoCamel converts a field name to camel case, as protoc does for the
+// JSON names and map entries.
+func protoCamel(name string, upper bool) string {
+	var b strings.Builder
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// On networks only under the operator's control now and then, the server
+// runs with --freeze and a provisioning window is opened for the machines
+// to install: for a set of MACs, or the first so many clients asking.
+// The window closes by itself after its duration, back to provisioning
+// nothing, so a server left running can't install whatever shows up
+// later.
+
+// ProvisioningWindow admits the MACs, and Count clients not listed, for
+// Duration.
+type ProvisioningWindow struct {
+	MACs     []string `json:"macs,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	Duration string   `json:"duration"`
+
+	duration time.Duration
+}
+
+func (p *ProvisioningWindow) check() error {
+	for i, value := range p.MACs {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAC %s", value)
+		}
+		p.MACs[i] = mac.String()
+	}
+	if p.Count < 0 {
+		return fmt.Errorf("count can't be negative")
+	}
+	if len(p.MACs) == 0 && p.Count == 0 {
+		return fmt.Errorf("needs MACs or a count of nodes")
+	}
+	duration, err := time.ParseDuration(p.Duration)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("invalid duration %q, e.g. 30m", p.Duration)
+	}
+	p.duration = duration
+	return nil
+}
+
+// ProvisioningStatus is whether provisioning is frozen and the window
+// open, if any, with the clients it admitted.
+type ProvisioningStatus struct {
+	Frozen bool `json:"frozen"`
+	Open   bool `json:"open"`
+	ProvisioningWindow
+	Closes   time.Time `json:"closes,omitempty"`
+	By       string    `json:"by,omitempty"`
+	Admitted []string  `json:"admitted,omitempty"`
+}
+
+type provisioningState struct {
+	lock     sync.Mutex
+	window   *ProvisioningWindow
+	closes   time.Time
+	by       string
+	admitted map[string]bool
+	// Admitted clients not listed in the window.
+	others int
+	timer  *time.Timer
+}
+
+// openLocked tells whether the window is open. Must be called with the
+// lock held.
+func (p *provisioningState) openLocked() bool {
+	return p.window != nil && time.Now().Before(p.closes)
+}
+
+// admits tells whether the window admits the client, admitting it if
+// there's room for one more. Returns whether it was admitted just now.
+func (p *provisioningState) admits(mac net.HardwareAddr) (bool, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.openLocked() {
+		return false, false
+	}
+	if p.admitted[mac.String()] {
+		return true, false
+	}
+	for _, m := range p.window.MACs {
+		if m == mac.String() {
+			p.admitted[m] = true
+			return true, true
+		}
+	}
+	if p.others >= p.window.Count {
+		return false, false
+	}
+	p.others++
+	p.admitted[mac.String()] = true
+	return true, true
+}
+
+func (p *provisioningState) status() ProvisioningStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.openLocked() {
+		return ProvisioningStatus{}
+	}
+	status := ProvisioningStatus{Open: true, ProvisioningWindow: *p.window, Closes: p.closes, By: p.by}
+	for mac := range p.admitted {
+		status.Admitted = append(status.Admitted, mac)
+	}
+	sort.Strings(status.Admitted)
+	return status
+}
+
+// frozen tells whether nothing is to be provisioned for the client, as
+// the server is frozen and no window admits it.
+func (s *Server) frozen(mac net.HardwareAddr) bool {
+	if !s.Freeze {
+		return false
+	}
+	if mac == nil {
+		return true
+	}
+	ok, now := s.provisioning.admits(mac)
+	if now {
+		log.Infof("Provisioning %s in the provisioning window", mac)
+		s.audit.record("provisioning", "provisioning.admit", mac.String(), "")
+	}
+	return !ok
+}
+
+func (s *Server) provisioningStatus() ProvisioningStatus {
+	status := s.provisioning.status()
+	status.Frozen = s.Freeze
+	return status
+}
+
+// openProvisioning opens the window, replacing the one open, until it
+// closes after its duration.
+func (s *Server) openProvisioning(actor string, window *ProvisioningWindow) (ProvisioningStatus, error) {
+	if !s.Freeze {
+		return ProvisioningStatus{}, fmt.Errorf("Provisioning isn't frozen, run with --freeze")
+	}
+
+	p := &s.provisioning
+	p.lock.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.window = window
+	p.closes = time.Now().Add(window.duration)
+	p.by = actor
+	p.admitted = make(map[string]bool)
+	p.others = 0
+	closes := p.closes
+	p.timer = time.AfterFunc(window.duration, func() {
+		p.lock.Lock()
+		expired := p.window == window
+		if expired {
+			p.window = nil
+		}
+		p.lock.Unlock()
+		if expired {
+			log.Infof("Provisioning window closed, provisioning is frozen again")
+			s.audit.record("provisioning", "provisioning.close", "", "expired")
+		}
+	})
+	p.lock.Unlock()
+
+	log.Warnf("Provisioning window opened by %s until %s", actor, closes.Format(time.RFC3339))
+	s.audit.record(actor, "provisioning.open", "", describeProvisioningWindow(window))
+	return s.provisioningStatus(), nil
+}
+
+// closeProvisioning closes the window, if any is open.
+func (s *Server) closeProvisioning(actor string) {
+	p := &s.provisioning
+	p.lock.Lock()
+	open := p.openLocked()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.window = nil
+	p.lock.Unlock()
+
+	if open {
+		log.Infof("Provisioning window closed by %s, provisioning is frozen again", actor)
+		s.audit.record(actor, "provisioning.close", "", "")
+	}
+}
+
+func describeProvisioningWindow(window *ProvisioningWindow) string {
+	var admits []string
+	if len(window.MACs) > 0 {
+		admits = append(admits, strings.Join(window.MACs, ", "))
+	}
+	if window.Count > 0 {
+		admits = append(admits, fmt.Sprintf("%d nodes", window.Count))
+	}
+	return strings.Join(admits, " and ") + " for " + window.duration.String()
+}
+
+// provisioningHandler returns the window on GET, opens it on PUT and
+// closes it on DELETE.
+func (s *Server) provisioningHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, s.provisioningStatus())
+	case http.MethodPut:
+		if !s.authorize(w, req, roleAdmin) {
+			return
+		}
+		window := &ProvisioningWindow{}
+		if err := json.NewDecoder(req.Body).Decode(window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := window.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := s.openProvisioning(requestActor(req), window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, status)
+	case http.MethodDelete:
+		s.closeProvisioning(requestActor(req))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runProvisioning shows, opens and closes the provisioning window of a
+// running server.
+func runProvisioning(args []string) error {
+	flags := flag.NewFlagSet("provisioning", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	macsFlag := flags.StringSlice("mac", nil, "MACs to provision, with open")
+	countFlag := flags.Int("count", 0, "Number of other clients to provision, the first asking, with open")
+	forFlag := flags.Duration("for", 30*time.Minute, "How long the window stays open, with open")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s provisioning status|open|close [flags]", os.Args[0])
+	if flags.NArg() != 1 {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var status ProvisioningStatus
+	switch flags.Arg(0) {
+	case "status":
+		status, err = client.GetProvisioning()
+	case "open":
+		window := ProvisioningWindow{MACs: *macsFlag, Count: *countFlag, Duration: forFlag.String()}
+		if err := window.check(); err != nil {
+			return err
+		}
+		status, err = client.OpenProvisioning(window)
+	case "close":
+		return client.CloseProvisioning()
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !status.Frozen:
+		fmt.Println("Provisioning isn't frozen")
+	case !status.Open:
+		fmt.Println("Provisioning is frozen, no window is open")
+	default:
+		fmt.Printf("Provisioning window open until %s, by %s\n", status.Closes.Local().Format(time.RFC1123), status.By)
+		if len(status.MACs) > 0 {
+			fmt.Printf("MACs: %s\n", strings.Join(status.MACs, ", "))
+		}
+		if status.Count > 0 {
+			fmt.Printf("Other nodes: %d\n", status.Count)
+		}
+		if len(status.Admitted) > 0 {
+			fmt.Println("Admitted:")
+		}
+		for _, mac := range status.Admitted {
+			fmt.Printf("  %s\n", mac)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/borancar/talos-pxe/pxesim"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	flag "github.com/spf13/pflag"
+)
+
+// runProxyDHCPCheck checks from a client's segment that the DHCP server
+// talos-pxe runs next to in ProxyDHCP mode is answering, and prints what
+// PXE clients make of the offers they get.
+func runProxyDHCPCheck(args []string) error {
+	flags := flag.NewFlagSet("proxydhcp-check", flag.ExitOnError)
+	ifNameFlag := flags.String("if", "veth1", "Interface to send the DHCP discover from")
+	macFlag := flags.String("mac", "", "Client MAC address (default interface address)")
+	timeoutFlag := flags.Duration("timeout", 5*time.Second, "How long to collect offers for")
+	flags.Parse(args)
+
+	cfg := pxesim.Config{
+		Interface: *ifNameFlag,
+		Timeout:   *timeoutFlag,
+		Logf:      log.Infof,
+	}
+	if *macFlag != "" {
+		mac, err := net.ParseMAC(*macFlag)
+		if err != nil {
+			return err
+		}
+		cfg.MAC = mac
+	}
+
+	check, err := pxesim.CheckProxyDHCP(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, offer := range check.Primary {
+		printOffer("DHCP", offer)
+	}
+	for _, offer := range check.Proxy {
+		printOffer("ProxyDHCP", offer)
+	}
+
+	fmt.Println("Clients see:")
+	if check.Address != nil {
+		fmt.Printf("  address    %s/%s\n", check.Address, net.IP(check.Netmask))
+		fmt.Printf("  routers    %s\n", joinIPs(check.Routers))
+		fmt.Printf("  dns        %s\n", joinIPs(check.DNS))
+	}
+	if check.BootFile != "" {
+		fmt.Printf("  boot file  %s on %s, from %s\n", check.BootFile, check.BootServer, check.BootFrom)
+	}
+
+	if len(check.Conflicts) == 0 {
+		fmt.Println("No conflicts")
+		return nil
+	}
+	fmt.Println("Conflicts:")
+	for _, conflict := range check.Conflicts {
+		fmt.Printf("  %s\n", conflict)
+	}
+	return fmt.Errorf("Found %d conflicts", len(check.Conflicts))
+}
+
+func printOffer(kind string, offer *dhcpv4.DHCPv4) {
+	fmt.Printf("%s offer from %s:\n", kind, offer.ServerIdentifier())
+	if !offer.YourIPAddr.IsUnspecified() {
+		fmt.Printf("  address      %s\n", offer.YourIPAddr)
+	}
+	if !offer.ServerIPAddr.IsUnspecified() {
+		fmt.Printf("  next server  %s\n", offer.ServerIPAddr)
+	}
+	if name := offer.BootFileNameOption(); name != "" {
+		fmt.Printf("  option 67    %s\n", name)
+	} else if offer.BootFileName != "" {
+		fmt.Printf("  file         %s\n", offer.BootFileName)
+	}
+	if name := offer.TFTPServerName(); name != "" {
+		fmt.Printf("  option 66    %s\n", name)
+	}
+	if class := offer.ClassIdentifier(); class != "" {
+		fmt.Printf("  option 60    %s\n", class)
+	}
+}
+
+func joinIPs(ips []net.IP) string {
+	var out []string
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return strings.Join(out, ", ")
+}
@@ -54,23 +54,47 @@ func (s *Server) servePXE(conn net.PacketConn) error {
 			continue
 		}
 
+		if s.dhcpPausedDrop("pxe") {
+			log.Debugf("Not answering PXE request of %s, DHCP is paused", m.ClientHWAddr)
+			continue
+		}
+
+		if s.quarantine.restricts(m.ClientHWAddr) {
+			log.Infof("Not answering PXE request of quarantined client %s", m.ClientHWAddr)
+			continue
+		}
+
+		sp := s.tracer.start(m.ClientHWAddr, "pxe")
+		s.sessions.seen(m.ClientHWAddr, "pxe")
+
 		resp, err := dhcpv4.NewReplyFromRequest(m,
 			dhcpv4.WithOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck)),
 			dhcpv4.WithOption(dhcpv4.OptBootFileName(fmt.Sprintf("%s/%s/%s", m.ClientHWAddr, m.ClassIdentifier(), m.UserClass()))),
 			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.IP)),
 			dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionClassIdentifier, []byte("PXEClient"))),
 		)
-		resp.ServerIPAddr = s.IP
+		resp.ServerIPAddr = s.advertisedIP()
+		if o := s.bootOverride(m); o != nil {
+			s.applyBootOverride(o, m, resp, false)
+		}
 
 		if m.Options[dhcpv4.OptionClientMachineIdentifier.Code()] != nil {
 			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientMachineIdentifier, m.Options[dhcpv4.OptionClientMachineIdentifier.Code()]))
 		}
 
+		// Clients which picked an item from the firmware boot menu
+		// expect it to be acknowledged.
+		if bootType, layer, ok := pxeBootItemRequested(m); ok {
+			sp.SetAttr("pxe.boot_item", fmt.Sprintf("%#04x", bootType))
+			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, pxeBootItemOption(bootType, layer)))
+		}
+
 		log.Debug(resp.Summary())
 		if _, err := l.WriteTo(resp.ToBytes(), &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
 		}, addr); err != nil {
 			log.Errorf("Failed to send PXE response to %s (%s): %s", m.ClientHWAddr, addr, err)
 		}
+		sp.End(err)
 	}
 }
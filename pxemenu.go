@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Older firmware, like the Intel Boot Agent, can show a boot menu before
+// loading any NBP. The menu is described by PXE suboptions of option 43,
+// and the selected item is then requested from the boot server on the
+// PXE port, see the PXE 2.1 specification.
+
+const (
+	pxeDiscoveryControl = 6
+	pxeBootServers      = 8
+	pxeBootMenu         = 9
+	pxeMenuPrompt       = 10
+	pxeBootItem         = 71
+
+	// Discovery control: no broadcast and no multicast discovery, ask the
+	// boot servers listed directly.
+	pxeDiscoveryUnicast = 0x03
+
+	pxeBootTypeLocal = 0x0000
+	pxeBootTypeTalos = 0x8001
+)
+
+type pxeMenuItem struct {
+	bootType uint16
+	desc     string
+}
+
+var pxeMenuItems = []pxeMenuItem{
+	{pxeBootTypeTalos, "Talos (iPXE)"},
+	{pxeBootTypeLocal, "Boot from local disk"},
+}
+
+func appendPXESuboption(b []byte, code byte, data []byte) []byte {
+	b = append(b, code, byte(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// pxeMenuOption returns the option 43 contents describing the boot menu,
+// with the server itself as the boot server of the Talos item.
+func (s *Server) pxeMenuOption() []byte {
+	var servers, menu []byte
+	for _, item := range pxeMenuItems {
+		menu = appendUint16(menu, item.bootType)
+		menu = append(menu, byte(len(item.desc)))
+		menu = append(menu, item.desc...)
+
+		if item.bootType != pxeBootTypeLocal {
+			servers = appendUint16(servers, item.bootType)
+			servers = append(servers, 1)
+			servers = append(servers, s.advertisedIP().To4()...)
+		}
+	}
+
+	timeout := int(s.PXEMenuTimeout / time.Second)
+	if timeout < 1 {
+		timeout = 1
+	} else if timeout > 254 {
+		timeout = 254
+	}
+	prompt := append([]byte{byte(timeout)}, "Press F8 for the boot menu"...)
+
+	var opt []byte
+	opt = appendPXESuboption(opt, pxeDiscoveryControl, []byte{pxeDiscoveryUnicast})
+	opt = appendPXESuboption(opt, pxeBootServers, servers)
+	opt = appendPXESuboption(opt, pxeBootMenu, menu)
+	opt = appendPXESuboption(opt, pxeMenuPrompt, prompt)
+	return append(opt, byte(dhcpv4.OptionEnd))
+}
+
+// pxeBootItemRequested returns the boot item the client selected from
+// the menu, if any.
+func pxeBootItemRequested(m *dhcpv4.DHCPv4) (bootType, layer uint16, ok bool) {
+	opt := m.Options.Get(dhcpv4.OptionVendorSpecificInformation)
+	for len(opt) >= 2 {
+		code, length := opt[0], int(opt[1])
+		if code == byte(dhcpv4.OptionEnd) || len(opt) < 2+length {
+			break
+		}
+		if code == pxeBootItem && length == 4 {
+			return binary.BigEndian.Uint16(opt[2:4]), binary.BigEndian.Uint16(opt[4:6]), true
+		}
+		opt = opt[2+length:]
+	}
+	return 0, 0, false
+}
+
+// pxeBootItemOption acknowledges the selected boot item.
+func pxeBootItemOption(bootType, layer uint16) []byte {
+	item := appendUint16(appendUint16(nil, bootType), layer)
+	return append(appendPXESuboption(nil, pxeBootItem, item), byte(dhcpv4.OptionEnd))
+}
+
+// isPXEClient tells whether the request comes from PXE firmware, which is
+// the only kind of client that understands the menu.
+func isPXEClient(m *dhcpv4.DHCPv4) bool {
+	return strings.HasPrefix(m.ClassIdentifier(), "PXEClient")
+}
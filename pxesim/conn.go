@@ -0,0 +1,37 @@
+package pxesim
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+)
+
+// dhcpConn opens the socket the DHCP client sends and receives on, a raw
+// one unless the client is unprivileged.
+func (c *Config) dhcpConn() (net.PacketConn, error) {
+	if !c.Unprivileged {
+		return nclient4.NewRawUDPConn(c.Interface, c.ClientPort)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, raw syscall.RawConn) error {
+			var err error
+			raw.Control(func(fd uintptr) {
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+					return
+				}
+				if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+					return
+				}
+				// Not allowed unprivileged before Linux 5.7, when the
+				// socket gets the broadcasts of every interface.
+				syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, c.Interface)
+			})
+			return err
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(c.ClientPort))
+}
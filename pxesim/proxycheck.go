@@ -0,0 +1,142 @@
+package pxesim
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// ProxyCheck is what a PXE client sees of the DHCP servers on its segment
+// when talos-pxe runs as a ProxyDHCP server next to another DHCP server.
+type ProxyCheck struct {
+	// Primary are the offers with an address.
+	Primary []*dhcpv4.DHCPv4
+	// Proxy are the ProxyDHCP offers, without an address.
+	Proxy []*dhcpv4.DHCPv4
+
+	// What the client combines out of the first offer of either kind.
+	Address    net.IP
+	Netmask    net.IPMask
+	Routers    []net.IP
+	DNS        []net.IP
+	BootFile   string
+	BootServer net.IP
+	// BootFrom is the server the boot file was taken from.
+	BootFrom net.IP
+
+	// Conflicts likely to break booting.
+	Conflicts []string
+}
+
+// CheckProxyDHCP broadcasts a PXE DISCOVER and collects the offers of all
+// the servers answering within the timeout of the config.
+func CheckProxyDHCP(ctx context.Context, cfg Config) (*ProxyCheck, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	conn, err := cfg.dhcpConn()
+	if err != nil {
+		return nil, fmt.Errorf("opening DHCP client: %w", err)
+	}
+	defer conn.Close()
+
+	discover := mustDiscover(cfg.MAC, []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier(cfg.ClassID)),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(cfg.Arch)),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionBootfileName, dhcpv4.OptionTFTPServerName),
+		dhcpv4.WithBroadcast(true),
+	})
+	if _, err := conn.WriteTo(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4bcast, Port: cfg.ServerPort}); err != nil {
+		return nil, fmt.Errorf("sending DHCP discover: %w", err)
+	}
+	cfg.logf("Sent DHCP discover, collecting offers for %s", cfg.Timeout)
+
+	deadline := time.Now().Add(cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	check := &ProxyCheck{}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("reading DHCP offers: %w", err)
+		}
+
+		m, err := dhcpv4.FromBytes(buf[:n])
+		if err != nil || m.OpCode != dhcpv4.OpcodeBootReply || m.TransactionID != discover.TransactionID ||
+			m.MessageType() != dhcpv4.MessageTypeOffer {
+			continue
+		}
+
+		if m.YourIPAddr.IsUnspecified() {
+			cfg.logf("ProxyDHCP offer from %s", m.ServerIdentifier())
+			check.Proxy = append(check.Proxy, m)
+		} else {
+			cfg.logf("Offer of %s from %s", m.YourIPAddr, m.ServerIdentifier())
+			check.Primary = append(check.Primary, m)
+		}
+	}
+
+	check.combine()
+	return check, nil
+}
+
+// combine fills in what the client makes of the offers, the way PXE
+// firmware does: the address from the first DHCP offer, and the boot file
+// from it too if it has one, else from the first ProxyDHCP offer.
+func (c *ProxyCheck) combine() {
+	if len(c.Primary) == 0 {
+		c.Conflicts = append(c.Conflicts, "No DHCP server offered an address")
+	} else {
+		primary := c.Primary[0]
+		c.Address, c.Netmask, c.Routers, c.DNS = primary.YourIPAddr, primary.SubnetMask(), primary.Router(), primary.DNS()
+
+		for _, offer := range c.Primary {
+			server := offer.ServerIdentifier()
+			if server.Equal(primary.ServerIdentifier()) {
+				continue
+			}
+			c.Conflicts = append(c.Conflicts, fmt.Sprintf("Several DHCP servers offer addresses, %s and %s", primary.ServerIdentifier(), server))
+			break
+		}
+
+		for _, offer := range c.Primary {
+			server := offer.ServerIdentifier()
+			if name, _ := bootFile(offer); name != "" {
+				c.Conflicts = append(c.Conflicts, fmt.Sprintf("DHCP server %s sets boot file %q, which firmware may boot instead of the ProxyDHCP one", server, name))
+			} else if !offer.ServerIPAddr.IsUnspecified() && !offer.ServerIPAddr.Equal(server) {
+				c.Conflicts = append(c.Conflicts, fmt.Sprintf("DHCP server %s sets next server %s", server, offer.ServerIPAddr))
+			}
+			if offer.ClassIdentifier() == "PXEClient" {
+				c.Conflicts = append(c.Conflicts, fmt.Sprintf("DHCP server %s claims to be a PXE server (option 60)", server))
+			}
+		}
+
+		if name, server := bootFile(primary); name != "" {
+			c.BootFile, c.BootServer, c.BootFrom = name, server, primary.ServerIdentifier()
+		}
+	}
+
+	if len(c.Proxy) == 0 {
+		c.Conflicts = append(c.Conflicts, "No ProxyDHCP server answered")
+		return
+	}
+	if len(c.Proxy) > 1 {
+		c.Conflicts = append(c.Conflicts, fmt.Sprintf("%d ProxyDHCP servers answered", len(c.Proxy)))
+	}
+	if c.BootFile == "" {
+		proxy := c.Proxy[0]
+		c.BootFile, c.BootServer = bootFile(proxy)
+		c.BootFrom = proxy.ServerIdentifier()
+	}
+}
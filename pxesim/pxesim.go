@@ -0,0 +1,410 @@
+// Package pxesim simulates a PXE booting machine against a talos-pxe
+// server. It walks through the same steps as real firmware: DHCP
+// DISCOVER/OFFER/REQUEST/ACK, the ProxyDHCP exchange if the address came
+// from another server, the TFTP download of the network boot program, the
+// iPXE DHCP round with its menu and finally the chained boot script.
+//
+// The simulator needs raw socket access to the interface it runs on,
+// typically one end of a veth pair whose other end is served by talos-pxe.
+package pxesim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/milosgajdos/tenus"
+	"github.com/pin/tftp"
+)
+
+// Config describes the simulated client.
+type Config struct {
+	// Interface to send the requests from.
+	Interface string
+	// MAC of the client, defaults to the interface address.
+	MAC net.HardwareAddr
+	// Arch is sent as the client system architecture (option 93).
+	Arch iana.Arch
+	// ClassID is sent as the vendor class identifier (option 60).
+	ClassID string
+	// Role is the menu entry to chain into, defaults to worker.
+	Role string
+	// UUID, Hostname and Serial are substituted into the menu URLs.
+	UUID     string
+	Hostname string
+	Serial   string
+	// Manufacturer and Product are the SMBIOS hardware model.
+	Manufacturer string
+	Product      string
+	// ClockOffset is added to the time the client reports, to simulate
+	// firmware with its clock off.
+	ClockOffset time.Duration
+	// ConfigureAddress assigns the leased address to the interface, which
+	// is required for the TFTP and HTTP steps unless the interface
+	// already has an address on the served subnet.
+	ConfigureAddress bool
+	// Timeout for every single step.
+	Timeout time.Duration
+	// ServerPort, ClientPort and TFTPPort are the ports of the server, of
+	// the client and of the TFTP server unless the boot file URL has one,
+	// 67, 68 and 69 by default. A server on high ports runs unprivileged.
+	ServerPort int
+	ClientPort int
+	TFTPPort   int
+	// Unprivileged uses a UDP socket instead of a raw one, asking for the
+	// DHCP replies to be broadcast as the socket only gets those before
+	// the interface has an address. With a ClientPort above 1023, no
+	// privileges are needed.
+	Unprivileged bool
+	// Logf receives progress messages, may be nil.
+	Logf func(format string, args ...interface{})
+}
+
+// Result holds what the client received in each step.
+type Result struct {
+	Lease      *nclient4.Lease
+	ProxyOffer *dhcpv4.DHCPv4
+	ServerIP   net.IP
+	BootFile   string
+	NBP        []byte
+	Menu       string
+	ChainURL   string
+	Script     string
+	// Timings of the steps completed, by the names in Steps.
+	Timings map[string]time.Duration
+}
+
+// Steps are the steps of a boot, in order. The ProxyDHCP step is only
+// taken if the address came from another server.
+var Steps = []string{"dhcp", "proxydhcp", "tftp", "ipxe-dhcp", "menu", "script"}
+
+// timed records the time since start as the time of the step and returns
+// the time now, when the next step starts.
+func (r *Result) timed(step string, start time.Time) time.Time {
+	now := time.Now()
+	r.Timings[step] = now.Sub(start)
+	return now
+}
+
+func (c *Config) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+func (c *Config) setDefaults() error {
+	if c.MAC == nil {
+		iface, err := net.InterfaceByName(c.Interface)
+		if err != nil {
+			return err
+		}
+		c.MAC = iface.HardwareAddr
+	}
+	if c.Arch == 0 && c.ClassID == "" {
+		c.Arch = iana.EFI_X86_64
+	}
+	if c.ClassID == "" {
+		c.ClassID = fmt.Sprintf("PXEClient:Arch:%05d:UNDI:003001", uint16(c.Arch))
+	}
+	if c.Role == "" {
+		c.Role = "worker"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.ServerPort == 0 {
+		c.ServerPort = nclient4.ServerPort
+	}
+	if c.ClientPort == 0 {
+		c.ClientPort = nclient4.ClientPort
+	}
+	if c.TFTPPort == 0 {
+		c.TFTPPort = 69
+	}
+	return nil
+}
+
+// Run performs a complete simulated boot, returning an error on the first
+// step that fails. The partial result is returned in either case.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	res := &Result{Timings: make(map[string]time.Duration)}
+	start := time.Now()
+
+	conn, err := cfg.dhcpConn()
+	if err != nil {
+		return res, fmt.Errorf("opening DHCP client: %w", err)
+	}
+	client, err := nclient4.NewWithConn(conn, cfg.MAC, nclient4.WithTimeout(cfg.Timeout),
+		nclient4.WithServerAddr(&net.UDPAddr{IP: net.IPv4bcast, Port: cfg.ServerPort}))
+	if err != nil {
+		conn.Close()
+		return res, fmt.Errorf("opening DHCP client: %w", err)
+	}
+	defer client.Close()
+
+	firmware := []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier(cfg.ClassID)),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(cfg.Arch)),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionBootfileName, dhcpv4.OptionTFTPServerName),
+	}
+	if cfg.Unprivileged {
+		firmware = append(firmware, dhcpv4.WithBroadcast(true))
+	}
+
+	offer, err := client.SendAndRead(ctx, client.RemoteAddr(), mustDiscover(cfg.MAC, firmware), func(m *dhcpv4.DHCPv4) bool {
+		return m.MessageType() == dhcpv4.MessageTypeOffer && !m.YourIPAddr.IsUnspecified()
+	})
+	if err != nil {
+		return res, fmt.Errorf("waiting for DHCP offer: %w", err)
+	}
+	cfg.logf("Received offer of %s from %s", offer.YourIPAddr, offer.ServerIdentifier())
+
+	res.Lease, err = client.RequestFromOffer(ctx, offer, firmware...)
+	if err != nil {
+		return res, fmt.Errorf("requesting offered address: %w", err)
+	}
+	ack := res.Lease.ACK
+	cfg.logf("Leased %s", ack.YourIPAddr)
+	start = res.timed("dhcp", start)
+
+	bootFrom := ack
+	res.BootFile, res.ServerIP = bootFile(ack)
+	if res.BootFile == "" {
+		cfg.logf("No boot file in the ACK, waiting for a ProxyDHCP offer")
+
+		res.ProxyOffer, err = client.SendAndRead(ctx, client.RemoteAddr(), mustDiscover(cfg.MAC, firmware), func(m *dhcpv4.DHCPv4) bool {
+			return m.MessageType() == dhcpv4.MessageTypeOffer && m.ClassIdentifier() == "PXEClient"
+		})
+		if err != nil {
+			return res, fmt.Errorf("waiting for ProxyDHCP offer: %w", err)
+		}
+
+		bootFrom = res.ProxyOffer
+		res.BootFile, res.ServerIP = bootFile(res.ProxyOffer)
+		if res.BootFile == "" {
+			return res, fmt.Errorf("ProxyDHCP offer from %s has no boot file", res.ProxyOffer.ServerIdentifier())
+		}
+		start = res.timed("proxydhcp", start)
+	}
+	cfg.logf("Boot file is %s on %s", res.BootFile, res.ServerIP)
+
+	if cfg.ConfigureAddress {
+		if err := configureAddress(cfg.Interface, ack); err != nil {
+			return res, fmt.Errorf("configuring leased address: %w", err)
+		}
+		start = time.Now()
+	}
+
+	res.NBP, err = fetchTFTP(cfg.tftpAddr(bootFrom, res.ServerIP), res.BootFile, cfg.Timeout)
+	if err != nil {
+		return res, fmt.Errorf("fetching %s over TFTP: %w", res.BootFile, err)
+	}
+	cfg.logf("Fetched %d byte network boot program", len(res.NBP))
+	start = res.timed("tftp", start)
+
+	// The network boot program is iPXE, which does its own DHCP round and
+	// identifies itself with its user class.
+	ipxe := append(firmware, dhcpv4.WithUserClass("iPXE", false))
+
+	ipxeLease, err := client.Request(ctx, ipxe...)
+	if err != nil {
+		return res, fmt.Errorf("iPXE DHCP request: %w", err)
+	}
+
+	menuFile, menuServer := bootFile(ipxeLease.ACK)
+	if menuFile == "" {
+		return res, fmt.Errorf("no boot file offered to iPXE")
+	}
+	start = res.timed("ipxe-dhcp", start)
+
+	menu, err := fetchTFTP(cfg.tftpAddr(ipxeLease.ACK, menuServer), menuFile, cfg.Timeout)
+	if err != nil {
+		return res, fmt.Errorf("fetching iPXE menu %s: %w", menuFile, err)
+	}
+	res.Menu = string(menu)
+	cfg.logf("Fetched %d byte iPXE menu", len(menu))
+	start = res.timed("menu", start)
+
+	res.ChainURL, err = chainURL(res.Menu, cfg.Role, map[string]string{
+		"uuid":                   cfg.UUID,
+		"ip":                     ipxeLease.ACK.YourIPAddr.String(),
+		"mac:hexhyp":             strings.Replace(cfg.MAC.String(), ":", "-", -1),
+		"hostname":               cfg.Hostname,
+		"serial":                 cfg.Serial,
+		"manufacturer:uristring": cfg.Manufacturer,
+		"product:uristring":      cfg.Product,
+		"unixtime":               strconv.FormatInt(time.Now().Add(cfg.ClockOffset).Unix(), 10),
+	})
+	if err != nil {
+		return res, err
+	}
+	cfg.logf("Chaining to %s", res.ChainURL)
+
+	httpClient := &http.Client{Timeout: cfg.Timeout}
+	resp, err := httpClient.Get(res.ChainURL)
+	if err != nil {
+		return res, fmt.Errorf("fetching boot script: %w", err)
+	}
+	defer resp.Body.Close()
+
+	script, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return res, fmt.Errorf("reading boot script: %w", err)
+	}
+	res.Script = string(script)
+
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("boot script request returned %s", resp.Status)
+	}
+	if !strings.HasPrefix(res.Script, "#!ipxe") {
+		return res, fmt.Errorf("boot script is not an iPXE script")
+	}
+	cfg.logf("Received %d byte boot script", len(script))
+	res.timed("script", start)
+
+	return res, nil
+}
+
+func mustDiscover(mac net.HardwareAddr, modifiers []dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	m, err := dhcpv4.NewDiscovery(mac, modifiers...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// bootFile returns the boot file and the TFTP server it's on, following
+// the same precedence as iPXE: tftp:// URLs, the TFTP server name option
+// and finally the next server field.
+func bootFile(m *dhcpv4.DHCPv4) (string, net.IP) {
+	name := m.BootFileNameOption()
+	if name == "" {
+		name = m.BootFileName
+	}
+	if name == "" {
+		return "", nil
+	}
+
+	if u, err := url.Parse(name); err == nil && u.Scheme == "tftp" {
+		return strings.TrimPrefix(u.Path, "/"), net.ParseIP(u.Hostname())
+	}
+
+	if server := net.ParseIP(m.TFTPServerName()); server != nil {
+		return name, server
+	}
+
+	return name, m.ServerIPAddr
+}
+
+// tftpAddr is the address of the TFTP server of the boot file, with the
+// port of its tftp:// URL if it has one.
+func (c *Config) tftpAddr(m *dhcpv4.DHCPv4, server net.IP) string {
+	port := strconv.Itoa(c.TFTPPort)
+	if u, err := url.Parse(m.BootFileNameOption()); err == nil && u.Scheme == "tftp" && u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(server.String(), port)
+}
+
+func fetchTFTP(addr, name string, timeout time.Duration) ([]byte, error) {
+	client, err := tftp.NewClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	client.SetTimeout(timeout)
+
+	wt, err := client.Receive(name, "octet")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := wt.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chainURL finds the chain command of the menu item and expands the iPXE
+// settings in it. Scripts which aren't menus, like the one reinstalling a
+// node, are followed to their first chain command.
+func chainURL(menu, item string, settings map[string]string) (string, error) {
+	lines := strings.Split(menu, "\n")
+	isMenu := false
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "menu") {
+			isMenu = true
+		}
+	}
+
+	for i, line := range lines {
+		if isMenu && strings.TrimSpace(line) != ":"+item {
+			continue
+		}
+
+		for _, line := range lines[i+1:] {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, ":") {
+				break
+			}
+			if strings.HasPrefix(line, "chain ") {
+				return expandSettings(strings.TrimSpace(strings.TrimPrefix(line, "chain ")), settings), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("menu has no chain command for %s", item)
+}
+
+func expandSettings(s string, settings map[string]string) string {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+
+		out.WriteString(s[:start])
+		out.WriteString(url.QueryEscape(settings[s[start+2:start+end]]))
+		s = s[start+end+1:]
+	}
+}
+
+func configureAddress(ifName string, ack *dhcpv4.DHCPv4) error {
+	link, err := tenus.NewLinkFrom(ifName)
+	if err != nil {
+		return err
+	}
+
+	mask := ack.SubnetMask()
+	if mask == nil {
+		mask = ack.YourIPAddr.DefaultMask()
+	}
+
+	network := &net.IPNet{IP: ack.YourIPAddr.Mask(mask), Mask: mask}
+	if err := link.SetLinkIp(ack.YourIPAddr, network); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
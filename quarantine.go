@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// In authoritative mode, clients which aren't approved can be kept off the
+// provisioning range: they get an address from a restricted range carved
+// out of the subnet and no boot options, or with Notice an iPXE script
+// telling them they're not authorized. Clients are approved by MAC or MAC
+// prefix in the config, or at runtime through the admin API.
+type QuarantineConfig struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Approved []string `json:"approved,omitempty"`
+	Notice   bool     `json:"notice,omitempty"`
+}
+
+const quarantineScript = `#!ipxe
+echo This machine (${mac}) is not authorized to be provisioned.
+echo Ask an administrator to approve it, then reboot.
+prompt --timeout 60000 Press any key to reboot || reboot
+reboot
+`
+
+// The boot options quarantined clients don't get.
+var quarantineStrippedOptions = []dhcpv4.OptionCode{
+	dhcpv4.OptionBootfileName,
+	dhcpv4.OptionTFTPServerName,
+	dhcpv4.OptionVendorSpecificInformation,
+	dhcpv4.OptionClassIdentifier,
+	dhcpv4.OptionClientMachineIdentifier,
+}
+
+func (q *QuarantineConfig) check() error {
+	start, end := net.ParseIP(q.Start).To4(), net.ParseIP(q.End).To4()
+	if start == nil || end == nil {
+		return fmt.Errorf("start and end have to be IPv4 addresses")
+	}
+	if bytes.Compare(start, end) > 0 {
+		return fmt.Errorf("start %s is after end %s", q.Start, q.End)
+	}
+	for _, prefix := range q.Approved {
+		if !isMACPrefix(prefix) {
+			return fmt.Errorf("invalid approved MAC (prefix) %q", prefix)
+		}
+	}
+	return nil
+}
+
+// isMACPrefix checks for colon separated hex bytes, e.g. 52:54:00.
+func isMACPrefix(prefix string) bool {
+	parts := strings.Split(prefix, ":")
+	if len(parts) > 6 {
+		return false
+	}
+	for _, part := range parts {
+		if len(part) != 2 || strings.Trim(strings.ToLower(part), "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+type quarantine struct {
+	config    *QuarantineConfig
+	allocator allocators.Allocator
+	start     net.IP
+	end       net.IP
+
+	lock     sync.Mutex
+	approved map[string]bool
+}
+
+// setupQuarantine creates the restricted pool and takes its addresses out
+// of the provisioning range.
+func (s *Server) setupQuarantine() error {
+	config := s.Config.Quarantine
+	if s.ProxyDHCP {
+		log.Warnf("Not quarantining unknown clients in proxyDHCP mode")
+		return nil
+	}
+
+	q := &quarantine{
+		config:   config,
+		start:    net.ParseIP(config.Start).To4(),
+		end:      net.ParseIP(config.End).To4(),
+		approved: make(map[string]bool),
+	}
+	if !s.Net.Contains(q.start) || !s.Net.Contains(q.end) {
+		return fmt.Errorf("Quarantine range %s - %s is not in %s", q.start, q.end, s.Net)
+	}
+
+	var err error
+	if q.allocator, err = bitmap.NewIPv4Allocator(q.start, q.end); err != nil {
+		return err
+	}
+
+	first := binary.BigEndian.Uint32(q.start)
+	last := binary.BigEndian.Uint32(q.end)
+	for n := first; n <= last; n++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, n)
+		// Addresses outside the provisioning range can't be reserved,
+		// which is fine.
+		reserveAddress(s.DHCPAllocator, ip)
+	}
+
+	s.quarantine = q
+	log.Infof("Quarantining unknown clients in %s - %s", q.start, q.end)
+	return nil
+}
+
+// holds returns whether the client is quarantined.
+func (q *quarantine) holds(mac net.HardwareAddr) bool {
+	if q == nil {
+		return false
+	}
+
+	q.lock.Lock()
+	approved := q.approved[mac.String()]
+	q.lock.Unlock()
+	if approved {
+		return false
+	}
+
+	for _, prefix := range q.config.Approved {
+		if strings.HasPrefix(mac.String(), strings.ToLower(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+// restricts returns whether the client is quarantined without any boot
+// options.
+func (q *quarantine) restricts(mac net.HardwareAddr) bool {
+	return q != nil && !q.config.Notice && q.holds(mac)
+}
+
+// reserved returns the part of the provisioning range start - end the
+// quarantine takes, bounds inclusive.
+func (q *quarantine) reserved(start, end uint32) (uint32, uint32, bool) {
+	if q == nil {
+		return 0, 0, false
+	}
+
+	first := binary.BigEndian.Uint32(q.start)
+	last := binary.BigEndian.Uint32(q.end)
+	if first < start {
+		first = start
+	}
+	if last > end {
+		last = end
+	}
+	return first, last, first <= last
+}
+
+// approve lets the client out of quarantine. Its restricted lease is
+// dropped, so that it gets a provisioning address the next time it asks.
+func (s *Server) approve(mac net.HardwareAddr) {
+	s.quarantine.lock.Lock()
+	s.quarantine.approved[mac.String()] = true
+	s.quarantine.lock.Unlock()
+
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	if record, ok := s.DHCPRecords[mac.String()]; ok && record.quarantined {
+		s.dropLeaseLocked(mac.String(), record)
+	}
+
+	log.Infof("Approved %s, it boots normally after a reboot", mac)
+}
+
+// quarantineHandler lists the quarantined clients on GET, and approves
+// the one given by the mac form value on POST.
+func (s *Server) quarantineHandler(w http.ResponseWriter, req *http.Request) {
+	if s.quarantine == nil {
+		http.Error(w, "Quarantine is not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		var out []Lease
+		for _, lease := range s.leases() {
+			if lease.Quarantined {
+				out = append(out, lease)
+			}
+		}
+		if out == nil {
+			out = []Lease{}
+		}
+		writeJSON(w, out)
+	case http.MethodPost:
+		mac, err := net.ParseMAC(req.FormValue("mac"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.approve(mac)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Packets of the UDP services are rate limited per client before they are
+// parsed, so that a device stuck in a DISCOVER or query loop can't starve
+// the nodes being provisioned. Excess packets are dropped, the client
+// retries anyway.
+//
+// As the keys of the clients can be spoofed, e.g. the chaddr of DHCP,
+// every group of clients, those behind a relay or else all of them, is
+// limited to rateLimitGroupFactor times as many packets as a client as a
+// backstop, and only rateLimitMaxClients clients and as many groups are
+// tracked. Once as many are, the new clients of a group share a single
+// client limit, and new groups a single group limit, until the idle ones
+// are swept.
+
+const (
+	dhcpRateLimit = 10
+	dnsRateLimit  = 100
+
+	rateLimitGroupFactor = 50
+	rateLimitMaxClients  = 4096
+
+	rateLimitIdle      = time.Minute
+	rateLimitWarnEvery = time.Minute
+)
+
+type rateClient struct {
+	limiter *rate.Limiter
+	last    time.Time
+	warned  time.Time
+
+	// untracked is the limit shared by the clients of a group which
+	// aren't tracked.
+	untracked *rateClient
+}
+
+// rateClients are the limiters of either the clients or their groups.
+type rateClients struct {
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateClient
+}
+
+func newRateClients(perSecond float64) *rateClients {
+	burst := int(2 * perSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateClients{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		clients: make(map[string]*rateClient),
+	}
+}
+
+func (rc *rateClients) newClient() *rateClient {
+	return &rateClient{limiter: rate.NewLimiter(rc.limit, rc.burst)}
+}
+
+// get returns the limiter of the key, or the untracked one once
+// rateLimitMaxClients are tracked.
+func (rc *rateClients) get(key string, now time.Time, untracked *rateClient) *rateClient {
+	c, ok := rc.clients[key]
+	if !ok {
+		if len(rc.clients) >= rateLimitMaxClients {
+			c = untracked
+		} else {
+			c = rc.newClient()
+			rc.clients[key] = c
+		}
+	}
+	c.last = now
+	return c
+}
+
+func (rc *rateClients) sweep(now time.Time) {
+	for k, c := range rc.clients {
+		if now.Sub(c.last) > rateLimitIdle {
+			delete(rc.clients, k)
+		}
+	}
+}
+
+type rateLimiter struct {
+	service string
+
+	lock      sync.Mutex
+	clients   *rateClients
+	groups    *rateClients
+	untracked *rateClient
+	lastSweep time.Time
+}
+
+// newRateLimiter allows perSecond packets per client, and
+// rateLimitGroupFactor times as many per group, with bursts of twice as
+// many.
+func newRateLimiter(service string, perSecond float64) *rateLimiter {
+	rl := &rateLimiter{
+		service: service,
+		clients: newRateClients(perSecond),
+		groups:  newRateClients(perSecond * rateLimitGroupFactor),
+	}
+	rl.untracked = rl.groups.newClient()
+	return rl
+}
+
+func (rl *rateLimiter) allow(group, key string) bool {
+	now := time.Now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimitIdle {
+		rl.clients.sweep(now)
+		rl.groups.sweep(now)
+		rl.lastSweep = now
+	}
+
+	g := rl.groups.get(group, now, rl.untracked)
+	if g.untracked == nil {
+		g.untracked = rl.clients.newClient()
+	}
+
+	c := rl.clients.get(key, now, g.untracked)
+	if !c.limiter.AllowN(now, 1) {
+		if c == g.untracked {
+			key = "untracked clients"
+		}
+		rl.dropped(c, key, rl.clients.limit, now)
+		return false
+	}
+
+	if !g.limiter.AllowN(now, 1) {
+		if g == rl.untracked {
+			group = "untracked groups"
+		}
+		if group == "" {
+			group = "all other clients"
+		}
+		rl.dropped(g, group, rl.groups.limit, now)
+		return false
+	}
+	return true
+}
+
+func (rl *rateLimiter) dropped(c *rateClient, key string, limit rate.Limit, now time.Time) {
+	rateLimited.WithLabelValues(rl.service).Inc()
+	if now.Sub(c.warned) > rateLimitWarnEvery {
+		log.Warnf("Rate limiting %s requests of %s, dropping packets beyond %g/s", rl.service, key, float64(limit))
+		c.warned = now
+	}
+}
+
+// rateLimitedConn drops the packets of clients over the limit. key tells
+// the clients apart, and the groups they're limited in.
+type rateLimitedConn struct {
+	net.PacketConn
+	limiter *rateLimiter
+	key     func(b []byte, addr net.Addr) (group, key string)
+}
+
+func (c rateLimitedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if c.limiter.allow(c.key(b[:n], addr)) {
+			return n, addr, err
+		}
+	}
+}
+
+// sourceIPKey limits every client by source IP, all in a single group.
+func sourceIPKey(b []byte, addr net.Addr) (string, string) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return "", udp.IP.String()
+	}
+	return "", addr.String()
+}
+
+// dhcpClientKey uses the source IP, or the client hardware address for
+// clients which don't have an address yet and for relayed packets, whose
+// source is the relay shared by a whole segment. The packets of every
+// relay are a group, and the rest of the local segment another.
+func dhcpClientKey(b []byte, addr net.Addr) (string, string) {
+	// giaddr, RFC 2131.
+	var group string
+	if len(b) >= 28 && !net.IP(b[24:28]).Equal(net.IPv4zero) {
+		group = net.IP(b[24:28]).String()
+	}
+	if udp, ok := addr.(*net.UDPAddr); ok && !udp.IP.IsUnspecified() && group == "" {
+		return group, udp.IP.String()
+	}
+
+	// htype, hlen and chaddr, RFC 2131.
+	if len(b) >= 44 && b[2] > 0 && b[2] <= 16 {
+		return group, net.HardwareAddr(b[28 : 28+int(b[2])]).String()
+	}
+	return group, addr.String()
+}
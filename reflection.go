@@ -0,0 +1,281 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The management server serves gRPC server reflection, so that tools
+// like grpcurl and grpcui can list and call its methods, and clients can
+// be generated from what it serves, without api/management.proto at hand.
+
+//go:embed api/management.proto
+var managementProto string
+
+const (
+	reflectionServiceV1Alpha = "grpc.reflection.v1alpha.ServerReflection"
+	reflectionServiceV1      = "grpc.reflection.v1.ServerReflection"
+)
+
+// reflectionFiles are the serialized descriptors of the management API
+// and its imports, and the file declaring each symbol.
+type reflectionFiles struct {
+	files   map[string][]byte
+	deps    map[string][]string
+	symbols map[string]string
+}
+
+var (
+	managementFilesOnce sync.Once
+	managementFiles     *reflectionFiles
+	managementFilesErr  error
+)
+
+// emptyProtoFile is google/protobuf/empty.proto, whose generated package
+// isn't vendored.
+var emptyProtoFile = &descriptorpb.FileDescriptorProto{
+	Name:        proto.String("google/protobuf/empty.proto"),
+	Package:     proto.String("google.protobuf"),
+	MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Empty")}},
+	Options:     &descriptorpb.FileOptions{GoPackage: proto.String("google.golang.org/protobuf/types/known/emptypb")},
+	Syntax:      proto.String("proto3"),
+}
+
+// loadManagementFiles parses and checks the descriptor of the management
+// API once.
+func loadManagementFiles() (*reflectionFiles, error) {
+	managementFilesOnce.Do(func() {
+		managementFiles, managementFilesErr = newReflectionFiles()
+	})
+	return managementFiles, managementFilesErr
+}
+
+// parseManagementProto returns the descriptors of the management API and
+// of google/protobuf/empty.proto.
+func parseManagementProto() (protoreflect.FileDescriptor, protoreflect.FileDescriptor, error) {
+	fd, err := parseProtoFile(managementServiceDesc.Metadata.(string), managementProto)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry := new(protoregistry.Files)
+	empty, err := protodesc.NewFile(emptyProtoFile, registry)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range []protoreflect.FileDescriptor{empty, timestamppb.File_google_protobuf_timestamp_proto} {
+		if err := registry.RegisterFile(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	management, err := protodesc.NewFile(fd, registry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid %s: %s", fd.GetName(), err)
+	}
+	return management, empty, nil
+}
+
+func newReflectionFiles() (*reflectionFiles, error) {
+	management, empty, err := parseManagementProto()
+	if err != nil {
+		return nil, err
+	}
+
+	rf := &reflectionFiles{
+		files:   make(map[string][]byte),
+		deps:    make(map[string][]string),
+		symbols: make(map[string]string),
+	}
+	for _, file := range []protoreflect.FileDescriptor{empty, timestamppb.File_google_protobuf_timestamp_proto, management} {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(protodesc.ToFileDescriptorProto(file))
+		if err != nil {
+			return nil, err
+		}
+		rf.files[file.Path()] = data
+		imports := file.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			rf.deps[file.Path()] = append(rf.deps[file.Path()], imports.Get(i).Path())
+		}
+		rf.addSymbols(file.Path(), file.Messages())
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			svc := services.Get(i)
+			rf.symbols[string(svc.FullName())] = file.Path()
+			methods := svc.Methods()
+			for j := 0; j < methods.Len(); j++ {
+				rf.symbols[string(methods.Get(j).FullName())] = file.Path()
+			}
+		}
+	}
+	return rf, nil
+}
+
+func (rf *reflectionFiles) addSymbols(path string, messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		msg := messages.Get(i)
+		rf.symbols[string(msg.FullName())] = path
+		fields := msg.Fields()
+		for j := 0; j < fields.Len(); j++ {
+			rf.symbols[string(fields.Get(j).FullName())] = path
+		}
+		rf.addSymbols(path, msg.Messages())
+	}
+}
+
+// withDeps returns the file and the files it imports, transitively.
+func (rf *reflectionFiles) withDeps(path string) [][]byte {
+	var out [][]byte
+	seen := make(map[string]bool)
+	var add func(path string)
+	add = func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		out = append(out, rf.files[path])
+		for _, dep := range rf.deps[path] {
+			add(dep)
+		}
+	}
+	add(path)
+	return out
+}
+
+// reflectionRequest is a ServerReflectionRequest, with the raw message
+// to echo back.
+type reflectionRequest struct {
+	raw      []byte
+	host     string
+	filename string
+	symbol   string
+	// Set for the requests about extensions, which aren't used.
+	extension bool
+	list      bool
+}
+
+func (r *reflectionRequest) MarshalWire() []byte {
+	return r.raw
+}
+
+func (r *reflectionRequest) UnmarshalWire(b []byte) error {
+	r.raw = append([]byte{}, b...)
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			r.host = string(v)
+		case 3:
+			r.filename = string(v)
+		case 4:
+			r.symbol = string(v)
+		case 5, 6:
+			r.extension = true
+		case 7:
+			r.list = true
+		}
+		return nil
+	})
+}
+
+// reflectionResponse is a ServerReflectionResponse, already encoded.
+type reflectionResponse []byte
+
+func (r *reflectionResponse) MarshalWire() []byte {
+	return *r
+}
+
+func (r *reflectionResponse) UnmarshalWire(b []byte) error {
+	*r = append((*r)[:0], b...)
+	return nil
+}
+
+func reflectionError(b []byte, code codes.Code, msg string) []byte {
+	var e []byte
+	e = wireAppendVarint(e, 1, uint64(code))
+	e = wireAppendString(e, 2, msg)
+	return wireAppendBytes(b, 7, e)
+}
+
+func (rf *reflectionFiles) answer(req *reflectionRequest) []byte {
+	var resp []byte
+	resp = wireAppendString(resp, 1, req.host)
+	resp = wireAppendBytes(resp, 2, req.raw)
+
+	path := ""
+	switch {
+	case req.list:
+		var list []byte
+		for _, name := range []string{managementService, reflectionServiceV1Alpha, reflectionServiceV1} {
+			list = wireAppendBytes(list, 1, wireAppendString(nil, 1, name))
+		}
+		return wireAppendBytes(resp, 6, list)
+	case req.filename != "":
+		if _, ok := rf.files[req.filename]; !ok {
+			return reflectionError(resp, codes.NotFound, fmt.Sprintf("file %s not found", req.filename))
+		}
+		path = req.filename
+	case req.symbol != "":
+		var ok bool
+		if path, ok = rf.symbols[req.symbol]; !ok {
+			return reflectionError(resp, codes.NotFound, fmt.Sprintf("symbol %s not found", req.symbol))
+		}
+	case req.extension:
+		return reflectionError(resp, codes.NotFound, "no extensions")
+	default:
+		return reflectionError(resp, codes.InvalidArgument, "unsupported request")
+	}
+
+	var files []byte
+	for _, data := range rf.withDeps(path) {
+		files = wireAppendBytes(files, 1, data)
+	}
+	return wireAppendBytes(resp, 4, files)
+}
+
+func serveReflection(srv interface{}, stream grpc.ServerStream) error {
+	rf, err := loadManagementFiles()
+	if err != nil {
+		return err
+	}
+
+	for {
+		req := &reflectionRequest{}
+		if err := stream.RecvMsg(req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		resp := reflectionResponse(rf.answer(req))
+		if err := stream.SendMsg(&resp); err != nil {
+			return err
+		}
+	}
+}
+
+func reflectionServiceDesc(name string) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: name,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    "ServerReflectionInfo",
+				Handler:       serveReflection,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+		},
+		Metadata: "grpc/reflection/v1/reflection.proto",
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	renderCacheSize = 4096
+	// How often the store is checked for changes at most.
+	renderCacheRecheck = time.Second
+)
+
+// The matchbox store is read and its templates rendered on every request.
+// During a boot storm most requests are identical, so the responses are
+// cached by request and store version, which changes whenever a file in
+// the store is modified.
+
+var renderStoreDirs = []string{"groups", "profiles", "ignition", "generic", "cloud"}
+
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+}
+
+type renderCache struct {
+	root string
+
+	lock      sync.Mutex
+	version   uint64
+	checked   time.Time
+	responses map[string]*cachedResponse
+}
+
+func newRenderCache(root string) *renderCache {
+	return &renderCache{
+		root:      root,
+		responses: make(map[string]*cachedResponse),
+	}
+}
+
+// storeVersion fingerprints the names, sizes and modification times of
+// the files the rendered responses are built from.
+func (c *renderCache) storeVersion() uint64 {
+	h := fnv.New64a()
+
+	add := func(p string, fi os.FileInfo) {
+		fmt.Fprintf(h, "%s %d %d\n", p, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	for _, dir := range renderStoreDirs {
+		filepath.Walk(filepath.Join(c.root, dir), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				add(p, fi)
+			}
+			return nil
+		})
+	}
+
+	// Only the machine configs of the assets, not the images.
+	if files, err := ioutil.ReadDir(filepath.Join(c.root, "assets")); err == nil {
+		for _, fi := range files {
+			if isMachineConfigPath("/assets/" + fi.Name()) {
+				add(fi.Name(), fi)
+			}
+		}
+	}
+
+	return h.Sum64()
+}
+
+// get returns the cached response to the key, dropping the whole cache
+// if the store changed since it was last checked.
+func (c *renderCache) get(key string) *cachedResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now := time.Now(); now.Sub(c.checked) >= renderCacheRecheck {
+		c.checked = now
+		if version := c.storeVersion(); version != c.version {
+			c.version = version
+			c.responses = make(map[string]*cachedResponse)
+		}
+	}
+
+	return c.responses[key]
+}
+
+func (c *renderCache) put(key string, resp *cachedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.responses) >= renderCacheSize {
+		c.responses = make(map[string]*cachedResponse)
+	}
+	c.responses[key] = resp
+}
+
+func (s *Server) isRenderedPath(name string) bool {
+	return isMatchboxEndpoint(name) || isMachineConfigPath(name) && len(s.machineConfigPatches()) > 0
+}
+
+// renderCacheHandler answers repeated requests for rendered configs and
+// scripts from the cache. Only successful GET responses are cached, and
+// not the machine configs patched for the requesting node.
+func (s *Server) renderCacheHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		if req.Method != http.MethodGet || !s.isRenderedPath(name) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if isMachineConfigPath(name) && s.nodePatched(s.clientMAC(req)) {
+			renderCacheMisses.Inc()
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		key := fmt.Sprintf("%s?%s#%x", name, req.URL.Query().Encode(), s.templateVarsVersion())
+		resp := s.renderCache.get(key)
+		if resp == nil {
+			renderCacheMisses.Inc()
+
+			rr := httptest.NewRecorder()
+			next.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				copyHeader(w.Header(), rr.Header())
+				w.WriteHeader(rr.Code)
+				w.Write(rr.Body.Bytes())
+				return
+			}
+
+			resp = &cachedResponse{header: rr.Header(), body: rr.Body.Bytes()}
+			s.renderCache.put(key, resp)
+		} else {
+			renderCacheHits.Inc()
+		}
+
+		copyHeader(w.Header(), resp.header)
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp.body)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
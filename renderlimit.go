@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Rendering matchbox templates and patching machine configs takes CPU,
+// unlike serving assets. The renders missing the cache are limited to
+// RenderWorkers at a time, and to RenderClientLimit at a time for every
+// client, so that firmware re-requesting its config in a tight loop
+// can't starve the other nodes of a rollout. Requests over the client
+// limit are refused right away, those waiting too long for a worker are
+// told to come back later.
+
+const (
+	renderClientLimit = 2
+	renderWait        = 5 * time.Second
+)
+
+var renderWorkers = runtime.NumCPU()
+
+type renderLimiter struct {
+	slots     chan struct{}
+	perClient int
+
+	lock    sync.Mutex
+	clients map[string]int
+}
+
+func newRenderLimiter(workers, perClient int) *renderLimiter {
+	return &renderLimiter{
+		slots:     make(chan struct{}, workers),
+		perClient: perClient,
+		clients:   make(map[string]int),
+	}
+}
+
+// enter counts a request of the client, returning false if it already
+// has as many in flight as allowed.
+func (rl *renderLimiter) enter(client string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.perClient > 0 && rl.clients[client] >= rl.perClient {
+		return false
+	}
+	rl.clients[client]++
+	return true
+}
+
+func (rl *renderLimiter) leave(client string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.clients[client]--; rl.clients[client] <= 0 {
+		delete(rl.clients, client)
+	}
+}
+
+// renderClient identifies the client by its address and the MAC it asks
+// for, so that clients behind the same address, like those of an edge,
+// are told apart.
+func renderClient(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if isEdgeRequest(req) {
+		if forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ","); forwarded[0] != "" {
+			client = strings.TrimSpace(forwarded[len(forwarded)-1])
+		}
+	}
+	if mac := req.URL.Query().Get("mac"); mac != "" {
+		client += " " + mac
+	}
+	return client
+}
+
+// renderLimitHandler limits the rendered requests passed to the next
+// handler. Everything else is passed on as is.
+func (s *Server) renderLimitHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if !s.isRenderedPath(path.Clean(req.URL.Path)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		client := renderClient(req)
+
+		if !s.renderLimiter.enter(client) {
+			log.Warnf("Refusing %s to %s, it has %d requests in flight", req.URL.Path, client, s.renderLimiter.perClient)
+			renderLimited.WithLabelValues("client").Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer s.renderLimiter.leave(client)
+
+		select {
+		case s.renderLimiter.slots <- struct{}{}:
+			defer func() { <-s.renderLimiter.slots }()
+		case <-time.After(renderWait):
+			log.Warnf("Refusing %s to %s, all %d render workers are busy", req.URL.Path, client, cap(s.renderLimiter.slots))
+			renderLimited.WithLabelValues("busy").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(renderWait.Seconds())))
+			http.Error(w, "Server busy", http.StatusServiceUnavailable)
+			return
+		case <-req.Context().Done():
+			return
+		}
+		renders.Inc()
+		defer renders.Dec()
+
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+var busyRetryTemplate = template.Must(template.New("iPXE busy").Parse(`#!ipxe
+echo
+echo The server is busy, retrying in {{ .Delay }} seconds.
+sleep {{ .Delay }}
+chain {{ .URL }}
+`))
+
+// busyRetryScript returns the script retrying a boot script request
+// refused by the limits, which iPXE would otherwise give up on, or nil if
+// it wasn't refused.
+func busyRetryScript(req *http.Request, status int, header http.Header) []byte {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	delay, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || delay < 1 {
+		delay = 1
+	}
+
+	var buf bytes.Buffer
+	err = busyRetryTemplate.Execute(&buf, map[string]interface{}{
+		"Delay": delay,
+		"URL":   "http://" + req.Host + req.URL.RequestURI(),
+	})
+	if err != nil {
+		log.Errorf("Could not render busy script: %s", err)
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The provisioning report documents a cluster build for compliance and
+// handover: every node with its role, serial number and pinned Talos
+// version, when it booted, and which machine config it was served, with
+// its SHA-256. `talos-pxe report` writes it as a self-contained HTML page,
+// printable to PDF from a browser, and signs it with --sign-key into a
+// detached .sig file, which `talos-pxe report verify` checks.
+
+type reportRole struct {
+	Role  string
+	Count int
+}
+
+type reportData struct {
+	Title     string
+	Generated time.Time
+	Server    string
+	Roles     []reportRole
+	Nodes     []Node
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"dash": func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; font-size: 10pt; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #999; padding: 0.3em 0.5em; text-align: left; vertical-align: top; }
+th { background: #eee; }
+td.sum { font-family: monospace; font-size: 8pt; word-break: break-all; }
+@media print { body { margin: 0; } @page { size: landscape; } }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+<p>Generated {{ time .Generated }} from the talos-pxe server at {{ .Server }}.</p>
+<h2>Summary</h2>
+<table>
+<tr><th>Role</th><th>Nodes</th></tr>
+{{- range .Roles }}
+<tr><td>{{ .Role }}</td><td>{{ .Count }}</td></tr>
+{{- end }}
+</table>
+<h2>Nodes</h2>
+<table>
+<tr><th>Hostname</th><th>MAC</th><th>IP</th><th>Serial</th><th>Role</th><th>State</th><th>Talos version</th><th>Booted</th><th>Machine config</th><th>Served</th><th>SHA-256</th></tr>
+{{- range .Nodes }}
+<tr><td>{{ dash .Hostname }}</td><td>{{ .MAC }}</td><td>{{ .IP }}</td><td>{{ dash .Serial }}</td><td>{{ .Role }}</td><td>{{ dash .State }}</td><td>{{ dash .Version }}</td><td>{{ time .Booted }}</td><td>{{ dash .Config }}</td><td>{{ time .ConfigServed }}</td><td class="sum">{{ dash .ConfigSHA256 }}</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+func renderReport(title, server string, nodes []Node) ([]byte, error) {
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		counts[node.Role]++
+	}
+	var roles []reportRole
+	for role, count := range counts {
+		roles = append(roles, reportRole{role, count})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Role < roles[j].Role })
+
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, reportData{
+		Title:     title,
+		Generated: time.Now(),
+		Server:    server,
+		Roles:     roles,
+		Nodes:     nodes,
+	})
+	return buf.Bytes(), err
+}
+
+// configServedHandler records the machine configs served in the
+// inventory entries of the nodes fetching them.
+func (s *Server) configServedHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || !isMachineConfigPath(path.Clean(req.URL.Path)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rr := httptest.NewRecorder()
+		next.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			if mac := s.clientMAC(req); mac != nil {
+				s.nodes.configServed(mac, path.Clean(req.URL.Path), req.URL.RequestURI(), rr.Body.Bytes())
+				s.configServeHooks(mac)
+			}
+		}
+		copyHeader(w.Header(), rr.Header())
+		w.WriteHeader(rr.Code)
+		w.Write(rr.Body.Bytes())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func loadSigningKey(name string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM key found in %s", name)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key %s: %s", name, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key %s", name)
+	}
+	return signer, nil
+}
+
+func signReport(key crypto.Signer, data []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// verifyReport checks the signature with the public key of the
+// certificate or public key PEM.
+func verifyReport(name string, data, sig []byte) error {
+	pemData, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return fmt.Errorf("No PEM certificate or public key found in %s", name)
+	}
+
+	var pub interface{}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pub = cert.PublicKey
+	} else if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	ok := false
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, sig)
+	default:
+		return fmt.Errorf("Unsupported public key in %s", name)
+	}
+	if !ok {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+func runReport(args []string) error {
+	if len(args) > 0 && args[0] == "verify" {
+		return runReportVerify(args[1:])
+	}
+
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	titleFlag := flags.String("title", "Talos provisioning report", "Title of the report")
+	signKeyFlag := flags.String("sign-key", "", "PEM private key to sign the report with, e.g. <root>/ca/ca.key")
+	outputFlag := flags.StringP("output", "o", "report.html", "File to write the report to, the signature goes to the same name with .sig appended")
+	flags.Parse(args)
+
+	var key crypto.Signer
+	if *signKeyFlag != "" {
+		var err error
+		if key, err = loadSigningKey(*signKeyFlag); err != nil {
+			return err
+		}
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	nodes, err := client.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	data, err := renderReport(*titleFlag, *managementAddrFlag, nodes)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*outputFlag, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote the report of %d nodes to %s\n", len(nodes), *outputFlag)
+
+	if key == nil {
+		return nil
+	}
+	sig, err := signReport(key, data)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*outputFlag+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Signed it into %s.sig\n", *outputFlag)
+	return nil
+}
+
+func runReportVerify(args []string) error {
+	flags := flag.NewFlagSet("report verify", flag.ExitOnError)
+	certFlag := flags.String("cert", "", "PEM certificate or public key of the signing key, e.g. <root>/ca/ca.crt")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 || *certFlag == "" {
+		return fmt.Errorf("Usage: %s report verify --cert CERT REPORT [SIGNATURE]", os.Args[0])
+	}
+	report := flags.Arg(0)
+	sigFile := report + ".sig"
+	if flags.NArg() == 2 {
+		sigFile = flags.Arg(1)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		return err
+	}
+	encoded, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("Invalid signature %s: %s", sigFile, err)
+	}
+
+	if err := verifyReport(*certFlag, data, sig); err != nil {
+		return fmt.Errorf("%s: %s", report, err)
+	}
+	fmt.Printf("%s: signature OK\n", report)
+	return nil
+}
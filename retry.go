@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// When no matchbox profile matches a machine choosing a role, e.g. because
+// its group hasn't been written yet, the machine is told to retry with a
+// backoff instead of getting the menu again, which unattended firmware
+// gives up on. The attempt is passed along in the retry parameter.
+
+const (
+	configRetryParam    = "retry"
+	configRetryMaxDelay = 5 * time.Minute
+)
+
+var configRetryTemplate = template.Must(template.New("iPXE retry").Parse(`#!ipxe
+echo
+echo No {{ .Type }} profile matches this machine ({{ .MAC }}) yet.
+echo Retrying in {{ .Delay }} seconds, attempt {{ .Attempt }} of {{ .Attempts }}.
+sleep {{ .Delay }}
+chain {{ .URL }}
+`))
+
+type configRetryData struct {
+	Type     string
+	MAC      string
+	Delay    int
+	Attempt  int
+	Attempts int
+	URL      string
+}
+
+// takeRetry removes the retry parameter from the request, so that it
+// doesn't reach matchbox, and returns the attempt.
+func takeRetry(req *http.Request) int {
+	query := req.URL.Query()
+	if _, ok := query[configRetryParam]; !ok {
+		return 0
+	}
+
+	retry, _ := strconv.Atoi(query.Get(configRetryParam))
+	query.Del(configRetryParam)
+	req.URL.RawQuery = query.Encode()
+	return retry
+}
+
+// retryData is what the retry scripts need to retry the request, with
+// the backoff of the attempt, with ok false if the attempts ran out.
+func (s *Server) retryData(req *http.Request, retry int) (configRetryData, bool) {
+	if retry >= s.ConfigRetryAttempts {
+		return configRetryData{}, false
+	}
+
+	delay := s.ConfigRetryDelay << uint(retry)
+	if delay > configRetryMaxDelay || delay <= 0 {
+		delay = configRetryMaxDelay
+	}
+
+	query := req.URL.Query()
+	query.Set(configRetryParam, strconv.Itoa(retry+1))
+	data := configRetryData{
+		Type:     query.Get("type"),
+		MAC:      query.Get("mac"),
+		Delay:    int(delay / time.Second),
+		Attempt:  retry + 1,
+		Attempts: s.ConfigRetryAttempts,
+		URL:      "http://" + req.Host + req.URL.Path + "?" + query.Encode(),
+	}
+	if data.Delay < 1 {
+		data.Delay = 1
+	}
+	return data, true
+}
+
+// configRetryScript returns the script retrying a request matchbox had no
+// profile for, or nil if the request can't be retried or the attempts
+// ran out.
+func (s *Server) configRetryScript(req *http.Request, status int, retry int) []byte {
+	query := req.URL.Query()
+	if status != http.StatusNotFound || query.Get("type") == "" {
+		return nil
+	}
+
+	data, ok := s.retryData(req, retry)
+	if !ok {
+		if s.ConfigRetryAttempts > 0 {
+			log.Warnf("No %s profile for %s after %d attempts, serving the menu", query.Get("type"), query.Get("mac"), retry)
+		}
+		return nil
+	}
+
+	log.Infof("No %s profile for %s, retrying in %ds", data.Type, data.MAC, data.Delay)
+
+	var buf bytes.Buffer
+	if err := configRetryTemplate.Execute(&buf, data); err != nil {
+		log.Errorf("Could not render retry script: %s", err)
+		return nil
+	}
+	return buf.Bytes()
+}
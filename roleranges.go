@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// Controlplane nodes and workers can be leased addresses from blocks of
+// their own, so that firewall rules can tell them apart and controlplane
+// addresses never mix with the churn of workers. New clients are leased
+// from the provisioning range until their role is known: once a node
+// boots a role, its next DHCP discover moves its lease into the range of
+// the role, where controlplane leases are pinned.
+
+// rangeRoles are the roles with ranges, init nodes are controlplane nodes.
+var rangeRoles = []string{"controlplane", "worker"}
+
+func checkRoleRanges(ranges map[string]*AddressRange) error {
+	for role, r := range ranges {
+		if role != "controlplane" && role != "worker" {
+			return fmt.Errorf("unknown role %s, has to be controlplane or worker", role)
+		}
+		if err := r.check(); err != nil {
+			return fmt.Errorf("%s: %s", role, err)
+		}
+	}
+	return nil
+}
+
+// setupRoleRanges carves the ranges of the roles out of the provisioning
+// range.
+func (s *Server) setupRoleRanges() error {
+	s.roleRanges = make(map[string]*addressRange)
+	for _, role := range rangeRoles {
+		config, ok := s.Config.RoleRanges[role]
+		if !ok {
+			continue
+		}
+		if s.ProxyDHCP {
+			log.Warnf("Not leasing %s nodes their own range in proxyDHCP mode", role)
+			continue
+		}
+		r, err := s.carveRange(role+" nodes", config)
+		if err != nil {
+			return err
+		}
+		s.roleRanges[role] = r
+	}
+	return nil
+}
+
+// roleRange returns the range of the role of the node, known from its
+// boots or its node pool, nil if none.
+func (s *Server) roleRange(mac net.HardwareAddr) *addressRange {
+	if len(s.roleRanges) == 0 {
+		return nil
+	}
+	var role string
+	if node, ok := s.nodes.get(mac.String()); ok {
+		role = node.Role
+	}
+	if role == "" {
+		if p := s.nodePool(url.Values{"mac": {mac.String()}}); p != nil {
+			role = p.Role
+		}
+	}
+	if isControlplaneRole(role) {
+		role = "controlplane"
+	}
+	return s.roleRanges[role]
+}
+
+// moveLeaseLocked moves the lease of the client into the range it's to be
+// leased from, if it was leased an address outside before its role or
+// pool was known, or back into the provisioning range once it has none,
+// e.g. demoted from controlplane. Pinned and quarantined leases stay where they are. Must
+// be called with DHCPLock held.
+func (s *Server) moveLeaseLocked(mac net.HardwareAddr, record *DHCPRecord) *DHCPRecord {
+	if record.pinned || record.quarantined {
+		return record
+	}
+	allocator, name := s.DHCPAllocator, "the provisioning range"
+	if r := s.leaseRange(mac); r != nil {
+		if r.contains(record.IP) {
+			return record
+		}
+		allocator, name = r.allocator, "the range of "+r.name
+	} else if s.allocatorOf(record) == s.DHCPAllocator {
+		return record
+	}
+
+	newIp, err := allocator.Allocate(net.IPNet{})
+	if err != nil {
+		log.Errorf("Could not move the lease of %s to %s: %s", mac, name, err)
+		return record
+	}
+	s.dropLeaseLocked(mac.String(), record)
+	moved := &DHCPRecord{
+		IP:      newIp.IP,
+		expires: record.expires,
+		granted: record.granted,
+	}
+	s.DHCPRecords[mac.String()] = moved
+	log.Infof("Moved the lease of %s from %s to %s in %s", mac, record.IP, moved.IP, name)
+
+	node, ok := s.nodes.update(mac.String(), func(node *Node) {
+		node.IP = moved.IP.String()
+	})
+	if s.ControlplaneVIP == nil {
+		s.DNSRecords.RemoveName(s.Controlplane, record.IP)
+	}
+	if ok && isControlplaneRole(node.Role) {
+		moved.pinned = true
+		log.Infof("Pinned %s to controlplane node %s", moved.IP, mac)
+		s.savePinsLocked()
+		if s.ControlplaneVIP == nil {
+			s.registerDNSEntry(s.Controlplane, moved.IP)
+		}
+	}
+	return moved
+}
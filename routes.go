@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Routes mount extra backends on the HTTP port next to matchbox, e.g. an
+// OCI registry cache under /registry/ or a bucket of extra assets, so
+// that nodes only need to reach the server. The longest matching prefix
+// wins, everything else goes to matchbox as before.
+
+// An HTTPRoute sends the requests under Prefix to a backend, either
+// proxied to URL or served from the files in Dir.
+type HTTPRoute struct {
+	// Prefix ending in / matches the paths under it, otherwise only the
+	// path itself.
+	Prefix string `json:"prefix"`
+	URL    string `json:"url,omitempty"`
+	Dir    string `json:"dir,omitempty"`
+	// StripPrefix removes the prefix from the path passed on.
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+	// CA verifies the certificate of an https URL instead of the system
+	// roots.
+	CA string `json:"ca,omitempty"`
+}
+
+// Paths the server itself answers, which routes can't take over.
+var reservedRoutePrefixes = []string{"/ipxe", "/assets/", progressPath, inventoryPath}
+
+func (r *HTTPRoute) check() error {
+	if !strings.HasPrefix(r.Prefix, "/") || path.Clean(r.Prefix) == "/" {
+		return fmt.Errorf("prefix needs to be an absolute path other than /")
+	}
+	for _, reserved := range reservedRoutePrefixes {
+		under := strings.HasSuffix(reserved, "/") && strings.HasPrefix(r.Prefix, reserved)
+		if r.matches(reserved) || under {
+			return fmt.Errorf("prefix %s takes over %s", r.Prefix, reserved)
+		}
+	}
+	if isMatchboxEndpoint(path.Clean(r.Prefix)) {
+		return fmt.Errorf("prefix %s takes over a matchbox endpoint", r.Prefix)
+	}
+
+	if (r.URL == "") == (r.Dir == "") {
+		return fmt.Errorf("route %s needs either a url or a dir", r.Prefix)
+	}
+	if r.URL != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("route %s needs an http or https url", r.Prefix)
+		}
+	}
+	if r.CA != "" && r.URL == "" {
+		return fmt.Errorf("route %s only needs a ca with an https url", r.Prefix)
+	}
+	return nil
+}
+
+func (r *HTTPRoute) matches(name string) bool {
+	if strings.HasSuffix(r.Prefix, "/") {
+		return strings.HasPrefix(name, r.Prefix)
+	}
+	return name == r.Prefix
+}
+
+type httpRoute struct {
+	*HTTPRoute
+	handler http.Handler
+}
+
+// newRouteHandler returns the handler of the backend of the route.
+func newRouteHandler(r *HTTPRoute) (http.Handler, error) {
+	var handler http.Handler
+	if r.Dir != "" {
+		handler = http.FileServer(http.Dir(r.Dir))
+	} else {
+		target, err := url.Parse(r.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if r.CA != "" {
+			pem, err := ioutil.ReadFile(r.CA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in %s", r.CA)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = transport
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			// Virtual hosted backends, like buckets, go by the host.
+			req.Host = target.Host
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Errorf("Could not proxy %s to %s: %s", req.URL.Path, r.URL, err)
+			http.Error(w, "backend unreachable", http.StatusBadGateway)
+		}
+		handler = proxy
+	}
+
+	if r.StripPrefix {
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		return http.StripPrefix(prefix, handler), nil
+	}
+	return handler, nil
+}
+
+// newHTTPRoutes sets up the backends of the routes, the longest prefix
+// first.
+func newHTTPRoutes(config []HTTPRoute) ([]httpRoute, error) {
+	var routes []httpRoute
+	for i := range config {
+		r := &config[i]
+		handler, err := newRouteHandler(r)
+		if err != nil {
+			return nil, fmt.Errorf("Route %s: %s", r.Prefix, err)
+		}
+		routes = append(routes, httpRoute{r, handler})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].Prefix) > len(routes[j].Prefix) })
+	return routes, nil
+}
+
+// routeHandler passes the requests matching a route to its backend, and
+// everything else to the next handler.
+func (s *Server) routeHandler(next http.Handler) http.Handler {
+	if len(s.routes) == 0 {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean("/" + req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/") && name != "/" {
+			name += "/"
+		}
+		for _, r := range s.routes {
+			if r.matches(name) {
+				r.handler.ServeHTTP(w, req)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	secretsMasterKeyFile = "master.key"
+	secretsStoreFile     = "secrets.enc"
+)
+
+// secretsStore keeps named secrets on disk, encrypted with a master key
+// which is generated next to them on first use. Keep the master key on a
+// different medium if the server root can't be trusted.
+type secretsStore struct {
+	lock   sync.Mutex
+	dir    string
+	aead   cipher.AEAD
+	values map[string][]byte
+}
+
+func openSecretsStore(dir string) (*secretsStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadFile(filepath.Join(dir, secretsMasterKeyFile))
+	if os.IsNotExist(err) {
+		log.Infof("Generating secrets master key in %s", dir)
+
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, secretsMasterKeyFile), key, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secrets master key: %s", err)
+	}
+
+	st := &secretsStore{
+		dir:    dir,
+		aead:   aead,
+		values: make(map[string][]byte),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, secretsStoreFile))
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	plain, err := openSealed(aead, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt secrets store: %s", err)
+	}
+
+	if err := json.Unmarshal(plain, &st.values); err != nil {
+		return nil, fmt.Errorf("Corrupt secrets store: %s", err)
+	}
+
+	return st, nil
+}
+
+// Get returns the named secret.
+func (st *secretsStore) Get(name string) ([]byte, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	value, ok := st.values[name]
+	return value, ok
+}
+
+// Put stores the named secret and persists the store.
+func (st *secretsStore) Put(name string, value []byte) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.values[name] = value
+	return st.save()
+}
+
+// GetOrCreate returns the named secret, generating it from size random
+// bytes if it doesn't exist yet.
+func (st *secretsStore) GetOrCreate(name string, size int) ([]byte, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if value, ok := st.values[name]; ok {
+		return value, nil
+	}
+
+	value := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, value); err != nil {
+		return nil, err
+	}
+
+	st.values[name] = value
+	if err := st.save(); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// save writes the store to disk. Must be called with the lock held.
+func (st *secretsStore) save() error {
+	plain, err := json.Marshal(st.values)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := seal(st.aead, plain, nil)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(st.dir, secretsStoreFile+".tmp")
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(st.dir, secretsStoreFile))
+}
+
+// secretsStore opens the server's secrets store on first use.
+func (s *Server) secretsStore() (*secretsStore, error) {
+	s.secretsLock.Lock()
+	defer s.secretsLock.Unlock()
+
+	if s.secrets != nil {
+		return s.secrets, nil
+	}
+
+	st, err := openSecretsStore(s.secretsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	s.secrets = st
+	return st, nil
+}
+
+func (s *Server) secretsDir() string {
+	if s.SecretsDir != "" {
+		return s.SecretsDir
+	}
+	return filepath.Join(s.ServerRoot, "secrets")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain, prepending the random nonce to the result.
+func seal(aead cipher.AEAD, plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+// openSealed reverses seal.
+func openSealed(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+}
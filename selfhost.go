@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Once the first nodes are up, talos-pxe can move from the laptop used on
+// day 0 into the cluster. `talos-pxe selfhost manifests` writes the
+// manifests running it on a node of the cluster, with host networking to
+// serve DHCP, PXE and TFTP on the provisioning network, carrying over the
+// state of the running server as a snapshot imported on startup.
+
+const (
+	selfhostDataDir  = "/var/lib/talos-pxe"
+	selfhostStateDir = "/state"
+)
+
+type selfhostData struct {
+	Namespace string
+	Node      string
+	Image     string
+	DataDir   string
+	Args      []string
+	State     string
+}
+
+var selfhostTemplate = template.Must(template.New("selfhost").Funcs(template.FuncMap{
+	"quote": func(s string) string {
+		data, _ := json.Marshal(s)
+		return string(data)
+	},
+}).Parse(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: {{ quote .Namespace }}
+  labels:
+    # DHCP and PXE need the host network.
+    pod-security.kubernetes.io/enforce: privileged
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: talos-pxe-state
+  namespace: {{ quote .Namespace }}
+data:
+  state.json: {{ .State }}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: talos-pxe
+  namespace: {{ quote .Namespace }}
+spec:
+  replicas: 1
+  # Never two servers answering DHCP.
+  strategy:
+    type: Recreate
+  selector:
+    matchLabels:
+      app: talos-pxe
+  template:
+    metadata:
+      labels:
+        app: talos-pxe
+    spec:
+      hostNetwork: true
+      dnsPolicy: ClusterFirstWithHostNet
+      nodeSelector:
+        kubernetes.io/hostname: {{ quote .Node }}
+      tolerations:
+        - key: node-role.kubernetes.io/control-plane
+          operator: Exists
+          effect: NoSchedule
+      containers:
+        - name: talos-pxe
+          image: {{ quote .Image }}
+          args:
+{{- range .Args }}
+            - {{ quote . }}
+{{- end }}
+          securityContext:
+            capabilities:
+              add: ["NET_ADMIN", "NET_BIND_SERVICE", "NET_RAW"]
+          volumeMounts:
+            - name: data
+              mountPath: /data
+            - name: state
+              mountPath: ` + selfhostStateDir + `
+              readOnly: true
+      volumes:
+        - name: data
+          hostPath:
+            path: {{ quote .DataDir }}
+            type: DirectoryOrCreate
+        - name: state
+          secret:
+            secretName: talos-pxe-state
+`))
+
+func runSelfhost(args []string) error {
+	flags := flag.NewFlagSet("selfhost", flag.ExitOnError)
+	nodeFlag := flags.String("node", "", "Name of the Kubernetes node to run talos-pxe on")
+	imageFlag := flags.String("image", "", "talos-pxe image with the server root, pushed to a registry the cluster pulls from")
+	namespaceFlag := flags.String("namespace", "talos-pxe", "Namespace to run talos-pxe in")
+	dataDirFlag := flags.String("data-dir", selfhostDataDir, "Directory on the node keeping the pinned leases, secrets and CA")
+	stateFlag := flags.String("state", "", "State snapshot to carry over, exported from the running server if empty")
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the running server")
+	outputFlag := flags.StringP("output", "o", "", "File to write the manifests to instead of stdout")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s selfhost manifests --node NODE --image IMAGE [flags] [-- SERVER FLAGS]", os.Args[0])
+	if flags.NArg() < 1 || flags.Arg(0) != "manifests" || *nodeFlag == "" || *imageFlag == "" {
+		return usage
+	}
+
+	var state []byte
+	if *stateFlag != "" {
+		data, err := ioutil.ReadFile(*stateFlag)
+		if err != nil {
+			return err
+		}
+		var st State
+		if err := json.Unmarshal(data, &st); err != nil {
+			return fmt.Errorf("Invalid snapshot %s: %s", *stateFlag, err)
+		}
+		if err := st.check(); err != nil {
+			return fmt.Errorf("Invalid snapshot %s: %s", *stateFlag, err)
+		}
+		state = data
+	} else {
+		client, err := dialManagement(*managementAddrFlag)
+		if err != nil {
+			return err
+		}
+		st, err := client.ExportState()
+		client.Close()
+		if err != nil {
+			return fmt.Errorf("Could not export the state of the running server: %s", err)
+		}
+		if state, err = json.Marshal(st); err != nil {
+			return err
+		}
+	}
+
+	// The state on the node outlives the pod, the root is the one of
+	// the image.
+	serverArgs := []string{
+		"--root", "/srv",
+		"--pins-file", "/data/pins.json",
+		"--secrets-dir", "/data/secrets",
+		"--ca-dir", "/data/ca",
+		"--import-state", selfhostStateDir + "/state.json",
+	}
+	serverArgs = append(serverArgs, flags.Args()[1:]...)
+
+	var buf bytes.Buffer
+	err := selfhostTemplate.Execute(&buf, selfhostData{
+		Namespace: *namespaceFlag,
+		Node:      *nodeFlag,
+		Image:     *imageFlag,
+		DataDir:   *dataDirFlag,
+		Args:      serverArgs,
+		State:     base64.StdEncoding.EncodeToString(state),
+	})
+	if err != nil {
+		return err
+	}
+
+	if *outputFlag == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*outputFlag, buf.Bytes(), 0600)
+}
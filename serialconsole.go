@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Which serial port the BMC redirects to its serial over LAN differs
+// between vendors, so a single console= argument in the profiles leaves
+// some of the fleet without serial output. The menu passes the SMBIOS
+// manufacturer and product of the client, and the console arguments of
+// the first matching serial console replace those of the kernel command
+// line of the boot script. The configured serial consoles are tried
+// before the built-in ones.
+
+// A SerialConsole sets the console arguments of the clients of a
+// hardware model. Manufacturer and Product are globs, matched ignoring
+// case.
+type SerialConsole struct {
+	Comment      string   `json:"comment,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Product      string   `json:"product,omitempty"`
+	Args         []string `json:"args"`
+}
+
+// The serial over LAN ports of common BMCs, COM2 on most servers.
+var defaultSerialConsoles = []SerialConsole{
+	{Manufacturer: "QEMU", Args: []string{"console=tty0", "console=ttyS0,115200n8"}},
+	{Manufacturer: "VMware*", Args: []string{"console=tty0", "console=ttyS0,115200n8"}},
+	{Manufacturer: "Supermicro", Args: []string{"console=tty0", "console=ttyS1,115200n8"}},
+	{Manufacturer: "Dell*", Args: []string{"console=tty0", "console=ttyS1,115200n8"}},
+	{Manufacturer: "HP*", Args: []string{"console=tty0", "console=ttyS1,115200n8"}},
+}
+
+func (c *SerialConsole) check() error {
+	if c.Manufacturer == "" && c.Product == "" {
+		return fmt.Errorf("needs a manufacturer or a product")
+	}
+	for _, pattern := range []string{c.Manufacturer, c.Product} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+	}
+	if len(c.Args) == 0 {
+		return fmt.Errorf("needs console arguments")
+	}
+	for _, arg := range c.Args {
+		if !strings.HasPrefix(arg, "console=") {
+			return fmt.Errorf("%s is not a console argument", arg)
+		}
+	}
+	return nil
+}
+
+func (c *SerialConsole) matches(manufacturer, product string) bool {
+	for _, m := range [][2]string{{c.Manufacturer, manufacturer}, {c.Product, product}} {
+		if m[0] == "" {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(m[0]), strings.ToLower(strings.TrimSpace(m[1]))); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// serialConsole returns the serial console of the hardware model, or nil
+// if none matches.
+func (s *Server) serialConsole(manufacturer, product string) *SerialConsole {
+	if manufacturer == "" && product == "" {
+		return nil
+	}
+
+	var consoles []SerialConsole
+	if s.Config != nil {
+		consoles = s.Config.SerialConsoles
+	}
+	for _, list := range [][]SerialConsole{consoles, defaultSerialConsoles} {
+		for i := range list {
+			if list[i].matches(manufacturer, product) {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// withSerialConsole replaces the console arguments of the kernel command
+// line of the boot script with those of the hardware model.
+func (s *Server) withSerialConsole(script []byte, manufacturer, product string) []byte {
+	console := s.serialConsole(manufacturer, product)
+	if console == nil {
+		return script
+	}
+
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "kernel" {
+			continue
+		}
+
+		kept := fields[:0]
+		for _, field := range fields {
+			if !strings.HasPrefix(field, "console=") {
+				kept = append(kept, field)
+			}
+		}
+		lines[i] = strings.Join(append(kept, console.Args...), " ")
+		log.Debugf("Using %s for %s %s", strings.Join(console.Args, " "), manufacturer, product)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The services of the server are published as SRV and TXT records under
+// ServiceDomain, so that other tooling of the lab can find them through
+// DNS instead of hardcoding addresses. Every service type is also listed
+// for DNS-SD browsing under _services._dns-sd._udp.
+
+const serviceDomain = clusterDomain + "."
+
+// serviceRecords are the records of the published services by name.
+type serviceRecords map[string][]dns.RR
+
+// A publishedService is a service of the server reachable by the nodes.
+type publishedService struct {
+	// Type is the service type, e.g. _http._tcp.
+	Type string
+	Port int
+	TXT  []string
+}
+
+// publishedServices returns the services reachable on the server IP.
+// The admin and management listeners are only published when bound to
+// it or to every address, loopback ones aren't of any use to others.
+func (s *Server) publishedServices() []publishedService {
+	var services []publishedService
+	if !s.DisableHTTP {
+		services = append(services, publishedService{"_http._tcp", s.HTTPPort, []string{"path=/"}})
+	}
+	if s.TLSCert != "" || s.MTLS {
+		services = append(services, publishedService{"_https._tcp", s.HTTPSPort, []string{"path=/"}})
+	}
+	if port := s.reachablePort(s.AdminAddr); port != 0 {
+		services = append(services,
+			publishedService{"_talos-pxe-api._tcp", port, []string{"path=/api/v1"}},
+			publishedService{"_metrics._tcp", port, []string{"path=/metrics"}})
+	}
+	if port := s.reachablePort(s.ManagementAddr); port != 0 {
+		services = append(services, publishedService{"_talos-pxe-grpc._tcp", port, nil})
+	}
+	return services
+}
+
+// reachablePort returns the port of the listen address if the nodes can
+// reach it on the server IP, or 0.
+func (s *Server) reachablePort(addr string) int {
+	if addr == "" {
+		return 0
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !(ip.IsUnspecified() || ip.Equal(s.IP))) {
+		log.Debugf("Not publishing %s, it isn't reachable on %s", addr, s.IP)
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// serviceHost is the name the SRV records point to, resolving to the
+// server IP.
+func (s *Server) serviceHost() string {
+	return "pxe." + dns.Fqdn(strings.ToLower(s.ServiceDomain))
+}
+
+// publishServices builds the records of the published services and
+// registers the name of the server.
+func (s *Server) publishServices() {
+	domain := dns.Fqdn(strings.ToLower(s.ServiceDomain))
+	host := s.serviceHost()
+	records := make(serviceRecords)
+	browse := "_services._dns-sd._udp." + domain
+
+	for _, svc := range s.publishedServices() {
+		name := svc.Type + "." + domain
+		instance := "talos-pxe." + name
+
+		records[browse] = append(records[browse], &dns.PTR{
+			Hdr: dns.RR_Header{Name: browse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: DNSTTL},
+			Ptr: name,
+		})
+		records[name] = append(records[name], &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: DNSTTL},
+			Ptr: instance,
+		})
+
+		// SRV on the service type too, for clients looking it up
+		// directly instead of browsing, like Prometheus.
+		for _, owner := range []string{name, instance} {
+			records[owner] = append(records[owner], &dns.SRV{
+				Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: DNSTTL},
+				Port:   uint16(svc.Port),
+				Target: host,
+			})
+			records[owner] = append(records[owner], &dns.TXT{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: DNSTTL},
+				Txt: append([]string{"txtvers=1"}, svc.TXT...),
+			})
+		}
+	}
+
+	s.serviceRecords = records
+	s.registerDNSEntry(host, s.advertisedIP())
+}
+
+// lookupService returns the records of the type published for the name.
+func (s *Server) lookupService(name string, qtype uint16) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range s.serviceRecords[name] {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+// serviceEntries lists the published records for the DNS API.
+func (s *Server) serviceEntries() []DNSEntry {
+	out := []DNSEntry{}
+	for _, rrs := range s.serviceRecords {
+		for _, rr := range rrs {
+			h := rr.Header()
+			data := strings.TrimSpace(strings.TrimPrefix(rr.String(), h.String()))
+			out = append(out, DNSEntry{Name: h.Name, Type: dns.TypeToString[h.Rrtype], Data: data})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
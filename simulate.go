@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/borancar/talos-pxe/pxesim"
+	"github.com/insomniacslk/dhcp/iana"
+	flag "github.com/spf13/pflag"
+)
+
+// runSimulate boots a fake client against a running server to validate
+// the whole pipeline without real hardware.
+func runSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	ifNameFlag := flags.String("if", "veth1", "Interface to simulate the client on")
+	macFlag := flags.String("mac", "", "Client MAC address (default interface address)")
+	biosFlag := flags.Bool("bios", false, "Simulate legacy BIOS firmware instead of x86-64 EFI")
+	roleFlag := flags.String("role", "worker", "Menu entry to select")
+	configureFlag := flags.Bool("configure-address", true, "Assign the leased address to the interface")
+	timeoutFlag := flags.Duration("timeout", 10*time.Second, "Timeout for every step")
+	manufacturerFlag := flags.String("manufacturer", "", "SMBIOS manufacturer of the client")
+	productFlag := flags.String("product", "", "SMBIOS product of the client")
+	clockOffsetFlag := flags.Duration("clock-offset", 0, "Offset of the clock of the client from the local one")
+	serverPortFlag := flags.Int("server-port", 67, "DHCP port of the server, for a server on high ports")
+	clientPortFlag := flags.Int("client-port", 68, "DHCP port of the client")
+	tftpPortFlag := flags.Int("tftp-port", 69, "TFTP port of the server, unless the boot file URL has one")
+	unprivilegedFlag := flags.Bool("unprivileged", false, "Use a UDP socket instead of a raw one, asking for broadcast replies, with a --client-port above 1023")
+	flags.Parse(args)
+
+	cfg := pxesim.Config{
+		Interface:        *ifNameFlag,
+		Role:             *roleFlag,
+		ConfigureAddress: *configureFlag,
+		Timeout:          *timeoutFlag,
+		Manufacturer:     *manufacturerFlag,
+		Product:          *productFlag,
+		ClockOffset:      *clockOffsetFlag,
+		ServerPort:       *serverPortFlag,
+		ClientPort:       *clientPortFlag,
+		TFTPPort:         *tftpPortFlag,
+		Unprivileged:     *unprivilegedFlag,
+		Logf:             log.Infof,
+	}
+
+	if *macFlag != "" {
+		mac, err := net.ParseMAC(*macFlag)
+		if err != nil {
+			return err
+		}
+		cfg.MAC = mac
+	}
+
+	if *biosFlag {
+		cfg.Arch = iana.INTEL_X86PC
+		cfg.ClassID = "PXEClient:Arch:00000:UNDI:002001"
+	}
+
+	res, err := pxesim.Run(context.Background(), cfg)
+	if err != nil {
+		return fmt.Errorf("Simulated boot failed: %s", err)
+	}
+
+	log.Infof("Simulated boot succeeded, boot script:\n%s", res.Script)
+
+	return nil
+}
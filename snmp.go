@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal SNMPv2c client, only doing GETs, which is all looking up the
+// switch port of a MAC takes, see switchlocate.go.
+
+const (
+	snmpTimeout = 2 * time.Second
+	snmpRetries = 2
+
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	snmpGetRequest = 0xa0
+	snmpResponse   = 0xa2
+	// The exceptions of RFC 3416 returned instead of a value.
+	snmpNoSuchObject   = 0x80
+	snmpNoSuchInstance = 0x81
+	snmpEndOfMibView   = 0x82
+)
+
+var errSNMPNoSuchName = fmt.Errorf("No such object")
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	return append(append([]byte{tag}, berLength(len(value))...), value...)
+}
+
+func berInt(v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v != 0 && v != -1; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	// Keep the sign of positive values with the top bit set.
+	if v == 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(berInteger, b)
+}
+
+func berOIDValue(oid string) ([]byte, error) {
+	var parts []uint64
+	for _, part := range strings.Split(strings.TrimPrefix(oid, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OID %s", oid)
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid OID %s", oid)
+	}
+
+	b := []byte{byte(parts[0]*40 + parts[1])}
+	for _, n := range parts[2:] {
+		sub := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			sub = append([]byte{0x80 | byte(n&0x7f)}, sub...)
+		}
+		b = append(b, sub...)
+	}
+	return berTLV(berOID, b), nil
+}
+
+// berRead splits the first TLV off b.
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("Truncated SNMP message")
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, fmt.Errorf("Invalid SNMP length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, fmt.Errorf("Truncated SNMP message")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+func berIntValue(b []byte) int {
+	var v int
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// snmpGet gets the value of the OID from the agent at the address,
+// returning its BER tag and contents.
+func snmpGet(address, community, oid string) (byte, []byte, error) {
+	name, err := berOIDValue(oid)
+	if err != nil {
+		return 0, nil, err
+	}
+	id := int(rand.Int31())
+	varbind := berTLV(berSequence, append(name, berTLV(berNull, nil)...))
+	pdu := berTLV(snmpGetRequest, concatBytes(berInt(id), berInt(0), berInt(0), berTLV(berSequence, varbind)))
+	// Version 1 is SNMPv2c.
+	msg := berTLV(berSequence, concatBytes(berInt(1), berTLV(berOctetString, []byte(community)), pdu))
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt <= snmpRetries; attempt++ {
+		if _, err := conn.Write(msg); err != nil {
+			return 0, nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(snmpTimeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			tag, value, respID, err := snmpParseResponse(buf[:n])
+			if err != nil {
+				return 0, nil, err
+			}
+			// Late answers to earlier attempts are the same.
+			if respID == id {
+				return tag, value, nil
+			}
+		}
+	}
+	return 0, nil, fmt.Errorf("No SNMP response from %s", address)
+}
+
+func snmpParseResponse(b []byte) (byte, []byte, int, error) {
+	var tag byte
+	var value []byte
+	var err error
+
+	if tag, b, _, err = berRead(b); err != nil || tag != berSequence {
+		return 0, nil, 0, fmt.Errorf("Invalid SNMP message")
+	}
+	// Version and community.
+	for i := 0; i < 2; i++ {
+		if _, _, b, err = berRead(b); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	if tag, b, _, err = berRead(b); err != nil || tag != snmpResponse {
+		return 0, nil, 0, fmt.Errorf("Invalid SNMP response")
+	}
+
+	var fields [3]int
+	for i := range fields {
+		if tag, value, b, err = berRead(b); err != nil || tag != berInteger {
+			return 0, nil, 0, fmt.Errorf("Invalid SNMP response")
+		}
+		fields[i] = berIntValue(value)
+	}
+	id, status := fields[0], fields[1]
+	if status == 2 {
+		return 0, nil, id, errSNMPNoSuchName
+	} else if status != 0 {
+		return 0, nil, id, fmt.Errorf("SNMP error status %d", status)
+	}
+
+	// The varbind list, its first varbind, and the name of it.
+	for i := 0; i < 2; i++ {
+		if _, b, _, err = berRead(b); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	if _, _, b, err = berRead(b); err != nil {
+		return 0, nil, 0, err
+	}
+	if tag, value, _, err = berRead(b); err != nil {
+		return 0, nil, 0, err
+	}
+	switch tag {
+	case snmpNoSuchObject, snmpNoSuchInstance, snmpEndOfMibView:
+		return 0, nil, id, errSNMPNoSuchName
+	}
+	return tag, value, id, nil
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// A state snapshot holds what the server learned while provisioning: the
+// leases, the node inventory with the roles of the nodes, and the DNS
+// records. Importing it into the server on new hardware carries on where
+// the old one left, with the nodes keeping their addresses and names.
+
+const stateVersion = 1
+
+type State struct {
+	Version  int        `json:"version"`
+	Exported time.Time  `json:"exported"`
+	Leases   []Lease    `json:"leases"`
+	Nodes    []Node     `json:"nodes"`
+	DNS      []DNSEntry `json:"dns"`
+}
+
+// StateImport counts what was restored from a snapshot.
+type StateImport struct {
+	Leases int `json:"leases"`
+	Nodes  int `json:"nodes"`
+	DNS    int `json:"dns"`
+}
+
+func (s *Server) exportState() State {
+	return State{
+		Version:  stateVersion,
+		Exported: time.Now(),
+		Leases:   s.leases(),
+		Nodes:    s.nodes.list(),
+		DNS:      s.DNSRecords.Entries(),
+	}
+}
+
+func (st *State) check() error {
+	if st.Version != stateVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d", st.Version, stateVersion)
+	}
+	for _, lease := range st.Leases {
+		if _, err := net.ParseMAC(lease.MAC); err != nil {
+			return fmt.Errorf("lease %s: %s", lease.IP, err)
+		}
+		if net.ParseIP(lease.IP).To4() == nil {
+			return fmt.Errorf("lease of %s: invalid address %q", lease.MAC, lease.IP)
+		}
+	}
+	for _, node := range st.Nodes {
+		if _, err := net.ParseMAC(node.MAC); err != nil {
+			return fmt.Errorf("node %s: %s", node.IP, err)
+		}
+		if node.Role == "" {
+			return fmt.Errorf("node %s: no role", node.MAC)
+		}
+	}
+	for _, entry := range st.DNS {
+		if entry.Type == "A" && net.ParseIP(entry.Data).To4() == nil {
+			return fmt.Errorf("DNS record %s: invalid address %q", entry.Name, entry.Data)
+		}
+	}
+	return nil
+}
+
+// importState restores the snapshot on top of what the server knows,
+// replacing the leases and nodes with the same MACs. Leases taken by
+// another client or outside the network are skipped.
+func (s *Server) importState(actor string, st State) (StateImport, error) {
+	if err := st.check(); err != nil {
+		return StateImport{}, err
+	}
+
+	var out StateImport
+	if s.ProxyDHCP {
+		log.Warnf("Not importing %d leases in proxyDHCP mode", len(st.Leases))
+	} else {
+		out.Leases = s.importLeases(st.Leases)
+	}
+
+	for _, node := range st.Nodes {
+		s.nodes.put(node)
+		out.Nodes++
+	}
+
+	// Only A records are created by talos-pxe, PTR records follow them.
+	for _, entry := range st.DNS {
+		if entry.Type != "A" {
+			continue
+		}
+		s.DNSRecords.AddV4(entry.Name, net.ParseIP(entry.Data).To4())
+		out.DNS++
+	}
+
+	log.Infof("Imported %d leases, %d nodes and %d DNS records", out.Leases, out.Nodes, out.DNS)
+	s.audit.record(actor, "state.import", "", fmt.Sprintf("%d leases, %d nodes, %d DNS records exported %s",
+		out.Leases, out.Nodes, out.DNS, st.Exported.Format(time.RFC3339)))
+	return out, nil
+}
+
+func (s *Server) importLeases(leases []Lease) int {
+	s.DHCPLock.Lock()
+	defer s.DHCPLock.Unlock()
+
+	taken := make(map[string]string)
+	for mac, record := range s.DHCPRecords {
+		taken[record.IP.String()] = mac
+	}
+
+	imported, pinned := 0, false
+	for _, lease := range leases {
+		mac, _ := net.ParseMAC(lease.MAC)
+		ip := net.ParseIP(lease.IP).To4()
+
+		if !s.Net.Contains(ip) {
+			log.Warnf("Not importing lease of %s for %s outside %s", ip, mac, s.Net)
+			continue
+		}
+		if holder, ok := taken[ip.String()]; ok && holder != mac.String() {
+			log.Warnf("Not importing lease of %s for %s, it's leased to %s", ip, mac, holder)
+			continue
+		}
+
+		if record, ok := s.DHCPRecords[mac.String()]; ok {
+			s.dropLeaseLocked(mac.String(), record)
+			delete(taken, record.IP.String())
+		}
+
+		quarantined := lease.Quarantined && s.quarantine != nil
+		record := &DHCPRecord{
+			IP:          ip,
+			expires:     sinceNow(lease.Expires),
+			granted:     time.Now(),
+			quarantined: quarantined,
+			pinned:      lease.Pinned,
+		}
+		// Addresses outside the provisioning range aren't in the pool.
+		if !reserveAddress(s.allocatorOf(record), ip) && (quarantined || s.inRange(ip)) {
+			log.Warnf("Could not reserve imported address %s of %s, it may be leased out", ip, mac)
+		}
+
+		s.DHCPRecords[mac.String()] = record
+		taken[ip.String()] = mac.String()
+		pinned = pinned || lease.Pinned
+		imported++
+	}
+
+	if pinned {
+		s.savePinsLocked()
+	}
+	s.checkPoolAlert(false)
+	return imported
+}
+
+// importStateFile imports the snapshot in the file, on startup.
+func (s *Server) importStateFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("Invalid snapshot %s: %s", name, err)
+	}
+	if _, err := s.importState("startup", st); err != nil {
+		return fmt.Errorf("Invalid snapshot %s: %s", name, err)
+	}
+	return nil
+}
+
+// stateHandler exports the state on GET and imports a snapshot on PUT.
+func (s *Server) stateHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, s.exportState())
+	case http.MethodPut:
+		if !s.authorize(w, req, roleAdmin) {
+			return
+		}
+		var st State
+		if err := json.NewDecoder(req.Body).Decode(&st); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		imported, err := s.importState(requestActor(req), st)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, imported)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runState exports the state of a running server to a snapshot, or
+// imports one into it.
+func runState(args []string) error {
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	outputFlag := flags.StringP("output", "o", "", "File to write the snapshot to instead of stdout, with export")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s state export|import [flags] [FILE]", os.Args[0])
+	if flags.NArg() < 1 {
+		return usage
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch flags.Arg(0) {
+	case "export":
+		st, err := client.ExportState()
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		if *outputFlag == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return ioutil.WriteFile(*outputFlag, data, 0600)
+	case "import":
+		if flags.NArg() != 2 {
+			return usage
+		}
+		var data []byte
+		if flags.Arg(1) == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(flags.Arg(1))
+		}
+		if err != nil {
+			return err
+		}
+
+		var st State
+		if err := json.Unmarshal(data, &st); err != nil {
+			return fmt.Errorf("Invalid snapshot %s: %s", flags.Arg(1), err)
+		}
+		imported, err := client.ImportState(st)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d leases, %d nodes and %d DNS records\n", imported.Leases, imported.Nodes, imported.DNS)
+		return nil
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = time.Minute
+	// A sub-server which ran for this long before failing is considered
+	// healthy again, resetting its backoff.
+	restartBackoffReset = time.Minute
+)
+
+// A subServer is one of the protocol servers run by Serve. open binds its
+// sockets, returning what has to be closed to stop it and the function
+// serving on them until they are closed.
+type subServer struct {
+	name string
+	open func() (io.Closer, func() error, error)
+
+	// Where the server listens and how to run without it, used to
+	// explain bind failures.
+	proto string
+	port  int
+	hint  string
+}
+
+func (srv subServer) withHint(hint string) subServer {
+	srv.hint = hint
+	return srv
+}
+
+func addrPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+func packetServer(name, network, addr string, serve func(net.PacketConn) error) subServer {
+	return subServer{
+		name:  name,
+		proto: "udp",
+		port:  addrPort(addr),
+		open: func() (io.Closer, func() error, error) {
+			conn, err := net.ListenPacket(network, addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, func() error { return serve(conn) }, nil
+		},
+	}
+}
+
+func streamServer(name, network, addr string, serve func(net.Listener) error) subServer {
+	return subServer{
+		name:  name,
+		proto: "tcp",
+		port:  addrPort(addr),
+		open: func() (io.Closer, func() error, error) {
+			l, err := net.Listen(network, addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return l, func() error { return serve(l) }, nil
+		},
+	}
+}
+
+// supervisor keeps the sub-servers running, restarting the ones which
+// fail or panic with exponential backoff, until it is stopped.
+type supervisor struct {
+	lock     sync.Mutex
+	stopping bool
+	closers  map[string]io.Closer
+	restarts map[string]int
+	wg       sync.WaitGroup
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		closers:  make(map[string]io.Closer),
+		restarts: make(map[string]int),
+	}
+}
+
+// start opens all the sub-servers and starts serving them. If any of
+// them can't be opened, the already opened ones are closed again.
+func (sv *supervisor) start(servers []subServer) error {
+	serves := make([]func() error, len(servers))
+	for i, srv := range servers {
+		closer, serve, err := srv.open()
+		if err != nil {
+			sv.stop()
+			return bindError(srv, err)
+		}
+
+		sv.lock.Lock()
+		sv.closers[srv.name] = closer
+		sv.lock.Unlock()
+
+		serves[i] = serve
+	}
+
+	for i, srv := range servers {
+		sv.wg.Add(1)
+		go sv.supervise(srv, serves[i])
+	}
+
+	return nil
+}
+
+// stop closes all the sub-servers and waits for them to exit.
+func (sv *supervisor) stop() {
+	sv.lock.Lock()
+	sv.stopping = true
+	for name, closer := range sv.closers {
+		closer.Close()
+		delete(sv.closers, name)
+	}
+	sv.lock.Unlock()
+
+	sv.wg.Wait()
+}
+
+func (sv *supervisor) isStopping() bool {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	return sv.stopping
+}
+
+// Restarts returns how many times each sub-server has been restarted.
+func (sv *supervisor) Restarts() map[string]int {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+
+	restarts := make(map[string]int, len(sv.restarts))
+	for name, n := range sv.restarts {
+		restarts[name] = n
+	}
+	return restarts
+}
+
+// runRecovered turns a panic of the serve loop into an error, restarting
+// the sub-server. The handlers the protocol libraries run in goroutines
+// of their own recover with recoverHandler instead.
+func runRecovered(serve func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debugf("%s", debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return serve()
+}
+
+// recoverHandler recovers a panic of the handler it's deferred in, so
+// that one packet can't take the process down.
+func recoverHandler(name string) {
+	if r := recover(); r != nil {
+		log.Errorf("%s handler panicked: %v", name, r)
+		log.Debugf("%s", debug.Stack())
+	}
+}
+
+func (sv *supervisor) supervise(srv subServer, serve func() error) {
+	defer sv.wg.Done()
+
+	backoff := restartBackoffMin
+	for {
+		started := time.Now()
+		err := runRecovered(serve)
+		if sv.isStopping() {
+			return
+		}
+
+		sv.lock.Lock()
+		if closer, ok := sv.closers[srv.name]; ok {
+			closer.Close()
+			delete(sv.closers, srv.name)
+		}
+		sv.lock.Unlock()
+
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+
+		if time.Since(started) > restartBackoffReset {
+			backoff = restartBackoffMin
+		}
+
+		for {
+			log.Errorf("%s server failed: %s, restarting in %s", srv.name, err, backoff)
+			time.Sleep(backoff)
+
+			if backoff *= 2; backoff > restartBackoffMax {
+				backoff = restartBackoffMax
+			}
+
+			var closer io.Closer
+			closer, serve, err = srv.open()
+			if err != nil {
+				err = bindError(srv, err)
+				if sv.isStopping() {
+					return
+				}
+				continue
+			}
+
+			sv.lock.Lock()
+			if sv.stopping {
+				sv.lock.Unlock()
+				closer.Close()
+				return
+			}
+			sv.closers[srv.name] = closer
+			sv.restarts[srv.name]++
+			sv.lock.Unlock()
+
+			break
+		}
+
+		log.Infof("Restarted %s server", srv.name)
+	}
+}
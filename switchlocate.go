@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When a client starts booting, the switches of the config are asked over
+// SNMP which of their ports its MAC is on: its bridge port from the
+// forwarding table, then the interface of that. The port of a node shows
+// up with it, its boot session and as an audit event, turning "a node is
+// misbehaving" into "port 14 on rack-3-tor". For switches only speaking
+// gNMI or anything else, --locate-command is run instead, e.g. wrapping
+// gnmic, printing the switch and the port of the MAC in $NODE_MAC.
+
+const (
+	// How long a MAC isn't looked up again.
+	switchLocateInterval = 10 * time.Minute
+	locateCommandTimeout = 30 * time.Second
+
+	oidDot1dTpFdbPort       = "1.3.6.1.2.1.17.4.3.1.2"
+	oidDot1qTpFdbPort       = "1.3.6.1.2.1.17.7.1.2.2.1.2"
+	oidDot1dBasePortIfIndex = "1.3.6.1.2.1.17.1.4.1.2"
+	oidIfName               = "1.3.6.1.2.1.31.1.1.1.1"
+	oidIfAlias              = "1.3.6.1.2.1.31.1.1.1.18"
+)
+
+// SwitchConfig is a switch asked over SNMPv2c for the ports of the nodes.
+// With a VLAN, MACs are looked up in its forwarding table instead of the
+// default one. Uplinks are the ports to other switches, where the MACs of
+// the nodes on them are learned too.
+type SwitchConfig struct {
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	Community string   `json:"community,omitempty"`
+	VLAN      int      `json:"vlan,omitempty"`
+	Uplinks   []string `json:"uplinks,omitempty"`
+}
+
+func (c *SwitchConfig) check() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if c.Address == "" {
+		return fmt.Errorf("missing address")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(c.Address, "161")
+	}
+	if c.Community == "" {
+		c.Community = "public"
+	}
+	if c.VLAN < 0 || c.VLAN > 4094 {
+		return fmt.Errorf("invalid VLAN %d", c.VLAN)
+	}
+	return nil
+}
+
+func macOID(prefix string, mac net.HardwareAddr) string {
+	oid := prefix
+	for _, b := range mac {
+		oid += "." + strconv.Itoa(int(b))
+	}
+	return oid
+}
+
+// locate returns the port of the switch the MAC is on, nil if it's not on
+// the switch or behind an uplink.
+func (c *SwitchConfig) locate(mac net.HardwareAddr) (*SwitchPort, error) {
+	oid := macOID(oidDot1dTpFdbPort, mac)
+	if c.VLAN > 0 {
+		oid = macOID(oidDot1qTpFdbPort+"."+strconv.Itoa(c.VLAN), mac)
+	}
+	tag, value, err := snmpGet(c.Address, c.Community, oid)
+	if err == errSNMPNoSuchName {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if tag != berInteger {
+		return nil, fmt.Errorf("Unexpected bridge port of %s", mac)
+	}
+
+	bridgePort := berIntValue(value)
+	tag, value, err = snmpGet(c.Address, c.Community, oidDot1dBasePortIfIndex+"."+strconv.Itoa(bridgePort))
+	if err != nil {
+		return nil, fmt.Errorf("Interface of bridge port %d: %s", bridgePort, err)
+	} else if tag != berInteger {
+		return nil, fmt.Errorf("Unexpected interface of bridge port %d", bridgePort)
+	}
+	ifIndex := strconv.Itoa(berIntValue(value))
+
+	host, _, _ := net.SplitHostPort(c.Address)
+	port := &SwitchPort{ChassisID: host, PortID: ifIndex, SystemName: c.Name, Seen: time.Now()}
+	if tag, value, err := snmpGet(c.Address, c.Community, oidIfName+"."+ifIndex); err == nil && tag == berOctetString && len(value) > 0 {
+		port.PortID = string(value)
+	}
+	if tag, value, err := snmpGet(c.Address, c.Community, oidIfAlias+"."+ifIndex); err == nil && tag == berOctetString {
+		port.PortDescription = string(value)
+	}
+
+	for _, uplink := range c.Uplinks {
+		if uplink == port.PortID {
+			return nil, nil
+		}
+	}
+	return port, nil
+}
+
+// locating tells whether the MAC is to be looked up, as it wasn't for
+// switchLocateInterval.
+func (sp *switchPorts) locating(mac string) bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.located == nil {
+		sp.located = make(map[string]time.Time)
+	}
+	if time.Since(sp.located[mac]) < switchLocateInterval {
+		return false
+	}
+	sp.located[mac] = time.Now()
+	return true
+}
+
+// locateSwitchPort looks up the port of the client in the background, if
+// there are switches to ask.
+func (s *Server) locateSwitchPort(mac net.HardwareAddr) {
+	if mac == nil || (s.LocateCommand == "" && (s.Config == nil || len(s.Config.Switches) == 0)) {
+		return
+	}
+	if !s.ports.locating(mac.String()) {
+		return
+	}
+
+	go func() {
+		port, err := s.lookupSwitchPort(mac)
+		if err != nil {
+			log.Warnf("Could not locate %s on the switches: %s", mac, err)
+			return
+		}
+		if port == nil {
+			log.Debugf("%s isn't on any of the switches", mac)
+			return
+		}
+		s.switchPortSeen("switches", mac, *port)
+	}()
+}
+
+// lookupSwitchPort asks the switches for the port of the MAC, returning
+// the first found.
+func (s *Server) lookupSwitchPort(mac net.HardwareAddr) (*SwitchPort, error) {
+	if s.LocateCommand != "" {
+		return s.runLocateCommand(mac)
+	}
+
+	var errs []string
+	for _, sw := range s.Config.Switches {
+		port, err := sw.locate(mac)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", sw.Name, err))
+			continue
+		}
+		if port != nil {
+			return port, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil, nil
+}
+
+// runLocateCommand runs the locate command for the MAC, which prints the
+// switch and the port, and optionally a description of the port, or
+// nothing if it doesn't know.
+func (s *Server) runLocateCommand(mac net.HardwareAddr) (*SwitchPort, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), locateCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.LocateCommand)
+	cmd.Env = append(os.Environ(), "NODE_MAC="+mac.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, nil
+	} else if len(fields) == 1 {
+		return nil, fmt.Errorf("Locate command printed %q, expected the switch and the port", strings.TrimSpace(string(out)))
+	}
+	return &SwitchPort{
+		ChassisID:       fields[0],
+		PortID:          fields[1],
+		PortDescription: strings.Join(fields[2:], " "),
+		SystemName:      fields[0],
+		Seen:            time.Now(),
+	}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The switch ports of the nodes are learned from LLDP, see lldp.go, and
+// looked up on the switches, see switchlocate.go. They're recorded with
+// the nodes, shown with the boot sessions, and the boots of the nodes get
+// switch and switch_port selectors, so groups and templates can name them
+// by rack and port.
+
+const (
+	switchLabel     = "switch"
+	switchPortLabel = "switch_port"
+)
+
+// SwitchPort is the switch port a MAC is on.
+type SwitchPort struct {
+	ChassisID       string    `json:"chassis_id"`
+	PortID          string    `json:"port_id"`
+	PortDescription string    `json:"port_description,omitempty"`
+	SystemName      string    `json:"system_name,omitempty"`
+	Seen            time.Time `json:"seen"`
+}
+
+// switchName is how the switch is named in the labels, its system name
+// if it has one.
+func (p *SwitchPort) switchName() string {
+	if p.SystemName != "" {
+		return p.SystemName
+	}
+	return p.ChassisID
+}
+
+func (p *SwitchPort) String() string {
+	return p.switchName() + " port " + p.PortID
+}
+
+type switchPorts struct {
+	lock  sync.Mutex
+	ports map[string]SwitchPort
+	// When the switches were last asked for the port of each MAC.
+	located map[string]time.Time
+}
+
+func (sp *switchPorts) get(mac string) (SwitchPort, bool) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	port, ok := sp.ports[mac]
+	return port, ok
+}
+
+// set records the port of the MAC, telling whether it moved.
+func (sp *switchPorts) set(mac string, port SwitchPort) bool {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.ports == nil {
+		sp.ports = make(map[string]SwitchPort)
+	}
+	old, ok := sp.ports[mac]
+	sp.ports[mac] = port
+	return !ok || old.ChassisID != port.ChassisID || old.PortID != port.PortID
+}
+
+// switchPortSeen records the port of the MAC with its node, recording an
+// audit event when it moved.
+func (s *Server) switchPortSeen(source string, mac net.HardwareAddr, port SwitchPort) {
+	if s.ports.set(mac.String(), port) {
+		log.Infof("%s is on %s, from %s", mac, port.String(), source)
+		s.audit.record(source, "node.switch-port", mac.String(), port.String())
+	}
+	s.nodes.update(mac.String(), func(node *Node) {
+		node.Switch = &port
+	})
+}
+
+// switchPortAttach records the port of the MAC, if known, with the node
+// booting from it.
+func (s *Server) switchPortAttach(mac net.HardwareAddr) {
+	if port, ok := s.ports.get(mac.String()); ok {
+		s.nodes.update(mac.String(), func(node *Node) {
+			node.Switch = &port
+		})
+	}
+}
+
+// withSwitchPorts adds the ports of the clients to the sessions.
+func (s *Server) withSwitchPorts(sessions []BootSession) []BootSession {
+	for i := range sessions {
+		if port, ok := s.ports.get(sessions[i].MAC); ok {
+			sessions[i].SwitchPort = port.String()
+		}
+	}
+	return sessions
+}
+
+// switchPortRequest adds the switch and the port of the node to the
+// selectors of the request, unless the request sets them itself.
+func (s *Server) switchPortRequest(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	mac, err := net.ParseMAC(query.Get("mac"))
+	if err != nil {
+		return req
+	}
+	port, ok := s.ports.get(mac.String())
+	if !ok {
+		return req
+	}
+	if _, ok := query[switchLabel]; ok {
+		return req
+	}
+
+	query.Set(switchLabel, port.switchName())
+	query.Set(switchPortLabel, port.PortID)
+
+	out := req.Clone(req.Context())
+	out.URL.RawQuery = query.Encode()
+	out.Form = nil
+	return out
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ajeddeloh/yaml"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Upgrades, health checks, etcd cleanups and applied configs go through the Talos API of
+// the nodes, authenticated with the client certificate of a talosconfig.
+// Only the few calls needed are implemented, with the messages encoded by
+// hand.
+
+const (
+	talosAPIPort = 50000
+
+	talosMachineService = "machine.MachineService"
+)
+
+type talosconfig struct {
+	Context  string `yaml:"context"`
+	Contexts map[string]struct {
+		CA  string `yaml:"ca"`
+		Crt string `yaml:"crt"`
+		Key string `yaml:"key"`
+	} `yaml:"contexts"`
+}
+
+// loadTalosTLS returns the TLS config to talk to the nodes from the
+// current context of the talosconfig.
+func loadTalosTLS(path string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTalosTLS(data, path)
+}
+
+// parseTalosTLS is loadTalosTLS for a talosconfig read from path.
+func parseTalosTLS(data []byte, path string) (*tls.Config, error) {
+	var cfg talosconfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Invalid talosconfig %s: %s", path, err)
+	}
+
+	ctx, ok := cfg.Contexts[cfg.Context]
+	if !ok {
+		return nil, fmt.Errorf("Talosconfig %s has no context %s", path, cfg.Context)
+	}
+
+	decode := func(name, v string) ([]byte, error) {
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("Talosconfig %s has no valid %s in context %s", path, name, cfg.Context)
+		}
+		return b, nil
+	}
+
+	ca, err := decode("ca", ctx.CA)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := decode("crt", ctx.Crt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decode("key", ctx.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid client certificate in talosconfig %s: %s", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Invalid CA in talosconfig %s", path)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+type talosClient struct {
+	conn *grpc.ClientConn
+}
+
+func dialTalos(ctx context.Context, tlsConfig *tls.Config, ip string) (*talosClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(ip, strconv.Itoa(talosAPIPort)),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &talosClient{conn: conn}, nil
+}
+
+func (c *talosClient) Close() error {
+	return c.conn.Close()
+}
+
+// Upgrade has the node install the image and reboot into it.
+func (c *talosClient) Upgrade(ctx context.Context, image string) error {
+	return c.conn.Invoke(ctx, "/"+talosMachineService+"/Upgrade", &talosUpgradeRequest{Image: image, Preserve: true}, &wireEmpty{})
+}
+
+// Version returns the Talos version the node runs.
+func (c *talosClient) Version(ctx context.Context) (string, error) {
+	resp := &talosVersionResponse{}
+	if err := c.conn.Invoke(ctx, "/"+talosMachineService+"/Version", &wireEmpty{}, resp); err != nil {
+		return "", err
+	}
+	return resp.Tag, nil
+}
+
+// EtcdRemoveMember removes the member with the hostname from etcd, asking
+// another controlplane node.
+func (c *talosClient) EtcdRemoveMember(ctx context.Context, member string) error {
+	return c.conn.Invoke(ctx, "/"+talosMachineService+"/EtcdRemoveMember", &talosEtcdRemoveMemberRequest{Member: member}, &wireEmpty{})
+}
+
+// ApplyConfiguration applies the machine config to the node in the mode,
+// returning what the node did with it and the warnings.
+func (c *talosClient) ApplyConfiguration(ctx context.Context, data []byte, mode uint64) (string, []string, error) {
+	resp := &talosApplyConfigurationResponse{}
+	if err := c.conn.Invoke(ctx, "/"+talosMachineService+"/ApplyConfiguration", &talosApplyConfigurationRequest{Data: data, Mode: mode}, resp); err != nil {
+		return "", nil, err
+	}
+	return resp.ModeDetails, resp.Warnings, nil
+}
+
+type talosUpgradeRequest struct {
+	Image    string
+	Preserve bool
+}
+
+func (m *talosUpgradeRequest) MarshalWire() []byte {
+	b := wireAppendString(nil, 1, m.Image)
+	if m.Preserve {
+		b = wireAppendVarint(b, 2, protowire.EncodeBool(true))
+	}
+	return b
+}
+
+func (m *talosUpgradeRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.Image = string(v)
+		case 2:
+			m.Preserve = protowire.DecodeBool(n)
+		}
+		return nil
+	})
+}
+
+type talosEtcdRemoveMemberRequest struct {
+	Member string
+}
+
+func (m *talosEtcdRemoveMemberRequest) MarshalWire() []byte {
+	return wireAppendString(nil, 1, m.Member)
+}
+
+func (m *talosEtcdRemoveMemberRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			m.Member = string(v)
+		}
+		return nil
+	})
+}
+
+type talosApplyConfigurationRequest struct {
+	Data []byte
+	Mode uint64
+}
+
+func (m *talosApplyConfigurationRequest) MarshalWire() []byte {
+	b := wireAppendBytes(nil, 1, m.Data)
+	if m.Mode != 0 {
+		b = wireAppendVarint(b, 4, m.Mode)
+	}
+	return b
+}
+
+func (m *talosApplyConfigurationRequest) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			m.Data = append([]byte(nil), v...)
+		case 4:
+			m.Mode = n
+		}
+		return nil
+	})
+}
+
+// talosApplyConfigurationResponse only keeps the first message, the node
+// we're talking to.
+type talosApplyConfigurationResponse struct {
+	Warnings    []string
+	ModeDetails string
+}
+
+func (m *talosApplyConfigurationResponse) MarshalWire() []byte {
+	var apply []byte
+	for _, warning := range m.Warnings {
+		apply = wireAppendString(apply, 2, warning)
+	}
+	apply = wireAppendNonEmpty(apply, 4, m.ModeDetails)
+	return wireAppendBytes(nil, 1, apply)
+}
+
+func (m *talosApplyConfigurationResponse) UnmarshalWire(b []byte) error {
+	first := true
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 || !first {
+			return nil
+		}
+		first = false
+		return wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			switch num {
+			case 2:
+				m.Warnings = append(m.Warnings, string(v))
+			case 4:
+				m.ModeDetails = string(v)
+			}
+			return nil
+		})
+	})
+}
+
+// talosVersionResponse only keeps the tag of the first message, the node
+// we're talking to.
+type talosVersionResponse struct {
+	Tag string
+}
+
+func (m *talosVersionResponse) MarshalWire() []byte {
+	info := wireAppendString(nil, 1, m.Tag)
+	version := wireAppendBytes(nil, 2, info)
+	return wireAppendBytes(nil, 1, version)
+}
+
+func (m *talosVersionResponse) UnmarshalWire(b []byte) error {
+	return wireFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 || m.Tag != "" {
+			return nil
+		}
+		// Version, then VersionInfo.
+		return wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			if num != 2 {
+				return nil
+			}
+			return wireFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num == 1 {
+					m.Tag = string(v)
+				}
+				return nil
+			})
+		})
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poseidon/matchbox/matchbox/storage"
+	"github.com/poseidon/matchbox/matchbox/storage/storagepb"
+)
+
+// Template variables are values looked up when rendering instead of being
+// baked into profiles, e.g. the current corporate proxy or a license key:
+// from the environment of the server, a file, or a field of the JSON
+// served at a URL. Matchbox templates get them as {{ .vars.name }} through
+// the metadata of every group, menus as {{ .Vars.name }}. They're kept out
+// of the group metadata matchbox serves as is on /metadata. Files and URLs
+// are read again once their TTL expired, and if that fails the last value
+// is kept.
+
+const (
+	templateVarTTL     = time.Minute
+	templateVarTimeout = 5 * time.Second
+)
+
+// A TemplateVar is read from one of Env, File or URL.
+type TemplateVar struct {
+	Env  string `json:"env,omitempty"`
+	File string `json:"file,omitempty"`
+	URL  string `json:"url,omitempty"`
+	// Field picks the value out of the JSON object served at URL, e.g.
+	// proxy.http. The whole document if empty.
+	Field string `json:"field,omitempty"`
+	// TTL of the value of File or URL, 1m if empty.
+	TTL string `json:"ttl,omitempty"`
+
+	ttl time.Duration
+}
+
+func (v *TemplateVar) check() error {
+	sources := 0
+	for _, source := range []string{v.Env, v.File, v.URL} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("needs exactly one of env, file or url")
+	}
+	if v.Field != "" && v.URL == "" {
+		return fmt.Errorf("field only applies to url")
+	}
+
+	v.ttl = templateVarTTL
+	if v.TTL != "" {
+		ttl, err := time.ParseDuration(v.TTL)
+		if err != nil {
+			return fmt.Errorf("invalid ttl %q: %s", v.TTL, err)
+		}
+		v.ttl = ttl
+	}
+	return nil
+}
+
+type cachedVar struct {
+	value   interface{}
+	ok      bool
+	fetched time.Time
+}
+
+type templateVars struct {
+	vars   map[string]*TemplateVar
+	client *http.Client
+
+	lock   sync.Mutex
+	values map[string]cachedVar
+}
+
+func newTemplateVars(vars map[string]*TemplateVar) *templateVars {
+	return &templateVars{
+		vars:   vars,
+		client: &http.Client{Timeout: templateVarTimeout},
+		values: make(map[string]cachedVar),
+	}
+}
+
+// get returns the current values of the variables, leaving out those
+// which couldn't be read yet, and a fingerprint of them.
+func (tv *templateVars) get() (map[string]interface{}, uint64) {
+	tv.lock.Lock()
+	defer tv.lock.Unlock()
+
+	out := make(map[string]interface{})
+	now := time.Now()
+	for name, v := range tv.vars {
+		if v.Env != "" {
+			if value, ok := os.LookupEnv(v.Env); ok {
+				out[name] = value
+			}
+			continue
+		}
+
+		cached, ok := tv.values[name]
+		if !ok || now.Sub(cached.fetched) >= v.ttl {
+			// Failures are retried after the TTL too, instead of on
+			// every render.
+			cached.fetched = now
+			if value, err := tv.fetch(v); err != nil {
+				log.Warnf("Could not read template variable %s: %s", name, err)
+			} else {
+				cached.value, cached.ok = value, true
+			}
+			tv.values[name] = cached
+		}
+		if cached.ok {
+			out[name] = cached.value
+		}
+	}
+
+	h := fnv.New64a()
+	data, _ := json.Marshal(out)
+	h.Write(data)
+	return out, h.Sum64()
+}
+
+func (tv *templateVars) fetch(v *TemplateVar) (interface{}, error) {
+	if v.File != "" {
+		data, err := ioutil.ReadFile(v.File)
+		if err != nil {
+			return nil, err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	resp, err := tv.client.Get(v.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", v.URL, resp.Status)
+	}
+
+	var value interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return nil, fmt.Errorf("%s didn't return JSON: %s", v.URL, err)
+	}
+	if v.Field == "" {
+		return value, nil
+	}
+	for _, key := range strings.Split(v.Field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s has no field %s", v.URL, v.Field)
+		}
+		if value, ok = object[key]; !ok {
+			return nil, fmt.Errorf("%s has no field %s", v.URL, v.Field)
+		}
+	}
+	return value, nil
+}
+
+// Vars returns the template variables, for menu templates.
+func (s *Server) Vars() map[string]interface{} {
+	if s.templateVars == nil {
+		return nil
+	}
+	vars, _ := s.templateVars.get()
+	return vars
+}
+
+// templateVarsVersion changes whenever a variable does, so that renders
+// with the old values aren't served from the cache.
+func (s *Server) templateVarsVersion() uint64 {
+	if s.templateVars == nil {
+		return 0
+	}
+	_, version := s.templateVars.get()
+	return version
+}
+
+// metadataWithoutVars serves /metadata, which dumps the metadata of the
+// group to anyone asking, from the matchbox handler rendering without
+// the template variables, and everything else from next.
+func metadataWithoutVars(next, metadata http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		if path.Clean(req.URL.Path) == "/metadata" {
+			metadata.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// varsStore adds the template variables to the metadata of the groups
+// matchbox renders with.
+type varsStore struct {
+	storage.Store
+	vars *templateVars
+}
+
+func (s *Server) withTemplateVars(store storage.Store) storage.Store {
+	if s.templateVars == nil {
+		return store
+	}
+	return &varsStore{Store: store, vars: s.templateVars}
+}
+
+func (st *varsStore) GroupGet(id string) (*storagepb.Group, error) {
+	group, err := st.Store.GroupGet(id)
+	if err != nil {
+		return nil, err
+	}
+	return group, st.addVars(group)
+}
+
+func (st *varsStore) GroupList() ([]*storagepb.Group, error) {
+	groups, err := st.Store.GroupList()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if err := st.addVars(group); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (st *varsStore) addVars(group *storagepb.Group) error {
+	metadata := make(map[string]interface{})
+	if len(group.Metadata) > 0 {
+		if err := json.Unmarshal(group.Metadata, &metadata); err != nil {
+			return fmt.Errorf("Invalid metadata of group %s: %s", group.Id, err)
+		}
+	}
+	metadata["vars"], _ = st.vars.get()
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	group.Metadata = data
+	return nil
+}
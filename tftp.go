@@ -19,12 +19,62 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	tftp "github.com/pin/tftp"
 )
 
+const (
+	tftpMaxTransfers = 64
+	tftpTimeout      = 5 * time.Second
+)
+
+// bootFileCache keeps the files sent over TFTP in memory, so that a
+// whole rack fetching ipxe.efi at once doesn't read it from the USB
+// stick for every client. Files are reloaded when they change.
+type bootFileCache struct {
+	lock  sync.Mutex
+	files map[string]*cachedBootFile
+}
+
+type cachedBootFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func (c *bootFileCache) read(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if f, ok := c.files[path]; ok && f.modTime.Equal(fi.ModTime()) && f.size == fi.Size() {
+		return f.data, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.files == nil {
+		c.files = make(map[string]*cachedBootFile)
+	}
+	c.files[path] = &cachedBootFile{modTime: fi.ModTime(), size: fi.Size(), data: data}
+
+	return data, nil
+}
+
 type TFTPHook struct {
 }
 
@@ -37,19 +87,48 @@ func (h *TFTPHook) OnFailure(stats tftp.TransferStats, err error) {
 }
 
 // readHandler is called when client starts file download from server
-func (s *Server) readHandler(path string, rf io.ReaderFrom) error {
-	_, classId, classInfo, err := extractInfo(path)
+func (s *Server) readHandler(path string, rf io.ReaderFrom) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("TFTP handler panicked on %s: %v", path, r)
+			log.Debugf("%s", debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	mac, classId, classInfo, err := extractInfo(path)
 	if err != nil {
 		return fmt.Errorf("unknown path %q", path)
 	}
 
-	bs, err := s.Ipxe(classId, classInfo)
+	// Every transfer holds a socket until it's done, so bound them to
+	// not run out of file descriptors. Clients beyond the limit wait for
+	// a slot for as long as they'd wait for a lost packet.
+	select {
+	case s.tftpSlots <- struct{}{}:
+		defer func() { <-s.tftpSlots }()
+	case <-time.After(s.TFTPTimeout):
+		tftpRejected.Inc()
+		return fmt.Errorf("too many concurrent transfers")
+	}
+	tftpTransfers.Inc()
+	defer tftpTransfers.Dec()
+
+	sp := s.tracer.start(mac, "tftp")
+	sp.SetAttr("tftp.filename", path)
+	s.sessions.seen(mac, "tftp")
+
+	bs, err := s.Ipxe(mac, classId, classInfo)
 	if err != nil {
+		sp.End(err)
+		s.sessions.failed(mac, err)
 		return err
 	}
 
 	rf.(tftp.OutgoingTransfer).SetSize(int64(len(bs)))
-	rf.ReadFrom(bytes.NewBuffer(bs))
+	_, err = rf.ReadFrom(s.chaosTFTPReader(mac, bytes.NewBuffer(bs)))
+	sp.SetAttr("tftp.size", fmt.Sprintf("%d", len(bs)))
+	sp.End(err)
 
 	return nil
 }
@@ -57,6 +136,7 @@ func (s *Server) readHandler(path string, rf io.ReaderFrom) error {
 func (s *Server) serveTFTP(l net.PacketConn) error {
 	ts := tftp.NewServer(s.readHandler, nil)
 	ts.SetHook(&TFTPHook{})
+	ts.SetTimeout(s.TFTPTimeout)
 	err := ts.Serve(l)
 	if err != nil {
 		return fmt.Errorf("TFTP server shut down: %s", err)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tftp "github.com/pin/tftp"
+)
+
+const (
+	// How many clients fetch ipxe.efi at once, like a rack booting.
+	benchTFTPClients = 100
+	benchTFTPSize    = 1 << 20
+)
+
+// BenchmarkTFTPConcurrentTransfers has a rack of clients fetch ipxe.efi
+// at once, through the transfer slots and the boot file cache, with
+// slot limits below and above the number of clients. Clients waiting
+// for a slot longer than the timeout are refused, counted as failed/op.
+func BenchmarkTFTPConcurrentTransfers(b *testing.B) {
+	level := log.Level
+	log.SetLevel(logrus.ErrorLevel)
+	defer log.SetLevel(level)
+
+	root, err := ioutil.TempDir("", "tftp-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, benchTFTPSize)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "ipxe.efi"), data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, slots := range []int{16, tftpMaxTransfers, 2 * benchTFTPClients} {
+		b.Run(fmt.Sprintf("slots=%d", slots), func(b *testing.B) {
+			benchmarkTFTPTransfers(b, root, slots)
+		})
+	}
+}
+
+func benchmarkTFTPTransfers(b *testing.B, root string, slots int) {
+	s := &Server{
+		ServerRoot:       root,
+		TFTPMaxTransfers: slots,
+		TFTPTimeout:      tftpTimeout,
+		sessions:         newBootSessions(),
+		tftpSlots:        make(chan struct{}, slots),
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ts := tftp.NewServer(s.readHandler, nil)
+	ts.SetTimeout(s.TFTPTimeout)
+	go ts.Serve(conn)
+	defer ts.Shutdown()
+	addr := conn.LocalAddr().String()
+
+	var failed int64
+	b.SetBytes(benchTFTPSize * benchTFTPClients)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for c := 0; c < benchTFTPClients; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x00, byte(c >> 8), byte(c)}
+				if err := benchTFTPFetch(addr, mac.String()+"/PXEClient:Arch:00007:UNDI:003001/"); err != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+	if len(s.bootFiles.files) != 1 {
+		b.Errorf("Boot file cache holds %d files, not 1", len(s.bootFiles.files))
+	}
+}
+
+func benchTFTPFetch(addr, path string) error {
+	client, err := tftp.NewClient(addr)
+	if err != nil {
+		return err
+	}
+	client.SetTimeout(time.Second)
+	client.SetRetries(5)
+	wt, err := client.Receive(path, "octet")
+	if err != nil {
+		return err
+	}
+	n, err := wt.WriteTo(ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	if n != benchTFTPSize {
+		return fmt.Errorf("Received %d bytes", n)
+	}
+	return nil
+}
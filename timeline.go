@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Besides the current stage, the boot sessions keep a timeline of the
+// last boot attempts of every client: the steps it went through, from
+// DHCP to the config fetch, and how long each took. A firmware stuck
+// retrying shows up as one attempt after the other never getting past
+// TFTP, a slow link as long kernel downloads.
+
+const (
+	maxBootAttempts   = 10
+	timelineRetention = 24 * time.Hour
+)
+
+type TimelineStep struct {
+	Stage    string    `json:"stage"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	Requests int       `json:"requests"`
+	Error    string    `json:"error,omitempty"`
+
+	lastSeen time.Time
+}
+
+type BootAttempt struct {
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration_seconds"`
+	Steps    []TimelineStep `json:"steps"`
+
+	reached    int
+	lastSeen   time.Time
+	milestones map[string]bool
+}
+
+type NodeTimeline struct {
+	MAC      string        `json:"mac"`
+	IP       string        `json:"ip,omitempty"`
+	Attempts []BootAttempt `json:"attempts"`
+}
+
+// Rank of the timeline stages in the order a boot goes through them.
+const (
+	rankFirmware = iota
+	rankTFTP
+	rankMenu
+	rankKernel
+	rankConfig
+	rankInstall
+)
+
+// timelineStage maps the stage of a session to the step of the timeline
+// and its rank.
+func timelineStage(stage string) (string, int) {
+	switch {
+	case stage == "dhcp":
+		return "dhcp", rankFirmware
+	case stage == "pxe":
+		return "proxydhcp", rankFirmware
+	case stage == "tftp":
+		return "tftp", rankTFTP
+	case strings.HasPrefix(stage, "install "):
+		return stage, rankInstall
+	case !strings.HasPrefix(stage, "http "):
+		return stage, rankMenu
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(stage, "http "))
+	switch {
+	case name == "/ipxe":
+		return "menu", rankMenu
+	case isMachineConfigPath(name):
+		return "config", rankConfig
+	case strings.HasPrefix(name, "/assets/vmlinuz"):
+		return "kernel", rankKernel
+	case strings.HasPrefix(name, "/assets/initramfs"):
+		return "initramfs", rankKernel
+	}
+	return "http", rankMenu
+}
+
+// stepLocked records the stage in the client's timeline, starting a new attempt
+// when the client went back to the firmware stages after reaching the
+// menu. The DHCP of the booted kernel is part of the attempt. Returns the
+// step if it's a new one. Must be called with the lock held.
+func (bs *bootSessions) stepLocked(mac string, stage string, now time.Time) string {
+	name, rank := timelineStage(stage)
+
+	tl, ok := bs.history[mac]
+	if !ok {
+		tl = &NodeTimeline{MAC: mac}
+		bs.history[mac] = tl
+	}
+
+	var attempt *BootAttempt
+	if n := len(tl.Attempts); n > 0 {
+		attempt = &tl.Attempts[n-1]
+	}
+
+	restarted := attempt != nil && rank <= rankTFTP && attempt.reached >= rankMenu &&
+		!(name == "dhcp" && attempt.reached >= rankKernel)
+	if attempt == nil || now.Sub(attempt.lastSeen) > bootSessionIdle || restarted {
+		next := BootAttempt{Started: now}
+
+		// The DHCP leading to the firmware stage is part of the new
+		// attempt already.
+		if restarted && name != "dhcp" {
+			if last := &attempt.Steps[len(attempt.Steps)-1]; last.Stage == "dhcp" && len(attempt.Steps) > 1 {
+				next.Started = last.Started
+				next.Steps = append(next.Steps, *last)
+				attempt.Steps = attempt.Steps[:len(attempt.Steps)-1]
+				attempt.lastSeen = attempt.Steps[len(attempt.Steps)-1].lastSeen
+			}
+		}
+
+		if len(tl.Attempts) == maxBootAttempts {
+			tl.Attempts = append(tl.Attempts[:0], tl.Attempts[1:]...)
+		}
+		tl.Attempts = append(tl.Attempts, next)
+		attempt = &tl.Attempts[len(tl.Attempts)-1]
+	}
+
+	if rank > attempt.reached {
+		attempt.reached = rank
+	}
+	attempt.lastSeen = now
+
+	if n := len(attempt.Steps); n > 0 && attempt.Steps[n-1].Stage == name {
+		attempt.Steps[n-1].Requests++
+		attempt.Steps[n-1].lastSeen = now
+		return ""
+	}
+	attempt.Steps = append(attempt.Steps, TimelineStep{Stage: name, Started: now, Requests: 1, lastSeen: now})
+	return name
+}
+
+// stepFailedLocked records the error in the current step of the client.
+func (bs *bootSessions) stepFailedLocked(mac string, err error) {
+	tl, ok := bs.history[mac]
+	if !ok || len(tl.Attempts) == 0 {
+		return
+	}
+	attempt := &tl.Attempts[len(tl.Attempts)-1]
+	if len(attempt.Steps) > 0 {
+		attempt.Steps[len(attempt.Steps)-1].Error = err.Error()
+	}
+}
+
+// copy returns the timeline with the durations filled in. A step lasts
+// until the next one starts, the last one of an attempt until its last
+// request.
+func (tl *NodeTimeline) copy(ip string) NodeTimeline {
+	out := NodeTimeline{MAC: tl.MAC, IP: ip, Attempts: make([]BootAttempt, len(tl.Attempts))}
+	for i, attempt := range tl.Attempts {
+		attempt.Steps = append([]TimelineStep{}, attempt.Steps...)
+		for j := range attempt.Steps {
+			end := attempt.lastSeen
+			if j+1 < len(attempt.Steps) {
+				end = attempt.Steps[j+1].Started
+			}
+			attempt.Steps[j].Duration = end.Sub(attempt.Steps[j].Started).Seconds()
+		}
+		attempt.Duration = attempt.lastSeen.Sub(attempt.Started).Seconds()
+		out.Attempts[i] = attempt
+	}
+	return out
+}
+
+// ipsLocked maps the MACs to the IPs learned for them.
+func (bs *bootSessions) ipsLocked() map[string]string {
+	ips := make(map[string]string, len(bs.ipToMac))
+	for ip, mac := range bs.ipToMac {
+		ips[mac] = ip
+	}
+	return ips
+}
+
+// timelines returns the timelines of the clients seen within
+// timelineRetention, most recent first, and forgets the others.
+func (bs *bootSessions) timelines() []NodeTimeline {
+	now := time.Now()
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	ips := bs.ipsLocked()
+	lastSeen := make(map[string]time.Time)
+	out := make([]NodeTimeline, 0, len(bs.history))
+	for mac, tl := range bs.history {
+		last := tl.Attempts[len(tl.Attempts)-1].lastSeen
+		if now.Sub(last) > timelineRetention {
+			delete(bs.history, mac)
+			continue
+		}
+		lastSeen[mac] = last
+		out = append(out, tl.copy(ips[mac]))
+	}
+	sort.Slice(out, func(i, j int) bool { return lastSeen[out[i].MAC].After(lastSeen[out[j].MAC]) })
+	return out
+}
+
+func (bs *bootSessions) timeline(mac string) (NodeTimeline, bool) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	tl, ok := bs.history[mac]
+	if !ok {
+		return NodeTimeline{}, false
+	}
+
+	return tl.copy(bs.ipsLocked()[mac]), true
+}
+
+// timelineHandler serves the timelines of all clients on /api/v1/timeline
+// and of one on /api/v1/timeline/<mac>.
+func (s *Server) timelineHandler(w http.ResponseWriter, req *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1/timeline"), "/")
+	if name == "" {
+		writeJSON(w, s.sessions.timelines())
+		return
+	}
+
+	mac, err := net.ParseMAC(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tl, ok := s.sessions.timeline(mac.String())
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, tl)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With config tokens, the talos.config URL in every boot script carries a
+// token only good for fetching the config once, within the token TTL, and
+// bound to the node the script was rendered for: the MAC and UUID it
+// chained with. The config is only served to the address leased to that
+// MAC, so that a URL read off a console screenshot can't be replayed
+// later, or by another machine. The progress and inventory URLs carry a
+// report token instead, good for as many reports as the install takes
+// but only for the node it was issued for, and reports without one, or
+// the client certificate of the node, are refused.
+
+const (
+	configTokenParam = "token"
+	configTokenTTL   = 10 * time.Minute
+	// The secret the report tokens are derived from, kept in the secrets
+	// store so that they stay good across restarts.
+	reportTokenKeyName = "report-token-key"
+)
+
+var (
+	errTokenUnknown  = fmt.Errorf("Unknown or used token")
+	errTokenExpired  = fmt.Errorf("Token expired")
+	errTokenPath     = fmt.Errorf("Token was issued for another config")
+	errTokenNode     = fmt.Errorf("Token was issued for another node")
+	errTokenRequired = fmt.Errorf("Token required")
+	errReportNode    = fmt.Errorf("Reports are only accepted from the node itself")
+)
+
+type configToken struct {
+	mac     string
+	uuid    string
+	path    string
+	expires time.Time
+}
+
+type configTokens struct {
+	ttl time.Duration
+	// reportKey signs the report tokens.
+	reportKey []byte
+
+	lock   sync.Mutex
+	tokens map[string]*configToken
+}
+
+func newConfigTokens(ttl time.Duration, reportKey []byte) *configTokens {
+	return &configTokens{ttl: ttl, reportKey: reportKey, tokens: make(map[string]*configToken)}
+}
+
+// reportToken returns the token the node with the MAC reports its install
+// progress and its hardware with.
+func (ct *configTokens) reportToken(mac net.HardwareAddr) string {
+	h := hmac.New(sha256.New, ct.reportKey)
+	h.Write([]byte(mac.String()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// issue returns a new token for the node to fetch the config at the path
+// with.
+func (ct *configTokens) issue(mac net.HardwareAddr, uuid, name string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	now := time.Now()
+	for t, tok := range ct.tokens {
+		if now.After(tok.expires) {
+			delete(ct.tokens, t)
+		}
+	}
+	ct.tokens[token] = &configToken{
+		mac:     mac.String(),
+		uuid:    strings.ToLower(uuid),
+		path:    name,
+		expires: now.Add(ct.ttl),
+	}
+	return token, nil
+}
+
+// redeem uses up the token if it's good for the config at the path,
+// fetched by the node with the MAC and, if it's known, the UUID. Tokens
+// aren't used up by other nodes trying them.
+func (ct *configTokens) redeem(token, name string, mac net.HardwareAddr, uuid string) error {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	tok, ok := ct.tokens[token]
+	if !ok {
+		return errTokenUnknown
+	}
+	if time.Now().After(tok.expires) {
+		delete(ct.tokens, token)
+		return errTokenExpired
+	}
+	if tok.path != name {
+		return errTokenPath
+	}
+	if mac == nil || mac.String() != tok.mac || (uuid != "" && tok.uuid != "" && strings.ToLower(uuid) != tok.uuid) {
+		return errTokenNode
+	}
+	delete(ct.tokens, token)
+	return nil
+}
+
+// withConfigTokens adds a token to the talos.config URLs of the boot
+// script for the node requesting it, and its report token to the
+// progress and inventory URLs.
+func (s *Server) withConfigTokens(script []byte, mac net.HardwareAddr, uuid string) []byte {
+	if s.configTokens == nil || mac == nil {
+		return script
+	}
+
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "kernel" {
+			continue
+		}
+
+		for j, field := range fields[1:] {
+			if strings.HasPrefix(field, progressKernelArg+"=") || strings.HasPrefix(field, inventoryKernelArg+"=") {
+				fields[j+1] = withURLParam(field, configTokenParam, s.configTokens.reportToken(s.nodes.identity(mac)))
+				continue
+			}
+			if !strings.HasPrefix(field, "talos.config=") {
+				continue
+			}
+			name, ok := configURLPath(strings.TrimPrefix(field, "talos.config="))
+			if !ok {
+				continue
+			}
+			token, err := s.configTokens.issue(mac, uuid, name)
+			if err != nil {
+				log.Errorf("Could not issue config token for %s: %s", mac, err)
+				continue
+			}
+			fields[j+1] = withURLParam(field, configTokenParam, token)
+		}
+		lines[i] = strings.Join(fields, " ")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func withURLParam(url, key, value string) string {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + key + "=" + value
+}
+
+// configURLPath returns the path of the config URL, which usually has the
+// address of the server as the ${next-server} iPXE variable.
+func configURLPath(url string) (string, bool) {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return "", false
+	}
+	rest := url[i+3:]
+	i = strings.Index(rest, "/")
+	if i < 0 {
+		return "", false
+	}
+	rest = rest[i:]
+	if i := strings.IndexAny(rest, "?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	return path.Clean(rest), true
+}
+
+// clientMAC returns the MAC of the client making the request, going by
+// its lease, or else by what the boot sessions learned. Configs rendered
+// again are for the node they're rendered for.
+func (s *Server) clientMAC(req *http.Request) net.HardwareAddr {
+	if mac := renderMAC(req); mac != nil {
+		return mac
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+
+	if !s.ProxyDHCP {
+		s.DHCPLock.Lock()
+		for mac, record := range s.DHCPRecords {
+			if record.IP.Equal(ip) {
+				s.DHCPLock.Unlock()
+				hw, _ := net.ParseMAC(mac)
+				return hw
+			}
+		}
+		s.DHCPLock.Unlock()
+	}
+	return s.sessions.lookupIP(ip)
+}
+
+// reportingNode returns the node reporting to the progress or the
+// inventory URL, the one with the MAC claimed if any, or else the one the
+// address is leased to. With config tokens, and so with mTLS, the report
+// needs the report token of the node, or its client certificate, and
+// without, has to come from the address of the node. Edges check the
+// reports themselves. Writes the error and returns nil if refused.
+func (s *Server) reportingNode(w http.ResponseWriter, req *http.Request, claimed string) net.HardwareAddr {
+	caller := s.clientMAC(req)
+	mac := caller
+	if claimed != "" {
+		var err error
+		if mac, err = net.ParseMAC(claimed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	if mac == nil {
+		http.Error(w, "Unknown node, pass its mac", http.StatusNotFound)
+		return nil
+	}
+	if isEdgeRequest(req) {
+		return mac
+	}
+	identity := s.nodes.identity(mac)
+
+	err := errReportNode
+	switch {
+	case s.ca != nil && req.TLS != nil && len(req.TLS.VerifiedChains) > 0:
+		if name := req.TLS.PeerCertificates[0].Subject.CommonName; name == mac.String() || name == identity.String() {
+			err = nil
+		} else {
+			err = errTokenNode
+		}
+	case s.configTokens != nil:
+		err = errTokenRequired
+		if token := req.URL.Query().Get(configTokenParam); token != "" {
+			err = errTokenNode
+			if hmac.Equal([]byte(token), []byte(s.configTokens.reportToken(identity))) {
+				err = nil
+			}
+		}
+	case caller != nil && s.nodes.identity(caller).String() == identity.String():
+		err = nil
+	}
+	if err != nil {
+		log.Warnf("Refusing the report on %s for %s from %s: %s", req.URL.Path, mac, req.RemoteAddr, err)
+		reportChecks.WithLabelValues("denied").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+	reportChecks.WithLabelValues("accepted").Inc()
+	return mac
+}
+
+// configTokenHandler only passes on requests for machine configs, and
+// requests carrying a token, if the token is good for them. The token is
+// dropped from the request on the way.
+func (s *Server) configTokenHandler(next http.Handler) http.Handler {
+	if s.configTokens == nil {
+		return next
+	}
+
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		name := path.Clean(req.URL.Path)
+		query := req.URL.Query()
+		token := query.Get(configTokenParam)
+		// Edges check the tokens they issued themselves. Only those
+		// which authenticated with the edge secret are let through.
+		if (token == "" && !isMachineConfigPath(name)) || isEdgeRequest(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		err := errTokenRequired
+		mac := s.clientMAC(req)
+		if token != "" {
+			err = s.configTokens.redeem(token, name, mac, query.Get("uuid"))
+		}
+		if err != nil {
+			log.Warnf("Refusing %s to %s: %s", name, req.RemoteAddr, err)
+			configTokenChecks.WithLabelValues("denied").Inc()
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		configTokenChecks.WithLabelValues("accepted").Inc()
+
+		query.Del(configTokenParam)
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+		next.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"golang.org/x/term"
+)
+
+// runTop shows the state of a running server in the terminal, refreshed
+// periodically from its admin API. It only needs the admin listener, so
+// it works over nothing more than an SSH session to the appliance.
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	adminAddrFlag := flags.String("admin-addr", "127.0.0.1:8081", "Admin address of the server")
+	intervalFlag := flags.Duration("interval", 2*time.Second, "Refresh interval")
+	flags.Parse(args)
+
+	config, err := apiClientTLS(*adminAddrFlag)
+	if err != nil {
+		return err
+	}
+	t := &topView{
+		base:   "http://" + *adminAddrFlag + "/api/v1/",
+		client: &http.Client{Timeout: *intervalFlag},
+	}
+	if config != nil {
+		t.base = "https://" + *adminAddrFlag + "/api/v1/"
+		t.client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+	}
+
+	// Alternate screen, hidden cursor.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	ticker := time.NewTicker(*intervalFlag)
+	defer ticker.Stop()
+
+	for {
+		t.refresh()
+		os.Stdout.Write(t.render())
+
+		select {
+		case <-ticker.C:
+		case key, ok := <-keys:
+			// q, Ctrl-C or EOF.
+			if !ok || key == 'q' || key == 3 {
+				return nil
+			}
+		}
+	}
+}
+
+type topView struct {
+	base   string
+	client *http.Client
+
+	pool     *poolStats
+	leases   []Lease
+	sessions []BootSession
+	dns      []DNSEntry
+	errors   []LoggedError
+	health   []NodeHealth
+	err      error
+	updated  time.Time
+}
+
+func (t *topView) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, t.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv(accessTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pool is missing in proxyDHCP mode.
+	if resp.StatusCode == http.StatusNotFound && path == "pool" {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (t *topView) refresh() {
+	var pool *poolStats
+	var leases []Lease
+	var sessions []BootSession
+	var dns []DNSEntry
+	var errors []LoggedError
+	var health []NodeHealth
+
+	for _, err := range []error{
+		t.get("pool", &pool),
+		t.get("leases", &leases),
+		t.get("sessions", &sessions),
+		t.get("dns", &dns),
+		t.get("errors", &errors),
+		t.get("health", &health),
+	} {
+		if err != nil {
+			// Keep showing the last state with the error.
+			t.err = err
+			return
+		}
+	}
+
+	t.pool, t.leases, t.sessions, t.dns, t.errors, t.health = pool, leases, sessions, dns, errors, health
+	t.err = nil
+	t.updated = time.Now()
+}
+
+func ago(then time.Time) string {
+	return time.Since(then).Round(time.Second).String()
+}
+
+func (t *topView) render() []byte {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	// Lines are cut to the terminal width before styling, so that the
+	// escape sequences stay intact.
+	addStyled := func(style, format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		if len(line) > width {
+			line = line[:width]
+		}
+		if style != "" {
+			line = style + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	add := func(format string, args ...interface{}) {
+		addStyled("", format, args...)
+	}
+	section := func(title string, count int) {
+		add("")
+		addStyled("\x1b[1m", "%s (%d)", title, count)
+	}
+
+	if t.err != nil {
+		addStyled("\x1b[7;31m", "talos-pxe top  %s", t.err)
+	} else {
+		addStyled("\x1b[7m", "talos-pxe top  updated %s  q to quit", t.updated.Format("15:04:05"))
+	}
+
+	if t.pool != nil {
+		add("Pool %s - %s: %d/%d used (%.0f%%), largest free block %d",
+			t.pool.Start, t.pool.End, t.pool.Used, t.pool.Total, t.pool.Utilization*100, t.pool.LargestFreeBlock)
+	}
+
+	// Sessions and errors are the most interesting, the other sections
+	// get cut first on small terminals.
+	section("Boot sessions", len(t.sessions))
+	add("%-17s  %-15s  %-20s  %8s  %8s  %-24s  %s", "MAC", "IP", "STAGE", "STARTED", "SEEN", "PORT", "ERROR")
+	for _, sess := range t.sessions {
+		add("%-17s  %-15s  %-20s  %8s  %8s  %-24s  %s", sess.MAC, sess.IP, sess.Stage, ago(sess.Started), ago(sess.LastSeen), sess.SwitchPort, sess.LastError)
+	}
+
+	section("Recent errors", len(t.errors))
+	for i, e := range t.errors {
+		if i == 5 {
+			break
+		}
+		add("%s  %-7s  %s", e.Time.Format("15:04:05"), e.Level, strings.TrimSpace(e.Message))
+	}
+
+	// Only there with a talosconfig.
+	if len(t.health) > 0 {
+		section("Talos API", len(t.health))
+		add("%-17s  %-15s  %-11s  %8s  %s", "MAC", "IP", "STATUS", "SINCE", "VERSION")
+		for _, check := range t.health {
+			if check.Reachable {
+				add("%-17s  %-15s  %-11s  %8s  %s", check.MAC, check.IP, "reachable", ago(check.Since), check.Version)
+			} else {
+				addStyled("\x1b[31m", "%-17s  %-15s  %-11s  %8s  %s", check.MAC, check.IP, "unreachable", ago(check.Since), check.Error)
+			}
+		}
+	}
+
+	section("Leases", len(t.leases))
+	add("%-17s  %-15s  %s", "MAC", "IP", "EXPIRES IN")
+	for _, lease := range t.leases {
+		expires := time.Until(lease.Expires).Round(time.Second).String()
+		if lease.Pinned {
+			expires = "pinned"
+		}
+		add("%-17s  %-15s  %s", lease.MAC, lease.IP, expires)
+	}
+
+	section("DNS records", len(t.dns))
+	for _, entry := range t.dns {
+		add("%-40s  %-4s  %s", entry.Name, entry.Type, entry.Data)
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for _, line := range lines {
+		// Raw mode doesn't translate newlines.
+		buf.WriteString(line + "\x1b[K\r\n")
+	}
+	buf.WriteString("\x1b[J")
+	return buf.Bytes()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Boot sessions are traced with one trace per client MAC. Every protocol
+// interaction (DHCP, PXE, TFTP, HTTP) becomes a span below the session's
+// root span, which is finished once the client has been idle for
+// traceSessionIdle. Spans are exported in OTLP/HTTP JSON encoding to
+// Jaeger, Tempo, or an OpenTelemetry collector.
+
+const (
+	traceSessionIdle   = 5 * time.Minute
+	traceFlushInterval = 5 * time.Second
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+
+	spanKindServer  = 2
+	statusCodeOk    = 1
+	statusCodeError = 2
+)
+
+type traceSession struct {
+	traceId []byte
+	spanId  []byte
+	start   time.Time
+	last    time.Time
+}
+
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *span
+
+	lock     sync.Mutex
+	sessions map[string]*traceSession
+	ipToMac  map[string]string
+}
+
+// A span is a single traced interaction. A nil span is valid and does
+// nothing, so callers don't have to check whether tracing is enabled.
+type span struct {
+	tracer   *tracer
+	name     string
+	traceId  []byte
+	spanId   []byte
+	parentId []byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+func newTracer(endpoint string) *tracer {
+	return &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceQueueSize),
+		sessions: make(map[string]*traceSession),
+		ipToMac:  make(map[string]string),
+	}
+}
+
+func randomId(n int) []byte {
+	id := make([]byte, n)
+	rand.Read(id)
+	return id
+}
+
+// session returns the boot session of the MAC, starting a new one if
+// needed. Must be called with the lock held.
+func (t *tracer) session(mac string, now time.Time) *traceSession {
+	sess, ok := t.sessions[mac]
+	if !ok {
+		sess = &traceSession{
+			traceId: randomId(16),
+			spanId:  randomId(8),
+			start:   now,
+		}
+		t.sessions[mac] = sess
+	}
+	sess.last = now
+	return sess
+}
+
+// start begins a span in the boot session of the given MAC.
+func (t *tracer) start(mac net.HardwareAddr, name string) *span {
+	if t == nil || mac == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sess := t.session(mac.String(), now)
+
+	return &span{
+		tracer:   t,
+		name:     name,
+		traceId:  sess.traceId,
+		spanId:   randomId(8),
+		parentId: sess.spanId,
+		start:    now,
+		attrs:    map[string]string{"net.host.mac": mac.String()},
+	}
+}
+
+// startByIP begins a span in the boot session of whichever client was
+// last seen using the IP. Returns nil if the IP is unknown.
+func (t *tracer) startByIP(ip net.IP, name string) *span {
+	if t == nil || ip == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	mac, ok := t.ipToMac[ip.String()]
+	t.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil
+	}
+	return t.start(hw, name)
+}
+
+// learnIP records that the MAC is using the IP, so that later requests
+// which only carry the IP (HTTP) can be tied to the boot session.
+func (t *tracer) learnIP(mac net.HardwareAddr, ip net.IP) {
+	if t == nil || mac == nil || ip == nil || ip.IsUnspecified() {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.ipToMac[ip.String()] = mac.String()
+}
+
+func (sp *span) SetAttr(key, value string) {
+	if sp == nil {
+		return
+	}
+	sp.attrs[key] = value
+}
+
+func (sp *span) End(err error) {
+	if sp == nil {
+		return
+	}
+
+	sp.end = time.Now()
+	sp.err = err
+
+	select {
+	case sp.tracer.spans <- sp:
+	default:
+		log.Debugf("Dropping span %s, export queue is full", sp.name)
+	}
+}
+
+// expire finishes the root spans of idle sessions.
+func (t *tracer) expire(now time.Time) []*span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var roots []*span
+	for mac, sess := range t.sessions {
+		if now.Sub(sess.last) < traceSessionIdle {
+			continue
+		}
+
+		delete(t.sessions, mac)
+		roots = append(roots, &span{
+			tracer:  t,
+			name:    "boot",
+			traceId: sess.traceId,
+			spanId:  sess.spanId,
+			start:   sess.start,
+			end:     sess.last,
+			attrs:   map[string]string{"net.host.mac": mac},
+		})
+	}
+	return roots
+}
+
+// run batches the finished spans and exports them. It never returns.
+func (t *tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case now := <-ticker.C:
+			batch = append(batch, t.expire(now)...)
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		if err := t.export(batch); err != nil {
+			log.Errorf("Failed to export %d spans: %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var out []otlpAttribute
+	for k, v := range attrs {
+		out = append(out, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	return out
+}
+
+func (t *tracer) export(batch []*span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(sp.traceId),
+			SpanId:            hex.EncodeToString(sp.spanId),
+			ParentSpanId:      hex.EncodeToString(sp.parentId),
+			Name:              sp.name,
+			Kind:              spanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(sp.attrs),
+			Status:            otlpStatus{Code: statusCodeOk},
+		}
+		if sp.err != nil {
+			o.Status = otlpStatus{Code: statusCodeError, Message: sp.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": "talos-pxe"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "talos-pxe"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// tracingHandler records a span for every HTTP request made by a client
+// that can be tied to a boot session, and updates the session for the
+// admin API.
+func (s *Server) tracingHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		var sp *span
+		if mac, err := net.ParseMAC(req.URL.Query().Get("mac")); err == nil {
+			ip := net.ParseIP(req.URL.Query().Get("ip"))
+			s.sessions.learnIP(mac, ip)
+			s.sessions.seen(mac, "http "+req.URL.Path)
+			s.tracer.learnIP(mac, ip)
+			sp = s.tracer.start(mac, "http "+req.URL.Path)
+		} else if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			s.sessions.seenIP(net.ParseIP(host), "http "+req.URL.Path)
+			sp = s.tracer.startByIP(net.ParseIP(host), "http "+req.URL.Path)
+		}
+
+		if sp == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		sp.SetAttr("http.method", req.Method)
+		sp.SetAttr("http.target", req.URL.RequestURI())
+		sp.SetAttr("http.status_code", strconv.Itoa(rec.status))
+
+		var err error
+		if rec.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%s", http.StatusText(rec.status))
+		}
+		sp.End(err)
+	}
+
+	return http.HandlerFunc(fn)
+}
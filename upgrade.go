@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// An upgrade rolls a Talos version across the registered nodes, the
+// controlplanes first, one node at a time. The next node is only upgraded
+// once the previous one runs the version and passes the health gate: its
+// Talos API and Kubernetes API server or kubelet ports are open again.
+// Nodes are either upgraded through the Talos API, which needs the
+// --talosconfig of the cluster, or by pinning the version and reinstalling
+// them over PXE, booting the kernel and initramfs from assets/<version>/
+// and installing the installer image of the version. Reinstalled nodes
+// are power cycled with the power cycle command if there is one, or else
+// the upgrade waits for them to be rebooted.
+
+const (
+	UpgradeMethodAPI = "api"
+	UpgradeMethodPXE = "pxe"
+
+	UpgradeRunning   = "running"
+	UpgradeDone      = "done"
+	UpgradeFailed    = "failed"
+	UpgradeCancelled = "cancelled"
+
+	upgradePollInterval = 10 * time.Second
+
+	talosVersionParam = "talos-version"
+)
+
+var talosVersionRegexp = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+[0-9A-Za-z.+-]*$`)
+
+var (
+	errUpgradeRunning   = fmt.Errorf("An upgrade is already running")
+	errNoUpgradeRunning = fmt.Errorf("No upgrade is running")
+)
+
+type UpgradeNode struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// pending, upgrading, done, skipped, failed or cancelled.
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type Upgrade struct {
+	Version  string        `json:"version"`
+	Method   string        `json:"method"`
+	Status   string        `json:"status"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished,omitempty"`
+	Nodes    []UpgradeNode `json:"nodes"`
+}
+
+type upgradeRequest struct {
+	Version string `json:"version"`
+	Method  string `json:"method"`
+}
+
+func (r *upgradeRequest) check() error {
+	if !talosVersionRegexp.MatchString(r.Version) {
+		return fmt.Errorf("Invalid Talos version %q, e.g. v1.5.3", r.Version)
+	}
+	if r.Method != UpgradeMethodAPI && r.Method != UpgradeMethodPXE {
+		return fmt.Errorf("Upgrade method has to be %s or %s", UpgradeMethodAPI, UpgradeMethodPXE)
+	}
+	return nil
+}
+
+// upgradeState keeps the last upgrade.
+type upgradeState struct {
+	lock    sync.Mutex
+	current *Upgrade
+	cancel  context.CancelFunc
+}
+
+// get returns a copy of the last upgrade.
+func (u *upgradeState) get() (Upgrade, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.current == nil {
+		return Upgrade{}, false
+	}
+	out := *u.current
+	out.Nodes = append([]UpgradeNode(nil), u.current.Nodes...)
+	return out, true
+}
+
+func (u *upgradeState) updateNode(i int, fn func(node *UpgradeNode)) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	fn(&u.current.Nodes[i])
+}
+
+func (u *upgradeState) finish(status string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.current.Status = status
+	u.current.Finished = time.Now()
+	u.cancel()
+}
+
+// upgradeOrder orders the nodes controlplanes first, by IP.
+func upgradeOrder(nodes []Node) {
+	sortNodes(nodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return isControlplaneRole(nodes[i].Role) && !isControlplaneRole(nodes[j].Role)
+	})
+}
+
+func (s *Server) installerImage(version string) string {
+	return s.InstallerImage + ":" + version
+}
+
+// startUpgrade starts upgrading all the nodes in the background.
+func (s *Server) startUpgrade(actor string, req upgradeRequest) (Upgrade, error) {
+	if s.Freeze {
+		return Upgrade{}, errFrozen
+	}
+	if req.Method == UpgradeMethodAPI && s.talosTLS == nil {
+		return Upgrade{}, fmt.Errorf("Upgrading through the Talos API needs --talosconfig")
+	}
+	if req.Method == UpgradeMethodPXE && !s.maintenanceStatus().Open {
+		return Upgrade{}, fmt.Errorf("Nodes are only reinstalled in maintenance windows")
+	}
+
+	nodes := s.nodes.list()
+	if len(nodes) == 0 {
+		return Upgrade{}, fmt.Errorf("No nodes to upgrade")
+	}
+	upgradeOrder(nodes)
+
+	upgrade := &Upgrade{
+		Version: req.Version,
+		Method:  req.Method,
+		Status:  UpgradeRunning,
+		Started: time.Now(),
+	}
+	for _, node := range nodes {
+		upgrade.Nodes = append(upgrade.Nodes, UpgradeNode{
+			MAC:    node.MAC,
+			Name:   node.name(),
+			Role:   node.Role,
+			Status: "pending",
+		})
+	}
+
+	s.upgrades.lock.Lock()
+	if s.upgrades.current != nil && s.upgrades.current.Status == UpgradeRunning {
+		s.upgrades.lock.Unlock()
+		return Upgrade{}, errUpgradeRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.upgrades.current, s.upgrades.cancel = upgrade, cancel
+	s.upgrades.lock.Unlock()
+
+	log.Infof("Upgrading %d nodes to Talos %s through %s", len(nodes), req.Version, req.Method)
+	s.audit.record(actor, "upgrade.start", "", fmt.Sprintf("%s through %s", req.Version, req.Method))
+	go s.runUpgrade(ctx, req)
+
+	out, _ := s.upgrades.get()
+	return out, nil
+}
+
+// cancelUpgrade stops the running upgrade, leaving the node being upgraded
+// as it is.
+func (s *Server) cancelUpgrade(actor string) (Upgrade, error) {
+	s.upgrades.lock.Lock()
+	if s.upgrades.current == nil || s.upgrades.current.Status != UpgradeRunning {
+		s.upgrades.lock.Unlock()
+		return Upgrade{}, errNoUpgradeRunning
+	}
+	s.upgrades.cancel()
+	s.upgrades.lock.Unlock()
+
+	s.audit.record(actor, "upgrade.cancel", "", "")
+	out, _ := s.upgrades.get()
+	return out, nil
+}
+
+func (s *Server) runUpgrade(ctx context.Context, req upgradeRequest) {
+	upgrade, _ := s.upgrades.get()
+
+	for i, node := range upgrade.Nodes {
+		if ctx.Err() != nil {
+			log.Infof("Upgrade to Talos %s cancelled", req.Version)
+			s.upgrades.finish(UpgradeCancelled)
+			return
+		}
+
+		s.upgrades.updateNode(i, func(n *UpgradeNode) {
+			n.Status = "upgrading"
+			n.Started = time.Now()
+		})
+		log.Infof("Upgrading %s to Talos %s", node.Name, req.Version)
+
+		skipped, err := s.upgradeNode(ctx, req, node.MAC)
+		cancelled := ctx.Err() != nil
+
+		s.upgrades.updateNode(i, func(n *UpgradeNode) {
+			n.Finished = time.Now()
+			switch {
+			case cancelled:
+				n.Status = "cancelled"
+			case err != nil:
+				n.Status = "failed"
+				n.Error = err.Error()
+			case skipped:
+				n.Status = "skipped"
+			default:
+				n.Status = "done"
+			}
+		})
+
+		if cancelled {
+			log.Infof("Upgrade to Talos %s cancelled while upgrading %s", req.Version, node.Name)
+			s.upgrades.finish(UpgradeCancelled)
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to upgrade %s to Talos %s, stopping the upgrade: %s", node.Name, req.Version, err)
+			s.audit.record("upgrade", "upgrade.node", node.MAC, fmt.Sprintf("failed: %s", err))
+			s.upgrades.finish(UpgradeFailed)
+			return
+		}
+		s.audit.record("upgrade", "upgrade.node", node.MAC, req.Version)
+	}
+
+	log.Infof("Upgraded all nodes to Talos %s", req.Version)
+	s.audit.record("upgrade", "upgrade.done", "", req.Version)
+	s.upgrades.finish(UpgradeDone)
+}
+
+// upgradeNode upgrades the node and waits for it to pass the health gate.
+// Returns true if the node already ran the version.
+func (s *Server) upgradeNode(ctx context.Context, req upgradeRequest, mac string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.UpgradeNodeTimeout)
+	defer cancel()
+
+	node, ok := s.nodes.get(mac)
+	if !ok {
+		return false, errNodeNotFound
+	}
+
+	if req.Method == UpgradeMethodAPI {
+		client, err := dialTalos(ctx, s.talosTLS, node.IP)
+		if err != nil {
+			return false, fmt.Errorf("Could not connect to the Talos API: %s", err)
+		}
+		defer client.Close()
+
+		if version, err := client.Version(ctx); err == nil && version == req.Version {
+			return true, nil
+		}
+		if err := client.Upgrade(ctx, s.installerImage(req.Version)); err != nil {
+			return false, fmt.Errorf("Talos API upgrade failed: %s", err)
+		}
+		s.nodes.update(mac, func(node *Node) {
+			node.Version = req.Version
+		})
+	} else {
+		s.nodes.update(mac, func(node *Node) {
+			node.Version = req.Version
+			node.State = NodeStateReinstall
+		})
+
+		if s.PowerCycleCommand != "" {
+			if err := s.powerCycle(node); err != nil {
+				return false, fmt.Errorf("Could not power cycle: %s", err)
+			}
+		} else {
+			log.Infof("Waiting for %s to be rebooted to reinstall it", node.name())
+		}
+
+		// The node is recorded again when it fetches its boot script.
+		if err := waitUntil(ctx, func() error {
+			node, ok := s.nodes.get(mac)
+			if !ok {
+				return errNodeNotFound
+			}
+			if node.State == NodeStateReinstall {
+				return fmt.Errorf("Node didn't boot into the reinstall")
+			}
+			return nil
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	return false, waitUntil(ctx, func() error {
+		return s.checkNodeHealth(ctx, mac, req.Version)
+	})
+}
+
+// waitUntil polls check until it passes, returning its last error when
+// ctx is done.
+func waitUntil(ctx context.Context, check func() error) error {
+	for {
+		err := check()
+		if err == nil || err == errNodeNotFound {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Timed out: %s", err)
+		case <-time.After(upgradePollInterval):
+		}
+	}
+}
+
+// checkNodeHealth is the health gate of the upgrade: the Talos API and the
+// Kubernetes API server of controlplanes, or the kubelet of workers, have
+// to be reachable, and the node has to run the version if we can ask it.
+func (s *Server) checkNodeHealth(ctx context.Context, mac string, version string) error {
+	node, ok := s.nodes.get(mac)
+	if !ok {
+		return errNodeNotFound
+	}
+
+	ports := []int{talosAPIPort, 10250}
+	if isControlplaneRole(node.Role) {
+		ports[1] = 6443
+	}
+	for _, port := range ports {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(node.IP, strconv.Itoa(port)), 3*time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	if s.talosTLS == nil {
+		return nil
+	}
+	client, err := dialTalos(ctx, s.talosTLS, node.IP)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	running, err := client.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if running != version {
+		return fmt.Errorf("Node runs Talos %s", running)
+	}
+	return nil
+}
+
+// withTalosVersion has the boot script of a node pinned to a version boot
+// the kernel and initramfs of the version, where assets/<version>/ has
+// them, and install the installer image of the version.
+func (s *Server) withTalosVersion(script []byte, mac net.HardwareAddr) []byte {
+	if mac == nil {
+		return script
+	}
+	node, ok := s.nodes.get(mac.String())
+	if !ok || node.Version == "" {
+		return script
+	}
+
+	lines := strings.Split(string(script), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "kernel" && fields[0] != "initrd") {
+			continue
+		}
+
+		for j, field := range fields[1:] {
+			if name, ok := bootImageURLPath(field); ok {
+				versioned := path.Join("/assets", node.Version, strings.TrimPrefix(name, "/assets/"))
+				if _, err := os.Stat(filepath.Join(s.ServerRoot, filepath.FromSlash(versioned))); err == nil {
+					fields[j+1] = strings.Replace(field, name, versioned, 1)
+				}
+			} else if strings.HasPrefix(field, "talos.config=") {
+				sep := "?"
+				if strings.Contains(field, "?") {
+					sep = "&"
+				}
+				fields[j+1] = field + sep + talosVersionParam + "=" + node.Version
+			}
+		}
+		lines[i] = strings.Join(fields, " ")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// installerImagePatch has the node install the installer image of the
+// version.
+func (s *Server) installerImagePatch(version string) machineConfigPatch {
+	return func(cfg map[interface{}]interface{}) error {
+		return setConfigValue(cfg, "machine.install.image", s.installerImage(version))
+	}
+}
+
+func (s *Server) upgradeHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		upgrade, ok := s.upgrades.get()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, upgrade)
+	case http.MethodPost:
+		upgradeReq := upgradeRequest{Method: UpgradeMethodPXE}
+		if err := json.NewDecoder(req.Body).Decode(&upgradeReq); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := upgradeReq.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.authorize(w, req, roleAdmin) {
+			return
+		}
+		upgrade, err := s.startUpgrade(requestActor(req), upgradeReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, upgrade)
+	case http.MethodDelete:
+		upgrade, err := s.cancelUpgrade(requestActor(req))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, upgrade)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var upgradeCommands = map[string]func(client *managementClient, args []string) error{
+	"start":  runUpgradeStart,
+	"status": runUpgradeStatus,
+	"cancel": runUpgradeCancel,
+}
+
+// runUpgrade starts, follows and cancels upgrades of a running server.
+func runUpgrade(args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	flags.SetInterspersed(false)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	command, ok := upgradeCommands[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("Usage: %s upgrade [--management-addr ADDR] start|status|cancel", os.Args[0])
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return command(client, flags.Args()[1:])
+}
+
+func runUpgradeStart(client *managementClient, args []string) error {
+	flags := flag.NewFlagSet("upgrade start", flag.ExitOnError)
+	versionFlag := flags.String("version", "", "Talos version to upgrade to, e.g. v1.5.3")
+	methodFlag := flags.String("method", UpgradeMethodPXE, "Upgrade through the Talos API (api) or by reinstalling over PXE (pxe)")
+	flags.Parse(args)
+
+	req := upgradeRequest{Version: *versionFlag, Method: *methodFlag}
+	if err := req.check(); err != nil {
+		return err
+	}
+
+	upgrade, err := client.StartUpgrade(req)
+	if err != nil {
+		return err
+	}
+	printUpgrade(upgrade)
+	return nil
+}
+
+func runUpgradeStatus(client *managementClient, args []string) error {
+	upgrade, err := client.GetUpgrade()
+	if err != nil {
+		return err
+	}
+	printUpgrade(upgrade)
+	return nil
+}
+
+func runUpgradeCancel(client *managementClient, args []string) error {
+	upgrade, err := client.CancelUpgrade()
+	if err != nil {
+		return err
+	}
+	printUpgrade(upgrade)
+	return nil
+}
+
+func printUpgrade(upgrade Upgrade) {
+	fmt.Printf("Talos %s through %s: %s\n", upgrade.Version, upgrade.Method, upgrade.Status)
+	for _, node := range upgrade.Nodes {
+		line := fmt.Sprintf("  %-20s %-17s %-12s %s", node.Name, node.MAC, node.Role, node.Status)
+		if node.Error != "" {
+			line += ": " + node.Error
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// The groups, profiles, templates and machine configs of the store are
+// edited by hand or synced from git while nodes run what they rendered
+// to before. Whenever the store or the template variables change, every
+// known node is previewed again, and a version is recorded if the store
+// files or what a node renders to changed: the hashes of the store files
+// and, for each node, of its boot script and machine config, the contents
+// being kept once however many nodes or versions share them. The machine
+// configs are kept with their secrets redacted, their hashes telling
+// when the secrets changed. Versions are diffed node by node for review,
+// by admins only, and kept in <root>/config-versions.json across
+// restarts.
+
+const (
+	configVersionsFile = "config-versions.json"
+	// How many versions are kept.
+	configVersionsKeep     = 20
+	configVersionsInterval = 30 * time.Second
+	// The lines of context around the changes of a diff.
+	diffContext = 3
+	// Beyond that many lines compared, the diff replaces the whole text.
+	diffMaxCells = 4000000
+)
+
+var errNoConfigVersion = fmt.Errorf("No such config version")
+
+// ConfigVersion is a version of the store and of what the nodes render
+// to.
+type ConfigVersion struct {
+	ID      int       `json:"id"`
+	Created time.Time `json:"created"`
+	// Files are the store files changed since the previous version.
+	Files []string `json:"files,omitempty"`
+	// Nodes are the MACs of the nodes whose boot script or machine config
+	// changed since the previous version.
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// NodeDiff is what changed in the rendered output of a node, as unified
+// diffs.
+type NodeDiff struct {
+	MAC           string `json:"mac"`
+	Role          string `json:"role"`
+	Script        string `json:"script,omitempty"`
+	MachineConfig string `json:"machine_config,omitempty"`
+}
+
+// VersionDiff is what changed between two versions.
+type VersionDiff struct {
+	From  int        `json:"from"`
+	To    int        `json:"to"`
+	Files []string   `json:"files,omitempty"`
+	Nodes []NodeDiff `json:"nodes"`
+}
+
+// renderedNode is what a node rendered to, with the SHA-256 of the
+// contents.
+type renderedNode struct {
+	Role          string `json:"role"`
+	Script        string `json:"script"`
+	Config        string `json:"config,omitempty"`
+	MachineConfig string `json:"machine_config,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type configVersion struct {
+	ConfigVersion
+	// Store has the SHA-256 of every store file.
+	Store    map[string]string       `json:"store"`
+	Rendered map[string]renderedNode `json:"rendered"`
+}
+
+// missesNodes tells whether nodes booted since the version was rendered.
+func (v *configVersion) missesNodes(nodes []Node) bool {
+	for _, node := range nodes {
+		if _, ok := v.Rendered[node.MAC]; !ok && node.Role != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type configVersions struct {
+	lock     sync.Mutex
+	path     string
+	versions []configVersion
+	// Contents by SHA-256.
+	blobs map[string]string
+}
+
+type configVersionsFileData struct {
+	Versions []configVersion   `json:"versions"`
+	Blobs    map[string]string `json:"blobs"`
+}
+
+func (v *configVersions) list() []ConfigVersion {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	out := make([]ConfigVersion, 0, len(v.versions))
+	for i := len(v.versions) - 1; i >= 0; i-- {
+		out = append(out, v.versions[i].ConfigVersion)
+	}
+	return out
+}
+
+// latest returns the last version, with ok false if there is none.
+func (v *configVersions) latest() (configVersion, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.versions) == 0 {
+		return configVersion{}, false
+	}
+	return v.versions[len(v.versions)-1], true
+}
+
+func (v *configVersions) getLocked(id int) (configVersion, bool) {
+	for _, version := range v.versions {
+		if version.ID == id {
+			return version, true
+		}
+	}
+	return configVersion{}, false
+}
+
+// add records the store files and the rendered outputs as a new version
+// if they changed, returning whether they did.
+func (v *configVersions) add(store map[string]string, rendered map[string]renderedNode, blobs map[string]string) (ConfigVersion, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	version := configVersion{
+		ConfigVersion: ConfigVersion{ID: 1, Created: time.Now().UTC().Round(time.Second)},
+		Store:         store,
+		Rendered:      rendered,
+	}
+	if n := len(v.versions); n > 0 {
+		last := v.versions[n-1]
+		version.ID = last.ID + 1
+		version.Files = changedFiles(last.Store, store)
+		for mac, node := range rendered {
+			if old, ok := last.Rendered[mac]; ok && old != node {
+				version.Nodes = append(version.Nodes, mac)
+			}
+		}
+		sort.Strings(version.Nodes)
+		if len(version.Files) == 0 && len(version.Nodes) == 0 {
+			// Only nodes added or gone, kept for the next diff.
+			v.versions[n-1].Rendered = rendered
+			for sum, blob := range blobs {
+				v.blobs[sum] = blob
+			}
+			v.pruneLocked()
+			return ConfigVersion{}, false
+		}
+	}
+
+	for sum, blob := range blobs {
+		v.blobs[sum] = blob
+	}
+	v.versions = append(v.versions, version)
+	if len(v.versions) > configVersionsKeep {
+		v.versions = v.versions[len(v.versions)-configVersionsKeep:]
+	}
+	v.pruneLocked()
+	return version.ConfigVersion, true
+}
+
+// pruneLocked drops the contents no version refers to anymore.
+func (v *configVersions) pruneLocked() {
+	used := make(map[string]bool)
+	for _, version := range v.versions {
+		for _, node := range version.Rendered {
+			used[node.Script] = true
+			used[node.MachineConfig] = true
+		}
+	}
+	for sum := range v.blobs {
+		if !used[sum] {
+			delete(v.blobs, sum)
+		}
+	}
+}
+
+func (v *configVersions) save() error {
+	v.lock.Lock()
+	data, err := json.Marshal(configVersionsFileData{Versions: v.versions, Blobs: v.blobs})
+	v.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+// diff returns what changed between the versions, for the node with the
+// MAC only unless it's empty. Nodes rendered in only one of them aren't
+// diffed.
+func (v *configVersions) diff(from, to int, mac string) (VersionDiff, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	a, ok := v.getLocked(from)
+	if !ok {
+		return VersionDiff{}, errNoConfigVersion
+	}
+	b, ok := v.getLocked(to)
+	if !ok {
+		return VersionDiff{}, errNoConfigVersion
+	}
+
+	macs := make([]string, 0, len(b.Rendered))
+	for m := range b.Rendered {
+		macs = append(macs, m)
+	}
+	sort.Strings(macs)
+
+	out := VersionDiff{From: from, To: to, Files: changedFiles(a.Store, b.Store), Nodes: []NodeDiff{}}
+	for _, m := range macs {
+		if mac != "" && m != mac {
+			continue
+		}
+		old, ok := a.Rendered[m]
+		node := b.Rendered[m]
+		if !ok || old == node {
+			continue
+		}
+		d := NodeDiff{MAC: m, Role: node.Role}
+		if old.Script != node.Script {
+			d.Script = unifiedDiff(v.blobs[old.Script], v.blobs[node.Script], fmt.Sprintf("script@%d", from), fmt.Sprintf("script@%d", to))
+		}
+		if old.MachineConfig != node.MachineConfig || old.Config != node.Config {
+			d.MachineConfig = unifiedDiff(v.blobs[old.MachineConfig], v.blobs[node.MachineConfig], fmt.Sprintf("%s@%d", old.Config, from), fmt.Sprintf("%s@%d", node.Config, to))
+			if d.MachineConfig == "" {
+				d.MachineConfig = "secrets changed\n"
+			}
+		}
+		if old.Error != node.Error {
+			d.MachineConfig += fmt.Sprintf("error: %q -> %q\n", old.Error, node.Error)
+		}
+		out.Nodes = append(out.Nodes, d)
+	}
+	return out, nil
+}
+
+func changedFiles(a, b map[string]string) []string {
+	var files []string
+	for name, sum := range b {
+		if a[name] != sum {
+			files = append(files, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// storeFiles returns the SHA-256 of the files of the store, relative to
+// the root.
+func (s *Server) storeFiles() map[string]string {
+	files := make(map[string]string)
+	add := func(p string) {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return
+		}
+		rel, _ := filepath.Rel(s.ServerRoot, p)
+		files[filepath.ToSlash(rel)] = sha256Hex(data)
+	}
+
+	for _, dir := range renderStoreDirs {
+		filepath.Walk(filepath.Join(s.ServerRoot, dir), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				add(p)
+			}
+			return nil
+		})
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(s.ServerRoot, "assets")); err == nil {
+		for _, fi := range entries {
+			if isMachineConfigPath("/assets/" + fi.Name()) {
+				add(filepath.Join(s.ServerRoot, "assets", fi.Name()))
+			}
+		}
+	}
+	return files
+}
+
+// renderNodes previews every node with a role, returning what they
+// rendered to and the contents by SHA-256, the machine configs redacted.
+func (s *Server) renderNodes() (map[string]renderedNode, map[string]string) {
+	rendered := make(map[string]renderedNode)
+	blobs := make(map[string]string)
+	keep := func(content string, redact bool) string {
+		if content == "" {
+			return ""
+		}
+		sum := sha256Hex([]byte(content))
+		if redact {
+			content = redactedBlob(content)
+		}
+		blobs[sum] = content
+		return sum
+	}
+
+	for _, node := range s.nodes.list() {
+		if node.Role == "" {
+			continue
+		}
+		preview, err := s.preview(previewRequest{MAC: node.MAC})
+		if err != nil {
+			rendered[node.MAC] = renderedNode{Role: node.Role, Error: err.Error()}
+			continue
+		}
+		rendered[node.MAC] = renderedNode{
+			Role:          preview.Role,
+			Script:        keep(preview.Script, false),
+			Config:        preview.Config,
+			MachineConfig: keep(preview.MachineConfig, true),
+		}
+	}
+	return rendered, blobs
+}
+
+// loadConfigVersions reads the versions kept across restarts.
+func (s *Server) loadConfigVersions() error {
+	s.configVersions.path = filepath.Join(s.ServerRoot, configVersionsFile)
+	s.configVersions.blobs = make(map[string]string)
+
+	data, err := ioutil.ReadFile(s.configVersions.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved configVersionsFileData
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Invalid config versions %s: %s", s.configVersions.path, err)
+	}
+	s.configVersions.versions = saved.Versions
+	if saved.Blobs != nil {
+		s.configVersions.blobs = saved.Blobs
+	}
+	// Versions saved before the machine configs were redacted.
+	for _, version := range saved.Versions {
+		for _, node := range version.Rendered {
+			if blob, ok := s.configVersions.blobs[node.MachineConfig]; ok {
+				s.configVersions.blobs[node.MachineConfig] = redactedBlob(blob)
+			}
+		}
+	}
+	return nil
+}
+
+// redactedBlob is the machine config with its secrets redacted, or a note
+// if it can't be redacted.
+func redactedBlob(config string) string {
+	data, err := redactMachineConfig([]byte(config))
+	if err != nil {
+		return fmt.Sprintf("# Not kept, the secrets can't be redacted: %s\n", err)
+	}
+	return string(data)
+}
+
+// recordConfigVersion renders the nodes again, recording a version if
+// anything changed.
+func (s *Server) recordConfigVersion() {
+	store := s.storeFiles()
+	rendered, blobs := s.renderNodes()
+	version, ok := s.configVersions.add(store, rendered, blobs)
+	if ok {
+		configVersionsRecorded.Inc()
+		if version.ID == 1 {
+			log.Infof("Recorded config version 1 of %d nodes", len(rendered))
+		} else {
+			log.Infof("Recorded config version %d: %d store files and the outputs of %d nodes changed, see talos-pxe versions diff", version.ID, len(version.Files), len(version.Nodes))
+		}
+	}
+	if err := s.configVersions.save(); err != nil {
+		log.Errorf("Could not save the config versions: %s", err)
+	}
+}
+
+// watchConfigVersions records a version whenever the store or the
+// template variables change. It never returns.
+func (s *Server) watchConfigVersions() {
+	s.recordConfigVersion()
+	vars := s.templateVarsVersion()
+	for {
+		time.Sleep(configVersionsInterval)
+
+		last, _ := s.configVersions.latest()
+		current := s.templateVarsVersion()
+		if current == vars && len(changedFiles(last.Store, s.storeFiles())) == 0 && !last.missesNodes(s.nodes.list()) {
+			continue
+		}
+		vars = current
+		s.recordConfigVersion()
+	}
+}
+
+// unifiedDiff diffs the texts line by line.
+func unifiedDiff(a, b, fromName, toName string) string {
+	if a == b {
+		return ""
+	}
+	x, y := splitLines(a), splitLines(b)
+
+	// ops is the edit script, ' ' keeping, '-' removing a line of x and
+	// '+' adding a line of y.
+	var ops []byte
+	if (len(x)+1)*(len(y)+1) > diffMaxCells {
+		ops = append([]byte(strings.Repeat("-", len(x))), strings.Repeat("+", len(y))...)
+	} else {
+		// lcs[i][j] is the longest common subsequence of x[i:] and y[j:].
+		lcs := make([][]int32, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				switch {
+				case x[i] == y[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(x) || j < len(y) {
+			switch {
+			case i < len(x) && j < len(y) && x[i] == y[j]:
+				ops = append(ops, ' ')
+				i++
+				j++
+			case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, '-')
+				i++
+			default:
+				ops = append(ops, '+')
+				j++
+			}
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	// Hunks of the changes, with their context.
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start] == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		end := start
+		for end < len(ops) {
+			if ops[end] != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run] == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				break
+			}
+			end = run
+		}
+		to := end + diffContext
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		// The line numbers where the hunk starts.
+		xi, yi := 0, 0
+		for _, op := range ops[:from] {
+			if op != '+' {
+				xi++
+			}
+			if op != '-' {
+				yi++
+			}
+		}
+		var xn, yn int
+		var lines []string
+		for _, op := range ops[from:to] {
+			switch op {
+			case ' ':
+				lines = append(lines, " "+x[xi+xn])
+				xn++
+				yn++
+			case '-':
+				lines = append(lines, "-"+x[xi+xn])
+				xn++
+			case '+':
+				lines = append(lines, "+"+y[yi+yn])
+				yn++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(xi, xn), hunkRange(yi, yn))
+		for _, line := range lines {
+			out.WriteString(line + "\n")
+		}
+		start = to
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// configVersionsHandler lists the versions on /api/v1/versions and diffs
+// two of them on /api/v1/versions/diff?from=ID&to=ID&mac=MAC, the last
+// version with the one before it by default, for admins.
+func (s *Server) configVersionsHandler(w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimSuffix(req.URL.Path, "/") {
+	case "/api/v1/versions":
+		writeJSON(w, s.configVersions.list())
+	case "/api/v1/versions/diff":
+		if !s.authorize(w, req, roleAdmin) {
+			return
+		}
+		var ids [2]int
+		for i, name := range []string{"from", "to"} {
+			if value := req.FormValue(name); value != "" {
+				id, err := strconv.Atoi(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid version %q", value), http.StatusBadRequest)
+					return
+				}
+				ids[i] = id
+			}
+		}
+		diff, err := s.diffConfigVersions(ids[0], ids[1], req.FormValue("mac"))
+		switch {
+		case err == errNoConfigVersion:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, diff)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// diffConfigVersions diffs the versions, to defaulting to the last
+// version and from to the one before to.
+func (s *Server) diffConfigVersions(from, to int, mac string) (VersionDiff, error) {
+	if to == 0 {
+		last, ok := s.configVersions.latest()
+		if !ok {
+			return VersionDiff{}, errNoConfigVersion
+		}
+		to = last.ID
+	}
+	if from == 0 {
+		from = to - 1
+	}
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return VersionDiff{}, err
+		}
+		mac = hw.String()
+	}
+	return s.configVersions.diff(from, to, mac)
+}
+
+// runVersions lists the config versions of a running server, or diffs
+// them.
+func runVersions(args []string) error {
+	flags := flag.NewFlagSet("versions", flag.ExitOnError)
+	managementAddrFlag := flags.String("management-addr", "127.0.0.1:8082", "Management API address of the server")
+	fromFlag := flags.Int("from", 0, "Version to diff from (default the one before --to)")
+	toFlag := flags.Int("to", 0, "Version to diff to (default the last one)")
+	macFlag := flags.String("mac", "", "Only diff the node with the MAC")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (flags.Arg(0) != "list" && flags.Arg(0) != "diff") {
+		return fmt.Errorf("Usage: %s versions list|diff [flags]", os.Args[0])
+	}
+
+	client, err := dialManagement(*managementAddrFlag)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if flags.Arg(0) == "list" {
+		versions, err := client.ListConfigVersions()
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			fmt.Println("No config versions recorded yet")
+		}
+		for _, version := range versions {
+			fmt.Printf("%d\t%s\t%d files\t%d nodes\t%s\n", version.ID, version.Created.Local().Format(time.RFC1123), len(version.Files), len(version.Nodes), strings.Join(version.Files, " "))
+		}
+		return nil
+	}
+
+	diff, err := client.GetConfigDiff(*fromFlag, *toFlag, *macFlag)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Version %d to %d\n", diff.From, diff.To)
+	for _, file := range diff.Files {
+		fmt.Printf("# Changed %s\n", file)
+	}
+	for _, node := range diff.Nodes {
+		fmt.Printf("\n# Node %s (%s)\n%s%s", node.MAC, node.Role, node.Script, node.MachineConfig)
+	}
+	if len(diff.Nodes) == 0 {
+		fmt.Println("\nNo node renders differently")
+	}
+	return nil
+}
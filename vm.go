@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Without spare hardware, the whole pipeline can be exercised on libvirt
+// VMs. `talos-pxe vm create N` defines and starts N VMs on the bridge the
+// server serves on, booting from the network first so that they get the
+// menu, and from their disk once installed. They're named <prefix>-<n>,
+// which `vm list` and `vm delete` go by. libvirt is driven through virsh.
+
+var vmPrefixRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type vmDomain struct {
+	Name   string
+	MAC    string
+	Memory int
+	VCPUs  int
+	Pool   string
+	Volume string
+	Bridge string
+}
+
+var vmDomainTemplate = template.Must(template.New("domain").Parse(`<domain type='kvm'>
+  <name>{{ .Name }}</name>
+  <memory unit='MiB'>{{ .Memory }}</memory>
+  <vcpu>{{ .VCPUs }}</vcpu>
+  <os>
+    <type arch='x86_64'>hvm</type>
+    <boot dev='network'/>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+  <cpu mode='host-passthrough'/>
+  <devices>
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source pool='{{ .Pool }}' volume='{{ .Volume }}'/>
+      <target dev='sda' bus='sata'/>
+    </disk>
+    <interface type='bridge'>
+      <mac address='{{ .MAC }}'/>
+      <source bridge='{{ .Bridge }}'/>
+      <model type='virtio'/>
+    </interface>
+    <serial type='pty'/>
+    <console type='pty'/>
+    <graphics type='vnc' listen='127.0.0.1'/>
+  </devices>
+</domain>
+`))
+
+type virsh struct {
+	uri string
+}
+
+func (v virsh) run(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("virsh", append([]string{"--connect", v.uri}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("virsh %s failed: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// domains returns the VMs named <prefix>-<n> by n.
+func (v virsh) domains(prefix string) (map[int]string, error) {
+	out, err := v.run("list", "--all", "--name")
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[int]string)
+	for _, name := range strings.Fields(out) {
+		if !strings.HasPrefix(name, prefix+"-") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, prefix+"-")); err == nil && n > 0 {
+			domains[n] = name
+		}
+	}
+	return domains, nil
+}
+
+// vmMAC returns a random MAC with the QEMU OUI, which machine classes
+// and node pools can match the VMs by.
+func vmMAC() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return net.HardwareAddr{0x52, 0x54, 0x00, b[0], b[1], b[2]}.String(), nil
+}
+
+// runVM creates, lists and deletes the VMs of a virtual test cluster.
+func runVM(args []string) error {
+	flags := flag.NewFlagSet("vm", flag.ExitOnError)
+	connectFlag := flags.String("connect", "qemu:///system", "libvirt connection URI")
+	prefixFlag := flags.String("prefix", "talos-pxe", "Name prefix of the VMs")
+	bridgeFlag := flags.String("bridge", "virbr0", "Bridge the server serves on, which the VMs are attached to")
+	memoryFlag := flags.Int("memory", 4096, "Memory of every VM in MiB, with create")
+	vcpusFlag := flags.Int("vcpus", 2, "Virtual CPUs of every VM, with create")
+	diskSizeFlag := flags.String("disk-size", "20G", "Disk size of every VM, with create")
+	poolFlag := flags.String("pool", "default", "libvirt storage pool the disks are created in, with create")
+	noStartFlag := flags.Bool("no-start", false, "Only define the VMs, with create")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("Usage: %s vm create N|list|delete [flags]", os.Args[0])
+	if flags.NArg() < 1 {
+		return usage
+	}
+	if !vmPrefixRegexp.MatchString(*prefixFlag) {
+		return fmt.Errorf("Invalid VM name prefix %q", *prefixFlag)
+	}
+	v := virsh{uri: *connectFlag}
+
+	switch flags.Arg(0) {
+	case "create":
+		if flags.NArg() != 2 {
+			return usage
+		}
+		count, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || count < 1 {
+			return fmt.Errorf("Invalid number of VMs %q", flags.Arg(1))
+		}
+		if *memoryFlag < 2048 {
+			return fmt.Errorf("Talos needs at least 2048 MiB of memory")
+		}
+		return v.createVMs(*prefixFlag, count, vmDomain{
+			Memory: *memoryFlag,
+			VCPUs:  *vcpusFlag,
+			Pool:   *poolFlag,
+			Bridge: *bridgeFlag,
+		}, *diskSizeFlag, !*noStartFlag)
+	case "list":
+		return v.listVMs(*prefixFlag)
+	case "delete":
+		return v.deleteVMs(*prefixFlag, flags.Args()[1:])
+	default:
+		return usage
+	}
+}
+
+// createVMs creates count VMs after the ones there already.
+func (v virsh) createVMs(prefix string, count int, domain vmDomain, diskSize string, start bool) error {
+	existing, err := v.domains(prefix)
+	if err != nil {
+		return err
+	}
+	next := 1
+	for n := range existing {
+		if n >= next {
+			next = n + 1
+		}
+	}
+
+	for n := next; n < next+count; n++ {
+		d := domain
+		d.Name = fmt.Sprintf("%s-%d", prefix, n)
+		d.Volume = d.Name + ".qcow2"
+		if d.MAC, err = vmMAC(); err != nil {
+			return err
+		}
+
+		if _, err := v.run("vol-create-as", d.Pool, d.Volume, diskSize, "--format", "qcow2"); err != nil {
+			return err
+		}
+		if err := v.define(d); err != nil {
+			v.run("vol-delete", "--pool", d.Pool, d.Volume)
+			return err
+		}
+		if start {
+			if _, err := v.run("start", d.Name); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%s\t%s\n", d.Name, d.MAC)
+	}
+	return nil
+}
+
+func (v virsh) define(d vmDomain) error {
+	f, err := ioutil.TempFile("", "talos-pxe-vm-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := vmDomainTemplate.Execute(f, d); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_, err = v.run("define", f.Name())
+	return err
+}
+
+func (v virsh) listVMs(prefix string) error {
+	domains, err := v.domains(prefix)
+	if err != nil {
+		return err
+	}
+	var ns []int
+	for n := range domains {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+
+	for _, n := range ns {
+		name := domains[n]
+		state, err := v.run("domstate", name)
+		if err != nil {
+			return err
+		}
+		var mac string
+		out, err := v.run("domiflist", name)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if fields := strings.Fields(line); len(fields) == 5 {
+				if _, err := net.ParseMAC(fields[4]); err == nil {
+					mac = fields[4]
+				}
+			}
+		}
+		fmt.Printf("%s\t%s\t%s\n", name, mac, strings.TrimSpace(state))
+	}
+	return nil
+}
+
+// deleteVMs destroys and undefines the VMs, all of them unless named,
+// removing their disks.
+func (v virsh) deleteVMs(prefix string, names []string) error {
+	domains, err := v.domains(prefix)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		for _, name := range domains {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	known := make(map[string]bool)
+	for _, name := range domains {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("%s isn't one of the VMs named %s-<n>", name, prefix)
+		}
+	}
+
+	for _, name := range names {
+		if state, err := v.run("domstate", name); err != nil {
+			return err
+		} else if strings.TrimSpace(state) != "shut off" {
+			if _, err := v.run("destroy", name); err != nil {
+				return err
+			}
+		}
+		if _, err := v.run("undefine", name, "--remove-all-storage"); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/libcontainer/netlink"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Edge sites reach the central asset cache, config repository and webhook
+// receivers through a WireGuard tunnel to a hub. The interface is set up
+// with netlink and configured with wg(8) from wireguard-tools; the private
+// key is generated once and kept in the secrets store.
+
+const (
+	wireGuardKeySecret       = "wireguard-key"
+	wireGuardDefaultIf       = "wg0"
+	wireGuardKeepalive       = 25
+	wireGuardCheckInterval   = 30 * time.Second
+	wireGuardHandshakeMaxAge = 3 * time.Minute
+)
+
+// WireGuardConfig describes the tunnel to the hub.
+type WireGuardConfig struct {
+	Interface  string        `json:"interface,omitempty"`
+	Address    string        `json:"address"`
+	ListenPort int           `json:"listenPort,omitempty"`
+	Peer       WireGuardPeer `json:"peer"`
+}
+
+type WireGuardPeer struct {
+	PublicKey           string   `json:"publicKey"`
+	Endpoint            string   `json:"endpoint"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive int      `json:"persistentKeepalive,omitempty"`
+}
+
+func (wg *WireGuardConfig) check() error {
+	if wg.Interface == "" {
+		wg.Interface = wireGuardDefaultIf
+	}
+	if wg.Peer.PersistentKeepalive == 0 {
+		wg.Peer.PersistentKeepalive = wireGuardKeepalive
+	}
+
+	if _, _, err := net.ParseCIDR(wg.Address); err != nil {
+		return fmt.Errorf("invalid address: %s", err)
+	}
+	if key, err := base64.StdEncoding.DecodeString(wg.Peer.PublicKey); err != nil || len(key) != curve25519.PointSize {
+		return fmt.Errorf("invalid peer public key")
+	}
+	if _, _, err := net.SplitHostPort(wg.Peer.Endpoint); err != nil {
+		return fmt.Errorf("invalid peer endpoint: %s", err)
+	}
+	for _, allowed := range wg.Peer.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil {
+			return fmt.Errorf("invalid allowed IPs: %s", err)
+		}
+	}
+	return nil
+}
+
+func wgCommand(stdin []byte, args ...string) error {
+	cmd := exec.Command("wg", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("wg %s: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setPeer (re)configures the hub as the peer, which also resolves its
+// endpoint again.
+func (wg *WireGuardConfig) setPeer() error {
+	return wgCommand(nil, "set", wg.Interface,
+		"peer", wg.Peer.PublicKey,
+		"endpoint", wg.Peer.Endpoint,
+		"allowed-ips", strings.Join(wg.Peer.AllowedIPs, ","),
+		"persistent-keepalive", strconv.Itoa(wg.Peer.PersistentKeepalive))
+}
+
+// setupWireGuard brings up the tunnel and routes the allowed IPs through
+// it.
+func (s *Server) setupWireGuard() error {
+	wg := s.Config.WireGuard
+
+	store, err := s.secretsStore()
+	if err != nil {
+		return err
+	}
+	key, err := store.GetOrCreate(wireGuardKeySecret, curve25519.ScalarSize)
+	if err != nil {
+		return err
+	}
+	public, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	if _, err := net.InterfaceByName(wg.Interface); err != nil {
+		if err := netlink.NetworkLinkAdd(wg.Interface, "wireguard"); err != nil {
+			return fmt.Errorf("Could not create WireGuard interface %s: %s", wg.Interface, err)
+		}
+	}
+	ifc, err := net.InterfaceByName(wg.Interface)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"set", wg.Interface, "private-key", "/dev/stdin"}
+	if wg.ListenPort != 0 {
+		args = append(args, "listen-port", strconv.Itoa(wg.ListenPort))
+	}
+	if err := wgCommand([]byte(base64.StdEncoding.EncodeToString(key)), args...); err != nil {
+		return err
+	}
+	if err := wg.setPeer(); err != nil {
+		return err
+	}
+
+	ip, ipNet, _ := net.ParseCIDR(wg.Address)
+	if err := netlink.NetworkLinkAddIp(ifc, ip, ipNet); err != nil && !isErrno(err, syscall.EEXIST) {
+		return fmt.Errorf("Could not set address of %s: %s", wg.Interface, err)
+	}
+	if err := netlink.NetworkLinkUp(ifc); err != nil {
+		return err
+	}
+
+	for _, allowed := range wg.Peer.AllowedIPs {
+		if err := netlink.AddRoute(allowed, "", "", wg.Interface); err != nil && !isErrno(err, syscall.EEXIST) {
+			return fmt.Errorf("Could not route %s through %s: %s", allowed, wg.Interface, err)
+		}
+	}
+
+	log.Infof("WireGuard tunnel %s to %s is up, the public key of this site is %s",
+		wg.Interface, wg.Peer.Endpoint, base64.StdEncoding.EncodeToString(public))
+
+	return nil
+}
+
+// latestHandshake returns when the last handshake with the hub happened,
+// zero if there was none yet.
+func (wg *WireGuardConfig) latestHandshake() (time.Time, error) {
+	out, err := exec.Command("wg", "show", wg.Interface, "latest-handshakes").Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != wg.Peer.PublicKey {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || sec == 0 {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, nil
+}
+
+// monitorWireGuard warns when the tunnel is down and reconfigures the
+// peer, in case the hub moved to another address. It never returns.
+func (s *Server) monitorWireGuard() {
+	wg := s.Config.WireGuard
+	up := true
+
+	for {
+		time.Sleep(wireGuardCheckInterval)
+
+		last, err := wg.latestHandshake()
+		if err != nil {
+			log.Errorf("Could not check WireGuard tunnel %s: %s", wg.Interface, err)
+			continue
+		}
+
+		if !last.IsZero() && time.Since(last) < wireGuardHandshakeMaxAge {
+			if !up {
+				log.Infof("WireGuard tunnel %s to %s is back up", wg.Interface, wg.Peer.Endpoint)
+			}
+			up = true
+			continue
+		}
+
+		if up {
+			log.Warnf("WireGuard tunnel %s to %s is down, last handshake %s", wg.Interface, wg.Peer.Endpoint, last)
+		}
+		up = false
+
+		if err := wg.setPeer(); err != nil {
+			log.Errorf("Could not reconfigure WireGuard peer: %s", err)
+		}
+	}
+}